@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AdjustmentType tells whether a discount or a penalty is a fixed amount
+// or a percentage of what it applies to
+type AdjustmentType string
+
+const (
+	AdjustmentFixed   AdjustmentType = "fixed"
+	AdjustmentPercent AdjustmentType = "percent"
+)
+
+var ErrDiscountExceedsSubtotal = errors.New("discount can't exceed the subtotal")
+
+// Valid reports whether the type is known, empty means fixed
+func (t AdjustmentType) Valid() bool {
+	return t == "" || t == AdjustmentFixed || t == AdjustmentPercent
+}
+
+// amount is the adjustment of value applied to base. The value is kept as
+// Money either way, a fixed amount in cents or a percentage with its 2
+// decimals, 12.5% being 12.50.
+func (t AdjustmentType) amount(value Money, base Money) Money {
+	if t == AdjustmentPercent {
+		return base.Percent(value.Float())
+	}
+	return value
+}
+
+// validateAdjustment checks a discount or penalty value against its type
+func validateAdjustment(name string, value Money, adjustmentType AdjustmentType) error {
+	if !adjustmentType.Valid() {
+		return fmt.Errorf("Invalid %s type %q, expected %q or %q", name, adjustmentType, AdjustmentFixed, AdjustmentPercent)
+	}
+	if value < 0 {
+		return fmt.Errorf("%s can't be negative", name)
+	}
+	if adjustmentType == AdjustmentPercent && value > moneyFromFloat(100) {
+		return fmt.Errorf("%s can't exceed 100%%", name)
+	}
+	return nil
+}
+
+// Gross is the line amount before its discount
+func (il *InvoiceLine) Gross() Money {
+	return il.UnitPrice.Times(il.Quantity)
+}
+
+// DiscountAmount is what the line discount takes off the line
+func (il *InvoiceLine) DiscountAmount() Money {
+	return il.DiscountType.amount(il.Discount, il.Gross())
+}
+
+// NetUnitPrice is the unit price once the line discount is spread over
+// the quantity
+func (il *InvoiceLine) NetUnitPrice() Money {
+	if thousandths(il.Quantity) == 0 {
+		return il.UnitPrice
+	}
+	return il.Total().Per(il.Quantity)
+}
+
+// DiscountAmount is what the invoice discount takes off the subtotal
+func (i *Invoice) DiscountAmount() Money {
+	return i.DiscountType.amount(i.Discount, i.SubTotal())
+}
+
+// PenaltyAmount is what the invoice penalty adds, percentages apply to the
+// subtotal after the discount
+func (i *Invoice) PenaltyAmount() Money {
+	return i.PenaltyType.amount(i.Penalty, i.SubTotal()-i.DiscountAmount())
+}
+
+// checkAdjustments fills in the adjustment types and makes sure no discount
+// exceeds what it applies to, once the line prices are known
+func (i *Invoice) checkAdjustments() error {
+	if i.DiscountType == "" {
+		i.DiscountType = AdjustmentFixed
+	}
+	if i.PenaltyType == "" {
+		i.PenaltyType = AdjustmentFixed
+	}
+	for index := range i.InvoiceLines {
+		line := &i.InvoiceLines[index]
+		if line.DiscountType == "" {
+			line.DiscountType = AdjustmentFixed
+		}
+		if line.DiscountAmount() > line.Gross() {
+			return fmt.Errorf("line %d: %w", index+1, ErrDiscountExceedsSubtotal)
+		}
+	}
+	if i.DiscountAmount() > i.SubTotal() {
+		return ErrDiscountExceedsSubtotal
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// clientArchive writes the whole history of a client in a zip, for handing
+// it over when the client leaves or for a dispute:
+//
+//	company.json
+//	statement.json, statement.pdf   every invoice and payment with the balance
+//	invoices.json, invoices/*.pdf   the documents billed to the client
+//	payments.json
+//	notes.json                      the timelines of the invoices
+//	emails.json                     the emails sent to the client
+//	attachments/*                   the files stored for the client
+type clientArchive struct {
+	writer *zip.Writer
+}
+
+func (a *clientArchive) add(name string, data []byte) error {
+	file, err := a.writer.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+func (a *clientArchive) addJSON(name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return a.add(name, data)
+}
+
+// buildClientArchive collects the history of the client into a zip file
+func buildClientArchive(store Store, clientID uint) ([]byte, error) {
+	company, err := store.GetCompany(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	archive := &clientArchive{writer: zip.NewWriter(&buf)}
+	if err := archive.addJSON("company.json", company); err != nil {
+		return nil, err
+	}
+
+	statement, err := store.GetStatement(clientID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.addJSON("statement.json", statement); err != nil {
+		return nil, err
+	}
+	if err := archive.add("statement.pdf", statement.PDF()); err != nil {
+		return nil, err
+	}
+
+	clientInvoices, err := store.GetClientInvoices(clientID)
+	if err != nil {
+		return nil, err
+	}
+	invoices := []Invoice{}
+	notes := []InvoiceEvent{}
+	for _, clientInvoice := range clientInvoices {
+		// The listing doesn't load what the printed document shows
+		invoice, err := store.GetInvoice(clientInvoice.ID)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, *invoice)
+		if err := archive.add(fmt.Sprintf("invoices/%d_%s.pdf", invoice.ID, invoice.Repr()), invoice.PDF().Bytes()); err != nil {
+			return nil, err
+		}
+
+		events, err := store.GetInvoiceEvents(invoice.ID)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, events...)
+	}
+	if err := archive.addJSON("invoices.json", invoices); err != nil {
+		return nil, err
+	}
+	if err := archive.addJSON("notes.json", notes); err != nil {
+		return nil, err
+	}
+
+	payments, err := store.GetClientPayments(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.addJSON("payments.json", payments); err != nil {
+		return nil, err
+	}
+
+	emails, err := store.GetCompanyEmailMessages(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.addJSON("emails.json", emails); err != nil {
+		return nil, err
+	}
+
+	attachments, err := store.GetCompanyAttachments(clientID)
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		data, err := attachment.Read()
+		if err != nil {
+			return nil, err
+		}
+		// Prefixed with the ID, the same name may be uploaded twice
+		if err := archive.add(fmt.Sprintf("attachments/%d_%s", attachment.ID, path.Base(attachment.Filename)), data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *Handler) getClientArchive(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	company, err := store.GetCompany(uint(companyId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := buildClientArchive(store, company.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	filename := strings.ReplaceAll(company.Name, " ", "") + "_archive.zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(data)
+}
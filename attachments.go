@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxLogoSize = 2 << 20 // 2 MiB
+
+var logoContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var ErrUnsupportedLogo = errors.New("logo must be a PNG, JPEG, GIF or WebP image")
+
+var ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+// Attachment is an uploaded file kept in the file storage, the attachments
+// directory or an S3 bucket, the database only keeps its metadata. Files are
+// stored under the SHA-256 of their content so identical uploads share one
+// copy.
+type Attachment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UUID        uuid.UUID `gorm:"type:text;uniqueIndex" json:"uuid"`
+	CompanyID   *uint     `gorm:"index" json:"company_id"`
+	Filename    string    `gorm:"size:255;not null" json:"filename"`
+	ContentType string    `gorm:"size:100;not null" json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `gorm:"column:sha256;size:64;index" json:"sha256"`
+	// InboundEmailID is the email received the file was attached to
+	InboundEmailID *uint         `gorm:"index" json:"inbound_email_id"`
+	InboundEmail   *InboundEmail `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	CreatedAt      time.Time     `json:"created_at"`
+}
+
+// Read loads the stored file
+func (a *Attachment) Read() ([]byte, error) {
+	return fileStorage.Get(a.contentKey())
+}
+
+// DataURI inlines the file so rendered documents don't depend on
+// authenticated endpoints to show it
+func (a *Attachment) DataURI() (template.URL, error) {
+	data, err := a.Read()
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:" + a.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// CreateAttachment records the file for the company owning it, putting it
+// in the file storage unless the same content is already there. Companies can't go over
+// their storage quota.
+func (r *Repository) CreateAttachment(companyID *uint, filename, contentType string, data []byte) (*Attachment, error) {
+	return r.createAttachment(companyID, filename, contentType, data, nil)
+}
+
+// createAttachment leaves the attachment being replaced out of the quota
+func (r *Repository) createAttachment(companyID *uint, filename, contentType string, data []byte, replacing *uint) (*Attachment, error) {
+	sum := sha256.Sum256(data)
+	attachment := &Attachment{
+		UUID:        uuid.New(),
+		CompanyID:   companyID,
+		Filename:    filepath.Base(filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+
+	if companyID != nil {
+		if err := r.checkStorageQuota(*companyID, attachment, replacing); err != nil {
+			return nil, err
+		}
+	}
+
+	stored, err := fileStorage.Exists(attachment.contentKey())
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		if err := fileStorage.Put(attachment.contentKey(), data); err != nil {
+			return nil, err
+		}
+	}
+
+	err = retryOnBusy(func() error {
+		return r.db.Create(attachment).Error
+	})
+	if err != nil {
+		if !stored {
+			fileStorage.Delete(attachment.contentKey())
+		}
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func (r *Repository) GetAttachment(id uint) (*Attachment, error) {
+	var attachment Attachment
+	err := r.db.First(&attachment, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// GetCompanyAttachments returns every file stored for the company
+func (r *Repository) GetCompanyAttachments(companyID uint) ([]Attachment, error) {
+	var attachments []Attachment
+	err := r.db.Where("company_id = ?", companyID).Order("id").Find(&attachments).Error
+	return attachments, err
+}
+
+func (r *Repository) DeleteAttachment(id uint) error {
+	attachment, err := r.GetAttachment(id)
+	if err != nil {
+		return err
+	}
+
+	err = retryOnBusy(func() error {
+		return r.db.Delete(attachment).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Keep the file while other attachments share its content
+	if attachment.SHA256 != "" {
+		var shared int64
+		if err := r.db.Model(&Attachment{}).Where("sha256 = ?", attachment.SHA256).Count(&shared).Error; err != nil {
+			return err
+		}
+		if shared > 0 {
+			return nil
+		}
+	}
+	return fileStorage.Delete(attachment.contentKey())
+}
+
+// SetCompanyLogo stores the image and points the company at it, removing
+// the previous logo
+func (r *Repository) SetCompanyLogo(companyID uint, filename string, data []byte) (*Attachment, error) {
+	contentType := http.DetectContentType(data)
+	if !logoContentTypes[contentType] {
+		return nil, ErrUnsupportedLogo
+	}
+
+	company, err := r.GetCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The logo being replaced doesn't count against the quota
+	logo, err := r.createAttachment(&companyID, filename, contentType, data, company.LogoID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retryOnBusy(func() error {
+		return r.db.Model(&Company{}).Where("id = ?", companyID).Update("logo_id", logo.ID).Error
+	})
+	if err != nil {
+		r.DeleteAttachment(logo.ID)
+		return nil, err
+	}
+
+	if company.LogoID != nil {
+		r.DeleteAttachment(*company.LogoID)
+	}
+	return logo, nil
+}
+
+func (r *Repository) RemoveCompanyLogo(companyID uint) error {
+	company, err := r.GetCompany(companyID)
+	if err != nil {
+		return err
+	}
+	if company.LogoID == nil {
+		return nil
+	}
+
+	err = retryOnBusy(func() error {
+		return r.db.Model(&Company{}).Where("id = ?", companyID).Update("logo_id", nil).Error
+	})
+	if err != nil {
+		return err
+	}
+	return r.DeleteAttachment(*company.LogoID)
+}
+
+// companyPDFLogo returns the company's logo to embed in PDFs, nil when it
+// has none or it can't be read
+func companyPDFLogo(company *Company) *PDFImage {
+	if company.Logo == nil {
+		return nil
+	}
+
+	data, err := company.Logo.Read()
+	if err != nil {
+		return nil
+	}
+	logo, err := NewPDFImage(data)
+	if err != nil {
+		return nil
+	}
+	return logo
+}
+
+// companyLogo returns the company's logo as a data URI, empty when it has none
+func companyLogo(company *Company) template.URL {
+	if company.Logo == nil {
+		return ""
+	}
+
+	logo, err := company.Logo.DataURI()
+	if err != nil {
+		return ""
+	}
+	return logo
+}
+
+func (h *Handler) uploadCompanyLogo(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLogoSize+1024)
+	file, header, err := r.FormFile("logo")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxLogoSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxLogoSize {
+		http.Error(w, "Logo must be at most 2 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	logo, err := h.storeFor(r).SetCompanyLogo(uint(companyId), header.Filename, data)
+	if err != nil {
+		writeAttachmentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(logo)
+}
+
+func (h *Handler) getCompanyLogo(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	company, err := h.storeFor(r).GetCompany(uint(companyId))
+	if err != nil || company.Logo == nil {
+		http.Error(w, "Logo not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := company.Logo.Read()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", company.Logo.ContentType)
+	w.Write(data)
+}
+
+func (h *Handler) deleteCompanyLogo(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).RemoveCompanyLogo(uint(companyId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
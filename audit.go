@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Audit actions
+const (
+	AuditLoginFailed            = "login_failed"
+	AuditAccountLocked          = "account_locked"
+	AuditPasswordResetRequested = "password_reset_requested"
+	AuditPasswordReset          = "password_reset"
+	AuditPasswordResetForced    = "password_reset_forced"
+)
+
+// AuditEvent records something security relevant that happened to an
+// account. Username is kept as given, the account may not exist.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    *uint     `gorm:"index" json:"user_id"`
+	User      *User     `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	Username  string    `gorm:"size:255;not null;index" json:"username"`
+	Action    string    `gorm:"size:50;not null;index" json:"action"`
+	Detail    string    `gorm:"size:255" json:"detail"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// AuditFilter narrows the audit log, empty fields match everything
+type AuditFilter struct {
+	Username string
+	Action   string
+}
+
+// recordAuditEvent adds the event to the audit log within the transaction
+func recordAuditEvent(tx *gorm.DB, user *User, username, action, detail string) error {
+	event := &AuditEvent{Username: username, Action: action, Detail: detail}
+	if user != nil {
+		event.UserID = &user.ID
+		event.Username = user.Username
+	}
+	return tx.Create(event).Error
+}
+
+// GetAuditEvents returns the latest events first
+func (r *Repository) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	query := r.db.Order("created_at DESC, id DESC").Limit(500)
+	if filter.Username != "" {
+		query = query.Where("username = ?", filter.Username)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	var events []AuditEvent
+	err := query.Find(&events).Error
+	return events, err
+}
+
+func (h *Handler) getAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter := AuditFilter{
+		Username: r.URL.Query().Get("username"),
+		Action:   r.URL.Query().Get("action"),
+	}
+
+	events, err := h.storeFor(r).GetAuditEvents(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -1,44 +1,134 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-// basicAuthMiddleware wraps HTTP handlers with basic authentication
-func basicAuthMiddleware(next http.HandlerFunc, testing bool) http.HandlerFunc {
+// basicAuthMiddleware wraps HTTP handlers with basic authentication, or
+// the session of a user signed in with OpenID Connect. Client users only
+// have the portal.
+func (h *Handler) basicAuthMiddleware(next http.HandlerFunc, testing bool) http.HandlerFunc {
+	next = debugSQLMiddleware(next, testing)
+	next = issuedOverrideMiddleware(next, testing)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if testing {
+		if testing || h.noAuth {
 			next(w, r)
 			return
 		}
 
-		username, password, ok := r.BasicAuth()
+		user, ok := h.signedInUser(w, r)
 		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Tiny CRM"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-
-		// Get user from database
-		user, err := repo.GetUserByUsername(username)
-		if err != nil {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Tiny CRM"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if user.CompanyID != nil {
+			http.Error(w, "Client users only have the portal, see "+publicURL("/portal"), http.StatusForbidden)
 			return
 		}
 
-		// Check password
-		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		// Authentication successful, call the next handler
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	}
+}
+
+// signedInUser returns the user of the session or of the basic
+// authentication credentials, answering the request when there is none
+func (h *Handler) signedInUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if user := h.sessionUser(r); user != nil {
+		return user, true
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		// Browsers of OpenID Connect users would prompt for a password
+		if h.oidc == nil {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Tiny CRM"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
 		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
 
-		// Authentication successful, call the next handler
+	user, err := authenticatedUser(h.storeFor(r), username, password, time.Now())
+	switch {
+	case errors.Is(err, ErrAccountLocked):
+		h.recordFailedLogin(r, username, err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*user.LockedUntil).Seconds())+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, false
+	case errors.Is(err, ErrPasswordResetRequired):
+		http.Error(w, "Password reset required, see "+publicURL("/auth/password_reset"), http.StatusForbidden)
+		return nil, false
+	case err != nil:
+		h.recordFailedLogin(r, username, err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="Tiny CRM"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return user, true
+}
+
+// adminMiddleware lets only administrators through basicAuthMiddleware
+func (h *Handler) adminMiddleware(next http.HandlerFunc, testing bool) http.HandlerFunc {
+	return h.basicAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := r.Context().Value(userContextKey{}).(*User); !testing && !h.noAuth && (!ok || !user.IsAdmin) {
+			http.Error(w, "Administrators only", http.StatusForbidden)
+			return
+		}
 		next(w, r)
+	}, testing)
+}
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// authenticate checks the credentials against the stored users
+func authenticate(store Store, username, password string) bool {
+	_, err := authenticatedUser(store, username, password, time.Now())
+	return err == nil
+}
+
+// authenticatedUser returns the user matching the credentials. Wrong
+// passwords count towards locking the account, a locked account is
+// returned along with ErrAccountLocked whatever the password. The count
+// is written after the unit of work, which a failed login rolls back.
+func authenticatedUser(store Store, username, password string, now time.Time) (*User, error) {
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		recordLoginFailure(store, username, now)
+		return nil, ErrInvalidCredentials
 	}
+	if user.Locked(now) {
+		return user, ErrAccountLocked
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		recordLoginFailure(store, username, now)
+		return nil, ErrInvalidCredentials
+	}
+	if user.FailedLogins > 0 {
+		store.AfterUnitOfWork(func(store Store) {
+			if err := store.RecordLoginSuccess(user.ID); err != nil {
+				log.Printf("Error clearing failed logins: %v", err)
+			}
+		})
+	}
+	if user.MustResetPassword {
+		return user, ErrPasswordResetRequired
+	}
+	return user, nil
+}
+
+// recordLoginFailure counts the wrong password towards locking the account
+func recordLoginFailure(store Store, username string, now time.Time) {
+	store.AfterUnitOfWork(func(store Store) {
+		if err := store.RecordLoginFailure(username, now); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+	})
 }
 
 // hashPassword creates a bcrypt hash of the password
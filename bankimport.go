@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidStatement is returned for bank statements that can't be read
+// as OFX or CSV
+var ErrInvalidStatement = errors.New("invalid bank statement")
+
+// ErrTransactionMatched is returned when assigning a transaction already
+// recorded as a payment
+var ErrTransactionMatched = errors.New("transaction is already recorded as a payment")
+
+// maxBankStatementSize caps the bank statements imported
+const maxBankStatementSize = 10 << 20
+
+// BankTransaction is money received on the bank account, read from an
+// imported statement or polled from the bank. It is matched with an open
+// invoice by recording a payment, the ones no invoice was found for wait to
+// be assigned one. Deleting the payment brings the transaction back
+// unmatched.
+type BankTransaction struct {
+	ID uint `gorm:"primaryKey" json:"id"`
+	// ExternalID keeps a transaction imported twice from being recorded
+	// twice: the bank's ID, or else a hash of the transaction
+	ExternalID string    `gorm:"size:255;not null;uniqueIndex" json:"external_id"`
+	Date       time.Time `gorm:"not null;index" json:"date"`
+	Amount     Money     `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Payer      string    `gorm:"size:255" json:"payer"`
+	Reference  string    `gorm:"size:255" json:"reference"`
+	PaymentID  *uint     `gorm:"index" json:"payment_id"`
+	Payment    *Payment  `gorm:"constraint:OnDelete:SET NULL" json:"payment,omitempty"`
+	ImportedAt time.Time `gorm:"not null" json:"imported_at"`
+	// Source is where the transaction comes from, a statement or the bank
+	// connector
+	Source string `gorm:"size:20;not null;default:statement" json:"source"`
+	// ReviewedAt is when a matched transaction was confirmed, or assigned
+	// by hand. Automatic matches wait for review until then.
+	ReviewedAt *time.Time `json:"reviewed_at"`
+	// Candidates are the open invoices an unmatched transaction could pay,
+	// none of them certain
+	Candidates []uint `gorm:"-" json:"candidates,omitempty"`
+}
+
+const (
+	BankSourceStatement = "statement"
+	BankSourcePix       = "pix"
+)
+
+type BankTransactionFilter struct {
+	// Unmatched lists only the transactions no invoice was found for
+	Unmatched bool
+	// Unreviewed lists only the matches waiting for review
+	Unreviewed bool
+}
+
+// BankImport reports an imported statement: the transactions matched with
+// an invoice and the ones left to assign. Duplicates were imported before
+// and Ignored are the money paid out of the account.
+type BankImport struct {
+	Imported   int               `json:"imported"`
+	Duplicates int               `json:"duplicates"`
+	Ignored    int               `json:"ignored"`
+	Matched    []BankTransaction `json:"matched"`
+	Unmatched  []BankTransaction `json:"unmatched"`
+}
+
+// parseBankStatement reads the transactions of an OFX or CSV statement
+func parseBankStatement(data []byte) ([]BankTransaction, error) {
+	if bytes.Contains(bytes.ToUpper(data), []byte("<STMTTRN>")) {
+		return parseOFX(data)
+	}
+	return parseBankCSV(data)
+}
+
+var ofxTransaction = regexp.MustCompile(`(?is)<STMTTRN>(.*?)</STMTTRN>`)
+
+// ofxField reads a field of an OFX transaction, closed or not as SGML
+// allows
+func ofxField(transaction, name string) string {
+	field := regexp.MustCompile(`(?i)<` + name + `>([^<\r\n]*)`).FindStringSubmatch(transaction)
+	if field == nil {
+		return ""
+	}
+	return strings.TrimSpace(field[1])
+}
+
+// parseOFX reads the transactions of an OFX statement, SGML or XML
+func parseOFX(data []byte) ([]BankTransaction, error) {
+	var transactions []BankTransaction
+	for _, block := range ofxTransaction.FindAllStringSubmatch(string(data), -1) {
+		posted := ofxField(block[1], "DTPOSTED")
+		if len(posted) < 8 {
+			return nil, fmt.Errorf("%w: transaction without a date", ErrInvalidStatement)
+		}
+		date, err := time.ParseInLocation("20060102", posted[:8], config.Location())
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid date %q", ErrInvalidStatement, posted)
+		}
+		amount, err := parseMoney(ofxField(block[1], "TRNAMT"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+		}
+		transactions = append(transactions, BankTransaction{
+			ExternalID: ofxField(block[1], "FITID"),
+			Date:       date,
+			Amount:     amount,
+			Payer:      ofxField(block[1], "NAME"),
+			Reference:  ofxField(block[1], "MEMO"),
+		})
+	}
+	if len(transactions) == 0 {
+		return nil, fmt.Errorf("%w: no transactions", ErrInvalidStatement)
+	}
+	return transactions, nil
+}
+
+// bankCSVColumns are the headers each field of a CSV statement is read from
+var bankCSVColumns = map[string][]string{
+	"id":        {"id", "transaction id", "fitid"},
+	"date":      {"date", "posted", "booking date"},
+	"amount":    {"amount", "value"},
+	"payer":     {"payer", "name", "counterparty"},
+	"reference": {"reference", "description", "memo"},
+}
+
+// parseBankAmount reads an amount written with a decimal point, or a decimal
+// comma when there is no point
+func parseBankAmount(text string) (Money, error) {
+	text = strings.ReplaceAll(strings.TrimSpace(text), " ", "")
+	if strings.Contains(text, ".") {
+		text = strings.ReplaceAll(text, ",", "")
+	} else {
+		text = strings.ReplaceAll(text, ",", ".")
+	}
+	return parseMoney(text)
+}
+
+// parseBankCSV reads a CSV statement with a header naming at least the
+// date, as YYYY-MM-DD, and the amount columns
+func parseBankCSV(data []byte) ([]BankTransaction, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil || len(rows) < 2 {
+		return nil, fmt.Errorf("%w: expected OFX or CSV with a header and transactions", ErrInvalidStatement)
+	}
+
+	columns := map[string]int{}
+	for i, header := range rows[0] {
+		header = strings.ToLower(strings.TrimSpace(header))
+		for field, names := range bankCSVColumns {
+			for _, name := range names {
+				if _, ok := columns[field]; !ok && header == name {
+					columns[field] = i
+				}
+			}
+		}
+	}
+	if _, ok := columns["date"]; !ok {
+		return nil, fmt.Errorf("%w: no date column", ErrInvalidStatement)
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, fmt.Errorf("%w: no amount column", ErrInvalidStatement)
+	}
+
+	var transactions []BankTransaction
+	for line, row := range rows[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		date, err := time.ParseInLocation("2006-01-02", field("date"), config.Location())
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: invalid date %q, expected YYYY-MM-DD", ErrInvalidStatement, line+2, field("date"))
+		}
+		amount, err := parseBankAmount(field("amount"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidStatement, line+2, err)
+		}
+		transactions = append(transactions, BankTransaction{
+			ExternalID: field("id"),
+			Date:       date,
+			Amount:     amount,
+			Payer:      field("payer"),
+			Reference:  field("reference"),
+		})
+	}
+	return transactions, nil
+}
+
+// transactionHash identifies a transaction the bank gave no ID
+func transactionHash(transaction *BankTransaction) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s",
+		transaction.Date.Format("2006-01-02"), transaction.Amount, transaction.Payer, transaction.Reference)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// openInvoice is an invoice sent and not paid yet, with what is left to pay
+type openInvoice struct {
+	ID         uint
+	ClientID   uint
+	ClientName string
+	Number     *int
+	Code       string
+	Remaining  Money
+}
+
+func openInvoices(tx *gorm.DB) ([]openInvoice, error) {
+	var invoices []openInvoice
+	err := tx.Table("invoices").
+		Select(`invoices.id, invoices.client_id, clients.name AS client_name, invoices.number, invoices.code,
+			ROUND(invoices.total - COALESCE(payments.paid, 0), 2) AS remaining`).
+		Joins("JOIN companies clients ON clients.id = invoices.client_id").
+		Joins("LEFT JOIN (SELECT invoice_id, SUM(amount) AS paid FROM payments GROUP BY invoice_id) payments ON payments.invoice_id = invoices.id").
+		Where("invoices.type = ? AND NOT invoices.paid AND invoices.cancelled_at IS NULL AND invoices.sent_at IS NOT NULL", DocumentInvoice).
+		Order("invoices.due_date, invoices.id").
+		Scan(&invoices).Error
+	return invoices, err
+}
+
+// referenceTokens splits the words of a transaction, codes like 2024-0012
+// kept whole
+func referenceTokens(text string) map[string]bool {
+	tokens := map[string]bool{}
+	for _, token := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '/'
+	}) {
+		tokens[strings.Trim(token, "-/")] = true
+	}
+	return tokens
+}
+
+// matchTransaction looks for the open invoice the transaction pays: the
+// one its reference names, else the only one of the amount billed to the
+// payer, else the only one of the amount. It returns the candidates when no
+// invoice is certain.
+func matchTransaction(invoices []openInvoice, transaction *BankTransaction) (*openInvoice, []uint) {
+	tokens := referenceTokens(transaction.Reference + " " + transaction.Payer)
+	var referenced, payers, amounts []*openInvoice
+	for i := range invoices {
+		invoice := &invoices[i]
+		if invoice.Remaining <= 0 {
+			continue
+		}
+		if invoice.Code != "" && tokens[strings.ToLower(invoice.Code)] ||
+			invoice.Number != nil && tokens[strconv.Itoa(*invoice.Number)] {
+			referenced = append(referenced, invoice)
+		}
+		if invoice.Remaining != transaction.Amount {
+			continue
+		}
+		amounts = append(amounts, invoice)
+		payer := strings.ToLower(transaction.Payer + " " + transaction.Reference)
+		if invoice.ClientName != "" && strings.Contains(payer, strings.ToLower(invoice.ClientName)) {
+			payers = append(payers, invoice)
+		}
+	}
+
+	for _, candidates := range [][]*openInvoice{referenced, payers, amounts} {
+		if len(candidates) == 1 && candidates[0].Remaining >= transaction.Amount {
+			return candidates[0], nil
+		}
+	}
+	var ids []uint
+	for _, candidates := range [][]*openInvoice{referenced, payers, amounts} {
+		for _, candidate := range candidates {
+			ids = append(ids, candidate.ID)
+		}
+		if len(ids) > 0 {
+			return nil, ids
+		}
+	}
+	return nil, nil
+}
+
+// payWithTransaction records the transaction as a payment of the invoice
+func payWithTransaction(tx *gorm.DB, transaction *BankTransaction, invoiceID uint) error {
+	var reference *string
+	if transaction.Reference != "" {
+		reference = &transaction.Reference
+	}
+	payment := &Payment{InvoiceID: invoiceID, Amount: transaction.Amount, Date: transaction.Date, Reference: reference}
+	if err := createPayment(tx, payment); err != nil {
+		return err
+	}
+	if err := tx.Model(transaction).Update("payment_id", payment.ID).Error; err != nil {
+		return err
+	}
+	transaction.Payment, transaction.PaymentID = payment, &payment.ID
+	return nil
+}
+
+// ImportBankTransactions records the money received of a statement and
+// pays the open invoices the transactions match
+func (r *Repository) ImportBankTransactions(transactions []BankTransaction, now time.Time) (*BankImport, error) {
+	var result *BankImport
+	err := retryOnBusy(func() error {
+		result = &BankImport{Matched: []BankTransaction{}, Unmatched: []BankTransaction{}}
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			invoices, err := openInvoices(tx)
+			if err != nil {
+				return err
+			}
+			for _, transaction := range transactions {
+				if transaction.Amount <= 0 {
+					result.Ignored++
+					continue
+				}
+				if transaction.ExternalID == "" {
+					transaction.ExternalID = transactionHash(&transaction)
+				}
+				var existing int64
+				if err := tx.Model(&BankTransaction{}).Where("external_id = ?", transaction.ExternalID).Count(&existing).Error; err != nil {
+					return err
+				}
+				if existing > 0 {
+					result.Duplicates++
+					continue
+				}
+
+				transaction.ImportedAt, transaction.ReviewedAt = now, nil
+				if transaction.Source == "" {
+					transaction.Source = BankSourceStatement
+				}
+				if err := tx.Create(&transaction).Error; err != nil {
+					return err
+				}
+				result.Imported++
+				invoice, candidates := matchTransaction(invoices, &transaction)
+				if invoice == nil {
+					transaction.Candidates = candidates
+					result.Unmatched = append(result.Unmatched, transaction)
+					continue
+				}
+				if err := payWithTransaction(tx, &transaction, invoice.ID); err != nil {
+					return err
+				}
+				invoice.Remaining -= transaction.Amount
+				result.Matched = append(result.Matched, transaction)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, transaction := range result.Matched {
+		publishEvent(r, EventPaymentRecorded, transaction.Payment)
+	}
+	return result, nil
+}
+
+// GetBankTransactions lists the transactions imported, newest first, the
+// unmatched ones with their candidates
+func (r *Repository) GetBankTransactions(filter BankTransactionFilter) ([]BankTransaction, error) {
+	query := r.db.Preload("Payment").Order("date DESC, id DESC")
+	if filter.Unmatched {
+		query = query.Where("payment_id IS NULL")
+	}
+	if filter.Unreviewed {
+		query = query.Where("payment_id IS NOT NULL AND reviewed_at IS NULL")
+	}
+	var transactions []BankTransaction
+	if err := query.Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+
+	invoices, err := openInvoices(r.db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range transactions {
+		if transactions[i].PaymentID != nil {
+			continue
+		}
+		// An invoice paid since the import can leave a single candidate
+		match, candidates := matchTransaction(invoices, &transactions[i])
+		if match != nil {
+			candidates = []uint{match.ID}
+		}
+		transactions[i].Candidates = candidates
+	}
+	return transactions, nil
+}
+
+// AssignBankTransaction records the unmatched transaction as a payment of
+// the invoice, reviewed
+func (r *Repository) AssignBankTransaction(id, invoiceID uint, now time.Time) (*BankTransaction, error) {
+	var transaction BankTransaction
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&transaction, id).Error; err != nil {
+				return err
+			}
+			if transaction.PaymentID != nil {
+				return ErrTransactionMatched
+			}
+			if err := payWithTransaction(tx, &transaction, invoiceID); err != nil {
+				return err
+			}
+			transaction.ReviewedAt = &now
+			return tx.Model(&transaction).Update("reviewed_at", now).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(r, EventPaymentRecorded, transaction.Payment)
+	return &transaction, nil
+}
+
+// importBankStatement takes an OFX or CSV bank statement and records
+// payments for the transactions matching open invoices
+func (h *Handler) importBankStatement(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBankStatementSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	transactions, err := parseBankStatement(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.storeFor(r).ImportBankTransactions(transactions, clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// getBankTransactions lists the transactions imported, ?unmatched=true the
+// ones left to assign
+func (h *Handler) getBankTransactions(w http.ResponseWriter, r *http.Request) {
+	unmatched, err := parseOptionalBool(r, "unmatched")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transactions, err := h.storeFor(r).GetBankTransactions(BankTransactionFilter{Unmatched: unmatched != nil && *unmatched})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+// assignBankTransaction records an unmatched transaction as a payment of
+// the invoice given
+func (h *Handler) assignBankTransaction(w http.ResponseWriter, r *http.Request) {
+	transactionId, err := strconv.ParseUint(r.PathValue("transactionId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		InvoiceID uint `json:"invoice_id"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if _, err := store.GetInvoice(request.InvoiceID); err != nil {
+		http.Error(w, fmt.Sprintf("Invoice %d not found", request.InvoiceID), http.StatusBadRequest)
+		return
+	}
+	transaction, err := store.AssignBankTransaction(uint(transactionId), request.InvoiceID, clock.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrTransactionMatched):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrDocumentNotPayable):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transaction)
+}
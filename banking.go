@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrBankNotConfigured is returned when polling with no bank API set up
+var ErrBankNotConfigured = errors.New("the bank API is not configured, set BANK_PIX_URL")
+
+// ErrTransactionUnmatched is returned when reviewing a transaction that
+// pays no invoice
+var ErrTransactionUnmatched = errors.New("transaction isn't matched with an invoice")
+
+// BankConnector fetches the transfers received on the bank account
+type BankConnector interface {
+	// IncomingTransfers returns the money received from since until until,
+	// each transfer with an ExternalID that stays the same across polls
+	IncomingTransfers(since, until time.Time) ([]BankTransaction, error)
+}
+
+var bankConnector BankConnector = newPixBankConnector(config.Bank)
+
+// PixBankConnector lists the Pix received through the Pix API Brazilian
+// banks offer, GET /pix of the Banco Central specification. Banks asking
+// for more than a bearer token, or other bank APIs, can be supported by
+// plugging another BankConnector.
+type PixBankConnector struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func newPixBankConnector(c BankConfig) *PixBankConnector {
+	return &PixBankConnector{
+		URL:    strings.TrimSuffix(c.PixURL, "/"),
+		Token:  c.APIToken,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// pixPage is a page of the Pix received
+type pixPage struct {
+	Parametros struct {
+		Paginacao struct {
+			PaginaAtual         int `json:"paginaAtual"`
+			QuantidadeDePaginas int `json:"quantidadeDePaginas"`
+		} `json:"paginacao"`
+	} `json:"parametros"`
+	Pix []struct {
+		EndToEndID  string    `json:"endToEndId"`
+		TxID        string    `json:"txid"`
+		Valor       string    `json:"valor"`
+		Horario     time.Time `json:"horario"`
+		InfoPagador string    `json:"infoPagador"`
+		Pagador     struct {
+			Nome string `json:"nome"`
+		} `json:"pagador"`
+	} `json:"pix"`
+}
+
+func (c *PixBankConnector) IncomingTransfers(since, until time.Time) ([]BankTransaction, error) {
+	if c.URL == "" {
+		return nil, ErrBankNotConfigured
+	}
+
+	var transfers []BankTransaction
+	for page := 0; ; page++ {
+		query := url.Values{
+			"inicio":                   {since.UTC().Format(time.RFC3339)},
+			"fim":                      {until.UTC().Format(time.RFC3339)},
+			"paginacao.paginaAtual":    {strconv.Itoa(page)},
+			"paginacao.itensPorPagina": {"100"},
+		}
+		req, err := http.NewRequest(http.MethodGet, c.URL+"/pix?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+
+		resp, err := c.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, fmt.Errorf("bank API answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		var received pixPage
+		if err := json.Unmarshal(body, &received); err != nil {
+			return nil, fmt.Errorf("reading the Pix received: %w", err)
+		}
+		for _, pix := range received.Pix {
+			amount, err := parseMoney(pix.Valor)
+			if err != nil {
+				return nil, err
+			}
+			// The txid is the charge the payer paid, named after the invoice
+			// when the charge was created for it
+			transfers = append(transfers, BankTransaction{
+				ExternalID: "pix:" + pix.EndToEndID,
+				Date:       pix.Horario.In(config.Location()),
+				Amount:     amount,
+				Payer:      pix.Pagador.Nome,
+				Reference:  strings.TrimSpace(pix.TxID + " " + pix.InfoPagador),
+				Source:     BankSourcePix,
+			})
+		}
+		if page+1 >= received.Parametros.Paginacao.QuantidadeDePaginas {
+			return transfers, nil
+		}
+	}
+}
+
+// BankPoll records a poll of the bank connector. The next poll starts from
+// the end of the last one that succeeded.
+type BankPoll struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	Since    time.Time `gorm:"not null" json:"since"`
+	Until    time.Time `gorm:"not null;index" json:"until"`
+	Imported int       `gorm:"not null" json:"imported"`
+	Matched  int       `gorm:"not null" json:"matched"`
+	Error    string    `gorm:"type:text" json:"error"`
+}
+
+// bankPollOverlap is how far back a poll goes past the previous one, for
+// the transfers the bank lists late. The ones seen before are skipped.
+const bankPollOverlap = time.Hour
+
+// GetLastBankPoll returns the last poll that succeeded, nil when none did
+func (r *Repository) GetLastBankPoll() (*BankPoll, error) {
+	var polls []BankPoll
+	if err := r.db.Where("error = ''").Order("until DESC").Limit(1).Find(&polls).Error; err != nil {
+		return nil, err
+	}
+	if len(polls) == 0 {
+		return nil, nil
+	}
+	return &polls[0], nil
+}
+
+func (r *Repository) RecordBankPoll(poll *BankPoll) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(poll).Error
+	})
+}
+
+// ReviewBankTransaction confirms an automatic match, or rejects it: its
+// payment is deleted and the transaction waits to be assigned
+func (r *Repository) ReviewBankTransaction(id uint, confirm bool, now time.Time) (*BankTransaction, error) {
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var transaction BankTransaction
+			if err := tx.Preload("Payment").First(&transaction, id).Error; err != nil {
+				return err
+			}
+			if transaction.Payment == nil {
+				return ErrTransactionUnmatched
+			}
+			if confirm {
+				return tx.Model(&transaction).Update("reviewed_at", now).Error
+			}
+
+			if err := tx.Model(&transaction).UpdateColumns(map[string]interface{}{"payment_id": nil, "reviewed_at": nil}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(transaction.Payment).Error; err != nil {
+				return err
+			}
+			var invoice Invoice
+			if err := tx.First(&invoice, transaction.Payment.InvoiceID).Error; err != nil {
+				return err
+			}
+			received, err := invoiceReceived(tx, invoice.ID)
+			if err != nil {
+				return err
+			}
+			if received < invoice.TotalAmount && invoice.Paid {
+				return tx.Model(&invoice).Update("paid", false).Error
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	var transaction BankTransaction
+	if err := r.db.Preload("Payment").First(&transaction, id).Error; err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// pollBank imports the transfers the connector received since the last
+// poll, paying the open invoices they match. Failed polls are recorded and
+// retried from the same point.
+func pollBank(store Store, connector BankConnector, now time.Time) (*BankImport, error) {
+	poll := &BankPoll{Since: now.AddDate(0, 0, -7), Until: now}
+	last, err := store.GetLastBankPoll()
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		poll.Since = last.Until.Add(-bankPollOverlap)
+	}
+
+	result, err := func() (*BankImport, error) {
+		transfers, err := connector.IncomingTransfers(poll.Since, poll.Until)
+		if err != nil {
+			return nil, err
+		}
+		return store.ImportBankTransactions(transfers, now)
+	}()
+	if err != nil {
+		poll.Error = err.Error()
+	} else {
+		poll.Imported, poll.Matched = result.Imported, len(result.Matched)
+	}
+	if recordErr := store.RecordBankPoll(poll); recordErr != nil && err == nil {
+		err = recordErr
+	}
+	return result, err
+}
+
+// scheduleBankPolls polls the bank every BANK_POLL_MINUTES, by the clock
+func scheduleBankPolls(store Store) {
+	var polledAt time.Time
+	for range time.Tick(time.Minute) {
+		now := clock.Now()
+		if now.Sub(polledAt) < time.Duration(config.Bank.PollMinutes)*time.Minute {
+			continue
+		}
+		polledAt = now
+		if !claimScheduledRun("bank_poll", time.Duration(config.Bank.PollMinutes)*time.Minute-5*time.Second) {
+			continue
+		}
+		if _, err := pollBank(store, bankConnector, now); err != nil {
+			log.Printf("Error polling the bank: %v", err)
+		}
+	}
+}
+
+// BankReconciliation is what is left to review: the transfers matched
+// automatically and the ones no invoice was found for
+type BankReconciliation struct {
+	LastPoll  *BankPoll         `json:"last_poll"`
+	Matched   []BankTransaction `json:"matched"`
+	Unmatched []BankTransaction `json:"unmatched"`
+}
+
+// postBankPoll polls the bank now instead of waiting for the schedule
+func (h *Handler) postBankPoll(w http.ResponseWriter, r *http.Request) {
+	result, err := pollBank(h.storeFor(r), bankConnector, clock.Now())
+	if err != nil {
+		if errors.Is(err, ErrBankNotConfigured) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) getBankReconciliation(w http.ResponseWriter, r *http.Request) {
+	store := h.storeFor(r)
+	var reconciliation BankReconciliation
+	var err error
+	if reconciliation.LastPoll, err = store.GetLastBankPoll(); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	if reconciliation.Matched, err = store.GetBankTransactions(BankTransactionFilter{Unreviewed: true}); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	if reconciliation.Unmatched, err = store.GetBankTransactions(BankTransactionFilter{Unmatched: true}); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reconciliation)
+}
+
+func (h *Handler) confirmBankTransaction(w http.ResponseWriter, r *http.Request) {
+	h.reviewBankTransaction(w, r, true)
+}
+
+func (h *Handler) rejectBankTransaction(w http.ResponseWriter, r *http.Request) {
+	h.reviewBankTransaction(w, r, false)
+}
+
+func (h *Handler) reviewBankTransaction(w http.ResponseWriter, r *http.Request, confirm bool) {
+	transactionId, err := strconv.ParseUint(r.PathValue("transactionId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	transaction, err := h.storeFor(r).ReviewBankTransaction(uint(transactionId), confirm, clock.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrTransactionUnmatched):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transaction)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BillingRun records that the monthly billing run invoiced a client for a
+// month, so running it again doesn't bill the client twice
+type BillingRun struct {
+	Month    string    `gorm:"size:7;primaryKey" json:"month"`
+	ClientID uint      `gorm:"primaryKey;autoIncrement:false" json:"client_id"`
+	Client   Company   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	RanAt    time.Time `gorm:"not null" json:"ran_at"`
+}
+
+// BillingSummary reports a billing run: the clients and contracts invoiced
+// by it, the ones a previous run already invoiced for the month and the
+// ones that failed, to be retried by running it again
+type BillingSummary struct {
+	Month    string                `json:"month"`
+	Invoiced []ConsolidationResult `json:"invoiced"`
+	Skipped  []ConsolidationResult `json:"skipped"`
+	Failed   []ConsolidationResult `json:"failed"`
+}
+
+const billingMonthLayout = "2006-01"
+
+func (r *Repository) GetBillingRuns(month string) ([]BillingRun, error) {
+	var runs []BillingRun
+	err := r.db.Where("month = ?", month).Order("client_id").Find(&runs).Error
+	return runs, err
+}
+
+func (r *Repository) RecordBillingRun(run *BillingRun) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(run).Error
+	})
+}
+
+// monthInvoiceIDs returns the invoices the deliverables of the client
+// dated in the month went on
+func monthInvoiceIDs(store Store, clientID uint, month time.Time) ([]uint, error) {
+	invoiced := true
+	deliverables, err := store.GetDeliverables(&clientID, &invoiced)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint{}
+	seen := map[uint]bool{}
+	for _, deliverable := range deliverables {
+		if deliverable.Date.Format(billingMonthLayout) == month.Format(billingMonthLayout) && !seen[*deliverable.InvoiceID] {
+			ids = append(ids, *deliverable.InvoiceID)
+			seen[*deliverable.InvoiceID] = true
+		}
+	}
+	return ids, nil
+}
+
+// runBilling invoices the deliverables of the month for every active
+// client billed monthly, each client in a transaction of its own, then the
+// contracts due in the month. Clients a previous run invoiced for the
+// month are skipped.
+func runBilling(store Store, month, now time.Time) (*BillingSummary, error) {
+	month = monthStart(month)
+	summary := &BillingSummary{
+		Month:    month.Format(billingMonthLayout),
+		Invoiced: []ConsolidationResult{},
+		Skipped:  []ConsolidationResult{},
+		Failed:   []ConsolidationResult{},
+	}
+
+	clients, err := store.GetConsolidatingClients()
+	if err != nil {
+		return nil, err
+	}
+	runs, err := store.GetBillingRuns(summary.Month)
+	if err != nil {
+		return nil, err
+	}
+	billed := map[uint]bool{}
+	for _, run := range runs {
+		billed[run.ClientID] = true
+	}
+
+	for _, client := range clients {
+		if client.ArchivedAt != nil {
+			continue
+		}
+		result := ConsolidationResult{ClientID: client.ID, InvoiceIDs: []uint{}}
+		if billed[client.ID] {
+			if result.InvoiceIDs, err = monthInvoiceIDs(store, client.ID, month); err != nil {
+				return nil, err
+			}
+			summary.Skipped = append(summary.Skipped, result)
+			continue
+		}
+
+		invoices, err := store.ConsolidateDeliverables(client.ID, month, now, nil)
+		if err == nil {
+			err = store.RecordBillingRun(&BillingRun{Month: summary.Month, ClientID: client.ID, RanAt: now})
+		}
+		for _, invoice := range invoices {
+			result.InvoiceIDs = append(result.InvoiceIDs, invoice.ID)
+		}
+		if err != nil {
+			// Invoiced deliverables aren't invoiced again, a client whose run
+			// wasn't recorded is retried without being billed twice
+			result.Error = err.Error()
+			summary.Failed = append(summary.Failed, result)
+			continue
+		}
+		summary.Invoiced = append(summary.Invoiced, result)
+	}
+
+	if err := billContracts(store, month, now, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// billContracts invoices the contracts with a period starting in the month,
+// each in a transaction of its own, the ones a previous run invoiced are
+// skipped
+func billContracts(store Store, month, now time.Time, summary *BillingSummary) error {
+	contracts, err := store.GetContracts(ContractFilter{})
+	if err != nil {
+		return err
+	}
+	billings, err := store.GetContractBillings(summary.Month)
+	if err != nil {
+		return err
+	}
+	billed := map[uint]*uint{}
+	for _, billing := range billings {
+		billed[billing.ContractID] = billing.InvoiceID
+	}
+
+	for _, contract := range contracts {
+		if contract.Client.ArchivedAt != nil || !contract.DueIn(month) {
+			continue
+		}
+		result := ConsolidationResult{ClientID: contract.ClientID, ContractID: contract.ID, InvoiceIDs: []uint{}}
+		if invoiceID, ok := billed[contract.ID]; ok {
+			if invoiceID != nil {
+				result.InvoiceIDs = append(result.InvoiceIDs, *invoiceID)
+			}
+			summary.Skipped = append(summary.Skipped, result)
+			continue
+		}
+
+		invoice, err := store.BillContract(&contract, month, now)
+		if err != nil {
+			result.Error = err.Error()
+			summary.Failed = append(summary.Failed, result)
+			continue
+		}
+		result.InvoiceIDs = append(result.InvoiceIDs, invoice.ID)
+		summary.Invoiced = append(summary.Invoiced, result)
+	}
+	return nil
+}
+
+func (h *Handler) postBillingRun(w http.ResponseWriter, r *http.Request) {
+	now := clock.Now()
+	month := monthStart(now).AddDate(0, -1, 0)
+	if value := r.URL.Query().Get("month"); value != "" {
+		var err error
+		if month, err = time.ParseInLocation(billingMonthLayout, value, now.Location()); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid month %q, expected YYYY-MM", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if month.AddDate(0, 1, 0).After(now) {
+		http.Error(w, fmt.Sprintf("Month %s isn't over yet", month.Format(billingMonthLayout)), http.StatusBadRequest)
+		return
+	}
+
+	summary, err := runBilling(h.storeFor(r), month, now)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// builderSearchLimit caps the products offered by the builder search
+const builderSearchLimit = 20
+
+// builderLinesChanged is the HTMX event asking the builder to recompute
+// its totals
+const builderLinesChanged = "linesChanged"
+
+// renderBuilder executes a template of the invoice builder: the page, or
+// one of the fragments HTMX swaps into it
+func renderBuilder(w http.ResponseWriter, name string, data interface{}) {
+	tmplPath := filepath.Join("templates", "builder", "invoice.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error executing template %s of %s: %v", name, tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseFormUint reads an optional ID of the form, zero when missing
+func parseFormUint(r *http.Request, name string) (uint, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return uint(parsed), nil
+}
+
+// parseFormDate reads an optional YYYY-MM-DD date of the form
+func parseFormDate(r *http.Request, name string) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := parseDate(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s date, expected YYYY-MM-DD", name)
+	}
+	return date, nil
+}
+
+// builderInvoice reads the invoice composed in the builder form, its lines
+// being the product_id and quantity fields in order, priced at what the
+// products cost the client on the issue date
+func builderInvoice(store Store, r *http.Request) (*Invoice, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	invoice := &Invoice{DiscountType: AdjustmentType(r.FormValue("discount_type"))}
+	var err error
+	if invoice.CompanyID, err = parseFormUint(r, "company_id"); err != nil {
+		return nil, err
+	}
+	if invoice.ClientID, err = parseFormUint(r, "client_id"); err != nil {
+		return nil, err
+	}
+	if invoice.RemitInformationID, err = parseFormUint(r, "remit_id"); err != nil {
+		return nil, err
+	}
+	if invoice.IssueDate, err = parseFormDate(r, "issue_date"); err != nil {
+		return nil, err
+	}
+	if invoice.DueDate, err = parseFormDate(r, "due_date"); err != nil {
+		return nil, err
+	}
+	if discount := r.FormValue("discount"); discount != "" {
+		if invoice.Discount, err = parseMoney(discount); err != nil {
+			return nil, fmt.Errorf("invalid discount %q", discount)
+		}
+	}
+	applyInvoiceDefaults(store, invoice)
+
+	productIDs, quantities := r.PostForm["product_id"], r.PostForm["quantity"]
+	if len(productIDs) != len(quantities) {
+		return nil, errors.New("every line needs a product and a quantity")
+	}
+	for index, productID := range productIDs {
+		id, err := strconv.ParseUint(productID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid product %q", index+1, productID)
+		}
+		quantity, err := strconv.ParseFloat(quantities[index], 64)
+		if err != nil || !validQuantity(quantity) {
+			return nil, fmt.Errorf("line %d: invalid quantity %q", index+1, quantities[index])
+		}
+		product, err := store.GetProduct(uint(id))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: product %d not found", index+1, id)
+		}
+		price, err := builderPrice(store, invoice.ClientID, product, invoice.IssueDate)
+		if err != nil {
+			return nil, err
+		}
+		invoice.InvoiceLines = append(invoice.InvoiceLines, InvoiceLine{
+			ProductID: &product.ID, Product: product, Quantity: quantity, Unit: product.Unit, UnitPrice: price,
+		})
+	}
+
+	if err := validateInvoice(invoice); err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceIssuer(store, invoice); err != nil {
+		return nil, err
+	}
+	if err := invoice.checkAdjustments(); err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// builderPrice is what the product costs the client on the issue date,
+// today when not chosen yet, the product price while no client is
+func builderPrice(store Store, clientID uint, product *Product, issueDate time.Time) (Money, error) {
+	if clientID == 0 {
+		return product.Price, nil
+	}
+	if issueDate.IsZero() {
+		issueDate = clock.Now()
+	}
+	return store.GetClientPrice(clientID, product.ID, issueDate)
+}
+
+type invoiceBuilderPage struct {
+	Issuers           []Company
+	Clients           []Company
+	RemitInformations []RemitInformation
+	IssueDate         string
+	DueDate           string
+	// The defaults of the settings are selected first, zero when none
+	DefaultCompanyID uint
+	DefaultRemitID   uint
+}
+
+// viewInvoiceBuilder renders the form composing an invoice
+func (h *Handler) viewInvoiceBuilder(w http.ResponseWriter, r *http.Request) {
+	store := h.storeFor(r)
+	issuers, err := store.GetCompanies(CompanyFilter{Archived: new(bool), Type: CompanyIssuer})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	clients, err := store.GetCompanies(CompanyFilter{Archived: new(bool), Type: CompanyClient})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	remits, err := store.GetRemitInformations(RemitFilter{Template: new(bool)})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	now := clock.Now()
+	page := invoiceBuilderPage{
+		Issuers:           issuers,
+		Clients:           clients,
+		RemitInformations: remits,
+		IssueDate:         now.Format("2006-01-02"),
+		DueDate:           now.AddDate(0, 0, 30).Format("2006-01-02"),
+	}
+	defaults := Invoice{}
+	applyInvoiceDefaults(h.storeFor(r), &defaults)
+	page.DefaultCompanyID, page.DefaultRemitID = defaults.CompanyID, defaults.RemitInformationID
+	renderBuilder(w, "invoice.html", page)
+}
+
+// searchProducts returns the options of the products matching q, archived
+// products left out
+func (h *Handler) searchProducts(w http.ResponseWriter, r *http.Request) {
+	products, err := h.storeFor(r).GetProducts(ProductFilter{Search: r.URL.Query().Get("q"), Archived: new(bool)})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	renderBuilder(w, "product_options", products[:min(len(products), builderSearchLimit)])
+}
+
+// addInvoiceBuilderLine returns the row of a new line of the product
+func (h *Handler) addInvoiceBuilderLine(w http.ResponseWriter, r *http.Request) {
+	productID, err := parseFormUint(r, "add_product_id")
+	if err != nil || productID == 0 {
+		http.Error(w, "Choose a product", http.StatusBadRequest)
+		return
+	}
+	quantity := 1.0
+	if value := r.FormValue("add_quantity"); value != "" {
+		if quantity, err = strconv.ParseFloat(value, 64); err != nil || !validQuantity(quantity) {
+			http.Error(w, fmt.Sprintf("Invalid quantity %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	clientID, err := parseFormUint(r, "client_id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	issueDate, err := parseFormDate(r, "issue_date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	product, err := h.storeFor(r).GetProduct(productID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	price, err := builderPrice(h.storeFor(r), clientID, product, issueDate)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("HX-Trigger", builderLinesChanged)
+	renderBuilder(w, "line", &InvoiceLine{ProductID: &product.ID, Product: product, Quantity: quantity, Unit: product.Unit, UnitPrice: price})
+}
+
+// removeInvoiceBuilderLine answers the removal of a row, swapped for nothing
+func (h *Handler) removeInvoiceBuilderLine(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("HX-Trigger", builderLinesChanged)
+	w.WriteHeader(http.StatusOK)
+}
+
+// getInvoiceBuilderTotal returns the totals of the invoice in the form
+func (h *Handler) getInvoiceBuilderTotal(w http.ResponseWriter, r *http.Request) {
+	invoice, err := builderInvoice(h.storeFor(r), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renderBuilder(w, "totals", invoice)
+}
+
+// createBuilderInvoice creates the invoice of the form and opens its preview
+func (h *Handler) createBuilderInvoice(w http.ResponseWriter, r *http.Request) {
+	store := h.storeFor(r)
+	invoice, err := builderInvoice(store, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if invoice.CompanyID == 0 || invoice.ClientID == 0 || invoice.RemitInformationID == 0 || len(invoice.InvoiceLines) == 0 {
+		http.Error(w, "The invoice needs an issuer, a client, remit information and at least a line", http.StatusBadRequest)
+		return
+	}
+	if invoice.DueDate.IsZero() {
+		http.Error(w, "The invoice needs a due date", http.StatusBadRequest)
+		return
+	}
+	// Loaded products would be saved along with the lines
+	for index := range invoice.InvoiceLines {
+		invoice.InvoiceLines[index].Product = nil
+	}
+
+	if err := store.CreateInvoice(invoice); err != nil {
+		if errors.Is(err, ErrDiscountExceedsSubtotal) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	preview := fmt.Sprintf("/api/invoices/%d/preview", invoice.ID)
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", preview)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	http.Redirect(w, r, preview, http.StatusSeeOther)
+}
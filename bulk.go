@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	BulkTag       = "tag"
+	BulkUntag     = "untag"
+	BulkAssign    = "assign"
+	BulkArchive   = "archive"
+	BulkUnarchive = "unarchive"
+)
+
+// tagPattern keeps tags safe to match with LIKE in the delimited column
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} -]{0,49}$`)
+
+var ErrUnknownOwner = errors.New("owner not found")
+
+// Tags labels companies and invoices. They are stored as ",vip,late," so a
+// single tag can be matched with LIKE '%,vip,%'.
+type Tags []string
+
+func (t Tags) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	return "," + strings.Join(t, ",") + ",", nil
+}
+
+func (t *Tags) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		*t = Tags{}
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Tags", value)
+	}
+
+	tags := Tags{}
+	for _, tag := range strings.Split(text, ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	*t = tags
+	return nil
+}
+
+// normalizeTag lowercases and trims the tag, failing when it has
+// characters tags can't contain
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag %q, use letters, digits, spaces and dashes", tag)
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes every tag and drops duplicates
+func normalizeTags(tags Tags) (Tags, error) {
+	normalized := Tags{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// tagLike is the LIKE pattern matching rows carrying tag
+func tagLike(tag string) string {
+	return "%," + tag + ",%"
+}
+
+// CompanyFilter narrows down company listings, zero values match everything
+type CompanyFilter struct {
+	IDs              []uint `json:"ids"`
+	Tag              string `json:"tag"`
+	OwnerID          *uint  `json:"owner_id"`
+	Archived         *bool  `json:"archived"`
+	Country          string `json:"country"`
+	ReferralSourceID *uint  `json:"referral_source_id"`
+	// Type lists the companies having the role: issuer, client or supplier
+	Type CompanyType `json:"type"`
+	// EmailBounced lists the companies whose email bounced, or the others
+	EmailBounced *bool `json:"email_bounced"`
+}
+
+func (f CompanyFilter) empty() bool {
+	return len(f.IDs) == 0 && f.Tag == "" && f.OwnerID == nil && f.Archived == nil && f.Country == "" && f.ReferralSourceID == nil && f.Type == "" && f.EmailBounced == nil
+}
+
+func (f CompanyFilter) apply(query *gorm.DB) *gorm.DB {
+	if len(f.IDs) > 0 {
+		query = query.Where("id IN ?", f.IDs)
+	}
+	if f.Tag != "" {
+		query = query.Where("tags LIKE ?", tagLike(strings.ToLower(f.Tag)))
+	}
+	if f.OwnerID != nil {
+		query = query.Where("owner_id = ?", *f.OwnerID)
+	}
+	query = applyArchivedFilter(query, f.Archived)
+	if f.Country != "" {
+		query = query.Where("country = ?", strings.ToUpper(f.Country))
+	}
+	if f.ReferralSourceID != nil {
+		query = query.Where("referral_source_id = ?", *f.ReferralSourceID)
+	}
+	if column := f.Type.column(); column != "" {
+		query = query.Where(column+" = ?", true)
+	}
+	if f.EmailBounced != nil {
+		if *f.EmailBounced {
+			query = query.Where("email_bounced_at IS NOT NULL")
+		} else {
+			query = query.Where("email_bounced_at IS NULL")
+		}
+	}
+	return query
+}
+
+func applyArchivedFilter(query *gorm.DB, archived *bool) *gorm.DB {
+	if archived == nil {
+		return query
+	}
+	if *archived {
+		return query.Where("archived_at IS NOT NULL")
+	}
+	return query.Where("archived_at IS NULL")
+}
+
+// BulkAction is applied to every row matched by a filter
+type BulkAction struct {
+	Action string `json:"action"`
+	Tag    string `json:"tag"`
+	// OwnerID is the user assigned by the assign action, null unassigns
+	OwnerID *uint `json:"owner_id"`
+	// All must be set to act without a filter
+	All bool `json:"all"`
+}
+
+// BulkResult reports how many rows a bulk action changed
+type BulkResult struct {
+	Affected int64 `json:"affected"`
+}
+
+func (a *BulkAction) validate() error {
+	switch a.Action {
+	case BulkTag, BulkUntag:
+		tag, err := normalizeTag(a.Tag)
+		if err != nil {
+			return err
+		}
+		a.Tag = tag
+	case BulkAssign, BulkArchive, BulkUnarchive:
+	default:
+		return fmt.Errorf("unknown action %q, expected tag, untag, assign, archive or unarchive", a.Action)
+	}
+	return nil
+}
+
+// bulkUpdate applies the action to the rows of query. Rows the action
+// wouldn't change aren't counted.
+func (r *Repository) bulkUpdate(query *gorm.DB, action BulkAction) (int64, error) {
+	query = query.Session(&gorm.Session{AllowGlobalUpdate: true})
+
+	switch action.Action {
+	case BulkTag:
+		query = query.Where("tags IS NULL OR tags NOT LIKE ?", tagLike(action.Tag)).
+			UpdateColumn("tags", gorm.Expr("COALESCE(NULLIF(tags, ''), ',') || ?", action.Tag+","))
+	case BulkUntag:
+		query = query.Where("tags LIKE ?", tagLike(action.Tag)).
+			UpdateColumn("tags", gorm.Expr("NULLIF(REPLACE(tags, ?, ','), ',')", ","+action.Tag+","))
+	case BulkAssign:
+		if action.OwnerID != nil {
+			var owners int64
+			if err := r.db.Model(&User{}).Where("id = ?", *action.OwnerID).Count(&owners).Error; err != nil {
+				return 0, err
+			}
+			if owners == 0 {
+				return 0, ErrUnknownOwner
+			}
+			query = query.Where("owner_id IS NULL OR owner_id <> ?", *action.OwnerID)
+		} else {
+			query = query.Where("owner_id IS NOT NULL")
+		}
+		query = query.UpdateColumn("owner_id", action.OwnerID)
+	case BulkArchive:
+		query = query.Where("archived_at IS NULL").UpdateColumn("archived_at", clock.Now())
+	case BulkUnarchive:
+		query = query.Where("archived_at IS NOT NULL").UpdateColumn("archived_at", nil)
+	default:
+		return 0, fmt.Errorf("unknown action %q", action.Action)
+	}
+	return query.RowsAffected, query.Error
+}
+
+func (r *Repository) BulkUpdateCompanies(filter CompanyFilter, action BulkAction) (int64, error) {
+	var affected int64
+	err := retryOnBusy(func() error {
+		var err error
+		affected, err = r.bulkUpdate(filter.apply(r.db.Model(&Company{})), action)
+		return err
+	})
+	return affected, err
+}
+
+func (r *Repository) BulkUpdateInvoices(filter InvoiceFilter, action BulkAction) (int64, error) {
+	var affected int64
+	err := retryOnBusy(func() error {
+		var err error
+		affected, err = r.bulkUpdate(filter.apply(r.db.Model(&Invoice{})), action)
+		return err
+	})
+	return affected, err
+}
+
+// parseOptionalUint reads an optional numeric query parameter
+func parseOptionalUint(r *http.Request, name string) (*uint, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	id := uint(parsed)
+	return &id, nil
+}
+
+// parseOptionalBool reads an optional true/false query parameter
+func parseOptionalBool(r *http.Request, name string) (*bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return &parsed, nil
+}
+
+// companyFilterFromQuery reads the filter of the company list view
+func companyFilterFromQuery(r *http.Request) (CompanyFilter, error) {
+	filter := CompanyFilter{
+		Tag:     r.URL.Query().Get("tag"),
+		Country: r.URL.Query().Get("country"),
+		Type:    CompanyType(r.URL.Query().Get("type")),
+	}
+	if !filter.Type.Valid() {
+		return filter, errors.New("Invalid company type, expected issuer, client or supplier")
+	}
+	var err error
+	if filter.OwnerID, err = parseOptionalUint(r, "owner_id"); err != nil {
+		return filter, err
+	}
+	if filter.ReferralSourceID, err = parseOptionalUint(r, "referral_source_id"); err != nil {
+		return filter, err
+	}
+	if filter.Archived, err = parseOptionalBool(r, "archived"); err != nil {
+		return filter, err
+	}
+	if filter.EmailBounced, err = parseOptionalBool(r, "email_bounced"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// invoiceFilterFromQuery reads the filter of the invoice list view
+func invoiceFilterFromQuery(r *http.Request) (InvoiceFilter, error) {
+	filter := InvoiceFilter{
+		Type:   DocumentType(r.URL.Query().Get("type")),
+		Tag:    r.URL.Query().Get("tag"),
+		Search: r.URL.Query().Get("q"),
+	}
+	if !filter.Type.Valid() {
+		return filter, errors.New("Invalid document type")
+	}
+	var err error
+	if filter.CompanyID, err = parseOptionalUint(r, "company_id"); err != nil {
+		return filter, err
+	}
+	if filter.ClientID, err = parseOptionalUint(r, "client_id"); err != nil {
+		return filter, err
+	}
+	if filter.OwnerID, err = parseOptionalUint(r, "owner_id"); err != nil {
+		return filter, err
+	}
+	if filter.Paid, err = parseOptionalBool(r, "paid"); err != nil {
+		return filter, err
+	}
+	if filter.Archived, err = parseOptionalBool(r, "archived"); err != nil {
+		return filter, err
+	}
+	if filter.Sent, err = parseOptionalBool(r, "sent"); err != nil {
+		return filter, err
+	}
+	if filter.IssuedFrom, err = parseDateQuery(r, "issued_from"); err != nil {
+		return filter, err
+	}
+	if filter.IssuedTo, err = parseDateQuery(r, "issued_to"); err != nil {
+		return filter, err
+	}
+	if filter.OverdueDays, err = parseOptionalUint(r, "overdue_days"); err != nil {
+		return filter, err
+	}
+	if filter.Disputed, err = parseOptionalBool(r, "disputed"); err != nil {
+		return filter, err
+	}
+	if filter.Cancelled, err = parseOptionalBool(r, "cancelled"); err != nil {
+		return filter, err
+	}
+	if filter.Sort = r.URL.Query().Get("sort"); filter.Sort != "" {
+		if _, ok := invoiceSorts[filter.Sort]; !ok {
+			return filter, errors.New("Invalid sort, expected number, issue_date, due_date, total or client")
+		}
+	}
+	switch order := r.URL.Query().Get("order"); order {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, errors.New("Invalid order, expected asc or desc")
+	}
+	return filter, nil
+}
+
+// writeBulkResult answers a bulk action
+func writeBulkResult(w http.ResponseWriter, affected int64, err error) {
+	if err != nil {
+		if errors.Is(err, ErrUnknownOwner) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, ErrUnknownTag) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BulkResult{Affected: affected})
+}
+
+func (h *Handler) bulkUpdateCompanies(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Filter CompanyFilter `json:"filter"`
+		BulkAction
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.BulkAction.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !request.Filter.Type.Valid() {
+		http.Error(w, "Invalid company type, expected issuer, client or supplier", http.StatusBadRequest)
+		return
+	}
+	if request.Filter.empty() && !request.All {
+		http.Error(w, "A filter is required, set \"all\": true to act on every company", http.StatusBadRequest)
+		return
+	}
+
+	affected, err := h.storeFor(r).BulkUpdateCompanies(request.Filter, request.BulkAction)
+	writeBulkResult(w, affected, err)
+}
+
+func (h *Handler) bulkUpdateInvoices(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Filter InvoiceFilter `json:"filter"`
+		BulkAction
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !request.Filter.Type.Valid() {
+		http.Error(w, "Invalid document type", http.StatusBadRequest)
+		return
+	}
+	if err := request.BulkAction.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Filter.empty() && !request.All {
+		http.Error(w, "A filter is required, set \"all\": true to act on every invoice", http.StatusBadRequest)
+		return
+	}
+
+	affected, err := h.storeFor(r).BulkUpdateInvoices(request.Filter, request.BulkAction)
+	writeBulkResult(w, affected, err)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InvoiceStatusSent is the status bulk updates give drafts they send
+const InvoiceStatusSent = "sent"
+
+var (
+	ErrInvoiceAlreadyPaid      = errors.New("invoice is already paid")
+	ErrInvoiceAlreadyCancelled = errors.New("invoice was already cancelled")
+	ErrDraftCancellation       = errors.New("drafts are deleted instead of cancelled")
+	// errBulkStatusFailed rolls back a bulk status update an invoice failed
+	errBulkStatusFailed = errors.New("bulk status update failed")
+)
+
+// BulkStatusResult is the outcome of a bulk status update for an invoice:
+// the payment settling it, the credit note cancelling it or why it failed
+type BulkStatusResult struct {
+	ID           uint   `json:"id"`
+	PaymentID    *uint  `json:"payment_id,omitempty"`
+	CreditNoteID *uint  `json:"credit_note_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// BulkStatusUpdate is the response of a bulk status update, applied only
+// when no invoice failed
+type BulkStatusUpdate struct {
+	Status  string             `json:"status"`
+	Applied bool               `json:"applied"`
+	Results []BulkStatusResult `json:"results"`
+}
+
+// payInvoice records a payment of what is left to pay on the invoice
+func payInvoice(tx *gorm.DB, id uint, now time.Time) (*Payment, error) {
+	var invoice Invoice
+	if err := tx.First(&invoice, id).Error; err != nil {
+		return nil, err
+	}
+	if invoice.Paid {
+		return nil, ErrInvoiceAlreadyPaid
+	}
+	if invoice.CancelledAt != nil {
+		return nil, ErrInvoiceAlreadyCancelled
+	}
+	received, err := invoiceReceived(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	payment := &Payment{InvoiceID: id, Amount: invoice.TotalAmount - received, Date: now}
+	if err := createPayment(tx, payment); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+// cancelInvoice credits the sent invoice in full with a credit note, sent
+// along, and marks it cancelled so it is no longer chased. It stays unpaid,
+// out of what was received.
+func cancelInvoice(tx *gorm.DB, id uint, now time.Time) (*Invoice, error) {
+	var invoice Invoice
+	if err := tx.Preload("InvoiceLines", orderInvoiceLines).First(&invoice, id).Error; err != nil {
+		return nil, err
+	}
+	if invoice.Type.Behavior().BalanceSign <= 0 {
+		return nil, fmt.Errorf("%s documents can't be cancelled", invoice.Type.Behavior().Label)
+	}
+	if invoice.Draft() {
+		return nil, ErrDraftCancellation
+	}
+	if invoice.CancelledAt != nil {
+		return nil, ErrInvoiceAlreadyCancelled
+	}
+	if invoice.Paid {
+		return nil, fmt.Errorf("invoice %d is paid: %w", id, ErrInvoiceIssued)
+	}
+
+	creditNote := convertedDocument(&invoice, DocumentCreditNote)
+	information := "Cancels invoice " + invoice.Identification()
+	creditNote.AdditionalInformation = &information
+	creditNote.IssueDate, creditNote.DueDate = now, now
+	if err := createInvoice(tx, &creditNote); err != nil {
+		return nil, err
+	}
+	if err := sendInvoice(tx, creditNote.ID, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&invoice).Update("cancelled_at", now).Error; err != nil {
+		return nil, err
+	}
+	event := InvoiceEvent{InvoiceID: id, Type: InvoiceStatusCancelled, Message: fmt.Sprintf("Cancelled by credit note %d", creditNote.ID)}
+	if err := tx.Create(&event).Error; err != nil {
+		return nil, err
+	}
+	return &creditNote, nil
+}
+
+// BulkUpdateInvoiceStatus marks the invoices paid, sent or cancelled in one
+// transaction. When an invoice fails none are changed, the results tell
+// which failed.
+func (r *Repository) BulkUpdateInvoiceStatus(ids []uint, status string, now time.Time) (*BulkStatusUpdate, error) {
+	var update *BulkStatusUpdate
+	var payments []*Payment
+	var creditNotes []*Invoice
+	err := retryOnBusy(func() error {
+		update = &BulkStatusUpdate{Status: status, Results: []BulkStatusResult{}}
+		payments, creditNotes = nil, nil
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			failed := false
+			for _, id := range ids {
+				result := BulkStatusResult{ID: id}
+				var err error
+				switch status {
+				case InvoiceStatusPaid:
+					var payment *Payment
+					if payment, err = payInvoice(tx, id, now); err == nil {
+						result.PaymentID = &payment.ID
+						payments = append(payments, payment)
+					}
+				case InvoiceStatusCancelled:
+					var creditNote *Invoice
+					if creditNote, err = cancelInvoice(tx, id, now); err == nil {
+						result.CreditNoteID = &creditNote.ID
+						creditNotes = append(creditNotes, creditNote)
+					}
+				default:
+					err = sendInvoice(tx, id, now)
+				}
+				if err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						err = fmt.Errorf("invoice %d not found", id)
+					}
+					result.Error, failed = err.Error(), true
+				}
+				update.Results = append(update.Results, result)
+			}
+			if failed {
+				return errBulkStatusFailed
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, errBulkStatusFailed) {
+		for i := range update.Results {
+			update.Results[i].PaymentID, update.Results[i].CreditNoteID = nil, nil
+		}
+		return update, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	update.Applied = true
+	for _, payment := range payments {
+		publishEvent(r, EventPaymentRecorded, payment)
+	}
+	for _, creditNote := range creditNotes {
+		publishEvent(r, EventInvoiceCreated, creditNote)
+	}
+	return update, nil
+}
+
+// bulkUpdateInvoiceStatus marks a list of invoices paid, sent or cancelled
+// at once, e.g. the invoices settled on a bank statement
+func (h *Handler) bulkUpdateInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		IDs    []uint `json:"ids"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch request.Status {
+	case InvoiceStatusPaid, InvoiceStatusSent, InvoiceStatusCancelled:
+	default:
+		http.Error(w, "Invalid status, expected paid, sent or cancelled", http.StatusBadRequest)
+		return
+	}
+	if len(request.IDs) == 0 {
+		http.Error(w, "ids are required", http.StatusBadRequest)
+		return
+	}
+	seen := map[uint]bool{}
+	for _, id := range request.IDs {
+		if seen[id] {
+			http.Error(w, fmt.Sprintf("Invoice %d is listed twice", id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+
+	update, err := h.storeFor(r).BulkUpdateInvoiceStatus(request.IDs, request.Status, clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !update.Applied {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(update)
+}
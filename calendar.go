@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SetCalendarToken gives the user a new calendar feed token, the previous
+// one stops working. Only the hash of the token is stored.
+func (r *Repository) SetCalendarToken(userID uint) (string, error) {
+	token := randomToken()
+	err := retryOnBusy(func() error {
+		return r.db.Model(&User{}).Where("id = ?", userID).Update("calendar_token_hash", hashResetToken(token)).Error
+	})
+	return token, err
+}
+
+func (r *Repository) RevokeCalendarToken(userID uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Model(&User{}).Where("id = ?", userID).Update("calendar_token_hash", "").Error
+	})
+}
+
+// GetUserByCalendarToken returns the user the feed token belongs to
+func (r *Repository) GetUserByCalendarToken(token string) (*User, error) {
+	var users []User
+	err := r.db.Where("calendar_token_hash = ?", hashResetToken(token)).Limit(1).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	if token == "" || len(users) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &users[0], nil
+}
+
+// GetOpenTasksDue lists the tasks still open that have a due date, with
+// their project
+func (r *Repository) GetOpenTasksDue() ([]Task, error) {
+	var tasks []Task
+	err := r.db.Preload("Project").Where("status = ? AND due_date IS NOT NULL", TaskOpen).Order("due_date, id").Find(&tasks).Error
+	return tasks, err
+}
+
+// GetConsolidatingClients lists the clients invoiced on a day of every month
+func (r *Repository) GetConsolidatingClients() ([]Company, error) {
+	var clients []Company
+	err := r.db.Where("consolidation_day IS NOT NULL").Order("id").Find(&clients).Error
+	return clients, err
+}
+
+// icsCalendar writes an iCalendar (RFC 5545) document
+type icsCalendar struct {
+	strings.Builder
+	stamp string
+}
+
+func newICSCalendar(name string, now time.Time) *icsCalendar {
+	calendar := &icsCalendar{stamp: now.UTC().Format("20060102T150405Z")}
+	calendar.line("BEGIN", "VCALENDAR")
+	calendar.line("VERSION", "2.0")
+	calendar.line("PRODID", "-//tiny-crm//Calendar//EN")
+	calendar.line("CALSCALE", "GREGORIAN")
+	calendar.line("X-WR-CALNAME", icsEscape(name))
+	return calendar
+}
+
+// line writes a content line, folded at 75 octets without splitting a
+// UTF-8 character
+func (c *icsCalendar) line(name, value string) {
+	line := name + ":" + value
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		c.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	c.WriteString(line + "\r\n")
+}
+
+// allDayEvent writes an event on the day of date. rule repeats it, e.g.
+// FREQ=MONTHLY;BYMONTHDAY=5, when not empty.
+func (c *icsCalendar) allDayEvent(uid string, date time.Time, summary, description, rule string) {
+	c.line("BEGIN", "VEVENT")
+	c.line("UID", uid+"@tiny-crm")
+	c.line("DTSTAMP", c.stamp)
+	c.line("DTSTART;VALUE=DATE", date.Format("20060102"))
+	if rule != "" {
+		c.line("RRULE", rule)
+	}
+	c.line("SUMMARY", icsEscape(summary))
+	if description != "" {
+		c.line("DESCRIPTION", icsEscape(description))
+	}
+	c.line("END", "VEVENT")
+}
+
+func (c *icsCalendar) close() string {
+	c.line("END", "VCALENDAR")
+	return c.String()
+}
+
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// buildCalendar lists the due dates of the unpaid invoices sent, of the
+// open tasks and the days clients get their monthly invoice
+func buildCalendar(store Store, now time.Time) (string, error) {
+	sent, paid, archived := true, false, false
+	invoices, err := store.GetInvoiceSummaries(InvoiceFilter{Type: DocumentInvoice, Sent: &sent, Paid: &paid, Archived: &archived})
+	if err != nil {
+		return "", err
+	}
+	tasks, err := store.GetOpenTasksDue()
+	if err != nil {
+		return "", err
+	}
+	clients, err := store.GetConsolidatingClients()
+	if err != nil {
+		return "", err
+	}
+
+	calendar := newICSCalendar("tiny-crm", now)
+	for _, summary := range invoices {
+		invoice := Invoice{UUID: summary.UUID, Number: summary.Number, Code: summary.Code}
+		calendar.allDayEvent("invoice-"+summary.UUID.String(), summary.DueDate,
+			fmt.Sprintf("Invoice %s due from %s", invoice.Identification(), summary.ClientName),
+			"Total "+ciiFormatAmount(summary.Total), "")
+	}
+	for _, task := range tasks {
+		calendar.allDayEvent(fmt.Sprintf("task-%d", task.ID), *task.DueDate,
+			"Task due: "+task.Name, "Project "+task.Project.Name, "")
+	}
+	for _, client := range clients {
+		day := *client.ConsolidationDay
+		start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, now.Location())
+		calendar.allDayEvent(fmt.Sprintf("consolidation-%d", client.ID), start,
+			"Monthly invoice of "+client.Name, "The deliverables of the past month are invoiced",
+			fmt.Sprintf("FREQ=MONTHLY;BYMONTHDAY=%d", day))
+	}
+	return calendar.close(), nil
+}
+
+// getCalendar serves the feed to calendar apps, authenticated by the token
+// of its URL as they can't sign in
+func (h *Handler) getCalendar(w http.ResponseWriter, r *http.Request) {
+	store := h.storeFor(r)
+	if _, err := store.GetUserByCalendarToken(r.URL.Query().Get("token")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	calendar, err := buildCalendar(store, clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write([]byte(calendar))
+}
+
+// createCalendarToken answers the feed URL of the user signed in, with a
+// new token revoking the previous one
+func (h *Handler) createCalendarToken(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r.Context())
+	if userID == nil {
+		http.Error(w, "Calendar feeds belong to a signed in user", http.StatusForbidden)
+		return
+	}
+
+	token, err := h.storeFor(r).SetCalendarToken(*userID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"url": publicURL("/calendar.ics?token=" + token)})
+}
+
+func (h *Handler) revokeCalendarToken(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r.Context())
+	if userID == nil {
+		http.Error(w, "Calendar feeds belong to a signed in user", http.StatusForbidden)
+		return
+	}
+
+	if err := h.storeFor(r).RevokeCalendarToken(*userID); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
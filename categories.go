@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Category groups products for filtering and reporting, e.g. "Services" or
+// "Hardware". The list is managed by the users.
+type Category struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"size:100;not null;uniqueIndex" json:"name"`
+}
+
+// CategoryRevenue is a line of the revenue by product category report.
+// Quantity and Billed count the lines of invoices minus credit notes issued
+// in the period, Billed is before the invoice discounts and penalties.
+type CategoryRevenue struct {
+	CategoryID *uint   `json:"category_id"`
+	Category   string  `json:"category"`
+	Quantity   float64 `json:"quantity"`
+	Billed     float64 `json:"billed"`
+}
+
+const uncategorized = "Uncategorized"
+
+// ProductFilter narrows down product listings, zero values match everything
+type ProductFilter struct {
+	CategoryID *uint  `json:"category_id"`
+	Tag        string `json:"tag"`
+	Archived   *bool  `json:"archived"`
+	// Search matches text in the name or description
+	Search string `json:"search"`
+}
+
+func (f ProductFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.CategoryID != nil {
+		query = query.Where("category_id = ?", *f.CategoryID)
+	}
+	if f.Tag != "" {
+		query = query.Where("tags LIKE ?", tagLike(strings.ToLower(f.Tag)))
+	}
+	if search := strings.TrimSpace(f.Search); search != "" {
+		pattern := likeContains(search)
+		query = query.Where(`(name LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+	return applyArchivedFilter(query, f.Archived)
+}
+
+// productFilterFromQuery reads the filter of the product list view, leaving
+// archived products out unless asked for
+func productFilterFromQuery(r *http.Request) (ProductFilter, error) {
+	filter := ProductFilter{Tag: r.URL.Query().Get("tag"), Search: r.URL.Query().Get("search")}
+
+	var err error
+	if filter.CategoryID, err = parseOptionalUint(r, "category_id"); err != nil {
+		return filter, err
+	}
+	if filter.Archived, err = parseOptionalBool(r, "archived"); err != nil {
+		return filter, err
+	}
+	if filter.Archived == nil {
+		filter.Archived = new(bool)
+	}
+	return filter, nil
+}
+
+// validateProduct checks the fields the database doesn't constrain
+func validateProduct(product *Product) error {
+	tags, err := normalizeTags(product.Tags)
+	if err != nil {
+		return err
+	}
+	product.Tags = tags
+	return validateUnit(product.Unit)
+}
+
+func (r *Repository) GetCategories() ([]Category, error) {
+	var categories []Category
+	err := r.db.Order("name").Find(&categories).Error
+	return categories, err
+}
+
+func (r *Repository) CreateCategory(category *Category) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(category).Error
+	})
+}
+
+// DeleteCategory removes the category, its products become uncategorized
+func (r *Repository) DeleteCategory(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Product{}).Where("category_id = ?", id).UpdateColumn("category_id", nil).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&Category{}, id).Error
+		})
+	})
+}
+
+// GetRevenueByCategory sums the invoice lines by the category of their
+// product, best selling categories first. Free text lines are
+// uncategorized. from and to are inclusive and
+// optional.
+func (r *Repository) GetRevenueByCategory(from, to *time.Time) ([]CategoryRevenue, error) {
+	query := r.db.Table("invoice_lines").
+		Joins("JOIN invoices ON invoices.id = invoice_lines.invoice_id").
+		Joins("LEFT JOIN products ON products.id = invoice_lines.product_id").
+		Joins("LEFT JOIN categories ON categories.id = products.category_id").
+		Where(balanceSignSQL()+" <> 0 AND invoice_lines.type <> ?", LineSection)
+	if from != nil {
+		query = query.Where("invoices.issue_date >= ?", *from)
+	}
+	if to != nil {
+		query = query.Where("invoices.issue_date < ?", to.AddDate(0, 0, 1))
+	}
+
+	var rows []struct {
+		CategoryID *uint
+		Category   *string
+		Quantity   float64
+		Billed     float64
+	}
+	err := query.Select(`categories.id AS category_id, categories.name AS category,
+			ROUND(COALESCE(SUM(` + balanceSignSQL() + ` * invoice_lines.quantity), 0), 3) AS quantity,
+			ROUND(COALESCE(SUM(` + balanceSignSQL() + ` * invoice_lines.unit_price * invoice_lines.quantity), 0), 2) AS billed`).
+		Group("categories.id, categories.name").
+		Order("billed DESC, category").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []CategoryRevenue{}
+	for _, row := range rows {
+		line := CategoryRevenue{CategoryID: row.CategoryID, Category: uncategorized, Quantity: row.Quantity, Billed: row.Billed}
+		if row.Category != nil {
+			line.Category = *row.Category
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func (h *Handler) getCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.storeFor(r).GetCategories()
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categories)
+}
+
+func (h *Handler) createCategory(w http.ResponseWriter, r *http.Request) {
+	var category Category
+	if err := decodeRequest(r, &category); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateCategory(&category); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+func (h *Handler) deleteCategory(w http.ResponseWriter, r *http.Request) {
+	categoryIdStr := r.PathValue("categoryId")
+	categoryId, err := strconv.ParseUint(categoryIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteCategory(uint(categoryId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRevenueByCategory(w http.ResponseWriter, r *http.Request) {
+	from, err := parseDateQuery(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateQuery(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.storeFor(r).GetRevenueByCategory(from, to)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// command is a subcommand of the binary, `tiny-crm [-config file] <name>
+// [flags] [args]`. Its flags are parsed by Run with a flag set of its own.
+type command struct {
+	Name  string
+	Usage string
+	Help  string
+	// BeforeMigrations runs the command on the database as it is, the
+	// others run once the pending migrations are applied and the settings
+	// loaded
+	BeforeMigrations bool
+	Run              func(repo *Repository, args []string) error
+}
+
+// errUsage reports arguments the command can't run with, its usage is
+// printed along
+var errUsage = errors.New("invalid arguments")
+
+var commands = []command{
+	{Name: "serve", Usage: "serve [-port port]", Help: "start the server, the default command", Run: runServeCommand},
+	{Name: "migrate", Usage: "migrate [up | status | down [steps] | to <version>]", Help: "apply, list or revert the migrations", BeforeMigrations: true,
+		Run: func(repo *Repository, args []string) error {
+			runMigrateCommand(repo, args)
+			return nil
+		}},
+	{Name: "schemadiff", Usage: "schemadiff", Help: "list what the database misses from the models", BeforeMigrations: true, Run: runSchemaDiffCommand},
+	{Name: "user", Usage: "user add [-admin | -company id] [-email address] <username> <password>\n  user list\n  user passwd <username> <password>",
+		Help: "create users, list them or set their password", Run: runUserCommand},
+	{Name: "backup", Usage: "backup <file>", Help: "copy the database to a new SQLite file while it is in use", Run: runBackupCommand},
+	{Name: "seed", Usage: "seed", Help: "fill the database with demo records", Run: runSeedCommand},
+	{Name: "export", Usage: "export <file.json | file.zip>", Help: "dump the whole dataset", Run: func(repo *Repository, args []string) error {
+		return runDatasetFileCommand(repo, "export", args)
+	}},
+	{Name: "import", Usage: "import <file.json | file.zip>", Help: "restore a dump into an empty database", Run: func(repo *Repository, args []string) error {
+		return runDatasetFileCommand(repo, "import", args)
+	}},
+	{Name: "sendreminders", Usage: "sendreminders", Help: "email the payment reminders due", Run: runSendRemindersCommand},
+	{Name: "consolidate", Usage: "consolidate", Help: "invoice the deliverables of the clients due today", Run: runConsolidateCommand},
+	{Name: "senddigest", Usage: "senddigest", Help: "email the digest of the day", Run: runSendDigestCommand},
+	{Name: "runjobs", Usage: "runjobs", Help: "run the background jobs due once", Run: runJobsCommand},
+	// Mail servers pipe the emails received to `tiny-crm receiveemail`
+	{Name: "receiveemail", Usage: "receiveemail < message.eml", Help: "file the email read from stdin", Run: runReceiveEmailCommand},
+	// adduser predates the user command, scripts still call it
+	{Name: "adduser", Usage: "adduser <username> <password> [email] [--admin | --company=<id>]", Help: "same as user add", Run: runAddUserCommand},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, command := range commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: tiny-crm [-config file] [-port port] [-stateless] <command> [flags] [args]\n\nCommands:")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", command.Name, command.Help)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun tiny-crm help <command> for its usage.")
+}
+
+func printCommandUsage(command command) {
+	fmt.Fprintf(os.Stderr, "Usage: tiny-crm %s\n", command.Usage)
+}
+
+// runCommand runs the named command, migrating the database first unless
+// the command works on it as it is
+func runCommand(repo *Repository, name string, args []string) error {
+	command, ok := findCommand(name)
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	if !command.BeforeMigrations {
+		fmt.Println("Running migrations...")
+		if err := repo.Migrate(); err != nil {
+			return fmt.Errorf("running migrations: %w", err)
+		}
+		fmt.Println("Migrations completed.")
+
+		if err := loadSettings(repo); err != nil {
+			return fmt.Errorf("loading settings: %w", err)
+		}
+		if err := snapshotTemplateFiles(repo); err != nil {
+			log.Printf("Error recording invoice template versions: %v", err)
+		}
+	}
+
+	err := command.Run(repo, args)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		printCommandUsage(command)
+	}
+	return err
+}
+
+// commandFlags is the flag set of a command, its errors returned rather
+// than exiting
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	return flags
+}
+
+func runServeCommand(repo *Repository, args []string) error {
+	flags := commandFlags("serve")
+	port := flags.String("port", "", "port to listen on, overrides the config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errUsage
+	}
+	if *port != "" {
+		config.Port = *port
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+
+	mux := setupRoutes(NewHandler(repo), false)
+
+	// The other instances save settings too
+	if redisClient != nil {
+		go watchSettings(repo)
+	}
+	if config.Digest.Enabled {
+		go scheduleDigest(repo)
+	}
+	if config.Bank.PixURL != "" {
+		go scheduleBankPolls(repo)
+	}
+	if config.Jobs.Workers > 0 {
+		if err := startJobWorkers(repo, config.Jobs.Workers); err != nil {
+			return fmt.Errorf("starting the job workers: %w", err)
+		}
+	}
+
+	if config.GRPCPort != "" {
+		go func() {
+			// gRPC has no overrides, authentication is all it skips
+			if err := serveGRPC(config, repo, config.AuthMode == AuthModeNone); err != nil {
+				fmt.Printf("gRPC server stopped: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if err := serve(config, mux); err != nil {
+		return fmt.Errorf("server stopped: %w", err)
+	}
+	return nil
+}
+
+// runSchemaDiffCommand reports schema drift before migrations get a
+// chance to fix it
+func runSchemaDiffCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	drift, err := repo.SchemaDrift()
+	if err != nil {
+		return fmt.Errorf("comparing schema: %w", err)
+	}
+
+	if len(drift) == 0 {
+		fmt.Println("Schema is up to date")
+		return nil
+	}
+	for _, line := range drift {
+		fmt.Println(line)
+	}
+	return fmt.Errorf("%d differences from the models", len(drift))
+}
+
+func runUserCommand(repo *Repository, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		flags := commandFlags("user add")
+		admin := flags.Bool("admin", false, "let the user reach the /admin endpoints and manage other users")
+		companyID := flags.Uint("company", 0, "make a client user of the company, for the portal")
+		email := flags.String("email", "", "email address of the user")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 2 || *admin && *companyID != 0 {
+			return errUsage
+		}
+
+		user := &User{Username: flags.Arg(0), Email: *email, IsAdmin: *admin}
+		if *companyID != 0 {
+			if _, err := repo.GetCompany(*companyID); err != nil {
+				return fmt.Errorf("company %d not found", *companyID)
+			}
+			user.CompanyID = companyID
+		}
+		return addUser(repo, user, flags.Arg(1))
+	case "list":
+		if len(args) != 1 {
+			return errUsage
+		}
+		users, err := repo.GetUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			role := "user"
+			switch {
+			case user.IsAdmin:
+				role = "admin"
+			case user.CompanyID != nil:
+				role = fmt.Sprintf("client of company %d", *user.CompanyID)
+			}
+			fmt.Printf("%-20s %-30s %s\n", user.Username, user.Email, role)
+		}
+		return nil
+	case "passwd":
+		if len(args) != 3 {
+			return errUsage
+		}
+		user, err := repo.GetUserByUsername(args[1])
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("user '%s' not found", args[1])
+		}
+		if err != nil {
+			return err
+		}
+		hashedPassword, err := hashPassword(args[2])
+		if err != nil {
+			return fmt.Errorf("hashing password: %w", err)
+		}
+		if err := repo.SetPassword(user.ID, hashedPassword); err != nil {
+			return err
+		}
+		fmt.Printf("Password of '%s' changed\n", user.Username)
+		return nil
+	}
+	return errUsage
+}
+
+// runAddUserCommand takes the arguments of adduser, flags after the
+// username and password, and adds the user as user add does
+func runAddUserCommand(repo *Repository, args []string) error {
+	var flags, positional []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			flags = append(flags, arg)
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 3 {
+		flags = append(flags, "-email", positional[2])
+		positional = positional[:2]
+	}
+	if len(positional) != 2 {
+		return errUsage
+	}
+	return runUserCommand(repo, append(append([]string{"add"}, flags...), positional...))
+}
+
+func addUser(repo *Repository, user *User, password string) error {
+	if existingUser, _ := repo.GetUserByUsername(user.Username); existingUser != nil {
+		return fmt.Errorf("user '%s' already exists", user.Username)
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+	user.PasswordHash = hashedPassword
+	if err := repo.CreateUser(user); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	fmt.Printf("User '%s' created successfully\n", user.Username)
+	return nil
+}
+
+// runBackupCommand copies the database with VACUUM INTO, consistent even
+// while the server writes to it. Attachments are files of their own, see
+// the export command to carry them too.
+func runBackupCommand(repo *Repository, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	if err := repo.Backup(args[0]); err != nil {
+		return fmt.Errorf("backing up the database: %w", err)
+	}
+
+	fmt.Printf("Database copied to %s\n", args[0])
+	return nil
+}
+
+// runDatasetFileCommand moves the dataset to another instance: export
+// there, import on the new one, zip files carrying the attachments too
+func runDatasetFileCommand(repo *Repository, name string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	runDatasetCommand(repo, name, args[0])
+	return nil
+}
+
+func runSendRemindersCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	results, err := sendReminders(repo, clock.Now())
+	if err != nil {
+		return fmt.Errorf("sending reminders: %w", err)
+	}
+
+	for _, result := range results {
+		if result.Sent {
+			fmt.Printf("Invoice %d: reminder sent\n", result.InvoiceID)
+		} else {
+			fmt.Printf("Invoice %d: %s\n", result.InvoiceID, result.Error)
+		}
+	}
+	return nil
+}
+
+func runConsolidateCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	results, err := consolidateInvoices(repo, clock.Now())
+	if err != nil {
+		return fmt.Errorf("consolidating invoices: %w", err)
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Printf("Client %d: %s\n", result.ClientID, result.Error)
+		} else {
+			fmt.Printf("Client %d: %d invoices created\n", result.ClientID, len(result.InvoiceIDs))
+		}
+	}
+	return nil
+}
+
+func runSendDigestCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	digest, err := sendDigest(repo, clock.Now())
+	if err != nil {
+		return fmt.Errorf("sending the digest: %w", err)
+	}
+
+	fmt.Printf("Digest sent to %s: %d invoices issued, %d payments, %d overdue, %d tasks due tomorrow\n", config.NotifyEmail,
+		len(digest.Issued), len(digest.Payments), len(digest.NewOverdue), len(digest.TasksDueTomorrow))
+	return nil
+}
+
+func runJobsCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ran, err := runDueJobs(repo, clock.Now())
+	if err != nil {
+		return fmt.Errorf("running jobs: %w", err)
+	}
+
+	fmt.Printf("%d jobs run\n", ran)
+	return nil
+}
+
+func runReceiveEmailCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	email, created, err := receiveEmail(repo, os.Stdin)
+	if err != nil {
+		return fmt.Errorf("receiving the email: %w", err)
+	}
+
+	switch {
+	case !created:
+		fmt.Printf("Email %d already received\n", email.ID)
+	case email.CompanyID != nil:
+		fmt.Printf("Email %d filed under company %d\n", email.ID, *email.CompanyID)
+	default:
+		fmt.Printf("Email %d received from %s, no company matched\n", email.ID, email.From)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// clientReportLimit is how many clients a page of the report lists unless
+// asked otherwise, and clientReportMaxLimit the most it lists
+const (
+	clientReportLimit    = 50
+	clientReportMaxLimit = 500
+)
+
+// ClientReportLine is a client of the client report. Invoiced is invoices
+// minus credit notes, Overdue what is left to pay on the invoices past
+// their due date.
+type ClientReportLine struct {
+	ClientID uint   `json:"client_id"`
+	Client   string `json:"client"`
+	Invoiced Money  `json:"invoiced"`
+	Received Money  `json:"received"`
+	// AverageDaysToPay is measured from the issue date to the payment that
+	// settled the invoice, nil until an invoice is paid
+	AverageDaysToPay *float64 `json:"average_days_to_pay"`
+	Overdue          Money    `json:"overdue"`
+}
+
+// clientReportSorts are the columns the client report sorts by
+var clientReportSorts = map[string]bool{
+	"client":              true,
+	"invoiced":            true,
+	"received":            true,
+	"average_days_to_pay": true,
+	"overdue":             true,
+}
+
+// ClientReportQuery is the order and page of the client report, Sort one
+// of clientReportSorts
+type ClientReportQuery struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	Offset     int
+}
+
+// GetClientReport adds up in the database, for every client billed, what
+// was invoiced and received, how long they take to pay and how much is
+// overdue on now. It returns the page asked for along with the number of
+// clients.
+func (r *Repository) GetClientReport(query ClientReportQuery, now time.Time) ([]ClientReportLine, int64, error) {
+	billed := r.db.Table("invoices").
+		Select("client_id, SUM(" + balanceSignSQL() + " * total) AS invoiced").
+		Where(balanceSignSQL() + " <> 0").
+		Group("client_id")
+	received := r.db.Table("payments").
+		Select("invoices.client_id, SUM(payments.amount) AS received").
+		Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Group("invoices.client_id")
+	daysToPay := r.db.Table("invoices").
+		Select("invoices.client_id, AVG(MAX(julianday(settlements.settled_at) - julianday(invoices.issue_date), 0)) AS days").
+		Joins("JOIN (SELECT invoice_id, MAX(date) AS settled_at FROM payments GROUP BY invoice_id) settlements ON settlements.invoice_id = invoices.id").
+		Where("invoices.paid").
+		Group("invoices.client_id")
+	overdue := r.db.Table("invoices").
+		Select("invoices.client_id, SUM(invoices.total - COALESCE(payments.paid, 0)) AS amount").
+		Joins("LEFT JOIN (SELECT invoice_id, SUM(amount) AS paid FROM payments GROUP BY invoice_id) payments ON payments.invoice_id = invoices.id").
+		Where("invoices.type = ? AND NOT invoices.paid AND invoices.cancelled_at IS NULL AND invoices.due_date < ?", DocumentInvoice, now).
+		Group("invoices.client_id")
+
+	clients := r.db.Table("companies").
+		Joins("JOIN (?) billed ON billed.client_id = companies.id", billed).
+		Joins("LEFT JOIN (?) received ON received.client_id = companies.id", received).
+		Joins("LEFT JOIN (?) days_to_pay ON days_to_pay.client_id = companies.id", daysToPay).
+		Joins("LEFT JOIN (?) overdue ON overdue.client_id = companies.id", overdue)
+
+	var total int64
+	if err := clients.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
+	}
+	var lines []ClientReportLine
+	err := clients.
+		Select(`companies.id AS client_id, companies.name AS client,
+			ROUND(billed.invoiced, 2) AS invoiced,
+			ROUND(COALESCE(received.received, 0), 2) AS received,
+			ROUND(days_to_pay.days, 1) AS average_days_to_pay,
+			ROUND(COALESCE(overdue.amount, 0), 2) AS overdue`).
+		Order(fmt.Sprintf("%s %s, client, client_id", query.Sort, direction)).
+		Limit(query.Limit).Offset(query.Offset).
+		Scan(&lines).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if lines == nil {
+		lines = []ClientReportLine{}
+	}
+	return lines, total, nil
+}
+
+// parseQueryInt reads an optional integer of the query, at least least
+func parseQueryInt(r *http.Request, name string, fallback, least int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < least {
+		return 0, fmt.Errorf("Invalid %s %q", name, value)
+	}
+	return parsed, nil
+}
+
+// getClientReport lists a page of the client report, most invoiced first
+// by default. The number of clients is given in X-Total-Count.
+func (h *Handler) getClientReport(w http.ResponseWriter, r *http.Request) {
+	query := ClientReportQuery{Sort: "invoiced", Descending: true}
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		if !clientReportSorts[sort] {
+			http.Error(w, "Invalid sort, expected client, invoiced, received, average_days_to_pay or overdue", http.StatusBadRequest)
+			return
+		}
+		// Amounts are sorted largest first, names alphabetically
+		query.Sort, query.Descending = sort, sort != "client"
+	}
+	switch r.URL.Query().Get("order") {
+	case "":
+	case "asc":
+		query.Descending = false
+	case "desc":
+		query.Descending = true
+	default:
+		http.Error(w, "Invalid order, expected asc or desc", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if query.Limit, err = parseQueryInt(r, "limit", clientReportLimit, 1); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Limit = min(query.Limit, clientReportMaxLimit)
+	if query.Offset, err = parseQueryInt(r, "offset", 0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines, total, err := h.storeFor(r).GetClientReport(query, clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	writeRecords(w, r, "clients", lines)
+}
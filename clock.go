@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the time based features: due dates and overdue
+// invoices, reminders, late fees and the scheduled jobs, in the business
+// time zone. Security checks like sessions, lockouts and edit locks always
+// follow the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// clock is the system clock unless demo_clock sets a simulated one
+var clock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().In(config.Location())
+}
+
+// SimulatedClock stands still until it is moved, so tests and demos decide
+// what time it is
+type SimulatedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewSimulatedClock(now time.Time) *SimulatedClock {
+	return &SimulatedClock{now: now}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now.In(config.Location())
+}
+
+// Advance moves the clock forward and returns the new time. Invoices may
+// turn overdue, the cached read models are dropped like after a write.
+func (c *SimulatedClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dataWritten()
+	c.now = c.now.Add(d)
+	return c.now.In(config.Location())
+}
+
+func (c *SimulatedClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dataWritten()
+	c.now = now
+}
+
+// parseClockTime reads an RFC 3339 time or a YYYY-MM-DD date, midnight in
+// the business time zone
+func parseClockTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := parseDate(value)
+	if err != nil {
+		return time.Time{}, errors.New("expected an RFC 3339 time or a YYYY-MM-DD date")
+	}
+	return t, nil
+}
+
+type clockState struct {
+	Now       time.Time `json:"now"`
+	Simulated bool      `json:"simulated"`
+}
+
+func (h *Handler) getClock(w http.ResponseWriter, r *http.Request) {
+	_, simulated := clock.(*SimulatedClock)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clockState{Now: clock.Now(), Simulated: simulated})
+}
+
+// moveClock sets the simulated clock to "now" or moves it by "advance", a
+// duration like "72h"
+func (h *Handler) moveClock(w http.ResponseWriter, r *http.Request) {
+	simulated, ok := clock.(*SimulatedClock)
+	if !ok {
+		http.Error(w, "The clock is only simulated with demo_clock set", http.StatusConflict)
+		return
+	}
+
+	var request struct {
+		Now     string `json:"now"`
+		Advance string `json:"advance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case request.Now != "":
+		now, err := parseClockTime(request.Now)
+		if err != nil {
+			http.Error(w, "Invalid now: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		simulated.Set(now)
+	case request.Advance != "":
+		duration, err := time.ParseDuration(request.Advance)
+		if err != nil || duration < 0 {
+			http.Error(w, "Invalid advance, expected a positive duration like 72h", http.StatusBadRequest)
+			return
+		}
+		simulated.Advance(duration)
+	default:
+		http.Error(w, "Either now or advance is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clockState{Now: simulated.Now(), Simulated: true})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// listTypes maps every list view whose columns can be chosen to the type
+// of its rows
+var listTypes = map[string]reflect.Type{
+	"companies": reflect.TypeOf(Company{}),
+	"products":  reflect.TypeOf(Product{}),
+	"invoices":  reflect.TypeOf(InvoiceSummary{}),
+}
+
+// Columns is a list of JSON field names, stored comma separated
+type Columns []string
+
+func (c Columns) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	return strings.Join(c, ","), nil
+}
+
+func (c *Columns) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		*c = Columns{}
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Columns", value)
+	}
+
+	columns := Columns{}
+	for _, column := range strings.Split(text, ",") {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	*c = columns
+	return nil
+}
+
+// ListColumns is the columns a user picked for a list view. Rows without a
+// user hold the choice made when authentication is disabled.
+type ListColumns struct {
+	ID      uint    `gorm:"primaryKey" json:"-"`
+	UserID  *uint   `gorm:"index" json:"-"`
+	User    *User   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	List    string  `gorm:"size:50;not null" json:"list"`
+	Columns Columns `gorm:"type:text" json:"columns"`
+}
+
+// availableColumns lists the JSON fields of the list's rows
+func availableColumns(list string) (Columns, bool) {
+	rowType, ok := listTypes[list]
+	if !ok {
+		return nil, false
+	}
+
+	return jsonColumns(rowType), true
+}
+
+// jsonColumns lists the JSON fields of the type in order, with the fields
+// of embedded structs
+func jsonColumns(rowType reflect.Type) Columns {
+	columns := Columns{}
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			columns = append(columns, jsonColumns(field.Type)...)
+			continue
+		}
+		if name != "" && name != "-" {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+// validateColumns checks the columns exist in the list and drops duplicates
+func validateColumns(list string, columns Columns) (Columns, error) {
+	available, _ := availableColumns(list)
+	known := map[string]bool{}
+	for _, column := range available {
+		known[column] = true
+	}
+
+	validated := Columns{}
+	seen := map[string]bool{}
+	for _, column := range columns {
+		column = strings.TrimSpace(column)
+		if !known[column] {
+			return nil, fmt.Errorf("unknown %s column %q", list, column)
+		}
+		if !seen[column] {
+			seen[column] = true
+			validated = append(validated, column)
+		}
+	}
+	return validated, nil
+}
+
+func listColumnsOwner(query *gorm.DB, userID *uint) *gorm.DB {
+	if userID == nil {
+		return query.Where("user_id IS NULL")
+	}
+	return query.Where("user_id = ?", *userID)
+}
+
+// GetListColumns returns the columns the user picked for the list, none
+// when every column is shown
+func (r *Repository) GetListColumns(userID *uint, list string) (Columns, error) {
+	var listColumns []ListColumns
+	err := listColumnsOwner(r.db, userID).Where("list = ?", list).Limit(1).Find(&listColumns).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(listColumns) == 0 {
+		return Columns{}, nil
+	}
+	return listColumns[0].Columns, nil
+}
+
+// SetListColumns stores the columns the user picked for the list, no
+// columns brings back every column
+func (r *Repository) SetListColumns(userID *uint, list string, columns Columns) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := listColumnsOwner(tx, userID).Where("list = ?", list).Delete(&ListColumns{}).Error; err != nil {
+				return err
+			}
+			if len(columns) == 0 {
+				return nil
+			}
+			return tx.Create(&ListColumns{UserID: userID, List: list, Columns: columns}).Error
+		})
+	})
+}
+
+type userContextKey struct{}
+
+// currentUserID returns the ID of the authenticated user, nil when
+// authentication is disabled
+func currentUserID(ctx context.Context) *uint {
+	if user, ok := ctx.Value(userContextKey{}).(*User); ok {
+		return &user.ID
+	}
+	return nil
+}
+
+// requestColumns returns the columns to show in the list: the columns
+// query parameter when given, "all" showing everything, or else the
+// columns the user picked
+func (h *Handler) requestColumns(r *http.Request, list string) (Columns, error) {
+	if value, ok := r.URL.Query()["columns"]; ok {
+		if value[0] == "all" || value[0] == "" {
+			return Columns{}, nil
+		}
+		return validateColumns(list, strings.Split(value[0], ","))
+	}
+	return h.storeFor(r).GetListColumns(currentUserID(r.Context()), list)
+}
+
+// writeList answers a list view with only the chosen columns of each row,
+// the id is always kept, in the format the request accepts
+func (h *Handler) writeList(w http.ResponseWriter, r *http.Request, list string, rows interface{}) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	columns, err := h.requestColumns(r, list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(columns) == 0 {
+		available, _ := availableColumns(list)
+		writeRows(w, format, list, available, rows)
+		return
+	}
+
+	decoded, err := decodeRows(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	projected := make([]map[string]json.RawMessage, len(decoded))
+	for i, row := range decoded {
+		projected[i] = map[string]json.RawMessage{"id": row["id"]}
+		for _, column := range columns {
+			projected[i][column] = row[column]
+		}
+	}
+	shown := Columns{"id"}
+	for _, column := range columns {
+		if column != "id" {
+			shown = append(shown, column)
+		}
+	}
+	writeRows(w, format, list, shown, projected)
+}
+
+// listColumnsResponse describes the columns of a list view
+type listColumnsResponse struct {
+	List      string  `json:"list"`
+	Columns   Columns `json:"columns"`
+	Available Columns `json:"available"`
+}
+
+func (h *Handler) getListColumns(w http.ResponseWriter, r *http.Request) {
+	list := r.PathValue("list")
+	available, ok := availableColumns(list)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown list %q", list), http.StatusNotFound)
+		return
+	}
+
+	columns, err := h.storeFor(r).GetListColumns(currentUserID(r.Context()), list)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listColumnsResponse{List: list, Columns: columns, Available: available})
+}
+
+func (h *Handler) updateListColumns(w http.ResponseWriter, r *http.Request) {
+	list := r.PathValue("list")
+	available, ok := availableColumns(list)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown list %q", list), http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Columns Columns `json:"columns"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	columns, err := validateColumns(list, request.Columns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SetListColumns(currentUserID(r.Context()), list, columns); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listColumnsResponse{List: list, Columns: columns, Available: available})
+}
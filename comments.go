@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EventCommentCreated carries the *InvoiceComment created
+const EventCommentCreated = "comment.created"
+
+var ErrCommentParent = errors.New("the comment replied to is not on this invoice")
+
+// mentionPattern finds the @username mentions of a comment. The @ has to
+// start a word, so email addresses aren't taken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([\p{L}\p{N}._-]+)`)
+
+// InvoiceComment is an internal note on an invoice, e.g. about a dispute.
+// Replies point to the comment they answer, so a discussion is a thread.
+type InvoiceComment struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	InvoiceID uint            `gorm:"not null;index" json:"invoice_id"`
+	Invoice   Invoice         `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	ParentID  *uint           `gorm:"index" json:"parent_id"`
+	Parent    *InvoiceComment `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	UserID    *uint           `gorm:"index" json:"user_id"`
+	User      *User           `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	Body      string          `gorm:"type:text;not null" json:"body"`
+	CreatedAt time.Time       `json:"created_at"`
+	// Author is the username of the user who wrote it, empty when the
+	// user was deleted or authentication is disabled
+	Author   string           `gorm:"-" json:"author"`
+	Mentions []string         `gorm:"-" json:"mentions"`
+	Replies  []InvoiceComment `gorm:"-" json:"replies"`
+}
+
+// parseMentions returns the usernames mentioned in the body, once each
+func parseMentions(body string) []string {
+	mentions := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// A mention ending a sentence doesn't take the period
+		username := strings.TrimRight(match[1], ".")
+		if username != "" && !seen[username] {
+			seen[username] = true
+			mentions = append(mentions, username)
+		}
+	}
+	return mentions
+}
+
+// validateInvoiceComment checks the fields the database doesn't constrain
+func validateInvoiceComment(comment *InvoiceComment) error {
+	comment.Body = strings.TrimSpace(comment.Body)
+	if comment.Body == "" {
+		return errors.New("Body is required")
+	}
+	if len(comment.Body) > 10000 {
+		return errors.New("Body can't be longer than 10000 characters")
+	}
+	return nil
+}
+
+// fill sets the fields derived from the author and the body
+func (c *InvoiceComment) fill() {
+	if c.User != nil {
+		c.Author = c.User.Username
+	}
+	c.Mentions = parseMentions(c.Body)
+	c.Replies = []InvoiceComment{}
+}
+
+// GetInvoiceComments returns the comments of the invoice as threads: the
+// comments starting one, oldest first, with their replies nested
+func (r *Repository) GetInvoiceComments(invoiceID uint) ([]InvoiceComment, error) {
+	var comments []InvoiceComment
+	err := r.db.Preload("User").Where("invoice_id = ?", invoiceID).Order("created_at, id").Find(&comments).Error
+	if err != nil {
+		return nil, err
+	}
+
+	replies := map[uint][]InvoiceComment{}
+	threads := []InvoiceComment{}
+	for _, comment := range comments {
+		comment.fill()
+		if comment.ParentID != nil {
+			replies[*comment.ParentID] = append(replies[*comment.ParentID], comment)
+		} else {
+			threads = append(threads, comment)
+		}
+	}
+	var nest func(comments []InvoiceComment) []InvoiceComment
+	nest = func(comments []InvoiceComment) []InvoiceComment {
+		for i := range comments {
+			comments[i].Replies = nest(replies[comments[i].ID])
+		}
+		if comments == nil {
+			return []InvoiceComment{}
+		}
+		return comments
+	}
+	return nest(threads), nil
+}
+
+func (r *Repository) GetInvoiceComment(id uint) (*InvoiceComment, error) {
+	var comment InvoiceComment
+	if err := r.db.Preload("User").First(&comment, id).Error; err != nil {
+		return nil, err
+	}
+	comment.fill()
+	return &comment, nil
+}
+
+func (r *Repository) CreateInvoiceComment(comment *InvoiceComment) error {
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if comment.ParentID != nil {
+				var parents int64
+				if err := tx.Model(&InvoiceComment{}).Where("id = ? AND invoice_id = ?", *comment.ParentID, comment.InvoiceID).Count(&parents).Error; err != nil {
+					return err
+				}
+				if parents == 0 {
+					return ErrCommentParent
+				}
+			}
+			return tx.Omit("Invoice", "Parent", "User").Create(comment).Error
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if comment.UserID != nil {
+		if user, err := r.GetUser(*comment.UserID); err == nil {
+			comment.User = user
+		}
+	}
+	comment.fill()
+
+	publishEvent(r, EventCommentCreated, comment)
+	return nil
+}
+
+// DeleteInvoiceComment deletes the comment along with its replies
+func (r *Repository) DeleteInvoiceComment(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&InvoiceComment{}, id).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&InvoiceComment{}, id).Error
+		})
+	})
+}
+
+// notifyMentions emails the users mentioned in the comment, but its author,
+// unless the notifications are paused. Users without an email are skipped.
+// It returns the usernames notified.
+func notifyMentions(store Store, invoice *Invoice, comment *InvoiceComment) []string {
+	notified := []string{}
+	if currentSettings().PauseNotifications {
+		return notified
+	}
+
+	author := comment.Author
+	if author == "" {
+		author = "Someone"
+	}
+	for _, username := range comment.Mentions {
+		user, err := store.GetUserByUsername(username)
+		if err != nil || user.Email == "" || (comment.UserID != nil && user.ID == *comment.UserID) {
+			continue
+		}
+		email := &Email{
+			To:      []string{user.Email},
+			Subject: fmt.Sprintf("%s mentioned you on invoice %s", author, invoice.Identification()),
+			Body: fmt.Sprintf("Hello %s,\n\n%s mentioned you on invoice %s of %s:\n\n%s\n",
+				user.Username, author, invoice.Identification(), invoice.Client.Name, comment.Body),
+		}
+		if _, err := enqueueJob(store, "email", email); err != nil {
+			log.Printf("Error queueing the mention of %s on comment %d: %v", username, comment.ID, err)
+			continue
+		}
+		notified = append(notified, username)
+	}
+	return notified
+}
+
+// Invoice comment handlers
+func (h *Handler) getInvoiceComments(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.storeFor(r).GetInvoice(uint(invoiceId)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	comments, err := h.storeFor(r).GetInvoiceComments(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+func (h *Handler) createInvoiceComment(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var comment InvoiceComment
+	if err := decodeRequest(r, &comment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateInvoiceComment(&comment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	comment.ID, comment.InvoiceID, comment.UserID = 0, invoice.ID, currentUserID(r.Context())
+
+	if err := h.storeFor(r).CreateInvoiceComment(&comment); err != nil {
+		if errors.Is(err, ErrCommentParent) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	response := struct {
+		*InvoiceComment
+		Notified []string `json:"notified"`
+	}{&comment, notifyMentions(h.storeFor(r), invoice, &comment)}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) deleteInvoiceComment(w http.ResponseWriter, r *http.Request) {
+	commentIdStr := r.PathValue("commentId")
+	commentId, err := strconv.ParseUint(commentIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+
+	comment, err := h.storeFor(r).GetInvoiceComment(uint(commentId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Only its author or an administrator deletes a comment
+	if user, ok := r.Context().Value(userContextKey{}).(*User); ok && !user.IsAdmin &&
+		(comment.UserID == nil || *comment.UserID != user.ID) {
+		http.Error(w, "Only the author of the comment or an administrator can delete it", http.StatusForbidden)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteInvoiceComment(comment.ID); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
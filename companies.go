@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CompanyType is a role a company plays, a company may have several
+type CompanyType string
+
+const (
+	CompanyIssuer   CompanyType = "issuer"
+	CompanyClient   CompanyType = "client"
+	CompanySupplier CompanyType = "supplier"
+)
+
+var companyTypeColumns = map[CompanyType]string{
+	CompanyIssuer:   "is_issuer",
+	CompanyClient:   "is_client",
+	CompanySupplier: "is_supplier",
+}
+
+// Valid reports whether the type is known, an empty type matches any company
+func (t CompanyType) Valid() bool {
+	if t == "" {
+		return true
+	}
+	_, ok := companyTypeColumns[t]
+	return ok
+}
+
+// column is the flag of the role on the companies table
+func (t CompanyType) column() string {
+	return companyTypeColumns[t]
+}
+
+// defaultCompanyRoles makes a company created without a role a client
+func defaultCompanyRoles(company *Company) {
+	if !company.IsIssuer && !company.IsClient && !company.IsSupplier {
+		company.IsClient = true
+	}
+}
+
+// checkInvoiceIssuer checks that the company issuing the invoice is an issuer
+func checkInvoiceIssuer(store Store, invoice *Invoice) error {
+	if invoice.CompanyID == 0 {
+		return errors.New("An invoice needs the company issuing it")
+	}
+	company, err := store.GetCompany(invoice.CompanyID)
+	if err != nil {
+		return fmt.Errorf("Company %d not found", invoice.CompanyID)
+	}
+	if !company.IsIssuer {
+		return fmt.Errorf("Company %d is not an issuer", invoice.CompanyID)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// bodyETag is the strong ETag of a response body
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the If-Match or If-None-Match header lists
+// the ETag. The weak comparison of If-None-Match ignores the W/ prefixes.
+func etagMatches(header, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveBuffered runs the request and holds back the response, with the
+// ETag of its body when it succeeded and the handler set none
+func serveBuffered(next http.Handler, r *http.Request) *bufferedResponseWriter {
+	buffered := &bufferedResponseWriter{header: http.Header{}}
+	next.ServeHTTP(buffered, r)
+	if buffered.status == 0 {
+		buffered.status = http.StatusOK
+	}
+	if buffered.status == http.StatusOK && buffered.header.Get("ETag") == "" {
+		buffered.header.Set("ETag", bodyETag(buffered.body.Bytes()))
+	}
+	return buffered
+}
+
+// currentETag is the ETag of the JSON representation of the resource the
+// write request targets, what a GET of its URL returns
+func currentETag(next http.Handler, r *http.Request) (string, bool) {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.Body = http.NoBody
+	get.ContentLength = 0
+	for _, name := range []string{"If-Match", "If-None-Match", "Content-Type", "HX-Request"} {
+		get.Header.Del(name)
+	}
+	get.Header.Set("Accept", "application/json")
+
+	current := serveBuffered(next, get)
+	if current.status != http.StatusOK {
+		return "", false
+	}
+	return current.header.Get("ETag"), true
+}
+
+// conditionalRequests tags the successful GET answers with the ETag of
+// their body, answering 304 Not Modified to clients holding it already,
+// so polling costs no bandwidth until something changes. Writes carrying
+// If-Match go ahead only while the resource still has that ETag, else 412
+// Precondition Failed, so nobody overwrites changes they haven't seen.
+// Within the unit of work the check and the write share the transaction.
+func conditionalRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			buffered := serveBuffered(next, r)
+			for key, values := range buffered.header {
+				w.Header()[key] = values
+			}
+			etag := buffered.header.Get("ETag")
+			if buffered.status == http.StatusOK && etag != "" {
+				if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+		case http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				etag, ok := currentETag(next, r)
+				if !ok || !etagMatches(ifMatch, etag, false) {
+					http.Error(w, "The resource changed since it was read, fetch it again", http.StatusPreconditionFailed)
+					return
+				}
+			}
+			if r.Method == http.MethodDelete {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Edits answer with the new ETag, for the next edit to match
+			buffered := &bufferedResponseWriter{header: http.Header{}}
+			next.ServeHTTP(buffered, r)
+			if buffered.status == 0 {
+				buffered.status = http.StatusOK
+			}
+			for key, values := range buffered.header {
+				w.Header()[key] = values
+			}
+			if buffered.status < http.StatusMultipleChoices {
+				if etag, ok := currentETag(next, r); ok {
+					w.Header().Set("ETag", etag)
+				}
+			}
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	AuthModeBasic = "basic"
+	AuthModeNone  = "none"
+)
+
+const (
+	// NumberingManual keeps the numbers given to the invoices
+	NumberingManual = "manual"
+	// NumberingOnSend leaves drafts unnumbered and numbers invoices in a
+	// gapless sequence when they are sent
+	NumberingOnSend = "on_send"
+)
+
+// SMTPConfig holds the outgoing mail server settings
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	// Cc, Bcc and ReplyTo apply to every email sent to clients, on top of
+	// the addresses set on each client
+	Cc      []string
+	Bcc     []string
+	ReplyTo string
+}
+
+// MailConfig picks the provider sending the emails, from SMTP_FROM: SMTP
+// or the HTTP API of SendGrid, Mailgun or Amazon SES, see mailProviders
+type MailConfig struct {
+	Provider string
+	// APIKey authenticates with SendGrid and Mailgun
+	APIKey string
+	// MailgunDomain is the sending domain, MailgunURL the API of its
+	// region, https://api.eu.mailgun.net for the EU
+	MailgunDomain string
+	MailgunURL    string
+	// SESRegion is the AWS region, e.g. us-east-1, the keys those of an IAM
+	// user allowed ses:SendRawEmail
+	SESRegion          string
+	SESAccessKeyID     string
+	SESSecretAccessKey string
+}
+
+// TLSConfig enables HTTPS, either with a certificate from files or with
+// certificates obtained automatically from Let's Encrypt
+type TLSConfig struct {
+	CertFile        string
+	KeyFile         string
+	AutocertDomains []string
+	AutocertEmail   string
+	AutocertCache   string
+}
+
+// Enabled reports whether the server should serve HTTPS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.AutocertDomains) > 0
+}
+
+// PeppolConfig points at the access point provider used to send e-invoices
+type PeppolConfig struct {
+	AccessPointURL string
+	APIKey         string
+}
+
+// BankConfig points at the bank API polled for incoming transfers, the Pix
+// API of Brazilian banks
+type BankConfig struct {
+	PixURL   string
+	APIToken string
+	// PollMinutes is how often incoming transfers are polled
+	PollMinutes int
+}
+
+// WhatsAppConfig sends invoice links and reminders over WhatsApp, through
+// the WhatsApp Business Cloud API or Twilio, see whatsAppProviders
+type WhatsAppConfig struct {
+	// Provider is cloud or twilio, WhatsApp is off when empty
+	Provider string
+	// Token and PhoneNumberID are those of the Cloud API app, AppSecret
+	// signs the status webhooks and VerifyToken is the one given when
+	// subscribing them
+	Token         string
+	PhoneNumberID string
+	AppSecret     string
+	VerifyToken   string
+	// Business initiated messages need approved templates, given the
+	// invoice number, amount, due date and link as parameters. Without
+	// them the text is sent, which WhatsApp only delivers to clients who
+	// wrote within the last 24 hours.
+	InvoiceTemplate  string
+	ReminderTemplate string
+	TemplateLanguage string
+	// TwilioFrom is the WhatsApp sender of the account, e.g. +14155238886
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFrom       string
+}
+
+// S3Config points at the bucket keeping the attachments, see S3FileStorage
+type S3Config struct {
+	Bucket string
+	Region string
+	// Endpoint is that of an S3 compatible service, AWS when empty
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// RedisConfig points at the Redis server shared by the instances, see
+// redisClient
+type RedisConfig struct {
+	// URL is redis://[:password@]host:port[/db], rediss:// over TLS
+	URL string
+	// Prefix starts every key, so other apps can share the server
+	Prefix string
+}
+
+// NFSeConfig describes the services issued as Brazilian fiscal notes
+type NFSeConfig struct {
+	// Provider names the NFSeLayout of the city hall, see nfseLayouts
+	Provider string
+	// MunicipalityCode is the IBGE code of the city the services are
+	// provided in, e.g. 3550308 for São Paulo
+	MunicipalityCode string
+	// ServiceCode is the item of the LC 116/2003 service list, e.g. "01.07"
+	ServiceCode string
+	// ISSRate is the municipal service tax, in percent
+	ISSRate         float64
+	RPSSeries       string
+	SimplesNacional bool
+}
+
+// ReportsConfig limits the load of the report endpoints on the database
+type ReportsConfig struct {
+	// MaxConcurrent is how many reports run at once, 0 is unlimited
+	MaxConcurrent int
+	// CacheTTL is how many seconds a report is reused, 0 disables the cache
+	CacheTTL int
+	// ReadModelTTL is how many seconds the dashboard figures and the client
+	// balances are reused while nothing is written, 0 disables their cache
+	ReadModelTTL int
+}
+
+// LateFeesConfig sets what clients owe on top of overdue invoices, e.g. a
+// 2% penalty and 1% monthly interest. Zero charges nothing.
+type LateFeesConfig struct {
+	PenaltyPercent         float64
+	MonthlyInterestPercent float64
+}
+
+// DigestConfig sends the end of day summary to the notify email
+type DigestConfig struct {
+	Enabled bool
+	// Hour is when the digest goes out, 0 to 23 in the business time zone
+	Hour int
+}
+
+// TracingConfig traces the requests and their queries, logging the slow
+// ones
+type TracingConfig struct {
+	Enabled bool
+	// SlowMS is how long a request takes, in milliseconds, for its trace
+	// to be logged, 0 logs every trace
+	SlowMS int
+}
+
+// JobsConfig sizes the pool of workers running the queued background jobs
+type JobsConfig struct {
+	// Workers run jobs at the same time, 0 leaves the queue to the
+	// runjobs command
+	Workers int
+	// MaxAttempts is how many times a failing job runs before it is dead
+	MaxAttempts int
+}
+
+// OIDCConfig enables signing in with an OpenID Connect provider such as
+// Google, Microsoft or Keycloak, next to the local passwords
+type OIDCConfig struct {
+	// DiscoveryURL is the provider's .well-known/openid-configuration
+	DiscoveryURL string
+	ClientID     string
+	ClientSecret string
+	// CreateUsers creates a local user on the first sign in, otherwise the
+	// email must match the username of an existing user
+	CreateUsers bool
+}
+
+// Enabled reports whether OpenID Connect sign in is offered
+func (c OIDCConfig) Enabled() bool {
+	return c.DiscoveryURL != ""
+}
+
+// Config holds every setting of the server. It is built from the defaults,
+// then the optional config file, then the environment, each overriding the
+// previous one.
+type Config struct {
+	Port string
+	// GRPCPort serves the gRPC API when set
+	GRPCPort    string
+	DatabaseDSN string
+	// DatabaseBusyTimeout is how long SQLite waits for a lock, in milliseconds
+	DatabaseBusyTimeout int
+	// DatabaseMaxOpenConns caps the connections to the database, 0 is
+	// unlimited, and DatabaseMaxIdleConns of them stay open between queries
+	DatabaseMaxOpenConns int
+	DatabaseMaxIdleConns int
+	// DatabaseConnMaxLifetime and DatabaseConnMaxIdleTime close connections
+	// open or idle for that many seconds, 0 keeps them
+	DatabaseConnMaxLifetime int
+	DatabaseConnMaxIdleTime int
+	// SerializeWrites runs write requests one at a time instead of letting
+	// them compete for the SQLite write lock
+	SerializeWrites bool
+	BaseURL         string
+	AuthMode        string
+	AttachmentsDir  string
+	// StorageQuotaMB caps the attachments of each company, 0 is unlimited
+	StorageQuotaMB int
+	// S3 keeps the attachments in a bucket instead of AttachmentsDir
+	S3              S3Config
+	ShareLinkSecret string
+	// ReceiptsEnabled emails clients a receipt once their invoice is paid,
+	// also sent when NPSSurveyEnabled for the survey link it carries
+	ReceiptsEnabled  bool
+	NPSSurveyEnabled bool
+	SMTP             SMTPConfig
+	Mail             MailConfig
+	TLS              TLSConfig
+	Peppol           PeppolConfig
+	Bank             BankConfig
+	WhatsApp         WhatsAppConfig
+	Redis            RedisConfig
+	NFSe             NFSeConfig
+	Reports          ReportsConfig
+	LateFees         LateFeesConfig
+	Digest           DigestConfig
+	Tracing          TracingConfig
+	Jobs             JobsConfig
+	OIDC             OIDCConfig
+
+	// NotifyEmail receives the internal notifications, e.g. budget alerts
+	NotifyEmail string
+	// BudgetAlertPercent is the share of a project budget billed that
+	// raises an alert, projects may set their own
+	BudgetAlertPercent int
+
+	// InvoiceNumbering is NumberingManual or NumberingOnSend
+	InvoiceNumbering string
+	// NumberingStrategy names the NumberingStrategy numbering sent invoices
+	// with NumberingOnSend
+	NumberingStrategy string
+	// EditLockMinutes is how long an invoice checked out for editing stays
+	// locked without being refreshed
+	EditLockMinutes int
+
+	// LoginLockoutAttempts is how many wrong passwords in a row lock an
+	// account, 0 never locks
+	LoginLockoutAttempts int
+	// LoginLockoutMinutes is how long the first lockout lasts, every further
+	// wrong password doubles it
+	LoginLockoutMinutes int
+	// IPBlockAttempts is how many failed logins from an IP within
+	// IPBlockMinutes block it for that long, 0 never blocks
+	IPBlockAttempts int
+	IPBlockMinutes  int
+
+	// Timezone is the IANA name of the business time zone, e.g.
+	// America/Sao_Paulo, where the days of due dates, reminders, late fees
+	// and the scheduled jobs begin and end. The server's when empty.
+	Timezone string
+	location *time.Location
+
+	// DemoClock starts a simulated clock at that time instead of the system
+	// one, moved through /admin/clock
+	DemoClock string
+
+	// Stateless refuses the backends local to the instance, so several
+	// instances can serve the same traffic, see validateStateless
+	Stateless bool
+}
+
+// config is the active configuration, main replaces it with LoadConfig
+var config = DefaultConfig()
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                 "8080",
+		DatabaseDSN:          "tinycrm.db",
+		DatabaseBusyTimeout:  5000,
+		DatabaseMaxIdleConns: 2,
+		AuthMode:             AuthModeBasic,
+		AttachmentsDir:       "attachments",
+		BudgetAlertPercent:   80,
+		InvoiceNumbering:     NumberingManual,
+		NumberingStrategy:    "sequential",
+		EditLockMinutes:      15,
+
+		LoginLockoutAttempts: 5,
+		LoginLockoutMinutes:  1,
+		IPBlockAttempts:      20,
+		IPBlockMinutes:       15,
+		SMTP: SMTPConfig{
+			Port: "587",
+		},
+		Mail: MailConfig{
+			Provider:   "smtp",
+			MailgunURL: "https://api.mailgun.net",
+		},
+		TLS: TLSConfig{
+			AutocertCache: "certs",
+		},
+		Bank: BankConfig{
+			PollMinutes: 15,
+		},
+		WhatsApp: WhatsAppConfig{
+			TemplateLanguage: "pt_BR",
+		},
+		Redis: RedisConfig{
+			Prefix: "tinycrm:",
+		},
+		NFSe: NFSeConfig{
+			Provider:  "abrasf",
+			RPSSeries: "1",
+		},
+		Reports: ReportsConfig{
+			MaxConcurrent: 2,
+			CacheTTL:      5,
+			ReadModelTTL:  300,
+		},
+		Digest: DigestConfig{
+			Hour: 18,
+		},
+		Tracing: TracingConfig{
+			SlowMS: 500,
+		},
+		Jobs: JobsConfig{
+			Workers:     2,
+			MaxAttempts: 5,
+		},
+	}
+}
+
+// configSetting maps a config file key and an environment variable to a field
+type configSetting struct {
+	key string
+	env string
+	set func(c *Config, value string) error
+}
+
+func stringSetting(key, env string, field func(c *Config) *string) configSetting {
+	return configSetting{key, env, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func boolSetting(key, env string, field func(c *Config) *bool) configSetting {
+	return configSetting{key, env, func(c *Config, value string) error {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		*field(c) = enabled
+		return nil
+	}}
+}
+
+func intSetting(key, env string, field func(c *Config) *int) configSetting {
+	return configSetting{key, env, func(c *Config, value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", key)
+		}
+		*field(c) = number
+		return nil
+	}}
+}
+
+func floatSetting(key, env string, field func(c *Config) *float64) configSetting {
+	return configSetting{key, env, func(c *Config, value string) error {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", key)
+		}
+		*field(c) = number
+		return nil
+	}}
+}
+
+// listSetting reads a comma separated list
+func listSetting(key, env string, field func(c *Config) *[]string) configSetting {
+	return configSetting{key, env, func(c *Config, value string) error {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}}
+}
+
+var configSettings = []configSetting{
+	stringSetting("port", "PORT", func(c *Config) *string { return &c.Port }),
+	stringSetting("grpc.port", "GRPC_PORT", func(c *Config) *string { return &c.GRPCPort }),
+	stringSetting("base_url", "BASE_URL", func(c *Config) *string { return &c.BaseURL }),
+	stringSetting("auth_mode", "AUTH_MODE", func(c *Config) *string { return &c.AuthMode }),
+	stringSetting("share_link_secret", "SHARE_LINK_SECRET", func(c *Config) *string { return &c.ShareLinkSecret }),
+	boolSetting("receipts_enabled", "RECEIPTS_ENABLED", func(c *Config) *bool { return &c.ReceiptsEnabled }),
+	boolSetting("nps_survey_enabled", "NPS_SURVEY_ENABLED", func(c *Config) *bool { return &c.NPSSurveyEnabled }),
+	stringSetting("notify_email", "NOTIFY_EMAIL", func(c *Config) *string { return &c.NotifyEmail }),
+	intSetting("budget_alert_percent", "BUDGET_ALERT_PERCENT", func(c *Config) *int { return &c.BudgetAlertPercent }),
+	stringSetting("invoice_numbering", "INVOICE_NUMBERING", func(c *Config) *string { return &c.InvoiceNumbering }),
+	stringSetting("numbering_strategy", "NUMBERING_STRATEGY", func(c *Config) *string { return &c.NumberingStrategy }),
+	intSetting("edit_lock_minutes", "EDIT_LOCK_MINUTES", func(c *Config) *int { return &c.EditLockMinutes }),
+	intSetting("login_lockout_attempts", "LOGIN_LOCKOUT_ATTEMPTS", func(c *Config) *int { return &c.LoginLockoutAttempts }),
+	intSetting("login_lockout_minutes", "LOGIN_LOCKOUT_MINUTES", func(c *Config) *int { return &c.LoginLockoutMinutes }),
+	intSetting("ip_block_attempts", "IP_BLOCK_ATTEMPTS", func(c *Config) *int { return &c.IPBlockAttempts }),
+	intSetting("ip_block_minutes", "IP_BLOCK_MINUTES", func(c *Config) *int { return &c.IPBlockMinutes }),
+	stringSetting("timezone", "TIMEZONE", func(c *Config) *string { return &c.Timezone }),
+	stringSetting("demo_clock", "DEMO_CLOCK", func(c *Config) *string { return &c.DemoClock }),
+	boolSetting("stateless", "STATELESS", func(c *Config) *bool { return &c.Stateless }),
+	stringSetting("database.dsn", "DATABASE_DSN", func(c *Config) *string { return &c.DatabaseDSN }),
+	intSetting("database.busy_timeout", "DATABASE_BUSY_TIMEOUT", func(c *Config) *int { return &c.DatabaseBusyTimeout }),
+	intSetting("database.max_open_conns", "DATABASE_MAX_OPEN_CONNS", func(c *Config) *int { return &c.DatabaseMaxOpenConns }),
+	intSetting("database.max_idle_conns", "DATABASE_MAX_IDLE_CONNS", func(c *Config) *int { return &c.DatabaseMaxIdleConns }),
+	intSetting("database.conn_max_lifetime", "DATABASE_CONN_MAX_LIFETIME", func(c *Config) *int { return &c.DatabaseConnMaxLifetime }),
+	intSetting("database.conn_max_idle_time", "DATABASE_CONN_MAX_IDLE_TIME", func(c *Config) *int { return &c.DatabaseConnMaxIdleTime }),
+	boolSetting("database.serialize_writes", "DATABASE_SERIALIZE_WRITES", func(c *Config) *bool { return &c.SerializeWrites }),
+	stringSetting("storage.attachments_dir", "ATTACHMENTS_DIR", func(c *Config) *string { return &c.AttachmentsDir }),
+	intSetting("storage.quota_mb", "STORAGE_QUOTA_MB", func(c *Config) *int { return &c.StorageQuotaMB }),
+	stringSetting("storage.s3_bucket", "S3_BUCKET", func(c *Config) *string { return &c.S3.Bucket }),
+	stringSetting("storage.s3_region", "S3_REGION", func(c *Config) *string { return &c.S3.Region }),
+	stringSetting("storage.s3_endpoint", "S3_ENDPOINT", func(c *Config) *string { return &c.S3.Endpoint }),
+	stringSetting("storage.s3_access_key_id", "S3_ACCESS_KEY_ID", func(c *Config) *string { return &c.S3.AccessKeyID }),
+	stringSetting("storage.s3_secret_access_key", "S3_SECRET_ACCESS_KEY", func(c *Config) *string { return &c.S3.SecretAccessKey }),
+	stringSetting("smtp.host", "SMTP_HOST", func(c *Config) *string { return &c.SMTP.Host }),
+	stringSetting("smtp.port", "SMTP_PORT", func(c *Config) *string { return &c.SMTP.Port }),
+	stringSetting("smtp.username", "SMTP_USERNAME", func(c *Config) *string { return &c.SMTP.Username }),
+	stringSetting("smtp.password", "SMTP_PASSWORD", func(c *Config) *string { return &c.SMTP.Password }),
+	stringSetting("smtp.from", "SMTP_FROM", func(c *Config) *string { return &c.SMTP.From }),
+	listSetting("smtp.cc", "SMTP_CC", func(c *Config) *[]string { return &c.SMTP.Cc }),
+	listSetting("smtp.bcc", "SMTP_BCC", func(c *Config) *[]string { return &c.SMTP.Bcc }),
+	stringSetting("smtp.reply_to", "SMTP_REPLY_TO", func(c *Config) *string { return &c.SMTP.ReplyTo }),
+	stringSetting("mail.provider", "MAIL_PROVIDER", func(c *Config) *string { return &c.Mail.Provider }),
+	stringSetting("mail.api_key", "MAIL_API_KEY", func(c *Config) *string { return &c.Mail.APIKey }),
+	stringSetting("mail.mailgun_domain", "MAILGUN_DOMAIN", func(c *Config) *string { return &c.Mail.MailgunDomain }),
+	stringSetting("mail.mailgun_url", "MAILGUN_URL", func(c *Config) *string { return &c.Mail.MailgunURL }),
+	stringSetting("mail.ses_region", "SES_REGION", func(c *Config) *string { return &c.Mail.SESRegion }),
+	stringSetting("mail.ses_access_key_id", "SES_ACCESS_KEY_ID", func(c *Config) *string { return &c.Mail.SESAccessKeyID }),
+	stringSetting("mail.ses_secret_access_key", "SES_SECRET_ACCESS_KEY", func(c *Config) *string { return &c.Mail.SESSecretAccessKey }),
+	stringSetting("peppol.access_point_url", "PEPPOL_ACCESS_POINT_URL", func(c *Config) *string { return &c.Peppol.AccessPointURL }),
+	stringSetting("peppol.api_key", "PEPPOL_API_KEY", func(c *Config) *string { return &c.Peppol.APIKey }),
+	stringSetting("whatsapp.provider", "WHATSAPP_PROVIDER", func(c *Config) *string { return &c.WhatsApp.Provider }),
+	stringSetting("whatsapp.token", "WHATSAPP_TOKEN", func(c *Config) *string { return &c.WhatsApp.Token }),
+	stringSetting("whatsapp.phone_number_id", "WHATSAPP_PHONE_NUMBER_ID", func(c *Config) *string { return &c.WhatsApp.PhoneNumberID }),
+	stringSetting("whatsapp.app_secret", "WHATSAPP_APP_SECRET", func(c *Config) *string { return &c.WhatsApp.AppSecret }),
+	stringSetting("whatsapp.verify_token", "WHATSAPP_VERIFY_TOKEN", func(c *Config) *string { return &c.WhatsApp.VerifyToken }),
+	stringSetting("whatsapp.invoice_template", "WHATSAPP_INVOICE_TEMPLATE", func(c *Config) *string { return &c.WhatsApp.InvoiceTemplate }),
+	stringSetting("whatsapp.reminder_template", "WHATSAPP_REMINDER_TEMPLATE", func(c *Config) *string { return &c.WhatsApp.ReminderTemplate }),
+	stringSetting("whatsapp.template_language", "WHATSAPP_TEMPLATE_LANGUAGE", func(c *Config) *string { return &c.WhatsApp.TemplateLanguage }),
+	stringSetting("whatsapp.twilio_account_sid", "TWILIO_ACCOUNT_SID", func(c *Config) *string { return &c.WhatsApp.TwilioAccountSID }),
+	stringSetting("whatsapp.twilio_auth_token", "TWILIO_AUTH_TOKEN", func(c *Config) *string { return &c.WhatsApp.TwilioAuthToken }),
+	stringSetting("whatsapp.twilio_from", "TWILIO_WHATSAPP_FROM", func(c *Config) *string { return &c.WhatsApp.TwilioFrom }),
+	stringSetting("redis.url", "REDIS_URL", func(c *Config) *string { return &c.Redis.URL }),
+	stringSetting("redis.prefix", "REDIS_PREFIX", func(c *Config) *string { return &c.Redis.Prefix }),
+	stringSetting("bank.pix_url", "BANK_PIX_URL", func(c *Config) *string { return &c.Bank.PixURL }),
+	stringSetting("bank.api_token", "BANK_API_TOKEN", func(c *Config) *string { return &c.Bank.APIToken }),
+	intSetting("bank.poll_minutes", "BANK_POLL_MINUTES", func(c *Config) *int { return &c.Bank.PollMinutes }),
+	stringSetting("nfse.provider", "NFSE_PROVIDER", func(c *Config) *string { return &c.NFSe.Provider }),
+	stringSetting("nfse.municipality_code", "NFSE_MUNICIPALITY_CODE", func(c *Config) *string { return &c.NFSe.MunicipalityCode }),
+	stringSetting("nfse.service_code", "NFSE_SERVICE_CODE", func(c *Config) *string { return &c.NFSe.ServiceCode }),
+	floatSetting("nfse.iss_rate", "NFSE_ISS_RATE", func(c *Config) *float64 { return &c.NFSe.ISSRate }),
+	stringSetting("nfse.rps_series", "NFSE_RPS_SERIES", func(c *Config) *string { return &c.NFSe.RPSSeries }),
+	boolSetting("nfse.simples_nacional", "NFSE_SIMPLES_NACIONAL", func(c *Config) *bool { return &c.NFSe.SimplesNacional }),
+	intSetting("reports.max_concurrent", "REPORTS_MAX_CONCURRENT", func(c *Config) *int { return &c.Reports.MaxConcurrent }),
+	intSetting("reports.cache_ttl", "REPORTS_CACHE_TTL", func(c *Config) *int { return &c.Reports.CacheTTL }),
+	intSetting("reports.read_model_ttl", "REPORTS_READ_MODEL_TTL", func(c *Config) *int { return &c.Reports.ReadModelTTL }),
+	floatSetting("late_fees.penalty_percent", "LATE_FEES_PENALTY_PERCENT", func(c *Config) *float64 { return &c.LateFees.PenaltyPercent }),
+	floatSetting("late_fees.monthly_interest_percent", "LATE_FEES_MONTHLY_INTEREST_PERCENT", func(c *Config) *float64 { return &c.LateFees.MonthlyInterestPercent }),
+	boolSetting("digest.enabled", "DIGEST_ENABLED", func(c *Config) *bool { return &c.Digest.Enabled }),
+	intSetting("digest.hour", "DIGEST_HOUR", func(c *Config) *int { return &c.Digest.Hour }),
+	boolSetting("tracing.enabled", "TRACING_ENABLED", func(c *Config) *bool { return &c.Tracing.Enabled }),
+	intSetting("tracing.slow_ms", "TRACING_SLOW_MS", func(c *Config) *int { return &c.Tracing.SlowMS }),
+	intSetting("jobs.workers", "JOBS_WORKERS", func(c *Config) *int { return &c.Jobs.Workers }),
+	intSetting("jobs.max_attempts", "JOBS_MAX_ATTEMPTS", func(c *Config) *int { return &c.Jobs.MaxAttempts }),
+	stringSetting("oidc.discovery_url", "OIDC_DISCOVERY_URL", func(c *Config) *string { return &c.OIDC.DiscoveryURL }),
+	stringSetting("oidc.client_id", "OIDC_CLIENT_ID", func(c *Config) *string { return &c.OIDC.ClientID }),
+	stringSetting("oidc.client_secret", "OIDC_CLIENT_SECRET", func(c *Config) *string { return &c.OIDC.ClientSecret }),
+	boolSetting("oidc.create_users", "OIDC_CREATE_USERS", func(c *Config) *bool { return &c.OIDC.CreateUsers }),
+	stringSetting("tls.cert_file", "TLS_CERT_FILE", func(c *Config) *string { return &c.TLS.CertFile }),
+	stringSetting("tls.key_file", "TLS_KEY_FILE", func(c *Config) *string { return &c.TLS.KeyFile }),
+	listSetting("tls.autocert_domains", "TLS_AUTOCERT_DOMAINS", func(c *Config) *[]string { return &c.TLS.AutocertDomains }),
+	stringSetting("tls.autocert_email", "TLS_AUTOCERT_EMAIL", func(c *Config) *string { return &c.TLS.AutocertEmail }),
+	stringSetting("tls.autocert_cache", "TLS_AUTOCERT_CACHE", func(c *Config) *string { return &c.TLS.AutocertCache }),
+}
+
+// LoadConfig builds the configuration from the defaults, the config file at
+// path when given, and the environment, then validates it
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, setting := range configSettings {
+			value, ok := values[setting.key]
+			if !ok {
+				continue
+			}
+			if err := setting.set(c, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			delete(values, setting.key)
+		}
+
+		for key := range values {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+	}
+
+	for _, setting := range configSettings {
+		value, ok := os.LookupEnv(setting.env)
+		if !ok {
+			continue
+		}
+		if err := setting.set(c, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", setting.env, err)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readConfigFile parses the TOML config file into the values of its
+// settings, keys inside a table returned as "table.key". Arrays are read
+// as the comma separated lists the environment gives.
+func readConfigFile(path string) (map[string]string, error) {
+	var document map[string]interface{}
+	if _, err := toml.DecodeFile(path, &document); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if err := flattenConfigTable(values, "", document); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfigTable(values map[string]string, prefix string, table map[string]interface{}) error {
+	for key, value := range table {
+		key = prefix + key
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfigTable(values, key+".", value); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				text, err := configValue(key, item)
+				if err != nil {
+					return err
+				}
+				items[i] = text
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			text, err := configValue(key, value)
+			if err != nil {
+				return err
+			}
+			values[key] = text
+		}
+	}
+	return nil
+}
+
+// configValue formats a TOML value as the environment would give it
+func configValue(key string, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("%s: unsupported value %v", key, value)
+	}
+}
+
+// Validate reports the first invalid setting
+func (c *Config) Validate() error {
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", c.Port)
+	}
+	if c.GRPCPort != "" {
+		if port, err := strconv.Atoi(c.GRPCPort); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid gRPC port %q", c.GRPCPort)
+		}
+		if c.GRPCPort == c.Port {
+			return errors.New("the gRPC port must differ from the HTTP port")
+		}
+	}
+	if c.DatabaseDSN == "" {
+		return errors.New("database DSN is required")
+	}
+	if c.DatabaseBusyTimeout < 0 {
+		return errors.New("database busy timeout can't be negative")
+	}
+	if c.DatabaseMaxOpenConns < 0 || c.DatabaseMaxIdleConns < 0 || c.DatabaseConnMaxLifetime < 0 || c.DatabaseConnMaxIdleTime < 0 {
+		return errors.New("database connection pool settings can't be negative")
+	}
+	if c.DatabaseMaxOpenConns > 0 && c.DatabaseMaxIdleConns > c.DatabaseMaxOpenConns {
+		return fmt.Errorf("database max_idle_conns %d can't exceed max_open_conns %d", c.DatabaseMaxIdleConns, c.DatabaseMaxOpenConns)
+	}
+	if c.AuthMode != AuthModeBasic && c.AuthMode != AuthModeNone {
+		return fmt.Errorf("invalid auth mode %q, expected %q or %q", c.AuthMode, AuthModeBasic, AuthModeNone)
+	}
+	if c.InvoiceNumbering != NumberingManual && c.InvoiceNumbering != NumberingOnSend {
+		return fmt.Errorf("invalid invoice numbering %q, expected %q or %q", c.InvoiceNumbering, NumberingManual, NumberingOnSend)
+	}
+	if _, ok := numberingStrategies[c.NumberingStrategy]; !ok {
+		return fmt.Errorf("invalid numbering strategy %q, expected sequential, yearly, per_client or random", c.NumberingStrategy)
+	}
+	if c.EditLockMinutes < 1 {
+		return fmt.Errorf("invalid edit lock minutes %d", c.EditLockMinutes)
+	}
+	if c.LoginLockoutAttempts < 0 {
+		return errors.New("login lockout attempts can't be negative")
+	}
+	if c.LoginLockoutMinutes < 1 {
+		return fmt.Errorf("invalid login lockout minutes %d", c.LoginLockoutMinutes)
+	}
+	if c.IPBlockAttempts < 0 {
+		return errors.New("IP block attempts can't be negative")
+	}
+	if c.IPBlockMinutes < 1 {
+		return fmt.Errorf("invalid IP block minutes %d", c.IPBlockMinutes)
+	}
+	c.location = nil
+	if c.Timezone != "" {
+		location, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q, expected a name like America/Sao_Paulo", c.Timezone)
+		}
+		c.location = location
+	}
+	if c.DemoClock != "" {
+		if _, err := parseClockTime(c.DemoClock); err != nil {
+			return fmt.Errorf("invalid demo clock: %w", err)
+		}
+	}
+	if c.BaseURL != "" {
+		baseURL, err := url.Parse(c.BaseURL)
+		if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+			return fmt.Errorf("invalid base URL %q", c.BaseURL)
+		}
+	}
+	if c.AttachmentsDir == "" {
+		return errors.New("attachments directory is required")
+	}
+	if c.StorageQuotaMB < 0 {
+		return fmt.Errorf("invalid storage quota %d", c.StorageQuotaMB)
+	}
+	if err := c.S3.validate(); err != nil {
+		return err
+	}
+	if c.NotifyEmail != "" {
+		if _, err := mail.ParseAddress(c.NotifyEmail); err != nil {
+			return fmt.Errorf("invalid notify email %q", c.NotifyEmail)
+		}
+	}
+	if c.BudgetAlertPercent < 1 || c.BudgetAlertPercent > 100 {
+		return fmt.Errorf("invalid budget alert percent %d, expected 1 to 100", c.BudgetAlertPercent)
+	}
+	if _, err := strconv.Atoi(c.SMTP.Port); err != nil {
+		return fmt.Errorf("invalid SMTP port %q", c.SMTP.Port)
+	}
+	if c.SMTP.Host != "" && c.SMTP.From == "" {
+		return errors.New("SMTP from address is required when an SMTP host is set")
+	}
+	for _, address := range append(append([]string{c.SMTP.ReplyTo}, c.SMTP.Cc...), c.SMTP.Bcc...) {
+		if address == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid SMTP address %q", address)
+		}
+	}
+	if err := c.Mail.validate(c.SMTP.From); err != nil {
+		return err
+	}
+	if c.Peppol.AccessPointURL != "" {
+		accessPoint, err := url.Parse(c.Peppol.AccessPointURL)
+		if err != nil || accessPoint.Scheme != "https" || accessPoint.Host == "" {
+			return fmt.Errorf("invalid Peppol access point URL %q, it must use https", c.Peppol.AccessPointURL)
+		}
+	}
+	if err := c.WhatsApp.validate(); err != nil {
+		return err
+	}
+	if err := c.Redis.validate(); err != nil {
+		return err
+	}
+	if c.Bank.PixURL != "" {
+		pixURL, err := url.Parse(c.Bank.PixURL)
+		if err != nil || pixURL.Scheme != "https" || pixURL.Host == "" {
+			return fmt.Errorf("invalid bank Pix URL %q, it must use https", c.Bank.PixURL)
+		}
+	}
+	if c.Bank.PollMinutes < 1 {
+		return fmt.Errorf("invalid bank poll_minutes %d, expected 1 or more", c.Bank.PollMinutes)
+	}
+	if _, ok := nfseLayouts[c.NFSe.Provider]; !ok {
+		return fmt.Errorf("invalid NFS-e provider %q, expected abrasf", c.NFSe.Provider)
+	}
+	if c.NFSe.MunicipalityCode != "" {
+		if _, err := strconv.Atoi(c.NFSe.MunicipalityCode); err != nil || len(c.NFSe.MunicipalityCode) != 7 {
+			return fmt.Errorf("invalid NFS-e municipality code %q, expected the 7 digit IBGE code", c.NFSe.MunicipalityCode)
+		}
+	}
+	if c.NFSe.ISSRate < 0 || c.NFSe.ISSRate > 5 {
+		return fmt.Errorf("invalid NFS-e ISS rate %v, expected 0 to 5", c.NFSe.ISSRate)
+	}
+	if c.NFSe.RPSSeries == "" {
+		return errors.New("NFS-e RPS series is required")
+	}
+	if c.Reports.MaxConcurrent < 0 {
+		return fmt.Errorf("invalid reports max concurrent %d", c.Reports.MaxConcurrent)
+	}
+	if c.Reports.CacheTTL < 0 {
+		return fmt.Errorf("invalid reports cache TTL %d", c.Reports.CacheTTL)
+	}
+	if c.Reports.ReadModelTTL < 0 {
+		return fmt.Errorf("invalid reports read model TTL %d", c.Reports.ReadModelTTL)
+	}
+	if c.LateFees.PenaltyPercent < 0 || c.LateFees.PenaltyPercent > 100 {
+		return fmt.Errorf("invalid late fees penalty percent %v", c.LateFees.PenaltyPercent)
+	}
+	if c.LateFees.MonthlyInterestPercent < 0 || c.LateFees.MonthlyInterestPercent > 100 {
+		return fmt.Errorf("invalid late fees monthly interest percent %v", c.LateFees.MonthlyInterestPercent)
+	}
+	if c.Digest.Hour < 0 || c.Digest.Hour > 23 {
+		return fmt.Errorf("invalid digest hour %d, expected 0 to 23", c.Digest.Hour)
+	}
+	if c.Digest.Enabled && c.NotifyEmail == "" {
+		return errors.New("the digest needs a notify email to be sent to")
+	}
+	if c.Tracing.SlowMS < 0 {
+		return fmt.Errorf("invalid tracing slow_ms %d, expected 0 or more", c.Tracing.SlowMS)
+	}
+	if c.Jobs.Workers < 0 {
+		return fmt.Errorf("invalid jobs workers %d, expected 0 or more", c.Jobs.Workers)
+	}
+	if c.Jobs.MaxAttempts < 1 {
+		return fmt.Errorf("invalid jobs max_attempts %d, expected 1 or more", c.Jobs.MaxAttempts)
+	}
+	if c.OIDC.Enabled() {
+		discovery, err := url.Parse(c.OIDC.DiscoveryURL)
+		if err != nil || discovery.Host == "" || (discovery.Scheme != "https" && !(discovery.Scheme == "http" && isLoopback(discovery.Hostname()))) {
+			return fmt.Errorf("invalid OIDC discovery URL %q, it must use https", c.OIDC.DiscoveryURL)
+		}
+		if c.OIDC.ClientID == "" {
+			return errors.New("OIDC client ID is required when a discovery URL is set")
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.AutocertDomains) > 0 {
+		return errors.New("TLS certificate files and autocert domains can't be used together")
+	}
+	if len(c.TLS.AutocertDomains) > 0 && c.TLS.AutocertCache == "" {
+		return errors.New("autocert cache directory is required")
+	}
+	if c.Stateless {
+		return c.validateStateless()
+	}
+	return nil
+}
+
+// Location is the business time zone
+func (c *Config) Location() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+	return c.location
+}
+
+// apply makes the configuration active
+func (c *Config) apply() {
+	config = c
+	if c.ShareLinkSecret != "" {
+		shareLinkSecret = []byte(c.ShareLinkSecret)
+	}
+	mailer = mailProviders[c.Mail.Provider](c)
+	peppolTransmitter = newHTTPPeppolTransmitter(c.Peppol)
+	bankConnector = newPixBankConnector(c.Bank)
+	whatsApp = newWhatsAppSender(c.WhatsApp)
+	redisClient = newRedisClient(c.Redis)
+	fileStorage = newFileStorage(c)
+	clock = systemClock{}
+	if c.DemoClock != "" {
+		start, _ := parseClockTime(c.DemoClock)
+		clock = NewSimulatedClock(start)
+	}
+}
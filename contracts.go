@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Contract is a subscription of a client to products, invoiced by the
+// billing run every cadence from its start month until its end date
+type Contract struct {
+	ID        uint    `gorm:"primaryKey" json:"id"`
+	CompanyID uint    `gorm:"not null;index" json:"company_id"`
+	Company   Company `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	ClientID  uint    `gorm:"not null;index" json:"client_id"`
+	Client    Company `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	// RemitInformationID is where the contract invoices are paid
+	RemitInformationID uint             `gorm:"not null" json:"remit_information_id"`
+	RemitInformation   RemitInformation `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name               string           `gorm:"size:255;not null" json:"name"`
+	// Cadence is monthly by default, see BillingCadence
+	Cadence   BillingCadence `gorm:"size:20;not null;default:monthly" json:"cadence"`
+	StartDate time.Time      `gorm:"not null" json:"start_date"`
+	// EndDate is the last day of the contract, its month is still billed
+	EndDate *time.Time     `json:"end_date"`
+	Lines   []ContractLine `gorm:"constraint:OnDelete:CASCADE" json:"lines"`
+}
+
+// ContractLine is a product billed every period of the contract
+type ContractLine struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	ContractID uint    `gorm:"not null;index" json:"contract_id"`
+	ProductID  uint    `gorm:"not null" json:"product_id"`
+	Product    Product `gorm:"constraint:OnDelete:RESTRICT" json:"product"`
+	Quantity   float64 `gorm:"type:decimal(10,3);default:1;not null" json:"quantity"`
+	// UnitPrice overrides the product price when set
+	UnitPrice Money `gorm:"type:decimal(10,2);not null;default:0.00" json:"unit_price"`
+}
+
+// ContractBilling records the period of a contract a billing run invoiced,
+// by the month it starts, so it isn't invoiced twice
+type ContractBilling struct {
+	ContractID uint     `gorm:"primaryKey;autoIncrement:false" json:"contract_id"`
+	Contract   Contract `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Month      string   `gorm:"size:7;primaryKey" json:"month"`
+	// InvoiceID is cleared when the invoice is deleted, the period stays
+	// billed
+	InvoiceID *uint     `gorm:"index" json:"invoice_id"`
+	Invoice   *Invoice  `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	BilledAt  time.Time `gorm:"not null" json:"billed_at"`
+}
+
+// BillingCadence is how often a contract is invoiced
+type BillingCadence string
+
+const (
+	CadenceMonthly   BillingCadence = "monthly"
+	CadenceQuarterly BillingCadence = "quarterly"
+	CadenceYearly    BillingCadence = "yearly"
+)
+
+// Months is the number of months a period of the cadence lasts, 0 when the
+// cadence is unknown
+func (c BillingCadence) Months() int {
+	switch c {
+	case CadenceMonthly:
+		return 1
+	case CadenceQuarterly:
+		return 3
+	case CadenceYearly:
+		return 12
+	}
+	return 0
+}
+
+// ContractFilter narrows down contract listings, zero values match
+// everything
+type ContractFilter struct {
+	ClientID *uint
+	ActiveOn *time.Time
+}
+
+// RecurringRevenue is the monthly recurring revenue report: what the
+// contracts active on a day bring in a month, quarterly and yearly ones
+// spread over their months
+type RecurringRevenue struct {
+	Date      time.Time                  `json:"date"`
+	MRR       Money                      `json:"mrr"`
+	Contracts []ContractRecurringRevenue `json:"contracts"`
+}
+
+type ContractRecurringRevenue struct {
+	ContractID uint           `json:"contract_id"`
+	Name       string         `json:"name"`
+	ClientID   uint           `json:"client_id"`
+	Cadence    BillingCadence `json:"cadence"`
+	// Amount is what a period of the contract is invoiced
+	Amount  Money `json:"amount"`
+	Monthly Money `json:"monthly"`
+}
+
+// Amount is what a period of the contract is invoiced, lines without a
+// price at their product's
+func (c *Contract) Amount() Money {
+	var amount Money
+	for _, line := range c.Lines {
+		price := line.UnitPrice
+		if price == 0 {
+			price = line.Product.Price
+		}
+		amount += price.Times(line.Quantity)
+	}
+	return amount
+}
+
+// ActiveIn reports whether the contract runs during some of the month
+func (c *Contract) ActiveIn(month time.Time) bool {
+	month = monthStart(month)
+	return !monthStart(c.StartDate).After(month) && (c.EndDate == nil || !monthStart(*c.EndDate).Before(month))
+}
+
+// DueIn reports whether a period of the contract starts in the month
+func (c *Contract) DueIn(month time.Time) bool {
+	if !c.ActiveIn(month) {
+		return false
+	}
+	start, month := monthStart(c.StartDate), monthStart(month)
+	elapsed := (month.Year()-start.Year())*12 + int(month.Month()-start.Month())
+	return elapsed%c.Cadence.Months() == 0
+}
+
+// period describes the months a period of the contract starting in month
+// covers, 2024-04 or 2024-04 to 2024-06
+func (c *Contract) period(month time.Time) string {
+	first := month.Format(billingMonthLayout)
+	if c.Cadence.Months() == 1 {
+		return first
+	}
+	return first + " to " + month.AddDate(0, c.Cadence.Months()-1, 0).Format(billingMonthLayout)
+}
+
+// validateContract checks the fields the database doesn't constrain
+func validateContract(contract *Contract) error {
+	contract.Name = strings.TrimSpace(contract.Name)
+	if contract.Name == "" || contract.CompanyID == 0 || contract.ClientID == 0 || contract.RemitInformationID == 0 {
+		return errors.New("Name, company_id, client_id and remit_information_id are required")
+	}
+	if contract.Cadence == "" {
+		contract.Cadence = CadenceMonthly
+	}
+	if contract.Cadence.Months() == 0 {
+		return errors.New("Cadence must be monthly, quarterly or yearly")
+	}
+	if contract.StartDate.IsZero() {
+		return errors.New("Start date is required")
+	}
+	if contract.EndDate != nil && contract.EndDate.Before(contract.StartDate) {
+		return errors.New("End date can't be before the start date")
+	}
+	if len(contract.Lines) == 0 {
+		return errors.New("A contract needs at least one line")
+	}
+	for i := range contract.Lines {
+		line := &contract.Lines[i]
+		if line.ProductID == 0 || line.Quantity <= 0 {
+			return errors.New("Contract lines need a product_id and a positive quantity")
+		}
+		if line.UnitPrice < 0 {
+			return errors.New("Unit price can't be negative")
+		}
+		line.ID, line.ContractID = 0, contract.ID
+	}
+	return nil
+}
+
+func (r *Repository) GetContracts(filter ContractFilter) ([]Contract, error) {
+	query := r.db.Preload("Client").Preload("Lines.Product")
+	if filter.ClientID != nil {
+		query = query.Where("client_id = ?", *filter.ClientID)
+	}
+	if filter.ActiveOn != nil {
+		query = query.Where("start_date < ? AND (end_date IS NULL OR end_date >= ?)", filter.ActiveOn.AddDate(0, 0, 1), *filter.ActiveOn)
+	}
+
+	var contracts []Contract
+	err := query.Order("id").Find(&contracts).Error
+	return contracts, err
+}
+
+func (r *Repository) GetContract(id uint) (*Contract, error) {
+	var contract Contract
+	if err := r.db.Preload("Lines.Product").First(&contract, id).Error; err != nil {
+		return nil, err
+	}
+	return &contract, nil
+}
+
+func (r *Repository) CreateContract(contract *Contract) error {
+	return retryOnBusy(func() error {
+		return r.db.Omit("Lines.Product").Create(contract).Error
+	})
+}
+
+// UpdateContract saves the contract, its lines replaced by the given ones
+func (r *Repository) UpdateContract(contract *Contract) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&Contract{}, contract.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("contract_id = ?", contract.ID).Delete(&ContractLine{}).Error; err != nil {
+				return err
+			}
+			return tx.Omit("Lines.Product").Save(contract).Error
+		})
+	})
+}
+
+// DeleteContract removes the contract, the invoices it billed are kept
+func (r *Repository) DeleteContract(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("contract_id = ?", id).Delete(&ContractBilling{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("contract_id = ?", id).Delete(&ContractLine{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&Contract{}, id).Error
+		})
+	})
+}
+
+func (r *Repository) GetContractBillings(month string) ([]ContractBilling, error) {
+	var billings []ContractBilling
+	err := r.db.Where("month = ?", month).Order("contract_id").Find(&billings).Error
+	return billings, err
+}
+
+// BillContract invoices the period of the contract starting in month,
+// issued on issueDate, and records it as billed
+func (r *Repository) BillContract(contract *Contract, month, issueDate time.Time) (*Invoice, error) {
+	month = monthStart(month)
+	information := fmt.Sprintf("%s, %s", contract.Name, contract.period(month))
+	invoice := Invoice{
+		IssueDate:             issueDate,
+		DueDate:               issueDate.AddDate(0, 0, consolidatedDueDays),
+		RemitInformationID:    contract.RemitInformationID,
+		CompanyID:             contract.CompanyID,
+		ClientID:              contract.ClientID,
+		AdditionalInformation: &information,
+	}
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			invoice.ID, invoice.InvoiceLines = 0, nil
+			for _, line := range contract.Lines {
+				invoice.InvoiceLines = append(invoice.InvoiceLines, InvoiceLine{
+					ProductID: &line.ProductID,
+					Quantity:  line.Quantity,
+					UnitPrice: line.UnitPrice,
+				})
+			}
+			if err := createInvoice(tx, &invoice); err != nil {
+				return err
+			}
+			return tx.Create(&ContractBilling{
+				ContractID: contract.ID,
+				Month:      month.Format(billingMonthLayout),
+				InvoiceID:  &invoice.ID,
+				BilledAt:   issueDate,
+			}).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := r.GetInvoice(invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(r, EventInvoiceCreated, created)
+	return created, nil
+}
+
+// GetRecurringRevenue adds up what the contracts active on the day bring
+// in a month
+func (r *Repository) GetRecurringRevenue(on time.Time) (*RecurringRevenue, error) {
+	contracts, err := r.GetContracts(ContractFilter{ActiveOn: &on})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RecurringRevenue{Date: on, Contracts: []ContractRecurringRevenue{}}
+	for _, contract := range contracts {
+		// Lines without a price bring what the client's price list says
+		for i := range contract.Lines {
+			line := &contract.Lines[i]
+			if line.UnitPrice != 0 {
+				continue
+			}
+			if line.UnitPrice, _, err = clientListPrice(r.db, contract.ClientID, line.ProductID, on); err != nil {
+				return nil, err
+			}
+		}
+		amount := contract.Amount()
+		line := ContractRecurringRevenue{
+			ContractID: contract.ID,
+			Name:       contract.Name,
+			ClientID:   contract.ClientID,
+			Cadence:    contract.Cadence,
+			Amount:     amount,
+			Monthly:    amount.Per(float64(contract.Cadence.Months())),
+		}
+		report.MRR += line.Monthly
+		report.Contracts = append(report.Contracts, line)
+	}
+	return report, nil
+}
+
+// Contract handlers
+func (h *Handler) getContracts(w http.ResponseWriter, r *http.Request) {
+	var filter ContractFilter
+	var err error
+	if filter.ClientID, err = parseOptionalUint(r, "client_id"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.ActiveOn, err = parseDateQuery(r, "active_on"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contracts, err := h.storeFor(r).GetContracts(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contracts)
+}
+
+func (h *Handler) getContract(w http.ResponseWriter, r *http.Request) {
+	contractIdStr := r.PathValue("contractId")
+	contractId, err := strconv.ParseUint(contractIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid contract ID", http.StatusBadRequest)
+		return
+	}
+
+	contract, err := h.storeFor(r).GetContract(uint(contractId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contract)
+}
+
+func (h *Handler) createContract(w http.ResponseWriter, r *http.Request) {
+	var contract Contract
+	if err := decodeRequest(r, &contract); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contract.ID = 0
+
+	if err := validateContract(&contract); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateContract(&contract); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	created, err := h.storeFor(r).GetContract(contract.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *Handler) updateContract(w http.ResponseWriter, r *http.Request) {
+	contractIdStr := r.PathValue("contractId")
+	contractId, err := strconv.ParseUint(contractIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid contract ID", http.StatusBadRequest)
+		return
+	}
+
+	var contract Contract
+	if err := decodeRequest(r, &contract); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contract.ID = uint(contractId)
+	if err := validateContract(&contract); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UpdateContract(&contract); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	updated, err := h.storeFor(r).GetContract(contract.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *Handler) deleteContract(w http.ResponseWriter, r *http.Request) {
+	contractIdStr := r.PathValue("contractId")
+	contractId, err := strconv.ParseUint(contractIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid contract ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteContract(uint(contractId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRecurringRevenue(w http.ResponseWriter, r *http.Request) {
+	date, err := parseDateQuery(r, "date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if date == nil {
+		now := clock.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		date = &today
+	}
+
+	report, err := h.storeFor(r).GetRecurringRevenue(*date)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
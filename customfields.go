@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrCustomFieldKey is returned when the entity already has a field with
+// that key
+var ErrCustomFieldKey = errors.New("a custom field of that entity already has that key")
+
+// CustomFieldEntity is what a custom field is added to
+type CustomFieldEntity string
+
+const (
+	CustomFieldCompany CustomFieldEntity = "company"
+	CustomFieldInvoice CustomFieldEntity = "invoice"
+)
+
+// CustomFieldType is what the values of a custom field hold
+type CustomFieldType string
+
+const (
+	CustomFieldText    CustomFieldType = "text"
+	CustomFieldNumber  CustomFieldType = "number"
+	CustomFieldDate    CustomFieldType = "date"
+	CustomFieldBoolean CustomFieldType = "boolean"
+	// CustomFieldChoice holds one of the options of the field
+	CustomFieldChoice CustomFieldType = "choice"
+)
+
+var customFieldTypes = map[CustomFieldType]bool{
+	CustomFieldText:    true,
+	CustomFieldNumber:  true,
+	CustomFieldDate:    true,
+	CustomFieldBoolean: true,
+	CustomFieldChoice:  true,
+}
+
+// customFieldKeyPattern keeps keys usable in templates, as
+// {{.Invoice.CustomFields.po_number}}
+var customFieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// CustomField is a field the users add to companies or invoices, e.g. the
+// purchase order number a client wants on its invoices, without a schema
+// change. The values are kept on the records, under the key of the field.
+type CustomField struct {
+	ID       uint               `gorm:"primaryKey" json:"id"`
+	Entity   CustomFieldEntity  `gorm:"size:20;not null;uniqueIndex:idx_custom_fields_key" json:"entity"`
+	Key      string             `gorm:"size:50;not null;uniqueIndex:idx_custom_fields_key" json:"key"`
+	Label    string             `gorm:"size:255;not null" json:"label"`
+	Type     CustomFieldType    `gorm:"size:20;not null" json:"type"`
+	Options  CustomFieldOptions `gorm:"type:text" json:"options"`
+	Required bool               `gorm:"not null;default:false" json:"required"`
+}
+
+// CustomFieldOptions are the values a choice field accepts, stored as JSON
+type CustomFieldOptions []string
+
+func (o CustomFieldOptions) Value() (driver.Value, error) {
+	if len(o) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(o)
+	return string(encoded), err
+}
+
+func (o *CustomFieldOptions) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*o = CustomFieldOptions{}
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	case []byte:
+		return json.Unmarshal(v, o)
+	default:
+		return fmt.Errorf("cannot scan %T into CustomFieldOptions", value)
+	}
+}
+
+// CustomFieldValues are the values of the custom fields of a record, by
+// key, stored as JSON
+type CustomFieldValues map[string]string
+
+func (v CustomFieldValues) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(v)
+	return string(encoded), err
+}
+
+func (v *CustomFieldValues) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*v = CustomFieldValues{}
+		return nil
+	case string:
+		return json.Unmarshal([]byte(data), v)
+	case []byte:
+		return json.Unmarshal(data, v)
+	default:
+		return fmt.Errorf("cannot scan %T into CustomFieldValues", value)
+	}
+}
+
+// validateCustomField checks the fields the database doesn't constrain
+func validateCustomField(field *CustomField) error {
+	if field.Entity != CustomFieldCompany && field.Entity != CustomFieldInvoice {
+		return errors.New("Invalid entity, expected company or invoice")
+	}
+	if !customFieldKeyPattern.MatchString(field.Key) {
+		return errors.New("Invalid key, use lowercase letters, digits and underscores, starting with a letter")
+	}
+	field.Label = strings.TrimSpace(field.Label)
+	if field.Label == "" {
+		return errors.New("Label is required")
+	}
+	if !customFieldTypes[field.Type] {
+		return errors.New("Invalid type, expected text, number, date, boolean or choice")
+	}
+	if field.Type == CustomFieldChoice && len(field.Options) == 0 {
+		return errors.New("Choice fields need options")
+	}
+	if field.Type != CustomFieldChoice {
+		field.Options = nil
+	}
+	return nil
+}
+
+// check tells whether the value fits the type of the field
+func (f *CustomField) check(value string) error {
+	var err error
+	switch f.Type {
+	case CustomFieldNumber:
+		_, err = strconv.ParseFloat(value, 64)
+	case CustomFieldDate:
+		_, err = parseDate(value)
+	case CustomFieldBoolean:
+		_, err = strconv.ParseBool(value)
+	case CustomFieldChoice:
+		err = errors.New("not an option")
+		for _, option := range f.Options {
+			if option == value {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q for custom field %s", f.Type, value, f.Key)
+	}
+	return nil
+}
+
+// checkCustomFields checks the values of a record against the custom
+// fields of its entity. Empty values are dropped.
+func checkCustomFields(store Store, entity CustomFieldEntity, values CustomFieldValues) error {
+	fields, err := store.GetCustomFields(entity)
+	if err != nil {
+		return err
+	}
+	defined := map[string]*CustomField{}
+	for i := range fields {
+		defined[fields[i].Key] = &fields[i]
+	}
+
+	for key, value := range values {
+		field, ok := defined[key]
+		if !ok {
+			return fmt.Errorf("Unknown custom field %s", key)
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			delete(values, key)
+			continue
+		}
+		if err := field.check(value); err != nil {
+			return err
+		}
+		values[key] = value
+	}
+	for _, field := range fields {
+		if _, ok := values[field.Key]; field.Required && !ok {
+			return fmt.Errorf("Custom field %s is required", field.Key)
+		}
+	}
+	return nil
+}
+
+// GetCustomFields lists the custom fields of the entity, every one when
+// entity is empty
+func (r *Repository) GetCustomFields(entity CustomFieldEntity) ([]CustomField, error) {
+	fields := []CustomField{}
+	query := r.db.Order("entity, key")
+	if entity != "" {
+		query = query.Where("entity = ?", entity)
+	}
+	err := query.Find(&fields).Error
+	return fields, err
+}
+
+func (r *Repository) GetCustomField(id uint) (*CustomField, error) {
+	var field CustomField
+	if err := r.db.First(&field, id).Error; err != nil {
+		return nil, err
+	}
+	return &field, nil
+}
+
+func (r *Repository) CreateCustomField(field *CustomField) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var taken int64
+			if err := tx.Model(&CustomField{}).Where("entity = ? AND key = ?", field.Entity, field.Key).Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return ErrCustomFieldKey
+			}
+			return tx.Create(field).Error
+		})
+	})
+}
+
+func (r *Repository) UpdateCustomField(field *CustomField) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&CustomField{}, field.ID).Error; err != nil {
+				return err
+			}
+			return tx.Save(field).Error
+		})
+	})
+}
+
+// customFieldTables are the tables holding the values of each entity
+var customFieldTables = map[CustomFieldEntity]interface{}{
+	CustomFieldCompany: &Company{},
+	CustomFieldInvoice: &Invoice{},
+}
+
+// DeleteCustomField removes the field and its values from the records
+func (r *Repository) DeleteCustomField(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var field CustomField
+			if err := tx.First(&field, id).Error; err != nil {
+				return err
+			}
+
+			var records []struct {
+				ID           uint
+				CustomFields CustomFieldValues `gorm:"type:text"`
+			}
+			model := customFieldTables[field.Entity]
+			err := tx.Model(model).Select("id, custom_fields").
+				Where(`custom_fields LIKE ? ESCAPE '\'`, likeContains(strconv.Quote(field.Key)+":")).
+				Scan(&records).Error
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				delete(record.CustomFields, field.Key)
+				if err := tx.Model(model).Where("id = ?", record.ID).UpdateColumn("custom_fields", record.CustomFields).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&field).Error
+		})
+	})
+}
+
+// Custom field handlers
+func (h *Handler) getCustomFields(w http.ResponseWriter, r *http.Request) {
+	fields, err := h.storeFor(r).GetCustomFields(CustomFieldEntity(r.URL.Query().Get("entity")))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
+
+func (h *Handler) createCustomField(w http.ResponseWriter, r *http.Request) {
+	var field CustomField
+	if err := decodeRequest(r, &field); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	field.ID = 0
+
+	if err := validateCustomField(&field); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateCustomField(&field); err != nil {
+		if errors.Is(err, ErrCustomFieldKey) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(field)
+}
+
+func (h *Handler) updateCustomField(w http.ResponseWriter, r *http.Request) {
+	customFieldIdStr := r.PathValue("customFieldId")
+	customFieldId, err := strconv.ParseUint(customFieldIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid custom field ID", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.storeFor(r).GetCustomField(uint(customFieldId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var field CustomField
+	if err := decodeRequest(r, &field); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The label, options and whether the field is required change, the
+	// values were stored by the entity, key and type
+	field.ID, field.Entity, field.Key, field.Type = existing.ID, existing.Entity, existing.Key, existing.Type
+	if err := validateCustomField(&field); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UpdateCustomField(&field); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(field)
+}
+
+func (h *Handler) deleteCustomField(w http.ResponseWriter, r *http.Request) {
+	customFieldIdStr := r.PathValue("customFieldId")
+	customFieldId, err := strconv.ParseUint(customFieldIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid custom field ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteCustomField(uint(customFieldId)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// recentInvoicesLimit is how many invoices the dashboard lists
+const recentInvoicesLimit = 10
+
+// DashboardStats aggregates the invoices, drafts included
+type DashboardStats struct {
+	Invoices      InvoiceTotals
+	Open          int
+	OpenAmount    Money
+	Overdue       int
+	OverdueAmount Money
+	NPS           *NPSScore
+}
+
+// DashboardData is what the dashboard page shows
+type DashboardData struct {
+	Companies         []Company
+	Products          []Product
+	RemitInformations []RemitInformation
+	RecentInvoices    []InvoiceSummary
+	Stats             DashboardStats
+	// Cache tells whether the stats and the recent invoices were cached
+	Cache ReadModelStatus
+}
+
+// DashboardSummary is the read model of the dashboard: its figures and the
+// latest invoices
+type DashboardSummary struct {
+	Stats          DashboardStats
+	RecentInvoices []InvoiceSummary
+	Cache          ReadModelStatus `json:"-"`
+}
+
+// GetDashboardSummary computes the dashboard figures, cached until the next
+// write
+func (r *Repository) GetDashboardSummary() (*DashboardSummary, error) {
+	summary, status, err := cachedReadModel(r, "dashboard", func() (DashboardSummary, error) {
+		var summary DashboardSummary
+		filter := InvoiceFilter{Type: DocumentInvoice}
+		stats, err := r.dashboardStats(filter, clock.Now())
+		if err != nil {
+			return summary, err
+		}
+		summary.Stats = *stats
+		if summary.RecentInvoices, err = r.invoiceSummaries(filter, "invoices.id DESC", recentInvoicesLimit); err != nil {
+			return summary, err
+		}
+
+		summary.Stats.NPS, err = r.GetNPSScore(nil)
+		return summary, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	summary.Cache = status
+	return &summary, nil
+}
+
+// dashboardStats sums the invoices matched by filter in a single query,
+// telling the open and overdue ones apart as their summaries would
+func (r *Repository) dashboardStats(filter InvoiceFilter, now time.Time) (*DashboardStats, error) {
+	var row struct {
+		InvoiceTotals
+		Open          int
+		OpenAmount    Money
+		Overdue       int
+		OverdueAmount Money
+	}
+	err := filter.apply(r.db.Model(&Invoice{})).
+		Select(`COUNT(*) AS count, COALESCE(SUM(subtotal), 0) AS sub_total, COALESCE(SUM(tax_total), 0) AS tax_total,
+			COALESCE(SUM(total), 0) AS total,
+			COALESCE(SUM((SELECT SUM(amount) FROM payments WHERE payments.invoice_id = invoices.id)), 0) AS paid,
+			COUNT(CASE WHEN NOT paid AND cancelled_at IS NULL AND disputed_at IS NULL AND due_date >= @now THEN 1 END) AS open,
+			COALESCE(SUM(CASE WHEN NOT paid AND cancelled_at IS NULL AND disputed_at IS NULL AND due_date >= @now THEN total END), 0) AS open_amount,
+			COUNT(CASE WHEN NOT paid AND cancelled_at IS NULL AND disputed_at IS NULL AND due_date < @now THEN 1 END) AS overdue,
+			COALESCE(SUM(CASE WHEN NOT paid AND cancelled_at IS NULL AND disputed_at IS NULL AND due_date < @now THEN total END), 0) AS overdue_amount`,
+			sql.Named("now", now)).
+		Scan(&row).Error
+	if err != nil {
+		return nil, err
+	}
+	return &DashboardStats{
+		Invoices:      row.InvoiceTotals,
+		Open:          row.Open,
+		OpenAmount:    row.OpenAmount,
+		Overdue:       row.Overdue,
+		OverdueAmount: row.OverdueAmount,
+	}, nil
+}
+
+// GetDashboardData gathers the dashboard from the store. Archived companies
+// and products are left out.
+func GetDashboardData(store Store) (*DashboardData, error) {
+	active := false
+	var data DashboardData
+	var err error
+	if data.Companies, err = store.GetCompanies(CompanyFilter{Archived: &active}); err != nil {
+		return nil, err
+	}
+	if data.Products, err = store.GetProducts(ProductFilter{Archived: &active}); err != nil {
+		return nil, err
+	}
+	if data.RemitInformations, err = store.GetRemitInformations(RemitFilter{Template: new(bool)}); err != nil {
+		return nil, err
+	}
+
+	summary, err := store.GetDashboardSummary()
+	if err != nil {
+		return nil, err
+	}
+	data.Stats, data.RecentInvoices, data.Cache = summary.Stats, summary.RecentInvoices, summary.Cache
+	return &data, nil
+}
+
+// Reference is how the dashboard names the invoice: its code, its number,
+// or the start of its UUID while it has neither
+func (s InvoiceSummary) Reference() string {
+	switch {
+	case s.Code != "":
+		return s.Code
+	case s.Number != nil && *s.Number != 0:
+		return fmt.Sprintf("#%d", *s.Number)
+	default:
+		return s.UUID.String()[:8]
+	}
+}
+
+func (h *Handler) viewDashboard(w http.ResponseWriter, r *http.Request) {
+	data, err := GetDashboardData(h.storeFor(r))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	tmplPath := filepath.Join("templates", "dashboard.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	setCacheHeaders(w, "X-Read-Model-Cache", data.Cache)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
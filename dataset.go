@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const datasetFormat = "tiny-crm"
+
+var (
+	ErrDatasetNotEmpty = errors.New("the database already holds companies, products, remit information, invoices or projects, import into an empty one")
+	ErrDatasetInvalid  = errors.New("invalid dataset")
+)
+
+// Dataset is every row of every table, users and their password hashes
+// included, keyed by column so nothing hidden from the API is lost. IDs are
+// kept, so the references between rows hold once imported.
+type Dataset struct {
+	Format        string                              `json:"format"`
+	SchemaVersion int                                 `json:"schema_version"`
+	ExportedAt    time.Time                           `json:"exported_at"`
+	Tables        map[string][]map[string]interface{} `json:"tables"`
+}
+
+// datasetDataTables are the tables an import refuses to overwrite. The
+// others are filled on their own, by signing in or starting the server.
+var datasetDataTables = []interface{}{&Company{}, &Product{}, &RemitInformation{}, &Invoice{}, &Project{}}
+
+// latestSchemaVersion is the version of the last migration
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func (r *Repository) parseModel(model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: r.db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// ExportDataset reads every table of the schema
+func (r *Repository) ExportDataset(now time.Time) (*Dataset, error) {
+	dataset := &Dataset{Format: datasetFormat, SchemaVersion: latestSchemaVersion(), ExportedAt: now, Tables: map[string][]map[string]interface{}{}}
+	for _, model := range schemaModels {
+		modelSchema, err := r.parseModel(model)
+		if err != nil {
+			return nil, err
+		}
+		query := r.db.Table(modelSchema.Table)
+		if modelSchema.PrioritizedPrimaryField != nil {
+			query = query.Order(modelSchema.PrioritizedPrimaryField.DBName)
+		}
+		rows := []map[string]interface{}{}
+		if err := query.Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		dataset.Tables[modelSchema.Table] = rows
+	}
+	return dataset, nil
+}
+
+// datasetValue turns a value decoded from JSON back into what the column
+// stores: times from their RFC 3339 text and whole numbers as integers
+func datasetValue(field *schema.Field, value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer, nil
+		}
+		return value.Float64()
+	case string:
+		if field != nil && field.DataType == schema.Time {
+			return time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	return value, nil
+}
+
+// ImportDataset fills the tables with the rows of the dataset, replacing
+// the rows filled on their own, in one transaction. The references are
+// checked once every row is in.
+func (r *Repository) ImportDataset(dataset *Dataset) error {
+	if dataset.Format != datasetFormat {
+		return fmt.Errorf("%w: not a %s dataset", ErrDatasetInvalid, datasetFormat)
+	}
+	if dataset.SchemaVersion != latestSchemaVersion() {
+		return fmt.Errorf("%w: exported at schema version %d, this instance is at %d", ErrDatasetInvalid, dataset.SchemaVersion, latestSchemaVersion())
+	}
+	for _, model := range datasetDataTables {
+		var count int64
+		if err := r.db.Model(model).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrDatasetNotEmpty
+		}
+	}
+
+	known := map[string]bool{}
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("PRAGMA defer_foreign_keys = ON").Error; err != nil {
+				return err
+			}
+			for _, model := range schemaModels {
+				modelSchema, err := r.parseModel(model)
+				if err != nil {
+					return err
+				}
+				known[modelSchema.Table] = true
+				if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Table(modelSchema.Table).Delete(nil).Error; err != nil {
+					return err
+				}
+
+				rows := dataset.Tables[modelSchema.Table]
+				for _, row := range rows {
+					for column, value := range row {
+						field := modelSchema.LookUpField(column)
+						if field == nil {
+							return fmt.Errorf("%w: unknown column %s.%s", ErrDatasetInvalid, modelSchema.Table, column)
+						}
+						if row[column], err = datasetValue(field, value); err != nil {
+							return fmt.Errorf("%w: %s.%s: %v", ErrDatasetInvalid, modelSchema.Table, column, err)
+						}
+					}
+				}
+				if len(rows) > 0 {
+					if err := tx.Table(modelSchema.Table).CreateInBatches(rows, 100).Error; err != nil {
+						return err
+					}
+				}
+			}
+			for table := range dataset.Tables {
+				if !known[table] {
+					return fmt.Errorf("%w: unknown table %s", ErrDatasetInvalid, table)
+				}
+			}
+
+			var violations []map[string]interface{}
+			if err := tx.Raw("PRAGMA foreign_key_check").Scan(&violations).Error; err != nil {
+				return err
+			}
+			if len(violations) > 0 {
+				return fmt.Errorf("%w: %d rows refer to rows missing from the dataset, e.g. in %v", ErrDatasetInvalid, len(violations), violations[0]["table"])
+			}
+			return nil
+		})
+	})
+}
+
+// decodeDataset reads a dataset, keeping numbers exact
+func decodeDataset(data []byte) (*Dataset, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var dataset Dataset
+	if err := decoder.Decode(&dataset); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatasetInvalid, err)
+	}
+	return &dataset, nil
+}
+
+// writeDatasetZip writes the dataset as dataset.json, with the files of the
+// attachments under attachments/
+func writeDatasetZip(w io.Writer, dataset *Dataset) error {
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("dataset.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(dataset); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, row := range dataset.Tables["attachments"] {
+		attachment := Attachment{}
+		attachment.SHA256, _ = row["sha256"].(string)
+		if id, ok := row["uuid"].(string); ok {
+			attachment.UUID.UnmarshalText([]byte(id))
+		}
+		name := attachment.contentKey()
+		if written[name] {
+			continue
+		}
+		data, err := attachment.Read()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		file, err := archive.Create(path.Join("attachments", name))
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+		written[name] = true
+	}
+	return archive.Close()
+}
+
+// readDatasetZip reads the dataset of a zip, storing its files among the
+// attachments
+func readDatasetZip(data []byte) (*Dataset, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatasetInvalid, err)
+	}
+
+	var dataset *Dataset
+	for _, file := range archive.File {
+		content, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDatasetInvalid, err)
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDatasetInvalid, err)
+		}
+
+		switch {
+		case file.Name == "dataset.json":
+			if dataset, err = decodeDataset(data); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(file.Name, "attachments/") && path.Base(file.Name) == strings.TrimPrefix(file.Name, "attachments/"):
+			if err := fileStorage.Put(path.Base(file.Name), data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if dataset == nil {
+		return nil, fmt.Errorf("%w: no dataset.json in the zip", ErrDatasetInvalid)
+	}
+	return dataset, nil
+}
+
+// readDataset reads a dataset from JSON or from a zip with its files
+func readDataset(data []byte) (*Dataset, error) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		return readDatasetZip(data)
+	}
+	return decodeDataset(data)
+}
+
+// exportDataset answers the whole dataset as JSON, ?format=zip adds the
+// files of the attachments
+func (h *Handler) exportDataset(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		http.Error(w, fmt.Sprintf("Invalid format %q, expected json or zip", format), http.StatusBadRequest)
+		return
+	}
+
+	now := clock.Now()
+	dataset, err := h.storeFor(r).ExportDataset(now)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	filename := "tinycrm_" + now.Format("20060102")
+	if format == "zip" {
+		var buffer bytes.Buffer
+		if err := writeDatasetZip(&buffer, dataset); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+		w.Write(buffer.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+	json.NewEncoder(w).Encode(dataset)
+}
+
+// importDataset restores an export, JSON or zip, into an empty database
+func (h *Handler) importDataset(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dataset, err := readDataset(data)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrDatasetInvalid) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	store := h.storeFor(r)
+	if err := store.ImportDataset(dataset); err != nil {
+		switch {
+		case errors.Is(err, ErrDatasetNotEmpty):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrDatasetInvalid):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+	if err := loadSettings(store); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	settingsSaved()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(datasetRowCounts(dataset))
+}
+
+// datasetRowCounts is how many rows each table of the dataset has
+func datasetRowCounts(dataset *Dataset) map[string]int {
+	counts := map[string]int{}
+	for table, rows := range dataset.Tables {
+		counts[table] = len(rows)
+	}
+	return counts
+}
+
+// runDatasetCommand exports the dataset to the file, or imports it from
+// the file, as JSON or as a zip by the extension
+func runDatasetCommand(store Store, command, filename string) {
+	if command == "export" {
+		dataset, err := store.ExportDataset(clock.Now())
+		if err != nil {
+			fmt.Printf("Error exporting the dataset: %v\n", err)
+			os.Exit(1)
+		}
+		var buffer bytes.Buffer
+		if strings.HasSuffix(filename, ".zip") {
+			err = writeDatasetZip(&buffer, dataset)
+		} else {
+			err = json.NewEncoder(&buffer).Encode(dataset)
+		}
+		if err == nil {
+			err = os.WriteFile(filename, buffer.Bytes(), 0o600)
+		}
+		if err != nil {
+			fmt.Printf("Error writing %s: %v\n", filename, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %v to %s\n", datasetRowCounts(dataset), filename)
+		return
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	dataset, err := readDataset(data)
+	if err == nil {
+		err = store.ImportDataset(dataset)
+	}
+	if err != nil {
+		fmt.Printf("Error importing %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %v from %s\n", datasetRowCounts(dataset), filename)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/logger"
+)
+
+// debugSQLHeader asks for the SQL of the request, like ?debug_sql=1, and
+// carries the queries back in the trailer
+const debugSQLHeader = "X-Debug-SQL"
+
+// maxDebugQueries caps the queries returned, the rest are only counted
+const maxDebugQueries = 200
+
+type sqlRecorderContextKey struct{}
+
+// sqlRecorder is a GORM logger keeping the queries of one request
+type sqlRecorder struct {
+	mu      sync.Mutex
+	queries []string
+	total   int
+}
+
+func (s *sqlRecorder) LogMode(logger.LogLevel) logger.Interface { return s }
+
+func (s *sqlRecorder) Info(context.Context, string, ...interface{})  {}
+func (s *sqlRecorder) Warn(context.Context, string, ...interface{})  {}
+func (s *sqlRecorder) Error(context.Context, string, ...interface{}) {}
+
+// Trace records the query, on a single line so it fits in a header
+func (s *sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, rows := fc()
+	query := fmt.Sprintf("%.3fms rows=%d %s", float64(time.Since(begin).Microseconds())/1000, rows, strings.Join(strings.Fields(sql), " "))
+	if err != nil {
+		query += " error=" + strings.Join(strings.Fields(err.Error()), " ")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	if len(s.queries) < maxDebugQueries {
+		s.queries = append(s.queries, query)
+	}
+}
+
+// debugSQLRequested reports whether the request asks for its SQL
+func debugSQLRequested(r *http.Request) bool {
+	value := r.URL.Query().Get("debug_sql")
+	if value == "" {
+		value = r.Header.Get(debugSQLHeader)
+	}
+	return value == "1" || value == "true"
+}
+
+// withSQLRecorder records the SQL run while serving the request, returned
+// in X-Debug-SQL trailers, one per query, and in the server log. The
+// handlers pick the recorder up through storeFor.
+func withSQLRecorder(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &sqlRecorder{}
+		next(w, r.WithContext(context.WithValue(r.Context(), sqlRecorderContextKey{}, recorder)))
+
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		// Trailers, the body may be written already
+		for _, query := range recorder.queries {
+			w.Header().Add(http.TrailerPrefix+debugSQLHeader, query)
+		}
+		w.Header().Set(http.TrailerPrefix+debugSQLHeader+"-Count", fmt.Sprint(recorder.total))
+		log.Printf("SQL of %s %s request_id=%s: %d queries\n  %s", r.Method, r.URL.Path, requestIDFrom(r.Context()), recorder.total, strings.Join(recorder.queries, "\n  "))
+	}
+}
+
+// debugSQLMiddleware records the SQL of the requests asking for it, when
+// they come from an administrator since it shows everybody's data
+func debugSQLMiddleware(next http.HandlerFunc, testing bool) http.HandlerFunc {
+	recorded := withSQLRecorder(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userContextKey{}).(*User)
+		if debugSQLRequested(r) && (testing || ok && user.IsAdmin) {
+			recorded(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
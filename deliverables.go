@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Deliverable is billable work done for a client that isn't invoiced yet,
+// e.g. hours worked, an expense or a recurring fee. Deliverables are rolled
+// into a single invoice per month instead of one small invoice each.
+type Deliverable struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	CompanyID   uint      `gorm:"not null;index" json:"company_id"`
+	Company     Company   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	ClientID    uint      `gorm:"not null;index" json:"client_id"`
+	Client      Company   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	ProductID   uint      `gorm:"not null" json:"product_id"`
+	Product     Product   `gorm:"constraint:OnDelete:RESTRICT" json:"product"`
+	Quantity    float64   `gorm:"type:decimal(10,3);default:1;not null" json:"quantity"`
+	Description *string   `gorm:"size:255" json:"description"`
+	Date        time.Time `gorm:"not null;index" json:"date"`
+	// UnitPrice overrides the product price when set
+	UnitPrice Money    `gorm:"type:decimal(10,2);not null;default:0.00" json:"unit_price"`
+	InvoiceID *uint    `gorm:"index" json:"invoice_id"`
+	Invoice   *Invoice `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+}
+
+// ConsolidationResult reports the invoices consolidated for a client
+type ConsolidationResult struct {
+	ClientID uint `json:"client_id"`
+	// ContractID is set for the contracts invoiced by the billing run
+	ContractID uint   `json:"contract_id,omitempty"`
+	InvoiceIDs []uint `json:"invoice_ids"`
+	Error      string `json:"error,omitempty"`
+}
+
+// consolidatedDueDays is how long clients have to pay a consolidated invoice
+const consolidatedDueDays = 30
+
+var (
+	ErrDeliverableInvoiced  = errors.New("deliverable is already invoiced")
+	ErrNoConsolidationRemit = errors.New("client has no remit information to consolidate with")
+)
+
+// validateDeliverable checks the fields the database doesn't constrain
+func validateDeliverable(deliverable *Deliverable) error {
+	if deliverable.CompanyID == 0 || deliverable.ClientID == 0 || deliverable.ProductID == 0 {
+		return errors.New("company_id, client_id and product_id are required")
+	}
+	if !validQuantity(deliverable.Quantity) {
+		return errors.New("quantity must be positive, with up to 3 decimals")
+	}
+	if deliverable.UnitPrice < 0 {
+		return errors.New("unit price can't be negative")
+	}
+	if deliverable.Date.IsZero() {
+		deliverable.Date = clock.Now()
+	}
+	return nil
+}
+
+// monthStart is the first instant of the month of t, in the business time
+// zone
+func monthStart(t time.Time) time.Time {
+	t = t.In(config.Location())
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+func (r *Repository) GetDeliverables(clientID *uint, invoiced *bool) ([]Deliverable, error) {
+	var deliverables []Deliverable
+	query := r.db.Preload("Product")
+	if clientID != nil {
+		query = query.Where("client_id = ?", *clientID)
+	}
+	if invoiced != nil {
+		if *invoiced {
+			query = query.Where("invoice_id IS NOT NULL")
+		} else {
+			query = query.Where("invoice_id IS NULL")
+		}
+	}
+	err := query.Order("date, id").Find(&deliverables).Error
+	return deliverables, err
+}
+
+func (r *Repository) CreateDeliverable(deliverable *Deliverable) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(deliverable).Error
+	})
+}
+
+// DeleteDeliverable removes a deliverable that isn't invoiced yet
+func (r *Repository) DeleteDeliverable(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var deliverable Deliverable
+			if err := tx.First(&deliverable, id).Error; err != nil {
+				return err
+			}
+			if deliverable.InvoiceID != nil {
+				return ErrDeliverableInvoiced
+			}
+			return tx.Delete(&deliverable).Error
+		})
+	})
+}
+
+// ConsolidateDeliverables invoices the deliverables of the client dated in
+// the month of month that aren't invoiced yet, one invoice per issuing
+// company, issued on issueDate. remitID defaults to the client's
+// consolidation remit information.
+func (r *Repository) ConsolidateDeliverables(clientID uint, month, issueDate time.Time, remitID *uint) ([]Invoice, error) {
+	var invoiceIDs []uint
+	err := retryOnBusy(func() error {
+		invoiceIDs = nil
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var client Company
+			if err := tx.First(&client, clientID).Error; err != nil {
+				return err
+			}
+			if remitID == nil {
+				remitID = client.ConsolidationRemitID
+			}
+			if remitID == nil {
+				return ErrNoConsolidationRemit
+			}
+
+			from := monthStart(month)
+			var deliverables []Deliverable
+			err := tx.Where("client_id = ? AND invoice_id IS NULL AND date >= ? AND date < ?", clientID, from, from.AddDate(0, 1, 0)).
+				Order("company_id, date, id").Find(&deliverables).Error
+			if err != nil {
+				return err
+			}
+
+			byCompany := map[uint][]Deliverable{}
+			var companyIDs []uint
+			for _, deliverable := range deliverables {
+				if _, ok := byCompany[deliverable.CompanyID]; !ok {
+					companyIDs = append(companyIDs, deliverable.CompanyID)
+				}
+				byCompany[deliverable.CompanyID] = append(byCompany[deliverable.CompanyID], deliverable)
+			}
+
+			for _, companyID := range companyIDs {
+				invoice := Invoice{
+					IssueDate:          issueDate,
+					DueDate:            issueDate.AddDate(0, 0, consolidatedDueDays),
+					RemitInformationID: *remitID,
+					CompanyID:          companyID,
+					ClientID:           clientID,
+				}
+				var ids []uint
+				for _, deliverable := range byCompany[companyID] {
+					invoice.InvoiceLines = append(invoice.InvoiceLines, InvoiceLine{
+						ProductID:   &deliverable.ProductID,
+						Quantity:    deliverable.Quantity,
+						Description: deliverable.Description,
+						UnitPrice:   deliverable.UnitPrice,
+					})
+					ids = append(ids, deliverable.ID)
+				}
+				if err := createInvoice(tx, &invoice); err != nil {
+					return err
+				}
+				if err := tx.Model(&Deliverable{}).Where("id IN ?", ids).UpdateColumn("invoice_id", invoice.ID).Error; err != nil {
+					return err
+				}
+				invoiceIDs = append(invoiceIDs, invoice.ID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := []Invoice{}
+	for _, id := range invoiceIDs {
+		invoice, err := r.GetInvoice(id)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, *invoice)
+		publishEvent(r, EventInvoiceCreated, invoice)
+	}
+	return invoices, nil
+}
+
+// GetClientsConsolidatingOn returns the clients whose deliverables are
+// consolidated on the given day of the month
+func (r *Repository) GetClientsConsolidatingOn(day int) ([]Company, error) {
+	var clients []Company
+	err := r.db.Where("consolidation_day = ?", day).Order("id").Find(&clients).Error
+	return clients, err
+}
+
+// consolidateInvoices rolls the deliverables of the past month into one
+// invoice for every client consolidating today
+func consolidateInvoices(r Store, now time.Time) ([]ConsolidationResult, error) {
+	clients, err := r.GetClientsConsolidatingOn(now.Day())
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ConsolidationResult{}
+	for _, client := range clients {
+		result := ConsolidationResult{ClientID: client.ID, InvoiceIDs: []uint{}}
+		invoices, err := r.ConsolidateDeliverables(client.ID, monthStart(now).AddDate(0, -1, 0), now, nil)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		for _, invoice := range invoices {
+			result.InvoiceIDs = append(result.InvoiceIDs, invoice.ID)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Deliverable handlers
+func (h *Handler) getDeliverables(w http.ResponseWriter, r *http.Request) {
+	clientID, err := parseOptionalUint(r, "client_id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	invoiced, err := parseOptionalBool(r, "invoiced")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deliverables, err := h.storeFor(r).GetDeliverables(clientID, invoiced)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliverables)
+}
+
+func (h *Handler) createDeliverable(w http.ResponseWriter, r *http.Request) {
+	var deliverable Deliverable
+	if err := decodeRequest(r, &deliverable); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deliverable.ID, deliverable.InvoiceID = 0, nil
+
+	if err := validateDeliverable(&deliverable); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateDeliverable(&deliverable); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(deliverable)
+}
+
+func (h *Handler) deleteDeliverable(w http.ResponseWriter, r *http.Request) {
+	deliverableIdStr := r.PathValue("deliverableId")
+	deliverableId, err := strconv.ParseUint(deliverableIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid deliverable ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteDeliverable(uint(deliverableId)); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Deliverable not found", http.StatusNotFound)
+		case errors.Is(err, ErrDeliverableInvoiced):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) consolidateDeliverables(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Month              string `json:"month"`
+		RemitInformationID *uint  `json:"remit_information_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := clock.Now()
+	month := monthStart(now).AddDate(0, -1, 0)
+	if request.Month != "" {
+		if month, err = time.ParseInLocation("2006-01", request.Month, now.Location()); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid month %q, expected YYYY-MM", request.Month), http.StatusBadRequest)
+			return
+		}
+	}
+
+	invoices, err := h.storeFor(r).ConsolidateDeliverables(uint(companyId), month, now, request.RemitInformationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Company not found", http.StatusNotFound)
+		case errors.Is(err, ErrNoConsolidationRemit):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+func (h *Handler) postConsolidateInvoices(w http.ResponseWriter, r *http.Request) {
+	results, err := consolidateInvoices(h.storeFor(r), clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
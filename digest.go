@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DigestRun records the day a digest went out, so it goes out once
+type DigestRun struct {
+	Day    string    `gorm:"size:10;primaryKey" json:"day"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// Digest sums up a day: the invoices issued, the payments received, the
+// invoices gone overdue and the open tasks due the next day
+type Digest struct {
+	Since            time.Time        `json:"since"`
+	Until            time.Time        `json:"until"`
+	Issued           []InvoiceSummary `json:"issued"`
+	Payments         []Payment        `json:"payments"`
+	NewOverdue       []InvoiceSummary `json:"new_overdue"`
+	TasksDueTomorrow []Task           `json:"tasks_due_tomorrow"`
+}
+
+// startOfDay is midnight of the day of t, in the business time zone
+func startOfDay(t time.Time) time.Time {
+	t = t.In(config.Location())
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// invoiceSummariesWhere lists the invoices matching the condition
+func (r *Repository) invoiceSummariesWhere(query string, args ...interface{}) ([]InvoiceSummary, error) {
+	var ids []uint
+	if err := r.db.Model(&Invoice{}).Where("type = ?", DocumentInvoice).Where(query, args...).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []InvoiceSummary{}, nil
+	}
+	return r.GetInvoiceSummaries(InvoiceFilter{IDs: ids})
+}
+
+// GetDigest gathers the digest of what happened between since and now
+func (r *Repository) GetDigest(since, now time.Time) (*Digest, error) {
+	digest := &Digest{Since: since, Until: now, Payments: []Payment{}, TasksDueTomorrow: []Task{}}
+	var err error
+	if digest.Issued, err = r.invoiceSummariesWhere("issue_date >= ? AND issue_date < ?", since, now); err != nil {
+		return nil, err
+	}
+	// Invoices are overdue once their due date is past
+	if digest.NewOverdue, err = r.invoiceSummariesWhere("paid = ? AND cancelled_at IS NULL AND due_date >= ? AND due_date < ?", false, since, now); err != nil {
+		return nil, err
+	}
+	if err := r.db.Preload("Invoice.Client").Where("date >= ? AND date < ?", since, now).Order("date, id").Find(&digest.Payments).Error; err != nil {
+		return nil, err
+	}
+
+	tomorrow := startOfDay(now).AddDate(0, 0, 1)
+	err = r.db.Preload("Project").Where("status = ? AND due_date >= ? AND due_date < ?", TaskOpen, tomorrow, tomorrow.AddDate(0, 0, 1)).
+		Order("due_date, id").Find(&digest.TasksDueTomorrow).Error
+	if err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// DigestSent reports whether the digest of the day, YYYY-MM-DD, went out
+func (r *Repository) DigestSent(day string) (bool, error) {
+	var run DigestRun
+	err := r.db.Where("day = ?", day).First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *Repository) RecordDigestSent(day string, at time.Time) error {
+	return retryOnBusy(func() error {
+		return r.db.Save(&DigestRun{Day: day, SentAt: at}).Error
+	})
+}
+
+// Body is the text of the digest email
+func (d *Digest) Body() string {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hello,\n\nHere is your day, %s.\n", d.Since.Format("Monday 2 January 2006"))
+
+	fmt.Fprintf(&body, "\nInvoices issued (%d):\n", len(d.Issued))
+	for _, invoice := range d.Issued {
+		fmt.Fprintf(&body, "- %s to %s: %.2f\n", invoice.Reference(), invoice.ClientName, invoice.Total)
+	}
+	fmt.Fprintf(&body, "\nPayments received (%d):\n", len(d.Payments))
+	for _, payment := range d.Payments {
+		fmt.Fprintf(&body, "- %.2f from %s for invoice %s\n", payment.Amount, payment.Invoice.Client.Name, payment.Invoice.Identification())
+	}
+	fmt.Fprintf(&body, "\nInvoices gone overdue (%d):\n", len(d.NewOverdue))
+	for _, invoice := range d.NewOverdue {
+		fmt.Fprintf(&body, "- %s to %s: %.2f\n", invoice.Reference(), invoice.ClientName, invoice.Total)
+	}
+	fmt.Fprintf(&body, "\nTasks due tomorrow (%d):\n", len(d.TasksDueTomorrow))
+	for _, task := range d.TasksDueTomorrow {
+		fmt.Fprintf(&body, "- %s (%s)\n", task.Name, task.Project.Name)
+	}
+	return body.String()
+}
+
+// sendDigest emails the digest of the day so far to the notify email
+func sendDigest(store Store, now time.Time) (*Digest, error) {
+	if config.NotifyEmail == "" {
+		return nil, errors.New("no notify email to send the digest to")
+	}
+	if currentSettings().PauseNotifications {
+		return nil, ErrEmailsPaused
+	}
+	digest, err := store.GetDigest(startOfDay(now), now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendEmail(store, &Email{
+		To:      []string{config.NotifyEmail},
+		Subject: "Tiny CRM digest - " + now.Format("2006-01-02"),
+		Body:    digest.Body(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digest, store.RecordDigestSent(now.Format("2006-01-02"), now)
+}
+
+// sendDigestIfDue sends the digest once a day, from the digest hour on,
+// when it is enabled and the notifications aren't paused
+func sendDigestIfDue(store Store, now time.Time) (bool, error) {
+	now = now.In(config.Location())
+	if !config.Digest.Enabled || currentSettings().PauseNotifications || now.Hour() < config.Digest.Hour {
+		return false, nil
+	}
+	sent, err := store.DigestSent(now.Format("2006-01-02"))
+	if err != nil || sent {
+		return false, err
+	}
+	if _, err := sendDigest(store, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// scheduleDigest checks every minute whether the digest is due, by the
+// clock, so a simulated clock moved past the hour sends it too. One
+// instance checks each minute.
+func scheduleDigest(store Store) {
+	for range time.Tick(time.Minute) {
+		if !claimScheduledRun("digest", 55*time.Second) {
+			continue
+		}
+		if _, err := sendDigestIfDue(store, clock.Now()); err != nil {
+			log.Printf("Error sending the digest: %v", err)
+		}
+	}
+}
+
+// getDigest previews the digest of the day so far
+func (h *Handler) getDigest(w http.ResponseWriter, r *http.Request) {
+	now := clock.Now()
+	digest, err := h.storeFor(r).GetDigest(startOfDay(now), now)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digest)
+}
+
+// postSendDigest sends the digest of the day so far right away
+func (h *Handler) postSendDigest(w http.ResponseWriter, r *http.Request) {
+	digest, err := sendDigest(h.storeFor(r), clock.Now())
+	if errors.Is(err, ErrEmailsPaused) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digest)
+}
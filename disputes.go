@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// EventInvoiceDisputed carries the *InvoiceDispute opened
+const EventInvoiceDisputed = "invoice.disputed"
+
+var (
+	ErrDisputeOpen   = errors.New("the invoice is already disputed")
+	ErrNoDispute     = errors.New("the invoice is not disputed")
+	ErrNotDisputable = errors.New("only invoices sent and not paid yet can be disputed")
+)
+
+// InvoiceDispute is a client disagreeing with an invoice, flagged from its
+// public link. While one is open the invoice is disputed and gets no
+// reminders.
+type InvoiceDispute struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	InvoiceID uint      `gorm:"not null;index" json:"invoice_id"`
+	Invoice   Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Comment   string    `gorm:"type:text;not null" json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	// ResolvedAt closes the dispute, with what was agreed in Resolution
+	ResolvedAt   *time.Time `json:"resolved_at"`
+	ResolvedByID *uint      `json:"resolved_by_id"`
+	ResolvedBy   *User      `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	Resolution   string     `gorm:"type:text" json:"resolution"`
+}
+
+// Disputable reports whether the client can dispute the invoice: sent, not
+// paid or cancelled yet and not disputed already
+func (i *Invoice) Disputable() bool {
+	return !i.Draft() && !i.Paid && i.CancelledAt == nil && i.DisputedAt == nil && i.Type.Behavior().Payable
+}
+
+// validateDisputeText checks the comment or the resolution of a dispute
+func validateDisputeText(field, text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("%s is required", field)
+	}
+	if len(text) > 5000 {
+		return "", fmt.Errorf("%s can't be longer than 5000 characters", field)
+	}
+	return text, nil
+}
+
+// OpenInvoiceDispute records the dispute and flags its invoice disputed
+func (r *Repository) OpenInvoiceDispute(dispute *InvoiceDispute) error {
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var invoice Invoice
+			if err := tx.First(&invoice, dispute.InvoiceID).Error; err != nil {
+				return err
+			}
+			if invoice.DisputedAt != nil {
+				return ErrDisputeOpen
+			}
+			if !invoice.Disputable() {
+				return ErrNotDisputable
+			}
+			if err := tx.Omit("Invoice", "ResolvedBy").Create(dispute).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Invoice{}).Where("id = ?", invoice.ID).UpdateColumn("disputed_at", dispute.CreatedAt).Error; err != nil {
+				return err
+			}
+			return tx.Create(&InvoiceEvent{InvoiceID: invoice.ID, Type: "dispute_opened", Message: "Disputed by the client: " + dispute.Comment}).Error
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	publishEvent(r, EventInvoiceDisputed, dispute)
+	return nil
+}
+
+// ResolveInvoiceDispute closes the open dispute of the invoice, which gets
+// its reminders back
+func (r *Repository) ResolveInvoiceDispute(invoiceID uint, userID *uint, resolution string, now time.Time) (*InvoiceDispute, error) {
+	var dispute InvoiceDispute
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Where("invoice_id = ? AND resolved_at IS NULL", invoiceID).Order("id DESC").First(&dispute).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNoDispute
+			}
+			if err != nil {
+				return err
+			}
+			dispute.ResolvedAt, dispute.ResolvedByID, dispute.Resolution = &now, userID, resolution
+			if err := tx.Omit("Invoice", "ResolvedBy").Save(&dispute).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Invoice{}).Where("id = ?", invoiceID).UpdateColumn("disputed_at", nil).Error; err != nil {
+				return err
+			}
+			return tx.Create(&InvoiceEvent{InvoiceID: invoiceID, Type: "dispute_resolved", Message: "Dispute resolved: " + resolution}).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// GetInvoiceDisputes lists the disputes of the invoice, oldest first
+func (r *Repository) GetInvoiceDisputes(invoiceID uint) ([]InvoiceDispute, error) {
+	disputes := []InvoiceDispute{}
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at, id").Find(&disputes).Error
+	return disputes, err
+}
+
+// notifyDispute emails the team, the notify email and the owner of the
+// invoice, about the dispute unless the notifications are paused
+func notifyDispute(store Store, invoice *Invoice, dispute *InvoiceDispute) {
+	if currentSettings().PauseNotifications {
+		return
+	}
+	recipients := []string{}
+	if config.NotifyEmail != "" {
+		recipients = append(recipients, config.NotifyEmail)
+	}
+	if invoice.OwnerID != nil {
+		if owner, err := store.GetUser(*invoice.OwnerID); err == nil && owner.Email != "" && owner.Email != config.NotifyEmail {
+			recipients = append(recipients, owner.Email)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	email := &Email{
+		To:      recipients,
+		Subject: fmt.Sprintf("Invoice %s disputed by %s", invoice.Identification(), invoice.Client.Name),
+		Body: fmt.Sprintf("Hello,\n\n%s disputed invoice %s of %s, its reminders are paused until the dispute is resolved:\n\n%s\n",
+			invoice.Client.Name, invoice.Identification(), invoice.FormatMoney(invoice.Total()), dispute.Comment),
+	}
+	if _, err := enqueueJob(store, "email", email); err != nil {
+		log.Printf("Error queueing the notification of dispute %d: %v", dispute.ID, err)
+	}
+}
+
+// disputeLinkPath is the public page disputing the invoice, signed like its
+// share link: whoever can view the invoice can dispute it
+func disputeLinkPath(invoice *Invoice) string {
+	return "/i/" + invoice.UUID.String() + "/dispute?sig=" + signInvoiceUUID(invoice.UUID)
+}
+
+// disputeInvoice loads the invoice of a signed dispute link
+func (h *Handler) disputeInvoice(w http.ResponseWriter, r *http.Request) (*Invoice, bool) {
+	invoiceUUID, err := uuid.Parse(r.PathValue("invoiceUUID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	signature := r.URL.Query().Get("sig")
+	if !hmac.Equal([]byte(signature), []byte(signInvoiceUUID(invoiceUUID))) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	invoice, err := h.storeFor(r).GetInvoiceByUUID(invoiceUUID)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return invoice, true
+}
+
+type disputePage struct {
+	Invoice   *Invoice
+	Error     string
+	Submitted bool
+}
+
+func renderDispute(w http.ResponseWriter, status int, data disputePage) {
+	tmplPath := filepath.Join("templates", "disputes", "dispute.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+	}
+}
+
+// Dispute handlers
+func (h *Handler) viewDispute(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.disputeInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	renderDispute(w, http.StatusOK, disputePage{Invoice: invoice, Submitted: invoice.DisputedAt != nil})
+}
+
+func (h *Handler) submitDispute(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.disputeInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := validateDisputeText("Comment", r.FormValue("comment"))
+	if err != nil {
+		renderDispute(w, http.StatusBadRequest, disputePage{Invoice: invoice, Error: err.Error()})
+		return
+	}
+
+	dispute := InvoiceDispute{InvoiceID: invoice.ID, Comment: comment, CreatedAt: clock.Now()}
+	switch err := h.storeFor(r).OpenInvoiceDispute(&dispute); {
+	case errors.Is(err, ErrDisputeOpen):
+		renderDispute(w, http.StatusOK, disputePage{Invoice: invoice, Submitted: true})
+		return
+	case errors.Is(err, ErrNotDisputable):
+		renderDispute(w, http.StatusConflict, disputePage{Invoice: invoice})
+		return
+	case err != nil:
+		writeDatabaseError(w, r, err)
+		return
+	}
+	notifyDispute(h.storeFor(r), invoice, &dispute)
+
+	renderDispute(w, http.StatusOK, disputePage{Invoice: invoice, Submitted: true})
+}
+
+func (h *Handler) getInvoiceDisputes(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	disputes, err := h.storeFor(r).GetInvoiceDisputes(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disputes)
+}
+
+func (h *Handler) resolveInvoiceDispute(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Resolution string `json:"resolution"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resolution, err := validateDisputeText("Resolution", request.Resolution)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dispute, err := h.storeFor(r).ResolveInvoiceDispute(uint(invoiceId), currentUserID(r.Context()), resolution, clock.Now())
+	if err != nil {
+		if errors.Is(err, ErrNoDispute) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
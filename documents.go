@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// DocumentType distinguishes the business documents built on top of the
+// invoice machinery. They all share lines, totals and numbering.
+type DocumentType string
+
+const (
+	DocumentInvoice    DocumentType = "invoice"
+	DocumentQuote      DocumentType = "quote"
+	DocumentCreditNote DocumentType = "credit_note"
+	DocumentReceipt    DocumentType = "receipt"
+	DocumentProforma   DocumentType = "proforma"
+)
+
+// DocumentBehavior holds what differs between document types
+type DocumentBehavior struct {
+	// Label is the human readable name used in titles and file names
+	Label string
+	// BalanceSign is how the document moves the client's balance:
+	// 1 for a debit, -1 for a credit and 0 when it is informational only
+	BalanceSign float64
+	// Payable reports whether payments can be recorded against it
+	Payable bool
+}
+
+var documentTypes = map[DocumentType]DocumentBehavior{
+	DocumentInvoice:    {Label: "Invoice", BalanceSign: 1, Payable: true},
+	DocumentQuote:      {Label: "Quote", BalanceSign: 0, Payable: false},
+	DocumentCreditNote: {Label: "Credit Note", BalanceSign: -1, Payable: false},
+	DocumentReceipt:    {Label: "Receipt", BalanceSign: 0, Payable: false},
+	DocumentProforma:   {Label: "Proforma", BalanceSign: 0, Payable: false},
+}
+
+var ErrDocumentNotPayable = errors.New("payments can only be recorded against payable documents")
+
+// Behavior returns the behavior of the type, an empty type is an invoice
+func (t DocumentType) Behavior() DocumentBehavior {
+	if t == "" {
+		return documentTypes[DocumentInvoice]
+	}
+	return documentTypes[t]
+}
+
+// Valid reports whether the type is known, an empty type defaults to invoice
+func (t DocumentType) Valid() bool {
+	if t == "" {
+		return true
+	}
+	_, ok := documentTypes[t]
+	return ok
+}
+
+// ConvertDocument creates a new document of the given type from an existing
+// one, e.g. turning an accepted quote into an invoice. The copy gets a fresh
+// UUID, no number and today's issue date.
+func (r *Repository) ConvertDocument(id uint, documentType DocumentType) (*Invoice, error) {
+	source, err := r.GetInvoice(id)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := convertedDocument(source, documentType)
+	if err := r.CreateInvoice(&converted); err != nil {
+		return nil, err
+	}
+	return r.GetInvoice(converted.ID)
+}
+
+// convertedDocument copies the document, with its lines, as a new document
+// of the given type, to be created
+func convertedDocument(source *Invoice, documentType DocumentType) Invoice {
+	converted := Invoice{
+		Type:                  documentType,
+		AdditionalInformation: source.AdditionalInformation,
+		Discount:              source.Discount,
+		DiscountType:          source.DiscountType,
+		Penalty:               source.Penalty,
+		PenaltyType:           source.PenaltyType,
+		DueDate:               source.DueDate,
+		RemitInformationID:    source.RemitInformationID,
+		CompanyID:             source.CompanyID,
+		ClientID:              source.ClientID,
+		ProjectID:             source.ProjectID,
+	}
+	for _, line := range source.InvoiceLines {
+		converted.InvoiceLines = append(converted.InvoiceLines, InvoiceLine{
+			Type:         line.Type,
+			ProductID:    line.ProductID,
+			Quantity:     line.Quantity,
+			Unit:         line.Unit,
+			Description:  line.Description,
+			UnitPrice:    line.UnitPrice,
+			Discount:     line.Discount,
+			DiscountType: line.DiscountType,
+			Position:     line.Position,
+		})
+	}
+	return converted
+}
+
+func (h *Handler) convertDocument(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Type DocumentType `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Type == "" || !request.Type.Valid() {
+		http.Error(w, fmt.Sprintf("Invalid document type %q", request.Type), http.StatusBadRequest)
+		return
+	}
+
+	converted, err := h.storeFor(r).ConvertDocument(uint(invoiceId), request.Type)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(converted)
+}
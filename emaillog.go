@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The status of an outgoing email, from sending to what the provider
+// reported back
+const (
+	EmailSent       = "sent"
+	EmailFailed     = "failed"
+	EmailBounced    = "bounced"
+	EmailComplained = "complained"
+)
+
+// EmailLog records an outgoing email, whoever it went to: clients,
+// users or the notify email. MessageID is the provider's id of the message,
+// the Message-ID header over SMTP, which bounce reports refer to.
+type EmailLog struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	To        string `gorm:"type:text;not null" json:"to"`
+	Subject   string `gorm:"size:255;not null" json:"subject"`
+	Status    string `gorm:"size:20;not null;index" json:"status"`
+	MessageID string `gorm:"size:255;index" json:"message_id"`
+	// Error is why sending failed, or the bounce or complaint reported
+	Error     string    `gorm:"type:text" json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type EmailLogFilter struct {
+	Status string
+	// Address matches the logs with the address among their recipients
+	Address string
+	Limit   int
+}
+
+// newMessageID returns a Message-ID for an email sent from the address
+func newMessageID(from string) string {
+	domain := "tiny-crm.local"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+	return "<" + uuid.NewString() + "@" + domain + ">"
+}
+
+// sendEmail sends the email through the mailer and logs it, sent or not,
+// after the unit of work so a request failing along with the email keeps
+// the entry. Failing to log it is only logged, the email is gone either way.
+func sendEmail(store Store, email *Email) error {
+	if email.MessageID == "" {
+		email.MessageID = newMessageID(config.SMTP.From)
+	}
+	err := mailer.Send(email)
+
+	entry := &EmailLog{
+		To:        strings.Join(email.Recipients(), ", "),
+		Subject:   email.Subject,
+		Status:    EmailSent,
+		MessageID: email.MessageID,
+	}
+	if err != nil {
+		entry.Status, entry.Error = EmailFailed, err.Error()
+	}
+	store.AfterUnitOfWork(func(store Store) {
+		if logErr := store.RecordEmailLog(entry); logErr != nil {
+			log.Printf("Error logging the email %s: %v", email.MessageID, logErr)
+		}
+	})
+	return err
+}
+
+func (r *Repository) RecordEmailLog(entry *EmailLog) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(entry).Error
+	})
+}
+
+// GetEmailLogs lists the logs matched by filter, newest first
+func (r *Repository) GetEmailLogs(filter EmailLogFilter) ([]EmailLog, error) {
+	query := r.db.Order("id DESC")
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Address != "" {
+		query = query.Where(`LOWER(email_logs."to") LIKE ? ESCAPE '\'`, likeContains(strings.ToLower(filter.Address)))
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	logs := []EmailLog{}
+	err := query.Find(&logs).Error
+	return logs, err
+}
+
+// EmailBounce is a bounce or a complaint a provider reported about an
+// address
+type EmailBounce struct {
+	Address string `json:"address"`
+	// MessageIDs are the ids the provider knows the email by, the email
+	// was logged under one of them
+	MessageIDs []string `json:"message_ids"`
+	// Status is EmailBounced or EmailComplained
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// RecordEmailBounce marks the logged email bounced or complained about, and
+// flags the companies with the address as their email. It returns how many
+// companies were flagged.
+func (r *Repository) RecordEmailBounce(bounce EmailBounce, now time.Time) (int64, error) {
+	var flagged int64
+	err := retryOnBusy(func() error {
+		if len(bounce.MessageIDs) > 0 {
+			err := r.db.Model(&EmailLog{}).Where("message_id IN ?", bounce.MessageIDs).
+				Updates(map[string]interface{}{"status": bounce.Status, "error": bounce.Reason}).Error
+			if err != nil {
+				return err
+			}
+		}
+		query := r.db.Model(&Company{}).Where("LOWER(email) = ?", strings.ToLower(bounce.Address)).
+			Updates(map[string]interface{}{"email_bounced_at": now, "email_bounce_reason": bounce.Reason})
+		flagged = query.RowsAffected
+		return query.Error
+	})
+	return flagged, err
+}
+
+// bounceReason labels the bounce with what the provider said about it
+func bounceReason(status, detail string) string {
+	reason := "bounced"
+	if status == EmailComplained {
+		reason = "marked as spam"
+	}
+	if detail != "" {
+		reason += ": " + detail
+	}
+	return reason
+}
+
+// parseSendGridEvents reads the bounces and spam reports of a SendGrid
+// event webhook. Blocks and other soft bounces don't flag the address.
+func parseSendGridEvents(body []byte) ([]EmailBounce, error) {
+	var events []struct {
+		Email     string `json:"email"`
+		Event     string `json:"event"`
+		Type      string `json:"type"`
+		Reason    string `json:"reason"`
+		SMTPID    string `json:"smtp-id"`
+		MessageID string `json:"sg_message_id"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, fmt.Errorf("invalid SendGrid events: %v", err)
+	}
+
+	bounces := []EmailBounce{}
+	for _, event := range events {
+		var status string
+		switch {
+		case event.Event == "bounce" && event.Type != "blocked":
+			status = EmailBounced
+		case event.Event == "spamreport":
+			status = EmailComplained
+		default:
+			continue
+		}
+		// The smtp-id is the Message-ID the email was sent with over SMTP,
+		// the sg_message_id starts with the X-Message-Id the API answered
+		messageIDs := []string{}
+		if event.SMTPID != "" {
+			messageIDs = append(messageIDs, event.SMTPID)
+		}
+		if id, _, _ := strings.Cut(event.MessageID, "."); id != "" {
+			messageIDs = append(messageIDs, id)
+		}
+		bounces = append(bounces, EmailBounce{Address: event.Email, MessageIDs: messageIDs, Status: status, Reason: bounceReason(status, event.Reason)})
+	}
+	return bounces, nil
+}
+
+// sesNotification is the notification SES publishes to SNS
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress   string `json:"emailAddress"`
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+		ComplaintFeedbackType string `json:"complaintFeedbackType"`
+	} `json:"complaint"`
+	Mail struct {
+		MessageID     string `json:"messageId"`
+		CommonHeaders struct {
+			MessageID string `json:"messageId"`
+		} `json:"commonHeaders"`
+	} `json:"mail"`
+}
+
+// parseSESNotification reads the permanent bounces and the complaints of an
+// SES notification delivered by SNS. The subscription confirmation SNS
+// sends first is confirmed.
+func parseSESNotification(body []byte) ([]EmailBounce, error) {
+	var message struct {
+		Type         string `json:"Type"`
+		Message      string `json:"Message"`
+		SubscribeURL string `json:"SubscribeURL"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, fmt.Errorf("invalid SNS message: %v", err)
+	}
+	if message.Type == "SubscriptionConfirmation" {
+		return []EmailBounce{}, confirmSNSSubscription(message.SubscribeURL)
+	}
+
+	var notification sesNotification
+	if err := json.Unmarshal([]byte(message.Message), &notification); err != nil {
+		return nil, fmt.Errorf("invalid SES notification: %v", err)
+	}
+	// The id SES answered when the email was sent through its API, the
+	// Message-ID header it was sent with over SMTP
+	messageIDs := []string{}
+	for _, id := range []string{notification.Mail.MessageID, notification.Mail.CommonHeaders.MessageID} {
+		if id != "" {
+			messageIDs = append(messageIDs, id)
+		}
+	}
+
+	bounces := []EmailBounce{}
+	switch notification.NotificationType {
+	case "Bounce":
+		if notification.Bounce.BounceType != "Permanent" {
+			break
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			bounces = append(bounces, EmailBounce{Address: recipient.EmailAddress, MessageIDs: messageIDs, Status: EmailBounced,
+				Reason: bounceReason(EmailBounced, recipient.DiagnosticCode)})
+		}
+	case "Complaint":
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			bounces = append(bounces, EmailBounce{Address: recipient.EmailAddress, MessageIDs: messageIDs, Status: EmailComplained,
+				Reason: bounceReason(EmailComplained, notification.Complaint.ComplaintFeedbackType)})
+		}
+	}
+	return bounces, nil
+}
+
+// confirmSNSSubscription visits the URL confirming the subscription of the
+// webhook to the SNS topic, which has to be on AWS
+func confirmSNSSubscription(subscribeURL string) error {
+	parsed, err := url.Parse(subscribeURL)
+	if err != nil || parsed.Scheme != "https" || !strings.HasSuffix(parsed.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("invalid SNS subscribe URL %q", subscribeURL)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(parsed.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("confirming the SNS subscription answered %s", resp.Status)
+	}
+	return nil
+}
+
+// emailEventParsers read the bounce webhooks of each provider
+var emailEventParsers = map[string]func(body []byte) ([]EmailBounce, error){
+	"sendgrid": parseSendGridEvents,
+	"ses":      parseSESNotification,
+}
+
+// Email log handlers
+func (h *Handler) getEmailLogs(w http.ResponseWriter, r *http.Request) {
+	filter := EmailLogFilter{Status: r.URL.Query().Get("status"), Address: r.URL.Query().Get("address"), Limit: 100}
+	switch filter.Status {
+	case "", EmailSent, EmailFailed, EmailBounced, EmailComplained:
+	default:
+		http.Error(w, fmt.Sprintf("Invalid status %q, expected sent, failed, bounced or complained", filter.Status), http.StatusBadRequest)
+		return
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	logs, err := h.storeFor(r).GetEmailLogs(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs)
+}
+
+// receiveEmailEvents processes the bounce and complaint webhook of a
+// provider
+func (h *Handler) receiveEmailEvents(w http.ResponseWriter, r *http.Request) {
+	parse, ok := emailEventParsers[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider, expected sendgrid or ses", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bounces, err := parse(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := struct {
+		Processed int   `json:"processed"`
+		Flagged   int64 `json:"flagged"`
+	}{}
+	for _, bounce := range bounces {
+		if bounce.Address == "" {
+			continue
+		}
+		flagged, err := h.storeFor(r).RecordEmailBounce(bounce, clock.Now())
+		if err != nil {
+			writeDatabaseError(w, r, err)
+			return
+		}
+		result.Processed++
+		result.Flagged += flagged
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
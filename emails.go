@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailMessage records an email sent to a client, with every address it went
+// to. InvoiceID is nil for emails not about a single invoice, e.g. statements.
+type EmailMessage struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CompanyID uint      `gorm:"not null;index" json:"company_id"`
+	Company   Company   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	InvoiceID *uint     `gorm:"index" json:"invoice_id"`
+	Invoice   *Invoice  `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	To        string    `gorm:"type:text;not null" json:"to"`
+	Cc        string    `gorm:"type:text" json:"cc"`
+	Bcc       string    `gorm:"type:text" json:"bcc"`
+	ReplyTo   string    `gorm:"size:255" json:"reply_to"`
+	Subject   string    `gorm:"size:255;not null" json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// parseAddresses splits a comma separated list of email addresses, keeping
+// only the addresses so they can be given to the SMTP server
+func parseAddresses(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	parsed, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email address list %q", list)
+	}
+	addresses := make([]string, len(parsed))
+	for i, address := range parsed {
+		addresses[i] = address.Address
+	}
+	return addresses, nil
+}
+
+// normalizeCompanyEmails checks the copy and reply-to addresses of the
+// company and stores the lists as "a@example.com, b@example.com"
+func normalizeCompanyEmails(company *Company) error {
+	for _, list := range []*string{&company.EmailCc, &company.EmailBcc} {
+		addresses, err := parseAddresses(*list)
+		if err != nil {
+			return err
+		}
+		*list = strings.Join(addresses, ", ")
+	}
+	company.EmailReplyTo = strings.TrimSpace(company.EmailReplyTo)
+	if company.EmailReplyTo != "" {
+		if _, err := mail.ParseAddress(company.EmailReplyTo); err != nil {
+			return fmt.Errorf("invalid reply-to address %q", company.EmailReplyTo)
+		}
+	}
+	return nil
+}
+
+// addressClient copies the email to the configured addresses and to the
+// ones of the client, whose reply-to wins over the configured one
+func addressClient(email *Email, client *Company) {
+	cc, _ := parseAddresses(client.EmailCc)
+	bcc, _ := parseAddresses(client.EmailBcc)
+	email.Cc = append(append([]string{}, config.SMTP.Cc...), cc...)
+	email.Bcc = append(append([]string{}, config.SMTP.Bcc...), bcc...)
+	email.ReplyTo = config.SMTP.ReplyTo
+	if client.EmailReplyTo != "" {
+		email.ReplyTo = client.EmailReplyTo
+	}
+}
+
+// sendClientEmail sends the email to the client with its copies and
+// reply-to, and records it. invoiceID is the invoice it is about, if any.
+// Nothing is sent while the settings pause the client emails.
+func sendClientEmail(r Store, client *Company, invoiceID *uint, email *Email) error {
+	if currentSettings().PauseClientEmails {
+		return ErrEmailsPaused
+	}
+	addressClient(email, client)
+	if err := sendEmail(r, email); err != nil {
+		return err
+	}
+	return r.RecordEmailMessage(&EmailMessage{
+		CompanyID: client.ID,
+		InvoiceID: invoiceID,
+		To:        strings.Join(email.To, ", "),
+		Cc:        strings.Join(email.Cc, ", "),
+		Bcc:       strings.Join(email.Bcc, ", "),
+		ReplyTo:   email.ReplyTo,
+		Subject:   email.Subject,
+	})
+}
+
+func (r *Repository) RecordEmailMessage(message *EmailMessage) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(message).Error
+	})
+}
+
+func (r *Repository) GetInvoiceEmailMessages(invoiceID uint) ([]EmailMessage, error) {
+	var messages []EmailMessage
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at, id").Find(&messages).Error
+	return messages, err
+}
+
+// GetCompanyEmailMessages returns every email sent to the company
+func (r *Repository) GetCompanyEmailMessages(companyID uint) ([]EmailMessage, error) {
+	var messages []EmailMessage
+	err := r.db.Where("company_id = ?", companyID).Order("created_at, id").Find(&messages).Error
+	return messages, err
+}
+
+func (h *Handler) getInvoiceEmails(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.storeFor(r).GetInvoiceEmailMessages(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
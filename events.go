@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Events published when records change, for the integrations subscribed
+const (
+	// EventInvoiceCreated carries the *Invoice created
+	EventInvoiceCreated = "invoice.created"
+	// EventPaymentRecorded carries the *Payment recorded
+	EventPaymentRecorded = "payment.recorded"
+	// EventCompanyUpdated carries the *Company updated
+	EventCompanyUpdated = "company.updated"
+)
+
+// Event is something that happened, Data being the record it happened to
+type Event struct {
+	Name string      `json:"name"`
+	At   time.Time   `json:"at"`
+	Data interface{} `json:"data"`
+}
+
+// EventHandler reacts to an event. It runs in the transaction of the change
+// with its store, so slow work is better queued as a job. An error is
+// logged, the change stands.
+type EventHandler func(store Store, event Event) error
+
+type subscription struct {
+	id      int
+	handler EventHandler
+}
+
+var (
+	subscriptionsMu  sync.RWMutex
+	subscriptions    = map[string][]subscription{}
+	lastSubscription int
+)
+
+// subscribe calls handler on every event of the name, or on every event for
+// "*", in the order subscribed. It returns the function unsubscribing.
+func subscribe(name string, handler EventHandler) func() {
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	lastSubscription++
+	id := lastSubscription
+	subscriptions[name] = append(subscriptions[name], subscription{id: id, handler: handler})
+
+	return func() {
+		subscriptionsMu.Lock()
+		defer subscriptionsMu.Unlock()
+		for index, s := range subscriptions[name] {
+			if s.id == id {
+				subscriptions[name] = append(subscriptions[name][:index:index], subscriptions[name][index+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// subscribeJob queues a job of kind for every event of the name, the job
+// payload being the event, for integrations to run in the background
+func subscribeJob(name, kind string) func() {
+	return subscribe(name, func(store Store, event Event) error {
+		_, err := enqueueJob(store, kind, event)
+		return err
+	})
+}
+
+// publishEvent hands the event to its subscribers. Their failures, panics
+// included, are logged without stopping the others.
+func publishEvent(store Store, name string, data interface{}) {
+	subscriptionsMu.RLock()
+	handlers := make([]EventHandler, 0, len(subscriptions[name])+len(subscriptions["*"]))
+	for _, s := range subscriptions[name] {
+		handlers = append(handlers, s.handler)
+	}
+	for _, s := range subscriptions["*"] {
+		handlers = append(handlers, s.handler)
+	}
+	subscriptionsMu.RUnlock()
+
+	event := Event{Name: name, At: clock.Now(), Data: data}
+	for _, handler := range handlers {
+		if err := runEventHandler(store, handler, event); err != nil {
+			log.Printf("Error handling event %s: %v", name, err)
+		}
+	}
+}
+
+func runEventHandler(store Store, handler EventHandler, event Event) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+		}
+	}()
+	return handler(store, event)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const facturXFilename = "factur-x.xml"
+
+// Structured e-invoice formats only describe invoices and credit notes, and
+// require the country of both parties
+var ErrEInvoiceDocumentType = errors.New("e-invoices are only available for invoices and credit notes")
+var ErrEInvoiceCountry = errors.New("e-invoices need the country of the issuer and the client")
+
+// eInvoiceTypeCodes maps document types to UNTDID 1001 codes
+var eInvoiceTypeCodes = map[DocumentType]string{
+	DocumentInvoice:    "380",
+	DocumentCreditNote: "381",
+}
+
+// eInvoiceTypeCode checks the invoice can be exported as an e-invoice and
+// returns its UNTDID 1001 document type code
+func (i *Invoice) eInvoiceTypeCode() (string, error) {
+	documentType := i.Type
+	if documentType == "" {
+		documentType = DocumentInvoice
+	}
+
+	typeCode, ok := eInvoiceTypeCodes[documentType]
+	if !ok {
+		return "", ErrEInvoiceDocumentType
+	}
+	if i.Company.Country == "" || i.Client.Country == "" {
+		return "", ErrEInvoiceCountry
+	}
+	return typeCode, nil
+}
+
+// The structs below are the subset of the UN/CEFACT Cross Industry Invoice
+// needed for the EN 16931 profile. Field order follows the schema.
+
+type ciiInvoice struct {
+	XMLName     xml.Name       `xml:"rsm:CrossIndustryInvoice"`
+	RSM         string         `xml:"xmlns:rsm,attr"`
+	RAM         string         `xml:"xmlns:ram,attr"`
+	UDT         string         `xml:"xmlns:udt,attr"`
+	GuidelineID string         `xml:"rsm:ExchangedDocumentContext>ram:GuidelineSpecifiedDocumentContextParameter>ram:ID"`
+	Document    ciiDocument    `xml:"rsm:ExchangedDocument"`
+	Transaction ciiTransaction `xml:"rsm:SupplyChainTradeTransaction"`
+}
+
+type ciiDate struct {
+	Format string `xml:"format,attr"`
+	Value  string `xml:",chardata"`
+}
+
+func newCIIDate(date time.Time) ciiDate {
+	return ciiDate{Format: "102", Value: date.Format("20060102")}
+}
+
+type ciiDocument struct {
+	ID        string    `xml:"ram:ID"`
+	TypeCode  string    `xml:"ram:TypeCode"`
+	IssueDate ciiDate   `xml:"ram:IssueDateTime>udt:DateTimeString"`
+	Notes     []ciiNote `xml:"ram:IncludedNote"`
+}
+
+type ciiNote struct {
+	Content string `xml:"ram:Content"`
+}
+
+type ciiQuantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ciiLineTax struct {
+	TypeCode     string `xml:"ram:TypeCode"`
+	CategoryCode string `xml:"ram:CategoryCode"`
+}
+
+type ciiLine struct {
+	LineID      string      `xml:"ram:AssociatedDocumentLineDocument>ram:LineID"`
+	ProductName string      `xml:"ram:SpecifiedTradeProduct>ram:Name"`
+	NetPrice    string      `xml:"ram:SpecifiedLineTradeAgreement>ram:NetPriceProductTradePrice>ram:ChargeAmount"`
+	Quantity    ciiQuantity `xml:"ram:SpecifiedLineTradeDelivery>ram:BilledQuantity"`
+	Tax         ciiLineTax  `xml:"ram:SpecifiedLineTradeSettlement>ram:ApplicableTradeTax"`
+	LineTotal   string      `xml:"ram:SpecifiedLineTradeSettlement>ram:SpecifiedTradeSettlementLineMonetarySummation>ram:LineTotalAmount"`
+}
+
+type ciiID struct {
+	ID string `xml:"ram:ID"`
+}
+
+type ciiURI struct {
+	URIID string `xml:"ram:URIID"`
+}
+
+type ciiParty struct {
+	Name      string  `xml:"ram:Name"`
+	Legal     *ciiID  `xml:"ram:SpecifiedLegalOrganization,omitempty"`
+	Address   string  `xml:"ram:PostalTradeAddress>ram:LineOne"`
+	CountryID string  `xml:"ram:PostalTradeAddress>ram:CountryID"`
+	Email     *ciiURI `xml:"ram:URIUniversalCommunication,omitempty"`
+}
+
+type ciiHeaderTax struct {
+	CalculatedAmount string `xml:"ram:CalculatedAmount"`
+	TypeCode         string `xml:"ram:TypeCode"`
+	ExemptionReason  string `xml:"ram:ExemptionReason"`
+	BasisAmount      string `xml:"ram:BasisAmount"`
+	CategoryCode     string `xml:"ram:CategoryCode"`
+}
+
+type ciiAllowanceCharge struct {
+	ChargeIndicator bool       `xml:"ram:ChargeIndicator>udt:Indicator"`
+	ActualAmount    string     `xml:"ram:ActualAmount"`
+	Reason          string     `xml:"ram:Reason"`
+	Tax             ciiLineTax `xml:"ram:CategoryTradeTax"`
+}
+
+type ciiAmount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type ciiSummation struct {
+	LineTotal       string    `xml:"ram:LineTotalAmount"`
+	ChargeTotal     string    `xml:"ram:ChargeTotalAmount"`
+	AllowanceTotal  string    `xml:"ram:AllowanceTotalAmount"`
+	TaxBasisTotal   string    `xml:"ram:TaxBasisTotalAmount"`
+	TaxTotal        ciiAmount `xml:"ram:TaxTotalAmount"`
+	GrandTotal      string    `xml:"ram:GrandTotalAmount"`
+	TotalPrepaid    string    `xml:"ram:TotalPrepaidAmount"`
+	DuePayableTotal string    `xml:"ram:DuePayableAmount"`
+}
+
+type ciiSettlement struct {
+	CurrencyCode      string               `xml:"ram:InvoiceCurrencyCode"`
+	Tax               ciiHeaderTax         `xml:"ram:ApplicableTradeTax"`
+	AllowanceCharges  []ciiAllowanceCharge `xml:"ram:SpecifiedTradeAllowanceCharge"`
+	PaymentTerms      *ciiPaymentTerms     `xml:"ram:SpecifiedTradePaymentTerms,omitempty"`
+	MonetarySummation ciiSummation         `xml:"ram:SpecifiedTradeSettlementHeaderMonetarySummation"`
+}
+
+type ciiPaymentTerms struct {
+	DueDate ciiDate `xml:"ram:DueDateDateTime>udt:DateTimeString"`
+}
+
+type ciiTransaction struct {
+	Lines      []ciiLine     `xml:"ram:IncludedSupplyChainTradeLineItem"`
+	Seller     ciiParty      `xml:"ram:ApplicableHeaderTradeAgreement>ram:SellerTradeParty"`
+	Buyer      ciiParty      `xml:"ram:ApplicableHeaderTradeAgreement>ram:BuyerTradeParty"`
+	Delivery   struct{}      `xml:"ram:ApplicableHeaderTradeDelivery"`
+	Settlement ciiSettlement `xml:"ram:ApplicableHeaderTradeSettlement"`
+}
+
+// validCountry reports whether country is empty or an ISO 3166-1 alpha-2 code
+func validCountry(country string) bool {
+	if country == "" {
+		return true
+	}
+	if len(country) != 2 {
+		return false
+	}
+	for _, c := range country {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func ciiFormatAmount(amount Money) string {
+	return amount.String()
+}
+
+// ciiFormatQuantity writes a quantity with the decimals it has, 7.5 or 2
+func ciiFormatQuantity(quantity float64) string {
+	return strconv.FormatFloat(quantity, 'f', -1, 64)
+}
+
+func newCIIParty(company *Company) ciiParty {
+	party := ciiParty{
+		Name:      company.Name,
+		Address:   company.Address,
+		CountryID: company.Country,
+	}
+	if company.Document != "" {
+		party.Legal = &ciiID{ID: company.Document}
+	}
+	if company.Email != "" {
+		party.Email = &ciiURI{URIID: company.Email}
+	}
+	return party
+}
+
+// FacturXXML renders the invoice as an EN 16931 Cross Industry Invoice.
+// No taxes are tracked, so every amount is declared outside the scope of VAT.
+// prepaid is what has already been received against the invoice.
+func (i *Invoice) FacturXXML(prepaid Money) ([]byte, error) {
+	typeCode, err := i.eInvoiceTypeCode()
+	if err != nil {
+		return nil, err
+	}
+
+	outOfScope := ciiLineTax{TypeCode: "VAT", CategoryCode: "O"}
+
+	invoice := ciiInvoice{
+		RSM:         "urn:un:unece:uncefact:data:standard:CrossIndustryInvoice:100",
+		RAM:         "urn:un:unece:uncefact:data:standard:ReusableAggregateBusinessInformationEntity:100",
+		UDT:         "urn:un:unece:uncefact:data:standard:UnqualifiedDataType:100",
+		GuidelineID: "urn:cen.eu:en16931:2017",
+		Document: ciiDocument{
+			ID:        i.Identification(),
+			TypeCode:  typeCode,
+			IssueDate: newCIIDate(i.IssueDate),
+		},
+	}
+	if i.AdditionalInformation != nil && *i.AdditionalInformation != "" {
+		invoice.Document.Notes = []ciiNote{{Content: *i.AdditionalInformation}}
+	}
+
+	// Sections only group the lines on paper, they bill nothing
+	for _, line := range i.InvoiceLines {
+		if line.Section() {
+			continue
+		}
+		name := line.Name()
+		if details := line.Details(); details != "" {
+			name += " (" + details + ")"
+		}
+		invoice.Transaction.Lines = append(invoice.Transaction.Lines, ciiLine{
+			LineID:      strconv.Itoa(len(invoice.Transaction.Lines) + 1),
+			ProductName: name,
+			NetPrice:    ciiFormatAmount(line.NetUnitPrice()),
+			Quantity:    ciiQuantity{UnitCode: line.Unit.Code(), Value: ciiFormatQuantity(line.Quantity)},
+			Tax:         outOfScope,
+			LineTotal:   ciiFormatAmount(line.Total()),
+		})
+	}
+	invoice.Transaction.Seller = newCIIParty(&i.Company)
+	invoice.Transaction.Buyer = newCIIParty(&i.Client)
+
+	settlement := &invoice.Transaction.Settlement
+	settlement.CurrencyCode = i.EffectiveLocale().CurrencyCode()
+	if i.DiscountAmount() != 0 {
+		settlement.AllowanceCharges = append(settlement.AllowanceCharges, ciiAllowanceCharge{
+			ChargeIndicator: false,
+			ActualAmount:    ciiFormatAmount(i.DiscountAmount()),
+			Reason:          "Discount",
+			Tax:             outOfScope,
+		})
+	}
+	if i.PenaltyAmount() != 0 {
+		settlement.AllowanceCharges = append(settlement.AllowanceCharges, ciiAllowanceCharge{
+			ChargeIndicator: true,
+			ActualAmount:    ciiFormatAmount(i.PenaltyAmount()),
+			Reason:          "Late payment penalty",
+			Tax:             outOfScope,
+		})
+	}
+	if typeCode == eInvoiceTypeCodes[DocumentInvoice] {
+		settlement.PaymentTerms = &ciiPaymentTerms{DueDate: newCIIDate(i.DueDate)}
+	}
+
+	total := i.Total()
+	settlement.Tax = ciiHeaderTax{
+		CalculatedAmount: ciiFormatAmount(0),
+		TypeCode:         "VAT",
+		ExemptionReason:  "Not subject to VAT",
+		BasisAmount:      ciiFormatAmount(total),
+		CategoryCode:     "O",
+	}
+	settlement.MonetarySummation = ciiSummation{
+		LineTotal:       ciiFormatAmount(i.SubTotal()),
+		ChargeTotal:     ciiFormatAmount(i.PenaltyAmount()),
+		AllowanceTotal:  ciiFormatAmount(i.DiscountAmount()),
+		TaxBasisTotal:   ciiFormatAmount(total),
+		TaxTotal:        ciiAmount{CurrencyID: settlement.CurrencyCode, Value: ciiFormatAmount(0)},
+		GrandTotal:      ciiFormatAmount(total),
+		TotalPrepaid:    ciiFormatAmount(prepaid),
+		DuePayableTotal: ciiFormatAmount(total - prepaid),
+	}
+
+	data, err := xml.MarshalIndent(invoice, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// facturXMetadata is the XMP packet declaring the PDF as a Factur-X invoice
+// with the EN 16931 profile, including the extension schema PDF/A requires
+// for the fx namespace
+func facturXMetadata(title string) []byte {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(title))
+
+	return []byte(`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about="" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/">
+      <pdfaid:part>3</pdfaid:part>
+      <pdfaid:conformance>B</pdfaid:conformance>
+    </rdf:Description>
+    <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+      <dc:title><rdf:Alt><rdf:li xml:lang="x-default">` + escaped.String() + `</rdf:li></rdf:Alt></dc:title>
+    </rdf:Description>
+    <rdf:Description rdf:about="" xmlns:fx="urn:factur-x:pdfa:CrossIndustryDocument:invoice:1p0#">
+      <fx:DocumentType>INVOICE</fx:DocumentType>
+      <fx:DocumentFileName>` + facturXFilename + `</fx:DocumentFileName>
+      <fx:Version>1.0</fx:Version>
+      <fx:ConformanceLevel>EN 16931</fx:ConformanceLevel>
+    </rdf:Description>
+    <rdf:Description rdf:about="" xmlns:pdfaExtension="http://www.aiim.org/pdfa/ns/extension/" xmlns:pdfaSchema="http://www.aiim.org/pdfa/ns/schema#" xmlns:pdfaProperty="http://www.aiim.org/pdfa/ns/property#">
+      <pdfaExtension:schemas>
+        <rdf:Bag>
+          <rdf:li rdf:parseType="Resource">
+            <pdfaSchema:schema>Factur-X PDFA Extension Schema</pdfaSchema:schema>
+            <pdfaSchema:namespaceURI>urn:factur-x:pdfa:CrossIndustryDocument:invoice:1p0#</pdfaSchema:namespaceURI>
+            <pdfaSchema:prefix>fx</pdfaSchema:prefix>
+            <pdfaSchema:property>
+              <rdf:Seq>
+                <rdf:li rdf:parseType="Resource">
+                  <pdfaProperty:name>DocumentFileName</pdfaProperty:name>
+                  <pdfaProperty:valueType>Text</pdfaProperty:valueType>
+                  <pdfaProperty:category>external</pdfaProperty:category>
+                  <pdfaProperty:description>name of the embedded XML invoice file</pdfaProperty:description>
+                </rdf:li>
+                <rdf:li rdf:parseType="Resource">
+                  <pdfaProperty:name>DocumentType</pdfaProperty:name>
+                  <pdfaProperty:valueType>Text</pdfaProperty:valueType>
+                  <pdfaProperty:category>external</pdfaProperty:category>
+                  <pdfaProperty:description>INVOICE</pdfaProperty:description>
+                </rdf:li>
+                <rdf:li rdf:parseType="Resource">
+                  <pdfaProperty:name>Version</pdfaProperty:name>
+                  <pdfaProperty:valueType>Text</pdfaProperty:valueType>
+                  <pdfaProperty:category>external</pdfaProperty:category>
+                  <pdfaProperty:description>The actual version of the Factur-X XML schema</pdfaProperty:description>
+                </rdf:li>
+                <rdf:li rdf:parseType="Resource">
+                  <pdfaProperty:name>ConformanceLevel</pdfaProperty:name>
+                  <pdfaProperty:valueType>Text</pdfaProperty:valueType>
+                  <pdfaProperty:category>external</pdfaProperty:category>
+                  <pdfaProperty:description>The conformance level of the embedded Factur-X data</pdfaProperty:description>
+                </rdf:li>
+              </rdf:Seq>
+            </pdfaSchema:property>
+          </rdf:li>
+        </rdf:Bag>
+      </pdfaExtension:schemas>
+    </rdf:Description>
+  </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`)
+}
+
+// PDF renders the invoice as a printable document in its locale
+func (i *Invoice) PDF() *PDFDocument {
+	documentType := i.Type
+	if documentType == "" {
+		documentType = DocumentInvoice
+	}
+
+	doc := NewPDFDocument(i.Repr())
+	doc.Logo = companyPDFLogo(&i.Company)
+	doc.AddLine("%s %s", i.T(string(documentType)), i.Identification())
+	doc.AddBlank()
+	doc.AddLine("%s: %s - %s", i.T("from"), i.Company.Name, i.Company.Document)
+	doc.AddLine("%s", i.Company.Address)
+	doc.AddLine("%s: %s - %s", i.T("to"), i.Client.Name, i.Client.Document)
+	doc.AddLine("%s", i.Client.Address)
+	doc.AddBlank()
+	doc.AddLine("%s: %s", i.T("issue_date"), i.FormatDate(i.IssueDate))
+	doc.AddLine("%s: %s", i.T("due_date"), i.FormatDate(i.DueDate))
+	doc.AddBlank()
+	for _, line := range i.InvoiceLines {
+		if line.Section() {
+			doc.AddLine("%s", line.Name())
+			continue
+		}
+		doc.AddLine("%-45s %8s %14s %14s", line.Name(), i.FormatQuantity(line.Quantity, line.Unit), i.FormatMoney(line.UnitPrice), i.FormatMoney(line.Total()))
+	}
+	doc.AddBlank()
+	doc.AddLine("%s: %s", i.T("subtotal"), i.FormatMoney(i.SubTotal()))
+	doc.AddLine("%s: %s", i.T("discount"), i.FormatMoney(i.DiscountAmount()))
+	doc.AddLine("%s: %s", i.T("penalty"), i.FormatMoney(i.PenaltyAmount()))
+	doc.AddLine("%s: %s", i.T("total"), i.FormatMoney(i.Total()))
+	if len(i.RemitInformation.Lines) > 0 {
+		doc.AddBlank()
+		doc.AddLine("%s", i.T("remit_to"))
+		for _, line := range i.RemitInformation.Lines {
+			doc.AddLine("%s: %s", line.Key, line.Value)
+		}
+	}
+	return doc
+}
+
+// FacturXPDF renders the invoice PDF with its EN 16931 XML embedded, so the
+// recipient's accounting software can import it
+func (i *Invoice) FacturXPDF(prepaid Money) ([]byte, error) {
+	data, err := i.FacturXXML(prepaid)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := i.PDF()
+	doc.Attachments = append(doc.Attachments, PDFAttachment{
+		Name:         facturXFilename,
+		ContentType:  "text/xml",
+		Data:         data,
+		Relationship: "Alternative",
+	})
+	doc.Metadata = facturXMetadata(doc.Title)
+	return doc.Bytes(), nil
+}
+
+func (h *Handler) getInvoiceFacturX(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	prepaid, err := h.storeFor(r).GetPaidAmount(invoice.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	var data []byte
+	contentType, filename := "application/pdf", invoice.Repr()+".pdf"
+	if r.URL.Query().Get("format") == "xml" {
+		data, err = invoice.FacturXXML(prepaid)
+		contentType, filename = "application/xml", facturXFilename
+	} else {
+		data, err = invoice.FacturXPDF(prepaid)
+	}
+	if err != nil {
+		if errors.Is(err, ErrEInvoiceDocumentType) || errors.Is(err, ErrEInvoiceCountry) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	w.Write(data)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStorage keeps the files of the attachments under their content key,
+// the database only their metadata
+type FileStorage interface {
+	Put(key string, data []byte) error
+	// Get fails with os.ErrNotExist when no file has the key
+	Get(key string) ([]byte, error)
+	Exists(key string) (bool, error)
+	// Delete succeeds when no file has the key
+	Delete(key string) error
+}
+
+// fileStorage keeps the attachments, in an S3 bucket when one is
+// configured so every instance sees them
+var fileStorage FileStorage = localFileStorage{}
+
+func newFileStorage(c *Config) FileStorage {
+	if c.S3.Bucket != "" {
+		return newS3FileStorage(c.S3)
+	}
+	return localFileStorage{}
+}
+
+// validate checks the bucket settings, the endpoint must use https unless
+// it is on this machine, e.g. a MinIO for development
+func (c S3Config) validate() error {
+	if c.Bucket == "" {
+		return nil
+	}
+	if c.Region == "" || c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("the S3 bucket needs S3_REGION, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	if c.Endpoint != "" {
+		endpoint, err := url.Parse(c.Endpoint)
+		if err != nil || endpoint.Host == "" || (endpoint.Scheme != "https" && !(endpoint.Scheme == "http" && isLoopback(endpoint.Hostname()))) {
+			return fmt.Errorf("invalid S3 endpoint %q, it must use https", c.Endpoint)
+		}
+	}
+	return nil
+}
+
+// localFileStorage keeps the files in ATTACHMENTS_DIR, on the instance's
+// own disk
+type localFileStorage struct{}
+
+func (localFileStorage) path(key string) string {
+	return filepath.Join(config.AttachmentsDir, filepath.Base(key))
+}
+
+func (s localFileStorage) Put(key string, data []byte) error {
+	if err := os.MkdirAll(config.AttachmentsDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(key), data, 0o644)
+}
+
+func (s localFileStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s localFileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s localFileStorage) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3FileStorage keeps the files in an S3 bucket, or one of a compatible
+// service at Endpoint, with requests signed by AWS Signature Version 4
+type S3FileStorage struct {
+	// URL is the bucket's, the keys are appended to it
+	URL             string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+// newS3FileStorage addresses the bucket by its AWS virtual host, or by
+// path at a custom endpoint
+func newS3FileStorage(c S3Config) *S3FileStorage {
+	bucketURL := "https://" + c.Bucket + ".s3." + c.Region + ".amazonaws.com"
+	if c.Endpoint != "" {
+		bucketURL = strings.TrimRight(c.Endpoint, "/") + "/" + url.PathEscape(c.Bucket)
+	}
+	return &S3FileStorage{
+		URL:             bucketURL,
+		Region:          c.Region,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		Client:          &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (s *S3FileStorage) do(method, key string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.URL+"/"+url.PathEscape(key), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	payloadHash := sha256.Sum256(data)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	signAWSRequest(req, data, "s3", s.Region, s.AccessKeyID, s.SecretAccessKey, time.Now().UTC())
+	return s.Client.Do(req)
+}
+
+func (s *S3FileStorage) Put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return providerError("S3", resp)
+	}
+	return nil
+}
+
+func (s *S3FileStorage) Get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, providerError("S3", resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3FileStorage) Exists(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("S3 answered %d checking %s", resp.StatusCode, key)
+}
+
+// Delete removes the file, S3 answers the same whether it existed or not
+func (s *S3FileStorage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return providerError("S3", resp)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFormMemory is how much of a multipart form is kept in memory
+const maxFormMemory = 32 << 20
+
+// decodeRequest reads the body of a create or update request into v, JSON
+// or an HTML form, urlencoded or multipart, so plain forms work without
+// JavaScript
+func decodeRequest(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		return decodeForm(r, v)
+	default:
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+}
+
+// formNode is a field of a form, or a group of fields under a common name
+// like invoice_lines[0][product_id] and invoice_lines[0][quantity]
+type formNode struct {
+	values   []string
+	children map[string]*formNode
+}
+
+// formPath splits the name of a form field into its parts, accepting
+// brackets and dots: invoice_lines[0][product_id] and
+// invoice_lines.0.product_id are both invoice_lines, 0, product_id
+func formPath(name string) []string {
+	name = strings.NewReplacer("][", ".", "[", ".", "]", "").Replace(name)
+	return strings.Split(name, ".")
+}
+
+// decodeForm reads the form fields into v through their JSON names. The
+// values are converted to the types of the fields, so the models decode
+// forms with the same rules as JSON.
+func decodeForm(r *http.Request, v interface{}) error {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		err = r.ParseMultipartForm(maxFormMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return err
+	}
+
+	root := &formNode{}
+	for name, values := range r.PostForm {
+		node := root
+		for _, part := range formPath(name) {
+			if node.children == nil {
+				node.children = map[string]*formNode{}
+			}
+			if node.children[part] == nil {
+				node.children[part] = &formNode{}
+			}
+			node = node.children[part]
+		}
+		node.values = values
+	}
+
+	value, _, err := formValue(root, reflect.TypeOf(v).Elem(), "form")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// jsonFields maps the JSON names of the struct fields to their types,
+// with the fields of embedded structs
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) map[string]reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			jsonFields(field.Type, fields)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// formValue converts the node to the JSON value of type t. Empty fields
+// are left out, or null for pointers, keeping what the model defaults to.
+func formValue(node *formNode, t reflect.Type, name string) (interface{}, bool, error) {
+	if t.Kind() == reflect.Pointer {
+		if node.children == nil && (len(node.values) == 0 || node.values[len(node.values)-1] == "") {
+			return nil, true, nil
+		}
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType || reflect.PointerTo(t).Implements(textUnmarshalerType):
+		// Parsed from text below
+	case t.Kind() == reflect.Struct:
+		if node.children == nil {
+			return nil, false, nil
+		}
+		fields := jsonFields(t, map[string]reflect.Type{})
+		object := map[string]interface{}{}
+		for key, child := range node.children {
+			fieldType, ok := fields[key]
+			if !ok {
+				continue
+			}
+			value, ok, err := formValue(child, fieldType, key)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				object[key] = value
+			}
+		}
+		return object, true, nil
+	case t.Kind() == reflect.Slice:
+		if node.children == nil {
+			// Repeated fields, e.g. tags=urgent&tags=vip
+			items := []interface{}{}
+			for _, value := range node.values {
+				item, ok, err := formValue(&formNode{values: []string{value}}, t.Elem(), name)
+				if err != nil {
+					return nil, false, err
+				}
+				if ok {
+					items = append(items, item)
+				}
+			}
+			return items, true, nil
+		}
+		indexes := make([]int, 0, len(node.children))
+		for key := range node.children {
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 {
+				return nil, false, fmt.Errorf("invalid index %q of %s", key, name)
+			}
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		items := []interface{}{}
+		for _, index := range indexes {
+			item, ok, err := formValue(node.children[strconv.Itoa(index)], t.Elem(), fmt.Sprintf("%s[%d]", name, index))
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				items = append(items, item)
+			}
+		}
+		return items, true, nil
+	}
+
+	if len(node.values) == 0 {
+		return nil, false, nil
+	}
+	// The last value wins, like a checkbox after its hidden default
+	value := strings.TrimSpace(node.values[len(node.values)-1])
+	if value == "" && t.Kind() != reflect.String {
+		return nil, false, nil
+	}
+	return formScalar(value, t, name)
+}
+
+// formScalar converts the text of a field to the JSON value of type t
+func formScalar(value string, t reflect.Type, name string) (interface{}, bool, error) {
+	switch {
+	case t == timeType:
+		// Dates and datetime-local inputs, or RFC 3339
+		for _, layout := range []string{"2006-01-02", "2006-01-02T15:04"} {
+			if date, err := time.Parse(layout, value); err == nil {
+				return date, true, nil
+			}
+		}
+		date, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s date %q, expected YYYY-MM-DD", name, value)
+		}
+		return date, true, nil
+	case reflect.PointerTo(t).Implements(textUnmarshalerType):
+		return value, true, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return value, true, nil
+	case reflect.Bool:
+		// Checked checkboxes send "on"
+		if value == "on" {
+			return true, true, nil
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s %q, expected true or false", name, value)
+		}
+		return enabled, true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s %q, expected a whole number", name, value)
+		}
+		return number, true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s %q, expected a whole number", name, value)
+		}
+		return number, true, nil
+	case reflect.Float32, reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s %q, expected a number", name, value)
+		}
+		return number, true, nil
+	}
+	return nil, false, fmt.Errorf("%s can't be set from a form", name)
+}
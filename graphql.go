@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+)
+
+// The GraphQL API is served by graphql-go from the schema in graphql/:
+// schema.graphql declares the queries and the types, mutation.graphql the
+// mutations and their inputs. Introspection is enabled, so GraphQL tools
+// can explore it.
+
+var (
+	//go:embed graphql/schema.graphql
+	graphQLQuerySchema string
+	//go:embed graphql/mutation.graphql
+	graphQLMutationSchema string
+)
+
+// graphQLMaxDepth caps how deeply a query nests its selections. Companies
+// list their invoices, which have companies, so queries could otherwise
+// load the whole database; the introspection query GraphQL tools send
+// nests 12 levels.
+const graphQLMaxDepth = 12
+
+var (
+	// graphQLSchema serves POST requests, graphQLReadSchema the GET ones,
+	// which can't mutate
+	graphQLSchema     = newGraphQLSchema(graphQLQuerySchema + graphQLMutationSchema)
+	graphQLReadSchema = newGraphQLSchema(graphQLQuerySchema)
+)
+
+func newGraphQLSchema(source string) *graphql.Schema {
+	return graphql.MustParseSchema(source, &graphQLResolver{},
+		graphql.MaxDepth(graphQLMaxDepth),
+		// The store of a write request is a single transaction, the fields
+		// are resolved one at a time
+		graphql.MaxParallelism(1),
+	)
+}
+
+// errGraphQLNoMutations is what graphQLReadSchema answers mutations with
+const errGraphQLNoMutations = "no mutations are offered by the schema"
+
+type graphQLContextKey struct{}
+
+// graphQLRequestContext is what the resolvers of a request run with
+type graphQLRequestContext struct {
+	store Store
+	// holder is who the mutations edit invoices as
+	holder lockHolder
+}
+
+func graphQLContext(ctx context.Context) *graphQLRequestContext {
+	return ctx.Value(graphQLContextKey{}).(*graphQLRequestContext)
+}
+
+// gqlRef is an ID argument or input field. It is read from a string or a
+// number and encoded as the number the models' JSON holds.
+type gqlRef uint
+
+func (gqlRef) ImplementsGraphQLType(name string) bool {
+	return name == "ID"
+}
+
+func (r *gqlRef) UnmarshalGraphQL(input interface{}) error {
+	var id uint64
+	var err error
+	switch v := input.(type) {
+	case int32:
+		id = uint64(v)
+		if v < 0 {
+			err = errors.New("negative")
+		}
+	case float64:
+		// Numbers given as variables are decoded from JSON
+		id = uint64(v)
+		if v < 0 || float64(id) != v {
+			err = errors.New("not an integer")
+		}
+	case string:
+		id, err = strconv.ParseUint(v, 10, 32)
+	default:
+		err = errors.New("wrong type")
+	}
+	if err != nil || id > 1<<32-1 {
+		return fmt.Errorf("invalid ID %v", input)
+	}
+	*r = gqlRef(id)
+	return nil
+}
+
+func gqlID(id uint) graphql.ID {
+	return graphql.ID(strconv.FormatUint(uint64(id), 10))
+}
+
+func gqlOptionalID(id *uint) *graphql.ID {
+	if id == nil {
+		return nil
+	}
+	value := gqlID(*id)
+	return &value
+}
+
+func gqlOptionalInt(n *int) *int32 {
+	if n == nil {
+		return nil
+	}
+	value := int32(*n)
+	return &value
+}
+
+func gqlOptionalTime(t *time.Time) *graphql.Time {
+	if t == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *t}
+}
+
+func gqlDeleted(err error) (*bool, error) {
+	if err != nil {
+		return nil, err
+	}
+	deleted := true
+	return &deleted, nil
+}
+
+// gqlCustomFields is a custom_fields input, encoded as the object of values
+// by key the models' JSON holds
+type gqlCustomFields []struct {
+	Key   string
+	Value string
+}
+
+func (f gqlCustomFields) MarshalJSON() ([]byte, error) {
+	values := CustomFieldValues{}
+	for _, field := range f {
+		values[field.Key] = field.Value
+	}
+	return json.Marshal(values)
+}
+
+// The inputs of the mutations, encoded as the JSON of the REST API: fields
+// missing from the input are left out, keeping their current value once
+// decoded with gqlDecodeInput.
+
+type gqlCompanyInput struct {
+	Name                 *string          `json:"name,omitempty"`
+	Document             *string          `json:"document,omitempty"`
+	Address              *string          `json:"address,omitempty"`
+	Email                *string          `json:"email,omitempty"`
+	Locale               *string          `json:"locale,omitempty"`
+	Country              *string          `json:"country,omitempty"`
+	PeppolID             *string          `json:"peppol_id,omitempty"`
+	Phone                *string          `json:"phone,omitempty"`
+	WhatsAppOptIn        *bool            `json:"whatsapp_opt_in,omitempty"`
+	EmailCc              *string          `json:"email_cc,omitempty"`
+	EmailBcc             *string          `json:"email_bcc,omitempty"`
+	EmailReplyTo         *string          `json:"email_reply_to,omitempty"`
+	ConsolidationDay     *int32           `json:"consolidation_day,omitempty"`
+	ConsolidationRemitID *gqlRef          `json:"consolidation_remit_id,omitempty"`
+	ReferralSourceID     *gqlRef          `json:"referral_source_id,omitempty"`
+	PriceListID          *gqlRef          `json:"price_list_id,omitempty"`
+	IsIssuer             *bool            `json:"is_issuer,omitempty"`
+	IsClient             *bool            `json:"is_client,omitempty"`
+	IsSupplier           *bool            `json:"is_supplier,omitempty"`
+	InvoicePrefix        *string          `json:"invoice_prefix,omitempty"`
+	NumberingStrategy    *string          `json:"numbering_strategy,omitempty"`
+	DefaultRemitID       *gqlRef          `json:"default_remit_id,omitempty"`
+	CustomFields         *gqlCustomFields `json:"custom_fields,omitempty"`
+}
+
+type gqlProductInput struct {
+	Name        *string  `json:"name,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Price       *float64 `json:"price,omitempty"`
+	Unit        *string  `json:"unit,omitempty"`
+	CategoryID  *gqlRef  `json:"category_id,omitempty"`
+}
+
+type gqlInvoiceInput struct {
+	Type                  *string                `json:"type,omitempty"`
+	Locale                *string                `json:"locale,omitempty"`
+	InvoiceTemplateID     *gqlRef                `json:"invoice_template_id,omitempty"`
+	Code                  *string                `json:"code,omitempty"`
+	AdditionalInformation *string                `json:"additional_information,omitempty"`
+	Discount              *float64               `json:"discount,omitempty"`
+	DiscountType          *string                `json:"discount_type,omitempty"`
+	Penalty               *float64               `json:"penalty,omitempty"`
+	PenaltyType           *string                `json:"penalty_type,omitempty"`
+	IssueDate             *graphql.Time          `json:"issue_date,omitempty"`
+	DueDate               *graphql.Time          `json:"due_date,omitempty"`
+	RemitInformationID    *gqlRef                `json:"remit_information_id,omitempty"`
+	CompanyID             *gqlRef                `json:"company_id,omitempty"`
+	ClientID              *gqlRef                `json:"client_id,omitempty"`
+	ProjectID             *gqlRef                `json:"project_id,omitempty"`
+	InvoiceLines          *[]gqlInvoiceLineInput `json:"invoice_lines,omitempty"`
+	CustomFields          *gqlCustomFields       `json:"custom_fields,omitempty"`
+}
+
+type gqlInvoiceLineInput struct {
+	Type         *string  `json:"type,omitempty"`
+	ProductID    *gqlRef  `json:"product_id,omitempty"`
+	Quantity     *float64 `json:"quantity,omitempty"`
+	Unit         *string  `json:"unit,omitempty"`
+	Description  *string  `json:"description,omitempty"`
+	UnitPrice    *float64 `json:"unit_price,omitempty"`
+	Discount     *float64 `json:"discount,omitempty"`
+	DiscountType *string  `json:"discount_type,omitempty"`
+	Position     *int32   `json:"position,omitempty"`
+}
+
+// gqlDecodeInput fills target from an input, going through the JSON of the
+// REST API so the models read it the way they read a request body
+func gqlDecodeInput(input interface{}, target interface{}) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("invalid input: %w", err)
+	}
+	return nil
+}
+
+// graphQLResolver resolves the queries and the mutations
+type graphQLResolver struct{}
+
+func (*graphQLResolver) Companies(ctx context.Context) ([]*gqlCompany, error) {
+	store := graphQLContext(ctx).store
+	companies, err := store.GetCompanies(CompanyFilter{})
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]*gqlCompany, len(companies))
+	for i := range companies {
+		resolvers[i] = &gqlCompany{&companies[i], store}
+	}
+	return resolvers, nil
+}
+
+func (*graphQLResolver) Company(ctx context.Context, args struct{ ID gqlRef }) (*gqlCompany, error) {
+	store := graphQLContext(ctx).store
+	company, err := store.GetCompany(uint(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &gqlCompany{company, store}, nil
+}
+
+func (*graphQLResolver) Products(ctx context.Context) ([]*gqlProduct, error) {
+	products, err := graphQLContext(ctx).store.GetProducts(ProductFilter{Archived: new(bool)})
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]*gqlProduct, len(products))
+	for i := range products {
+		resolvers[i] = &gqlProduct{&products[i]}
+	}
+	return resolvers, nil
+}
+
+func (*graphQLResolver) Product(ctx context.Context, args struct{ ID gqlRef }) (*gqlProduct, error) {
+	product, err := graphQLContext(ctx).store.GetProduct(uint(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &gqlProduct{product}, nil
+}
+
+func (*graphQLResolver) Invoices(ctx context.Context, args struct {
+	Type   *string
+	Search *string
+}) ([]*gqlInvoice, error) {
+	store := graphQLContext(ctx).store
+	filter := InvoiceFilter{}
+	if args.Type != nil {
+		filter.Type = DocumentType(*args.Type)
+		if !filter.Type.Valid() {
+			return nil, errors.New("invalid document type")
+		}
+	}
+	if args.Search != nil {
+		filter.Search = *args.Search
+	}
+	invoices, err := store.GetInvoices(filter)
+	if err != nil {
+		return nil, err
+	}
+	return gqlInvoices(invoices, store), nil
+}
+
+func (*graphQLResolver) Invoice(ctx context.Context, args struct{ ID gqlRef }) (*gqlInvoice, error) {
+	store := graphQLContext(ctx).store
+	invoice, err := store.GetInvoice(uint(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &gqlInvoice{invoice, store}, nil
+}
+
+func (*graphQLResolver) CreateCompany(ctx context.Context, args struct{ Input gqlCompanyInput }) (*gqlCompany, error) {
+	store := graphQLContext(ctx).store
+	var company Company
+	if err := gqlDecodeInput(args.Input, &company); err != nil {
+		return nil, err
+	}
+	if err := validateCompany(&company); err != nil {
+		return nil, err
+	}
+	if err := checkCustomFields(store, CustomFieldCompany, company.CustomFields); err != nil {
+		return nil, err
+	}
+	if err := store.CreateCompany(&company); err != nil {
+		return nil, err
+	}
+	return &gqlCompany{&company, store}, nil
+}
+
+func (*graphQLResolver) UpdateCompany(ctx context.Context, args struct {
+	ID    gqlRef
+	Input gqlCompanyInput
+}) (*gqlCompany, error) {
+	store := graphQLContext(ctx).store
+	id := uint(args.ID)
+	company, err := store.GetCompany(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := gqlDecodeInput(args.Input, company); err != nil {
+		return nil, err
+	}
+	if err := validateCompany(company); err != nil {
+		return nil, err
+	}
+	if err := checkCustomFields(store, CustomFieldCompany, company.CustomFields); err != nil {
+		return nil, err
+	}
+	company.ID = id
+	company.Logo, company.ReferralSource, company.ConsolidationRemit = nil, nil, nil
+	if err := store.UpdateCompany(company); err != nil {
+		return nil, err
+	}
+	if company, err = store.GetCompany(id); err != nil {
+		return nil, err
+	}
+	return &gqlCompany{company, store}, nil
+}
+
+func (*graphQLResolver) DeleteCompany(ctx context.Context, args struct{ ID gqlRef }) (*bool, error) {
+	return gqlDeleted(graphQLContext(ctx).store.DeleteCompany(uint(args.ID)))
+}
+
+func (*graphQLResolver) CreateProduct(ctx context.Context, args struct{ Input gqlProductInput }) (*gqlProduct, error) {
+	store := graphQLContext(ctx).store
+	var product Product
+	if err := gqlDecodeInput(args.Input, &product); err != nil {
+		return nil, err
+	}
+	if err := validateProduct(&product); err != nil {
+		return nil, err
+	}
+	if err := store.CreateProduct(&product); err != nil {
+		return nil, err
+	}
+	return &gqlProduct{&product}, nil
+}
+
+func (*graphQLResolver) UpdateProduct(ctx context.Context, args struct {
+	ID    gqlRef
+	Input gqlProductInput
+}) (*gqlProduct, error) {
+	store := graphQLContext(ctx).store
+	id := uint(args.ID)
+	product, err := store.GetProduct(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := gqlDecodeInput(args.Input, product); err != nil {
+		return nil, err
+	}
+	product.ID = id
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+	if err := store.UpdateProduct(product); err != nil {
+		return nil, err
+	}
+	return &gqlProduct{product}, nil
+}
+
+func (*graphQLResolver) DeleteProduct(ctx context.Context, args struct{ ID gqlRef }) (*bool, error) {
+	return gqlDeleted(graphQLContext(ctx).store.DeleteProduct(uint(args.ID)))
+}
+
+func (*graphQLResolver) CreateInvoice(ctx context.Context, args struct{ Input gqlInvoiceInput }) (*gqlInvoice, error) {
+	store := graphQLContext(ctx).store
+	var invoice Invoice
+	if err := gqlDecodeInput(args.Input, &invoice); err != nil {
+		return nil, err
+	}
+	if err := validateInvoice(&invoice); err != nil {
+		return nil, err
+	}
+	if err := checkCustomFields(store, CustomFieldInvoice, invoice.CustomFields); err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceIssuer(store, &invoice); err != nil {
+		return nil, err
+	}
+	if err := store.CreateInvoice(&invoice); err != nil {
+		return nil, err
+	}
+	created, err := store.GetInvoice(invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlInvoice{created, store}, nil
+}
+
+func (*graphQLResolver) UpdateInvoice(ctx context.Context, args struct {
+	ID    gqlRef
+	Input gqlInvoiceInput
+}) (*gqlInvoice, error) {
+	request := graphQLContext(ctx)
+	store := request.store
+	id := uint(args.ID)
+	invoice, err := store.GetInvoice(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceLock(store, id, request.holder, time.Now()); err != nil {
+		return nil, err
+	}
+	// Lines given in the input replace the current ones
+	if args.Input.InvoiceLines != nil {
+		invoice.InvoiceLines = nil
+	}
+	if err := gqlDecodeInput(args.Input, invoice); err != nil {
+		return nil, err
+	}
+	if err := validateInvoice(invoice); err != nil {
+		return nil, err
+	}
+	if err := checkCustomFields(store, CustomFieldInvoice, invoice.CustomFields); err != nil {
+		return nil, err
+	}
+	if err := checkInvoiceIssuer(store, invoice); err != nil {
+		return nil, err
+	}
+	invoice.ID = id
+	invoice.Company, invoice.Client, invoice.RemitInformation = Company{}, Company{}, RemitInformation{}
+	for i := range invoice.InvoiceLines {
+		invoice.InvoiceLines[i].Product = nil
+	}
+	if err := store.UpdateInvoice(invoice); err != nil {
+		return nil, err
+	}
+	if invoice, err = store.GetInvoice(id); err != nil {
+		return nil, err
+	}
+	return &gqlInvoice{invoice, store}, nil
+}
+
+func (*graphQLResolver) DeleteInvoice(ctx context.Context, args struct{ ID gqlRef }) (*bool, error) {
+	request := graphQLContext(ctx)
+	if err := checkInvoiceLock(request.store, uint(args.ID), request.holder, time.Now()); err != nil {
+		return nil, err
+	}
+	return gqlDeleted(request.store.DeleteInvoice(uint(args.ID)))
+}
+
+// The resolvers of the object types, named after the fields of the schema
+
+type gqlCompany struct {
+	company *Company
+	store   Store
+}
+
+func (c *gqlCompany) ID() graphql.ID           { return gqlID(c.company.ID) }
+func (c *gqlCompany) Name() string             { return c.company.Name }
+func (c *gqlCompany) Document() string         { return c.company.Document }
+func (c *gqlCompany) Address() string          { return c.company.Address }
+func (c *gqlCompany) Email() string            { return c.company.Email }
+func (c *gqlCompany) Locale() string           { return string(c.company.Locale) }
+func (c *gqlCompany) Country() string          { return c.company.Country }
+func (c *gqlCompany) PeppolID() string         { return c.company.PeppolID }
+func (c *gqlCompany) EmailCc() string          { return c.company.EmailCc }
+func (c *gqlCompany) EmailBcc() string         { return c.company.EmailBcc }
+func (c *gqlCompany) EmailReplyTo() string     { return c.company.EmailReplyTo }
+func (c *gqlCompany) ConsolidationDay() *int32 { return gqlOptionalInt(c.company.ConsolidationDay) }
+func (c *gqlCompany) ConsolidationRemitID() *graphql.ID {
+	return gqlOptionalID(c.company.ConsolidationRemitID)
+}
+func (c *gqlCompany) ReferralSourceID() *graphql.ID { return gqlOptionalID(c.company.ReferralSourceID) }
+func (c *gqlCompany) IsIssuer() bool                { return c.company.IsIssuer }
+func (c *gqlCompany) IsClient() bool                { return c.company.IsClient }
+func (c *gqlCompany) IsSupplier() bool              { return c.company.IsSupplier }
+func (c *gqlCompany) Tags() []string                { return c.company.Tags }
+func (c *gqlCompany) OwnerID() *graphql.ID          { return gqlOptionalID(c.company.OwnerID) }
+func (c *gqlCompany) ArchivedAt() *graphql.Time     { return gqlOptionalTime(c.company.ArchivedAt) }
+
+func (c *gqlCompany) Invoices() ([]*gqlInvoice, error) {
+	invoices, err := c.store.GetClientInvoices(c.company.ID)
+	if err != nil {
+		return nil, err
+	}
+	return gqlInvoices(invoices, c.store), nil
+}
+
+type gqlProduct struct {
+	product *Product
+}
+
+func (p *gqlProduct) ID() graphql.ID            { return gqlID(p.product.ID) }
+func (p *gqlProduct) Name() string              { return p.product.Name }
+func (p *gqlProduct) Description() *string      { return p.product.Description }
+func (p *gqlProduct) Price() float64            { return p.product.Price.Float() }
+func (p *gqlProduct) Unit() string              { return string(p.product.Unit) }
+func (p *gqlProduct) CategoryID() *graphql.ID   { return gqlOptionalID(p.product.CategoryID) }
+func (p *gqlProduct) Tags() []string            { return p.product.Tags }
+func (p *gqlProduct) ArchivedAt() *graphql.Time { return gqlOptionalTime(p.product.ArchivedAt) }
+
+type gqlRemitInformation struct {
+	remit *RemitInformation
+}
+
+func (r *gqlRemitInformation) ID() graphql.ID { return gqlID(r.remit.ID) }
+func (r *gqlRemitInformation) Name() string   { return r.remit.Name }
+
+func (r *gqlRemitInformation) Lines() []*gqlRemitInformationLine {
+	lines := make([]*gqlRemitInformationLine, len(r.remit.Lines))
+	for i := range r.remit.Lines {
+		lines[i] = &gqlRemitInformationLine{&r.remit.Lines[i]}
+	}
+	return lines
+}
+
+type gqlRemitInformationLine struct {
+	line *RemitInformationLine
+}
+
+func (l *gqlRemitInformationLine) Key() string   { return l.line.Key }
+func (l *gqlRemitInformationLine) Value() string { return l.line.Value }
+
+type gqlInvoice struct {
+	invoice *Invoice
+	store   Store
+}
+
+func gqlInvoices(invoices []Invoice, store Store) []*gqlInvoice {
+	resolvers := make([]*gqlInvoice, len(invoices))
+	for i := range invoices {
+		resolvers[i] = &gqlInvoice{&invoices[i], store}
+	}
+	return resolvers
+}
+
+func (i *gqlInvoice) ID() graphql.ID                 { return gqlID(i.invoice.ID) }
+func (i *gqlInvoice) UUID() string                   { return i.invoice.UUID.String() }
+func (i *gqlInvoice) Type() string                   { return string(i.invoice.Type) }
+func (i *gqlInvoice) Locale() string                 { return string(i.invoice.Locale) }
+func (i *gqlInvoice) Number() *int32                 { return gqlOptionalInt(i.invoice.Number) }
+func (i *gqlInvoice) Code() string                   { return i.invoice.Code }
+func (i *gqlInvoice) SentAt() *graphql.Time          { return gqlOptionalTime(i.invoice.SentAt) }
+func (i *gqlInvoice) Identification() string         { return i.invoice.Identification() }
+func (i *gqlInvoice) AdditionalInformation() *string { return i.invoice.AdditionalInformation }
+func (i *gqlInvoice) Discount() float64              { return i.invoice.Discount.Float() }
+func (i *gqlInvoice) DiscountType() string           { return string(i.invoice.DiscountType) }
+func (i *gqlInvoice) DiscountAmount() float64        { return i.invoice.DiscountAmount().Float() }
+func (i *gqlInvoice) Penalty() float64               { return i.invoice.Penalty.Float() }
+func (i *gqlInvoice) PenaltyType() string            { return string(i.invoice.PenaltyType) }
+func (i *gqlInvoice) PenaltyAmount() float64         { return i.invoice.PenaltyAmount().Float() }
+func (i *gqlInvoice) Paid() bool                     { return i.invoice.Paid }
+func (i *gqlInvoice) IssueDate() graphql.Time        { return graphql.Time{Time: i.invoice.IssueDate} }
+func (i *gqlInvoice) DueDate() graphql.Time          { return graphql.Time{Time: i.invoice.DueDate} }
+func (i *gqlInvoice) SubTotal() float64              { return i.invoice.SubTotal().Float() }
+func (i *gqlInvoice) TaxTotal() float64              { return i.invoice.TaxTotal.Float() }
+func (i *gqlInvoice) Total() float64                 { return i.invoice.Total().Float() }
+func (i *gqlInvoice) Tags() []string                 { return i.invoice.Tags }
+func (i *gqlInvoice) OwnerID() *graphql.ID           { return gqlOptionalID(i.invoice.OwnerID) }
+func (i *gqlInvoice) ArchivedAt() *graphql.Time      { return gqlOptionalTime(i.invoice.ArchivedAt) }
+func (i *gqlInvoice) ProjectID() *graphql.ID         { return gqlOptionalID(i.invoice.ProjectID) }
+func (i *gqlInvoice) Company() *gqlCompany           { return &gqlCompany{&i.invoice.Company, i.store} }
+func (i *gqlInvoice) Client() *gqlCompany            { return &gqlCompany{&i.invoice.Client, i.store} }
+
+func (i *gqlInvoice) RemitInformation() *gqlRemitInformation {
+	return &gqlRemitInformation{&i.invoice.RemitInformation}
+}
+
+func (i *gqlInvoice) InvoiceLines() []*gqlInvoiceLine {
+	lines := make([]*gqlInvoiceLine, len(i.invoice.InvoiceLines))
+	for index := range i.invoice.InvoiceLines {
+		lines[index] = &gqlInvoiceLine{&i.invoice.InvoiceLines[index]}
+	}
+	return lines
+}
+
+func (i *gqlInvoice) Payments() ([]*gqlPayment, error) {
+	payments, err := i.store.GetPayments(i.invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]*gqlPayment, len(payments))
+	for index := range payments {
+		resolvers[index] = &gqlPayment{&payments[index]}
+	}
+	return resolvers, nil
+}
+
+func (i *gqlInvoice) PaidAmount() (float64, error) {
+	paid, err := i.store.GetPaidAmount(i.invoice.ID)
+	return paid.Float(), err
+}
+
+type gqlInvoiceLine struct {
+	line *InvoiceLine
+}
+
+func (l *gqlInvoiceLine) ID() graphql.ID       { return gqlID(l.line.ID) }
+func (l *gqlInvoiceLine) Type() string         { return string(l.line.Type) }
+func (l *gqlInvoiceLine) Position() int32      { return int32(l.line.Position) }
+func (l *gqlInvoiceLine) Quantity() float64    { return l.line.Quantity }
+func (l *gqlInvoiceLine) Unit() string         { return string(l.line.Unit) }
+func (l *gqlInvoiceLine) Description() *string { return l.line.Description }
+func (l *gqlInvoiceLine) UnitPrice() float64   { return l.line.UnitPrice.Float() }
+func (l *gqlInvoiceLine) Discount() float64    { return l.line.Discount.Float() }
+func (l *gqlInvoiceLine) DiscountType() string { return string(l.line.DiscountType) }
+func (l *gqlInvoiceLine) Total() float64       { return l.line.Total().Float() }
+
+func (l *gqlInvoiceLine) Product() *gqlProduct {
+	if l.line.Product == nil {
+		return nil
+	}
+	return &gqlProduct{l.line.Product}
+}
+
+type gqlPayment struct {
+	payment *Payment
+}
+
+func (p *gqlPayment) ID() graphql.ID     { return gqlID(p.payment.ID) }
+func (p *gqlPayment) Amount() float64    { return p.payment.Amount.Float() }
+func (p *gqlPayment) Date() graphql.Time { return graphql.Time{Time: p.payment.Date} }
+func (p *gqlPayment) Reference() *string { return p.payment.Reference }
+
+// graphQLRequest is the body of a GraphQL request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": err.Error()}},
+	})
+}
+
+func (h *Handler) graphQL(w http.ResponseWriter, r *http.Request) {
+	var request graphQLRequest
+	schema := graphQLSchema
+	if r.Method == http.MethodGet {
+		schema = graphQLReadSchema
+		request.Query = r.URL.Query().Get("query")
+		request.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, fmt.Errorf("invalid variables: %w", err))
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphQLContextKey{}, &graphQLRequestContext{
+		store:  h.storeFor(r),
+		holder: editLockHolder(r),
+	})
+	response := schema.Exec(ctx, request.Query, request.OperationName, request.Variables)
+
+	status := http.StatusOK
+	if response.Data == nil && len(response.Errors) > 0 {
+		// The query couldn't be parsed or validated, nothing ran
+		status = http.StatusBadRequest
+		if response.Errors[0].Message == errGraphQLNoMutations {
+			writeGraphQLError(w, http.StatusMethodNotAllowed, errors.New("mutations must be sent with POST"))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
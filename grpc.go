@@ -0,0 +1,587 @@
+package main
+
+//go:generate buf generate
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/samuel19992/tiny-crm/tinycrmpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// The gRPC services expose companies, products, invoices and payments on
+// their own port. They are built on the same Store as the HTTP handlers and
+// share their validation, so both APIs behave the same.
+
+// newGRPCServer registers every service. Unless testing, calls must carry
+// the same basic auth credentials as the HTTP API in the authorization
+// metadata.
+func newGRPCServer(store Store, testing bool, opts ...grpc.ServerOption) *grpc.Server {
+	if !testing {
+		opts = append(opts, grpc.UnaryInterceptor(grpcAuthInterceptor(store)))
+	}
+	server := grpc.NewServer(opts...)
+	tinycrmpb.RegisterCompanyServiceServer(server, &companyService{store: store})
+	tinycrmpb.RegisterProductServiceServer(server, &productService{store: store})
+	tinycrmpb.RegisterInvoiceServiceServer(server, &invoiceService{store: store})
+	tinycrmpb.RegisterPaymentServiceServer(server, &paymentService{store: store})
+	return server
+}
+
+// serveGRPC listens on the configured gRPC port, with the HTTPS certificates
+// when TLS is enabled
+func serveGRPC(c *Config, store Store, testing bool) error {
+	creds, err := grpcCredentials(c)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", ":"+c.GRPCPort)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Running gRPC on port " + c.GRPCPort)
+	return newGRPCServer(store, testing, grpc.Creds(creds)).Serve(listener)
+}
+
+func grpcAuthInterceptor(store Store) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			if username, password, ok := parseBasicAuth(value); ok && authenticate(store, username, password) {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+}
+
+// parseBasicAuth reads "Basic base64(username:password)"
+func parseBasicAuth(value string) (username, password string, ok bool) {
+	scheme, encoded, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// grpcError maps store errors to status codes
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrDocumentNotPayable), errors.Is(err, ErrProductInUse), errors.Is(err, ErrCompanyInUse), errors.Is(err, ErrRemitInUse), errors.Is(err, ErrSentInvoiceDeletion),
+		errors.Is(err, ErrInvoiceIssued):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvoiceLocked):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrDiscountExceedsSubtotal):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func invalidArgument(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func uintToProto(value *uint) *uint32 {
+	if value == nil {
+		return nil
+	}
+	converted := uint32(*value)
+	return &converted
+}
+
+func uintFromProto(value *uint32) *uint {
+	if value == nil {
+		return nil
+	}
+	converted := uint(*value)
+	return &converted
+}
+
+func timeToProto(value *time.Time) *timestamppb.Timestamp {
+	if value == nil {
+		return nil
+	}
+	return timestamppb.New(*value)
+}
+
+// timeFromProto returns the zero time for unset timestamps
+func timeFromProto(value *timestamppb.Timestamp) time.Time {
+	if value == nil {
+		return time.Time{}
+	}
+	return value.AsTime()
+}
+
+func companyToProto(company *Company) *tinycrmpb.Company {
+	return &tinycrmpb.Company{
+		Id:               uint32(company.ID),
+		Name:             company.Name,
+		Document:         company.Document,
+		Address:          company.Address,
+		Email:            company.Email,
+		Locale:           string(company.Locale),
+		Country:          company.Country,
+		PeppolId:         company.PeppolID,
+		ReferralSourceId: uintToProto(company.ReferralSourceID),
+		Tags:             company.Tags,
+		OwnerId:          uintToProto(company.OwnerID),
+		ArchivedAt:       timeToProto(company.ArchivedAt),
+	}
+}
+
+func companyFromProto(company *tinycrmpb.Company) *Company {
+	return &Company{
+		ID:               uint(company.GetId()),
+		Name:             company.GetName(),
+		Document:         company.GetDocument(),
+		Address:          company.GetAddress(),
+		Email:            company.GetEmail(),
+		Locale:           Locale(company.GetLocale()),
+		Country:          company.GetCountry(),
+		PeppolID:         company.GetPeppolId(),
+		ReferralSourceID: uintFromProto(company.ReferralSourceId),
+	}
+}
+
+func productToProto(product *Product) *tinycrmpb.Product {
+	return &tinycrmpb.Product{
+		Id:          uint32(product.ID),
+		Name:        product.Name,
+		Description: product.Description,
+		Price:       product.Price.Float(),
+	}
+}
+
+func productFromProto(product *tinycrmpb.Product) *Product {
+	return &Product{
+		ID:          uint(product.GetId()),
+		Name:        product.GetName(),
+		Description: product.Description,
+		Price:       moneyFromFloat(product.GetPrice()),
+	}
+}
+
+func invoiceToProto(invoice *Invoice) *tinycrmpb.Invoice {
+	remit := &tinycrmpb.RemitInformation{
+		Id:   uint32(invoice.RemitInformation.ID),
+		Name: invoice.RemitInformation.Name,
+	}
+	for _, line := range invoice.RemitInformation.Lines {
+		remit.Lines = append(remit.Lines, &tinycrmpb.RemitInformationLine{
+			Id:    uint32(line.ID),
+			Key:   line.Key,
+			Value: line.Value,
+		})
+	}
+
+	var number *int32
+	if invoice.Number != nil {
+		converted := int32(*invoice.Number)
+		number = &converted
+	}
+
+	converted := &tinycrmpb.Invoice{
+		Id:                    uint32(invoice.ID),
+		Uuid:                  invoice.UUID.String(),
+		Type:                  string(invoice.Type),
+		Locale:                string(invoice.Locale),
+		Number:                number,
+		AdditionalInformation: invoice.AdditionalInformation,
+		Discount:              invoice.Discount.Float(),
+		Penalty:               invoice.Penalty.Float(),
+		Paid:                  invoice.Paid,
+		IssueDate:             timestamppb.New(invoice.IssueDate),
+		DueDate:               timestamppb.New(invoice.DueDate),
+		RemitInformationId:    uint32(invoice.RemitInformationID),
+		CompanyId:             uint32(invoice.CompanyID),
+		ClientId:              uint32(invoice.ClientID),
+		Company:               companyToProto(&invoice.Company),
+		Client:                companyToProto(&invoice.Client),
+		RemitInformation:      remit,
+		Subtotal:              invoice.SubTotal().Float(),
+		Total:                 invoice.Total().Float(),
+		Tags:                  invoice.Tags,
+		OwnerId:               uintToProto(invoice.OwnerID),
+		ArchivedAt:            timeToProto(invoice.ArchivedAt),
+	}
+	for _, line := range invoice.InvoiceLines {
+		protoLine := &tinycrmpb.InvoiceLine{
+			Id: uint32(line.ID),
+			// The rounded quantity is still filled for the clients built
+			// before decimal_quantity
+			Quantity:        int32(math.Round(line.Quantity)),
+			DecimalQuantity: &line.Quantity,
+			Unit:            string(line.Unit),
+			Description:     line.Description,
+			Total:           line.Total().Float(),
+		}
+		// Free text lines and sections have no product, product_id 0
+		if line.ProductID != nil {
+			protoLine.ProductId = uint32(*line.ProductID)
+		}
+		if line.Product != nil {
+			protoLine.Product = productToProto(line.Product)
+		}
+		converted.Lines = append(converted.Lines, protoLine)
+	}
+	return converted
+}
+
+func grpcLineKey(line *InvoiceLine) string {
+	if line.ProductID != nil {
+		return fmt.Sprintf("product %d", *line.ProductID)
+	}
+	return "text " + line.Name()
+}
+
+func invoiceFromProto(invoice *tinycrmpb.Invoice) *Invoice {
+	var number *int
+	if invoice.Number != nil {
+		converted := int(*invoice.Number)
+		number = &converted
+	}
+
+	converted := &Invoice{
+		ID:                    uint(invoice.GetId()),
+		Type:                  DocumentType(invoice.GetType()),
+		Locale:                Locale(invoice.GetLocale()),
+		Number:                number,
+		AdditionalInformation: invoice.AdditionalInformation,
+		Discount:              moneyFromFloat(invoice.GetDiscount()),
+		Penalty:               moneyFromFloat(invoice.GetPenalty()),
+		Paid:                  invoice.GetPaid(),
+		IssueDate:             timeFromProto(invoice.IssueDate),
+		DueDate:               timeFromProto(invoice.DueDate),
+		RemitInformationID:    uint(invoice.GetRemitInformationId()),
+		CompanyID:             uint(invoice.GetCompanyId()),
+		ClientID:              uint(invoice.GetClientId()),
+	}
+	if converted.IssueDate.IsZero() {
+		converted.IssueDate = clock.Now()
+	}
+	for _, line := range invoice.GetLines() {
+		convertedLine := InvoiceLine{Quantity: line.GetDecimalQuantity(), Unit: Unit(line.GetUnit()), Description: line.Description}
+		if line.DecimalQuantity == nil {
+			convertedLine.Quantity = float64(line.GetQuantity())
+		}
+		if line.GetProductId() != 0 {
+			productID := uint(line.GetProductId())
+			convertedLine.ProductID = &productID
+		}
+		converted.InvoiceLines = append(converted.InvoiceLines, convertedLine)
+	}
+	return converted
+}
+
+func paymentToProto(payment *Payment) *tinycrmpb.Payment {
+	return &tinycrmpb.Payment{
+		Id:        uint32(payment.ID),
+		InvoiceId: uint32(payment.InvoiceID),
+		Amount:    payment.Amount.Float(),
+		Date:      timestamppb.New(payment.Date),
+		Reference: payment.Reference,
+	}
+}
+
+type companyService struct {
+	tinycrmpb.UnimplementedCompanyServiceServer
+	store Store
+}
+
+func (s *companyService) ListCompanies(ctx context.Context, req *tinycrmpb.ListCompaniesRequest) (*tinycrmpb.ListCompaniesResponse, error) {
+	companies, err := s.store.GetCompanies(CompanyFilter{
+		Tag:              req.GetTag(),
+		OwnerID:          uintFromProto(req.OwnerId),
+		Archived:         req.Archived,
+		Country:          req.GetCountry(),
+		ReferralSourceID: uintFromProto(req.ReferralSourceId),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &tinycrmpb.ListCompaniesResponse{}
+	for i := range companies {
+		response.Companies = append(response.Companies, companyToProto(&companies[i]))
+	}
+	return response, nil
+}
+
+func (s *companyService) GetCompany(ctx context.Context, req *tinycrmpb.GetCompanyRequest) (*tinycrmpb.Company, error) {
+	company, err := s.store.GetCompany(uint(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return companyToProto(company), nil
+}
+
+func (s *companyService) CreateCompany(ctx context.Context, req *tinycrmpb.CreateCompanyRequest) (*tinycrmpb.Company, error) {
+	company := companyFromProto(req.GetCompany())
+	company.ID = 0
+	if err := validateCompany(company); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if err := s.store.CreateCompany(company); err != nil {
+		return nil, grpcError(err)
+	}
+	return s.GetCompany(ctx, &tinycrmpb.GetCompanyRequest{Id: uint32(company.ID)})
+}
+
+func (s *companyService) UpdateCompany(ctx context.Context, req *tinycrmpb.UpdateCompanyRequest) (*tinycrmpb.Company, error) {
+	company := companyFromProto(req.GetCompany())
+	if err := validateCompany(company); err != nil {
+		return nil, invalidArgument(err)
+	}
+	existing, err := s.store.GetCompany(company.ID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	// The message has no quota, email copy, consolidation, role, custom
+	// fields nor WhatsApp phone, keep the ones set over HTTP
+	company.StorageQuotaMB = existing.StorageQuotaMB
+	company.IsIssuer, company.IsClient, company.IsSupplier = existing.IsIssuer, existing.IsClient, existing.IsSupplier
+	company.EmailCc, company.EmailBcc, company.EmailReplyTo = existing.EmailCc, existing.EmailBcc, existing.EmailReplyTo
+	company.ConsolidationDay, company.ConsolidationRemitID = existing.ConsolidationDay, existing.ConsolidationRemitID
+	company.CustomFields = existing.CustomFields
+	company.Phone, company.WhatsAppOptIn = existing.Phone, existing.WhatsAppOptIn
+	if err := s.store.UpdateCompany(company); err != nil {
+		return nil, grpcError(err)
+	}
+	return s.GetCompany(ctx, &tinycrmpb.GetCompanyRequest{Id: uint32(company.ID)})
+}
+
+func (s *companyService) DeleteCompany(ctx context.Context, req *tinycrmpb.DeleteCompanyRequest) (*emptypb.Empty, error) {
+	if err := s.store.DeleteCompany(uint(req.GetId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+type productService struct {
+	tinycrmpb.UnimplementedProductServiceServer
+	store Store
+}
+
+func (s *productService) ListProducts(ctx context.Context, req *tinycrmpb.ListProductsRequest) (*tinycrmpb.ListProductsResponse, error) {
+	products, err := s.store.GetProducts(ProductFilter{Archived: new(bool)})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &tinycrmpb.ListProductsResponse{}
+	for i := range products {
+		response.Products = append(response.Products, productToProto(&products[i]))
+	}
+	return response, nil
+}
+
+func (s *productService) GetProduct(ctx context.Context, req *tinycrmpb.GetProductRequest) (*tinycrmpb.Product, error) {
+	product, err := s.store.GetProduct(uint(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return productToProto(product), nil
+}
+
+func (s *productService) CreateProduct(ctx context.Context, req *tinycrmpb.CreateProductRequest) (*tinycrmpb.Product, error) {
+	product := productFromProto(req.GetProduct())
+	product.ID = 0
+	if err := s.store.CreateProduct(product); err != nil {
+		return nil, grpcError(err)
+	}
+	return productToProto(product), nil
+}
+
+func (s *productService) UpdateProduct(ctx context.Context, req *tinycrmpb.UpdateProductRequest) (*tinycrmpb.Product, error) {
+	product := productFromProto(req.GetProduct())
+	current, err := s.store.GetProduct(product.ID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	// The category and tags aren't part of the gRPC product
+	product.CategoryID, product.Tags = current.CategoryID, current.Tags
+	if err := s.store.UpdateProduct(product); err != nil {
+		return nil, grpcError(err)
+	}
+	return productToProto(product), nil
+}
+
+func (s *productService) DeleteProduct(ctx context.Context, req *tinycrmpb.DeleteProductRequest) (*emptypb.Empty, error) {
+	if err := s.store.DeleteProduct(uint(req.GetId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+type invoiceService struct {
+	tinycrmpb.UnimplementedInvoiceServiceServer
+	store Store
+}
+
+func (s *invoiceService) ListInvoices(ctx context.Context, req *tinycrmpb.ListInvoicesRequest) (*tinycrmpb.ListInvoicesResponse, error) {
+	filter := InvoiceFilter{
+		Type:      DocumentType(req.GetType()),
+		CompanyID: uintFromProto(req.CompanyId),
+		ClientID:  uintFromProto(req.ClientId),
+		Paid:      req.Paid,
+		Tag:       req.GetTag(),
+		OwnerID:   uintFromProto(req.OwnerId),
+		Archived:  req.Archived,
+	}
+	if !filter.Type.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "Invalid document type")
+	}
+
+	invoices, err := s.store.GetInvoices(filter)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &tinycrmpb.ListInvoicesResponse{}
+	for i := range invoices {
+		response.Invoices = append(response.Invoices, invoiceToProto(&invoices[i]))
+	}
+	return response, nil
+}
+
+func (s *invoiceService) GetInvoice(ctx context.Context, req *tinycrmpb.GetInvoiceRequest) (*tinycrmpb.Invoice, error) {
+	invoice, err := s.store.GetInvoice(uint(req.GetId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return invoiceToProto(invoice), nil
+}
+
+func (s *invoiceService) CreateInvoice(ctx context.Context, req *tinycrmpb.CreateInvoiceRequest) (*tinycrmpb.Invoice, error) {
+	invoice := invoiceFromProto(req.GetInvoice())
+	invoice.ID = 0
+	if err := validateInvoice(invoice); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if err := checkInvoiceIssuer(s.store, invoice); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if err := s.store.CreateInvoice(invoice); err != nil {
+		return nil, grpcError(err)
+	}
+	return s.GetInvoice(ctx, &tinycrmpb.GetInvoiceRequest{Id: uint32(invoice.ID)})
+}
+
+func (s *invoiceService) UpdateInvoice(ctx context.Context, req *tinycrmpb.UpdateInvoiceRequest) (*tinycrmpb.Invoice, error) {
+	invoice := invoiceFromProto(req.GetInvoice())
+	if err := validateInvoice(invoice); err != nil {
+		return nil, invalidArgument(err)
+	}
+	if err := checkInvoiceIssuer(s.store, invoice); err != nil {
+		return nil, invalidArgument(err)
+	}
+	existing, err := s.store.GetInvoice(invoice.ID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	// gRPC clients don't check invoices out, they wait for the lock to go
+	if err := checkInvoiceLock(s.store, invoice.ID, lockHolder{}, time.Now()); err != nil {
+		return nil, grpcError(err)
+	}
+	// Keep what the message can't carry
+	invoice.UUID = existing.UUID
+	invoice.InvoiceTemplateID = existing.InvoiceTemplateID
+	invoice.DiscountType = existing.DiscountType
+	invoice.PenaltyType = existing.PenaltyType
+	invoice.ProjectID = existing.ProjectID
+	invoice.CustomFields = existing.CustomFields
+	// Lines are matched by their product, or by their text when they have
+	// none, to keep their type, price and discount
+	existingLines := map[string]InvoiceLine{}
+	for _, line := range existing.InvoiceLines {
+		existingLines[grpcLineKey(&line)] = line
+	}
+	for i := range invoice.InvoiceLines {
+		line := &invoice.InvoiceLines[i]
+		if kept, ok := existingLines[grpcLineKey(line)]; ok {
+			line.Type, line.Discount, line.DiscountType = kept.Type, kept.Discount, kept.DiscountType
+			if line.Unit == "" {
+				line.Unit = kept.Unit
+			}
+			if line.ProductID == nil {
+				line.UnitPrice = kept.UnitPrice
+			}
+		}
+	}
+	if err := s.store.UpdateInvoice(invoice); err != nil {
+		return nil, grpcError(err)
+	}
+	return s.GetInvoice(ctx, &tinycrmpb.GetInvoiceRequest{Id: uint32(invoice.ID)})
+}
+
+func (s *invoiceService) DeleteInvoice(ctx context.Context, req *tinycrmpb.DeleteInvoiceRequest) (*emptypb.Empty, error) {
+	if err := checkInvoiceLock(s.store, uint(req.GetId()), lockHolder{}, time.Now()); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := s.store.DeleteInvoice(uint(req.GetId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+type paymentService struct {
+	tinycrmpb.UnimplementedPaymentServiceServer
+	store Store
+}
+
+func (s *paymentService) ListPayments(ctx context.Context, req *tinycrmpb.ListPaymentsRequest) (*tinycrmpb.ListPaymentsResponse, error) {
+	payments, err := s.store.GetPayments(uint(req.GetInvoiceId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &tinycrmpb.ListPaymentsResponse{}
+	for i := range payments {
+		response.Payments = append(response.Payments, paymentToProto(&payments[i]))
+	}
+	return response, nil
+}
+
+func (s *paymentService) CreatePayment(ctx context.Context, req *tinycrmpb.CreatePaymentRequest) (*tinycrmpb.Payment, error) {
+	payment := &Payment{
+		InvoiceID: uint(req.GetPayment().GetInvoiceId()),
+		Amount:    moneyFromFloat(req.GetPayment().GetAmount()),
+		Date:      timeFromProto(req.GetPayment().GetDate()),
+		Reference: req.GetPayment().Reference,
+	}
+	if payment.Amount <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Payment amount must be positive")
+	}
+	if err := recordPayment(s.store, payment); err != nil {
+		return nil, grpcError(err)
+	}
+	return paymentToProto(payment), nil
+}
+
+func (s *paymentService) DeletePayment(ctx context.Context, req *tinycrmpb.DeletePaymentRequest) (*emptypb.Empty, error) {
+	if err := s.store.DeletePayment(uint(req.GetId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
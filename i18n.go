@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Locale selects the language and number formatting used to render documents
+type Locale string
+
+const (
+	LocalePtBR Locale = "pt-BR"
+	LocaleEn   Locale = "en"
+	LocaleEs   Locale = "es"
+
+	defaultLocale = LocalePtBR
+)
+
+type localeFormat struct {
+	months            [12]string
+	dateLayout        string
+	currencySymbol    string
+	currencyCode      string
+	thousandSeparator string
+	decimalSeparator  string
+	labels            map[string]string
+}
+
+var localeFormats = map[Locale]localeFormat{
+	LocalePtBR: {
+		months:            [12]string{"Janeiro", "Fevereiro", "Março", "Abril", "Maio", "Junho", "Julho", "Agosto", "Setembro", "Outubro", "Novembro", "Dezembro"},
+		dateLayout:        "02/01/2006",
+		currencySymbol:    "R$",
+		currencyCode:      "BRL",
+		thousandSeparator: ".",
+		decimalSeparator:  ",",
+		labels: map[string]string{
+			"invoice":         "Fatura",
+			"quote":           "Orçamento",
+			"credit_note":     "Nota de Crédito",
+			"receipt":         "Recibo",
+			"proforma":        "Fatura Proforma",
+			"number":          "Número",
+			"issue_date":      "Data de Emissão",
+			"due_date":        "Vencimento",
+			"from":            "Cedente",
+			"to":              "Cliente",
+			"document":        "CPF/CNPJ",
+			"address":         "Endereço",
+			"product":         "Produto",
+			"quantity":        "Quantidade",
+			"price":           "Valor",
+			"total":           "Total",
+			"subtotal":        "Subtotal",
+			"discount":        "Desconto",
+			"penalty":         "Multa/Juros",
+			"remit_to":        "Dados para depósito bancário",
+			"reference":       "Referente",
+			"invoice_total":   "Total da Fatura",
+			"additional_info": "Informações Adicionais",
+			"dispute":         "Contestar esta fatura",
+		},
+	},
+	LocaleEn: {
+		months:            [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		dateLayout:        "2006/01/02",
+		currencySymbol:    "$",
+		currencyCode:      "USD",
+		thousandSeparator: ",",
+		decimalSeparator:  ".",
+		labels: map[string]string{
+			"invoice":         "Invoice",
+			"quote":           "Quote",
+			"credit_note":     "Credit Note",
+			"receipt":         "Receipt",
+			"proforma":        "Proforma Invoice",
+			"number":          "Number",
+			"issue_date":      "Issue Date",
+			"due_date":        "Due Date",
+			"from":            "From",
+			"to":              "To",
+			"document":        "Document",
+			"address":         "Address",
+			"product":         "Product",
+			"quantity":        "Quantity",
+			"price":           "Price",
+			"total":           "Total",
+			"subtotal":        "Subtotal",
+			"discount":        "Discount",
+			"penalty":         "Penalty",
+			"remit_to":        "Remit To",
+			"reference":       "Reference",
+			"invoice_total":   "Invoice Total",
+			"additional_info": "Additional Information",
+			"dispute":         "Dispute this invoice",
+		},
+	},
+	LocaleEs: {
+		months:            [12]string{"Enero", "Febrero", "Marzo", "Abril", "Mayo", "Junio", "Julio", "Agosto", "Septiembre", "Octubre", "Noviembre", "Diciembre"},
+		dateLayout:        "02/01/2006",
+		currencySymbol:    "€",
+		currencyCode:      "EUR",
+		thousandSeparator: ".",
+		decimalSeparator:  ",",
+		labels: map[string]string{
+			"invoice":         "Factura",
+			"quote":           "Presupuesto",
+			"credit_note":     "Nota de Crédito",
+			"receipt":         "Recibo",
+			"proforma":        "Factura Proforma",
+			"number":          "Número",
+			"issue_date":      "Fecha de Emisión",
+			"due_date":        "Vencimiento",
+			"from":            "Emisor",
+			"to":              "Cliente",
+			"document":        "NIF",
+			"address":         "Dirección",
+			"product":         "Producto",
+			"quantity":        "Cantidad",
+			"price":           "Precio",
+			"total":           "Total",
+			"subtotal":        "Subtotal",
+			"discount":        "Descuento",
+			"penalty":         "Recargo",
+			"remit_to":        "Datos bancarios",
+			"reference":       "Referencia",
+			"invoice_total":   "Total de la Factura",
+			"additional_info": "Información Adicional",
+			"dispute":         "Disputar esta factura",
+		},
+	},
+}
+
+// Valid reports whether the locale is supported, empty means "inherit"
+func (l Locale) Valid() bool {
+	if l == "" {
+		return true
+	}
+	_, ok := localeFormats[l]
+	return ok
+}
+
+func (l Locale) format() localeFormat {
+	if format, ok := localeFormats[l]; ok {
+		return format
+	}
+	return localeFormats[defaultLocale]
+}
+
+// T translates a template label, unknown labels are returned unchanged
+func (l Locale) T(key string) string {
+	if label, ok := l.format().labels[key]; ok {
+		return label
+	}
+	return key
+}
+
+func (l Locale) MonthName(month time.Month) string {
+	return l.format().months[month-1]
+}
+
+func (l Locale) FormatDate(date time.Time) string {
+	return date.In(config.Location()).Format(l.format().dateLayout)
+}
+
+// FormatNumber renders an amount with its two decimals and the locale
+// separators
+func (l Locale) FormatNumber(amount Money) string {
+	format := l.format()
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	cents := int64(amount)
+	integer := fmt.Sprintf("%d", cents/100)
+
+	var grouped strings.Builder
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			grouped.WriteString(format.thousandSeparator)
+		}
+		grouped.WriteRune(digit)
+	}
+
+	return fmt.Sprintf("%s%s%s%02d", sign, grouped.String(), format.decimalSeparator, cents%100)
+}
+
+// FormatMoney renders an amount with the locale currency symbol, or the
+// code of another currency set in the settings
+func (l Locale) FormatMoney(amount Money) string {
+	symbol := l.format().currencySymbol
+	if code := l.CurrencyCode(); code != l.format().currencyCode {
+		symbol = code
+	}
+	return symbol + " " + l.FormatNumber(amount)
+}
+
+// CurrencyCode is the ISO 4217 code of the locale's currency, or of the
+// currency of the settings
+func (l Locale) CurrencyCode() string {
+	if currency := currentSettings().Currency; currency != "" {
+		return currency
+	}
+	return l.format().currencyCode
+}
+
+// EffectiveLocale is the invoice locale, falling back to the client's, to
+// the one of the settings and then to the default one
+func (i *Invoice) EffectiveLocale() Locale {
+	if i.Locale != "" {
+		return i.Locale
+	}
+	if i.Client.Locale != "" {
+		return i.Client.Locale
+	}
+	if locale := currentSettings().Locale; locale != "" {
+		return locale
+	}
+	return defaultLocale
+}
+
+// T translates a label in the invoice locale, for use in templates
+func (i *Invoice) T(key string) string {
+	return i.EffectiveLocale().T(key)
+}
+
+func (i *Invoice) FormatMoney(amount Money) string {
+	return i.EffectiveLocale().FormatMoney(amount)
+}
+
+func (i *Invoice) FormatDate(date time.Time) string {
+	return i.EffectiveLocale().FormatDate(date)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidEmail is returned for messages that can't be read as an email
+var ErrInvalidEmail = errors.New("invalid email")
+
+// EventEmailReceived carries the *InboundEmail received
+const EventEmailReceived = "email.received"
+
+// maxInboundEmailSize caps the raw messages accepted, attachments included
+const maxInboundEmailSize = 25 << 20
+
+// InboundEmail is an email received, kept as a note of the company it came
+// from. Emails no company matched wait in the inbox as leads until they are
+// assigned one.
+type InboundEmail struct {
+	ID uint `gorm:"primaryKey" json:"id"`
+	// MessageID keeps an email delivered twice from being recorded twice
+	MessageID  string    `gorm:"size:255;index" json:"message_id"`
+	CompanyID  *uint     `gorm:"index" json:"company_id"`
+	Company    *Company  `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	From       string    `gorm:"size:255;not null" json:"from"`
+	FromName   string    `gorm:"size:255" json:"from_name"`
+	Subject    string    `gorm:"size:255" json:"subject"`
+	Body       string    `gorm:"type:text" json:"body"`
+	ReceivedAt time.Time `gorm:"not null;index" json:"received_at"`
+	// The constraint is the one of Attachment.InboundEmail
+	Attachments []Attachment `gorm:"foreignKey:InboundEmailID;-:migration" json:"attachments"`
+}
+
+type InboundEmailFilter struct {
+	CompanyID *uint
+	// Unmatched lists only the emails no company was found for
+	Unmatched bool
+}
+
+// freeMailDomains are shared by unrelated senders, so they only match a
+// company by the full address
+var freeMailDomains = map[string]bool{
+	"gmail.com": true, "googlemail.com": true, "outlook.com": true, "hotmail.com": true, "live.com": true,
+	"yahoo.com": true, "yahoo.com.br": true, "icloud.com": true, "me.com": true, "aol.com": true,
+	"proton.me": true, "protonmail.com": true, "gmx.com": true, "uol.com.br": true, "bol.com.br": true,
+}
+
+// MatchSenderCompany finds the company an email comes from: the one with
+// the sender's address, else the only one whose email shares its domain.
+// It returns nil when there is none or the domain is ambiguous.
+func (r *Repository) MatchSenderCompany(address string) (*Company, error) {
+	address = strings.ToLower(address)
+	var companies []Company
+	if err := r.db.Where("LOWER(email) = ?", address).Order("id").Limit(1).Find(&companies).Error; err != nil {
+		return nil, err
+	}
+	if len(companies) == 1 {
+		return &companies[0], nil
+	}
+
+	_, domain, ok := strings.Cut(address, "@")
+	if !ok || freeMailDomains[domain] {
+		return nil, nil
+	}
+	// The pattern of likeContains, anchored at the end of the address
+	pattern := "%@" + strings.Trim(likeContains(domain), "%")
+	if err := r.db.Where(`LOWER(email) LIKE ? ESCAPE '\'`, pattern).Order("id").Limit(2).Find(&companies).Error; err != nil {
+		return nil, err
+	}
+	if len(companies) != 1 {
+		return nil, nil
+	}
+	return &companies[0], nil
+}
+
+func (r *Repository) GetInboundEmailByMessageID(messageID string) (*InboundEmail, error) {
+	var emails []InboundEmail
+	if err := r.db.Preload("Attachments").Where("message_id = ?", messageID).Limit(1).Find(&emails).Error; err != nil {
+		return nil, err
+	}
+	if messageID == "" || len(emails) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &emails[0], nil
+}
+
+// CreateInboundEmail records the email with its files, stored as
+// attachments of its company. Files over the company's storage quota are
+// left out.
+func (r *Repository) CreateInboundEmail(email *InboundEmail, files []EmailAttachment) error {
+	err := retryOnBusy(func() error {
+		return r.db.Omit("Attachments").Create(email).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		attachment, err := r.CreateAttachment(email.CompanyID, file.Filename, file.ContentType, file.Data)
+		if errors.Is(err, ErrStorageQuotaExceeded) {
+			log.Printf("Left %s of email %d out: %v", file.Filename, email.ID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = retryOnBusy(func() error {
+			return r.db.Model(attachment).Update("inbound_email_id", email.ID).Error
+		})
+		if err != nil {
+			return err
+		}
+		attachment.InboundEmailID = &email.ID
+		email.Attachments = append(email.Attachments, *attachment)
+	}
+	return nil
+}
+
+// GetInboundEmails lists the emails received, newest first
+func (r *Repository) GetInboundEmails(filter InboundEmailFilter) ([]InboundEmail, error) {
+	query := r.db.Preload("Attachments").Order("received_at DESC, id DESC")
+	if filter.CompanyID != nil {
+		query = query.Where("company_id = ?", *filter.CompanyID)
+	}
+	if filter.Unmatched {
+		query = query.Where("company_id IS NULL")
+	}
+	var emails []InboundEmail
+	err := query.Find(&emails).Error
+	return emails, err
+}
+
+func (r *Repository) GetInboundEmail(id uint) (*InboundEmail, error) {
+	var email InboundEmail
+	if err := r.db.Preload("Attachments").First(&email, id).Error; err != nil {
+		return nil, err
+	}
+	return &email, nil
+}
+
+// AssignInboundEmail attaches the email and its files to the company
+func (r *Repository) AssignInboundEmail(id, companyID uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&InboundEmail{}).Where("id = ?", id).Update("company_id", companyID)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			return tx.Model(&Attachment{}).Where("inbound_email_id = ?", id).Update("company_id", companyID).Error
+		})
+	})
+}
+
+// parseInboundEmail reads a raw RFC 5322 message: its sender, subject, the
+// plain text body, or the HTML one when there is none, and the files
+func parseInboundEmail(raw io.Reader) (*InboundEmail, []EmailAttachment, error) {
+	message, err := mail.ReadMessage(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidEmail, err)
+	}
+	from, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w, no sender: %v", ErrInvalidEmail, err)
+	}
+
+	email := &InboundEmail{
+		MessageID:  strings.Trim(message.Header.Get("Message-Id"), "<> "),
+		From:       strings.ToLower(from.Address),
+		FromName:   from.Name,
+		ReceivedAt: clock.Now(),
+	}
+	decoder := mime.WordDecoder{}
+	if subject, err := decoder.DecodeHeader(message.Header.Get("Subject")); err == nil {
+		email.Subject = subject
+	}
+	if date, err := message.Header.Date(); err == nil {
+		email.ReceivedAt = date
+	}
+
+	parts := &inboundParts{}
+	if err := parts.read(message.Header, message.Body); err != nil {
+		return nil, nil, err
+	}
+	email.Body = parts.text
+	if email.Body == "" {
+		email.Body = parts.html
+	}
+	return email, parts.files, nil
+}
+
+// mimeHeader is the header of the message or of one of its parts
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// inboundParts collects the parts of a MIME message
+type inboundParts struct {
+	text, html string
+	files      []EmailAttachment
+}
+
+func (p *inboundParts) read(header mimeHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	content := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(content, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w part: %v", ErrInvalidEmail, err)
+			}
+			if err := p.read(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("%w part: %v", ErrInvalidEmail, err)
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case disposition == "attachment" || filename != "":
+		if filename == "" {
+			filename = "attachment"
+		}
+		p.files = append(p.files, EmailAttachment{Filename: filename, ContentType: mediaType, Data: data})
+	case mediaType == "text/plain" && p.text == "":
+		p.text = strings.TrimSpace(string(data))
+	case mediaType == "text/html" && p.html == "":
+		p.html = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// newlineStripper drops the line breaks of base64 content
+type newlineStripper struct {
+	reader io.Reader
+}
+
+func (s newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	kept := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[kept] = b
+			kept++
+		}
+	}
+	return kept, err
+}
+
+// receiveEmail records a raw email under the company of its sender. An
+// email received again is answered as already recorded.
+func receiveEmail(store Store, raw io.Reader) (*InboundEmail, bool, error) {
+	email, files, err := parseInboundEmail(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	if email.MessageID != "" {
+		if existing, err := store.GetInboundEmailByMessageID(email.MessageID); err == nil {
+			return existing, false, nil
+		}
+	}
+
+	company, err := store.MatchSenderCompany(email.From)
+	if err != nil {
+		return nil, false, err
+	}
+	if company != nil {
+		email.CompanyID = &company.ID
+	}
+	if err := store.CreateInboundEmail(email, files); err != nil {
+		return nil, false, err
+	}
+	publishEvent(store, EventEmailReceived, email)
+	return email, true, nil
+}
+
+// receiveInboundEmail takes the raw message posted by the mail server or
+// provider, as message/rfc822
+func (h *Handler) receiveInboundEmail(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInboundEmailSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	email, created, err := receiveEmail(h.storeFor(r), bytes.NewReader(raw))
+	if err != nil {
+		if errors.Is(err, ErrInvalidEmail) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(email)
+}
+
+// getInboundEmails lists the emails received, ?company_id= those of a
+// company and ?unmatched=true the leads no company was found for
+func (h *Handler) getInboundEmails(w http.ResponseWriter, r *http.Request) {
+	companyID, err := parseOptionalUint(r, "company_id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unmatched, err := parseOptionalBool(r, "unmatched")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := InboundEmailFilter{CompanyID: companyID, Unmatched: unmatched != nil && *unmatched}
+
+	emails, err := h.storeFor(r).GetInboundEmails(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(emails)
+}
+
+func (h *Handler) getInboundEmail(w http.ResponseWriter, r *http.Request) {
+	emailId, err := strconv.ParseUint(r.PathValue("emailId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusBadRequest)
+		return
+	}
+
+	email, err := h.storeFor(r).GetInboundEmail(uint(emailId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(email)
+}
+
+// assignInboundEmail files an email under the company given, typically a
+// lead once its company is created
+func (h *Handler) assignInboundEmail(w http.ResponseWriter, r *http.Request) {
+	emailId, err := strconv.ParseUint(r.PathValue("emailId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid email ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		CompanyID uint `json:"company_id"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if _, err := store.GetCompany(request.CompanyID); err != nil {
+		http.Error(w, fmt.Sprintf("Company %d not found", request.CompanyID), http.StatusBadRequest)
+		return
+	}
+	if err := store.AssignInboundEmail(uint(emailId), request.CompanyID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	email, err := store.GetInboundEmail(uint(emailId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(email)
+}
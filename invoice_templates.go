@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// InvoiceTemplate customizes how an issuer's invoices are rendered on top
+// of one of the HTML files in templates/invoices
+type InvoiceTemplate struct {
+	ID                  uint    `gorm:"primaryKey" json:"id"`
+	CompanyID           uint    `gorm:"not null;index" json:"company_id"`
+	Company             Company `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name                string  `gorm:"size:255;not null" json:"name"`
+	BaseTemplate        string  `gorm:"size:255;not null" json:"base_template"`
+	LogoURL             string  `gorm:"size:1024" json:"logo_url"`
+	Color               string  `gorm:"size:7" json:"color"`
+	FooterText          string  `gorm:"type:text" json:"footer_text"`
+	PaymentInstructions string  `gorm:"type:text" json:"payment_instructions"`
+	IsDefault           bool    `gorm:"default:false" json:"is_default"`
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func (t *InvoiceTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.BaseTemplate == "" {
+		t.BaseTemplate = "localized_invoice.html"
+	}
+	t.BaseTemplate = filepath.Base(t.BaseTemplate)
+	if _, err := os.Stat(filepath.Join("templates", "invoices", t.BaseTemplate)); err != nil {
+		return fmt.Errorf("unknown base template %s", t.BaseTemplate)
+	}
+	if t.Color != "" && !colorPattern.MatchString(t.Color) {
+		return fmt.Errorf("color must be a hex value like #1a2b3c")
+	}
+	return nil
+}
+
+// InvoiceTemplate CRUD
+func (r *Repository) GetInvoiceTemplate(id uint) (*InvoiceTemplate, error) {
+	var invoiceTemplate InvoiceTemplate
+	err := r.db.First(&invoiceTemplate, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &invoiceTemplate, nil
+}
+
+func (r *Repository) GetInvoiceTemplates(companyID uint) ([]InvoiceTemplate, error) {
+	var invoiceTemplates []InvoiceTemplate
+	err := r.db.Where("company_id = ?", companyID).Find(&invoiceTemplates).Error
+	return invoiceTemplates, err
+}
+
+// GetDefaultInvoiceTemplate returns the company's default template, or nil when it has none
+func (r *Repository) GetDefaultInvoiceTemplate(companyID uint) (*InvoiceTemplate, error) {
+	var invoiceTemplate InvoiceTemplate
+	err := r.db.Where("company_id = ? AND is_default = ?", companyID, true).First(&invoiceTemplate).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invoiceTemplate, nil
+}
+
+// SaveInvoiceTemplate creates or updates a template, keeping a single default
+// per company and recording the saved settings as a new version
+func (r *Repository) SaveInvoiceTemplate(invoiceTemplate *InvoiceTemplate) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if invoiceTemplate.IsDefault {
+				if err := tx.Model(&InvoiceTemplate{}).
+					Where("company_id = ? AND id <> ?", invoiceTemplate.CompanyID, invoiceTemplate.ID).
+					Update("is_default", false).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Save(invoiceTemplate).Error; err != nil {
+				return err
+			}
+			return recordInvoiceTemplateVersion(tx, invoiceTemplate)
+		})
+	})
+}
+
+func (r *Repository) DeleteInvoiceTemplate(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Invoice{}).Where("invoice_template_id = ?", id).Update("invoice_template_id", nil).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_template_id = ?", id).Delete(&InvoiceTemplateVersion{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&InvoiceTemplate{}, id).Error
+		})
+	})
+}
+
+// ErrTemplateCompany is returned for a template of another issuer than the
+// invoice's
+var ErrTemplateCompany = errors.New("the template belongs to another company than the invoice issuer")
+
+// resolveInvoiceTemplate picks the template used to render an invoice: the
+// requested one, then the one chosen on the invoice, then the issuer default.
+// It returns nil when none applies.
+func resolveInvoiceTemplate(store InvoiceTemplateStore, invoice *Invoice, requestedID *uint) (*InvoiceTemplate, error) {
+	if requestedID == nil {
+		requestedID = invoice.InvoiceTemplateID
+	}
+	if requestedID == nil {
+		return store.GetDefaultInvoiceTemplate(invoice.CompanyID)
+	}
+	invoiceTemplate, err := store.GetInvoiceTemplate(*requestedID)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceTemplate.CompanyID != invoice.CompanyID {
+		return nil, ErrTemplateCompany
+	}
+	return invoiceTemplate, nil
+}
+
+// InvoiceTemplate handlers
+func (h *Handler) getInvoiceTemplates(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	invoiceTemplates, err := h.storeFor(r).GetInvoiceTemplates(uint(companyId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceTemplates)
+}
+
+func (h *Handler) createInvoiceTemplate(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	var invoiceTemplate InvoiceTemplate
+	if err := decodeRequest(r, &invoiceTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invoiceTemplate.ID = 0
+	invoiceTemplate.CompanyID = uint(companyId)
+	if err := invoiceTemplate.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SaveInvoiceTemplate(&invoiceTemplate); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invoiceTemplate)
+}
+
+func (h *Handler) getInvoiceTemplate(w http.ResponseWriter, r *http.Request) {
+	templateIdStr := r.PathValue("templateId")
+	templateId, err := strconv.ParseUint(templateIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	invoiceTemplate, err := h.storeFor(r).GetInvoiceTemplate(uint(templateId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceTemplate)
+}
+
+func (h *Handler) updateInvoiceTemplate(w http.ResponseWriter, r *http.Request) {
+	templateIdStr := r.PathValue("templateId")
+	templateId, err := strconv.ParseUint(templateIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.storeFor(r).GetInvoiceTemplate(uint(templateId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var invoiceTemplate InvoiceTemplate
+	if err := decodeRequest(r, &invoiceTemplate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invoiceTemplate.ID = existing.ID
+	invoiceTemplate.CompanyID = existing.CompanyID
+	if err := invoiceTemplate.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SaveInvoiceTemplate(&invoiceTemplate); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoiceTemplate)
+}
+
+func (h *Handler) deleteInvoiceTemplate(w http.ResponseWriter, r *http.Request) {
+	templateIdStr := r.PathValue("templateId")
+	templateId, err := strconv.ParseUint(templateIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteInvoiceTemplate(uint(templateId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// previewInvoice renders an invoice with a stored template, defaulting to
+// the one picked on the invoice or the issuer's default template
+func (h *Handler) previewInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestedID *uint
+	if templateIdStr := r.URL.Query().Get("template"); templateIdStr != "" {
+		templateId, err := strconv.ParseUint(templateIdStr, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid template ID", http.StatusBadRequest)
+			return
+		}
+		id := uint(templateId)
+		requestedID = &id
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	invoiceTemplate, err := resolveInvoiceTemplate(h.storeFor(r), invoice, requestedID)
+	if errors.Is(err, ErrTemplateCompany) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if invoiceTemplate == nil {
+		renderInvoice(w, h.storeFor(r), invoice, defaultInvoiceTemplate, nil, "", false)
+		return
+	}
+	renderInvoice(w, h.storeFor(r), invoice, invoiceTemplate.BaseTemplate, invoiceTemplate, "", false)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvoiceIssued = errors.New("sent and paid invoices can't be changed, issue a credit note instead")
+
+// issuedOverrideContextKey marks the requests of administrators allowed to
+// change sent and paid invoices
+type issuedOverrideContextKey struct{}
+
+// issuedOverrideRequested reports whether the request asks to change sent
+// and paid invoices anyway
+func issuedOverrideRequested(r *http.Request) bool {
+	value := r.URL.Query().Get("override")
+	return value == "1" || value == "true"
+}
+
+// issuedOverrideMiddleware lets the requests asking for it change sent and
+// paid invoices, when they come from an administrator
+func issuedOverrideMiddleware(next http.HandlerFunc, testing bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userContextKey{}).(*User)
+		if issuedOverrideRequested(r) && (testing || ok && user.IsAdmin) {
+			r = r.WithContext(context.WithValue(r.Context(), issuedOverrideContextKey{}, true))
+		}
+		next(w, r)
+	}
+}
+
+// checkInvoiceIssued fails with ErrInvoiceIssued when the invoice was sent,
+// paid or cancelled, unless the repository was given the override
+func (r *Repository) checkInvoiceIssued(tx *gorm.DB, invoiceID uint) error {
+	if r.overrideIssued {
+		return nil
+	}
+	var invoice Invoice
+	if err := tx.Select("id", "sent_at", "paid", "cancelled_at").First(&invoice, invoiceID).Error; err != nil {
+		return err
+	}
+	switch {
+	case invoice.Paid:
+		return fmt.Errorf("invoice %d is paid: %w", invoiceID, ErrInvoiceIssued)
+	case invoice.CancelledAt != nil:
+		return fmt.Errorf("invoice %d was cancelled: %w", invoiceID, ErrInvoiceIssued)
+	case invoice.SentAt != nil:
+		return fmt.Errorf("invoice %d was sent: %w", invoiceID, ErrInvoiceIssued)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	// JobDead jobs failed every attempt, they wait to be retried by hand
+	JobDead = "dead"
+)
+
+// Job is a unit of background work kept in the database, so it survives
+// restarts until it is done
+type Job struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Kind string `gorm:"size:100;not null;index" json:"kind"`
+	// Payload is the JSON handed to the handler of the kind
+	Payload     string `gorm:"type:text;not null" json:"payload"`
+	Status      string `gorm:"size:20;not null;default:pending;index" json:"status"`
+	Attempts    int    `gorm:"not null;default:0" json:"attempts"`
+	MaxAttempts int    `gorm:"not null" json:"max_attempts"`
+	// RunAt is when the job is due, pushed back after each failure
+	RunAt      time.Time  `gorm:"not null;index" json:"run_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	LastError  string     `gorm:"type:text" json:"last_error"`
+	// LeaseOwner is the worker running the job, which holds it until
+	// LeaseExpiresAt unless it renews the lease
+	LeaseOwner     string     `gorm:"size:100" json:"lease_owner,omitempty"`
+	LeaseExpiresAt *time.Time `gorm:"index" json:"lease_expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// ErrJobLeaseLost is returned for a job whose lease expired and went to
+// another worker
+var ErrJobLeaseLost = errors.New("the job's lease expired")
+
+type JobFilter struct {
+	Status string
+	Kind   string
+	Limit  int
+}
+
+// JobHandler runs a job of its kind, an error schedules another attempt
+type JobHandler func(store Store, payload json.RawMessage) error
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = map[string]JobHandler{}
+)
+
+// registerJobHandler makes the workers run the jobs of kind with handler
+func registerJobHandler(kind string, handler JobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[kind] = handler
+}
+
+func jobHandler(kind string) (JobHandler, bool) {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	handler, ok := jobHandlers[kind]
+	return handler, ok
+}
+
+func init() {
+	// Emails queued to be sent in the background
+	registerJobHandler("email", func(store Store, payload json.RawMessage) error {
+		var email Email
+		if err := json.Unmarshal(payload, &email); err != nil {
+			return err
+		}
+		return sendEmail(store, &email)
+	})
+}
+
+// enqueueJob queues a job of kind, due now, payload being JSON encoded
+func enqueueJob(store Store, kind string, payload interface{}) (*Job, error) {
+	if _, ok := jobHandler(kind); !ok {
+		return nil, fmt.Errorf("no handler for jobs of kind %q", kind)
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{Kind: kind, Payload: string(encoded), Status: JobPending, MaxAttempts: config.Jobs.MaxAttempts, RunAt: clock.Now()}
+	if err := store.CreateJob(job); err != nil {
+		return nil, err
+	}
+	wakeJobWorkers()
+	return job, nil
+}
+
+// jobBackoff is how long a job waits after its failed attempt: 30 seconds
+// doubling each time, up to an hour
+func jobBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	return min(backoff, time.Hour)
+}
+
+func (r *Repository) CreateJob(job *Job) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(job).Error
+	})
+}
+
+func (r *Repository) GetJob(id uint) (*Job, error) {
+	var job Job
+	if err := r.db.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJobs lists the jobs matched by filter, newest first
+func (r *Repository) GetJobs(filter JobFilter) ([]Job, error) {
+	query := r.db.Order("id DESC")
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Kind != "" {
+		query = query.Where("kind = ?", filter.Kind)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var jobs []Job
+	err := query.Find(&jobs).Error
+	return jobs, err
+}
+
+// ClaimJob marks the job due first as running, leased to owner, and
+// returns it, nil when no job is due. Workers racing for a job each get a
+// different one.
+func (r *Repository) ClaimJob(owner string, now time.Time) (*Job, error) {
+	for {
+		var jobs []Job
+		err := r.db.Where("status = ? AND run_at <= ?", JobPending, now).Order("run_at, id").Limit(1).Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return nil, err
+		}
+		job := jobs[0]
+
+		var claimed int64
+		expires := now.Add(jobLeaseTTL)
+		err = retryOnBusy(func() error {
+			result := r.db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, JobPending).
+				Updates(map[string]interface{}{"status": JobRunning, "attempts": gorm.Expr("attempts + 1"), "started_at": now,
+					"lease_owner": owner, "lease_expires_at": expires})
+			claimed = result.RowsAffected
+			return result.Error
+		})
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			job.Status, job.Attempts, job.StartedAt = JobRunning, job.Attempts+1, &now
+			job.LeaseOwner, job.LeaseExpiresAt = owner, &expires
+			return &job, nil
+		}
+	}
+}
+
+// RenewJobLease keeps the job leased to its owner until, ErrJobLeaseLost
+// once it went to another worker
+func (r *Repository) RenewJobLease(job *Job, until time.Time) error {
+	return retryOnBusy(func() error {
+		result := r.db.Model(&Job{}).Where("id = ? AND status = ? AND lease_owner = ?", job.ID, JobRunning, job.LeaseOwner).
+			Update("lease_expires_at", until)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrJobLeaseLost
+		}
+		job.LeaseExpiresAt = &until
+		return nil
+	})
+}
+
+// FinishJob records the outcome of the attempt at the job: done, due again
+// after the backoff, or dead once its attempts are used up. The lease is
+// given up, ErrJobLeaseLost when another worker took the job meanwhile.
+func (r *Repository) FinishJob(job *Job, runErr error, now time.Time) error {
+	updates := map[string]interface{}{"finished_at": now, "lease_owner": "", "lease_expires_at": nil}
+	switch {
+	case runErr == nil:
+		updates["status"], updates["last_error"] = JobDone, ""
+	case job.Attempts >= job.MaxAttempts:
+		updates["status"], updates["last_error"] = JobDead, runErr.Error()
+	default:
+		updates["status"], updates["last_error"] = JobPending, runErr.Error()
+		updates["run_at"] = now.Add(jobBackoff(job.Attempts))
+	}
+	return retryOnBusy(func() error {
+		result := r.db.Model(&Job{}).Where("id = ? AND status = ? AND lease_owner = ?", job.ID, JobRunning, job.LeaseOwner).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrJobLeaseLost
+		}
+		return nil
+	})
+}
+
+// RetryJob gives a dead job its attempts back, due now
+func (r *Repository) RetryJob(id uint, now time.Time) error {
+	return retryOnBusy(func() error {
+		result := r.db.Model(&Job{}).Where("id = ? AND status = ?", id, JobDead).
+			Updates(map[string]interface{}{"status": JobPending, "attempts": 0, "run_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// jobRequeued is the update putting a running job back in the queue, its
+// attempt not counted
+var jobRequeued = map[string]interface{}{"status": JobPending, "attempts": gorm.Expr("attempts - 1"), "lease_owner": "", "lease_expires_at": nil}
+
+// RequeueRunningJobs puts back the jobs left running when the server
+// stopped, their attempt not counted
+func (r *Repository) RequeueRunningJobs() (int64, error) {
+	var count int64
+	err := retryOnBusy(func() error {
+		result := r.db.Model(&Job{}).Where("status = ?", JobRunning).Updates(jobRequeued)
+		count = result.RowsAffected
+		return result.Error
+	})
+	return count, err
+}
+
+// RequeueExpiredJobs puts back the running jobs whose lease expired by
+// now, their worker stopped, their attempt not counted
+func (r *Repository) RequeueExpiredJobs(now time.Time) (int64, error) {
+	var count int64
+	err := retryOnBusy(func() error {
+		result := r.db.Model(&Job{}).Where("status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", JobRunning, now).
+			Updates(jobRequeued)
+		count = result.RowsAffected
+		return result.Error
+	})
+	return count, err
+}
+
+// jobLeaseTTL is how long a running job stays leased to its worker without
+// the lease being renewed, see holdJobLease
+const jobLeaseTTL = time.Minute
+
+// jobWorkerID names the workers of this process in the leases of the jobs
+// they run
+var jobWorkerID = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), randomToken()[:8])
+}()
+
+// holdJobLease renews the lease of the job claimed by this worker while
+// it runs, so other instances know it isn't abandoned, until the returned
+// func stops. FinishJob gives the lease up.
+func holdJobLease(store Store, job *Job) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.RenewJobLease(job, clock.Now().Add(jobLeaseTTL)); err != nil {
+					log.Printf("Error renewing the lease of job %d: %v", job.ID, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// requeueAbandonedJobs puts back the jobs left running by a stopped
+// worker. Alone, every running job was left by this instance's previous
+// run; with Redis, those whose lease expired were.
+func requeueAbandonedJobs(store Store, now time.Time) (int64, error) {
+	if redisClient == nil {
+		return store.RequeueRunningJobs()
+	}
+	return store.RequeueExpiredJobs(now)
+}
+
+// wakeJobWorkers tells the workers of every instance a job was queued,
+// when Redis shares the queue. Without it they find it within a second.
+func wakeJobWorkers() {
+	if redisClient == nil {
+		return
+	}
+	ctx := context.Background()
+	key := redisClient.key("jobs", "wake")
+	if err := redisClient.LPush(ctx, key, "1").Err(); err != nil {
+		log.Printf("Error waking the job workers: %v", err)
+		return
+	}
+	// Nobody may be listening, e.g. with JOBS_WORKERS=0
+	redisClient.LTrim(ctx, key, 0, 99)
+}
+
+// waitForJobs waits a second, or less when woken by wakeJobWorkers
+func waitForJobs() {
+	if redisClient == nil {
+		time.Sleep(time.Second)
+		return
+	}
+	// Nothing popped within the second is no error
+	err := redisClient.BLPop(context.Background(), time.Second, redisClient.key("jobs", "wake")).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("Error waiting for jobs: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// runJob runs a claimed job with the handler of its kind, recovering from
+// a panicking handler as from a failure
+func runJob(store Store, job *Job) (err error) {
+	handler, ok := jobHandler(job.Kind)
+	if !ok {
+		return fmt.Errorf("no handler for jobs of kind %q", job.Kind)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+	return handler(store, json.RawMessage(job.Payload))
+}
+
+// runDueJobs runs the jobs due by now one after the other and returns how
+// many ran
+func runDueJobs(store Store, now time.Time) (int, error) {
+	ran := 0
+	for {
+		job, err := store.ClaimJob(jobWorkerID, now)
+		if err != nil || job == nil {
+			return ran, err
+		}
+		stop := holdJobLease(store, job)
+		runErr := runJob(store, job)
+		if runErr != nil {
+			log.Printf("Job %d (%s) failed attempt %d of %d: %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, runErr)
+		}
+		stop()
+		// Another worker took the job over, its outcome is that worker's
+		if err := store.FinishJob(job, runErr, now); errors.Is(err, ErrJobLeaseLost) {
+			log.Printf("Job %d (%s) was taken over by another worker", job.ID, job.Kind)
+			continue
+		} else if err != nil {
+			return ran, err
+		}
+		ran++
+	}
+}
+
+// startJobWorkers runs the queued jobs in the background with workers
+// polling the queue every second. With Redis the jobs of a stopped
+// instance are requeued every minute, not only on start.
+func startJobWorkers(store Store, workers int) error {
+	count, err := requeueAbandonedJobs(store, clock.Now())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Printf("Requeued %d jobs left running", count)
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				waitForJobs()
+				if _, err := runDueJobs(store, clock.Now()); err != nil {
+					log.Printf("Error running jobs: %v", err)
+				}
+			}
+		}()
+	}
+	if redisClient != nil && workers > 0 {
+		go func() {
+			for range time.Tick(jobLeaseTTL) {
+				if count, err := requeueAbandonedJobs(store, clock.Now()); err != nil {
+					log.Printf("Error requeueing abandoned jobs: %v", err)
+				} else if count > 0 {
+					log.Printf("Requeued %d jobs abandoned by a stopped instance", count)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// getJobs lists the jobs, ?status=dead being the dead letters
+func (h *Handler) getJobs(w http.ResponseWriter, r *http.Request) {
+	filter := JobFilter{Status: r.URL.Query().Get("status"), Kind: r.URL.Query().Get("kind"), Limit: 100}
+	switch filter.Status {
+	case "", JobPending, JobRunning, JobDone, JobDead:
+	default:
+		http.Error(w, fmt.Sprintf("Invalid status %q, expected pending, running, done or dead", filter.Status), http.StatusBadRequest)
+		return
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	jobs, err := h.storeFor(r).GetJobs(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// retryJob puts a dead job back in the queue
+func (h *Handler) retryJob(w http.ResponseWriter, r *http.Request) {
+	jobId, err := strconv.ParseUint(r.PathValue("jobId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if err := store.RetryJob(uint(jobId), clock.Now()); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, fmt.Sprintf("No dead job %d", jobId), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+	wakeJobWorkers()
+
+	job, err := store.GetJob(uint(jobId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
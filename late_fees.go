@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LateCharges is what an overdue invoice costs on a date: the outstanding
+// amount plus the penalty and the interest of the late fees configuration
+type LateCharges struct {
+	AsOf        time.Time `json:"as_of"`
+	DaysOverdue int       `json:"days_overdue"`
+	Outstanding Money     `json:"outstanding"`
+	Penalty     Money     `json:"penalty"`
+	Interest    Money     `json:"interest"`
+	AmountDue   Money     `json:"amount_due"`
+}
+
+// Enabled reports whether overdue invoices are charged anything
+func (c LateFeesConfig) Enabled() bool {
+	return c.PenaltyPercent > 0 || c.MonthlyInterestPercent > 0
+}
+
+// daysBetween counts the calendar days from one date to the other in the
+// business time zone
+func daysBetween(from, to time.Time) int {
+	from, to = from.In(config.Location()), to.In(config.Location())
+	fromDate := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDate := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toDate.Sub(fromDate).Hours() / 24)
+}
+
+// charges computes the late charges of the invoice as of now given its total
+// and what was paid, nil when nothing is charged. The penalty applies once, the interest
+// is simple and pro rata per day, a month counting 30 days.
+func (c LateFeesConfig) charges(invoice *Invoice, total, paid Money, now time.Time) *LateCharges {
+	if !c.Enabled() || invoice.Paid || invoice.CancelledAt != nil || !invoice.Type.Behavior().Payable {
+		return nil
+	}
+	days := daysBetween(invoice.DueDate, now)
+	outstanding := total - paid
+	if days <= 0 || outstanding <= 0 {
+		return nil
+	}
+
+	charges := &LateCharges{
+		AsOf:        now,
+		DaysOverdue: days,
+		Outstanding: outstanding,
+		Penalty:     outstanding.Percent(c.PenaltyPercent),
+		Interest:    moneyFromFloat(outstanding.Float() * c.MonthlyInterestPercent / 100 * float64(days) / 30),
+	}
+	charges.AmountDue = charges.Outstanding + charges.Penalty + charges.Interest
+	return charges
+}
+
+// lateChargesOf computes the late charges of the invoice as of now with the
+// active configuration
+func lateChargesOf(r Store, invoice *Invoice, now time.Time) (*LateCharges, error) {
+	if !config.LateFees.Enabled() {
+		return nil, nil
+	}
+	paid, err := r.GetPaidAmount(invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	return config.LateFees.charges(invoice, invoice.Total(), paid, now), nil
+}
+
+// Describe explains the charges in a sentence, for emails
+func (c *LateCharges) Describe(invoice *Invoice) string {
+	return fmt.Sprintf("As of %s, %d days overdue, the amount due is %s: %s outstanding plus %s penalty and %s interest.",
+		invoice.FormatDate(c.AsOf), c.DaysOverdue, invoice.FormatMoney(c.AmountDue),
+		invoice.FormatMoney(c.Outstanding), invoice.FormatMoney(c.Penalty), invoice.FormatMoney(c.Interest))
+}
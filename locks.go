@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// editLockHeader carries the token of the lock the request edits under
+const editLockHeader = "X-Edit-Lock"
+
+var ErrInvoiceLocked = errors.New("invoice is being edited")
+
+// InvoiceLock checks an invoice out for editing so nobody else changes it
+// meanwhile. Locks are optional and expire on their own, editors refresh
+// theirs while the form stays open.
+type InvoiceLock struct {
+	InvoiceID uint      `gorm:"primaryKey;autoIncrement:false" json:"invoice_id"`
+	Invoice   Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	UserID    *uint     `gorm:"index" json:"user_id"`
+	User      *User     `gorm:"constraint:OnDelete:CASCADE" json:"user,omitempty"`
+	Token     string    `gorm:"size:64;not null" json:"token,omitempty"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// lockHolder is who asks for a lock: the signed in user, if any, or
+// whoever presents the token of the lock
+type lockHolder struct {
+	UserID *uint
+	Token  string
+}
+
+// editLockHolder returns the holder the request acts as
+func editLockHolder(r *http.Request) lockHolder {
+	return lockHolder{UserID: currentUserID(r.Context()), Token: r.Header.Get(editLockHeader)}
+}
+
+// Active reports whether the lock still holds at now
+func (l *InvoiceLock) Active(now time.Time) bool {
+	return now.Before(l.ExpiresAt)
+}
+
+// heldBy reports whether the holder owns the lock
+func (l *InvoiceLock) heldBy(holder lockHolder) bool {
+	if holder.Token != "" && subtle.ConstantTimeCompare([]byte(holder.Token), []byte(l.Token)) == 1 {
+		return true
+	}
+	return l.UserID != nil && holder.UserID != nil && *l.UserID == *holder.UserID
+}
+
+// lockedError describes who holds the lock and until when
+func (l *InvoiceLock) lockedError() error {
+	if l.User != nil {
+		return fmt.Errorf("%w by %s until %s", ErrInvoiceLocked, l.User.Username, l.ExpiresAt.Format(time.RFC3339))
+	}
+	return fmt.Errorf("%w until %s", ErrInvoiceLocked, l.ExpiresAt.Format(time.RFC3339))
+}
+
+func (r *Repository) GetInvoiceLock(invoiceID uint) (*InvoiceLock, error) {
+	var lock InvoiceLock
+	if err := r.db.Preload("User").First(&lock, "invoice_id = ?", invoiceID).Error; err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// LockInvoice checks the invoice out for the holder until now plus the
+// duration, or extends the lock the holder already has. When someone else
+// holds it, their lock is returned along with ErrInvoiceLocked.
+func (r *Repository) LockInvoice(invoiceID uint, holder lockHolder, now time.Time, duration time.Duration) (*InvoiceLock, error) {
+	var lock InvoiceLock
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Select("id").First(&Invoice{}, invoiceID).Error; err != nil {
+				return err
+			}
+
+			token := randomToken()
+			var current InvoiceLock
+			err := tx.Preload("User").First(&current, "invoice_id = ?", invoiceID).Error
+			switch {
+			case err == nil && current.Active(now) && !current.heldBy(holder):
+				lock = current
+				return current.lockedError()
+			case err == nil && current.Active(now):
+				token = current.Token
+			case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+				return err
+			}
+
+			if err := tx.Where("invoice_id = ?", invoiceID).Delete(&InvoiceLock{}).Error; err != nil {
+				return err
+			}
+			lock = InvoiceLock{InvoiceID: invoiceID, UserID: holder.UserID, Token: token, ExpiresAt: now.Add(duration)}
+			return tx.Create(&lock).Error
+		})
+	})
+	return &lock, err
+}
+
+// UnlockInvoice releases the lock of the holder, releasing an expired or
+// missing lock does nothing
+func (r *Repository) UnlockInvoice(invoiceID uint, holder lockHolder, now time.Time) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var lock InvoiceLock
+			err := tx.Preload("User").First(&lock, "invoice_id = ?", invoiceID).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if lock.Active(now) && !lock.heldBy(holder) {
+				return lock.lockedError()
+			}
+			return tx.Delete(&lock).Error
+		})
+	})
+}
+
+// checkInvoiceLock fails with ErrInvoiceLocked when someone other than the
+// holder has the invoice checked out
+func checkInvoiceLock(r Store, invoiceID uint, holder lockHolder, now time.Time) error {
+	lock, err := r.GetInvoiceLock(invoiceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lock.Active(now) && !lock.heldBy(holder) {
+		return lock.lockedError()
+	}
+	return nil
+}
+
+// Invoice lock handlers
+func (h *Handler) getInvoiceLock(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	lock, err := h.storeFor(r).GetInvoiceLock(uint(invoiceId))
+	if err != nil || !lock.Active(time.Now()) {
+		http.Error(w, "Invoice isn't locked", http.StatusNotFound)
+		return
+	}
+	if !lock.heldBy(editLockHolder(r)) {
+		lock.Token = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lock)
+}
+
+func (h *Handler) lockInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	duration := time.Duration(config.EditLockMinutes) * time.Minute
+	lock, err := h.storeFor(r).LockInvoice(uint(invoiceId), editLockHolder(r), time.Now(), duration)
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrInvoiceLocked):
+		// Tell who has it, without the token
+		lock.Token = ""
+		status = http.StatusConflict
+	case err != nil:
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(lock)
+}
+
+func (h *Handler) unlockInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UnlockInvoice(uint(invoiceId), editLockHolder(r), time.Now()); err != nil {
+		if errors.Is(err, ErrInvoiceLocked) {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LoginAttempt is a failed sign in, kept to spot brute forcing. Reason is
+// why it failed, e.g. ErrInvalidCredentials or ErrAccountLocked.
+type LoginAttempt struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	IP        string    `gorm:"size:45;not null;index" json:"ip"`
+	Username  string    `gorm:"size:255;not null;index" json:"username"`
+	Reason    string    `gorm:"size:100" json:"reason"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// LoginAttemptFilter narrows the attempts, zero values match everything
+type LoginAttemptFilter struct {
+	IP       string
+	Username string
+	Since    *time.Time
+}
+
+func (r *Repository) RecordLoginAttempt(attempt *LoginAttempt) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(attempt).Error
+	})
+}
+
+// GetLoginAttempts returns the latest attempts first
+func (r *Repository) GetLoginAttempts(filter LoginAttemptFilter) ([]LoginAttempt, error) {
+	query := r.db.Order("created_at DESC, id DESC").Limit(500)
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.Username != "" {
+		query = query.Where("username = ?", filter.Username)
+	}
+	if filter.Since != nil {
+		query = query.Where("created_at >= ?", *filter.Since)
+	}
+	var attempts []LoginAttempt
+	err := query.Find(&attempts).Error
+	return attempts, err
+}
+
+// CountLoginAttempts counts the failed attempts from the IP since then
+func (r *Repository) CountLoginAttempts(ip string, since time.Time) (int64, error) {
+	var count int64
+	err := r.db.Model(&LoginAttempt{}).Where("ip = ? AND created_at >= ?", ip, since).Count(&count).Error
+	return count, err
+}
+
+// ipBlocker counts the failed logins of each address and blocks those
+// failing too often
+type ipBlocker interface {
+	// countFailure counts the failed login from ip, just recorded, among
+	// those within window
+	countFailure(store Store, ip string, now time.Time, window time.Duration) (int64, error)
+	block(ip string, until time.Time)
+	// blockedUntil returns until when the IP is blocked
+	blockedUntil(ip string, now time.Time) (time.Time, bool)
+	// list returns the current blocks, ending soonest first
+	list(now time.Time) []BlockedIP
+}
+
+// newIPBlocker keeps the blocks in Redis when configured, for every
+// instance to turn the address away
+func newIPBlocker() ipBlocker {
+	if redisClient != nil {
+		return &redisIPBlocker{client: redisClient}
+	}
+	return newIPBlocklist()
+}
+
+// ipBlocklist holds the addresses blocked for failing to sign in too
+// often. It lives in memory, a restart lifts the blocks.
+type ipBlocklist struct {
+	mu      sync.Mutex
+	blocked map[string]time.Time
+}
+
+func newIPBlocklist() *ipBlocklist {
+	return &ipBlocklist{blocked: map[string]time.Time{}}
+}
+
+// countFailure counts the attempts recorded in the database
+func (b *ipBlocklist) countFailure(store Store, ip string, now time.Time, window time.Duration) (int64, error) {
+	return store.CountLoginAttempts(ip, now.Add(-window))
+}
+
+func (b *ipBlocklist) block(ip string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked[ip] = until
+}
+
+// blockedUntil returns until when the IP is blocked, forgetting expired blocks
+func (b *ipBlocklist) blockedUntil(ip string, now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.blocked[ip]
+	if ok && !now.Before(until) {
+		delete(b.blocked, ip)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// redisIPBlocker keeps the failed login counters and the blocks in Redis,
+// expiring with them
+type redisIPBlocker struct {
+	client *RedisClient
+}
+
+// countFailure counts the failures in a window starting with the first one
+func (b *redisIPBlocker) countFailure(store Store, ip string, now time.Time, window time.Duration) (int64, error) {
+	ctx := context.Background()
+	key := b.client.key("failed_logins", ip)
+	count, err := b.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		err = b.client.PExpire(ctx, key, window).Err()
+	}
+	return count, err
+}
+
+func (b *redisIPBlocker) block(ip string, until time.Time) {
+	err := b.client.Set(context.Background(), b.client.key("blocked_ip", ip), strconv.FormatInt(until.UnixMilli(), 10),
+		time.Until(until)+time.Millisecond).Err()
+	if err != nil {
+		log.Printf("Error blocking %s: %v", ip, err)
+	}
+}
+
+// blockedUntil lets the address through when Redis can't be reached
+func (b *redisIPBlocker) blockedUntil(ip string, now time.Time) (time.Time, bool) {
+	until, err := b.client.Get(context.Background(), b.client.key("blocked_ip", ip)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Error checking whether %s is blocked: %v", ip, err)
+		}
+		return time.Time{}, false
+	}
+	milliseconds, err := strconv.ParseInt(until, 10, 64)
+	if err != nil || !now.Before(time.UnixMilli(milliseconds)) {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(milliseconds), true
+}
+
+func (b *redisIPBlocker) list(now time.Time) []BlockedIP {
+	blocked := []BlockedIP{}
+	prefix := b.client.key("blocked_ip", "")
+	// SCAN doesn't block Redis on a large database
+	ctx := context.Background()
+	keys := b.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for keys.Next(ctx) {
+		ip := strings.TrimPrefix(keys.Val(), prefix)
+		if until, ok := b.blockedUntil(ip, now); ok {
+			blocked = append(blocked, BlockedIP{IP: ip, Until: until})
+		}
+	}
+	if err := keys.Err(); err != nil {
+		log.Printf("Error listing the blocked addresses: %v", err)
+	}
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].Until.Before(blocked[j].Until) })
+	return blocked
+}
+
+// BlockedIP is an address blocked until some time
+type BlockedIP struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// list returns the current blocks, ending soonest first
+func (b *ipBlocklist) list(now time.Time) []BlockedIP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blocked := []BlockedIP{}
+	for ip, until := range b.blocked {
+		if now.Before(until) {
+			blocked = append(blocked, BlockedIP{IP: ip, Until: until})
+		}
+	}
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].Until.Before(blocked[j].Until) })
+	return blocked
+}
+
+// clientIP is the address the request came from. Proxies in front of the
+// server aren't trusted, so X-Forwarded-For is ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordFailedLogin logs the attempt, blocking the IP for ip_block_minutes
+// once it failed ip_block_attempts times within that long. Both are kept
+// for after the unit of work, which the failed login rolls back.
+func (h *Handler) recordFailedLogin(r *http.Request, username string, reason error) {
+	ip, now := clientIP(r), time.Now()
+	h.storeFor(r).AfterUnitOfWork(func(store Store) {
+		if err := store.RecordLoginAttempt(&LoginAttempt{IP: ip, Username: username, Reason: reason.Error()}); err != nil {
+			log.Printf("Error recording login attempt: %v", err)
+			return
+		}
+		if config.IPBlockAttempts == 0 {
+			return
+		}
+
+		window := time.Duration(config.IPBlockMinutes) * time.Minute
+		count, err := h.blocked.countFailure(store, ip, now, window)
+		if err != nil {
+			log.Printf("Error counting login attempts: %v", err)
+			return
+		}
+		if count >= int64(config.IPBlockAttempts) {
+			log.Printf("Blocking %s for %s after %d failed logins", ip, window, count)
+			h.blocked.block(ip, now.Add(window))
+		}
+	})
+}
+
+// ipBlockMiddleware turns away every request of a blocked IP
+func (h *Handler) ipBlockMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if until, blocked := h.blocked.blockedUntil(clientIP(r), time.Now()); blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+			http.Error(w, "Too many failed logins from your address", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) getLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	filter := LoginAttemptFilter{
+		IP:       r.URL.Query().Get("ip"),
+		Username: r.URL.Query().Get("username"),
+	}
+	since, err := parseDateQuery(r, "since")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Since = since
+
+	attempts, err := h.storeFor(r).GetLoginAttempts(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"attempts":    attempts,
+		"blocked_ips": h.blocked.list(time.Now()),
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// EmailAttachment is a file sent along with an email
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Email is an outgoing message
+type Email struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+	// ReplyTo is where the answers go when it isn't the sender
+	ReplyTo     string
+	Subject     string
+	Body        string
+	Attachments []EmailAttachment
+	// MessageID is the Message-ID header, see sendEmail. Providers that
+	// don't take it replace it with their own id of the message.
+	MessageID string
+}
+
+// Mailer delivers outgoing emails. Emails are sent through sendEmail,
+// which logs them.
+type Mailer interface {
+	Send(email *Email) error
+}
+
+var mailer Mailer = newSMTPMailer(config.SMTP)
+
+// SMTPMailer sends emails through a plain SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func newSMTPMailer(c SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     c.Host,
+		Port:     c.Port,
+		Username: c.Username,
+		Password: c.Password,
+		From:     c.From,
+	}
+}
+
+func (m *SMTPMailer) Send(email *Email) error {
+	if m.Host == "" {
+		return fmt.Errorf("SMTP is not configured, set SMTP_HOST")
+	}
+
+	message, err := buildMIMEMessage(m.From, email)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, email.Recipients(), message)
+}
+
+// Recipients lists every address the email is delivered to, the blind
+// copies included
+func (e *Email) Recipients() []string {
+	recipients := append([]string{}, e.To...)
+	recipients = append(recipients, e.Cc...)
+	return append(recipients, e.Bcc...)
+}
+
+// buildMIMEMessage renders the email as a multipart MIME message
+func buildMIMEMessage(from string, email *Email) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(email.To, ", "))
+	if len(email.Cc) > 0 {
+		fmt.Fprintf(&buf, "Cc: %s\r\n", strings.Join(email.Cc, ", "))
+	}
+	if email.ReplyTo != "" {
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", email.ReplyTo)
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	if email.MessageID != "" {
+		fmt.Fprintf(&buf, "Message-ID: %s\r\n", email.MessageID)
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	body, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	body.Write([]byte(email.Body))
+
+	for _, attachment := range email.Attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", attachment.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
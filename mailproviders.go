@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mailProviders builds the Mailer of each MAIL_PROVIDER
+var mailProviders = map[string]func(c *Config) Mailer{
+	"smtp":     func(c *Config) Mailer { return newSMTPMailer(c.SMTP) },
+	"sendgrid": func(c *Config) Mailer { return newSendGridMailer(c.SMTP.From, c.Mail) },
+	"mailgun":  func(c *Config) Mailer { return newMailgunMailer(c.SMTP.From, c.Mail) },
+	"ses":      func(c *Config) Mailer { return newSESMailer(c.SMTP.From, c.Mail) },
+}
+
+// validate checks the settings the provider needs, from being the sender
+func (c MailConfig) validate(from string) error {
+	if _, ok := mailProviders[c.Provider]; !ok {
+		return fmt.Errorf("invalid mail provider %q, expected smtp, sendgrid, mailgun or ses", c.Provider)
+	}
+	if c.Provider == "smtp" {
+		return nil
+	}
+	if from == "" {
+		return fmt.Errorf("the %s mail provider needs SMTP_FROM, the address emails are sent from", c.Provider)
+	}
+	switch c.Provider {
+	case "sendgrid":
+		if c.APIKey == "" {
+			return errors.New("the sendgrid mail provider needs MAIL_API_KEY")
+		}
+	case "mailgun":
+		if c.APIKey == "" || c.MailgunDomain == "" {
+			return errors.New("the mailgun mail provider needs MAIL_API_KEY and MAILGUN_DOMAIN")
+		}
+		mailgunURL, err := url.Parse(c.MailgunURL)
+		if err != nil || mailgunURL.Scheme != "https" || mailgunURL.Host == "" {
+			return fmt.Errorf("invalid Mailgun URL %q, it must use https", c.MailgunURL)
+		}
+	case "ses":
+		if c.SESRegion == "" || c.SESAccessKeyID == "" || c.SESSecretAccessKey == "" {
+			return errors.New("the ses mail provider needs SES_REGION, SES_ACCESS_KEY_ID and SES_SECRET_ACCESS_KEY")
+		}
+	}
+	return nil
+}
+
+// providerError reads the error a mail provider answered
+func providerError(provider string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s answered %d: %s", provider, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// SendGridMailer sends emails through the SendGrid v3 mail API
+type SendGridMailer struct {
+	URL    string
+	APIKey string
+	From   string
+	Client *http.Client
+}
+
+func newSendGridMailer(from string, c MailConfig) *SendGridMailer {
+	return &SendGridMailer{
+		URL:    "https://api.sendgrid.com/v3/mail/send",
+		APIKey: c.APIKey,
+		From:   from,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+func sendGridAddresses(addresses []string) []sendGridAddress {
+	if len(addresses) == 0 {
+		return nil
+	}
+	list := make([]sendGridAddress, len(addresses))
+	for i, address := range addresses {
+		list[i] = sendGridAddress{Email: address}
+	}
+	return list
+}
+
+// Send posts the email to SendGrid, which doesn't take a Message-ID: the
+// email gets SendGrid's X-Message-Id instead, its bounce events refer to it
+func (m *SendGridMailer) Send(email *Email) error {
+	type attachment struct {
+		Content     string `json:"content"`
+		Filename    string `json:"filename"`
+		Type        string `json:"type"`
+		Disposition string `json:"disposition"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	message := struct {
+		Personalizations []map[string][]sendGridAddress `json:"personalizations"`
+		From             sendGridAddress                `json:"from"`
+		ReplyTo          *sendGridAddress               `json:"reply_to,omitempty"`
+		Subject          string                         `json:"subject"`
+		Content          []content                      `json:"content"`
+		Attachments      []attachment                   `json:"attachments,omitempty"`
+	}{
+		From:    sendGridAddress{Email: m.From},
+		Subject: email.Subject,
+		Content: []content{{Type: "text/plain", Value: email.Body}},
+	}
+	personalization := map[string][]sendGridAddress{"to": sendGridAddresses(email.To)}
+	if len(email.Cc) > 0 {
+		personalization["cc"] = sendGridAddresses(email.Cc)
+	}
+	if len(email.Bcc) > 0 {
+		personalization["bcc"] = sendGridAddresses(email.Bcc)
+	}
+	message.Personalizations = []map[string][]sendGridAddress{personalization}
+	if email.ReplyTo != "" {
+		message.ReplyTo = &sendGridAddress{Email: email.ReplyTo}
+	}
+	for _, file := range email.Attachments {
+		message.Attachments = append(message.Attachments, attachment{
+			Content:     base64.StdEncoding.EncodeToString(file.Data),
+			Filename:    file.Filename,
+			Type:        file.ContentType,
+			Disposition: "attachment",
+		})
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, m.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.APIKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return providerError("SendGrid", resp)
+	}
+	if id := resp.Header.Get("X-Message-Id"); id != "" {
+		email.MessageID = id
+	}
+	return nil
+}
+
+// MailgunMailer sends emails through the Mailgun API, posting the MIME
+// message as built for SMTP
+type MailgunMailer struct {
+	URL    string
+	APIKey string
+	From   string
+	Client *http.Client
+}
+
+func newMailgunMailer(from string, c MailConfig) *MailgunMailer {
+	return &MailgunMailer{
+		URL:    strings.TrimRight(c.MailgunURL, "/") + "/v3/" + url.PathEscape(c.MailgunDomain) + "/messages.mime",
+		APIKey: c.APIKey,
+		From:   from,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (m *MailgunMailer) Send(email *Email) error {
+	message, err := buildMIMEMessage(m.From, email)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	// The blind copies aren't in the message headers, Mailgun delivers to
+	// every address listed here
+	if err := form.WriteField("to", strings.Join(email.Recipients(), ",")); err != nil {
+		return err
+	}
+	part, err := form.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	part.Write(message)
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", m.APIKey)
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return providerError("Mailgun", resp)
+	}
+	var queued struct {
+		ID string `json:"id"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&queued) == nil && queued.ID != "" {
+		email.MessageID = queued.ID
+	}
+	return nil
+}
+
+// SESMailer sends emails through the Amazon SES v2 API, posting the MIME
+// message as built for SMTP, signed with AWS Signature Version 4
+type SESMailer struct {
+	URL             string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	From            string
+	Client          *http.Client
+}
+
+func newSESMailer(from string, c MailConfig) *SESMailer {
+	return &SESMailer{
+		URL:             "https://email." + c.SESRegion + ".amazonaws.com/v2/email/outbound-emails",
+		Region:          c.SESRegion,
+		AccessKeyID:     c.SESAccessKeyID,
+		SecretAccessKey: c.SESSecretAccessKey,
+		From:            from,
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send posts the email to SES, the email gets the SES message ID its
+// notifications refer to
+func (m *SESMailer) Send(email *Email) error {
+	message, err := buildMIMEMessage(m.From, email)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": m.From,
+		// The blind copies aren't in the message headers
+		"Destination": map[string][]string{"ToAddresses": email.Recipients()},
+		"Content":     map[string]interface{}{"Raw": map[string][]byte{"Data": message}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	m.sign(req, payload, time.Now().UTC())
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return providerError("SES", resp)
+	}
+	var sent struct {
+		MessageID string `json:"MessageId"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&sent) == nil && sent.MessageID != "" {
+		email.MessageID = sent.MessageID
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign sets the Authorization header of AWS Signature Version 4 on the
+// request, signing its content type, host and date
+func (m *SESMailer) sign(req *http.Request, payload []byte, now time.Time) {
+	signAWSRequest(req, payload, "ses", m.Region, m.AccessKeyID, m.SecretAccessKey, now)
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4 for the
+// service and region: its host, date, and content type and payload hash
+// when set
+func signAWSRequest(req *http.Request, payload []byte, service, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := []string{}
+	canonicalHeaders := ""
+	for _, name := range []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"} {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		if value == "" {
+			continue
+		}
+		headers = append(headers, name)
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
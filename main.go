@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
@@ -9,129 +11,230 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-)
+	"strings"
+	"time"
 
-var repo *Repository
-var PORT = "8080"
+	"gorm.io/gorm"
+)
 
-func setupRoutes(testing bool) *http.ServeMux {
+func setupRoutes(h *Handler, testing bool) http.Handler {
 	mux := http.NewServeMux()
-
-	// Serve index.html at root path
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" {
-			http.ServeFile(w, r, "templates/index.html")
+	for _, route := range routes(h, testing) {
+		switch route.Access {
+		case RouteUser:
+			mux.HandleFunc(route.Pattern, h.basicAuthMiddleware(route.Handler, testing))
+		case RouteAdmin:
+			mux.HandleFunc(route.Pattern, h.adminMiddleware(route.Handler, testing))
+		case RouteClient:
+			mux.HandleFunc(route.Pattern, h.portalMiddleware(route.Handler))
+		default:
+			mux.HandleFunc(route.Pattern, route.Handler)
 		}
-	})
-
-	// Protected API routes
-	mux.HandleFunc("GET /api/companies", basicAuthMiddleware(getCompanies, testing))
-	mux.HandleFunc("POST /api/companies", basicAuthMiddleware(createCompany, testing))
-	mux.HandleFunc("GET /api/companies/{companyId}", basicAuthMiddleware(getCompany, testing))
-	mux.HandleFunc("PUT /api/companies/{companyId}", basicAuthMiddleware(updateCompany, testing))
-	mux.HandleFunc("DELETE /api/companies/{companyId}", basicAuthMiddleware(deleteCompany, testing))
-
-	mux.HandleFunc("GET /api/remit", basicAuthMiddleware(getRemitInformations, testing))
-	mux.HandleFunc("POST /api/remit", basicAuthMiddleware(createRemitInformation, testing))
-	mux.HandleFunc("GET /api/remit/{remitId}", basicAuthMiddleware(getRemitInformation, testing))
-	mux.HandleFunc("PUT /api/remit/{remitId}", basicAuthMiddleware(updateRemitInformation, testing))
-	mux.HandleFunc("DELETE /api/remit/{remitId}", basicAuthMiddleware(deleteRemitInformation, testing))
-
-	mux.HandleFunc("GET /api/products", basicAuthMiddleware(getProducts, testing))
-	mux.HandleFunc("POST /api/products", basicAuthMiddleware(createProduct, testing))
-	mux.HandleFunc("GET /api/products/{productId}", basicAuthMiddleware(getProduct, testing))
-	mux.HandleFunc("PUT /api/products/{productId}", basicAuthMiddleware(updateProduct, testing))
-	mux.HandleFunc("DELETE /api/products/{productId}", basicAuthMiddleware(deleteProduct, testing))
-
-	mux.HandleFunc("GET /api/invoices", basicAuthMiddleware(getInvoices, testing))
-	mux.HandleFunc("POST /api/invoices", basicAuthMiddleware(createInvoice, testing))
-	mux.HandleFunc("GET /api/invoices/{invoiceId}", basicAuthMiddleware(getInvoice, testing))
-	mux.HandleFunc("PUT /api/invoices/{invoiceId}", basicAuthMiddleware(updateInvoice, testing))
-	mux.HandleFunc("DELETE /api/invoices/{invoiceId}", basicAuthMiddleware(deleteInvoice, testing))
-	mux.HandleFunc("GET /api/invoices/{invoiceId}/open", basicAuthMiddleware(openInvoice, testing))
-	mux.HandleFunc("GET /api/list_invoice_templates", basicAuthMiddleware(listTemplates, testing))
-	mux.HandleFunc("POST /api/logout", logout)
-
-	return mux
+	}
+
+	handler := conditionalRequests(mux)
+	if unitOfWork, ok := h.store.(UnitOfWork); ok {
+		handler = unitOfWork.UnitOfWork(handler)
+	}
+	return requestIDMiddleware(h.ipBlockMiddleware(handler))
 }
 
 func main() {
-	var err error
-	repo, err = NewRepository()
-	if err != nil {
-		panic(err)
+	configPath := flag.String("config", "", "path to a TOML config file")
+	port := flag.String("port", "", "port to listen on, overrides the config")
+	stateless := flag.Bool("stateless", false, "refuse the backends keeping state on this instance")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	// Without a command the server starts, as before commands existed
+	name, args := "serve", flag.Args()
+	if len(args) >= 1 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		if command, ok := findCommand(strings.Join(args, " ")); ok {
+			printCommandUsage(command)
+		} else {
+			printUsage()
+		}
+		return
 	}
-	repo.Migrate()
 
-	if len(os.Args) >= 2 && os.Args[1] == "--port" {
-		PORT = os.Args[2]
+	loadedConfig, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
 	}
-
-	// Handle CLI commands
-	if len(os.Args) >= 2 && os.Args[1] == "adduser" {
-		if len(os.Args) != 4 {
-			fmt.Println("Usage: go run . adduser <username> <password>")
+	if *port != "" || *stateless {
+		if *port != "" {
+			loadedConfig.Port = *port
+		}
+		loadedConfig.Stateless = loadedConfig.Stateless || *stateless
+		if err := loadedConfig.Validate(); err != nil {
+			fmt.Printf("Invalid configuration: %v\n", err)
 			os.Exit(1)
 		}
+	}
+	loadedConfig.apply()
 
-		username := os.Args[2]
-		password := os.Args[3]
+	repo, err := NewRepository()
+	if err != nil {
+		panic(err)
+	}
 
-		// Check if user already exists
-		existingUser, _ := repo.GetUserByUsername(username)
-		if existingUser != nil {
-			fmt.Printf("User '%s' already exists\n", username)
-			os.Exit(1)
+	if err := runCommand(repo, name, args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Printf("Error: %v\n", err)
 		}
+		os.Exit(1)
+	}
+}
 
-		// Hash password
-		hashedPassword, err := hashPassword(password)
+// validateCompany checks the fields the database doesn't constrain
+func validateCompany(company *Company) error {
+	tags, err := normalizeTags(company.Tags)
+	if err != nil {
+		return err
+	}
+	company.Tags = tags
+	if err := normalizeCompanyEmails(company); err != nil {
+		return err
+	}
+	if company.Phone != "" {
+		phone, err := normalizePhone(company.Phone)
 		if err != nil {
-			fmt.Printf("Error hashing password: %v\n", err)
-			os.Exit(1)
+			return err
 		}
+		company.Phone = phone
+	}
+	if company.WhatsAppOptIn && company.Phone == "" {
+		return errors.New("Opting in to WhatsApp needs a phone number")
+	}
+	if day := company.ConsolidationDay; day != nil && (*day < 1 || *day > 28) {
+		return errors.New("Consolidation day must be between 1 and 28")
+	}
+	if company.ConsolidationDay != nil && company.ConsolidationRemitID == nil {
+		return errors.New("Consolidation needs the remit information to invoice with")
+	}
+	if !company.Locale.Valid() {
+		return errors.New("Unsupported locale")
+	}
+	defaultCompanyRoles(company)
+	if !validCountry(company.Country) {
+		return errors.New("Country must be an ISO 3166 two letter code")
+	}
+	if !validPeppolID(company.PeppolID) {
+		return errors.New("Peppol ID must look like 0106:12345678")
+	}
+	if _, ok := numberingStrategies[company.NumberingStrategy]; company.NumberingStrategy != "" && !ok {
+		return errors.New("Invalid numbering strategy, expected sequential, yearly, per_client or random")
+	}
+	if company.InvoicePrefix != nil && len(*company.InvoicePrefix) > 20 {
+		return errors.New("Invoice prefix can't be longer than 20 characters")
+	}
+	return nil
+}
 
-		// Create user
-		user := &User{
-			Username:     username,
-			PasswordHash: hashedPassword,
+// validateInvoice checks the fields the database doesn't constrain
+func validateInvoice(invoice *Invoice) error {
+	tags, err := normalizeTags(invoice.Tags)
+	if err != nil {
+		return err
+	}
+	invoice.Tags = tags
+	if !invoice.Type.Valid() {
+		return errors.New("Invalid document type")
+	}
+	if !invoice.Locale.Valid() {
+		return errors.New("Unsupported locale")
+	}
+	if err := validateAdjustment("discount", invoice.Discount, invoice.DiscountType); err != nil {
+		return err
+	}
+	if err := validateAdjustment("penalty", invoice.Penalty, invoice.PenaltyType); err != nil {
+		return err
+	}
+	for index := range invoice.InvoiceLines {
+		line := &invoice.InvoiceLines[index]
+		if err := validateInvoiceLine(index, line); err != nil {
+			return err
+		}
+		if err := validateAdjustment(fmt.Sprintf("line %d discount", index+1), line.Discount, line.DiscountType); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if err := repo.CreateUser(user); err != nil {
-			fmt.Printf("Error creating user: %v\n", err)
-			os.Exit(1)
+// validateInvoiceLine checks the line bills a product or says what it
+// bills, and that sections only head the lines after them
+func validateInvoiceLine(index int, line *InvoiceLine) error {
+	if line.Type == "" {
+		line.Type = LineItem
+	}
+	if !line.Type.Valid() {
+		return fmt.Errorf("Line %d has an invalid type, expected item or section", index+1)
+	}
+	if line.ProductID != nil && *line.ProductID == 0 {
+		line.ProductID = nil
+	}
+	described := line.Description != nil && strings.TrimSpace(*line.Description) != ""
+	if line.Section() {
+		if line.ProductID != nil || line.UnitPrice != 0 || line.Discount != 0 {
+			return fmt.Errorf("Line %d is a section, it can't have a product, price or discount", index+1)
 		}
+		if !described {
+			return fmt.Errorf("Line %d is a section, its description is the heading", index+1)
+		}
+		return nil
+	}
+	if line.ProductID == nil && !described {
+		return fmt.Errorf("Line %d needs a product or a description", index+1)
+	}
+	// Lines sent without a quantity bill one
+	if line.Quantity != 0 && !validQuantity(line.Quantity) {
+		return fmt.Errorf("Line %d quantity must be positive, with up to 3 decimals", index+1)
+	}
+	if err := validateUnit(line.Unit); err != nil {
+		return fmt.Errorf("Line %d has an %v", index+1, err)
+	}
+	return nil
+}
 
-		fmt.Printf("User '%s' created successfully\n", username)
+func (h *Handler) getCompanies(w http.ResponseWriter, r *http.Request) {
+	filter, err := companyFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	mux := setupRoutes(false)
-
-	fmt.Println("Running on port " + PORT)
-	http.ListenAndServe(":"+PORT, mux)
-}
-
-func getCompanies(w http.ResponseWriter, r *http.Request) {
-	companies, err := repo.GetCompanies()
+	companies, err := h.storeFor(r).GetCompanies(filter)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDatabaseError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(companies)
+	h.writeList(w, r, "companies", companies)
 }
 
-func createCompany(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) createCompany(w http.ResponseWriter, r *http.Request) {
 	var company Company
-	if err := json.NewDecoder(r.Body).Decode(&company); err != nil {
+	if err := decodeRequest(r, &company); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := repo.CreateCompany(&company); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validateCompany(&company); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkCustomFields(h.storeFor(r), CustomFieldCompany, company.CustomFields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateCompany(&company); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -140,7 +243,7 @@ func createCompany(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(company)
 }
 
-func getCompany(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) getCompany(w http.ResponseWriter, r *http.Request) {
 	companyIdStr := r.PathValue("companyId")
 	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
 	if err != nil {
@@ -148,17 +251,16 @@ func getCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	company, err := repo.GetCompany(uint(companyId))
+	company, err := h.storeFor(r).GetCompany(uint(companyId))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(company)
+	writeRecord(w, r, "company", company)
 }
 
-func updateCompany(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) updateCompany(w http.ResponseWriter, r *http.Request) {
 	companyIdStr := r.PathValue("companyId")
 	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
 	if err != nil {
@@ -167,14 +269,23 @@ func updateCompany(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var company Company
-	if err := json.NewDecoder(r.Body).Decode(&company); err != nil {
+	if err := decodeRequest(r, &company); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateCompany(&company); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkCustomFields(h.storeFor(r), CustomFieldCompany, company.CustomFields); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	company.ID = uint(companyId)
-	if err := repo.UpdateCompany(&company); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).UpdateCompany(&company); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -182,7 +293,7 @@ func updateCompany(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(company)
 }
 
-func deleteCompany(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) deleteCompany(w http.ResponseWriter, r *http.Request) {
 	companyIdStr := r.PathValue("companyId")
 	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
 	if err != nil {
@@ -190,8 +301,12 @@ func deleteCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := repo.DeleteCompany(uint(companyId)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).DeleteCompany(uint(companyId)); err != nil {
+		if errors.Is(err, ErrCompanyInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -199,26 +314,31 @@ func deleteCompany(w http.ResponseWriter, r *http.Request) {
 }
 
 // RemitInformation handlers
-func getRemitInformations(w http.ResponseWriter, r *http.Request) {
-	remits, err := repo.GetRemitInformations()
+func (h *Handler) getRemitInformations(w http.ResponseWriter, r *http.Request) {
+	template, err := parseOptionalBool(r, "template")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(remits)
+	remits, err := h.storeFor(r).GetRemitInformations(RemitFilter{Template: template})
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	writeRecords(w, r, "remit", remits)
 }
 
-func createRemitInformation(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) createRemitInformation(w http.ResponseWriter, r *http.Request) {
 	var remit RemitInformation
-	if err := json.NewDecoder(r.Body).Decode(&remit); err != nil {
+	if err := decodeRequest(r, &remit); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := repo.CreateRemitInformation(&remit); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).CreateRemitInformation(&remit); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -227,7 +347,7 @@ func createRemitInformation(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(remit)
 }
 
-func getRemitInformation(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) getRemitInformation(w http.ResponseWriter, r *http.Request) {
 	remitIdStr := r.PathValue("remitId")
 	remitId, err := strconv.ParseUint(remitIdStr, 10, 32)
 	if err != nil {
@@ -235,17 +355,16 @@ func getRemitInformation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	remit, err := repo.GetRemitInformation(uint(remitId))
+	remit, err := h.storeFor(r).GetRemitInformation(uint(remitId))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(remit)
+	writeRecord(w, r, "remit", remit)
 }
 
-func updateRemitInformation(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) updateRemitInformation(w http.ResponseWriter, r *http.Request) {
 	remitIdStr := r.PathValue("remitId")
 	remitId, err := strconv.ParseUint(remitIdStr, 10, 32)
 	if err != nil {
@@ -254,14 +373,14 @@ func updateRemitInformation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var remit RemitInformation
-	if err := json.NewDecoder(r.Body).Decode(&remit); err != nil {
+	if err := decodeRequest(r, &remit); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	remit.ID = uint(remitId)
-	if err := repo.UpdateRemitInformation(&remit); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).UpdateRemitInformation(&remit); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -269,7 +388,7 @@ func updateRemitInformation(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(remit)
 }
 
-func deleteRemitInformation(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) deleteRemitInformation(w http.ResponseWriter, r *http.Request) {
 	remitIdStr := r.PathValue("remitId")
 	remitId, err := strconv.ParseUint(remitIdStr, 10, 32)
 	if err != nil {
@@ -277,8 +396,12 @@ func deleteRemitInformation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := repo.DeleteRemitInformation(uint(remitId)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).DeleteRemitInformation(uint(remitId)); err != nil {
+		if errors.Is(err, ErrRemitInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -286,26 +409,36 @@ func deleteRemitInformation(w http.ResponseWriter, r *http.Request) {
 }
 
 // Product handlers
-func getProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := repo.GetProducts()
+func (h *Handler) getProducts(w http.ResponseWriter, r *http.Request) {
+	filter, err := productFilterFromQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	products, err := h.storeFor(r).GetProducts(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	h.writeList(w, r, "products", products)
 }
 
-func createProduct(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) createProduct(w http.ResponseWriter, r *http.Request) {
 	var product Product
-	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+	if err := decodeRequest(r, &product); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := repo.CreateProduct(&product); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validateProduct(&product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateProduct(&product); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -314,7 +447,7 @@ func createProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(product)
 }
 
-func getProduct(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) {
 	productIdStr := r.PathValue("productId")
 	productId, err := strconv.ParseUint(productIdStr, 10, 32)
 	if err != nil {
@@ -322,17 +455,16 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	product, err := repo.GetProduct(uint(productId))
+	product, err := h.storeFor(r).GetProduct(uint(productId))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(product)
+	writeRecord(w, r, "product", product)
 }
 
-func updateProduct(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
 	productIdStr := r.PathValue("productId")
 	productId, err := strconv.ParseUint(productIdStr, 10, 32)
 	if err != nil {
@@ -341,14 +473,19 @@ func updateProduct(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var product Product
-	if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+	if err := decodeRequest(r, &product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateProduct(&product); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	product.ID = uint(productId)
-	if err := repo.UpdateProduct(&product); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).UpdateProduct(&product); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -356,7 +493,7 @@ func updateProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(product)
 }
 
-func deleteProduct(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) deleteProduct(w http.ResponseWriter, r *http.Request) {
 	productIdStr := r.PathValue("productId")
 	productId, err := strconv.ParseUint(productIdStr, 10, 32)
 	if err != nil {
@@ -364,42 +501,130 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := repo.DeleteProduct(uint(productId)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.storeFor(r).DeleteProduct(uint(productId)); err != nil {
+		if errors.Is(err, ErrProductInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *Handler) archiveProduct(w http.ResponseWriter, r *http.Request) {
+	h.setProductArchived(w, r, true)
+}
+
+func (h *Handler) unarchiveProduct(w http.ResponseWriter, r *http.Request) {
+	h.setProductArchived(w, r, false)
+}
+
+func (h *Handler) setProductArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	productIdStr := r.PathValue("productId")
+	productId, err := strconv.ParseUint(productIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := h.storeFor(r).SetProductArchived(uint(productId), archived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
 // Invoice handlers
-func getInvoices(w http.ResponseWriter, r *http.Request) {
-	invoices, err := repo.GetInvoices()
+func (h *Handler) getInvoices(w http.ResponseWriter, r *http.Request) {
+	filter, err := h.requestInvoiceFilter(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInvoiceFilterError(w, err)
+		return
+	}
+
+	// Lists are summaries unless the full invoices are asked for
+	switch view := r.URL.Query().Get("view"); view {
+	case "", "summary":
+		summaries, err := h.storeFor(r).GetInvoiceSummaries(filter)
+		if err != nil {
+			writeDatabaseError(w, r, err)
+			return
+		}
+		h.writeList(w, r, "invoices", summaries)
+	case "full":
+		invoices, err := h.storeFor(r).GetInvoices(filter)
+		if err != nil {
+			writeDatabaseError(w, r, err)
+			return
+		}
+		writeRecords(w, r, "invoices", invoices)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid view %q, expected summary or full", view), http.StatusBadRequest)
+	}
+}
+
+// getInvoiceTotals sums the invoices matched by the list filters
+func (h *Handler) getInvoiceTotals(w http.ResponseWriter, r *http.Request) {
+	filter, err := h.requestInvoiceFilter(r)
+	if err != nil {
+		writeInvoiceFilterError(w, err)
+		return
+	}
+
+	totals, err := h.storeFor(r).GetInvoiceTotals(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoices)
+	json.NewEncoder(w).Encode(totals)
 }
 
-func createInvoice(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) createInvoice(w http.ResponseWriter, r *http.Request) {
 	var invoice Invoice
-	if err := json.NewDecoder(r.Body).Decode(&invoice); err != nil {
+	if err := decodeRequest(r, &invoice); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	applyInvoiceDefaults(h.storeFor(r), &invoice)
 
-	if err := repo.CreateInvoice(&invoice); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validateInvoice(&invoice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkInvoiceIssuer(h.storeFor(r), &invoice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkCustomFields(h.storeFor(r), CustomFieldInvoice, invoice.CustomFields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateInvoice(&invoice); err != nil {
+		if errors.Is(err, ErrDiscountExceedsSubtotal) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	if err := checkProjectBudget(h.storeFor(r), invoice.ProjectID, clock.Now()); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
 	// Fetch the created invoice with all preloaded relationships
-	createdInvoice, err := repo.GetInvoice(invoice.ID)
+	createdInvoice, err := h.storeFor(r).GetInvoice(invoice.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -408,7 +633,7 @@ func createInvoice(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(createdInvoice)
 }
 
-func getInvoice(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) getInvoice(w http.ResponseWriter, r *http.Request) {
 	invoiceIdStr := r.PathValue("invoiceId")
 	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
 	if err != nil {
@@ -416,17 +641,20 @@ func getInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	invoice, err := repo.GetInvoice(uint(invoiceId))
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if invoice.LateCharges, err = lateChargesOf(h.storeFor(r), invoice, clock.Now()); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoice)
+	writeRecord(w, r, "invoice", invoice)
 }
 
-func updateInvoice(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) updateInvoice(w http.ResponseWriter, r *http.Request) {
 	invoiceIdStr := r.PathValue("invoiceId")
 	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
 	if err != nil {
@@ -435,21 +663,61 @@ func updateInvoice(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var invoice Invoice
-	if err := json.NewDecoder(r.Body).Decode(&invoice); err != nil {
+	if err := decodeRequest(r, &invoice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateInvoice(&invoice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkInvoiceIssuer(h.storeFor(r), &invoice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkCustomFields(h.storeFor(r), CustomFieldInvoice, invoice.CustomFields); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	invoice.ID = uint(invoiceId)
-	if err := repo.UpdateInvoice(&invoice); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	previous, err := h.storeFor(r).GetInvoice(invoice.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if err := checkInvoiceLock(h.storeFor(r), invoice.ID, editLockHolder(r), time.Now()); err != nil {
+		if errors.Is(err, ErrInvoiceLocked) {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+	if err := h.storeFor(r).UpdateInvoice(&invoice); err != nil {
+		if errors.Is(err, ErrInvoiceIssued) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrDiscountExceedsSubtotal) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+	for _, projectID := range []*uint{previous.ProjectID, invoice.ProjectID} {
+		if err := checkProjectBudget(h.storeFor(r), projectID, clock.Now()); err != nil {
+			writeDatabaseError(w, r, err)
+			return
+		}
+	}
 
 	// Fetch the updated invoice with all preloaded relationships
-	updatedInvoice, err := repo.GetInvoice(uint(invoiceId))
+	updatedInvoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDatabaseError(w, r, err)
 		return
 	}
 
@@ -457,7 +725,7 @@ func updateInvoice(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(updatedInvoice)
 }
 
-func deleteInvoice(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) deleteInvoice(w http.ResponseWriter, r *http.Request) {
 	invoiceIdStr := r.PathValue("invoiceId")
 	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
 	if err != nil {
@@ -465,15 +733,133 @@ func deleteInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := repo.DeleteInvoice(uint(invoiceId)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var projectID *uint
+	if invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId)); err == nil {
+		projectID = invoice.ProjectID
+	}
+	if err := checkInvoiceLock(h.storeFor(r), uint(invoiceId), editLockHolder(r), time.Now()); err != nil {
+		if errors.Is(err, ErrInvoiceLocked) {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteInvoice(uint(invoiceId)); err != nil {
+		if errors.Is(err, ErrSentInvoiceDeletion) || errors.Is(err, ErrInvoiceIssued) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+	if err := checkProjectBudget(h.storeFor(r), projectID, clock.Now()); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Payment handlers
+func (h *Handler) getPayments(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	payments, err := h.storeFor(r).GetPayments(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	writeRecords(w, r, "payments", payments)
+}
+
+// recordPayment stores the payment against its invoice and thanks the
+// client once it makes the invoice fully paid
+func recordPayment(store Store, payment *Payment) error {
+	if payment.Date.IsZero() {
+		payment.Date = clock.Now()
+	}
+
+	invoice, err := store.GetInvoice(payment.InvoiceID)
+	if err != nil {
+		return err
+	}
+	wasPaid := invoice.Paid
+
+	if err := store.CreatePayment(payment); err != nil {
+		return err
+	}
+
+	if invoice, err := store.GetInvoice(payment.InvoiceID); err == nil && invoice.Paid && !wasPaid {
+		if err := sendReceipt(store, invoice); err != nil {
+			log.Printf("Error sending receipt for invoice %d: %v", invoice.ID, err)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) createPayment(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var payment Payment
+	if err := decodeRequest(r, &payment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if payment.Amount <= 0 {
+		http.Error(w, "Payment amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	payment.InvoiceID = uint(invoiceId)
+	if err := recordPayment(h.storeFor(r), &payment); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrDocumentNotPayable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(payment)
+}
+
+func (h *Handler) deletePayment(w http.ResponseWriter, r *http.Request) {
+	paymentIdStr := r.PathValue("paymentId")
+	paymentId, err := strconv.ParseUint(paymentIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeletePayment(uint(paymentId)); err != nil {
+		writeDatabaseError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func listTemplates(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) listTemplates(w http.ResponseWriter, r *http.Request) {
 	dirs, err := os.ReadDir("templates/invoices")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -491,7 +877,7 @@ func listTemplates(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(templates)
 }
 
-func openInvoice(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) openInvoice(w http.ResponseWriter, r *http.Request) {
 	invoiceIdStr := r.PathValue("invoiceId")
 	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
 	if err != nil {
@@ -505,22 +891,44 @@ func openInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	invoice, err := repo.GetInvoice(uint(invoiceId))
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	renderInvoice(w, h.storeFor(r), invoice, templateName, nil, "", false)
+}
+
+// renderInvoice executes the named invoice template with the invoice and
+// the optional stored template customizations, as they were when the
+// invoice was sent. The pages clients see are read-only and don't record
+// the version of the file.
+func renderInvoice(w http.ResponseWriter, store Store, invoice *Invoice, templateName string, settings *InvoiceTemplate, disputeURL string, readOnly bool) {
+	source, settings, err := invoiceTemplateSource(store, invoice, templateName, settings, !readOnly)
+	if err != nil {
+		log.Printf("Error loading template %s: %v", templateName, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	templateData := struct {
-		Invoice *Invoice
+		Invoice  *Invoice
+		Template *InvoiceTemplate
+		Logo     template.URL
+		// DisputeURL links the client to disputing the invoice, set on the
+		// pages clients see
+		DisputeURL string
 	}{
-		Invoice: invoice,
+		Invoice:    invoice,
+		Template:   settings,
+		Logo:       companyLogo(&invoice.Company),
+		DisputeURL: disputeURL,
 	}
 
-	tmplPath := filepath.Join("templates", "invoices", templateName)
-	tmpl, err := template.ParseFiles(tmplPath)
+	tmpl, err := template.New(filepath.Base(templateName)).Parse(source)
 	if err != nil {
-		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		log.Printf("Error parsing template %s: %v", templateName, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -528,13 +936,23 @@ func openInvoice(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	err = tmpl.Execute(w, templateData)
 	if err != nil {
-		log.Printf("Error executing template %s: %v", tmplPath, err)
+		log.Printf("Error executing template %s: %v", templateName, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func logout(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := endSession(cookie.Value); err != nil {
+			log.Printf("Error ending the session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	if h.oidc != nil && r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	// Set WWW-Authenticate header to prompt for new credentials
 	w.Header().Set("WWW-Authenticate", `Basic realm="Tiny CRM"`)
 	http.Error(w, "Logged out successfully", http.StatusUnauthorized)
@@ -1,20 +1,60 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/jpeg"
+	imagepng "image/png"
 	"io"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
+	"github.com/samuel19992/tiny-crm/tinycrmpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func setupTestServer(t *testing.T) (*httptest.Server, *Repository) {
@@ -34,29 +74,19 @@ func setupTestServer(t *testing.T) (*httptest.Server, *Repository) {
 	}
 
 	// Run migrations
-	err = testDB.AutoMigrate(
-		&RemitInformation{},
-		&RemitInformationLine{},
-		&Product{},
-		&Company{},
-		&Invoice{},
-		&InvoiceLine{},
-	)
-	if err != nil {
+	if err := testRepo.Migrate(); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
 
-	// Store original repo and set test repo
-	originalRepo := repo
-	repo = testRepo
+	if err := loadSettings(testRepo); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
 
 	// Use the same route setup as main.go
-	mux := setupRoutes(true)
+	mux := setupRoutes(NewHandler(testRepo), true)
 	server := httptest.NewServer(mux)
 
-	// Clean up function to restore original repo
 	t.Cleanup(func() {
-		repo = originalRepo
 		server.Close()
 	})
 
@@ -92,43 +122,93 @@ func makeRequest(server *httptest.Server, method, endpoint, body string) (*http.
 	return resp, responseBody, nil
 }
 
-func createTestData(testRepo *Repository) (companyID, productID, remitID uint, err error) {
-	// Create test company
-	company := Company{
-		Name:     "Test Company Ltd",
-		Document: "12.345.678/0001-90",
-		Address:  "123 Test Street, Test City",
+// routeWildcard is a wildcard of a manifest path, like {invoiceId}
+var routeWildcard = regexp.MustCompile(`\{[^}]+\}`)
+
+// routePath fills the wildcards of a manifest path with the values, in order
+func routePath(path string, values ...interface{}) string {
+	if wildcards := len(routeWildcard.FindAllString(path, -1)); wildcards != len(values) {
+		panic(fmt.Sprintf("routePath: %s takes %d values, got %d", path, wildcards, len(values)))
 	}
-	if err = testRepo.CreateCompany(&company); err != nil {
+	i := 0
+	return routeWildcard.ReplaceAllStringFunc(path, func(string) string {
+		i++
+		return fmt.Sprint(values[i-1])
+	})
+}
+
+func createTestData(testRepo *Repository) (companyID, productID, remitID uint, err error) {
+	f := NewFactory(testRepo)
+	company, err := f.Company(func(c *Company) {
+		c.Name, c.Document, c.Address = "Test Company Ltd", "12.345.678/0001-90", "123 Test Street, Test City"
+		c.IsIssuer, c.IsClient = true, true
+	})
+	if err != nil {
 		return 0, 0, 0, err
 	}
-	companyID = company.ID
 
-	// Create test product
-	product := Product{
-		Name:        "Test Product",
-		Description: stringPtr("Test product description"),
-		Price:       99.99,
-	}
-	if err = testRepo.CreateProduct(&product); err != nil {
+	product, err := f.Product(func(p *Product) {
+		p.Name, p.Description, p.Price = "Test Product", stringPtr("Test product description"), moneyFromFloat(99.99)
+	})
+	if err != nil {
 		return 0, 0, 0, err
 	}
-	productID = product.ID
 
-	// Create test remit information
-	remit := RemitInformation{
-		Name: "Test Remit Info",
-		Lines: []RemitInformationLine{
-			{Key: "bank", Value: "Test Bank"},
-			{Key: "account", Value: "123456789"},
-		},
-	}
-	if err = testRepo.CreateRemitInformation(&remit); err != nil {
+	remit, err := f.RemitInformation(func(r *RemitInformation) { r.Name = "Test Remit Info" })
+	if err != nil {
 		return 0, 0, 0, err
 	}
-	remitID = remit.ID
 
-	return companyID, productID, remitID, nil
+	return company.ID, product.ID, remit.ID, nil
+}
+
+// fakeMailer records emails instead of sending them
+type fakeMailer struct {
+	sent []*Email
+}
+
+func (m *fakeMailer) Send(email *Email) error {
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func setupFakeMailer(t *testing.T) *fakeMailer {
+	fake := &fakeMailer{}
+	originalMailer := mailer
+	mailer = fake
+	t.Cleanup(func() {
+		mailer = originalMailer
+	})
+	return fake
+}
+
+// setupRedis points redisClient at an in-memory Redis server asking for
+// the password, for the test
+func setupRedis(t *testing.T, password string) *miniredis.Miniredis {
+	server := miniredis.RunT(t)
+	if password != "" {
+		server.RequireAuth(password)
+	}
+	server.Select(2)
+
+	originalClient := redisClient
+	redisClient = newRedisClient(RedisConfig{URL: "redis://:" + password + "@" + server.Addr() + "/2", Prefix: "test:"})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = originalClient
+	})
+	return server
+}
+
+// setupSimulatedClock stops the clock at now for the test
+func setupSimulatedClock(t *testing.T, now time.Time) *SimulatedClock {
+	simulated := NewSimulatedClock(now)
+	originalClock := clock
+	clock = simulated
+	t.Cleanup(func() {
+		clock = originalClock
+	})
+	return simulated
 }
 
 func stringPtr(s string) *string {
@@ -150,7 +230,7 @@ func TestCompanyCreate(t *testing.T) {
 		"address": "456 Integration Ave, Test City, ST"
 	}`
 
-	resp, body, err := makeRequest(server, "POST", "/api/companies", companyJSON)
+	resp, body, err := makeRequest(server, "POST", pathCompanies, companyJSON)
 	if err != nil {
 		t.Fatalf("Failed to create company: %v", err)
 	}
@@ -189,7 +269,7 @@ func TestCompanyGet(t *testing.T) {
 		t.Fatalf("Failed to create test company: %v", err)
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/companies/"+strconv.Itoa(int(company.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompany, company.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to get company: %v", err)
 	}
@@ -227,7 +307,7 @@ func TestCompanyList(t *testing.T) {
 		}
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/companies", "")
+	resp, body, err := makeRequest(server, "GET", pathCompanies, "")
 	if err != nil {
 		t.Fatalf("Failed to list companies: %v", err)
 	}
@@ -266,7 +346,7 @@ func TestCompanyUpdate(t *testing.T) {
 		"address": "789 Updated Street, New City, ST"
 	}`
 
-	resp, body, err := makeRequest(server, "PUT", "/api/companies/"+strconv.Itoa(int(company.ID)), updateJSON)
+	resp, body, err := makeRequest(server, "PUT", routePath(pathCompany, company.ID), updateJSON)
 	if err != nil {
 		t.Fatalf("Failed to update company: %v", err)
 	}
@@ -302,7 +382,7 @@ func TestCompanyDelete(t *testing.T) {
 		t.Fatalf("Failed to create test company: %v", err)
 	}
 
-	resp, _, err := makeRequest(server, "DELETE", "/api/companies/"+strconv.Itoa(int(company.ID)), "")
+	resp, _, err := makeRequest(server, "DELETE", routePath(pathCompany, company.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to delete company: %v", err)
 	}
@@ -312,7 +392,7 @@ func TestCompanyDelete(t *testing.T) {
 	}
 
 	// Verify deletion by trying to fetch
-	resp, body, err := makeRequest(server, "GET", "/api/companies/"+strconv.Itoa(int(company.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompany, company.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to verify deletion: %v", err)
 	}
@@ -340,7 +420,7 @@ func TestProductCreate(t *testing.T) {
 		"price": 149.99
 	}`
 
-	resp, body, err := makeRequest(server, "POST", "/api/products", productJSON)
+	resp, body, err := makeRequest(server, "POST", pathProducts, productJSON)
 	if err != nil {
 		t.Fatalf("Failed to create product: %v", err)
 	}
@@ -360,7 +440,7 @@ func TestProductCreate(t *testing.T) {
 	if createdProduct.Name != "Integration Test Product" {
 		t.Errorf("Expected name 'Integration Test Product', got '%s'", createdProduct.Name)
 	}
-	if createdProduct.Price != 149.99 {
+	if createdProduct.Price != moneyFromFloat(149.99) {
 		t.Errorf("Expected price 149.99, got %f", createdProduct.Price)
 	}
 	if createdProduct.Description == nil || *createdProduct.Description != "A product for integration testing" {
@@ -377,7 +457,7 @@ func TestProductCreateWithoutDescription(t *testing.T) {
 		"price": 99.99
 	}`
 
-	resp, body, err := makeRequest(server, "POST", "/api/products", productJSON)
+	resp, body, err := makeRequest(server, "POST", pathProducts, productJSON)
 	if err != nil {
 		t.Fatalf("Failed to create product without description: %v", err)
 	}
@@ -397,7 +477,7 @@ func TestProductCreateWithoutDescription(t *testing.T) {
 	if productNoDesc.Name != "Product Without Description" {
 		t.Errorf("Expected name 'Product Without Description', got '%s'", productNoDesc.Name)
 	}
-	if productNoDesc.Price != 99.99 {
+	if productNoDesc.Price != moneyFromFloat(99.99) {
 		t.Errorf("Expected price 99.99, got %f", productNoDesc.Price)
 	}
 }
@@ -410,13 +490,13 @@ func TestProductGet(t *testing.T) {
 	product := Product{
 		Name:        "Test Product",
 		Description: stringPtr("Test description"),
-		Price:       149.99,
+		Price:       moneyFromFloat(149.99),
 	}
 	if err := testRepo.CreateProduct(&product); err != nil {
 		t.Fatalf("Failed to create test product: %v", err)
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/products/"+strconv.Itoa(int(product.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathProduct, product.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to get product: %v", err)
 	}
@@ -433,7 +513,7 @@ func TestProductGet(t *testing.T) {
 	if retrievedProduct.ID != product.ID {
 		t.Errorf("Expected ID %d, got %d", product.ID, retrievedProduct.ID)
 	}
-	if retrievedProduct.Price != 149.99 {
+	if retrievedProduct.Price != moneyFromFloat(149.99) {
 		t.Errorf("Expected price 149.99, got %f", retrievedProduct.Price)
 	}
 }
@@ -444,8 +524,8 @@ func TestProductList(t *testing.T) {
 
 	// Create test products
 	products := []Product{
-		{Name: "Product 1", Price: 10.99},
-		{Name: "Product 2", Description: stringPtr("Product 2 desc"), Price: 20.99},
+		{Name: "Product 1", Price: moneyFromFloat(10.99)},
+		{Name: "Product 2", Description: stringPtr("Product 2 desc"), Price: moneyFromFloat(20.99)},
 	}
 
 	for i := range products {
@@ -454,7 +534,7 @@ func TestProductList(t *testing.T) {
 		}
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/products", "")
+	resp, body, err := makeRequest(server, "GET", pathProducts, "")
 	if err != nil {
 		t.Fatalf("Failed to list products: %v", err)
 	}
@@ -481,7 +561,7 @@ func TestProductUpdate(t *testing.T) {
 	product := Product{
 		Name:        "Original Product",
 		Description: stringPtr("Original description"),
-		Price:       149.99,
+		Price:       moneyFromFloat(149.99),
 	}
 	if err := testRepo.CreateProduct(&product); err != nil {
 		t.Fatalf("Failed to create test product: %v", err)
@@ -493,7 +573,7 @@ func TestProductUpdate(t *testing.T) {
 		"price": 199.99
 	}`
 
-	resp, body, err := makeRequest(server, "PUT", "/api/products/"+strconv.Itoa(int(product.ID)), updateJSON)
+	resp, body, err := makeRequest(server, "PUT", routePath(pathProduct, product.ID), updateJSON)
 	if err != nil {
 		t.Fatalf("Failed to update product: %v", err)
 	}
@@ -510,7 +590,7 @@ func TestProductUpdate(t *testing.T) {
 	if updatedProduct.Name != "Updated Product Name" {
 		t.Errorf("Expected updated name 'Updated Product Name', got '%s'", updatedProduct.Name)
 	}
-	if updatedProduct.Price != 199.99 {
+	if updatedProduct.Price != moneyFromFloat(199.99) {
 		t.Errorf("Expected updated price 199.99, got %f", updatedProduct.Price)
 	}
 	if updatedProduct.Description == nil || *updatedProduct.Description != "Updated description for the product" {
@@ -525,13 +605,13 @@ func TestProductDelete(t *testing.T) {
 	// Create test product first
 	product := Product{
 		Name:  "Product to Delete",
-		Price: 99.99,
+		Price: moneyFromFloat(99.99),
 	}
 	if err := testRepo.CreateProduct(&product); err != nil {
 		t.Fatalf("Failed to create test product: %v", err)
 	}
 
-	resp, _, err := makeRequest(server, "DELETE", "/api/products/"+strconv.Itoa(int(product.ID)), "")
+	resp, _, err := makeRequest(server, "DELETE", routePath(pathProduct, product.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to delete product: %v", err)
 	}
@@ -541,7 +621,7 @@ func TestProductDelete(t *testing.T) {
 	}
 
 	// Verify deletion by trying to fetch
-	resp, body, err := makeRequest(server, "GET", "/api/products/"+strconv.Itoa(int(product.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathProduct, product.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to verify deletion: %v", err)
 	}
@@ -558,6 +638,182 @@ func TestProductDelete(t *testing.T) {
 	}
 }
 
+func TestProductArchive(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	_, productID, _, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	if _, _, _, err := createTestData(testRepo); err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	companyID, _, remitID, _ := createTestData(testRepo)
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+
+	// A billed product can't be deleted
+	resp, body, _ := makeRequest(server, "DELETE", routePath(pathProduct, productID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "archive") {
+		t.Errorf("Expected 409 suggesting to archive, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathProductArchive, productID), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to archive product: %d %s", resp.StatusCode, body)
+	}
+	var archived Product
+	json.Unmarshal(body, &archived)
+	if archived.ArchivedAt == nil {
+		t.Error("Expected the product to be archived")
+	}
+
+	// Updating the product keeps it archived
+	makeRequest(server, "PUT", routePath(pathProduct, productID), `{"name": "Renamed", "price": 99.99}`)
+
+	var products []Product
+	_, body, _ = makeRequest(server, "GET", pathProducts, "")
+	json.Unmarshal(body, &products)
+	for _, product := range products {
+		if product.ID == productID {
+			t.Error("Expected archived products to be left out of the list")
+		}
+	}
+	if len(products) != 2 {
+		t.Errorf("Expected 2 active products, got %d", len(products))
+	}
+
+	products = nil
+	_, body, _ = makeRequest(server, "GET", pathProducts+"?archived=true", "")
+	json.Unmarshal(body, &products)
+	if len(products) != 1 || products[0].ID != productID || products[0].Name != "Renamed" {
+		t.Errorf("Expected only the archived product, got %+v", products)
+	}
+
+	// Its invoices still show it
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	if stored.InvoiceLines[0].Product.ID != productID {
+		t.Error("Expected the invoice to keep the archived product")
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathProductUnarchive, productID), "")
+	json.Unmarshal(body, &archived)
+	if resp.StatusCode != http.StatusOK || archived.ArchivedAt != nil {
+		t.Errorf("Expected the product to be brought back, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, _, _ = makeRequest(server, "POST", routePath(pathProductArchive, 9999), "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown product, got %d", resp.StatusCode)
+	}
+}
+
+func TestProductCategories(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, uncategorizedID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, _ := makeRequest(server, "POST", pathCategories, `{"name": " Services "}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create category: %d %s", resp.StatusCode, body)
+	}
+	var category Category
+	json.Unmarshal(body, &category)
+	if category.Name != "Services" {
+		t.Errorf("Expected the name to be trimmed, got %q", category.Name)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", pathProducts, fmt.Sprintf(`{"name": "Consulting", "price": 50, "category_id": %d, "tags": ["Hourly ", "remote", "hourly"]}`, category.ID))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create product: %d %s", resp.StatusCode, body)
+	}
+	var consulting Product
+	json.Unmarshal(body, &consulting)
+	if len(consulting.Tags) != 2 || consulting.Tags[0] != "hourly" || consulting.Tags[1] != "remote" {
+		t.Errorf("Expected normalized tags, got %v", consulting.Tags)
+	}
+
+	resp, _, _ = makeRequest(server, "POST", pathProducts, `{"name": "Bad", "price": 1, "tags": ["a,b"]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tag, got %d", resp.StatusCode)
+	}
+
+	for query, expected := range map[string]uint{
+		fmt.Sprintf("category_id=%d", category.ID): consulting.ID,
+		"tag=Remote": consulting.ID,
+	} {
+		var products []Product
+		_, body, _ = makeRequest(server, "GET", pathProducts+"?"+query, "")
+		json.Unmarshal(body, &products)
+		if len(products) != 1 || products[0].ID != expected {
+			t.Errorf("%s: expected only the consulting product, got %+v", query, products)
+		}
+	}
+
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &consulting.ID, Quantity: 3},
+			{ProductID: &uncategorizedID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	credit := Invoice{
+		Type:               DocumentCreditNote,
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &consulting.ID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&credit); err != nil {
+		t.Fatalf("Failed to create credit note: %v", err)
+	}
+
+	resp, body, _ = makeRequest(server, "GET", pathReportsRevenueByCategory, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get revenue by category: %d %s", resp.StatusCode, body)
+	}
+	var report []CategoryRevenue
+	json.Unmarshal(body, &report)
+	if len(report) != 2 {
+		t.Fatalf("Expected 2 report lines, got %+v", report)
+	}
+	if report[0].Category != "Services" || report[0].Billed != 100 || report[0].Quantity != 2 {
+		t.Errorf("Expected the services category first, got %+v", report[0])
+	}
+	if report[1].Category != "Uncategorized" || report[1].CategoryID != nil || report[1].Billed != 99.99 {
+		t.Errorf("Expected the uncategorized line, got %+v", report[1])
+	}
+
+	resp, _, _ = makeRequest(server, "DELETE", routePath(pathCategory, category.ID), "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	stored, _ := testRepo.GetProduct(consulting.ID)
+	if stored.CategoryID != nil {
+		t.Error("Expected the product to become uncategorized")
+	}
+}
+
 // RemitInformation Tests
 func TestRemitInformationCreate(t *testing.T) {
 	server, _ := setupTestServer(t)
@@ -572,7 +828,7 @@ func TestRemitInformationCreate(t *testing.T) {
 		]
 	}`
 
-	resp, body, err := makeRequest(server, "POST", "/api/remit", remitJSON)
+	resp, body, err := makeRequest(server, "POST", pathRemits, remitJSON)
 	if err != nil {
 		t.Fatalf("Failed to create remit information: %v", err)
 	}
@@ -613,7 +869,7 @@ func TestRemitInformationGet(t *testing.T) {
 		t.Fatalf("Failed to create test remit: %v", err)
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/remit/"+strconv.Itoa(int(remit.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathRemit, remit.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to get remit information: %v", err)
 	}
@@ -654,7 +910,7 @@ func TestRemitInformationList(t *testing.T) {
 		}
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/remit", "")
+	resp, body, err := makeRequest(server, "GET", pathRemits, "")
 	if err != nil {
 		t.Fatalf("Failed to list remit informations: %v", err)
 	}
@@ -703,7 +959,7 @@ func TestRemitInformationUpdate(t *testing.T) {
 		]
 	}`
 
-	resp, body, err := makeRequest(server, "PUT", "/api/remit/"+strconv.Itoa(int(remit.ID)), updateJSON)
+	resp, body, err := makeRequest(server, "PUT", routePath(pathRemit, remit.ID), updateJSON)
 	if err != nil {
 		t.Fatalf("Failed to update remit information: %v", err)
 	}
@@ -751,7 +1007,7 @@ func TestRemitInformationDelete(t *testing.T) {
 		t.Error("RemitInformationLines should be created with the remit")
 	}
 
-	resp, _, err := makeRequest(server, "DELETE", "/api/remit/"+strconv.Itoa(int(remit.ID)), "")
+	resp, _, err := makeRequest(server, "DELETE", routePath(pathRemit, remit.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to delete remit information: %v", err)
 	}
@@ -761,7 +1017,7 @@ func TestRemitInformationDelete(t *testing.T) {
 	}
 
 	// Verify deletion by trying to fetch
-	resp, body, err := makeRequest(server, "GET", "/api/remit/"+strconv.Itoa(int(remit.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathRemit, remit.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to verify deletion: %v", err)
 	}
@@ -809,7 +1065,7 @@ func TestInvoiceCreate(t *testing.T) {
 		]
 	}`, remitID, companyID, companyID, productID)
 
-	resp, body, err := makeRequest(server, "POST", "/api/invoices", invoiceJSON)
+	resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceJSON)
 	if err != nil {
 		t.Fatalf("Failed to create invoice: %v", err)
 	}
@@ -849,15 +1105,15 @@ func TestInvoiceGet(t *testing.T) {
 	invoice := Invoice{
 		Number:                intPtr(2001),
 		AdditionalInformation: stringPtr("Test invoice for get"),
-		Discount:              15.00,
-		Penalty:               0.00,
+		Discount:              1500,
+		Penalty:               0,
 		DueDate:               dueDate,
 		RemitInformationID:    remitID,
 		CompanyID:             companyID,
 		ClientID:              companyID,
 		InvoiceLines: []InvoiceLine{
 			{
-				ProductID:   productID,
+				ProductID:   &productID,
 				Quantity:    3,
 				Description: stringPtr("Get test line"),
 			},
@@ -867,7 +1123,7 @@ func TestInvoiceGet(t *testing.T) {
 		t.Fatalf("Failed to create test invoice: %v", err)
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/invoices/"+strconv.Itoa(int(invoice.ID)), "")
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoice, invoice.ID), "")
 	if err != nil {
 		t.Fatalf("Failed to get invoice: %v", err)
 	}
@@ -913,26 +1169,26 @@ func TestInvoiceList(t *testing.T) {
 	invoices := []Invoice{
 		{
 			Number:             intPtr(3001),
-			Discount:           0.00,
-			Penalty:            0.00,
+			Discount:           0,
+			Penalty:            0,
 			DueDate:            time.Now().AddDate(0, 1, 0),
 			RemitInformationID: remitID,
 			CompanyID:          companyID,
 			ClientID:           companyID,
 			InvoiceLines: []InvoiceLine{
-				{ProductID: productID, Quantity: 1},
+				{ProductID: &productID, Quantity: 1},
 			},
 		},
 		{
 			Number:             intPtr(3002),
-			Discount:           5.00,
+			Discount:           500,
 			Penalty:            0.00,
 			DueDate:            time.Now().AddDate(0, 2, 0),
 			RemitInformationID: remitID,
 			CompanyID:          companyID,
 			ClientID:           companyID,
 			InvoiceLines: []InvoiceLine{
-				{ProductID: productID, Quantity: 2},
+				{ProductID: &productID, Quantity: 2},
 			},
 		},
 	}
@@ -943,7 +1199,7 @@ func TestInvoiceList(t *testing.T) {
 		}
 	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/invoices", "")
+	resp, body, err := makeRequest(server, "GET", pathInvoices+"?view=full", "")
 	if err != nil {
 		t.Fatalf("Failed to list invoices: %v", err)
 	}
@@ -972,318 +1228,583 @@ func TestInvoiceList(t *testing.T) {
 	}
 }
 
-func TestInvoiceUpdate(t *testing.T) {
+func TestInvoiceListSummaries(t *testing.T) {
 	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	// Create prerequisite data
 	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
 		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	// Create test invoice
-	dueDate := time.Now().AddDate(0, 1, 0)
-	invoice := Invoice{
-		Number:             intPtr(4001),
-		Discount:           0.00,
-		Penalty:            0.00,
-		DueDate:            dueDate,
-		RemitInformationID: remitID,
-		CompanyID:          companyID,
-		ClientID:           companyID,
-		InvoiceLines: []InvoiceLine{
-			{ProductID: productID, Quantity: 1},
+	invoices := []Invoice{
+		{
+			Number:             intPtr(4001),
+			Discount:           500,
+			DueDate:            time.Now().AddDate(0, 1, 0),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
+			InvoiceLines: []InvoiceLine{
+				{ProductID: &productID, Quantity: 2},
+				{ProductID: &productID, Quantity: 1},
+			},
+		},
+		{
+			Number:             intPtr(4002),
+			DueDate:            time.Now().AddDate(0, 0, -1),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
 		},
 	}
-	if err := testRepo.CreateInvoice(&invoice); err != nil {
-		t.Fatalf("Failed to create test invoice: %v", err)
+	for i := range invoices {
+		if err := testRepo.CreateInvoice(&invoices[i]); err != nil {
+			t.Fatalf("Failed to create test invoice: %v", err)
+		}
 	}
 
-	updateJSON := fmt.Sprintf(`{
-		"number": 4002,
-		"additional_information": "Updated invoice info",
-		"discount": 25.00,
-		"penalty": 10.00,
-		"due_date": "2025-01-31T23:59:59Z",
-		"remit_information_id": %d,
-		"company_id": %d,
-		"client_id": %d,
-		"invoice_lines": [
-			{
-				"product_id": %d,
-				"quantity": 5,
-				"description": "Updated line"
-			}
-		]
-	}`, remitID, companyID, companyID, productID)
-
-	resp, body, err := makeRequest(server, "PUT", "/api/invoices/"+strconv.Itoa(int(invoice.ID)), updateJSON)
+	resp, body, err := makeRequest(server, "GET", pathInvoices, "")
 	if err != nil {
-		t.Fatalf("Failed to update invoice: %v", err)
+		t.Fatalf("Failed to list invoices: %v", err)
 	}
-
 	if resp.StatusCode != http.StatusOK {
-		t.Errorf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if strings.Contains(string(body), "invoice_lines") {
+		t.Errorf("Expected summaries without lines, got %s", body)
 	}
 
-	var updatedInvoice Invoice
-	if err := json.Unmarshal(body, &updatedInvoice); err != nil {
-		t.Fatalf("Failed to unmarshal updated invoice: %v", err)
+	var summaries []InvoiceSummary
+	if err := json.Unmarshal(body, &summaries); err != nil {
+		t.Fatalf("Failed to unmarshal invoice summaries: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 summaries, got %d", len(summaries))
 	}
 
-	if updatedInvoice.Number == nil || *updatedInvoice.Number != 4002 {
-		t.Error("Invoice number should be updated")
+	first, second := summaries[0], summaries[1]
+	if first.ClientName != "Test Company Ltd" || first.Number == nil || *first.Number != 4001 {
+		t.Errorf("Unexpected summary %+v", first)
+	}
+	if expected := moneyFromFloat(99.99)*3 - moneyFromFloat(5); first.Total != expected {
+		t.Errorf("Expected total %.2f, got %.2f", expected, first.Total)
+	}
+	if first.Status != InvoiceStatusOpen {
+		t.Errorf("Expected status open, got %q", first.Status)
+	}
+	if second.Total != 0 || second.Status != InvoiceStatusOverdue {
+		t.Errorf("Expected an empty overdue invoice, got %+v", second)
+	}
+
+	resp, body, err = makeRequest(server, "GET", pathInvoices+"?paid=false&view=summary", "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to filter invoice summaries: %v", err)
+	}
+	json.Unmarshal(body, &summaries)
+	if len(summaries) != 2 {
+		t.Errorf("Expected filters to apply to summaries, got %d", len(summaries))
+	}
+
+	resp, _, err = makeRequest(server, "GET", pathInvoices+"?view=bogus", "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
 	}
-	if updatedInvoice.Discount != 25.00 {
-		t.Errorf("Expected discount 25.00, got %f", updatedInvoice.Discount)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown view, got %d", resp.StatusCode)
 	}
 }
 
-func TestInvoiceDelete(t *testing.T) {
+func TestInvoiceSearch(t *testing.T) {
 	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	// Create prerequisite data
 	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
 		t.Fatalf("Failed to create test data: %v", err)
 	}
-
-	// Create test invoice
-	dueDate := time.Now().AddDate(0, 1, 0)
-	invoice := Invoice{
-		Number:             intPtr(5001),
-		DueDate:            dueDate,
-		RemitInformationID: remitID,
-		CompanyID:          companyID,
-		ClientID:           companyID,
-	}
-	if err := testRepo.CreateInvoice(&invoice); err != nil {
-		t.Fatalf("Failed to create test invoice: %v", err)
+	certificate := Product{Name: "SSL Certificate", Price: moneyFromFloat(50)}
+	if err := testRepo.CreateProduct(&certificate); err != nil {
+		t.Fatalf("Failed to create product: %v", err)
 	}
 
-	// Create invoice lines separately to ensure foreign key is set
-	line := InvoiceLine{
-		InvoiceID: invoice.ID,
-		ProductID: productID,
-		Quantity:  1,
+	lines := [][]InvoiceLine{
+		{{ProductID: &productID, Quantity: 1, Description: stringPtr("Hosting for March")}},
+		{{ProductID: &certificate.ID, Quantity: 1}},
+		{{ProductID: &productID, Quantity: 1, Description: stringPtr("100% uptime bonus")}},
 	}
-	if err := testRepo.db.Create(&line).Error; err != nil {
-		t.Fatalf("Failed to create test invoice line: %v", err)
+	var ids []uint
+	for _, invoiceLines := range lines {
+		invoice := Invoice{
+			DueDate:            time.Now(),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
+			InvoiceLines:       invoiceLines,
+		}
+		if err := testRepo.CreateInvoice(&invoice); err != nil {
+			t.Fatalf("Failed to create invoice: %v", err)
+		}
+		ids = append(ids, invoice.ID)
 	}
 
-	// Verify invoice lines were created with proper foreign key
-	var initialLineCount int64
-	testRepo.db.Model(&InvoiceLine{}).Where("invoice_id = ?", invoice.ID).Count(&initialLineCount)
-	if initialLineCount == 0 {
-		t.Error("InvoiceLines should be created with the invoice")
+	search := func(query string) []uint {
+		resp, body, err := makeRequest(server, "GET", pathInvoices+"?q="+url.QueryEscape(query), "")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to search invoices: %v", err)
+		}
+		var summaries []InvoiceSummary
+		json.Unmarshal(body, &summaries)
+		var found []uint
+		for _, summary := range summaries {
+			found = append(found, summary.ID)
+		}
+		return found
 	}
 
-	resp, _, err := makeRequest(server, "DELETE", "/api/invoices/"+strconv.Itoa(int(invoice.ID)), "")
-	if err != nil {
-		t.Fatalf("Failed to delete invoice: %v", err)
+	if found := search("ssl cert"); len(found) != 1 || found[0] != ids[1] {
+		t.Errorf("Expected the invoice billing the certificate, got %v", found)
 	}
-
-	if resp.StatusCode != http.StatusNoContent {
-		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	if found := search("march"); len(found) != 1 || found[0] != ids[0] {
+		t.Errorf("Expected the invoice with the March line, got %v", found)
 	}
-
-	// Verify deletion by trying to fetch
-	resp, body, err := makeRequest(server, "GET", "/api/invoices/"+strconv.Itoa(int(invoice.ID)), "")
-	if err != nil {
-		t.Fatalf("Failed to verify deletion: %v", err)
+	// Product descriptions match too
+	if found := search("test product description"); len(found) != 2 {
+		t.Errorf("Expected 2 invoices billing the test product, got %v", found)
 	}
-
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected status 404 after deletion, got %d. Response: %s", resp.StatusCode, string(body))
+	// LIKE wildcards are matched literally
+	if found := search("100%"); len(found) != 1 || found[0] != ids[2] {
+		t.Errorf("Expected only the line containing 100%%, got %v", found)
 	}
-
-	// Verify cascade deletion of invoice lines - only check if lines were initially created
-	if initialLineCount > 0 {
-		var lineCount int64
-		testRepo.db.Model(&InvoiceLine{}).Where("invoice_id = ?", invoice.ID).Count(&lineCount)
-		if lineCount != 0 {
-			t.Error("InvoiceLines should be cascade deleted")
-		}
+	if found := search("%"); len(found) != 1 {
+		t.Errorf("Expected %% to match literally, got %v", found)
+	}
+	if found := search("nothing like this"); len(found) != 0 {
+		t.Errorf("Expected no match, got %v", found)
 	}
 }
 
-// Error handling tests
-func TestCompanyGetInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
+func TestInvoiceStoredTotals(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "GET", "/api/companies/invalid", "")
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	invoiceJSON := fmt.Sprintf(`{
+		"penalty": 2.5,
+		"due_date": "2024-12-31T00:00:00Z",
+		"remit_information_id": %d,
+		"company_id": %d,
+		"client_id": %d,
+		"total": 1000000,
+		"invoice_lines": [{"product_id": %d, "quantity": 2}]
+	}`, remitID, companyID, companyID, productID)
+	resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceJSON)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create invoice: %v %s", err, body)
+	}
+	var invoice Invoice
+	json.Unmarshal(body, &invoice)
+	if invoice.SubTotalAmount != moneyFromFloat(199.98) || invoice.TotalAmount != moneyFromFloat(202.48) || invoice.TaxTotal != 0 {
+		t.Errorf("Expected the totals computed from the lines, got %.2f/%.2f/%.2f", invoice.SubTotalAmount, invoice.TaxTotal, invoice.TotalAmount)
 	}
-}
 
-func TestCompanyGetNotFound(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	// Repricing the product leaves the invoices billing it alone
+	product, _ := testRepo.GetProduct(productID)
+	product.Price = moneyFromFloat(10)
+	if err := testRepo.UpdateProduct(product); err != nil {
+		t.Fatalf("Failed to update product: %v", err)
+	}
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	if stored.TotalAmount != moneyFromFloat(202.48) || stored.TotalAmount != stored.Total() {
+		t.Errorf("Expected the stored total to keep the billed price, got %.2f", stored.TotalAmount)
+	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/companies/99999", "")
-	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+	stored.InvoiceLines = []InvoiceLine{{ProductID: &productID, Quantity: 5, UnitPrice: moneyFromFloat(10)}}
+	if err := testRepo.UpdateInvoice(stored); err != nil {
+		t.Fatalf("Failed to update invoice: %v", err)
+	}
+	if stored.SubTotalAmount != moneyFromFloat(50) || stored.TotalAmount != moneyFromFloat(52.5) {
+		t.Errorf("Expected the totals of the new lines, got %.2f/%.2f", stored.SubTotalAmount, stored.TotalAmount)
 	}
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	quote := Invoice{
+		Type:               DocumentQuote,
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&quote); err != nil {
+		t.Fatalf("Failed to create quote: %v", err)
+	}
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(20), Date: time.Now()}); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	resp, body, err = makeRequest(server, "GET", pathReportsInvoiceTotals+"?type=invoice", "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get invoice totals: %v", err)
+	}
+	var totals InvoiceTotals
+	json.Unmarshal(body, &totals)
+	if totals.Count != 1 || totals.SubTotal != moneyFromFloat(50) || totals.Total != moneyFromFloat(52.5) || totals.Paid != moneyFromFloat(20) {
+		t.Errorf("Unexpected invoice totals %+v", totals)
+	}
+
+	totalsAll, err := testRepo.GetInvoiceTotals(InvoiceFilter{})
+	if err != nil || totalsAll.Count != 2 || totalsAll.Total != moneyFromFloat(62.5) {
+		t.Errorf("Unexpected totals of every document %+v (%v)", totalsAll, err)
 	}
 }
 
-func TestCompanyCreateMalformedJSON(t *testing.T) {
-	server, _ := setupTestServer(t)
+func TestInvoiceDiscountTypes(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "POST", "/api/companies", `{"name": "Test", invalid json}`)
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	invoiceJSON := func(discount, discountType, lineDiscount string) string {
+		return fmt.Sprintf(`{
+			"discount": %s,
+			"discount_type": %q,
+			"penalty": 2,
+			"penalty_type": "percent",
+			"due_date": "2024-12-31T00:00:00Z",
+			"remit_information_id": %d,
+			"company_id": %d,
+			"client_id": %d,
+			"invoice_lines": [
+				{"product_id": %d, "quantity": 2, "unit_price": 100, "discount": 10, "discount_type": "percent"},
+				{"product_id": %d, "quantity": 1, "unit_price": 50, "discount": %s}
+			]
+		}`, discount, discountType, remitID, companyID, companyID, productID, productID, lineDiscount)
+	}
+
+	resp, body, _ := makeRequest(server, "POST", pathInvoices, invoiceJSON("10", "percent", "5"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create invoice: %d %s", resp.StatusCode, body)
+	}
+	var invoice Invoice
+	json.Unmarshal(body, &invoice)
+	// Lines 180 + 45, minus 10% and plus 2% of the discounted 202.50
+	if invoice.SubTotal() != moneyFromFloat(225) || invoice.DiscountAmount() != moneyFromFloat(22.5) || invoice.PenaltyAmount() != moneyFromFloat(4.05) {
+		t.Errorf("Unexpected amounts %.2f/%.2f/%.2f", invoice.SubTotal(), invoice.DiscountAmount(), invoice.PenaltyAmount())
+	}
+	if invoice.SubTotalAmount != moneyFromFloat(225) || invoice.TotalAmount != moneyFromFloat(206.55) || invoice.Total() != moneyFromFloat(206.55) {
+		t.Errorf("Expected the stored totals to follow the adjustments, got %.2f/%.2f", invoice.SubTotalAmount, invoice.TotalAmount)
+	}
+	if invoice.InvoiceLines[1].DiscountType != AdjustmentFixed {
+		t.Errorf("Expected line discounts to be fixed by default, got %q", invoice.InvoiceLines[1].DiscountType)
+	}
+
+	for name, test := range map[string]struct {
+		body   string
+		status int
+	}{
+		"percent over 100":         {invoiceJSON("101", "percent", "0"), http.StatusBadRequest},
+		"unknown type":             {invoiceJSON("1", "ratio", "0"), http.StatusBadRequest},
+		"negative discount":        {invoiceJSON("-1", "fixed", "0"), http.StatusBadRequest},
+		"discount over subtotal":   {invoiceJSON("230.01", "fixed", "0"), http.StatusUnprocessableEntity},
+		"line discount over price": {invoiceJSON("0", "fixed", "50.01"), http.StatusUnprocessableEntity},
+	} {
+		resp, body, _ := makeRequest(server, "POST", pathInvoices, test.body)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", name, test.status, resp.StatusCode, body)
+		}
+	}
+
+	converted, err := testRepo.ConvertDocument(invoice.ID, DocumentQuote)
+	if err != nil {
+		t.Fatalf("Failed to convert invoice: %v", err)
+	}
+	if converted.DiscountType != AdjustmentPercent || converted.TotalAmount != moneyFromFloat(206.55) {
+		t.Errorf("Expected the conversion to keep the adjustments, got %q %.2f", converted.DiscountType, converted.TotalAmount)
 	}
 }
 
-func TestCompanyUpdateInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
+func TestProductPriceHistory(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	companyData := `{"name": "Updated Company", "document": "987654321", "address": "Updated Address"}`
-	resp, body, err := makeRequest(server, "PUT", "/api/companies/invalid", companyData)
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 2}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if invoice.InvoiceLines[0].UnitPrice != moneyFromFloat(99.99) {
+		t.Errorf("Expected the line to capture the product price, got %.2f", invoice.InvoiceLines[0].UnitPrice)
 	}
-}
 
-func TestCompanyDeleteInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	resp, body, err := makeRequest(server, "PUT", routePath(pathProduct, productID), `{"name": "Test Product", "price": 120}`)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to update product: %v %s", err, body)
+	}
 
-	resp, body, err := makeRequest(server, "DELETE", "/api/companies/invalid", "")
-	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+	// Lines sent again without a price keep the one they were billed at
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	stored.InvoiceLines = []InvoiceLine{{ProductID: &productID, Quantity: 3}}
+	if err := testRepo.UpdateInvoice(stored); err != nil {
+		t.Fatalf("Failed to update invoice: %v", err)
+	}
+	stored, _ = testRepo.GetInvoice(invoice.ID)
+	if stored.InvoiceLines[0].UnitPrice != moneyFromFloat(99.99) || stored.TotalAmount != moneyFromFloat(299.97) {
+		t.Errorf("Expected the billed price to be kept, got %.2f/%.2f", stored.InvoiceLines[0].UnitPrice, stored.TotalAmount)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	next := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&next); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if next.TotalAmount != moneyFromFloat(120) {
+		t.Errorf("Expected new invoices to bill the new price, got %.2f", next.TotalAmount)
+	}
+
+	resp, body, err = makeRequest(server, "GET", routePath(pathProductPrices, productID), "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get price history: %v", err)
+	}
+	var prices []ProductPrice
+	json.Unmarshal(body, &prices)
+	if len(prices) != 2 || prices[0].Price != moneyFromFloat(120) || prices[1].Price != moneyFromFloat(99.99) {
+		t.Errorf("Unexpected price history %+v", prices)
+	}
+
+	resp, _, _ = makeRequest(server, "GET", routePath(pathProductPrices, 9999), "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown product, got %d", resp.StatusCode)
 	}
 }
 
-func TestProductGetInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
+func TestInvoiceUpdate(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "GET", "/api/products/invalid", "")
+	// Create prerequisite data
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	// Create test invoice
+	dueDate := time.Now().AddDate(0, 1, 0)
+	invoice := Invoice{
+		Number:             intPtr(4001),
+		Discount:           0,
+		Penalty:            0,
+		DueDate:            dueDate,
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
 	}
-}
 
-func TestProductGetNotFound(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	updateJSON := fmt.Sprintf(`{
+		"number": 4002,
+		"additional_information": "Updated invoice info",
+		"discount": 25.00,
+		"penalty": 10.00,
+		"due_date": "2025-01-31T23:59:59Z",
+		"remit_information_id": %d,
+		"company_id": %d,
+		"client_id": %d,
+		"invoice_lines": [
+			{
+				"product_id": %d,
+				"quantity": 5,
+				"description": "Updated line"
+			}
+		]
+	}`, remitID, companyID, companyID, productID)
 
-	resp, body, err := makeRequest(server, "GET", "/api/products/99999", "")
+	resp, body, err := makeRequest(server, "PUT", routePath(pathInvoice, invoice.ID), updateJSON)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to update invoice: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var updatedInvoice Invoice
+	if err := json.Unmarshal(body, &updatedInvoice); err != nil {
+		t.Fatalf("Failed to unmarshal updated invoice: %v", err)
+	}
+
+	if updatedInvoice.Number == nil || *updatedInvoice.Number != 4002 {
+		t.Error("Invoice number should be updated")
+	}
+	if updatedInvoice.Discount != moneyFromFloat(25) {
+		t.Errorf("Expected discount 25.00, got %.2f", updatedInvoice.Discount)
 	}
 }
 
-func TestProductCreateMalformedJSON(t *testing.T) {
-	server, _ := setupTestServer(t)
+func TestInvoiceDelete(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "POST", "/api/products", `{"name": "Test", invalid json}`)
+	// Create prerequisite data
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	// Create test invoice
+	dueDate := time.Now().AddDate(0, 1, 0)
+	invoice := Invoice{
+		Number:             intPtr(5001),
+		DueDate:            dueDate,
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
 	}
-}
 
-func TestRemitInformationGetInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	// Create invoice lines separately to ensure foreign key is set
+	line := InvoiceLine{
+		InvoiceID: invoice.ID,
+		ProductID: &productID,
+		Quantity:  1,
+	}
+	if err := testRepo.db.Create(&line).Error; err != nil {
+		t.Fatalf("Failed to create test invoice line: %v", err)
+	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/remit/invalid", "")
-	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+	// Verify invoice lines were created with proper foreign key
+	var initialLineCount int64
+	testRepo.db.Model(&InvoiceLine{}).Where("invoice_id = ?", invoice.ID).Count(&initialLineCount)
+	if initialLineCount == 0 {
+		t.Error("InvoiceLines should be created with the invoice")
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	resp, _, err := makeRequest(server, "DELETE", routePath(pathInvoice, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to delete invoice: %v", err)
 	}
-}
 
-func TestRemitInformationGetNotFound(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/remit/99999", "")
+	// Verify deletion by trying to fetch
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoice, invoice.ID), "")
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to verify deletion: %v", err)
 	}
 
 	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+		t.Errorf("Expected status 404 after deletion, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	// Verify cascade deletion of invoice lines - only check if lines were initially created
+	if initialLineCount > 0 {
+		var lineCount int64
+		testRepo.db.Model(&InvoiceLine{}).Where("invoice_id = ?", invoice.ID).Count(&lineCount)
+		if lineCount != 0 {
+			t.Error("InvoiceLines should be cascade deleted")
+		}
 	}
 }
 
-func TestInvoiceGetInvalidID(t *testing.T) {
-	server, _ := setupTestServer(t)
+// Payment Tests
+func TestPaymentCreateMarksInvoicePaid(t *testing.T) {
+	server, testRepo := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "GET", "/api/invoices/invalid", "")
+	companyID, productID, remitID, err := createTestData(testRepo)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create test data: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 2},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
 	}
-}
 
-func TestInvoiceGetNotFound(t *testing.T) {
-	server, _ := setupTestServer(t)
-	defer server.Close()
+	endpoint := routePath(pathInvoicePayments, invoice.ID)
+	resp, body, err := makeRequest(server, "POST", endpoint, `{"amount": 100, "reference": "partial"}`)
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	partial, _ := testRepo.GetInvoice(invoice.ID)
+	if partial.Paid {
+		t.Error("Invoice should not be paid after a partial payment")
+	}
 
-	resp, body, err := makeRequest(server, "GET", "/api/invoices/99999", "")
+	resp, body, err = makeRequest(server, "POST", endpoint, `{"amount": 99.98}`)
 	if err != nil {
-		t.Fatalf("Failed to make request: %v", err)
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
 	}
 
-	if resp.StatusCode != http.StatusNotFound {
-		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	paid, _ := testRepo.GetInvoice(invoice.ID)
+	if !paid.Paid {
+		t.Error("Invoice should be paid once payments cover the total")
+	}
+
+	resp, body, err = makeRequest(server, "GET", endpoint, "")
+	if err != nil {
+		t.Fatalf("Failed to list payments: %v", err)
+	}
+
+	var payments []Payment
+	if err := json.Unmarshal(body, &payments); err != nil {
+		t.Fatalf("Failed to unmarshal payments: %v", err)
+	}
+	if len(payments) != 2 {
+		t.Errorf("Expected 2 payments, got %d", len(payments))
 	}
 }
 
-func TestInvoiceCreateMalformedJSON(t *testing.T) {
+func TestPaymentCreateInvalidAmount(t *testing.T) {
 	server, _ := setupTestServer(t)
 	defer server.Close()
 
-	resp, body, err := makeRequest(server, "POST", "/api/invoices", `{"number": 1, invalid json}`)
+	resp, body, err := makeRequest(server, "POST", routePath(pathInvoicePayments, 1), `{"amount": 0}`)
 	if err != nil {
 		t.Fatalf("Failed to make request: %v", err)
 	}
@@ -1292,3 +1813,8182 @@ func TestInvoiceCreateMalformedJSON(t *testing.T) {
 		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
 	}
 }
+
+// Statement Tests
+func createStatementTestData(t *testing.T, testRepo *Repository) uint {
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	for i, issueDate := range []time.Time{
+		time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC),
+	} {
+		invoice := Invoice{
+			Number:             intPtr(6001 + i),
+			IssueDate:          issueDate,
+			DueDate:            issueDate.AddDate(0, 0, 30),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
+			InvoiceLines: []InvoiceLine{
+				{ProductID: &productID, Quantity: 1},
+			},
+		}
+		if err := testRepo.CreateInvoice(&invoice); err != nil {
+			t.Fatalf("Failed to create test invoice: %v", err)
+		}
+		if _, err := testRepo.SendInvoice(invoice.ID, issueDate); err != nil {
+			t.Fatalf("Failed to send test invoice: %v", err)
+		}
+
+		payment := Payment{
+			InvoiceID: invoice.ID,
+			Amount:    moneyFromFloat(50),
+			Date:      issueDate.AddDate(0, 0, 5),
+		}
+		if err := testRepo.CreatePayment(&payment); err != nil {
+			t.Fatalf("Failed to create test payment: %v", err)
+		}
+	}
+
+	return companyID
+}
+
+func TestCompanyOverview(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	issued := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	documents := []Invoice{
+		{Type: DocumentInvoice, Number: intPtr(1), IssueDate: issued, InvoiceLines: []InvoiceLine{{ProductID: &productID, Quantity: 2}}},
+		{Type: DocumentInvoice, Number: intPtr(2), IssueDate: issued.AddDate(0, 1, 0), InvoiceLines: []InvoiceLine{{ProductID: &productID, Quantity: 1}}},
+		{Type: DocumentCreditNote, Number: intPtr(3), IssueDate: issued.AddDate(0, 1, 5), InvoiceLines: []InvoiceLine{{ProductID: &productID, Quantity: 1}}},
+		{Type: DocumentQuote, Number: intPtr(4), IssueDate: issued.AddDate(0, 2, 0), InvoiceLines: []InvoiceLine{{ProductID: &productID, Quantity: 9}}},
+	}
+	for i := range documents {
+		documents[i].DueDate = documents[i].IssueDate.AddDate(0, 0, 30)
+		documents[i].RemitInformationID = remitID
+		documents[i].CompanyID = companyID
+		documents[i].ClientID = companyID
+		if err := testRepo.CreateInvoice(&documents[i]); err != nil {
+			t.Fatalf("Failed to create document: %v", err)
+		}
+	}
+	// The first invoice is settled in two payments, 10 days after being issued
+	for _, payment := range []Payment{
+		{InvoiceID: documents[0].ID, Amount: moneyFromFloat(100), Date: issued.AddDate(0, 0, 4)},
+		{InvoiceID: documents[0].ID, Amount: moneyFromFloat(99.98), Date: issued.AddDate(0, 0, 10)},
+	} {
+		if err := testRepo.CreatePayment(&payment); err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+	}
+	if err := testRepo.RecordInvoiceEvent(documents[1].ID, "reminder_sent", "Reminder sent"); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompanyOverview, companyID), "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get overview: %v %s", err, body)
+	}
+	var overview CompanyOverview
+	if err := json.Unmarshal(body, &overview); err != nil {
+		t.Fatalf("Failed to unmarshal overview: %v", err)
+	}
+
+	// Two invoices minus a credit note, the quote doesn't count
+	if revenue := moneyFromFloat(99.99) * 2; overview.LifetimeRevenue != revenue {
+		t.Errorf("Expected lifetime revenue %.2f, got %.2f", revenue, overview.LifetimeRevenue)
+	}
+	if overview.OpenBalance != 0 {
+		t.Errorf("Expected no open balance, got %.2f", overview.OpenBalance)
+	}
+	if overview.Invoices != 4 || overview.UnpaidInvoices != 1 {
+		t.Errorf("Expected 4 documents and 1 unpaid invoice, got %d and %d", overview.Invoices, overview.UnpaidInvoices)
+	}
+	if overview.AverageDaysToPay == nil || *overview.AverageDaysToPay != 10 {
+		t.Errorf("Expected 10 days to pay, got %v", overview.AverageDaysToPay)
+	}
+	if overview.LastInvoiceDate == nil || !overview.LastInvoiceDate.Equal(issued.AddDate(0, 2, 0)) {
+		t.Errorf("Expected the quote as last document, got %v", overview.LastInvoiceDate)
+	}
+	if overview.LastContactDate == nil || time.Since(*overview.LastContactDate) > time.Minute {
+		t.Errorf("Expected the reminder as last contact, got %v", overview.LastContactDate)
+	}
+	if len(overview.RecentActivity) != 7 || overview.RecentActivity[0].Type != "reminder_sent" {
+		t.Errorf("Unexpected recent activity %+v", overview.RecentActivity)
+	}
+
+	resp, body, err = makeRequest(server, "GET", routePath(pathCompanyOverview, companyID)+"?format=html", "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to render overview: %v %s", err, body)
+	}
+	if !strings.Contains(string(body), "Average days to pay") || !strings.Contains(string(body), "10.0") {
+		t.Errorf("Expected the KPIs in the overview page, got %s", body)
+	}
+
+	resp, _, err = makeRequest(server, "GET", routePath(pathCompanyOverview, 999), "")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown company, got %v", err)
+	}
+}
+
+func TestStatementGet(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID := createStatementTestData(t, testRepo)
+	// Drafts aren't owed yet, they stay off the statement
+	if _, err := NewFactory(testRepo).Invoice(InvoiceDraft, func(i *Invoice) { i.ClientID = companyID }); err != nil {
+		t.Fatalf("Failed to create draft: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompanyStatement, companyID), "")
+	if err != nil {
+		t.Fatalf("Failed to get statement: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var statement Statement
+	if err := json.Unmarshal(body, &statement); err != nil {
+		t.Fatalf("Failed to unmarshal statement: %v", err)
+	}
+
+	if len(statement.Entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(statement.Entries))
+	}
+	expectedBalances := []float64{99.99, 49.99, 149.98, 99.98}
+	for i, entry := range statement.Entries {
+		if fmt.Sprintf("%.2f", entry.Balance) != fmt.Sprintf("%.2f", expectedBalances[i]) {
+			t.Errorf("Entry %d: expected balance %.2f, got %.2f", i, expectedBalances[i], entry.Balance)
+		}
+	}
+	if fmt.Sprintf("%.2f", statement.ClosingBalance) != "99.98" {
+		t.Errorf("Expected closing balance 99.98, got %.2f", statement.ClosingBalance)
+	}
+}
+
+func TestStatementGetPeriod(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID := createStatementTestData(t, testRepo)
+
+	endpoint := routePath(pathCompanyStatement, companyID) + "?from=2024-02-01&to=2024-02-10"
+	resp, body, err := makeRequest(server, "GET", endpoint, "")
+	if err != nil {
+		t.Fatalf("Failed to get statement: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var statement Statement
+	if err := json.Unmarshal(body, &statement); err != nil {
+		t.Fatalf("Failed to unmarshal statement: %v", err)
+	}
+
+	if fmt.Sprintf("%.2f", statement.OpeningBalance) != "49.99" {
+		t.Errorf("Expected opening balance 49.99, got %.2f", statement.OpeningBalance)
+	}
+	if len(statement.Entries) != 1 || statement.Entries[0].Type != "invoice" {
+		t.Errorf("Expected only the February invoice, got %+v", statement.Entries)
+	}
+}
+
+func TestStatementGetInvalidDate(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompanyStatement, 1)+"?from=01/02/2024", "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestStatementPDF(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID := createStatementTestData(t, testRepo)
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompanyStatement, companyID)+"?format=pdf", "")
+	if err != nil {
+		t.Fatalf("Failed to get statement: %v", err)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("Expected application/pdf, got %s", resp.Header.Get("Content-Type"))
+	}
+	if !bytes.HasPrefix(body, []byte("%PDF-")) {
+		t.Error("Response should be a PDF document")
+	}
+}
+
+func TestStatementEmail(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	companyID := createStatementTestData(t, testRepo)
+	endpoint := routePath(pathCompanyStatementEmail, companyID)
+
+	resp, body, err := makeRequest(server, "POST", endpoint, "")
+	if err != nil {
+		t.Fatalf("Failed to email statement: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without an email address, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body, err = makeRequest(server, "POST", endpoint, `{"to": "billing@example.com"}`)
+	if err != nil {
+		t.Fatalf("Failed to email statement: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	if len(fake.sent) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(fake.sent))
+	}
+	if fake.sent[0].To[0] != "billing@example.com" {
+		t.Errorf("Expected recipient billing@example.com, got %v", fake.sent[0].To)
+	}
+	if len(fake.sent[0].Attachments) != 1 {
+		t.Error("Statement PDF should be attached")
+	}
+}
+
+func TestClientArchive(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	originalDir := config.AttachmentsDir
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() { config.AttachmentsDir = originalDir })
+
+	companyID := createStatementTestData(t, testRepo)
+	if _, err := testRepo.CreateAttachment(&companyID, "contract.txt", "text/plain", []byte("signed")); err != nil {
+		t.Fatalf("Failed to create attachment: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompanyArchive, companyID), "")
+	if err != nil {
+		t.Fatalf("Failed to get archive: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip, got %d %s. Response: %s", resp.StatusCode, resp.Header.Get("Content-Type"), string(body))
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	files := map[string]*zip.File{}
+	pdfs := 0
+	for _, file := range archive.File {
+		files[file.Name] = file
+		if strings.HasPrefix(file.Name, "invoices/") && strings.HasSuffix(file.Name, ".pdf") {
+			pdfs++
+		}
+	}
+	for _, name := range []string{"company.json", "statement.json", "statement.pdf", "invoices.json", "payments.json", "notes.json", "emails.json"} {
+		if files[name] == nil {
+			t.Errorf("Expected %s in the archive", name)
+		}
+	}
+	if pdfs != 2 {
+		t.Errorf("Expected a PDF per invoice, got %d", pdfs)
+	}
+
+	var attachment *zip.File
+	for name, file := range files {
+		if strings.HasPrefix(name, "attachments/") && strings.HasSuffix(name, "_contract.txt") {
+			attachment = file
+		}
+	}
+	if attachment == nil {
+		t.Fatal("Expected the attachment in the archive")
+	}
+	reader, _ := attachment.Open()
+	data, _ := io.ReadAll(reader)
+	if string(data) != "signed" {
+		t.Errorf("Expected the attachment content, got %q", data)
+	}
+
+	resp, _, _ = makeRequest(server, "GET", routePath(pathCompanyArchive, 99999), "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown company, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientEmailCopies(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	originalSMTP := config.SMTP
+	config.SMTP.Cc = []string{"accountant@example.com"}
+	config.SMTP.ReplyTo = "billing@example.com"
+	t.Cleanup(func() { config.SMTP = originalSMTP })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	companyPath := routePath(pathCompany, companyID)
+
+	resp, body, err := makeRequest(server, "PUT", companyPath,
+		`{"name": "Client", "document": "1", "address": "Street", "email": "client@example.com", "email_cc": "not an address"}`)
+	if err != nil {
+		t.Fatalf("Failed to update company: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid copy address, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body, err = makeRequest(server, "PUT", companyPath,
+		`{"name": "Client", "document": "1", "address": "Street", "email": "client@example.com",
+		  "email_cc": "Boss <boss@client.example>", "email_bcc": "archive@example.com", "email_reply_to": "sales@example.com"}`)
+	if err != nil {
+		t.Fatalf("Failed to update company: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var company Company
+	json.Unmarshal(body, &company)
+	if company.EmailCc != "boss@client.example" {
+		t.Errorf("Expected the copy list to be normalized, got %q", company.EmailCc)
+	}
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 0, -1),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	makeRequest(server, "POST", pathRemindersSend, "")
+	if len(fake.sent) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(fake.sent))
+	}
+	email := fake.sent[0]
+	if fmt.Sprint(email.Cc) != "[accountant@example.com boss@client.example]" {
+		t.Errorf("Expected the global and client copies, got %v", email.Cc)
+	}
+	if fmt.Sprint(email.Bcc) != "[archive@example.com]" {
+		t.Errorf("Expected the client blind copy, got %v", email.Bcc)
+	}
+	if email.ReplyTo != "sales@example.com" {
+		t.Errorf("The client reply-to should win over the global one, got %q", email.ReplyTo)
+	}
+	if len(email.Recipients()) != 4 {
+		t.Errorf("Expected 4 recipients, got %v", email.Recipients())
+	}
+
+	message, err := buildMIMEMessage("us@example.com", email)
+	if err != nil {
+		t.Fatalf("Failed to build message: %v", err)
+	}
+	if !strings.Contains(string(message), "Cc: accountant@example.com, boss@client.example\r\n") ||
+		!strings.Contains(string(message), "Reply-To: sales@example.com\r\n") {
+		t.Errorf("Copies and reply-to should be in the headers:\n%s", message)
+	}
+	if strings.Contains(string(message), "archive@example.com") {
+		t.Error("Blind copies must not appear in the message")
+	}
+
+	resp, body, err = makeRequest(server, "GET", routePath(pathInvoiceEmails, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get emails: %v", err)
+	}
+	var messages []EmailMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		t.Fatalf("Failed to unmarshal emails: %v", err)
+	}
+	if len(messages) != 1 || messages[0].To != "client@example.com" || messages[0].Bcc != "archive@example.com" || messages[0].ReplyTo != "sales@example.com" {
+		t.Errorf("Expected the reminder to be recorded with its recipients, got %+v", messages)
+	}
+}
+
+// Unit of work Tests
+func TestUnitOfWorkRollsBackOnError(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	handler := testRepo.UnitOfWork(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		company := Company{Name: "Rolled Back", Document: "1", Address: "Nowhere"}
+		if err := testRepo.WithContext(r.Context()).CreateCompany(&company); err != nil {
+			t.Fatalf("Failed to create company: %v", err)
+		}
+		http.Error(w, "something failed after the write", http.StatusInternalServerError)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", pathRoot, nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", recorder.Code)
+	}
+
+	companies, err := testRepo.GetCompanies(CompanyFilter{})
+	if err != nil {
+		t.Fatalf("Failed to list companies: %v", err)
+	}
+	if len(companies) != 0 {
+		t.Errorf("Expected the write to be rolled back, found %d companies", len(companies))
+	}
+}
+
+func TestUnitOfWorkCommitsOnSuccess(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	handler := testRepo.UnitOfWork(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		company := Company{Name: "Committed", Document: "1", Address: "Somewhere"}
+		if err := testRepo.WithContext(r.Context()).CreateCompany(&company); err != nil {
+			t.Fatalf("Failed to create company: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", pathRoot, nil))
+
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d", recorder.Code)
+	}
+
+	companies, err := testRepo.GetCompanies(CompanyFilter{})
+	if err != nil {
+		t.Fatalf("Failed to list companies: %v", err)
+	}
+	if len(companies) != 1 {
+		t.Errorf("Expected the write to be committed, found %d companies", len(companies))
+	}
+}
+
+// Shared invoice link Tests
+func TestSharedInvoiceLink(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	invoice := Invoice{
+		Number:             intPtr(7001),
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	originalBaseURL := config.BaseURL
+	config.BaseURL = "https://crm.example.com"
+	t.Cleanup(func() { config.BaseURL = originalBaseURL })
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoiceShare, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get share link: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var link struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(body, &link); err != nil {
+		t.Fatalf("Failed to unmarshal share link: %v", err)
+	}
+
+	// The link points at the configured base URL, whatever host was asked
+	path, ok := strings.CutPrefix(link.URL, "https://crm.example.com")
+	if !ok {
+		t.Fatalf("Expected the link on the base URL, got %s", link.URL)
+	}
+	resp, body, err = makeRequest(server, "GET", path, "")
+	if err != nil {
+		t.Fatalf("Failed to open shared invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if !bytes.Contains(body, []byte("7001")) {
+		t.Error("Shared invoice should render the invoice number")
+	}
+
+	// The template can't be picked on a shared link, and viewing it
+	// records no template version
+	resp, _, _ = makeRequest(server, "GET", path+"&template=missing.html", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the template of the query ignored, got %d", resp.StatusCode)
+	}
+	var versions int64
+	testRepo.db.Model(&TemplateVersion{}).Count(&versions)
+	if versions != 0 {
+		t.Errorf("Expected no template version recorded by shared links, got %d", versions)
+	}
+
+	resp, _, err = makeRequest(server, "GET", routePath(pathSharedInvoice, invoice.UUID.String())+"?sig=forged", "")
+	if err != nil {
+		t.Fatalf("Failed to open shared invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a forged signature, got %d", resp.StatusCode)
+	}
+}
+
+// Busy retry Tests
+func TestRetryOnBusyRetriesLockedWrites(t *testing.T) {
+	attempts := 0
+	err := retryOnBusy(func() error {
+		attempts++
+		if attempts < 3 {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("Expected the write to succeed after retrying, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryOnBusyGivesUp(t *testing.T) {
+	attempts := 0
+	err := retryOnBusy(func() error {
+		attempts++
+		return sqlite3.Error{Code: sqlite3.ErrLocked}
+	})
+
+	if !isBusyError(err) {
+		t.Errorf("Expected the busy error to be returned, got %v", err)
+	}
+	if attempts != busyRetryAttempts {
+		t.Errorf("Expected %d attempts, got %d", busyRetryAttempts, attempts)
+	}
+}
+
+func TestRetryOnBusyIgnoresOtherErrors(t *testing.T) {
+	attempts := 0
+	retryOnBusy(func() error {
+		attempts++
+		return gorm.ErrRecordNotFound
+	})
+
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt for non-busy errors, got %d", attempts)
+	}
+}
+
+// Document type Tests
+func TestDocumentConvertQuoteToInvoice(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	quote := Invoice{
+		Type:               DocumentQuote,
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 3},
+		},
+	}
+	if err := testRepo.CreateInvoice(&quote); err != nil {
+		t.Fatalf("Failed to create test quote: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathInvoicePayments, quote.ID), `{"amount": 10}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 when paying a quote, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body, err = makeRequest(server, "POST", routePath(pathInvoiceConvert, quote.ID), `{"type": "invoice"}`)
+	if err != nil {
+		t.Fatalf("Failed to convert quote: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var converted Invoice
+	if err := json.Unmarshal(body, &converted); err != nil {
+		t.Fatalf("Failed to unmarshal converted invoice: %v", err)
+	}
+	if converted.Type != DocumentInvoice {
+		t.Errorf("Expected type invoice, got %s", converted.Type)
+	}
+	if converted.ID == quote.ID || converted.UUID == quote.UUID {
+		t.Error("Conversion should create a new document")
+	}
+	if len(converted.InvoiceLines) != 1 || converted.InvoiceLines[0].Quantity != 3 {
+		t.Error("Lines should be copied to the converted document")
+	}
+}
+
+func TestInvoiceListByType(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, _, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	for _, documentType := range []DocumentType{DocumentInvoice, DocumentQuote, DocumentCreditNote} {
+		document := Invoice{
+			Type:               documentType,
+			DueDate:            time.Now().AddDate(0, 1, 0),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
+		}
+		if err := testRepo.CreateInvoice(&document); err != nil {
+			t.Fatalf("Failed to create test document: %v", err)
+		}
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathInvoices+"?type=quote", "")
+	if err != nil {
+		t.Fatalf("Failed to list invoices: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var documents []Invoice
+	if err := json.Unmarshal(body, &documents); err != nil {
+		t.Fatalf("Failed to unmarshal invoices: %v", err)
+	}
+	if len(documents) != 1 || documents[0].Type != DocumentQuote {
+		t.Errorf("Expected only the quote, got %+v", documents)
+	}
+
+	resp, _, err = makeRequest(server, "GET", pathInvoices+"?type=bogus", "")
+	if err != nil {
+		t.Fatalf("Failed to list invoices: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown type, got %d", resp.StatusCode)
+	}
+}
+
+// i18n Tests
+func TestLocaleFormatting(t *testing.T) {
+	tests := []struct {
+		locale   Locale
+		amount   float64
+		expected string
+	}{
+		{LocalePtBR, 1234.5, "R$ 1.234,50"},
+		{LocaleEn, 1234567.891, "$ 1,234,567.89"},
+		{LocaleEs, -99.99, "€ -99,99"},
+		{LocaleEn, 0, "$ 0.00"},
+	}
+
+	for _, test := range tests {
+		if got := test.locale.FormatMoney(moneyFromFloat(test.amount)); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.locale, test.expected, got)
+		}
+	}
+}
+
+func TestMoneyInWords(t *testing.T) {
+	tests := []struct {
+		locale   Locale
+		amount   float64
+		expected string
+	}{
+		{LocalePtBR, 1234.56, "mil duzentos e trinta e quatro reais e cinquenta e seis centavos"},
+		{LocalePtBR, 1, "um real"},
+		{LocalePtBR, 0.01, "um centavo"},
+		{LocalePtBR, 0, "zero reais"},
+		{LocalePtBR, 100, "cem reais"},
+		{LocalePtBR, 1200, "mil e duzentos reais"},
+		{LocalePtBR, 2021.1, "dois mil e vinte e um reais e dez centavos"},
+		{LocalePtBR, 115000, "cento e quinze mil reais"},
+		{LocalePtBR, 1000000, "um milhão de reais"},
+		{LocalePtBR, 2500000.5, "dois milhões e quinhentos mil reais e cinquenta centavos"},
+		{LocalePtBR, 1000115, "um milhão cento e quinze reais"},
+		{LocalePtBR, -17, "menos dezessete reais"},
+		{LocaleEn, 1234.56, "one thousand two hundred thirty-four dollars and fifty-six cents"},
+		{LocaleEn, 1, "one dollar"},
+		{LocaleEn, 0.99, "ninety-nine cents"},
+		{LocaleEn, 3000000, "three million dollars"},
+		{LocaleEs, 10, ""},
+	}
+
+	for _, test := range tests {
+		if got := test.locale.MoneyInWords(moneyFromFloat(test.amount)); got != test.expected {
+			t.Errorf("%s %.2f: expected %q, got %q", test.locale, test.amount, test.expected, got)
+		}
+	}
+}
+
+func TestInvoiceEffectiveLocale(t *testing.T) {
+	invoice := Invoice{DueDate: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	if invoice.DueMonth() != "Março" {
+		t.Errorf("Expected the default Portuguese month, got %s", invoice.DueMonth())
+	}
+
+	invoice.Client.Locale = LocaleEs
+	if invoice.DueMonth() != "Marzo" {
+		t.Errorf("Expected the client locale month, got %s", invoice.DueMonth())
+	}
+
+	invoice.Locale = LocaleEn
+	if invoice.DueMonth() != "March" {
+		t.Errorf("Expected the invoice locale to win, got %s", invoice.DueMonth())
+	}
+	if invoice.T("due_date") != "Due Date" {
+		t.Errorf("Expected translated label, got %s", invoice.T("due_date"))
+	}
+}
+
+func TestInvoiceOpenLocalizedTemplate(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	invoice := Invoice{
+		Locale:             LocaleEs,
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoiceOpen, invoice.ID)+"?template=localized_invoice.html", "")
+	if err != nil {
+		t.Fatalf("Failed to open invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if !bytes.Contains(body, []byte("Vencimiento")) || !bytes.Contains(body, []byte("€ 99,99")) {
+		t.Error("Invoice should be rendered in Spanish")
+	}
+}
+
+func TestInvoiceCreateUnsupportedLocale(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "POST", pathInvoices, `{"locale": "klingon"}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+// Invoice template Tests
+func TestInvoiceTemplatePreview(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	templateJSON := `{
+		"name": "Branded",
+		"logo_url": "https://example.com/logo.png",
+		"color": "#123abc",
+		"footer_text": "Thank you for your business",
+		"payment_instructions": "Pay by bank transfer within 30 days",
+		"is_default": true
+	}`
+	resp, body, err := makeRequest(server, "POST", routePath(pathCompanyInvoiceTemplates, companyID), templateJSON)
+	if err != nil {
+		t.Fatalf("Failed to create invoice template: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var invoiceTemplate InvoiceTemplate
+	if err := json.Unmarshal(body, &invoiceTemplate); err != nil {
+		t.Fatalf("Failed to unmarshal invoice template: %v", err)
+	}
+	if invoiceTemplate.BaseTemplate != "localized_invoice.html" {
+		t.Errorf("Expected the localized base template by default, got %s", invoiceTemplate.BaseTemplate)
+	}
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	resp, body, err = makeRequest(server, "GET", routePath(pathInvoicePreview, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to preview invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	for _, expected := range []string{"https://example.com/logo.png", "#123abc", "Thank you for your business", "Pay by bank transfer"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("Preview should contain %q", expected)
+		}
+	}
+
+	other := Company{Name: "Other Issuer", Document: "99", Address: "Elsewhere"}
+	testRepo.CreateCompany(&other)
+	otherTemplate := InvoiceTemplate{CompanyID: other.ID, Name: "Theirs", BaseTemplate: "localized_invoice.html"}
+	testRepo.SaveInvoiceTemplate(&otherTemplate)
+	resp, body, _ = makeRequest(server, "GET", routePath(pathInvoicePreview, invoice.ID)+fmt.Sprintf("?template=%d", otherTemplate.ID), "")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the template of another company refused, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestInvoiceTemplateInvalidColor(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathCompanyInvoiceTemplates, 1), `{"name": "Bad", "color": "red"}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+// Reminder Tests
+func TestInvoiceReminderDue(t *testing.T) {
+	dueDate := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	invoice := Invoice{Type: DocumentInvoice, DueDate: dueDate}
+
+	if _, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, -5)); ok {
+		t.Error("No reminder should be due before the first step")
+	}
+
+	step, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, 2))
+	if !ok || !step.Equal(dueDate.AddDate(0, 0, 1)) {
+		t.Errorf("Expected the day-after-due step, got %v %v", step, ok)
+	}
+
+	sentAt := dueDate.AddDate(0, 0, 2)
+	invoice.LastReminderAt = &sentAt
+	if _, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, 3)); ok {
+		t.Error("A step should only be reminded once")
+	}
+	if _, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, 8)); !ok {
+		t.Error("The next step should be due")
+	}
+
+	snoozedUntil := dueDate.AddDate(0, 0, 20)
+	invoice.RemindersSnoozedUntil = &snoozedUntil
+	if _, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, 16)); ok {
+		t.Error("Snoozed invoices should not be reminded")
+	}
+
+	invoice.RemindersSnoozedUntil = nil
+	invoice.ReminderDays = ReminderDays{}
+	if _, ok := invoice.ReminderDue(dueDate.AddDate(0, 0, 16)); ok {
+		t.Error("An empty schedule should disable reminders")
+	}
+}
+
+func TestRemindersSnoozeAndSend(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("email", "client@example.com")
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 0, -2),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	until := time.Now().AddDate(0, 0, 3).Format("2006-01-02")
+	resp, body, err := makeRequest(server, "POST", routePath(pathInvoiceRemindersSnooze, invoice.ID), `{"until": "`+until+`", "note": "client promised payment Friday"}`)
+	if err != nil {
+		t.Fatalf("Failed to snooze reminders: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	makeRequest(server, "POST", pathRemindersSend, "")
+	if len(fake.sent) != 0 {
+		t.Errorf("Snoozed invoices should not be reminded, sent %d emails", len(fake.sent))
+	}
+
+	makeRequest(server, "DELETE", routePath(pathInvoiceRemindersSnooze, invoice.ID), "")
+	resp, body, err = makeRequest(server, "POST", pathRemindersSend, "")
+	if err != nil {
+		t.Fatalf("Failed to send reminders: %v", err)
+	}
+
+	var results []ReminderResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("Failed to unmarshal reminder results: %v", err)
+	}
+	if len(results) != 1 || !results[0].Sent || len(fake.sent) != 1 {
+		t.Errorf("Expected one reminder to be sent, got %+v", results)
+	}
+
+	makeRequest(server, "POST", pathRemindersSend, "")
+	if len(fake.sent) != 1 {
+		t.Errorf("The same step should not be reminded twice, sent %d emails", len(fake.sent))
+	}
+
+	resp, body, err = makeRequest(server, "GET", routePath(pathInvoiceTimeline, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get timeline: %v", err)
+	}
+
+	var events []InvoiceEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		t.Fatalf("Failed to unmarshal timeline: %v", err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	if fmt.Sprint(types) != "[reminders_snoozed reminders_resumed reminder_sent]" {
+		t.Errorf("Unexpected timeline %v", types)
+	}
+}
+
+func TestLateCharges(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	originalLateFees := config.LateFees
+	config.LateFees = LateFeesConfig{PenaltyPercent: 2, MonthlyInterestPercent: 1}
+	t.Cleanup(func() { config.LateFees = originalLateFees })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("email", "client@example.com")
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 0, -45),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	if _, err := testRepo.SendInvoice(invoice.ID, time.Now()); err != nil {
+		t.Fatalf("Failed to send test invoice: %v", err)
+	}
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(49.99), Date: time.Now()}); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	_, body, err := makeRequest(server, "GET", routePath(pathInvoice, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get invoice: %v", err)
+	}
+	var fetched Invoice
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		t.Fatalf("Failed to unmarshal invoice: %v", err)
+	}
+	charges := fetched.LateCharges
+	if charges == nil {
+		t.Fatalf("Expected late charges on an overdue invoice, got %s", body)
+	}
+	// 2% of the 50.00 outstanding, plus 1% a month for 45 days
+	if charges.DaysOverdue != 45 || charges.Outstanding != moneyFromFloat(50) || charges.Penalty != moneyFromFloat(1) || charges.Interest != moneyFromFloat(0.75) || charges.AmountDue != moneyFromFloat(51.75) {
+		t.Errorf("Unexpected late charges %+v", charges)
+	}
+
+	_, body, _ = makeRequest(server, "GET", routePath(pathCompanyStatement, companyID), "")
+	var statement Statement
+	json.Unmarshal(body, &statement)
+	if statement.LateCharges != moneyFromFloat(1.75) || statement.AmountDue != moneyFromFloat(51.75) {
+		t.Errorf("Expected the statement to show 1.75 of late charges and 51.75 due, got %.2f and %.2f", statement.LateCharges, statement.AmountDue)
+	}
+
+	makeRequest(server, "POST", pathRemindersSend, "")
+	if len(fake.sent) != 1 {
+		t.Fatalf("Expected 1 reminder, got %d", len(fake.sent))
+	}
+	if !strings.Contains(fake.sent[0].Body, "the amount due is R$ 51,75") {
+		t.Errorf("Expected the reminder to state the amount due:\n%s", fake.sent[0].Body)
+	}
+
+	config.LateFees = LateFeesConfig{}
+	if charges := config.LateFees.charges(&fetched, fetched.Total(), moneyFromFloat(49.99), time.Now()); charges != nil {
+		t.Errorf("Nothing should be charged without late fees configured, got %+v", charges)
+	}
+}
+
+func TestReminderScheduleOverride(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, _, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "PUT", routePath(pathInvoiceRemindersSchedule, invoice.ID), `{"days": [2, 5]}`)
+	if err != nil {
+		t.Fatalf("Failed to set reminder schedule: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	updated, err := testRepo.GetInvoice(invoice.ID)
+	if err != nil {
+		t.Fatalf("Failed to get invoice: %v", err)
+	}
+	if fmt.Sprint(updated.ReminderSchedule()) != "[2 5]" {
+		t.Errorf("Expected schedule [2 5], got %v", updated.ReminderSchedule())
+	}
+}
+
+// Survey Tests
+func TestProjectBudgetAlert(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	config.NotifyEmail = "owner@example.com"
+	t.Cleanup(func() { config.NotifyEmail = "" })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", pathProjects, fmt.Sprintf(`{"company_id": %d, "name": "Website", "budget": 200}`, companyID))
+	if err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var project Project
+	json.Unmarshal(body, &project)
+
+	invoiceData := fmt.Sprintf(`{"due_date": "2030-01-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d, "project_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, project.ID, productID)
+	var invoiceIDs []string
+	for i := 0; i < 3; i++ {
+		resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceData)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create invoice: %v %s", err, body)
+		}
+		var invoice Invoice
+		json.Unmarshal(body, &invoice)
+		invoiceIDs = append(invoiceIDs, strconv.Itoa(int(invoice.ID)))
+
+		if i == 0 && len(fake.sent) != 0 {
+			t.Errorf("No alert expected under 80%% of the budget, sent %d", len(fake.sent))
+		}
+	}
+	if len(fake.sent) != 1 || fake.sent[0].To[0] != "owner@example.com" {
+		t.Fatalf("Expected one budget alert, got %d emails", len(fake.sent))
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathProjects+"?budget_alert=true", "")
+	var flagged []map[string]interface{}
+	json.Unmarshal(body, &flagged)
+	if len(flagged) != 1 || flagged[0]["billed"] != 299.97 || flagged[0]["budget_alert"] != true {
+		t.Errorf("Expected the project to be flagged, got %s", body)
+	}
+
+	for _, id := range invoiceIDs[1:] {
+		makeRequest(server, "DELETE", routePath(pathInvoice, id), "")
+	}
+	reloaded, err := testRepo.GetProject(project.ID)
+	if err != nil {
+		t.Fatalf("Failed to get project: %v", err)
+	}
+	if reloaded.BudgetAlert() || reloaded.BudgetAlertedAt != nil {
+		t.Errorf("The alert should be re-armed once under the budget percentage, got %+v", reloaded)
+	}
+
+	resp, body, _ = makeRequest(server, "PUT", routePath(pathProject, project.ID),
+		fmt.Sprintf(`{"company_id": %d, "name": "Website", "budget": 200, "budget_alert_percent": 40}`, companyID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if len(fake.sent) != 2 {
+		t.Errorf("Lowering the alert percentage should alert again, sent %d emails", len(fake.sent))
+	}
+}
+
+func TestProjectProfitability(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", pathProjects, fmt.Sprintf(`{"company_id": %d, "name": "Website", "status": "paused"}`, companyID))
+	if err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown status, got %d", resp.StatusCode)
+	}
+
+	_, body, _ = makeRequest(server, "POST", pathProjects, fmt.Sprintf(`{"company_id": %d, "name": "Website"}`, companyID))
+	var project Project
+	json.Unmarshal(body, &project)
+	if project.Status != ProjectActive {
+		t.Errorf("Expected a new project to be active, got %q", project.Status)
+	}
+	projectPath := routePath(pathProject, project.ID)
+
+	resp, body, err = makeRequest(server, "POST", routePath(pathProjectTasks, project.ID), `{"name": "Design"}`)
+	if err != nil {
+		t.Fatalf("Failed to create task: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var task Task
+	json.Unmarshal(body, &task)
+
+	for _, entry := range []string{
+		fmt.Sprintf(`{"task_id": %d, "hours": 1.5, "hourly_cost": 20, "date": "2024-03-01T00:00:00Z"}`, task.ID),
+		`{"hours": 0.5, "hourly_cost": 30, "date": "2024-03-02T00:00:00Z"}`,
+	} {
+		resp, body, err := makeRequest(server, "POST", routePath(pathProjectTimeEntries, project.ID), entry)
+		if err != nil {
+			t.Fatalf("Failed to create time entry: %v", err)
+		}
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+	}
+
+	invoiceData := fmt.Sprintf(`{"issue_date": "2024-03-05T00:00:00Z", "due_date": "2024-04-05T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d, "project_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, project.ID, productID)
+	if resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceData); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create invoice: %v %s", err, body)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathReportsProjectProfitability+"?from=2024-03-01&to=2024-03-31", "")
+	var report []ProjectProfitability
+	json.Unmarshal(body, &report)
+	if len(report) != 1 {
+		t.Fatalf("Expected one project in the report, got %s", body)
+	}
+	line := report[0]
+	if line.Billed != moneyFromFloat(99.99) || line.Hours != 2 || line.Cost != 4500 || line.Margin != moneyFromFloat(54.99) {
+		t.Errorf("Unexpected profitability %+v", line)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathReportsProjectProfitability+"?from=2024-04-01", "")
+	json.Unmarshal(body, &report)
+	if len(report) != 1 || report[0].Billed != 0 || report[0].Cost != 0 || report[0].MarginPercent != nil {
+		t.Errorf("Expected nothing in the period, got %s", body)
+	}
+
+	makeRequest(server, "DELETE", routePath(pathTask, task.ID), "")
+	entries, err := testRepo.GetTimeEntries(project.ID)
+	if err != nil || len(entries) != 2 || entries[0].TaskID != nil {
+		t.Errorf("Deleting the task should keep its time, got %+v %v", entries, err)
+	}
+
+	makeRequest(server, "DELETE", projectPath, "")
+	if entries, _ := testRepo.GetTimeEntries(project.ID); len(entries) != 0 {
+		t.Errorf("Deleting the project should delete its time, got %d entries", len(entries))
+	}
+}
+
+func TestInvoiceNumberingOnSend(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	config.InvoiceNumbering = NumberingOnSend
+	t.Cleanup(func() { config.InvoiceNumbering = NumberingManual })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	invoiceData := fmt.Sprintf(`{"number": 42, "due_date": "2030-01-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, productID)
+	var drafts []Invoice
+	for i := 0; i < 3; i++ {
+		resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceData)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create invoice: %v %s", err, body)
+		}
+		var draft Invoice
+		json.Unmarshal(body, &draft)
+		if !draft.Draft() || (draft.Number != nil && *draft.Number != 0) {
+			t.Errorf("Expected an unnumbered draft, got number %v sent at %v", draft.Number, draft.SentAt)
+		}
+		if draft.Identification() != draft.UUID.String() {
+			t.Errorf("Expected the draft to be identified by its UUID, got %s", draft.Identification())
+		}
+		drafts = append(drafts, draft)
+	}
+
+	// The abandoned draft doesn't burn a number
+	resp, body, _ := makeRequest(server, "DELETE", routePath(pathInvoice, drafts[0].ID), "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 deleting a draft, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	for i, draft := range drafts[1:] {
+		resp, body, err := makeRequest(server, "POST", routePath(pathInvoiceSend, draft.ID), "")
+		if err != nil {
+			t.Fatalf("Failed to send invoice: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var sent Invoice
+		json.Unmarshal(body, &sent)
+		if sent.Number == nil || *sent.Number != i+1 || sent.SentAt == nil {
+			t.Errorf("Expected number %d once sent, got %v", i+1, sent.Number)
+		}
+	}
+
+	sentPath := routePath(pathInvoice, drafts[1].ID)
+	resp, _, _ = makeRequest(server, "POST", routePath(pathInvoiceSend, drafts[1].ID), "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 sending twice, got %d", resp.StatusCode)
+	}
+
+	resp, body, _ = makeRequest(server, "PUT", sentPath+"?override=true", strings.Replace(invoiceData, `"number": 42`, `"number": 7`, 1))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var updated Invoice
+	json.Unmarshal(body, &updated)
+	if updated.Number == nil || *updated.Number != 1 || updated.SentAt == nil {
+		t.Errorf("Updating should keep the number given when sent, got %v", updated.Number)
+	}
+
+	resp, _, _ = makeRequest(server, "DELETE", sentPath, "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 deleting a sent invoice, got %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signIDToken := func(claims map[string]interface{}) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`))
+		payload, _ := json.Marshal(claims)
+		signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	// A provider issuing the claims of the test for any code
+	var claims map[string]interface{}
+	provider := http.NewServeMux()
+	idp := httptest.NewServer(provider)
+	defer idp.Close()
+	provider.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	provider.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test", "kty": "RSA", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	provider.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if client, secret, _ := r.BasicAuth(); client != "tinycrm" || secret != "s3cret" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signIDToken(claims)})
+	})
+
+	previous := config.OIDC
+	config.OIDC = OIDCConfig{DiscoveryURL: idp.URL + "/.well-known/openid-configuration", ClientID: "tinycrm", ClientSecret: "s3cret"}
+	t.Cleanup(func() { config.OIDC = previous })
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	cookieOf := func(recorder *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, cookie := range recorder.Result().Cookies() {
+			if cookie.Name == name {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	if resp := request(pathRoot); resp.Code != http.StatusFound || resp.Header().Get("Location") != pathAuthLogin {
+		t.Errorf("Expected the dashboard to redirect to the sign in, got %d %s", resp.Code, resp.Header().Get("Location"))
+	}
+
+	// signIn goes through the flow with the given claims, the nonce being
+	// the one sent to the provider
+	signIn := func(subject, email string) *httptest.ResponseRecorder {
+		login := request(pathAuthLogin)
+		authorize, err := url.Parse(login.Header().Get("Location"))
+		if login.Code != http.StatusFound || err != nil || !strings.HasPrefix(authorize.String(), idp.URL+"/authorize?") {
+			t.Fatalf("Expected a redirect to the provider, got %d %s", login.Code, login.Header().Get("Location"))
+		}
+		query := authorize.Query()
+		if query.Get("client_id") != "tinycrm" || query.Get("code_challenge_method") != "S256" {
+			t.Errorf("Unexpected authorization request %s", authorize)
+		}
+		claims = map[string]interface{}{
+			"iss": idp.URL, "sub": subject, "aud": "tinycrm", "exp": time.Now().Add(time.Hour).Unix(),
+			"nonce": query.Get("nonce"), "email": email, "email_verified": true,
+		}
+		return request(pathAuthCallback+"?code=abc&state="+url.QueryEscape(query.Get("state")), cookieOf(login, oidcLoginCookie))
+	}
+
+	if resp := request(pathAuthCallback + "?code=abc&state=forged"); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without the login cookie, got %d", resp.Code)
+	}
+	if resp := signIn("google-1", "ana@example.com"); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for an unknown user, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	ana := User{Username: "ana@example.com"}
+	if err := testRepo.CreateUser(&ana); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	resp := signIn("google-1", "ana@example.com")
+	session := cookieOf(resp, sessionCookie)
+	if resp.Code != http.StatusFound || session == nil {
+		t.Fatalf("Expected a session once signed in, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if resp := request(pathCompanies, session); resp.Code != http.StatusOK {
+		t.Errorf("Expected the session to authenticate, got %d", resp.Code)
+	}
+	if resp := request(pathCompanies); resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("Expected status 401 without a password prompt, got %d %q", resp.Code, resp.Header().Get("WWW-Authenticate"))
+	}
+	forged := *session
+	forged.Value = strings.Replace(forged.Value, strconv.Itoa(int(ana.ID))+".", "999.", 1)
+	if resp := request(pathCompanies, &forged); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered session to be rejected, got %d", resp.Code)
+	}
+
+	// The identity stays linked when the email changes
+	resp = signIn("google-1", "ana.silva@example.com")
+	if resp.Code != http.StatusFound {
+		t.Fatalf("Expected the linked identity to sign in, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if user, err := testRepo.GetUserByIdentity(idp.URL, "google-1"); err != nil || user.ID != ana.ID {
+		t.Errorf("Expected the identity to map to the existing user, got %+v %v", user, err)
+	}
+
+	config.OIDC.CreateUsers = true
+	handler = setupRoutes(NewHandler(testRepo), false)
+	if resp := signIn("google-2", "bruno@example.com"); resp.Code != http.StatusFound {
+		t.Fatalf("Expected a user to be created, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if _, err := testRepo.GetUserByUsername("bruno@example.com"); err != nil {
+		t.Errorf("Expected the user to be created: %v", err)
+	}
+	if authenticate(testRepo, "bruno@example.com", "") {
+		t.Error("A user created by the provider shouldn't sign in without it")
+	}
+}
+
+func TestInvoiceEditLock(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	invoiceData := fmt.Sprintf(`{"due_date": "2030-01-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, productID)
+	_, body, _ := makeRequest(server, "POST", pathInvoices, invoiceData)
+	var invoice Invoice
+	json.Unmarshal(body, &invoice)
+	invoicePath := routePath(pathInvoice, invoice.ID)
+
+	withLock := func(method, path, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(editLockHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathInvoiceLock, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to lock invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var lock InvoiceLock
+	json.Unmarshal(body, &lock)
+	if lock.Token == "" || !lock.ExpiresAt.After(time.Now().Add(14*time.Minute)) {
+		t.Fatalf("Expected a lock token valid for 15 minutes, got %+v", lock)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathInvoiceLock, invoice.ID), "")
+	var held InvoiceLock
+	json.Unmarshal(body, &held)
+	if resp.StatusCode != http.StatusConflict || held.Token != "" {
+		t.Errorf("Expected status 409 without the token for someone else, got %d %s", resp.StatusCode, body)
+	}
+	if resp := withLock("PUT", invoicePath, invoiceData, ""); resp.StatusCode != http.StatusLocked {
+		t.Errorf("Expected status 423 editing without the lock, got %d", resp.StatusCode)
+	}
+	if resp := withLock("DELETE", invoicePath, "", "wrong"); resp.StatusCode != http.StatusLocked {
+		t.Errorf("Expected status 423 deleting without the lock, got %d", resp.StatusCode)
+	}
+	if resp := withLock("PUT", invoicePath, invoiceData, lock.Token); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the holder to edit, got %d", resp.StatusCode)
+	}
+	if resp := withLock("POST", routePath(pathInvoiceLock, invoice.ID), "", lock.Token); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the holder to refresh the lock, got %d", resp.StatusCode)
+	}
+
+	if resp := withLock("DELETE", routePath(pathInvoiceLock, invoice.ID), "", ""); resp.StatusCode != http.StatusLocked {
+		t.Errorf("Expected status 423 releasing someone else's lock, got %d", resp.StatusCode)
+	}
+	if resp := withLock("DELETE", routePath(pathInvoiceLock, invoice.ID), "", lock.Token); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204 releasing the lock, got %d", resp.StatusCode)
+	}
+	if resp := withLock("PUT", invoicePath, invoiceData, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected edits once released, got %d", resp.StatusCode)
+	}
+
+	// Locks expire on their own
+	if _, err := testRepo.LockInvoice(invoice.ID, lockHolder{}, time.Now().Add(-time.Hour), 15*time.Minute); err != nil {
+		t.Fatalf("Failed to lock invoice: %v", err)
+	}
+	if resp := withLock("PUT", invoicePath, invoiceData, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected an expired lock to be ignored, got %d", resp.StatusCode)
+	}
+
+	// Signed in users hold their locks without the token
+	user := User{Username: "carla"}
+	if err := testRepo.CreateUser(&user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if _, err := testRepo.LockInvoice(invoice.ID, lockHolder{UserID: &user.ID}, time.Now(), time.Minute); err != nil {
+		t.Fatalf("Failed to lock invoice: %v", err)
+	}
+	if err := checkInvoiceLock(testRepo, invoice.ID, lockHolder{UserID: &user.ID}, time.Now()); err != nil {
+		t.Errorf("Expected the user to hold the lock, got %v", err)
+	}
+	err = checkInvoiceLock(testRepo, invoice.ID, lockHolder{}, time.Now())
+	if !errors.Is(err, ErrInvoiceLocked) || !strings.Contains(err.Error(), "carla") {
+		t.Errorf("Expected the lock to name its holder, got %v", err)
+	}
+}
+
+func TestDeliverableConsolidation(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	for _, deliverable := range []string{
+		`{"company_id": %d, "client_id": %d, "product_id": %d, "quantity": 2, "date": "2024-01-05T00:00:00Z"}`,
+		`{"company_id": %d, "client_id": %d, "product_id": %d, "quantity": 1, "unit_price": 40, "description": "Travel", "date": "2024-01-20T00:00:00Z"}`,
+		`{"company_id": %d, "client_id": %d, "product_id": %d, "quantity": 3, "date": "2024-02-10T00:00:00Z"}`,
+	} {
+		resp, body, err := makeRequest(server, "POST", pathDeliverables, fmt.Sprintf(deliverable, companyID, companyID, productID))
+		if err != nil {
+			t.Fatalf("Failed to create deliverable: %v", err)
+		}
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+	}
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathCompanyConsolidate, companyID), `{"month": "2024-01"}`)
+	if err != nil {
+		t.Fatalf("Failed to consolidate: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 without remit information, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body, err = makeRequest(server, "POST", routePath(pathCompanyConsolidate, companyID), fmt.Sprintf(`{"month": "2024-01", "remit_information_id": %d}`, remitID))
+	if err != nil {
+		t.Fatalf("Failed to consolidate: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var invoices []Invoice
+	if err := json.Unmarshal(body, &invoices); err != nil {
+		t.Fatalf("Failed to unmarshal invoices: %v", err)
+	}
+	if len(invoices) != 1 || len(invoices[0].InvoiceLines) != 2 {
+		t.Fatalf("Expected one invoice with the two January deliverables, got %+v", invoices)
+	}
+	if invoices[0].TotalAmount != moneyFromFloat(239.98) {
+		t.Errorf("Expected total 239.98, got %.2f", invoices[0].TotalAmount)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathCompanyConsolidate, companyID), fmt.Sprintf(`{"month": "2024-01", "remit_information_id": %d}`, remitID))
+	if strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("Invoiced deliverables should not be invoiced again, got %s", body)
+	}
+
+	resp, body, _ = makeRequest(server, "GET", pathDeliverables+"?invoiced=false", "")
+	var pending []Deliverable
+	json.Unmarshal(body, &pending)
+	if len(pending) != 1 || pending[0].Quantity != 3 {
+		t.Fatalf("Expected the February deliverable to wait, got %+v", pending)
+	}
+
+	resp, body, _ = makeRequest(server, "GET", pathDeliverables+"?invoiced=true", "")
+	var invoiced []Deliverable
+	json.Unmarshal(body, &invoiced)
+	resp, body, _ = makeRequest(server, "DELETE", routePath(pathDeliverable, invoiced[0].ID), "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 deleting an invoiced deliverable, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	day := 5
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).
+		Updates(map[string]interface{}{"consolidation_day": day, "consolidation_remit_id": remitID})
+	results, err := consolidateInvoices(testRepo, time.Date(2024, 3, day, 9, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatalf("Failed to run the consolidation: %v", err)
+	}
+	if len(results) != 1 || len(results[0].InvoiceIDs) != 1 {
+		t.Fatalf("Expected the February deliverable to be invoiced on March 5th, got %+v", results)
+	}
+
+	makeRequest(server, "DELETE", routePath(pathInvoice, results[0].InvoiceIDs[0]), "")
+	resp, body, _ = makeRequest(server, "GET", pathDeliverables+"?invoiced=false", "")
+	pending = nil
+	json.Unmarshal(body, &pending)
+	if len(pending) != 1 {
+		t.Errorf("Deleting the invoice should release its deliverables, got %+v", pending)
+	}
+}
+
+func TestSurveyLinkInReceiptAndScore(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := setupFakeMailer(t)
+	config.NPSSurveyEnabled = true
+	t.Cleanup(func() { config.NPSSurveyEnabled = false })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("email", "client@example.com")
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	surveyPath := surveyLinkPath(&invoice)
+	unpaid, err := http.PostForm(server.URL+surveyPath, url.Values{"score": {"0"}})
+	if err != nil {
+		t.Fatalf("Failed to submit survey: %v", err)
+	}
+	unpaid.Body.Close()
+	if unpaid.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 rating an unpaid invoice, got %d", unpaid.StatusCode)
+	}
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathInvoicePayments, invoice.ID), `{"amount": 99.99}`)
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	if len(fake.sent) != 1 || !strings.Contains(fake.sent[0].Body, surveyPath) {
+		t.Fatalf("Expected a receipt with the survey link, got %+v", fake.sent)
+	}
+
+	resp, err = http.PostForm(server.URL+surveyPath, url.Values{"score": {"10"}, "comment": {"Great service"}})
+	if err != nil {
+		t.Fatalf("Failed to submit survey: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.PostForm(server.URL+routePath(pathSurvey, invoice.UUID.String())+"?sig=forged", url.Values{"score": {"0"}})
+	if err != nil {
+		t.Fatalf("Failed to submit survey: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a forged signature, got %d", resp.StatusCode)
+	}
+
+	resp, body, err = makeRequest(server, "GET", pathSurveysScore+"?company_id="+strconv.Itoa(int(companyID)), "")
+	if err != nil {
+		t.Fatalf("Failed to get NPS score: %v", err)
+	}
+
+	var score NPSScore
+	if err := json.Unmarshal(body, &score); err != nil {
+		t.Fatalf("Failed to unmarshal NPS score: %v", err)
+	}
+	if score.Responses != 1 || score.Promoters != 1 || score.Score != 100 {
+		t.Errorf("Unexpected NPS score %+v", score)
+	}
+}
+
+// Company logo Tests
+func TestCompanyLogoUploadAndRender(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	originalDir := config.AttachmentsDir
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() { config.AttachmentsDir = originalDir })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	uploadLogo := func(filename string, data []byte) *http.Response {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("logo", filename)
+		part.Write(data)
+		writer.Close()
+
+		req, _ := http.NewRequest("PUT", server.URL+routePath(pathCompanyLogo, companyID), &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to upload logo: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := uploadLogo("logo.txt", []byte("not an image")); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 for a text file, got %d", resp.StatusCode)
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if resp := uploadLogo("logo.png", png); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+
+	invoice := Invoice{
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoiceOpen, invoice.ID)+"?template=default_invoice.html", "")
+	if err != nil {
+		t.Fatalf("Failed to open invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if !bytes.Contains(body, []byte("data:image/png;base64,")) {
+		t.Error("Invoice should render the company logo")
+	}
+
+	// The PDF embeds the logo as an image, its transparency as a soft mask
+	logo := image.NewNRGBA(image.Rect(0, 0, 300, 60))
+	logo.Set(0, 0, color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0x80})
+	var encoded bytes.Buffer
+	imagepng.Encode(&encoded, logo)
+	if resp := uploadLogo("logo.png", encoded.Bytes()); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	body = stored.PDF().Bytes()
+	for _, expected := range []string{"/Subtype /Image /Width 300 /Height 60 /ColorSpace /DeviceRGB", "/SMask", "/XObject << /Im1", "q 150.00 0 0 30.00 395.00 772.00 cm /Im1 Do Q"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("Expected the PDF to contain %s", expected)
+		}
+	}
+	encoded.Reset()
+	jpeg.Encode(&encoded, logo, nil)
+	if img, err := NewPDFImage(encoded.Bytes()); err != nil || img.filter != "DCTDecode" || img.alpha != nil || !bytes.Equal(img.data, encoded.Bytes()) {
+		t.Errorf("Expected a JPEG embedded as is, got %v", err)
+	}
+
+	resp, _, err = makeRequest(server, "DELETE", routePath(pathCompanyLogo, companyID), "")
+	if err != nil {
+		t.Fatalf("Failed to delete logo: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	entries, _ := os.ReadDir(config.AttachmentsDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected the logo file to be removed, found %d files", len(entries))
+	}
+}
+
+// Config Tests
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tinycrm.toml")
+	content := `# test config
+port = 9090
+base_url = "https://crm.example.com" # public address
+nps_survey_enabled = true
+
+share_link_secret = "s3cr#t" # a "quoted" comment
+
+[database]
+dsn = "test.db"
+
+[smtp]
+host = 'smtp.example.com'
+from = "billing@example.com"
+cc = ["books@example.com", "audit@example.com"]
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	t.Setenv("DATABASE_DSN", "env.db")
+
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if loaded.Port != "9090" || loaded.BaseURL != "https://crm.example.com" || !loaded.NPSSurveyEnabled {
+		t.Errorf("Unexpected config %+v", loaded)
+	}
+	if loaded.DatabaseDSN != "env.db" {
+		t.Errorf("Expected the environment to override the file, got DSN %q", loaded.DatabaseDSN)
+	}
+	if loaded.SMTP.Host != "smtp.example.com" || loaded.SMTP.Port != "587" || len(loaded.SMTP.Cc) != 2 {
+		t.Errorf("Unexpected SMTP config %+v", loaded.SMTP)
+	}
+	if loaded.ShareLinkSecret != "s3cr#t" {
+		t.Errorf("Expected the comment left out of the secret, got %q", loaded.ShareLinkSecret)
+	}
+	if loaded.TLS.Enabled() {
+		t.Error("TLS should be disabled by default")
+	}
+}
+
+func TestLoadConfigAutocertDomains(t *testing.T) {
+	t.Setenv("TLS_AUTOCERT_DOMAINS", "crm.example.com, www.crm.example.com")
+
+	loaded, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !loaded.TLS.Enabled() || fmt.Sprint(loaded.TLS.AutocertDomains) != "[crm.example.com www.crm.example.com]" {
+		t.Errorf("Unexpected TLS config %+v", loaded.TLS)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	loaded, err := LoadConfig("tinycrm.example.toml")
+	if err != nil {
+		t.Fatalf("Failed to load the example config: %v", err)
+	}
+	if loaded.Port != "8080" || loaded.AuthMode != AuthModeBasic {
+		t.Errorf("Unexpected example config %+v", loaded)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting": "colour = \"blue\"\n",
+		"invalid port":    "port = 99999\n",
+		"invalid auth":    "auth_mode = \"token\"\n",
+		"invalid url":     "base_url = \"crm.example.com\"\n",
+		"missing from":    "[smtp]\nhost = \"smtp.example.com\"\n",
+		"invalid bool":    "nps_survey_enabled = sometimes\n",
+		"missing key":     "[tls]\ncert_file = \"cert.pem\"\n",
+		"tls conflict":    "[tls]\ncert_file = \"cert.pem\"\nkey_file = \"key.pem\"\nautocert_domains = \"crm.example.com\"\n",
+		"negative ttl":    "[reports]\ncache_ttl = -1\n",
+		"mail provider":   "[mail]\nprovider = \"postmark\"\n",
+		"sendgrid key":    "[smtp]\nfrom = \"billing@example.com\"\n[mail]\nprovider = \"sendgrid\"\n",
+		"mailgun domain":  "[smtp]\nfrom = \"billing@example.com\"\n[mail]\nprovider = \"mailgun\"\napi_key = \"key\"\n",
+		"ses from":        "[mail]\nprovider = \"ses\"\nses_region = \"us-east-1\"\nses_access_key_id = \"id\"\nses_secret_access_key = \"secret\"\n",
+		"whatsapp":        "[whatsapp]\nprovider = \"telegram\"\n",
+		"cloud token":     "[whatsapp]\nprovider = \"cloud\"\nphone_number_id = \"123\"\n",
+		"twilio from":     "[whatsapp]\nprovider = \"twilio\"\ntwilio_account_sid = \"AC1\"\ntwilio_auth_token = \"token\"\ntwilio_from = \"14155238886\"\n",
+		"redis url":       "[redis]\nurl = \"http://localhost:6379\"\n",
+		"redis database":  "[redis]\nurl = \"redis://localhost:6379/main\"\n",
+		"pool negative":   "[database]\nmax_open_conns = -1\n",
+		"pool idle":       "[database]\nmax_open_conns = 2\nmax_idle_conns = 5\n",
+		"s3 keys":         "[storage]\ns3_bucket = \"files\"\ns3_region = \"eu-west-1\"\n",
+		"s3 endpoint":     "[storage]\ns3_bucket = \"files\"\ns3_region = \"eu-west-1\"\ns3_access_key_id = \"AKID\"\ns3_secret_access_key = \"secret\"\ns3_endpoint = \"http://minio.example.com\"\n",
+	}
+
+	for name, content := range tests {
+		path := filepath.Join(t.TempDir(), "tinycrm.toml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Report limit Tests
+func TestReportCache(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	if _, _, _, err := createTestData(testRepo); err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, first, _ := makeRequest(server, "GET", pathReportsInvoiceTotals, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Report-Cache") != "miss" {
+		t.Fatalf("Expected a computed report, got %d %q", resp.StatusCode, resp.Header.Get("X-Report-Cache"))
+	}
+	resp, second, _ := makeRequest(server, "GET", pathReportsInvoiceTotals, "")
+	if resp.Header.Get("X-Report-Cache") != "hit" || string(first) != string(second) {
+		t.Errorf("Expected the cached report, got %q %s", resp.Header.Get("X-Report-Cache"), second)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the cached headers, got %q", resp.Header.Get("Content-Type"))
+	}
+
+	// Any write drops the cached reports
+	makeRequest(server, "POST", pathProducts, `{"name": "Another", "price": 1}`)
+	resp, _, _ = makeRequest(server, "GET", pathReportsInvoiceTotals, "")
+	if resp.Header.Get("X-Report-Cache") != "miss" {
+		t.Errorf("Expected the report to be computed again after a write")
+	}
+
+	// Errors aren't cached
+	for i := 0; i < 2; i++ {
+		resp, _, _ = makeRequest(server, "GET", pathReportsInvoiceTotals+"?type=bogus", "")
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Report-Cache") != "miss" {
+			t.Errorf("Expected an uncached error, got %d %q", resp.StatusCode, resp.Header.Get("X-Report-Cache"))
+		}
+	}
+}
+
+func TestReportConcurrencyLimit(t *testing.T) {
+	h := &Handler{reports: newReportLimiter(ReportsConfig{MaxConcurrent: 2})}
+
+	var running, highest int32
+	release := make(chan struct{})
+	report := h.reportMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			previous := atomic.LoadInt32(&highest)
+			if current <= previous || atomic.CompareAndSwapInt32(&highest, previous, current) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		w.Write([]byte("{}"))
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(widget int) {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			report(recorder, httptest.NewRequest("GET", fmt.Sprintf("/api/reports/widget%d", widget), nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", recorder.Code)
+			}
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if current := atomic.LoadInt32(&running); current != 2 {
+		t.Errorf("Expected 2 reports running, got %d", current)
+	}
+	close(release)
+	wg.Wait()
+	if highest != 2 {
+		t.Errorf("Expected at most 2 reports at once, got %d", highest)
+	}
+}
+
+// Referral source Tests
+func TestRevenueBySource(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", pathReferralSources, `{"name": "Conference"}`)
+	if err != nil {
+		t.Fatalf("Failed to create referral source: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var source ReferralSource
+	if err := json.Unmarshal(body, &source); err != nil {
+		t.Fatalf("Failed to unmarshal referral source: %v", err)
+	}
+
+	client := Company{Name: "Referred Client", Document: "99.999.999/0001-99", Address: "Client Street", ReferralSourceID: &source.ID}
+	if err := testRepo.CreateCompany(&client); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for _, clientID := range []uint{client.ID, companyID} {
+		invoice := Invoice{
+			DueDate:            time.Now().AddDate(0, 1, 0),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           clientID,
+			InvoiceLines: []InvoiceLine{
+				{ProductID: &productID, Quantity: 1},
+			},
+		}
+		if err := testRepo.CreateInvoice(&invoice); err != nil {
+			t.Fatalf("Failed to create test invoice: %v", err)
+		}
+		if clientID == client.ID {
+			if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(50), Date: time.Now()}); err != nil {
+				t.Fatalf("Failed to create payment: %v", err)
+			}
+		}
+	}
+
+	resp, body, err = makeRequest(server, "GET", pathReportsRevenueBySource, "")
+	if err != nil {
+		t.Fatalf("Failed to get report: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	var report []SourceRevenue
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("Failed to unmarshal report: %v", err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("Expected 2 report lines, got %+v", report)
+	}
+	if report[0].Source != "Conference" || report[0].Clients != 1 || report[0].Billed != moneyFromFloat(99.99) || report[0].Received != moneyFromFloat(50) {
+		t.Errorf("Unexpected report line %+v", report[0])
+	}
+	if report[1].Source != "Unknown" || report[1].Received != 0 {
+		t.Errorf("Unexpected report line %+v", report[1])
+	}
+
+	resp, _, err = makeRequest(server, "GET", pathReportsRevenueBySource+"?from=2020-13-01", "")
+	if err != nil {
+		t.Fatalf("Failed to get report: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid date, got %d", resp.StatusCode)
+	}
+}
+
+// Migration Tests
+func TestMigrationsUpDownStatus(t *testing.T) {
+	testDB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	testRepo, err := NewRepositoryWithDB(testDB)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	ran, err := testRepo.MigrateUp()
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(ran) != len(migrations) {
+		t.Errorf("Expected %d migrations to run, ran %d", len(migrations), len(ran))
+	}
+
+	drift, err := testRepo.SchemaDrift()
+	if err != nil {
+		t.Fatalf("Failed to compare schema: %v", err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("Expected no drift after migrating, got %v", drift)
+	}
+
+	if ran, _ := testRepo.MigrateUp(); len(ran) != 0 {
+		t.Errorf("Expected no pending migrations, ran %d", len(ran))
+	}
+	if _, err := testRepo.MigrateTo(migrations[len(migrations)-1].Version + 1); err == nil {
+		t.Error("Expected migrating to an unknown version to fail")
+	}
+
+	reverted, err := testRepo.MigrateDown(1)
+	if err != nil {
+		t.Fatalf("Failed to revert migration: %v", err)
+	}
+	last := migrations[len(migrations)-1]
+	if len(reverted) != 1 || reverted[0].Version != last.Version {
+		t.Errorf("Expected migration %d to be reverted, got %+v", last.Version, reverted)
+	}
+
+	status, err := testRepo.MigrationStatus()
+	if err != nil {
+		t.Fatalf("Failed to read migration status: %v", err)
+	}
+	if status[0].AppliedAt == nil || status[len(status)-1].AppliedAt != nil {
+		t.Errorf("Unexpected migration status %+v", status)
+	}
+
+	if _, err := testRepo.MigrateTo(8); err != nil {
+		t.Fatalf("Failed to migrate to version 8: %v", err)
+	}
+	if testDB.Migrator().HasTable("referral_sources") || testDB.Migrator().HasColumn("companies", "referral_source_id") {
+		t.Error("Reverting the referral sources migration should drop its table and column")
+	}
+
+	if _, err := testRepo.MigrateDown(len(migrations)); err != nil {
+		t.Fatalf("Failed to revert every migration: %v", err)
+	}
+	if testDB.Migrator().HasTable(&Invoice{}) {
+		t.Error("Reverting every migration should drop the invoices table")
+	}
+
+	if ran, err := testRepo.MigrateUp(); err != nil || len(ran) != len(migrations) {
+		t.Errorf("Expected every migration to apply again, ran %d: %v", len(ran), err)
+	}
+}
+
+// Factur-X Tests
+func TestInvoiceFacturX(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	invoice := Invoice{
+		Number:             intPtr(42),
+		Locale:             LocaleEs,
+		Discount:           999,
+		DueDate:            time.Now().AddDate(0, 1, 0),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 2},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	endpoint := routePath(pathInvoiceFacturX, invoice.ID)
+
+	resp, body, err := makeRequest(server, "GET", endpoint, "")
+	if err != nil {
+		t.Fatalf("Failed to get Factur-X invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 without countries, got %d", resp.StatusCode)
+	}
+
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("country", "FR")
+
+	resp, body, err = makeRequest(server, "GET", endpoint+"?format=xml", "")
+	if err != nil {
+		t.Fatalf("Failed to get Factur-X XML: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	for _, expected := range []string{
+		"<ram:ID>urn:cen.eu:en16931:2017</ram:ID>",
+		"<ram:TypeCode>380</ram:TypeCode>",
+		"<ram:InvoiceCurrencyCode>EUR</ram:InvoiceCurrencyCode>",
+		"<ram:AllowanceTotalAmount>9.99</ram:AllowanceTotalAmount>",
+		"<ram:GrandTotalAmount>189.99</ram:GrandTotalAmount>",
+		"<ram:CountryID>FR</ram:CountryID>",
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("Factur-X XML should contain %s", expected)
+		}
+	}
+
+	resp, body, err = makeRequest(server, "GET", endpoint, "")
+	if err != nil {
+		t.Fatalf("Failed to get Factur-X PDF: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if !bytes.HasPrefix(body, []byte("%PDF-")) || !bytes.Contains(body, []byte("(factur-x.xml)")) ||
+		!bytes.Contains(body, []byte("/AFRelationship /Alternative")) || !bytes.Contains(body, []byte("<fx:ConformanceLevel>EN 16931</fx:ConformanceLevel>")) {
+		t.Error("Factur-X PDF should embed the XML and declare it in the metadata")
+	}
+
+	quote := invoice
+	quote.ID = 0
+	quote.UUID = uuid.Nil
+	quote.Type = DocumentQuote
+	quote.InvoiceLines = []InvoiceLine{{ProductID: &productID, Quantity: 1}}
+	if err := testRepo.CreateInvoice(&quote); err != nil {
+		t.Fatalf("Failed to create test quote: %v", err)
+	}
+	resp, _, err = makeRequest(server, "GET", routePath(pathInvoiceFacturX, quote.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get Factur-X quote: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a quote, got %d", resp.StatusCode)
+	}
+}
+
+// SQLite tuning Tests
+func TestSQLiteDSNPragmas(t *testing.T) {
+	dsn := sqliteDSN("tinycrm.db", 5000, "")
+	if dsn != "tinycrm.db?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate&_foreign_keys=on&_loc=auto" {
+		t.Errorf("Unexpected DSN %s", dsn)
+	}
+
+	dsn = sqliteDSN("file:tinycrm.db?_journal_mode=DELETE", 100, "America/Sao_Paulo")
+	if dsn != "file:tinycrm.db?_journal_mode=DELETE&_busy_timeout=100&_txlock=immediate&_foreign_keys=on&_loc=America/Sao_Paulo" {
+		t.Errorf("Pragmas set in the DSN should be kept, got %s", dsn)
+	}
+}
+
+func TestConcurrentWritesWaitForLock(t *testing.T) {
+	dsn := sqliteDSN(filepath.Join(t.TempDir(), "concurrent.db"), 5000, "")
+	testDB, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	testRepo, err := NewRepositoryWithDB(testDB)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	var journalMode string
+	testDB.Raw("PRAGMA journal_mode").Scan(&journalMode)
+	if journalMode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %s", journalMode)
+	}
+
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- testDB.Transaction(func(tx *gorm.DB) error {
+				// Reading first, a deferred transaction couldn't take the
+				// write lock once another one committed
+				var companies int64
+				if err := tx.Model(&Company{}).Count(&companies).Error; err != nil {
+					return err
+				}
+				company := Company{Name: fmt.Sprintf("Company %d", companies), Document: "1", Address: "Street"}
+				return tx.Create(&company).Error
+			})
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Concurrent write failed: %v", err)
+		}
+	}
+}
+
+func TestUnitOfWorkBusyReturns503(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	handler := testRepo.UnitOfWork(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeDatabaseError(w, r, fmt.Errorf("saving the invoice: %w", sqlite3.Error{Code: sqlite3.ErrBusy}))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", pathRoot, nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("Busy responses should tell the client when to retry")
+	}
+
+	// Only the error recorded tells, not what the message says
+	handler = testRepo.UnitOfWork(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid note: "+sqlite3.ErrBusy.Error(), http.StatusInternalServerError)
+	}))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", pathRoot, nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for an error only mentioning a lock, got %d", recorder.Code)
+	}
+}
+
+func TestDatabasePool(t *testing.T) {
+	original := *config
+	t.Cleanup(func() { *config = original })
+	config.DatabaseDSN = filepath.Join(t.TempDir(), "pool.db")
+	config.DatabaseMaxOpenConns, config.DatabaseMaxIdleConns = 3, 1
+	config.DatabaseConnMaxLifetime, config.DatabaseConnMaxIdleTime = 600, 60
+
+	testRepo, err := NewRepository()
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	if err := loadSettings(testRepo); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	server := httptest.NewServer(setupRoutes(NewHandler(testRepo), true))
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", pathAdminDBStats, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the pool stats, got %v %v", resp, err)
+	}
+	var stats DatabaseStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.MaxOpenConnections != 3 || stats.OpenConnections < 1 || stats.OpenConnections > 3 || stats.Idle > 1 {
+		t.Errorf("Expected the configured pool in use, got %+v", stats)
+	}
+}
+
+// queryCounter counts the statements a repository runs
+type queryCounter struct {
+	logger.Interface
+	count atomic.Int64
+}
+
+func (c *queryCounter) LogMode(logger.LogLevel) logger.Interface { return c }
+
+func (c *queryCounter) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	c.count.Add(1)
+}
+
+// countQueries returns how many statements run runs against the repository
+func countQueries(testRepo *Repository, run func(store *Repository) error) (int64, error) {
+	counter := &queryCounter{Interface: logger.Discard}
+	err := run(&Repository{db: testRepo.db.Session(&gorm.Session{Logger: counter})})
+	return counter.count.Load(), err
+}
+
+// hotPathQueries are the queries the invoice list, the dashboard and a
+// statement may run whatever the number of invoices
+var hotPathQueries = []struct {
+	name string
+	max  int64
+	run  func(store *Repository, clientID uint) error
+}{
+	{"invoice list", 1, func(store *Repository, clientID uint) error {
+		_, err := store.GetInvoiceSummaries(InvoiceFilter{})
+		return err
+	}},
+	{"full invoice list", 4, func(store *Repository, clientID uint) error {
+		_, err := store.GetInvoices(InvoiceFilter{})
+		return err
+	}},
+	{"dashboard", 7, func(store *Repository, clientID uint) error {
+		_, err := GetDashboardData(store)
+		return err
+	}},
+	{"statement", 3, func(store *Repository, clientID uint) error {
+		_, err := store.GetStatement(clientID, nil, nil)
+		return err
+	}},
+}
+
+// seedHotPaths creates invoices of a single client in every state
+func seedHotPaths(tb testing.TB, testRepo *Repository, invoices int) uint {
+	f := NewFactory(testRepo)
+	client, err := f.Company()
+	if err != nil {
+		tb.Fatalf("Failed to create client: %v", err)
+	}
+	states := []InvoiceState{InvoiceDraft, InvoiceSent, InvoicePartiallyPaid, InvoicePaid, InvoiceOverdue}
+	for i := 0; i < invoices; i++ {
+		if _, err := f.Invoice(states[i%len(states)], func(i *Invoice) { i.ClientID = client.ID }); err != nil {
+			tb.Fatalf("Failed to create invoice: %v", err)
+		}
+	}
+	return client.ID
+}
+
+func TestHotPathQueryCounts(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+	original := config.Reports.ReadModelTTL
+	config.Reports.ReadModelTTL = 0
+	t.Cleanup(func() { config.Reports.ReadModelTTL = original })
+
+	originalDir := config.AttachmentsDir
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() { config.AttachmentsDir = originalDir })
+
+	clientID := seedHotPaths(t, testRepo, 2)
+	first, err := testRepo.GetInvoices(InvoiceFilter{})
+	if err != nil || len(first) == 0 {
+		t.Fatalf("Failed to list invoices: %v", err)
+	}
+	if _, err := testRepo.SetCompanyLogo(first[0].CompanyID, "logo.png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")); err != nil {
+		t.Fatalf("Failed to set logo: %v", err)
+	}
+
+	// The joined relations are the ones read one invoice at a time
+	invoices, err := testRepo.GetInvoices(InvoiceFilter{})
+	if err != nil {
+		t.Fatalf("Failed to list invoices: %v", err)
+	}
+	for _, invoice := range invoices {
+		single, err := testRepo.GetInvoice(invoice.ID)
+		if err != nil {
+			t.Fatalf("Failed to get invoice: %v", err)
+		}
+		if invoice.Company.Name != single.Company.Name || invoice.Client.Name != single.Client.Name ||
+			(invoice.Company.Logo == nil) != (single.Company.Logo == nil) ||
+			len(invoice.InvoiceLines) != len(single.InvoiceLines) || invoice.InvoiceLines[0].Product == nil ||
+			len(invoice.RemitInformation.Lines) != len(single.RemitInformation.Lines) {
+			t.Errorf("Expected the listed invoice %d as read alone, got %+v", invoice.ID, invoice)
+		}
+	}
+	if invoices[0].Company.Logo == nil || invoices[1].Company.Logo != nil {
+		t.Errorf("Expected only the first issuer with a logo")
+	}
+
+	counts := map[string]int64{}
+	for _, path := range hotPathQueries {
+		count, err := countQueries(testRepo, func(store *Repository) error { return path.run(store, clientID) })
+		if err != nil {
+			t.Fatalf("Failed to run the %s: %v", path.name, err)
+		}
+		if count > path.max {
+			t.Errorf("Expected the %s in at most %d queries, got %d", path.name, path.max, count)
+		}
+		counts[path.name] = count
+	}
+
+	// More invoices take no more queries
+	seedHotPaths(t, testRepo, 20)
+	for _, path := range hotPathQueries {
+		count, _ := countQueries(testRepo, func(store *Repository) error { return path.run(store, clientID) })
+		if count != counts[path.name] {
+			t.Errorf("Expected the %s in %d queries with more invoices, got %d", path.name, counts[path.name], count)
+		}
+	}
+}
+
+func BenchmarkHotPaths(b *testing.B) {
+	testDB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		b.Fatalf("Failed to connect to test database: %v", err)
+	}
+	testRepo, err := NewRepositoryWithDB(testDB)
+	if err != nil {
+		b.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		b.Fatalf("Failed to migrate test database: %v", err)
+	}
+	if err := loadSettings(testRepo); err != nil {
+		b.Fatalf("Failed to load settings: %v", err)
+	}
+	original := config.Reports.ReadModelTTL
+	config.Reports.ReadModelTTL = 0
+	b.Cleanup(func() { config.Reports.ReadModelTTL = original })
+	clientID := seedHotPaths(b, testRepo, 100)
+
+	for _, path := range hotPathQueries {
+		b.Run(path.name, func(b *testing.B) {
+			var queries int64
+			for i := 0; i < b.N; i++ {
+				count, err := countQueries(testRepo, func(store *Repository) error { return path.run(store, clientID) })
+				if err != nil {
+					b.Fatalf("Failed to run the %s: %v", path.name, err)
+				}
+				if count > path.max {
+					b.Fatalf("Expected the %s in at most %d queries, got %d", path.name, path.max, count)
+				}
+				queries += count
+			}
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// UBL Tests
+func TestInvoiceUBL(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("country", "NL")
+
+	invoice := Invoice{
+		Number:             intPtr(77),
+		Locale:             LocaleEs,
+		DueDate:            time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 3},
+		},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(100), Date: time.Now()}); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoiceUBL, invoice.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get UBL invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	for _, expected := range []string{
+		`<Invoice xmlns="urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"`,
+		"<cbc:InvoiceTypeCode>380</cbc:InvoiceTypeCode>",
+		"<cbc:DueDate>2024-07-01</cbc:DueDate>",
+		`<cbc:InvoicedQuantity unitCode="C62">3</cbc:InvoicedQuantity>`,
+		`<cbc:PrepaidAmount currencyID="EUR">100.00</cbc:PrepaidAmount>`,
+		`<cbc:PayableAmount currencyID="EUR">199.97</cbc:PayableAmount>`,
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("UBL invoice should contain %s", expected)
+		}
+	}
+
+	creditNote := Invoice{
+		Type:               DocumentCreditNote,
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines: []InvoiceLine{
+			{ProductID: &productID, Quantity: 1},
+		},
+	}
+	if err := testRepo.CreateInvoice(&creditNote); err != nil {
+		t.Fatalf("Failed to create test credit note: %v", err)
+	}
+
+	_, body, err = makeRequest(server, "GET", routePath(pathInvoiceUBL, creditNote.ID), "")
+	if err != nil {
+		t.Fatalf("Failed to get UBL credit note: %v", err)
+	}
+	if !bytes.Contains(body, []byte("<cbc:CreditNoteTypeCode>381</cbc:CreditNoteTypeCode>")) || !bytes.Contains(body, []byte("<cac:CreditNoteLine>")) {
+		t.Errorf("Credit notes should be exported as UBL CreditNote documents, got %s", string(body))
+	}
+}
+
+type fakePeppolTransmitter struct {
+	sent []*PeppolDocument
+	err  error
+}
+
+func (f *fakePeppolTransmitter) Transmit(document *PeppolDocument) (*PeppolReceipt, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.sent = append(f.sent, document)
+	return &PeppolReceipt{MessageID: "msg-1", Evidence: []byte(`{"message_id":"msg-1","status":"accepted"}`)}, nil
+}
+
+func TestPeppolTransmission(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	fake := &fakePeppolTransmitter{}
+	originalTransmitter := peppolTransmitter
+	peppolTransmitter = fake
+	t.Cleanup(func() { peppolTransmitter = originalTransmitter })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("country", "BE")
+
+	invoice := Invoice{
+		DueDate:            time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	path := routePath(pathInvoicePeppol, invoice.ID)
+
+	resp, body, err := makeRequest(server, "POST", path, "")
+	if err != nil {
+		t.Fatalf("Failed to send invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 without a Peppol ID, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body, err = makeRequest(server, "PUT", routePath(pathCompany, companyID), `{"name": "Test Company", "country": "BE", "peppol_id": "not an id"}`)
+	if err != nil {
+		t.Fatalf("Failed to update company: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for an invalid Peppol ID, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("peppol_id", "0208:0123456789")
+
+	resp, body, err = makeRequest(server, "POST", path, "")
+	if err != nil {
+		t.Fatalf("Failed to send invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if len(fake.sent) != 1 {
+		t.Fatalf("Expected 1 transmitted document, got %d", len(fake.sent))
+	}
+	sent := fake.sent[0]
+	if sent.ReceiverID != "0208:0123456789" || sent.DocumentTypeID != peppolInvoiceDocumentType {
+		t.Errorf("Unexpected document envelope: %+v", sent)
+	}
+	if !strings.Contains(string(sent.Payload), `<cbc:EndpointID schemeID="0208">0123456789</cbc:EndpointID>`) {
+		t.Errorf("Expected the UBL payload to carry the endpoint ID, got %s", sent.Payload)
+	}
+
+	fake.err = fmt.Errorf("access point unavailable")
+	resp, _, err = makeRequest(server, "POST", path, "")
+	if err != nil {
+		t.Fatalf("Failed to send invoice: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502 when the access point fails, got %d", resp.StatusCode)
+	}
+
+	resp, body, err = makeRequest(server, "GET", path, "")
+	if err != nil {
+		t.Fatalf("Failed to list transmissions: %v", err)
+	}
+	var transmissions []PeppolTransmission
+	if err := json.Unmarshal(body, &transmissions); err != nil {
+		t.Fatalf("Failed to decode transmissions: %v", err)
+	}
+	if len(transmissions) != 1 || transmissions[0].MessageID != "msg-1" || !strings.Contains(transmissions[0].Evidence, "accepted") {
+		t.Errorf("Expected the stored transmission evidence, got %+v", transmissions)
+	}
+}
+
+// Storage Tests
+func TestAttachmentDeduplicationAndQuota(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	originalDir, originalQuota := config.AttachmentsDir, config.StorageQuotaMB
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() {
+		config.AttachmentsDir = originalDir
+		config.StorageQuotaMB = originalQuota
+	})
+
+	first := Company{Name: "First", Document: "1", Address: "Somewhere"}
+	second := Company{Name: "Second", Document: "2", Address: "Elsewhere"}
+	if err := testRepo.CreateCompany(&first); err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+	if err := testRepo.CreateCompany(&second); err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	firstLogo, err := testRepo.SetCompanyLogo(first.ID, "logo.png", png)
+	if err != nil {
+		t.Fatalf("Failed to set logo: %v", err)
+	}
+	secondLogo, err := testRepo.SetCompanyLogo(second.ID, "same.png", png)
+	if err != nil {
+		t.Fatalf("Failed to set logo: %v", err)
+	}
+	if firstLogo.SHA256 != secondLogo.SHA256 {
+		t.Fatal("Identical uploads should have the same content hash")
+	}
+	files, _ := os.ReadDir(config.AttachmentsDir)
+	if len(files) != 1 {
+		t.Fatalf("Expected identical uploads to share one file, found %d", len(files))
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathReportsStorage, "")
+	if err != nil {
+		t.Fatalf("Failed to get storage report: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var usage StorageUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		t.Fatalf("Failed to unmarshal storage report: %v", err)
+	}
+	size := int64(len(png))
+	if usage.Files != 2 || usage.UploadedBytes != 2*size || usage.StoredBytes != size {
+		t.Errorf("Unexpected storage totals %+v", usage)
+	}
+	if len(usage.Companies) != 2 || usage.Companies[0].Bytes != size || usage.Companies[0].Files != 1 {
+		t.Errorf("Unexpected per company usage %+v", usage.Companies)
+	}
+
+	// The shared file stays until its last attachment goes
+	if err := testRepo.RemoveCompanyLogo(first.ID); err != nil {
+		t.Fatalf("Failed to remove logo: %v", err)
+	}
+	if _, err := secondLogo.Read(); err != nil {
+		t.Fatalf("Removing one logo deleted the shared file: %v", err)
+	}
+	if err := testRepo.RemoveCompanyLogo(second.ID); err != nil {
+		t.Fatalf("Failed to remove logo: %v", err)
+	}
+	if files, _ := os.ReadDir(config.AttachmentsDir); len(files) != 0 {
+		t.Errorf("Expected the file to be deleted with its last attachment, found %d files", len(files))
+	}
+
+	config.StorageQuotaMB = 1
+	big := append(append([]byte{}, png...), make([]byte, 1<<20)...)
+	if _, err := testRepo.SetCompanyLogo(first.ID, "big.png", big); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Errorf("Expected the quota to be enforced, got %v", err)
+	}
+	if _, err := testRepo.SetCompanyLogo(first.ID, "logo.png", png); err != nil {
+		t.Fatalf("Failed to set logo within the quota: %v", err)
+	}
+	// Replacing a logo doesn't count the old one
+	if _, err := testRepo.SetCompanyLogo(first.ID, "other.png", append(png, 'x')); err != nil {
+		t.Errorf("Replacing a logo should fit in the quota: %v", err)
+	}
+
+	var upload bytes.Buffer
+	writer := multipart.NewWriter(&upload)
+	part, _ := writer.CreateFormFile("logo", "big.png")
+	part.Write(big[:1<<20])
+	writer.Close()
+	req, _ := http.NewRequest("PUT", server.URL+routePath(pathCompanyLogo, second.ID), &upload)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	uploadResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload logo: %v", err)
+	}
+	uploadResp.Body.Close()
+	if uploadResp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected a 1 MiB logo to fit a 1 MiB quota, got %d", uploadResp.StatusCode)
+	}
+
+	testRepo.db.Model(&Company{}).Where("id = ?", second.ID).Update("storage_quota_mb", 0)
+	config.StorageQuotaMB = 1
+	if _, err := testRepo.CreateAttachment(&second.ID, "extra.png", "image/png", big); err != nil {
+		t.Errorf("A company quota of 0 should lift the limit: %v", err)
+	}
+}
+
+// GraphQL Tests
+func TestGraphQL(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	invoice := Invoice{
+		DueDate:            time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 2}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(50), Date: time.Now()}); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	graphQL := func(query string, variables map[string]interface{}) (int, string) {
+		body, _ := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+		resp, responseBody, err := makeRequest(server, "POST", pathGraphQL, string(body))
+		if err != nil {
+			t.Fatalf("Failed to run GraphQL query: %v", err)
+		}
+		return resp.StatusCode, string(responseBody)
+	}
+
+	status, body := graphQL(`query Invoice($id: ID!) {
+		invoice(id: $id) {
+			id
+			total
+			client { name }
+			lines: invoice_lines { quantity product { name price } }
+			payments { amount }
+		}
+	}`, map[string]interface{}{"id": invoice.ID})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", status, body)
+	}
+	expected := fmt.Sprintf(`{"data":{"invoice":{"id":"%d","total":199.98,"client":{"name":"Test Company Ltd"},"lines":[{"quantity":2,"product":{"name":"Test Product","price":99.99}}],"payments":[{"amount":50}]}}}`, invoice.ID)
+	if strings.TrimSpace(body) != expected {
+		t.Errorf("Unexpected response\n got: %s\nwant: %s", body, expected)
+	}
+
+	status, body = graphQL(`mutation {
+		created: createCompany(input: {name: "GraphQL Inc", document: "42", address: "Somewhere", country: "FR"}) { id name }
+		updateProduct(id: `+strconv.Itoa(int(productID))+`, input: {price: 120}) { name price }
+	}`, nil)
+	if status != http.StatusOK || strings.Contains(body, "errors") {
+		t.Fatalf("Mutation failed with status %d: %s", status, body)
+	}
+	if !strings.Contains(body, `"name":"GraphQL Inc"`) || !strings.Contains(body, `"updateProduct":{"name":"Test Product","price":120}`) {
+		t.Errorf("Unexpected mutation response: %s", body)
+	}
+	product, err := testRepo.GetProduct(productID)
+	if err != nil || product.Price != moneyFromFloat(120) || product.Name != "Test Product" {
+		t.Errorf("Expected a partial product update, got %+v", product)
+	}
+
+	status, body = graphQL(`mutation UpdateInvoice($id: ID!, $lines: [InvoiceLineInput!]) {
+		updateInvoice(id: $id, input: {due_date: "2024-08-01T00:00:00Z", invoice_lines: $lines}) { due_date invoice_lines { quantity } }
+	}`, map[string]interface{}{
+		"id":    strconv.Itoa(int(invoice.ID)),
+		"lines": []map[string]interface{}{{"product_id": productID, "quantity": 1.5}},
+	})
+	if status != http.StatusOK || !strings.Contains(body, `"updateInvoice":{"due_date":"2024-08-01T00:00:00Z","invoice_lines":[{"quantity":1.5}]}`) {
+		t.Errorf("Expected the invoice lines to be replaced, got %d: %s", status, body)
+	}
+
+	status, body = graphQL(`mutation { createCompany(input: {name: "Bad", document: "1", address: "x", country: "France"}) { id } }`, nil)
+	if status != http.StatusOK || !strings.Contains(body, `"createCompany":null`) || !strings.Contains(body, "ISO 3166") {
+		t.Errorf("Expected the company validation error, got %d: %s", status, body)
+	}
+
+	status, body = graphQL(`{ companies { id secret } }`, nil)
+	if status != http.StatusBadRequest || !strings.Contains(body, `Cannot query field \"secret\" on type \"Company\"`) {
+		t.Errorf("Expected an unknown field error, got %d: %s", status, body)
+	}
+
+	status, body = graphQL(`{ __type(name: "Invoice") { fields { name } } }`, nil)
+	if status != http.StatusOK || !strings.Contains(body, `{"name":"paid_amount"}`) {
+		t.Errorf("Expected the schema to be introspectable, got %d: %s", status, body)
+	}
+
+	deep := "name"
+	for i := 0; i < graphQLMaxDepth; i++ {
+		deep = "client { invoices { " + deep + " } }"
+	}
+	status, body = graphQL(`{ invoices { `+deep+` } }`, nil)
+	if status != http.StatusBadRequest || !strings.Contains(body, "exceeds max depth") {
+		t.Errorf("Expected queries nested too deeply to be refused, got %d: %s", status, body)
+	}
+
+	status, _ = graphQL(`{ companies { id `, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a syntax error, got %d", status)
+	}
+
+	resp, _, err := makeRequest(server, "GET", pathGraphQL+"?query="+url.QueryEscape("mutation { deleteProduct(id: 1) }"), "")
+	if err != nil {
+		t.Fatalf("Failed to run GraphQL query: %v", err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected mutations over GET to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body2, err := makeRequest(server, "GET", pathGraphQL+"?query="+url.QueryEscape("{ products { name } }"), "")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body2), `{"data":{"products":[{"name":"Test Product"}]}}`) {
+		t.Errorf("Expected a GET query to work, got %v: %s", err, body2)
+	}
+}
+
+// Bulk action Tests
+func TestBulkCompanyAndInvoiceActions(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	other := Company{Name: "Other", Document: "2", Address: "Elsewhere", Country: "FR"}
+	if err := testRepo.CreateCompany(&other); err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+	owner := User{Username: "owner", PasswordHash: "x"}
+	if err := testRepo.CreateUser(&owner); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	bulk := func(path, body string) (int, BulkResult) {
+		resp, responseBody, err := makeRequest(server, "POST", path, body)
+		if err != nil {
+			t.Fatalf("Failed to run bulk action: %v", err)
+		}
+		var result BulkResult
+		json.Unmarshal(responseBody, &result)
+		return resp.StatusCode, result
+	}
+
+	if status, _ := bulk(pathCompaniesBulk, `{"action": "archive"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected a bulk action without filter to be refused, got %d", status)
+	}
+	if status, _ := bulk(pathCompaniesBulk, `{"action": "tag", "tag": "bad,tag", "all": true}`); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid tag to be refused, got %d", status)
+	}
+
+	status, result := bulk(pathCompaniesBulk, `{"action": "tag", "tag": "VIP", "all": true}`)
+	if status != http.StatusOK || result.Affected != 2 {
+		t.Fatalf("Expected 2 tagged companies, got %d with %+v", status, result)
+	}
+	// Companies already tagged are not counted again
+	if _, result := bulk(pathCompaniesBulk, `{"action": "tag", "tag": "vip", "filter": {"country": "fr"}}`); result.Affected != 0 {
+		t.Errorf("Expected no change when tagging twice, got %+v", result)
+	}
+	if _, result := bulk(pathCompaniesBulk, `{"action": "tag", "tag": "europe", "filter": {"country": "fr"}}`); result.Affected != 1 {
+		t.Errorf("Expected 1 company tagged by country, got %+v", result)
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathCompanies+"?tag=europe", "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list companies by tag: %v", err)
+	}
+	var companies []Company
+	json.Unmarshal(body, &companies)
+	if len(companies) != 1 || companies[0].ID != other.ID || strings.Join(companies[0].Tags, ",") != "vip,europe" {
+		t.Errorf("Unexpected companies tagged europe: %+v", companies)
+	}
+
+	if _, result := bulk(pathCompaniesBulk, `{"action": "untag", "tag": "vip", "filter": {"ids": [`+strconv.Itoa(int(other.ID))+`]}}`); result.Affected != 1 {
+		t.Errorf("Expected 1 company untagged, got %+v", result)
+	}
+	if status, _ := bulk(pathCompaniesBulk, `{"action": "assign", "owner_id": 999, "all": true}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an unknown owner to be refused, got %d", status)
+	}
+	if _, result := bulk(pathCompaniesBulk, fmt.Sprintf(`{"action": "assign", "owner_id": %d, "filter": {"tag": "vip"}}`, owner.ID)); result.Affected != 1 {
+		t.Errorf("Expected 1 company assigned, got %+v", result)
+	}
+
+	// Editing a company keeps what bulk actions set
+	resp, _, err = makeRequest(server, "PUT", routePath(pathCompany, companyID), `{"name": "Renamed", "document": "1", "address": "Somewhere"}`)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to update company: %v", err)
+	}
+	company, _ := testRepo.GetCompany(companyID)
+	if company.OwnerID == nil || *company.OwnerID != owner.ID || len(company.Tags) != 1 {
+		t.Errorf("Expected the owner and tags to survive an update, got %+v", company)
+	}
+
+	for i := 0; i < 3; i++ {
+		invoice := Invoice{
+			DueDate:            time.Now(),
+			RemitInformationID: remitID,
+			CompanyID:          companyID,
+			ClientID:           companyID,
+			Paid:               i == 0,
+			InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+		}
+		if err := testRepo.CreateInvoice(&invoice); err != nil {
+			t.Fatalf("Failed to create invoice: %v", err)
+		}
+	}
+	if _, result := bulk(pathInvoicesBulk, `{"action": "archive", "filter": {"paid": true}}`); result.Affected != 1 {
+		t.Errorf("Expected 1 paid invoice archived, got %+v", result)
+	}
+	invoices, err := testRepo.GetInvoices(InvoiceFilter{Archived: new(bool)})
+	if err != nil || len(invoices) != 2 {
+		t.Errorf("Expected 2 invoices left unarchived, got %d (%v)", len(invoices), err)
+	}
+	if _, result := bulk(pathInvoicesBulk, `{"action": "unarchive", "all": true}`); result.Affected != 1 {
+		t.Errorf("Expected 1 invoice unarchived, got %+v", result)
+	}
+}
+
+func TestListColumns(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	if _, _, _, err := createTestData(testRepo); err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathListColumns, "companies"), "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get list columns: %v", err)
+	}
+	if !strings.Contains(string(body), `"available":["id","name","document"`) || !strings.Contains(string(body), `"columns":[]`) {
+		t.Errorf("Expected every company column available and none picked, got %s", body)
+	}
+
+	resp, _, err = makeRequest(server, "PUT", routePath(pathListColumns, "companies"), `{"columns": ["name", "password"]}`)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown column to be refused, got %v", err)
+	}
+	resp, _, err = makeRequest(server, "GET", routePath(pathListColumns, "users"), "")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown list to be refused, got %v", err)
+	}
+
+	resp, _, err = makeRequest(server, "PUT", routePath(pathListColumns, "companies"), `{"columns": ["name", "country", "name"]}`)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to pick columns: %v", err)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathCompanies, "")
+	var rows []map[string]interface{}
+	json.Unmarshal(body, &rows)
+	if len(rows) != 1 || len(rows[0]) != 3 || rows[0]["name"] != "Test Company Ltd" || rows[0]["id"] == nil {
+		t.Errorf("Expected only the id, name and country, got %s", body)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathCompanies+"?columns=all", "")
+	json.Unmarshal(body, &rows)
+	if len(rows) != 1 || rows[0]["document"] == nil {
+		t.Errorf("Expected every column with columns=all, got %s", body)
+	}
+	_, body, _ = makeRequest(server, "GET", pathProducts+"?columns=price", "")
+	rows = nil
+	json.Unmarshal(body, &rows)
+	if len(rows) != 1 || len(rows[0]) != 2 || rows[0]["price"] != 99.99 {
+		t.Errorf("Expected the product id and price, got %s", body)
+	}
+
+	// Each user keeps their own columns
+	alice := User{Username: "alice"}
+	alice.PasswordHash, _ = hashPassword("secret")
+	if err := testRepo.CreateUser(&alice); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	if recorder := request("GET", pathCompanies, ""); strings.Contains(recorder.Body.String(), `"country"`) == false {
+		t.Errorf("Expected every column for a user without a choice, got %s", recorder.Body.String())
+	}
+	if recorder := request("PUT", routePath(pathListColumns, "invoices"), `{"columns": ["status", "total"]}`); recorder.Code != http.StatusOK {
+		t.Fatalf("Failed to pick invoice columns: %d %s", recorder.Code, recorder.Body.String())
+	}
+	columns, err := testRepo.GetListColumns(&alice.ID, "invoices")
+	if err != nil || strings.Join(columns, ",") != "status,total" {
+		t.Errorf("Expected alice's invoice columns to be stored, got %v (%v)", columns, err)
+	}
+	if columns, _ := testRepo.GetListColumns(nil, "invoices"); len(columns) != 0 {
+		t.Errorf("Expected the anonymous columns to be left alone, got %v", columns)
+	}
+
+	// An empty list brings back every column
+	if recorder := request("PUT", routePath(pathListColumns, "invoices"), `{"columns": []}`); recorder.Code != http.StatusOK {
+		t.Fatalf("Failed to reset invoice columns: %d", recorder.Code)
+	}
+	if columns, _ := testRepo.GetListColumns(&alice.ID, "invoices"); len(columns) != 0 {
+		t.Errorf("Expected alice's invoice columns to be reset, got %v", columns)
+	}
+}
+
+// gRPC Tests
+
+// dialGRPC serves the gRPC API over an in-memory listener
+func dialGRPC(t *testing.T, store Store, testing bool) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(store, testing)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial gRPC server: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+func TestGRPCServices(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	mail := setupFakeMailer(t)
+	config.ReceiptsEnabled = true
+	t.Cleanup(func() { config.ReceiptsEnabled = false })
+
+	issuerID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	conn := dialGRPC(t, testRepo, true)
+	companies := tinycrmpb.NewCompanyServiceClient(conn)
+	invoices := tinycrmpb.NewInvoiceServiceClient(conn)
+	payments := tinycrmpb.NewPaymentServiceClient(conn)
+	ctx := context.Background()
+
+	_, err = companies.CreateCompany(ctx, &tinycrmpb.CreateCompanyRequest{
+		Company: &tinycrmpb.Company{Name: "Bad Country", Country: "Belgium"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid country, got %v", err)
+	}
+
+	client, err := companies.CreateCompany(ctx, &tinycrmpb.CreateCompanyRequest{
+		Company: &tinycrmpb.Company{Name: "gRPC Client", Document: "123", Address: "Somewhere", Email: "client@example.com", Country: "BE"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+	if client.Id == 0 || client.Name != "gRPC Client" {
+		t.Errorf("Expected the stored company, got %+v", client)
+	}
+
+	list, err := companies.ListCompanies(ctx, &tinycrmpb.ListCompaniesRequest{Country: "BE"})
+	if err != nil || len(list.Companies) != 1 || list.Companies[0].Name != "gRPC Client" {
+		t.Errorf("Expected only the Belgian company, got %v (%v)", list, err)
+	}
+
+	invoice, err := invoices.CreateInvoice(ctx, &tinycrmpb.CreateInvoiceRequest{
+		Invoice: &tinycrmpb.Invoice{
+			DueDate:            timestamppb.New(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)),
+			RemitInformationId: uint32(remitID),
+			CompanyId:          uint32(issuerID),
+			ClientId:           client.Id,
+			Lines:              []*tinycrmpb.InvoiceLine{{ProductId: uint32(productID), Quantity: 2}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if invoice.Type != string(DocumentInvoice) || invoice.Total != 199.98 || invoice.Lines[0].Product.Name != "Test Product" {
+		t.Errorf("Expected a 199.98 invoice with its product, got %+v", invoice)
+	}
+
+	hours := 7.5
+	invoice.Lines = []*tinycrmpb.InvoiceLine{{ProductId: uint32(productID), DecimalQuantity: &hours, Unit: "h"}}
+	invoice, err = invoices.UpdateInvoice(ctx, &tinycrmpb.UpdateInvoiceRequest{Invoice: invoice})
+	if err != nil {
+		t.Fatalf("Failed to update invoice: %v", err)
+	}
+	if line := invoice.Lines[0]; line.GetDecimalQuantity() != 7.5 || line.Unit != "h" || line.Quantity != 8 {
+		t.Errorf("Expected 7.5 hours, rounded in the deprecated quantity, got %+v", line)
+	}
+	if invoice.Total != 749.93 {
+		t.Errorf("Expected 7.5 hours billed, got a total of %v", invoice.Total)
+	}
+
+	_, err = payments.CreatePayment(ctx, &tinycrmpb.CreatePaymentRequest{
+		Payment: &tinycrmpb.Payment{InvoiceId: invoice.Id},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an empty payment, got %v", err)
+	}
+	payment, err := payments.CreatePayment(ctx, &tinycrmpb.CreatePaymentRequest{
+		Payment: &tinycrmpb.Payment{InvoiceId: invoice.Id, Amount: 749.93},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if payment.Id == 0 || payment.Date == nil {
+		t.Errorf("Expected a stored payment dated now, got %+v", payment)
+	}
+
+	paid, err := invoices.GetInvoice(ctx, &tinycrmpb.GetInvoiceRequest{Id: invoice.Id})
+	if err != nil || !paid.Paid {
+		t.Errorf("Expected the invoice paid, got %+v (%v)", paid, err)
+	}
+	if len(mail.sent) != 1 || mail.sent[0].To[0] != "client@example.com" {
+		t.Errorf("Expected a receipt sent to the client, got %+v", mail.sent)
+	}
+
+	_, err = invoices.GetInvoice(ctx, &tinycrmpb.GetInvoiceRequest{Id: 9999})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a missing invoice, got %v", err)
+	}
+	_, err = invoices.ListInvoices(ctx, &tinycrmpb.ListInvoicesRequest{Type: "bogus"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unknown type, got %v", err)
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if err := testRepo.CreateUser(&User{Username: "admin", PasswordHash: hash}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	products := tinycrmpb.NewProductServiceClient(dialGRPC(t, testRepo, false))
+	withAuth := func(credentials string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(),
+			"authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if _, err := products.ListProducts(context.Background(), &tinycrmpb.ListProductsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated without credentials, got %v", err)
+	}
+	if _, err := products.ListProducts(withAuth("admin:wrong"), &tinycrmpb.ListProductsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated with a wrong password, got %v", err)
+	}
+	if _, err := products.ListProducts(withAuth("admin:secret"), &tinycrmpb.ListProductsRequest{}); err != nil {
+		t.Errorf("Expected products with valid credentials, got %v", err)
+	}
+}
+
+// Store injection Tests
+
+// fakeCompanyStore serves companies from memory; calling any other store
+// method panics through the nil embedded Store
+type fakeCompanyStore struct {
+	Store
+	companies map[uint]Company
+}
+
+func (f *fakeCompanyStore) WithContext(ctx context.Context) Store {
+	return f
+}
+
+func (f *fakeCompanyStore) GetCompany(id uint) (*Company, error) {
+	company, ok := f.companies[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &company, nil
+}
+
+func TestHandlerWithFakeStore(t *testing.T) {
+	store := &fakeCompanyStore{companies: map[uint]Company{7: {ID: 7, Name: "Fake Company"}}}
+	handler := setupRoutes(NewHandler(store), true)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", routePath(pathCompany, 7), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", recorder.Code, recorder.Body.String())
+	}
+	var company Company
+	if err := json.Unmarshal(recorder.Body.Bytes(), &company); err != nil {
+		t.Fatalf("Failed to unmarshal company: %v", err)
+	}
+	if company.Name != "Fake Company" {
+		t.Errorf("Expected the company from the fake store, got %+v", company)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", routePath(pathCompany, 8), nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", recorder.Code)
+	}
+}
+
+// Error handling tests
+func TestCompanyGetInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompany, "invalid"), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestCompanyGetNotFound(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathCompany, 99999), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestCompanyCreateMalformedJSON(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "POST", pathCompanies, `{"name": "Test", invalid json}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestCompanyUpdateInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	companyData := `{"name": "Updated Company", "document": "987654321", "address": "Updated Address"}`
+	resp, body, err := makeRequest(server, "PUT", routePath(pathCompany, "invalid"), companyData)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestCompanyDeleteInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "DELETE", routePath(pathCompany, "invalid"), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestProductGetInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathProduct, "invalid"), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestProductGetNotFound(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathProduct, 99999), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestProductCreateMalformedJSON(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "POST", pathProducts, `{"name": "Test", invalid json}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestRemitInformationGetInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathRemit, "invalid"), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestRemitInformationGetNotFound(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathRemit, 99999), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestInvoiceGetInvalidID(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoice, "invalid"), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestInvoiceGetNotFound(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "GET", routePath(pathInvoice, 99999), "")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestInvoiceCreateMalformedJSON(t *testing.T) {
+	server, _ := setupTestServer(t)
+	defer server.Close()
+
+	resp, body, err := makeRequest(server, "POST", pathInvoices, `{"number": 1, invalid json}`)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+}
+
+// Schema drift tests
+func TestSchemaDrift(t *testing.T) {
+	testDB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	if err := testDB.AutoMigrate(schemaModels...); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	testRepo, err := NewRepositoryWithDB(testDB)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+
+	drift, err := testRepo.SchemaDrift()
+	if err != nil {
+		t.Fatalf("Failed to compare schema: %v", err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("Expected no drift after migration, got %v", drift)
+	}
+
+	if err := testDB.Migrator().DropIndex(&User{}, "idx_users_username"); err != nil {
+		t.Fatalf("Failed to drop index: %v", err)
+	}
+	if err := testDB.Migrator().DropTable(&InvoiceLine{}); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+
+	drift, err = testRepo.SchemaDrift()
+	if err != nil {
+		t.Fatalf("Failed to compare schema: %v", err)
+	}
+
+	expected := map[string]bool{
+		"missing index idx_users_username on users": false,
+		"missing table invoice_lines":               false,
+	}
+	for _, line := range drift {
+		if _, ok := expected[line]; ok {
+			expected[line] = true
+		}
+	}
+	for line, found := range expected {
+		if !found {
+			t.Errorf("Expected drift %q, got %v", line, drift)
+		}
+	}
+}
+
+func TestTemplateVersioning(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	templatePath := filepath.Join("templates", "invoices", "versioned_test_invoice.html")
+	if err := os.WriteFile(templatePath, []byte(`v1 {{.Template.FooterText}}`), 0644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(templatePath) })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", routePath(pathCompanyInvoiceTemplates, companyID),
+		`{"name": "Versioned", "base_template": "versioned_test_invoice.html", "footer_text": "Net 30"}`)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create invoice template: %v %s", err, body)
+	}
+	var invoiceTemplate InvoiceTemplate
+	json.Unmarshal(body, &invoiceTemplate)
+	templateURL := routePath(pathInvoiceTemplate, invoiceTemplate.ID)
+
+	invoiceData := fmt.Sprintf(`{"number": %%d, "due_date": "2030-01-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_template_id": %d, "invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, invoiceTemplate.ID, productID)
+	var invoices []Invoice
+	for number := 1; number <= 2; number++ {
+		resp, body, err := makeRequest(server, "POST", pathInvoices, fmt.Sprintf(invoiceData, number))
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create invoice: %v %s", err, body)
+		}
+		var invoice Invoice
+		json.Unmarshal(body, &invoice)
+		invoices = append(invoices, invoice)
+	}
+
+	if resp, body, _ := makeRequest(server, "POST", routePath(pathInvoiceSend, invoices[0].ID), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to send invoice: %d %s", resp.StatusCode, body)
+	}
+	_, original, _ := makeRequest(server, "GET", routePath(pathInvoicePreview, invoices[0].ID), "")
+	if string(original) != "v1 Net 30" {
+		t.Fatalf("Expected the first version, got %q", original)
+	}
+
+	// Both the file and the stored settings change after the invoice was sent
+	if err := os.WriteFile(templatePath, []byte(`v2 {{.Template.FooterText}}`), 0644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+	resp, body, _ = makeRequest(server, "PUT", templateURL,
+		`{"name": "Versioned", "base_template": "versioned_test_invoice.html", "footer_text": "Net 60"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	_, regenerated, _ := makeRequest(server, "GET", routePath(pathInvoicePreview, invoices[0].ID), "")
+	if string(regenerated) != string(original) {
+		t.Errorf("Expected the sent invoice to render as it did, got %q", regenerated)
+	}
+	_, draft, _ := makeRequest(server, "GET", routePath(pathInvoicePreview, invoices[1].ID), "")
+	if string(draft) != "v2 Net 60" {
+		t.Errorf("Expected the draft to follow the current template, got %q", draft)
+	}
+
+	resp, body, _ = makeRequest(server, "GET", routePath(pathInvoiceTemplateVersions, invoiceTemplate.ID), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var versions []InvoiceTemplateVersion
+	json.Unmarshal(body, &versions)
+	if len(versions) != 2 || versions[0].FooterText != "Net 30" || versions[1].Version != 2 {
+		t.Errorf("Expected two versions of the template, got %+v", versions)
+	}
+}
+
+func TestPasswordResetAndLockout(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+	fake := setupFakeMailer(t)
+
+	config.LoginLockoutAttempts, config.LoginLockoutMinutes = 3, 1
+	t.Cleanup(func() { config.LoginLockoutAttempts, config.LoginLockoutMinutes = 5, 1 })
+
+	passwordHash, _ := hashPassword("correct horse")
+	user := &User{Username: "carla", Email: "carla@example.com", PasswordHash: passwordHash}
+	if err := testRepo.CreateUser(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Three wrong passwords lock the account for a minute, the next one for two
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := authenticatedUser(testRepo, "carla", "wrong", now); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Expected invalid credentials, got %v", err)
+		}
+	}
+	if _, err := authenticatedUser(testRepo, "carla", "correct horse", now); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("Expected the account to be locked, got %v", err)
+	}
+	later := now.Add(61 * time.Second)
+	authenticatedUser(testRepo, "carla", "wrong", later)
+	locked, _ := testRepo.GetUser(user.ID)
+	if locked.LockedUntil == nil || !locked.LockedUntil.Equal(later.Add(2*time.Minute)) {
+		t.Errorf("Expected the lockout to double, got %v", locked.LockedUntil)
+	}
+
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := httptest.NewRequest("GET", pathCompanies, nil)
+	request.SetBasicAuth("carla", "correct horse")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status 429 with Retry-After, got %d", recorder.Code)
+	}
+
+	// Forcing a reset emails a link, the old password stops working
+	request = httptest.NewRequest("POST", routePath(pathUserForcePasswordReset, user.ID), nil)
+	recorder = httptest.NewRecorder()
+	setupRoutes(NewHandler(testRepo), true).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(fake.sent) != 1 || fake.sent[0].To[0] != "carla@example.com" {
+		t.Fatalf("Expected a reset email to carla, got %+v", fake.sent)
+	}
+	_, link, _ := strings.Cut(fake.sent[0].Body, "?token=")
+	token := strings.Fields(link)[0]
+
+	form := url.Values{"token": {token}, "password": {"battery staple"}}
+	request = httptest.NewRequest("POST", pathAuthPasswordReset, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the reset to succeed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if _, err := authenticatedUser(testRepo, "carla", "battery staple", time.Now()); err != nil {
+		t.Errorf("Expected the new password to sign in, got %v", err)
+	}
+	if _, err := testRepo.ResetPassword(token, passwordHash, time.Now()); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("Expected the token to work only once, got %v", err)
+	}
+
+	// Unknown users get the same answer, and no email
+	request = httptest.NewRequest("POST", pathAuthPasswordReset, strings.NewReader("username=nobody"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusAccepted || len(fake.sent) != 1 {
+		t.Errorf("Expected status 202 without an email, got %d and %d emails", recorder.Code, len(fake.sent))
+	}
+
+	events, err := testRepo.GetAuditEvents(AuditFilter{Username: "carla"})
+	if err != nil {
+		t.Fatalf("Failed to get audit events: %v", err)
+	}
+	actions := map[string]int{}
+	for _, event := range events {
+		actions[event.Action]++
+	}
+	if actions[AuditLoginFailed] != 4 || actions[AuditAccountLocked] != 2 || actions[AuditPasswordResetForced] != 1 ||
+		actions[AuditPasswordResetRequested] != 1 || actions[AuditPasswordReset] != 1 {
+		t.Errorf("Unexpected audit log %v", actions)
+	}
+
+	// Wrong passwords on a write route lock the account too, though its
+	// transaction is rolled back
+	dario := &User{Username: "dario", PasswordHash: passwordHash}
+	if err := testRepo.CreateUser(dario); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	write := func(password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", pathCompanies, strings.NewReader(`{"name": "Acme"}`))
+		request.SetBasicAuth("dario", password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	for i := 0; i < 3; i++ {
+		if resp := write("wrong"); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", resp.Code)
+		}
+	}
+	if resp := write("correct horse"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the account to be locked, got %d", resp.Code)
+	}
+	if locked, _ := testRepo.GetUser(dario.ID); locked.FailedLogins != 3 || locked.LockedUntil == nil {
+		t.Errorf("Expected the failed logins and the lockout kept, got %d %v", locked.FailedLogins, locked.LockedUntil)
+	}
+	if events, _ := testRepo.GetAuditEvents(AuditFilter{Username: "dario", Action: AuditAccountLocked}); len(events) != 1 {
+		t.Errorf("Expected the lockout audited, got %+v", events)
+	}
+}
+
+func TestNumberingStrategies(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	config.InvoiceNumbering = NumberingOnSend
+	t.Cleanup(func() { config.InvoiceNumbering, config.NumberingStrategy = NumberingManual, "sequential" })
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	client := &Company{Name: "Second Client", Document: "11.222.333/0001-44", Address: "Rua B, 2"}
+	if err := testRepo.CreateCompany(client); err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	send := func(clientID uint, issueDate string) *Invoice {
+		t.Helper()
+		invoiceData := fmt.Sprintf(`{"issue_date": "%s", "due_date": "2030-01-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+			"invoice_lines": [{"product_id": %d, "quantity": 1}]}`, issueDate, remitID, companyID, clientID, productID)
+		resp, body, err := makeRequest(server, "POST", pathInvoices, invoiceData)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create invoice: %v %s", err, body)
+		}
+		var draft Invoice
+		json.Unmarshal(body, &draft)
+		invoice, err := testRepo.SendInvoice(draft.ID, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to send invoice: %v", err)
+		}
+		return invoice
+	}
+
+	config.NumberingStrategy = "yearly"
+	var codes []string
+	for _, issueDate := range []string{"2024-12-30T00:00:00Z", "2024-12-31T00:00:00Z", "2025-01-02T00:00:00Z"} {
+		codes = append(codes, send(companyID, issueDate).Identification())
+	}
+	if strings.Join(codes, " ") != "2024-0001 2024-0002 2025-0001" {
+		t.Errorf("Expected the numbers to restart every year, got %v", codes)
+	}
+
+	config.NumberingStrategy = "per_client"
+	codes = nil
+	for _, clientID := range []uint{companyID, client.ID, companyID} {
+		codes = append(codes, send(clientID, "2025-03-01T00:00:00Z").Identification())
+	}
+	expected := fmt.Sprintf("C%d-0001 C%d-0001 C%d-0002", companyID, client.ID, companyID)
+	if strings.Join(codes, " ") != expected {
+		t.Errorf("Expected a series per client %s, got %v", expected, codes)
+	}
+
+	config.NumberingStrategy = "random"
+	invoice := send(companyID, "2025-03-01T00:00:00Z")
+	code := strings.Replace(invoice.Code, "-", "", 1)
+	if invoice.Number != nil || len(code) != 8 || strings.Trim(code, codeAlphabet) != "" || invoice.Code[4] != '-' {
+		t.Errorf("Expected an unnumbered random code, got %v %q", invoice.Number, invoice.Code)
+	}
+
+	// The code survives edits of the sent invoice
+	resp, body, _ := makeRequest(server, "PUT", routePath(pathInvoice, invoice.ID)+"?override=true", fmt.Sprintf(`{"code": "MINE", "due_date": "2030-01-01T00:00:00Z",
+		"remit_information_id": %d, "company_id": %d, "client_id": %d, "invoice_lines": [{"product_id": %d, "quantity": 2}]}`, remitID, companyID, companyID, productID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if updated, _ := testRepo.GetInvoice(invoice.ID); updated.Code != invoice.Code {
+		t.Errorf("Expected the code %s to be kept, got %s", invoice.Code, updated.Code)
+	}
+
+	config.NumberingStrategy = "base36"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown numbering strategy to be rejected")
+	}
+}
+
+func TestLoginAttemptBlocking(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	config.IPBlockAttempts = 3
+	t.Cleanup(func() { config.IPBlockAttempts = 20 })
+
+	for _, user := range []struct {
+		name  string
+		admin bool
+	}{{"root", true}, {"dora", false}} {
+		passwordHash, _ := hashPassword("secret")
+		if err := testRepo.CreateUser(&User{Username: user.name, PasswordHash: passwordHash, IsAdmin: user.admin}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := func(method, path, ip, username, password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		request.RemoteAddr = ip + ":51234"
+		request.SetBasicAuth(username, password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := request("GET", pathCompanies, "203.0.113.7", "admin", "guess"); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", resp.Code)
+		}
+	}
+	// Blocked even with the right credentials, other addresses aren't
+	if resp := request("GET", pathCompanies, "203.0.113.7", "dora", "secret"); resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the address to be blocked, got %d", resp.Code)
+	}
+	if resp := request("GET", pathCompanies, "198.51.100.2", "dora", "secret"); resp.Code != http.StatusOK {
+		t.Errorf("Expected another address to get through, got %d", resp.Code)
+	}
+
+	if resp := request("GET", pathAdminLoginAttempts, "198.51.100.2", "dora", "secret"); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a non administrator, got %d", resp.Code)
+	}
+	resp := request("GET", pathAdminLoginAttempts+"?ip=203.0.113.7", "198.51.100.2", "root", "secret")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var report struct {
+		Attempts   []LoginAttempt `json:"attempts"`
+		BlockedIPs []BlockedIP    `json:"blocked_ips"`
+	}
+	json.Unmarshal(resp.Body.Bytes(), &report)
+	if len(report.Attempts) != 3 || report.Attempts[0].Username != "admin" {
+		t.Errorf("Expected the three failed attempts, got %+v", report.Attempts)
+	}
+	if len(report.BlockedIPs) != 1 || report.BlockedIPs[0].IP != "203.0.113.7" {
+		t.Errorf("Expected the address to be listed as blocked, got %+v", report.BlockedIPs)
+	}
+
+	// The failures on a write route outlive its rolled back transaction
+	for i := 0; i < 3; i++ {
+		if resp := request("POST", pathCompanies, "203.0.113.8", "admin", "guess"); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", resp.Code)
+		}
+	}
+	if resp := request("POST", pathCompanies, "203.0.113.8", "admin", "guess"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to be blocked after failing on a write route, got %d", resp.Code)
+	}
+	if count, _ := testRepo.CountLoginAttempts("203.0.113.8", time.Now().Add(-time.Hour)); count != 3 {
+		t.Errorf("Expected the three failed attempts recorded, got %d", count)
+	}
+}
+
+func TestDebugSQL(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	for _, user := range []struct {
+		name  string
+		admin bool
+	}{{"root", true}, {"dora", false}} {
+		passwordHash, _ := hashPassword("secret")
+		if err := testRepo.CreateUser(&User{Username: user.name, PasswordHash: passwordHash, IsAdmin: user.admin}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := func(method, path, username string, body string, header http.Header) *http.Response {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		request.SetBasicAuth(username, "secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+
+	resp := request("GET", pathCompanies+"?debug_sql=1", "root", "", nil)
+	queries := resp.Trailer.Values("X-Debug-SQL")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(strings.Join(queries, "\n"), "FROM `companies`") {
+		t.Errorf("Expected the queries in the trailer, got %d %v", resp.StatusCode, queries)
+	}
+	if resp.Trailer.Get("X-Debug-SQL-Count") != strconv.Itoa(len(queries)) {
+		t.Errorf("Expected the count of %d queries, got %s", len(queries), resp.Trailer.Get("X-Debug-SQL-Count"))
+	}
+
+	// Writes run in the request transaction, the recorder follows them
+	resp = request("POST", pathCompanies, "root", `{"name": "Traced", "document": "1", "address": "Somewhere"}`,
+		http.Header{"X-Debug-Sql": {"1"}})
+	queries = resp.Trailer.Values("X-Debug-SQL")
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(strings.Join(queries, "\n"), "INSERT INTO `companies`") {
+		t.Errorf("Expected the insert in the trailer, got %d %v", resp.StatusCode, queries)
+	}
+
+	if resp := request("GET", pathCompanies+"?debug_sql=1", "dora", "", nil); len(resp.Trailer.Values("X-Debug-SQL")) != 0 {
+		t.Errorf("Expected no SQL for a non administrator, got %v", resp.Trailer)
+	}
+	if resp := request("GET", pathCompanies, "root", "", nil); len(resp.Trailer.Values("X-Debug-SQL")) != 0 {
+		t.Errorf("Expected no SQL unless asked for, got %v", resp.Trailer)
+	}
+}
+
+func TestSimulatedClock(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	resp, _, _ := makeRequest(server, "POST", pathAdminClock, `{"advance": "24h"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected the system clock to stay put, got %d", resp.StatusCode)
+	}
+
+	simulated := setupSimulatedClock(t, time.Date(2025, 1, 10, 9, 0, 0, 0, time.UTC))
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "POST", pathInvoices, fmt.Sprintf(`{"due_date": "2025-01-20T00:00:00Z", "remit_information_id": %d,
+		"company_id": %d, "client_id": %d, "invoice_lines": [{"product_id": %d, "quantity": 1}]}`, remitID, companyID, companyID, productID))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create invoice: %v %s", err, body)
+	}
+	var invoice Invoice
+	json.Unmarshal(body, &invoice)
+	if !invoice.IssueDate.Equal(simulated.Now()) {
+		t.Errorf("Expected the invoice to be issued at the simulated time, got %v", invoice.IssueDate)
+	}
+
+	status := func() string {
+		t.Helper()
+		_, body, _ := makeRequest(server, "GET", pathInvoices, "")
+		var summaries []InvoiceSummary
+		json.Unmarshal(body, &summaries)
+		if len(summaries) != 1 {
+			t.Fatalf("Expected one invoice, got %s", body)
+		}
+		return summaries[0].Status
+	}
+	if status() != InvoiceStatusOpen {
+		t.Errorf("Expected the invoice to be open before its due date")
+	}
+
+	resp, body, _ = makeRequest(server, "POST", pathAdminClock, `{"advance": "240h"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var state clockState
+	json.Unmarshal(body, &state)
+	if !state.Simulated || !state.Now.Equal(time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the clock to move ten days, got %+v", state)
+	}
+	if status() != InvoiceStatusOverdue {
+		t.Errorf("Expected the invoice to be overdue once the clock passed its due date")
+	}
+
+	resp, _, _ = makeRequest(server, "POST", pathAdminClock, `{"now": "2025-01-15"}`)
+	if resp.StatusCode != http.StatusOK || status() != InvoiceStatusOpen {
+		t.Errorf("Expected setting the clock back to reopen the invoice, got %d", resp.StatusCode)
+	}
+}
+
+func TestFactory(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+	setupSimulatedClock(t, time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	invoices, err := seed(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+
+	paid := map[InvoiceState]Money{}
+	for i, state := range []InvoiceState{InvoiceDraft, InvoiceSent, InvoicePartiallyPaid, InvoicePaid, InvoiceOverdue} {
+		invoice := invoices[i]
+		if invoice.Draft() != (state == InvoiceDraft) {
+			t.Errorf("Expected the %s invoice to be a draft only when asked for, sent at %v", state, invoice.SentAt)
+		}
+		if (state == InvoiceOverdue) != invoice.DueDate.Before(clock.Now()) {
+			t.Errorf("Expected only the overdue invoice to be past due, %s is due %v", state, invoice.DueDate)
+		}
+		if invoice.Paid != (state == InvoicePaid) {
+			t.Errorf("Expected only the paid invoice to be paid, %s is %v", state, invoice.Paid)
+		}
+		paid[state], _ = testRepo.GetPaidAmount(invoice.ID)
+		if paid[state] > 0 && state != InvoicePaid && state != InvoicePartiallyPaid {
+			t.Errorf("Unexpected payment of %.2f on the %s invoice", paid[state], state)
+		}
+	}
+	if partial := invoices[2]; paid[InvoicePartiallyPaid] != partial.TotalAmount.Per(2) {
+		t.Errorf("Expected half of %.2f paid, got %.2f", partial.TotalAmount, paid[InvoicePartiallyPaid])
+	}
+
+	// Every invoice gets its own records unless told otherwise
+	f := NewFactory(testRepo)
+	first, err := f.Invoice(InvoiceDraft)
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	second, err := f.Invoice(InvoiceDraft, func(invoice *Invoice) { invoice.ClientID = first.ClientID })
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if second.ClientID != first.ClientID || second.CompanyID == first.CompanyID || second.Client.Name == second.Company.Name {
+		t.Errorf("Expected a shared client and separate issuers, got %+v and %+v", first.ClientID, second.CompanyID)
+	}
+	if first.TotalAmount != moneyFromFloat(100) || len(first.InvoiceLines) != 1 {
+		t.Errorf("Expected a single line of 100, got %.2f over %d lines", first.TotalAmount, len(first.InvoiceLines))
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	setupSimulatedClock(t, time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	resp, body, err := makeRequest(server, "GET", pathRoot, "")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Request.URL.Path != pathDashboard {
+		t.Fatalf("Expected the root to lead to the dashboard, got %v %v", resp, err)
+	}
+	if !strings.Contains(string(body), "No invoices yet") {
+		t.Errorf("Expected an empty dashboard, got %s", body)
+	}
+
+	invoices, err := seed(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+	if _, err := NewFactory(testRepo).Product(func(p *Product) { p.Name = "Retired plan" }); err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+	retired, _ := testRepo.GetProducts(ProductFilter{})
+	if _, err := testRepo.SetProductArchived(retired[len(retired)-1].ID, true); err != nil {
+		t.Fatalf("Failed to archive product: %v", err)
+	}
+
+	data, err := GetDashboardData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to get dashboard data: %v", err)
+	}
+	if len(data.Companies) != 3 || len(data.Products) != 2 || len(data.RemitInformations) != 1 {
+		t.Errorf("Expected 3 companies, 2 products and 1 remit information, got %d, %d and %d",
+			len(data.Companies), len(data.Products), len(data.RemitInformations))
+	}
+	if len(data.RecentInvoices) != 5 || data.RecentInvoices[0].ID != invoices[4].ID {
+		t.Errorf("Expected the 5 invoices latest first, got %+v", data.RecentInvoices)
+	}
+	overdue := invoices[4]
+	if data.Stats.Invoices.Count != 5 || data.Stats.Overdue != 1 || data.Stats.OverdueAmount != overdue.TotalAmount || data.Stats.Open != 3 {
+		t.Errorf("Expected 5 invoices, 3 open and the overdue one of %.2f, got %+v", overdue.TotalAmount, data.Stats)
+	}
+
+	_, body, err = makeRequest(server, "GET", pathDashboard, "")
+	if err != nil {
+		t.Fatalf("Failed to get dashboard: %v", err)
+	}
+	for _, expected := range []string{"Globex", "Consulting hour", "Main account", "overdue", "#4", fmt.Sprintf("%.2f", overdue.TotalAmount)} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %q on the dashboard", expected)
+		}
+	}
+	if strings.Contains(string(body), "Retired plan") {
+		t.Error("Expected archived products off the dashboard")
+	}
+}
+
+func TestReadModelCache(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	f := NewFactory(testRepo)
+	invoice, err := f.Invoice(InvoiceSent)
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+
+	overviewPath := routePath(pathCompanyOverview, invoice.ClientID)
+	for _, path := range []string{pathDashboard, overviewPath} {
+		resp, _, err := makeRequest(server, "GET", path, "")
+		if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Read-Model-Cache") != "miss" {
+			t.Fatalf("%s: expected a computed read model, got %v %v", path, resp, err)
+		}
+		if resp.Header.Get("Cache-Control") != "private, no-cache" || resp.Header.Get("Age") == "" {
+			t.Errorf("%s: expected the cache headers, got %v", path, resp.Header)
+		}
+	}
+	// Off the report cache, the overview is still the cached read model
+	overview, err := testRepo.GetCompanyOverview(invoice.ClientID)
+	if err != nil || !overview.Cache.Hit || overview.Invoices != 1 {
+		t.Fatalf("Expected the cached overview, got %+v %v", overview, err)
+	}
+	resp, _, _ := makeRequest(server, "GET", pathDashboard, "")
+	if resp.Header.Get("X-Read-Model-Cache") != "hit" {
+		t.Errorf("Expected the cached dashboard, got %q", resp.Header.Get("X-Read-Model-Cache"))
+	}
+
+	// A write made off the requests, like a job's, drops them
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: invoice.Total(), Date: clock.Now()}); err != nil {
+		t.Fatalf("Failed to add payment: %v", err)
+	}
+	overview, err = testRepo.GetCompanyOverview(invoice.ClientID)
+	if err != nil || overview.Cache.Hit || overview.Received != invoice.Total() {
+		t.Errorf("Expected the overview computed with the payment, got %+v %v", overview, err)
+	}
+	summary, err := testRepo.GetDashboardSummary()
+	if err != nil || summary.Cache.Hit || summary.Stats.Open != 0 {
+		t.Errorf("Expected the dashboard computed with the payment, got %+v %v", summary, err)
+	}
+
+	// Without a TTL they are computed every time
+	originalTTL := config.Reports.ReadModelTTL
+	config.Reports.ReadModelTTL = 0
+	defer func() { config.Reports.ReadModelTTL = originalTTL }()
+	for i := 0; i < 2; i++ {
+		if summary, err := testRepo.GetDashboardSummary(); err != nil || summary.Cache.Hit {
+			t.Errorf("Expected an uncached dashboard, got %+v %v", summary, err)
+		}
+	}
+}
+
+func TestRouteManifest(t *testing.T) {
+	handler := setupRoutes(NewHandler(nil), true)
+	mux := http.NewServeMux()
+	for _, route := range routes(NewHandler(nil), true) {
+		mux.HandleFunc(route.Pattern, route.Handler)
+	}
+
+	// Every route is reached by its own path
+	for _, route := range routes(NewHandler(nil), true) {
+		method, path, found := strings.Cut(route.Pattern, " ")
+		if !found {
+			method, path = "GET", route.Pattern
+		}
+		req := httptest.NewRequest(method, routeWildcard.ReplaceAllString(path, "1"), nil)
+		if _, pattern := mux.Handler(req); pattern != route.Pattern {
+			t.Errorf("Expected %s %s to reach %q, got %q", method, req.URL.Path, route.Pattern, pattern)
+		}
+	}
+
+	// The tests fill the wildcards in order
+	if path := routePath(pathCompanyPortalUser, 3, 7); path != "/api/companies/3/portal_users/7" {
+		t.Errorf("Expected the wildcards filled, got %s", path)
+	}
+
+	// Paths off the manifest are not found rather than answered blank
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/company/1", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown path to be not found, got %d", recorder.Code)
+	}
+}
+
+func TestInvoiceBuilder(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	client, _ := f.Company()
+	remit, _ := f.RemitInformation()
+	consulting, _ := f.Product(func(p *Product) { p.Name, p.Price = "Consulting hour", moneyFromFloat(150) })
+	support, _ := f.Product(func(p *Product) { p.Name, p.Price = "Support plan", moneyFromFloat(990) })
+	retainer, _ := f.Product(func(p *Product) { p.Name = "Consulting retainer" })
+	if _, err := testRepo.SetProductArchived(retainer.ID, true); err != nil {
+		t.Fatalf("Failed to archive product: %v", err)
+	}
+
+	postForm := func(path string, form url.Values) (*http.Response, string) {
+		resp, err := http.PostForm(server.URL+path, form)
+		if err != nil {
+			t.Fatalf("Failed to post %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathNewInvoice, "")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body), issuer.Name) || !strings.Contains(string(body), remit.Name) {
+		t.Fatalf("Expected the builder with the companies and remit information, got %v %s", err, body)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathProductSearch+"?q=consult", "")
+	if !strings.Contains(string(body), fmt.Sprintf(`<option value="%d">Consulting hour (150.00)</option>`, consulting.ID)) ||
+		strings.Contains(string(body), "Support plan") || strings.Contains(string(body), "retainer") {
+		t.Errorf("Expected only the active consulting product, got %s", body)
+	}
+	if _, body, _ = makeRequest(server, "GET", pathProductSearch+"?q=nothing", ""); !strings.Contains(string(body), "No products match") {
+		t.Errorf("Expected no products, got %s", body)
+	}
+
+	resp, line := postForm(pathNewInvoiceLines, url.Values{"add_product_id": {fmt.Sprint(support.ID)}, "add_quantity": {"2"}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("HX-Trigger") != "linesChanged" ||
+		!strings.Contains(line, fmt.Sprintf(`name="product_id" value="%d"`, support.ID)) || !strings.Contains(line, "1980.00") {
+		t.Errorf("Expected a line of 2 support plans, got %d %s", resp.StatusCode, line)
+	}
+	if resp, _ := postForm(pathNewInvoiceLines, url.Values{}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a line without product to be refused, got %d", resp.StatusCode)
+	}
+
+	form := url.Values{
+		"company_id":    {fmt.Sprint(issuer.ID)},
+		"client_id":     {fmt.Sprint(client.ID)},
+		"remit_id":      {fmt.Sprint(remit.ID)},
+		"issue_date":    {"2025-03-01"},
+		"due_date":      {"2025-03-31"},
+		"discount":      {"10"},
+		"discount_type": {"percent"},
+		"product_id":    {fmt.Sprint(consulting.ID), fmt.Sprint(support.ID)},
+		"quantity":      {"4", "1"},
+	}
+	resp, totals := postForm(pathNewInvoiceTotal, form)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(totals, "1590.00") || !strings.Contains(totals, "159.00") || !strings.Contains(totals, "1431.00") {
+		t.Errorf("Expected a subtotal of 1590.00 less 159.00, got %d %s", resp.StatusCode, totals)
+	}
+
+	resp, _ = postForm(pathNewInvoice, form)
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(resp.Request.URL.Path, "/preview") {
+		t.Fatalf("Expected the preview of the new invoice, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+	invoices, _ := testRepo.GetInvoices(InvoiceFilter{})
+	if len(invoices) != 1 || len(invoices[0].InvoiceLines) != 2 || invoices[0].TotalAmount != moneyFromFloat(1431) || invoices[0].ClientID != client.ID {
+		t.Errorf("Expected the invoice of the form, got %+v", invoices)
+	}
+
+	delete(form, "remit_id")
+	if resp, _ := postForm(pathNewInvoice, form); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invoice without remit information to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+	fake := setupFakeMailer(t)
+	simulated := setupSimulatedClock(t, time.Date(2025, 3, 3, 17, 0, 0, 0, time.UTC))
+	originalNotifyEmail, originalDigest := config.NotifyEmail, config.Digest
+	config.NotifyEmail, config.Digest = "owner@example.com", DigestConfig{Enabled: true, Hour: 18}
+	t.Cleanup(func() { config.NotifyEmail, config.Digest = originalNotifyEmail, originalDigest })
+
+	today := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	f := NewFactory(testRepo)
+	issued, _ := f.Invoice(InvoiceDraft)
+	older, _ := f.Invoice(InvoiceSent, func(invoice *Invoice) {
+		invoice.IssueDate, invoice.DueDate = today.AddDate(0, 0, -20), today.AddDate(0, 0, 10)
+	})
+	if _, err := f.Payment(older, moneyFromFloat(40)); err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	overdue, _ := f.Invoice(InvoiceSent, func(invoice *Invoice) {
+		invoice.IssueDate, invoice.DueDate = today.AddDate(0, 0, -30), today
+	})
+	f.Invoice(InvoiceSent, func(invoice *Invoice) {
+		invoice.IssueDate, invoice.DueDate = today.AddDate(0, 0, -30), today.AddDate(0, 0, -1)
+	})
+
+	project := &Project{CompanyID: issued.ClientID, Name: "Website"}
+	if err := testRepo.CreateProject(project); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	tomorrow, later := today.AddDate(0, 0, 1).Add(9*time.Hour), today.AddDate(0, 0, 2)
+	for _, task := range []*Task{
+		{ProjectID: project.ID, Name: "Launch", Status: TaskOpen, DueDate: &tomorrow},
+		{ProjectID: project.ID, Name: "Design", Status: TaskDone, DueDate: &tomorrow},
+		{ProjectID: project.ID, Name: "Review", Status: TaskOpen, DueDate: &later},
+	} {
+		if err := testRepo.CreateTask(task); err != nil {
+			t.Fatalf("Failed to create task: %v", err)
+		}
+	}
+
+	// Before the digest hour nothing goes out
+	if sent, err := sendDigestIfDue(testRepo, clock.Now()); err != nil || sent || len(fake.sent) != 0 {
+		t.Fatalf("Expected no digest before 18:00, got %v %v", sent, err)
+	}
+
+	simulated.Advance(90 * time.Minute)
+	if sent, err := sendDigestIfDue(testRepo, clock.Now()); err != nil || !sent || len(fake.sent) != 1 {
+		t.Fatalf("Expected the digest at 18:30, got %v %v", sent, err)
+	}
+	email := fake.sent[0]
+	if email.To[0] != "owner@example.com" || email.Subject != "Tiny CRM digest - 2025-03-03" {
+		t.Errorf("Unexpected digest email %+v", email)
+	}
+	for _, expected := range []string{
+		"Invoices issued (1):\n- " + issued.UUID.String()[:8] + " to " + issued.Client.Name,
+		"Payments received (1):\n- 40.00 from " + older.Client.Name,
+		"Invoices gone overdue (1):\n- " + overdue.UUID.String()[:8],
+		"Tasks due tomorrow (1):\n- Launch (Website)",
+	} {
+		if !strings.Contains(email.Body, expected) {
+			t.Errorf("Expected %q in the digest:\n%s", expected, email.Body)
+		}
+	}
+
+	// Once a day
+	simulated.Advance(time.Hour)
+	if sent, err := sendDigestIfDue(testRepo, clock.Now()); err != nil || sent || len(fake.sent) != 1 {
+		t.Errorf("Expected a single digest a day, got %v %v", sent, err)
+	}
+	config.Digest.Enabled = false
+	simulated.Advance(24 * time.Hour)
+	if sent, _ := sendDigestIfDue(testRepo, clock.Now()); sent {
+		t.Error("Expected no digest when disabled")
+	}
+}
+
+func TestFormRequests(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	f := NewFactory(testRepo)
+	product, _ := f.Product(func(p *Product) { p.Price = moneyFromFloat(80) })
+
+	sendForm := func(method, path string, form url.Values) (*http.Response, []byte) {
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := sendForm("POST", pathCompanies, url.Values{
+		"name": {"Form Corp"}, "document": {"12345"}, "address": {"1 Form Street"},
+		"email": {"billing@form.example"}, "tags": {"vip", "retail"}, "is_issuer": {"on"}, "is_client": {"on"},
+	})
+	var company Company
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &company) != nil {
+		t.Fatalf("Expected the company created from the form, got %d %s", resp.StatusCode, body)
+	}
+	if company.Name != "Form Corp" || len(company.Tags) != 2 || company.Tags[0] != "vip" {
+		t.Errorf("Expected the form fields and the repeated tags, got %+v", company)
+	}
+
+	resp, body = sendForm("PUT", routePath(pathCompany, company.ID), url.Values{
+		"name": {"Form Corp Ltd"}, "document": {"12345"}, "address": {"2 Form Street"}, "is_issuer": {"on"},
+	})
+	if updated, _ := testRepo.GetCompany(company.ID); resp.StatusCode != http.StatusOK || updated.Name != "Form Corp Ltd" {
+		t.Errorf("Expected the company updated from the form, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = sendForm("POST", pathRemits, url.Values{
+		"name":            {"Form Bank"},
+		"lines[1][key]":   {"IBAN"},
+		"lines[1][value]": {"DE89 3704 0044"},
+		"lines[0][key]":   {"Bank"},
+		"lines[0][value]": {"Form Bank AG"},
+	})
+	var remit RemitInformation
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &remit) != nil {
+		t.Fatalf("Expected the remit information created from the form, got %d %s", resp.StatusCode, body)
+	}
+	if len(remit.Lines) != 2 || remit.Lines[0].Key != "Bank" || remit.Lines[1].Value != "DE89 3704 0044" {
+		t.Errorf("Expected the indexed lines in order, got %+v", remit.Lines)
+	}
+
+	resp, body = sendForm("POST", pathInvoices, url.Values{
+		"company_id":                   {fmt.Sprint(company.ID)},
+		"client_id":                    {fmt.Sprint(company.ID)},
+		"remit_information_id":         {fmt.Sprint(remit.ID)},
+		"issue_date":                   {"2025-03-01"},
+		"due_date":                     {"2025-03-31"},
+		"invoice_lines[0][product_id]": {fmt.Sprint(product.ID)},
+		"invoice_lines[0][quantity]":   {"3"},
+		"invoice_lines[0][discount]":   {""},
+	})
+	var invoice Invoice
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &invoice) != nil {
+		t.Fatalf("Expected the invoice created from the form, got %d %s", resp.StatusCode, body)
+	}
+	if len(invoice.InvoiceLines) != 1 || invoice.InvoiceLines[0].Quantity != 3 || invoice.Total() != moneyFromFloat(240) ||
+		invoice.DueDate.Format("2006-01-02") != "2025-03-31" {
+		t.Errorf("Expected a line of 3 products due 2025-03-31, got %+v", invoice)
+	}
+
+	resp, body = sendForm("POST", pathInvoices, url.Values{"invoice_lines[0][quantity]": {"three"}})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), `invalid quantity "three"`) {
+		t.Errorf("Expected a bad request for a quantity that isn't a number, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	f := NewFactory(testRepo)
+	company, _ := f.Company(func(c *Company) { c.Name, c.Tags = "Negotiated, Inc", Tags{"vip", "retail"} })
+
+	get := func(path string, headers map[string]string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get(pathCompanies, nil)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") || !strings.HasPrefix(body, "[") {
+		t.Errorf("Expected JSON by default, got %s %s", resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, body = get(pathCompanies+"?columns=name,tags", map[string]string{"Accept": "text/csv"})
+	if resp.Header.Get("Content-Type") != "text/csv" || !strings.Contains(resp.Header.Get("Content-Disposition"), "companies.csv") {
+		t.Errorf("Expected a CSV download, got %s %s", resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"))
+	}
+	if want := fmt.Sprintf("id,name,tags\n%d,\"Negotiated, Inc\",\"vip, retail\"\n", company.ID); body != want {
+		t.Errorf("Expected the chosen columns as CSV %q, got %q", want, body)
+	}
+
+	resp, body = get(pathCompanies, map[string]string{"HX-Request": "true"})
+	if resp.Header.Get("Content-Type") != "text/html" || !strings.Contains(body, `<table class="table" id="companies">`) ||
+		!strings.Contains(body, "<td>Negotiated, Inc</td>") || !strings.Contains(body, `<th scope="col">document</th>`) {
+		t.Errorf("Expected an HTML table for HTMX, got %s", body)
+	}
+
+	resp, body = get(routePath(pathCompany, company.ID), map[string]string{"Accept": "text/html;q=0.5, application/json"})
+	var decoded Company
+	if json.Unmarshal([]byte(body), &decoded) != nil || decoded.ID != company.ID {
+		t.Errorf("Expected the preferred JSON, got %s", body)
+	}
+	_, body = get(routePath(pathCompany, company.ID)+"?format=html", map[string]string{"Accept": "application/json"})
+	if !strings.Contains(body, `<dt class="col-sm-3">name</dt>`) || !strings.Contains(body, `<dd class="col-sm-9">Negotiated, Inc</dd>`) {
+		t.Errorf("Expected the format parameter to win with an HTML record, got %s", body)
+	}
+
+	invoice, _ := f.Invoice(InvoicePaid)
+	_, body = get(routePath(pathInvoicePayments, invoice.ID)+"?format=csv", nil)
+	if lines := strings.Split(strings.TrimSpace(body), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "id,") {
+		t.Errorf("Expected a header and a payment as CSV, got %q", body)
+	}
+
+	if resp, _ = get(pathProducts, map[string]string{"Accept": "application/xml"}); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for XML, got %d", resp.StatusCode)
+	}
+	if resp, _ = get(pathProducts+"?format=xml", nil); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 for the XML format, got %d", resp.StatusCode)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	company, _ := NewFactory(testRepo).Company()
+	path := routePath(pathCompany, company.ID)
+
+	send := func(method, path, body string, headers map[string]string) (*http.Response, string) {
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp, string(respBody)
+	}
+
+	resp, _ := send("GET", path, "", nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Expected an ETag, got %d %q", resp.StatusCode, etag)
+	}
+	resp, body := send("GET", path, "", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("Expected 304 without a body for the same ETag, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ = send("GET", path, "", map[string]string{"If-None-Match": `"stale", W/` + etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a weak match in a list, got %d", resp.StatusCode)
+	}
+	if resp, _ = send("GET", path, "", map[string]string{"If-None-Match": `"stale"`}); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for another ETag, got %d", resp.StatusCode)
+	}
+
+	update := func(name, ifMatch string) (*http.Response, string) {
+		body := fmt.Sprintf(`{"name": %q, "document": %q, "address": %q}`, name, company.Document, company.Address)
+		return send("PUT", path, body, map[string]string{"Content-Type": "application/json", "If-Match": ifMatch})
+	}
+	resp, body = update("Renamed once", etag)
+	newETag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || newETag == "" || newETag == etag {
+		t.Fatalf("Expected the update with the current ETag and a new ETag, got %d %q %s", resp.StatusCode, newETag, body)
+	}
+	if resp, _ = send("GET", path, "", map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != newETag {
+		t.Errorf("Expected the changed company with the ETag of the update, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// A second editor still holding the first ETag loses the race
+	if resp, _ = update("Renamed twice", etag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag, got %d", resp.StatusCode)
+	}
+	if updated, _ := testRepo.GetCompany(company.ID); updated.Name != "Renamed once" {
+		t.Errorf("Expected the stale update left out, got %q", updated.Name)
+	}
+	if resp, _ = update("Renamed twice", newETag); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the update with the fresh ETag, got %d", resp.StatusCode)
+	}
+	if resp, _ = send("DELETE", routePath(pathCompany, 999999), "", map[string]string{"If-Match": "*"}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 matching a missing company, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestIDAndTracing(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	company, _ := NewFactory(testRepo).Company()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	originalTracing := config.Tracing
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		config.Tracing = originalTracing
+	})
+
+	get := func(path string, headers map[string]string) *http.Response {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	first, second := get(pathCompanies, nil), get(pathCompanies, nil)
+	if id := first.Header.Get("X-Request-ID"); id == "" || id == second.Header.Get("X-Request-ID") {
+		t.Errorf("Expected a new request ID per request, got %q and %q", id, second.Header.Get("X-Request-ID"))
+	}
+	if resp := get(pathCompanies, map[string]string{"X-Request-ID": "proxy-42"}); resp.Header.Get("X-Request-ID") != "proxy-42" {
+		t.Errorf("Expected the request ID of the proxy, got %q", resp.Header.Get("X-Request-ID"))
+	}
+	if resp := get(pathCompanies, map[string]string{"X-Request-ID": "forged\tline"}); resp.Header.Get("X-Request-ID") == "forged\tline" {
+		t.Error("Expected a request ID with control characters replaced")
+	}
+	if resp := get(pathCompanies, nil); resp.Header.Get("traceparent") != "" {
+		t.Error("Expected no trace with tracing disabled")
+	}
+
+	failing := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is gone", http.StatusInternalServerError)
+	}))
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", pathCompanies, nil)
+	request.Header.Set("X-Request-ID", "req-500")
+	failing.ServeHTTP(recorder, request)
+	if body := recorder.Body.String(); body != "database is gone\nRequest ID: req-500\n" || !strings.Contains(logged.String(), "request_id=req-500") {
+		t.Errorf("Expected the internal error tagged and logged with the request ID, got %q and log %q", body, logged.String())
+	}
+
+	config.Tracing = TracingConfig{Enabled: true}
+	logged.Reset()
+	caller := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	resp := get(routePath(pathCompany, company.ID), map[string]string{"traceparent": caller, "X-Request-ID": "traced-1"})
+	traceID, spanID, ok := parseTraceparent(resp.Header.Get("traceparent"))
+	if !ok || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID == "00f067aa0ba902b7" {
+		t.Errorf("Expected the trace of the caller continued in a new span, got %q", resp.Header.Get("traceparent"))
+	}
+	if trace := logged.String(); !strings.Contains(trace, "Trace 4bf92f3577b34da6a3ce929d0e0e4736 span="+spanID+" request_id=traced-1 GET /api/companies/") ||
+		!strings.Contains(trace, "SQL SELECT * FROM `companies`") {
+		t.Errorf("Expected the trace logged with its queries, got %q", trace)
+	}
+
+	config.Tracing.SlowMS = 60000
+	logged.Reset()
+	if resp := get(pathCompanies, nil); resp.Header.Get("traceparent") == "" || strings.Contains(logged.String(), "Trace ") {
+		t.Errorf("Expected fast requests traced but not logged, got %q", logged.String())
+	}
+}
+
+func TestSettings(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	t.Cleanup(func() { cacheSettings(Settings{}) })
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	client, _ := f.Company(func(c *Company) { c.Email = "client@example.com" })
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+
+	resp, body, _ := makeRequest(server, "GET", pathSettings, "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"default_company_id":null`) {
+		t.Fatalf("Expected the empty settings, got %d %s", resp.StatusCode, body)
+	}
+
+	for _, invalid := range []string{`{"currency": "euro"}`, `{"locale": "fr"}`, `{"default_company_id": 999}`, `{"theme": "dark"}`} {
+		if resp, body, _ := makeRequest(server, "PUT", pathSettings, invalid); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d %s", invalid, resp.StatusCode, body)
+		}
+	}
+
+	settingsData := fmt.Sprintf(`{"default_company_id": %d, "default_remit_id": %d, "invoice_prefix": "INV-", "locale": "en", "currency": "EUR"}`, issuer.ID, remit.ID)
+	if resp, body, _ = makeRequest(server, "PUT", pathSettings, settingsData); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the settings saved, got %d %s", resp.StatusCode, body)
+	}
+	// Settings left out are kept
+	if resp, body, _ = makeRequest(server, "PUT", pathSettings, `{"pause_client_emails": true}`); resp.StatusCode != http.StatusOK ||
+		!strings.Contains(string(body), `"invoice_prefix":"INV-"`) {
+		t.Fatalf("Expected a partial update keeping the others, got %d %s", resp.StatusCode, body)
+	}
+
+	// The cache is rebuilt from the database on start up
+	cacheSettings(Settings{})
+	if err := loadSettings(testRepo); err != nil {
+		t.Fatalf("Failed to load settings: %v", err)
+	}
+	if s := currentSettings(); s.DefaultCompanyID == nil || *s.DefaultCompanyID != issuer.ID || s.Currency != "EUR" || !s.PauseClientEmails {
+		t.Errorf("Expected the stored settings, got %+v", s)
+	}
+
+	config.InvoiceNumbering = NumberingOnSend
+	t.Cleanup(func() { config.InvoiceNumbering = NumberingManual })
+	invoiceData := fmt.Sprintf(`{"client_id": %d, "due_date": "2030-01-01T00:00:00Z", "invoice_lines": [{"product_id": %d, "quantity": 1}]}`, client.ID, product.ID)
+	resp, body, _ = makeRequest(server, "POST", pathInvoices, invoiceData)
+	var invoice Invoice
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &invoice) != nil {
+		t.Fatalf("Expected the invoice created with the defaults, got %d %s", resp.StatusCode, body)
+	}
+	if invoice.CompanyID != issuer.ID || invoice.RemitInformationID != remit.ID {
+		t.Errorf("Expected the default issuer and remit information, got %d and %d", invoice.CompanyID, invoice.RemitInformationID)
+	}
+	if locale := invoice.EffectiveLocale(); locale != LocaleEn || locale.CurrencyCode() != "EUR" || locale.FormatMoney(moneyFromFloat(1234.5)) != "EUR 1,234.50" {
+		t.Errorf("Expected English in euros, got %s %s %s", locale, locale.CurrencyCode(), locale.FormatMoney(moneyFromFloat(1234.5)))
+	}
+
+	sent, err := testRepo.SendInvoice(invoice.ID, time.Now())
+	if err != nil || sent.Code != "INV-0001" {
+		t.Errorf("Expected the invoice coded with the prefix, got %v %+v", err, sent)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathCompanyStatementEmail, client.ID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "paused") {
+		t.Errorf("Expected the statement held back while client emails are paused, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestRemitLineOrderAndTemplates(t *testing.T) {
+	server, _ := setupTestServer(t)
+
+	lineKeys := func(remit RemitInformation) string {
+		keys := []string{}
+		for _, line := range remit.Lines {
+			keys = append(keys, fmt.Sprintf("%s:%d", line.Key, line.Position))
+		}
+		return strings.Join(keys, ",")
+	}
+	request := func(method, path, body string, status int) RemitInformation {
+		resp, respBody, err := makeRequest(server, method, path, body)
+		if err != nil || resp.StatusCode != status {
+			t.Fatalf("Expected %d for %s %s, got %v %d %s", status, method, path, err, resp.StatusCode, respBody)
+		}
+		var remit RemitInformation
+		json.Unmarshal(respBody, &remit)
+		return remit
+	}
+
+	template := request("POST", pathRemits, `{"name": "Bank template", "is_template": true, "lines": [
+		{"key": "IBAN", "value": "DE89", "position": 2}, {"key": "Bank", "value": "Acme Bank", "position": 1}, {"key": "BIC", "value": "ACMEDEFF", "position": 3}]}`, http.StatusCreated)
+	if got := lineKeys(template); got != "Bank:1,IBAN:2,BIC:3" {
+		t.Fatalf("Expected the lines in the order of their positions, got %s", got)
+	}
+	if got := lineKeys(request("GET", routePath(pathRemit, template.ID), "", http.StatusOK)); got != "Bank:1,IBAN:2,BIC:3" {
+		t.Errorf("Expected the stored lines in order, got %s", got)
+	}
+
+	bank, iban, bic := template.Lines[0].ID, template.Lines[1].ID, template.Lines[2].ID
+	reordered := request("PUT", routePath(pathRemitLinesOrder, template.ID), fmt.Sprintf(`{"line_ids": [%d, %d, %d]}`, iban, bic, bank), http.StatusOK)
+	if got := lineKeys(reordered); got != "IBAN:1,BIC:2,Bank:3" {
+		t.Errorf("Expected the chosen order, got %s", got)
+	}
+	request("PUT", routePath(pathRemitLinesOrder, template.ID), fmt.Sprintf(`{"line_ids": [%d, %d]}`, iban, bic), http.StatusBadRequest)
+	moved := request("POST", routePath(pathRemitLineMove, template.ID, bank), `{"position": 1}`, http.StatusOK)
+	if got := lineKeys(moved); got != "Bank:1,IBAN:2,BIC:3" {
+		t.Errorf("Expected the bank moved first, got %s", got)
+	}
+	request("POST", routePath(pathRemitLineMove, template.ID, bank), `{"position": 4}`, http.StatusBadRequest)
+
+	clone := request("POST", routePath(pathRemitClone, template.ID), `{"name": "Acme Bank account"}`, http.StatusCreated)
+	if clone.ID == template.ID || clone.Name != "Acme Bank account" || clone.IsTemplate || lineKeys(clone) != "Bank:1,IBAN:2,BIC:3" {
+		t.Errorf("Expected a copy of the template with its lines in order, got %+v", clone)
+	}
+	if clone.Lines[0].ID == bank {
+		t.Error("Expected the clone to have lines of its own")
+	}
+	request("POST", routePath(pathRemitClone, 999999), "", http.StatusNotFound)
+
+	resp, body, _ := makeRequest(server, "GET", pathRemits+"?template=false", "")
+	var remits []RemitInformation
+	if json.Unmarshal(body, &remits); resp.StatusCode != http.StatusOK || len(remits) != 1 || remits[0].ID != clone.ID {
+		t.Errorf("Expected only the clone outside the templates, got %s", body)
+	}
+}
+
+func TestCompanyRoles(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	supplier, _ := f.Company(func(c *Company) { c.IsSupplier = true })
+	product, _ := f.Product()
+	remit, _ := f.RemitInformation()
+
+	resp, body, _ := makeRequest(server, "POST", pathCompanies, `{"name": "Roleless", "document": "1", "address": "Here"}`)
+	var client Company
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &client) != nil {
+		t.Fatalf("Expected the company created, got %d %s", resp.StatusCode, body)
+	}
+	if !client.IsClient || client.IsIssuer || client.IsSupplier {
+		t.Errorf("Expected a company without a role to be a client, got %+v", client)
+	}
+
+	for kind, want := range map[string]uint{"issuer": issuer.ID, "client": client.ID, "supplier": supplier.ID} {
+		var companies []Company
+		_, body, _ := makeRequest(server, "GET", pathCompanies+"?type="+kind, "")
+		if json.Unmarshal(body, &companies) != nil || len(companies) != 1 || companies[0].ID != want {
+			t.Errorf("Expected only company %d as %s, got %s", want, kind, body)
+		}
+	}
+	if resp, _, _ := makeRequest(server, "GET", pathCompanies+"?type=partner", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown type to be refused, got %d", resp.StatusCode)
+	}
+
+	invoiceData := func(companyID uint) string {
+		return fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d, "due_date": "2030-01-01T00:00:00Z", "invoice_lines": [{"product_id": %d, "quantity": 1}]}`,
+			companyID, client.ID, remit.ID, product.ID)
+	}
+	resp, body, _ = makeRequest(server, "POST", pathInvoices, invoiceData(client.ID))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "is not an issuer") {
+		t.Errorf("Expected an invoice issued by a client to be refused, got %d %s", resp.StatusCode, body)
+	}
+	resp, body, _ = makeRequest(server, "POST", pathInvoices, invoiceData(issuer.ID))
+	var invoice Invoice
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &invoice) != nil {
+		t.Fatalf("Expected the invoice of the issuer, got %d %s", resp.StatusCode, body)
+	}
+	resp, _, _ = makeRequest(server, "PUT", routePath(pathInvoice, invoice.ID), invoiceData(supplier.ID))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an update moving the invoice to a supplier to be refused, got %d", resp.StatusCode)
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathNewInvoice, "")
+	if page := string(body); strings.Count(page, issuer.Name) != 1 || strings.Count(page, client.Name) != 1 || strings.Contains(page, supplier.Name) {
+		t.Errorf("Expected the issuers and the clients apart in the builder, got %s", body)
+	}
+}
+
+func TestClientPortal(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	f := NewFactory(testRepo)
+	client, _ := f.Company(func(c *Company) { c.Name = "Portal Client" })
+	other, _ := f.Company()
+	sent, _ := f.Invoice(InvoiceSent, func(i *Invoice) { i.ClientID = client.ID })
+	paid, _ := f.Invoice(InvoicePaid, func(i *Invoice) { i.ClientID = client.ID })
+	draft, _ := f.Invoice(InvoiceDraft, func(i *Invoice) { i.ClientID = client.ID })
+	foreign, _ := f.Invoice(InvoiceSent, func(i *Invoice) { i.ClientID = other.ID })
+
+	path := routePath(pathCompanyPortalUsers, client.ID)
+	if resp, _, _ := makeRequest(server, "POST", path, `{"username": "ana", "password": "short"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a short password to be refused, got %d", resp.StatusCode)
+	}
+	resp, body, _ := makeRequest(server, "POST", path, `{"username": "ana", "email": "ana@client.example", "password": "portal-secret"}`)
+	var user User
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &user) != nil || user.CompanyID == nil || *user.CompanyID != client.ID {
+		t.Fatalf("Expected the client user of the company, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _, _ := makeRequest(server, "POST", path, `{"username": "ana", "password": "portal-secret"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a taken username to be refused, got %d", resp.StatusCode)
+	}
+	staffHash, _ := hashPassword("staff-secret")
+	if err := testRepo.CreateUser(&User{Username: "staff", PasswordHash: staffHash}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	portal := func(path, username, password string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, _ := portal(pathPortal, "ana", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected wrong credentials to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _ := portal(pathPortal, "staff", "staff-secret"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the portal to refuse staff users, got %d", resp.StatusCode)
+	}
+
+	resp, page := portal(pathPortal, "ana", "portal-secret")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(page, "Portal Client") ||
+		!strings.Contains(page, `href="`+routePath(pathPortalInvoice, sent.ID)+`"`) || !strings.Contains(page, shareLinkPath(sent)) ||
+		strings.Contains(page, routePath(pathPortalInvoice, draft.ID)+`"`) || strings.Contains(page, shareLinkPath(paid)) {
+		t.Errorf("Expected the sent invoices with the link to pay the open one, got %d %s", resp.StatusCode, page)
+	}
+
+	_, listed := portal(pathPortalInvoices, "ana", "portal-secret")
+	var invoices []PortalInvoice
+	if json.Unmarshal([]byte(listed), &invoices) != nil || len(invoices) != 2 || invoices[0].ID != sent.ID || invoices[1].Status != InvoiceStatusPaid {
+		t.Errorf("Expected the two invoices sent to the client, got %s", listed)
+	}
+
+	if resp, _ := portal(routePath(pathPortalInvoice, sent.ID), "ana", "portal-secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the invoice of the client, got %d", resp.StatusCode)
+	}
+	for _, invoice := range []*Invoice{draft, foreign} {
+		if resp, _ := portal(routePath(pathPortalInvoice, invoice.ID), "ana", "portal-secret"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected invoice %d to be hidden, got %d", invoice.ID, resp.StatusCode)
+		}
+	}
+
+	_, statementBody := portal(pathPortalStatement, "ana", "portal-secret")
+	var statement Statement
+	if json.Unmarshal([]byte(statementBody), &statement) != nil || statement.Company.ID != client.ID {
+		t.Errorf("Expected the statement of the client, got %s", statementBody)
+	}
+	for _, entry := range statement.Entries {
+		if entry.InvoiceID == draft.ID {
+			t.Errorf("Expected the draft off the statement, got %+v", entry)
+		}
+	}
+	if statement.ClosingBalance != sent.TotalAmount {
+		t.Errorf("Expected the sent invoice left to pay, got %.2f", statement.ClosingBalance)
+	}
+
+	// Client users only have the portal
+	handler := setupRoutes(NewHandler(testRepo), false)
+	request := httptest.NewRequest("GET", pathInvoices, nil)
+	request.SetBasicAuth("ana", "portal-secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected the API to refuse client users, got %d", recorder.Code)
+	}
+
+	if resp, _, _ := makeRequest(server, "DELETE", routePath(pathCompanyPortalUser, other.ID, user.ID), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the user of another company not to be found, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := makeRequest(server, "DELETE", routePath(pathCompanyPortalUser, client.ID, user.ID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the client user deleted, got %d", resp.StatusCode)
+	}
+	if _, body, _ := makeRequest(server, "GET", path, ""); strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("Expected no client users left, got %s", body)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	mail := setupFakeMailer(t)
+
+	failures := 0
+	registerJobHandler("test_flaky", func(store Store, payload json.RawMessage) error {
+		var request struct {
+			Fail int `json:"fail"`
+		}
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return err
+		}
+		if failures < request.Fail {
+			failures++
+			return fmt.Errorf("failure %d", failures)
+		}
+		return nil
+	})
+	registerJobHandler("test_panic", func(store Store, payload json.RawMessage) error { panic("broken") })
+	t.Cleanup(func() {
+		jobHandlersMu.Lock()
+		delete(jobHandlers, "test_flaky")
+		delete(jobHandlers, "test_panic")
+		jobHandlersMu.Unlock()
+	})
+	originalJobs := config.Jobs
+	config.Jobs.MaxAttempts = 3
+	t.Cleanup(func() { config.Jobs = originalJobs })
+
+	if _, err := enqueueJob(testRepo, "unknown", nil); err == nil {
+		t.Errorf("Expected a job without handler to be refused")
+	}
+	emailJob, _ := enqueueJob(testRepo, "email", &Email{To: []string{"client@example.com"}, Subject: "Queued"})
+	flaky, _ := enqueueJob(testRepo, "test_flaky", map[string]int{"fail": 2})
+	broken, _ := enqueueJob(testRepo, "test_panic", nil)
+	now := clock.Now()
+
+	if ran, err := runDueJobs(testRepo, now); err != nil || ran != 3 {
+		t.Fatalf("Expected the 3 jobs run, got %d (%v)", ran, err)
+	}
+	if len(mail.sent) != 1 || mail.sent[0].Subject != "Queued" {
+		t.Errorf("Expected the queued email sent, got %+v", mail.sent)
+	}
+	if job, _ := testRepo.GetJob(emailJob.ID); job.Status != JobDone || job.Attempts != 1 {
+		t.Errorf("Expected the email job done, got %+v", job)
+	}
+	job, _ := testRepo.GetJob(flaky.ID)
+	if job.Status != JobPending || job.LastError != "failure 1" || !job.RunAt.Equal(now.Add(30*time.Second)) {
+		t.Errorf("Expected the failed job due again in 30 seconds, got %+v", job)
+	}
+
+	// Nothing is due until the backoff is over, which doubles
+	if ran, _ := runDueJobs(testRepo, now.Add(29*time.Second)); ran != 0 {
+		t.Errorf("Expected no job due yet, got %d", ran)
+	}
+	runDueJobs(testRepo, now.Add(30*time.Second))
+	if job, _ := testRepo.GetJob(flaky.ID); job.Attempts != 2 || !job.RunAt.Equal(now.Add(90*time.Second)) {
+		t.Errorf("Expected the second attempt to back off a minute, got %+v", job)
+	}
+	runDueJobs(testRepo, now.Add(90*time.Second))
+	if job, _ := testRepo.GetJob(flaky.ID); job.Status != JobDone || job.Attempts != 3 {
+		t.Errorf("Expected the job done on its third attempt, got %+v", job)
+	}
+
+	runDueJobs(testRepo, now.Add(time.Hour))
+	runDueJobs(testRepo, now.Add(2*time.Hour))
+	resp, body, _ := makeRequest(server, "GET", pathAdminJobs+"?status=dead", "")
+	var dead []Job
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &dead) != nil || len(dead) != 1 || dead[0].ID != broken.ID ||
+		dead[0].Attempts != 3 || !strings.Contains(dead[0].LastError, "panicked: broken") {
+		t.Fatalf("Expected the panicking job in the dead letters, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _, _ := makeRequest(server, "GET", pathAdminJobs+"?status=lost", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown status to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathAdminJobRetry, broken.ID), "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"status":"pending"`) || !strings.Contains(string(body), `"attempts":0`) {
+		t.Errorf("Expected the dead job queued again, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _, _ := makeRequest(server, "POST", routePath(pathAdminJobRetry, emailJob.ID), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected only dead jobs to be retried, got %d", resp.StatusCode)
+	}
+
+	// A job left running by a stopped server is queued again
+	later := now.Add(3 * time.Hour)
+	claimed, _ := testRepo.ClaimJob(jobWorkerID, later)
+	if claimed.LeaseOwner != jobWorkerID || !claimed.LeaseExpiresAt.Equal(later.Add(jobLeaseTTL)) {
+		t.Errorf("Expected the job leased to the worker claiming it, got %+v", claimed)
+	}
+	if requeued, err := testRepo.RequeueRunningJobs(); err != nil || requeued != 1 {
+		t.Fatalf("Expected the running job requeued, got %d (%v)", requeued, err)
+	}
+	if job, _ := testRepo.GetJob(claimed.ID); job.Status != JobPending || job.Attempts != 0 || job.LeaseOwner != "" || job.LeaseExpiresAt != nil {
+		t.Errorf("Expected the interrupted attempt not to count, got %+v", job)
+	}
+
+	// Its lease keeps a job running until it expires, when another worker
+	// takes it over and the first can no longer record an outcome
+	claimed, _ = testRepo.ClaimJob(jobWorkerID, later)
+	if err := testRepo.RenewJobLease(claimed, later.Add(2*jobLeaseTTL)); err != nil {
+		t.Fatalf("Failed to renew the lease: %v", err)
+	}
+	if requeued, err := testRepo.RequeueExpiredJobs(later.Add(jobLeaseTTL + time.Second)); err != nil || requeued != 0 {
+		t.Errorf("Expected the renewed lease kept, got %d (%v)", requeued, err)
+	}
+	if requeued, err := testRepo.RequeueExpiredJobs(later.Add(3 * jobLeaseTTL)); err != nil || requeued != 1 {
+		t.Fatalf("Expected the expired lease requeued, got %d (%v)", requeued, err)
+	}
+	taken, _ := testRepo.ClaimJob("another instance", later.Add(3*jobLeaseTTL))
+	if taken == nil || taken.ID != claimed.ID {
+		t.Fatalf("Expected the job claimed again, got %+v", taken)
+	}
+	if err := testRepo.RenewJobLease(claimed, later.Add(4*jobLeaseTTL)); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Expected the lost lease not renewed, got %v", err)
+	}
+	if err := testRepo.FinishJob(claimed, nil, later); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("Expected the outcome of the lost lease refused, got %v", err)
+	}
+	if err := testRepo.FinishJob(taken, nil, later.Add(3*jobLeaseTTL)); err != nil {
+		t.Errorf("Expected the new owner to finish the job, got %v", err)
+	}
+	if job, _ := testRepo.GetJob(claimed.ID); job.Status != JobDone || job.LeaseOwner != "" {
+		t.Errorf("Expected the job done by its new owner, got %+v", job)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+	server := setupRedis(t, "secret")
+	ctx := context.Background()
+
+	if err := redisClient.Set(ctx, "greeting", "hello", 0).Err(); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	if value, err := redisClient.Get(ctx, "greeting").Result(); err != nil || value != "hello" {
+		t.Errorf("Expected the value set, got %q %v", value, err)
+	}
+	if err := redisClient.Incr(ctx, "greeting").Err(); err == nil {
+		t.Errorf("Expected the error answered")
+	}
+	if _, err := redisClient.Get(ctx, "missing").Result(); !errors.Is(err, redis.Nil) {
+		t.Errorf("Expected a missing key after an error, got %v", err)
+	}
+
+	// Sessions are found by every instance and ended on logout
+	ana := User{Username: "ana@example.com"}
+	if err := testRepo.CreateUser(&ana); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	session, err := newSession(ana.ID, time.Now().Add(time.Hour))
+	if userID, _ := server.Get("test:session:" + session); err != nil || strings.Contains(session, ".") || userID != strconv.Itoa(int(ana.ID)) {
+		t.Fatalf("Expected a session token kept in Redis, got %q %v", session, err)
+	}
+	request := httptest.NewRequest("GET", pathCompanies, nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	instances := []*Handler{NewHandler(testRepo), NewHandler(testRepo)}
+	for _, h := range instances {
+		h.oidc = &oidcProvider{}
+		if user := h.sessionUser(request); user == nil || user.ID != ana.ID {
+			t.Errorf("Expected every instance to find the session, got %+v", user)
+		}
+	}
+	instances[0].logout(httptest.NewRecorder(), request)
+	if user := instances[1].sessionUser(request); user != nil {
+		t.Errorf("Expected the session ended on logout, got %+v", user)
+	}
+
+	// An address blocked by an instance is turned away by the others
+	originalAttempts := config.IPBlockAttempts
+	config.IPBlockAttempts = 2
+	defer func() { config.IPBlockAttempts = originalAttempts }()
+	login := httptest.NewRequest("POST", pathCompanies, nil)
+	login.RemoteAddr = "203.0.113.9:4000"
+	instances[0].recordFailedLogin(login, "ana", ErrInvalidCredentials)
+	if _, blocked := instances[1].blocked.blockedUntil("203.0.113.9", time.Now()); blocked {
+		t.Fatal("Expected a single failure not to block")
+	}
+	instances[1].recordFailedLogin(login, "ana", ErrInvalidCredentials)
+	recorder := httptest.NewRecorder()
+	instances[0].ipBlockMiddleware(http.NotFoundHandler()).ServeHTTP(recorder, login)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the address blocked by the other instance, got %d", recorder.Code)
+	}
+	if blocked := instances[0].blocked.list(time.Now()); len(blocked) != 1 || blocked[0].IP != "203.0.113.9" {
+		t.Errorf("Expected the block listed, got %+v", blocked)
+	}
+
+	// Queuing wakes the workers, and only the running jobs without a lease
+	// are requeued
+	first, _ := enqueueJob(testRepo, "email", &Email{To: []string{"a@example.com"}})
+	second, _ := enqueueJob(testRepo, "email", &Email{To: []string{"b@example.com"}})
+	if wake, _ := server.List("test:jobs:wake"); len(wake) != 2 {
+		t.Errorf("Expected the workers woken, got %v", wake)
+	}
+	started := time.Now()
+	waitForJobs()
+	if time.Since(started) > 500*time.Millisecond {
+		t.Errorf("Expected the worker to wake at once, waited %s", time.Since(started))
+	}
+	now := clock.Now()
+	leased, _ := testRepo.ClaimJob(jobWorkerID, now)
+	testRepo.ClaimJob(jobWorkerID, now)
+	testRepo.RenewJobLease(leased, now.Add(2*jobLeaseTTL))
+	if requeued, err := requeueAbandonedJobs(testRepo, now.Add(jobLeaseTTL+time.Second)); err != nil || requeued != 1 {
+		t.Fatalf("Expected the job whose lease expired requeued, got %d %v", requeued, err)
+	}
+	if job, _ := testRepo.GetJob(first.ID); job.Status != JobRunning {
+		t.Errorf("Expected the leased job left running, got %s", job.Status)
+	}
+	if job, _ := testRepo.GetJob(second.ID); job.Status != JobPending {
+		t.Errorf("Expected the abandoned job pending, got %s", job.Status)
+	}
+	if requeued, _ := requeueAbandonedJobs(testRepo, now.Add(3*jobLeaseTTL)); requeued != 1 {
+		t.Errorf("Expected the job requeued once its lease expired, got %d", requeued)
+	}
+}
+
+func TestStatelessMode(t *testing.T) {
+	_, testRepo := setupTestServer(t)
+
+	// Attachments go to the bucket, by path at a custom endpoint
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	var authorizations []string
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if !strings.HasPrefix(r.URL.Path, "/files/") {
+			http.Error(w, "NoSuchBucket", http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/files/")
+		switch r.Method {
+		case http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+		case http.MethodGet, http.MethodHead:
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				w.Write(data)
+			}
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer s3.Close()
+	originalStorage := fileStorage
+	fileStorage = newS3FileStorage(S3Config{Bucket: "files", Region: "eu-west-1", Endpoint: s3.URL + pathRoot, AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	t.Cleanup(func() { fileStorage = originalStorage })
+
+	company := Company{Name: "Bucket Co"}
+	if err := testRepo.CreateCompany(&company); err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+	attachment, err := testRepo.CreateAttachment(&company.ID, "contract.pdf", "application/pdf", []byte("signed"))
+	if err != nil {
+		t.Fatalf("Failed to create attachment: %v", err)
+	}
+	if data, err := attachment.Read(); err != nil || string(data) != "signed" {
+		t.Errorf("Expected the attachment read from the bucket, got %q %v", data, err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("Expected one object in the bucket, got %d", len(objects))
+	}
+	for _, authorization := range authorizations {
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request") {
+			t.Errorf("Expected signed requests, got %q", authorization)
+		}
+	}
+	if err := testRepo.DeleteAttachment(attachment.ID); err != nil {
+		t.Fatalf("Failed to delete attachment: %v", err)
+	}
+	if _, err := fileStorage.Get(attachment.contentKey()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the object deleted, got %v", err)
+	}
+	if err := fileStorage.Delete(attachment.contentKey()); err != nil {
+		t.Errorf("Expected deleting a missing object to succeed, got %v", err)
+	}
+
+	// Every backend keeping state on the instance is reported at once
+	stateless := DefaultConfig()
+	stateless.Stateless = true
+	stateless.DemoClock = "2025-01-31"
+	err = stateless.Validate()
+	for _, problem := range []string{"DATABASE_DSN", "S3_BUCKET", "REDIS_URL", "SHARE_LINK_SECRET", "DEMO_CLOCK"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %s reported, got %v", problem, err)
+		}
+	}
+	stateless.DemoClock = ""
+	stateless.ShareLinkSecret = "shared"
+	stateless.Redis.URL = "redis://localhost:6379"
+	stateless.S3 = S3Config{Bucket: "files", Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	if err := stateless.Validate(); err == nil || strings.Contains(err.Error(), "S3_BUCKET") || !strings.Contains(err.Error(), "SQLite") {
+		t.Errorf("Expected only the database reported, got %v", err)
+	}
+
+	// A database replicated by LiteFS is shared, one in memory never is
+	originalMountInfo := mountInfoPath
+	mountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	t.Cleanup(func() { mountInfoPath = originalMountInfo })
+	mounts := "22 1 0:21 / / rw,relatime - ext4 /dev/sda1 rw\n" +
+		"48 22 0:42 / /var/lib/litefs\\040data rw,nosuid shared:25 - fuse.litefs litefs rw,user_id=0\n"
+	if err := os.WriteFile(mountInfoPath, []byte(mounts), 0o644); err != nil {
+		t.Fatalf("Failed to write the mounts: %v", err)
+	}
+	stateless.DatabaseDSN = "file:/var/lib/litefs data/tinycrm.db?_fk=1"
+	if err := stateless.Validate(); err != nil {
+		t.Errorf("Expected a fully shared config to validate, got %v", err)
+	}
+	stateless.DatabaseDSN = "/var/lib/tinycrm.db"
+	if err := stateless.Validate(); err == nil || !strings.Contains(err.Error(), "disk of this instance") {
+		t.Errorf("Expected a database on the instance's disk reported, got %v", err)
+	}
+	stateless.DatabaseDSN = "file::memory:?cache=shared"
+	if err := stateless.Validate(); err == nil || !strings.Contains(err.Error(), "memory of this instance") {
+		t.Errorf("Expected an in-memory database reported, got %v", err)
+	}
+
+	// Alone every scheduled run is this instance's
+	if !claimScheduledRun("digest", time.Minute) || !claimScheduledRun("digest", time.Minute) {
+		t.Errorf("Expected scheduled runs claimed without Redis")
+	}
+
+	// With Redis one instance runs each, and the caches and settings follow
+	// the writes of the others
+	server := setupRedis(t, "")
+	if !claimScheduledRun("digest", time.Minute) || claimScheduledRun("digest", time.Minute) {
+		t.Errorf("Expected the scheduled run claimed once")
+	}
+	if !claimScheduledRun("bank_poll", time.Minute) {
+		t.Errorf("Expected each task claimed on its own")
+	}
+
+	mark, known := currentDataMark()
+	if !known {
+		t.Fatalf("Expected the data version known")
+	}
+	server.Set("test:data_version", strconv.FormatInt(mark.shared+1, 10))
+	if now, _ := currentDataMark(); now == mark {
+		t.Errorf("Expected a write of another instance to change the data version")
+	}
+	dataWritten()
+	if now, _ := currentDataMark(); now.shared != mark.shared+2 {
+		t.Errorf("Expected a write announced to the other instances, got %d", now.shared)
+	}
+
+	settingsSaved()
+	if version, _ := server.Get("test:settings_version"); version != "1" {
+		t.Errorf("Expected the settings version bumped, got %q", version)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+
+	var received []Event
+	record := func(store Store, event Event) error {
+		received = append(received, event)
+		return nil
+	}
+	unsubscribes := []func(){
+		subscribe(EventInvoiceCreated, record),
+		subscribe(EventPaymentRecorded, record),
+		subscribe(EventInvoiceCreated, func(store Store, event Event) error { panic("broken integration") }),
+		subscribe(EventCompanyUpdated, func(store Store, event Event) error { return errors.New("sync down") }),
+		subscribe("*", func(store Store, event Event) error {
+			received = append(received, Event{Name: "*" + event.Name})
+			return nil
+		}),
+	}
+	registerJobHandler("test_sync", func(store Store, payload json.RawMessage) error { return nil })
+	unsubscribes = append(unsubscribes, subscribeJob(EventCompanyUpdated, "test_sync"))
+	t.Cleanup(func() {
+		for _, unsubscribe := range unsubscribes {
+			unsubscribe()
+		}
+		jobHandlersMu.Lock()
+		delete(jobHandlers, "test_sync")
+		jobHandlersMu.Unlock()
+	})
+
+	invoiceData := fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d, "due_date": "2030-01-01T00:00:00Z", "invoice_lines": [{"product_id": %d, "quantity": 2}]}`,
+		companyID, companyID, remitID, productID)
+	resp, body, _ := makeRequest(server, "POST", pathInvoices, invoiceData)
+	var invoice Invoice
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &invoice) != nil {
+		t.Fatalf("Expected the invoice created despite the failing handler, got %d %s", resp.StatusCode, body)
+	}
+	resp, _, _ = makeRequest(server, "POST", routePath(pathInvoicePayments, invoice.ID), `{"amount": 50}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the payment recorded, got %d", resp.StatusCode)
+	}
+	resp, _, _ = makeRequest(server, "PUT", routePath(pathCompany, companyID), `{"name": "Renamed Ltd", "document": "1", "address": "Here", "is_issuer": true}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the company updated despite the failing handler, got %d", resp.StatusCode)
+	}
+
+	var names []string
+	for _, event := range received {
+		names = append(names, event.Name)
+	}
+	if strings.Join(names, " ") != "invoice.created *invoice.created payment.recorded *payment.recorded *company.updated" {
+		t.Fatalf("Expected the events in order, got %v", names)
+	}
+	if created, ok := received[0].Data.(*Invoice); !ok || created.ID != invoice.ID || received[0].At.IsZero() {
+		t.Errorf("Expected the created invoice as the event data, got %+v", received[0])
+	}
+	if payment, ok := received[2].Data.(*Payment); !ok || payment.Amount != moneyFromFloat(50) {
+		t.Errorf("Expected the payment as the event data, got %+v", received[2])
+	}
+
+	jobs, _ := testRepo.GetJobs(JobFilter{Kind: "test_sync"})
+	if len(jobs) != 1 || !strings.Contains(jobs[0].Payload, `"name":"company.updated"`) || !strings.Contains(jobs[0].Payload, `"Renamed Ltd"`) {
+		t.Errorf("Expected a job queued with the event, got %+v", jobs)
+	}
+
+	// Unsubscribed handlers are no longer called
+	unsubscribes[0]()
+	received = nil
+	if _, err := NewFactory(testRepo).Invoice(InvoiceDraft); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if len(received) != 1 || received[0].Name != "*invoice.created" {
+		t.Errorf("Expected only the catch-all handler, got %+v", received)
+	}
+}
+
+func TestInvoiceNFSe(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	client, err := NewFactory(testRepo).Company(func(c *Company) {
+		c.Name, c.Document, c.Email = "Cliente & Filhos", "123.456.789-09", "cliente@example.com"
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	sentAt := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	invoice := Invoice{
+		Number:             intPtr(12),
+		Locale:             LocalePtBR,
+		IssueDate:          sentAt,
+		DueDate:            sentAt.AddDate(0, 0, 30),
+		Discount:           1000,
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           client.ID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 3}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create test invoice: %v", err)
+	}
+	testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("sent_at", sentAt)
+	endpoint := routePath(pathInvoiceNFSe, invoice.ID)
+
+	resp, body, _ := makeRequest(server, "GET", endpoint, "")
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), "municipality_code") {
+		t.Fatalf("Expected the export refused until configured, got %d %s", resp.StatusCode, body)
+	}
+
+	originalNFSe := config.NFSe
+	config.NFSe = NFSeConfig{Provider: "abrasf", MunicipalityCode: "3550308", ServiceCode: "01.07", ISSRate: 5, RPSSeries: "A"}
+	t.Cleanup(func() { config.NFSe = originalNFSe })
+
+	resp, body, _ = makeRequest(server, "GET", endpoint, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/xml" {
+		t.Fatalf("Expected the RPS XML, got %d %s", resp.StatusCode, body)
+	}
+	for _, expected := range []string{
+		`<GerarNfseEnvio xmlns="http://www.abrasf.org.br/nfse.xsd">`,
+		`<InfDeclaracaoPrestacaoServico Id="rps12">`,
+		`<Numero>12</Numero>`,
+		`<Serie>A</Serie>`,
+		`<DataEmissao>2024-03-05</DataEmissao>`,
+		`<ValorServicos>299.97</ValorServicos>`,
+		`<ValorIss>14.50</ValorIss>`,
+		`<Aliquota>5.00</Aliquota>`,
+		`<DescontoIncondicionado>10.00</DescontoIncondicionado>`,
+		`<ItemListaServico>01.07</ItemListaServico>`,
+		`<Discriminacao>3 x Test Product: 299.97</Discriminacao>`,
+		`<CodigoMunicipio>3550308</CodigoMunicipio>`,
+		`<Prestador>`,
+		`<Cnpj>12345678000190</Cnpj>`,
+		`<Cpf>12345678909</Cpf>`,
+		`<RazaoSocial>Cliente &amp; Filhos</RazaoSocial>`,
+		`<Email>cliente@example.com</Email>`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected the RPS to contain %s, got %s", expected, body)
+		}
+	}
+
+	// Drafts, credit notes, other currencies and companies without a CPF
+	// or CNPJ aren't issued
+	refused := map[string]func(){
+		"draft":       func() { testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("sent_at", nil) },
+		"credit note": func() { testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("type", DocumentCreditNote) },
+		"currency":    func() { testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("locale", LocaleEn) },
+		"document":    func() { testRepo.db.Model(&Company{}).Where("id = ?", client.ID).Update("document", "N/A") },
+	}
+	for name, change := range refused {
+		testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Updates(map[string]interface{}{"sent_at": sentAt, "type": DocumentInvoice, "locale": LocalePtBR})
+		testRepo.db.Model(&Company{}).Where("id = ?", client.ID).Update("document", "123.456.789-09")
+		change()
+		if resp, body, _ := makeRequest(server, "GET", endpoint, ""); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("Expected the %s refused, got %d %s", name, resp.StatusCode, body)
+		}
+	}
+
+	config.NFSe.Provider = "curitiba"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "NFS-e provider") {
+		t.Errorf("Expected an unknown provider to be invalid, got %v", err)
+	}
+	config.NFSe = NFSeConfig{Provider: "abrasf", MunicipalityCode: "355", RPSSeries: "1"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "IBGE") {
+		t.Errorf("Expected a short municipality code to be invalid, got %v", err)
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	factory := NewFactory(testRepo)
+
+	client, err := factory.Company(func(c *Company) { c.Name, c.ConsolidationDay = "Monthly, Inc", intPtr(5) })
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	due, err := factory.Invoice(InvoiceSent, func(i *Invoice) { i.ClientID, i.Number = client.ID, intPtr(42) })
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	paid, _ := factory.Invoice(InvoicePaid)
+	draft, _ := factory.Invoice(InvoiceDraft)
+	project := &Project{CompanyID: client.ID, Name: "Website"}
+	if err := testRepo.CreateProject(project); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	taskDue := time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC)
+	testRepo.CreateTask(&Task{ProjectID: project.ID, Name: "Launch; at last", DueDate: &taskDue})
+	testRepo.CreateTask(&Task{ProjectID: project.ID, Name: "Done already", Status: TaskDone, DueDate: &taskDue})
+
+	passwordHash, _ := hashPassword("calendar-secret")
+	user := &User{Username: "dana", PasswordHash: passwordHash}
+	if err := testRepo.CreateUser(user); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	handler := setupRoutes(NewHandler(testRepo), false)
+	tokenRequest := func(method string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, pathCalendarToken, nil)
+		request.SetBasicAuth("dana", "calendar-secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if resp, _, _ := makeRequest(server, "GET", pathCalendar+"?token=guess", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown token to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := makeRequest(server, "POST", pathCalendarToken, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a token to need a signed in user, got %d", resp.StatusCode)
+	}
+
+	recorder := tokenRequest("POST")
+	var created struct {
+		URL string `json:"url"`
+	}
+	if recorder.Code != http.StatusCreated || json.Unmarshal(recorder.Body.Bytes(), &created) != nil || !strings.Contains(created.URL, pathCalendar+"?token=") {
+		t.Fatalf("Expected the feed URL, got %d %s", recorder.Code, recorder.Body)
+	}
+	feedPath := created.URL[strings.Index(created.URL, pathCalendar):]
+
+	resp, body, _ := makeRequest(server, "GET", feedPath, "")
+	feed := string(body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("Expected the calendar, got %d %s", resp.StatusCode, feed)
+	}
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"UID:invoice-" + due.UUID.String() + "@tiny-crm\r\n",
+		"DTSTART;VALUE=DATE:" + due.DueDate.Format("20060102") + "\r\n",
+		`SUMMARY:Invoice 42 due from Monthly\, Inc` + "\r\n",
+		`SUMMARY:Task due: Launch\; at last` + "\r\nDESCRIPTION:Project Website\r\n",
+		"DTSTART;VALUE=DATE:20300201\r\n",
+		"RRULE:FREQ=MONTHLY;BYMONTHDAY=5\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(feed, expected) {
+			t.Errorf("Expected the feed to contain %q, got %s", expected, feed)
+		}
+	}
+	for _, unexpected := range []string{paid.UUID.String(), draft.UUID.String(), "Done already"} {
+		if strings.Contains(feed, unexpected) {
+			t.Errorf("Expected %s left out of the feed", unexpected)
+		}
+	}
+
+	// Long lines are folded without splitting characters
+	calendar := newICSCalendar("tiny-crm", time.Now())
+	calendar.line("SUMMARY", strings.Repeat("é", 60))
+	for _, line := range strings.Split(calendar.close(), "\r\n") {
+		if len(line) > 75 || !utf8.ValidString(line) {
+			t.Errorf("Expected folded UTF-8 lines of 75 octets at most, got %q", line)
+		}
+	}
+
+	// A new token revokes the previous one, as does deleting it
+	tokenRequest("POST")
+	if resp, _, _ := makeRequest(server, "GET", feedPath, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the previous token revoked, got %d", resp.StatusCode)
+	}
+	if recorder := tokenRequest("DELETE"); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected the token deleted, got %d", recorder.Code)
+	}
+	if revoked, _ := testRepo.GetUser(user.ID); revoked.CalendarTokenHash != "" {
+		t.Errorf("Expected no token left, got %q", revoked.CalendarTokenHash)
+	}
+}
+
+func TestInboundEmail(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	originalDir := config.AttachmentsDir
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() { config.AttachmentsDir = originalDir })
+
+	factory := NewFactory(testRepo)
+	acme, err := factory.Company(func(c *Company) { c.Name, c.Email = "Acme", "billing@acme.example" })
+	if err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+	factory.Company(func(c *Company) { c.Email = "someone@gmail.com" })
+
+	var received []*InboundEmail
+	unsubscribe := subscribe(EventEmailReceived, func(store Store, event Event) error {
+		received = append(received, event.Data.(*InboundEmail))
+		return nil
+	})
+	t.Cleanup(unsubscribe)
+
+	message := strings.ReplaceAll(`From: Maria Silva <Maria@Acme.example>
+To: crm@example.com
+Subject: =?UTF-8?B?T3LDp2FtZW50bw==?=
+Message-ID: <quote-1@acme.example>
+Date: Tue, 05 Mar 2024 10:00:00 -0300
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+We need a quote for 10 licen=
+ses.
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>We need a quote for 10 licenses.</p>
+--inner--
+--outer
+Content-Type: text/csv
+Content-Disposition: attachment; filename="licenses.csv"
+Content-Transfer-Encoding: base64
+
+c2VhdCxjb3VudApsaWNl
+bnNlLDEw
+--outer--
+`, "\n", "\r\n")
+
+	resp, body, _ := makeRequest(server, "POST", pathInboundEmails, message)
+	var email InboundEmail
+	if resp.StatusCode != http.StatusCreated || json.Unmarshal(body, &email) != nil {
+		t.Fatalf("Expected the email received, got %d %s", resp.StatusCode, body)
+	}
+	if email.CompanyID == nil || *email.CompanyID != acme.ID || email.From != "maria@acme.example" || email.FromName != "Maria Silva" ||
+		email.Subject != "Orçamento" || email.Body != "We need a quote for 10 licenses." || email.MessageID != "quote-1@acme.example" ||
+		!email.ReceivedAt.Equal(time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the email filed under the company of the sender's domain, got %+v", email)
+	}
+	if len(email.Attachments) != 1 || email.Attachments[0].Filename != "licenses.csv" || email.Attachments[0].CompanyID == nil || *email.Attachments[0].CompanyID != acme.ID {
+		t.Fatalf("Expected the file stored for the company, got %+v", email.Attachments)
+	}
+	if data, _ := email.Attachments[0].Read(); string(data) != "seat,count\nlicense,10" {
+		t.Errorf("Expected the decoded file, got %q", data)
+	}
+	if len(received) != 1 || received[0].ID != email.ID {
+		t.Errorf("Expected an email.received event, got %+v", received)
+	}
+
+	// The same email delivered again isn't recorded twice
+	resp, body, _ = makeRequest(server, "POST", pathInboundEmails, message)
+	var again InboundEmail
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &again) != nil || again.ID != email.ID || len(received) != 1 {
+		t.Errorf("Expected the email already received, got %d %s", resp.StatusCode, body)
+	}
+
+	// Unknown domains and free mail providers wait in the inbox as leads
+	for _, from := range []string{"lead@newcorp.example", "other@gmail.com"} {
+		lead := "From: " + from + "\r\nSubject: Hello\r\n\r\nAre you available?\r\n"
+		resp, body, _ := makeRequest(server, "POST", pathInboundEmails, lead)
+		if resp.StatusCode != http.StatusCreated || strings.Contains(string(body), `"company_id":`+strconv.Itoa(int(acme.ID))) {
+			t.Errorf("Expected %s unmatched, got %d %s", from, resp.StatusCode, body)
+		}
+	}
+	var leads []InboundEmail
+	_, body, _ = makeRequest(server, "GET", pathInboundEmails+"?unmatched=true", "")
+	if json.Unmarshal(body, &leads) != nil || len(leads) != 2 || leads[0].CompanyID != nil {
+		t.Fatalf("Expected the two leads, got %s", body)
+	}
+
+	resp, body, _ = makeRequest(server, "PUT", routePath(pathInboundEmailCompany, leads[0].ID), fmt.Sprintf(`{"company_id": %d}`, acme.ID))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), fmt.Sprintf(`"company_id":%d`, acme.ID)) {
+		t.Errorf("Expected the lead assigned, got %d %s", resp.StatusCode, body)
+	}
+	var acmeEmails []InboundEmail
+	_, body, _ = makeRequest(server, "GET", pathInboundEmails+fmt.Sprintf("?company_id=%d", acme.ID), "")
+	if json.Unmarshal(body, &acmeEmails) != nil || len(acmeEmails) != 2 {
+		t.Errorf("Expected the company's two emails, got %s", body)
+	}
+	resp, _, _ = makeRequest(server, "GET", routePath(pathInboundEmail, email.ID), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the email, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := makeRequest(server, "POST", pathInboundEmails, "not an email"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unreadable message to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestDatasetExportImport(t *testing.T) {
+	source, sourceRepo := setupTestServer(t)
+	defer source.Close()
+	originalDir := config.AttachmentsDir
+	config.AttachmentsDir = t.TempDir()
+	t.Cleanup(func() { config.AttachmentsDir = originalDir })
+
+	factory := NewFactory(sourceRepo)
+	invoice, err := factory.Invoice(InvoicePartiallyPaid, func(i *Invoice) { i.Tags = Tags{"export"} })
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	passwordHash, _ := hashPassword("moving-secret")
+	if err := sourceRepo.CreateUser(&User{Username: "mover", PasswordHash: passwordHash, IsAdmin: true}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	attachment, err := sourceRepo.CreateAttachment(&invoice.ClientID, "contract.txt", "text/plain", []byte("signed"))
+	if err != nil {
+		t.Fatalf("Failed to create attachment: %v", err)
+	}
+
+	resp, jsonDump, _ := makeRequest(source, "GET", pathAdminExport, "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), ".json") {
+		t.Fatalf("Expected the JSON export, got %d %s", resp.StatusCode, jsonDump)
+	}
+	var dataset Dataset
+	if err := json.Unmarshal(jsonDump, &dataset); err != nil || dataset.SchemaVersion != latestSchemaVersion() ||
+		len(dataset.Tables["invoices"]) != 1 || len(dataset.Tables["payments"]) != 1 || len(dataset.Tables["companies"]) != 2 {
+		t.Fatalf("Expected every table in the export, got %v %s", err, jsonDump)
+	}
+	if !strings.Contains(string(jsonDump), `"password_hash"`) {
+		t.Errorf("Expected the columns hidden from the API exported too")
+	}
+	resp, zipDump, _ := makeRequest(source, "GET", pathAdminExport+"?format=zip", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected the zip export, got %d", resp.StatusCode)
+	}
+
+	// Restored into another instance, rows keep their IDs and references
+	config.AttachmentsDir = t.TempDir()
+	target, targetRepo := setupTestServer(t)
+	defer target.Close()
+	resp, body, _ := makeRequest(target, "POST", pathAdminImport, string(zipDump))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"invoices":1`) {
+		t.Fatalf("Expected the dataset imported, got %d %s", resp.StatusCode, body)
+	}
+	restored, err := targetRepo.GetInvoice(invoice.ID)
+	if err != nil || restored.ClientID != invoice.ClientID || restored.TotalAmount != invoice.TotalAmount ||
+		!restored.IssueDate.Equal(invoice.IssueDate) || restored.SentAt == nil || len(restored.Tags) != 1 || len(restored.InvoiceLines) != 1 {
+		t.Fatalf("Expected the invoice restored, got %+v %v", restored, err)
+	}
+	if paidAmount, _ := targetRepo.GetPaidAmount(invoice.ID); paidAmount != invoice.TotalAmount.Per(2) {
+		t.Errorf("Expected the payment restored, got %v", paidAmount)
+	}
+	if _, err := authenticatedUser(targetRepo, "mover", "moving-secret", time.Now()); err != nil {
+		t.Errorf("Expected the user to sign in with their password, got %v", err)
+	}
+	if file, err := targetRepo.GetAttachment(attachment.ID); err != nil {
+		t.Errorf("Expected the attachment restored, got %v", err)
+	} else if data, _ := file.Read(); string(data) != "signed" {
+		t.Errorf("Expected the file of the attachment restored, got %q", data)
+	}
+	if _, err := factory.Invoice(InvoiceDraft); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if created, err := NewFactory(targetRepo).Invoice(InvoiceDraft); err != nil || created.ID <= invoice.ID {
+		t.Errorf("Expected new rows to follow the imported ones, got %+v %v", created, err)
+	}
+
+	// Only into an empty database, at the same schema version, with every
+	// reference resolved
+	if resp, _, _ := makeRequest(target, "POST", pathAdminImport, string(jsonDump)); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected an import over existing data refused, got %d", resp.StatusCode)
+	}
+	empty, _ := setupTestServer(t)
+	defer empty.Close()
+	outdated := strings.Replace(string(jsonDump), fmt.Sprintf(`"schema_version":%d`, latestSchemaVersion()), `"schema_version":1`, 1)
+	if resp, body, _ := makeRequest(empty, "POST", pathAdminImport, outdated); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "schema version 1") {
+		t.Errorf("Expected another schema version refused, got %d %s", resp.StatusCode, body)
+	}
+	dataset.Tables["payments"] = nil
+	dataset.Tables["companies"] = dataset.Tables["companies"][:1]
+	broken, _ := json.Marshal(dataset)
+	if resp, body, _ := makeRequest(empty, "POST", pathAdminImport, string(broken)); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "missing") {
+		t.Errorf("Expected dangling references refused, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _, _ := makeRequest(empty, "GET", pathInvoices, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the database usable after a refused import, got %d", resp.StatusCode)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	client, err := NewFactory(testRepo).Company()
+	if err != nil {
+		t.Fatalf("Failed to create company: %v", err)
+	}
+
+	if err := runCommand(testRepo, "user", []string{"add", "-admin", "-email", "ana@example.com", "ana", "secret"}); err != nil {
+		t.Fatalf("Expected the user added, got %v", err)
+	}
+	if user, err := testRepo.GetUserByUsername("ana"); err != nil || !user.IsAdmin || user.Email != "ana@example.com" {
+		t.Errorf("Expected an administrator with an email, got %+v %v", user, err)
+	}
+	// adduser keeps its flags after the arguments
+	if err := runCommand(testRepo, "adduser", []string{"bob", "secret", "bob@example.com", fmt.Sprintf("--company=%d", client.ID)}); err != nil {
+		t.Fatalf("Expected the client user added, got %v", err)
+	}
+	if user, err := testRepo.GetUserByUsername("bob"); err != nil || user.CompanyID == nil || *user.CompanyID != client.ID || user.Email != "bob@example.com" {
+		t.Errorf("Expected a client user of the company, got %+v %v", user, err)
+	}
+	if err := runCommand(testRepo, "user", []string{"add", "ana", "other"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected a taken username refused, got %v", err)
+	}
+	if err := runCommand(testRepo, "user", []string{"add", "-admin", "-company", "1", "carla", "secret"}); !errors.Is(err, errUsage) {
+		t.Errorf("Expected administrators of a company refused, got %v", err)
+	}
+	if err := runCommand(testRepo, "user", []string{"add", "-owner", "carla", "secret"}); err == nil {
+		t.Errorf("Expected an unknown flag refused")
+	}
+	if users, err := testRepo.GetUsers(); err != nil || len(users) != 2 || runCommand(testRepo, "user", []string{"list"}) != nil {
+		t.Errorf("Expected the users listed, got %+v %v", users, err)
+	}
+
+	if err := runCommand(testRepo, "user", []string{"passwd", "ana", "changed"}); err != nil {
+		t.Fatalf("Expected the password changed, got %v", err)
+	}
+	if _, err := authenticatedUser(testRepo, "ana", "changed", time.Now()); err != nil {
+		t.Errorf("Expected the new password accepted, got %v", err)
+	}
+	if _, err := authenticatedUser(testRepo, "ana", "secret", time.Now()); err == nil {
+		t.Errorf("Expected the old password refused")
+	}
+	if err := runCommand(testRepo, "user", []string{"passwd", "nobody", "changed"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected an unknown user reported, got %v", err)
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if err := runCommand(testRepo, "backup", []string{backup}); err != nil {
+		t.Fatalf("Expected the database backed up, got %v", err)
+	}
+	backupDB, err := gorm.Open(sqlite.Open(backup), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open the backup: %v", err)
+	}
+	var users int64
+	if err := backupDB.Model(&User{}).Count(&users).Error; err != nil || users != 2 {
+		t.Errorf("Expected the users in the backup, got %d %v", users, err)
+	}
+	if sqlDB, err := backupDB.DB(); err == nil {
+		sqlDB.Close()
+	}
+	if err := runCommand(testRepo, "backup", []string{backup}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected an existing file kept, got %v", err)
+	}
+
+	if err := runCommand(testRepo, "schemadiff", nil); err != nil {
+		t.Errorf("Expected no schema drift, got %v", err)
+	}
+	if err := runCommand(testRepo, "serve", []string{"extra"}); !errors.Is(err, errUsage) {
+		t.Errorf("Expected arguments of serve refused, got %v", err)
+	}
+	if err := runCommand(testRepo, "frobnicate", nil); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("Expected an unknown command reported, got %v", err)
+	}
+}
+
+func TestInvoiceLineSections(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("country", "NL")
+
+	// Listed out of order, the positions order them
+	body := fmt.Sprintf(`{"number": 5, "due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [
+			{"type": "section", "description": "Support", "position": 4},
+			{"description": "On call weekend", "unit_price": 80, "quantity": 2, "position": 5},
+			{"type": "section", "description": "Development", "position": 1},
+			{"product_id": %d, "quantity": 2, "position": 2},
+			{"description": "Travel expenses", "unit_price": 150, "position": 3}
+		]}`, remitID, companyID, companyID, productID)
+	resp, response, _ := makeRequest(server, "POST", pathInvoices, body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the invoice created, got %d %s", resp.StatusCode, response)
+	}
+	var invoice Invoice
+	json.Unmarshal(response, &invoice)
+	if invoice.TotalAmount != moneyFromFloat(99.99*2+150+160) {
+		t.Errorf("Expected sections to bill nothing, got a total of %v", invoice.TotalAmount)
+	}
+	var names []string
+	for _, line := range invoice.InvoiceLines {
+		names = append(names, fmt.Sprintf("%s %s %d", line.Type, line.Name(), line.Position))
+	}
+	if strings.Join(names, ", ") != "section Development 1, item Test Product 2, item Travel expenses 3, section Support 4, item On call weekend 5" {
+		t.Errorf("Expected the lines in the order of their positions, got %v", names)
+	}
+	if travel := invoice.InvoiceLines[2]; travel.ProductID != nil || travel.Product != nil || travel.UnitPrice != moneyFromFloat(150) || travel.Quantity != 1 {
+		t.Errorf("Expected a free text line without product, got %+v", travel)
+	}
+
+	// Lines listed without positions keep the order they are listed in
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	stored.InvoiceLines = []InvoiceLine{stored.InvoiceLines[4], stored.InvoiceLines[1]}
+	stored.InvoiceLines[0].Position, stored.InvoiceLines[1].Position = 0, 0
+	if err := testRepo.UpdateInvoice(stored); err != nil {
+		t.Fatalf("Failed to update the invoice: %v", err)
+	}
+	if updated, _ := testRepo.GetInvoice(invoice.ID); len(updated.InvoiceLines) != 2 || updated.InvoiceLines[0].Name() != "On call weekend" ||
+		updated.InvoiceLines[0].UnitPrice != moneyFromFloat(80) || updated.InvoiceLines[1].UnitPrice != moneyFromFloat(99.99) || updated.TotalAmount != moneyFromFloat(160+2*99.99) {
+		t.Errorf("Expected the lines reordered with their prices, got %+v", updated)
+	}
+	if err := testRepo.UpdateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to update the invoice: %v", err)
+	}
+
+	_, page, _ := makeRequest(server, "GET", routePath(pathInvoiceOpen, invoice.ID)+"?template=default_invoice_en.html", "")
+	if !strings.Contains(string(page), `<td colspan="4"><b>Development</b></td>`) || !strings.Contains(string(page), "Travel expenses") {
+		t.Errorf("Expected the sections and free text lines rendered, got %s", page)
+	}
+	_, ubl, _ := makeRequest(server, "GET", routePath(pathInvoiceUBL, invoice.ID), "")
+	if strings.Count(string(ubl), "<cac:InvoiceLine>") != 3 || strings.Contains(string(ubl), "Development") {
+		t.Errorf("Expected the sections left out of the e-invoice, got %s", ubl)
+	}
+	_, found, _ := makeRequest(server, "GET", pathInvoices+"?search=travel", "")
+	if !strings.Contains(string(found), fmt.Sprintf(`"id":%d`, invoice.ID)) {
+		t.Errorf("Expected free text lines searched, got %s", found)
+	}
+	if revenue, err := testRepo.GetRevenueByCategory(nil, nil); err != nil || len(revenue) != 1 || revenue[0].Quantity != 5 || revenue[0].Billed != invoice.TotalAmount.Float() {
+		t.Errorf("Expected free text lines counted as uncategorized, got %+v %v", revenue, err)
+	}
+
+	for _, line := range []string{
+		`{"quantity": 1, "unit_price": 10}`,
+		`{"description": "  ", "unit_price": 10}`,
+		`{"type": "section", "description": "Hosting", "unit_price": 10}`,
+		fmt.Sprintf(`{"type": "section", "description": "Hosting", "product_id": %d}`, productID),
+		`{"type": "section"}`,
+		`{"type": "subtotal", "description": "Hosting"}`,
+	} {
+		body := fmt.Sprintf(`{"due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d, "invoice_lines": [%s]}`,
+			remitID, companyID, companyID, line)
+		if resp, response, _ := makeRequest(server, "POST", pathInvoices, body); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(response), "Line 1") {
+			t.Errorf("Expected line %s refused, got %d %s", line, resp.StatusCode, response)
+		}
+	}
+
+	// Reverting the migration drops the lines without a product
+	if _, err := testRepo.MigrateTo(38); err != nil {
+		t.Fatalf("Failed to revert the migration: %v", err)
+	}
+	var lines int64
+	testRepo.db.Model(&InvoiceLine{}).Where("invoice_id = ?", invoice.ID).Count(&lines)
+	if lines != 1 || testRepo.db.Exec("INSERT INTO invoice_lines (invoice_id, quantity) VALUES (?, 1)", invoice.ID).Error == nil {
+		t.Errorf("Expected only the product line kept and products required, got %d lines", lines)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate again: %v", err)
+	}
+	if resp, response, _ := makeRequest(server, "POST", pathInvoices, body); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected free text lines allowed again, got %d %s", resp.StatusCode, response)
+	}
+}
+
+func TestDecimalQuantities(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, _, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	testRepo.db.Model(&Company{}).Where("id = ?", companyID).Update("country", "NL")
+
+	resp, response, _ := makeRequest(server, "POST", pathProducts, `{"name": "Consulting", "price": 80, "unit": "h"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the product created, got %d %s", resp.StatusCode, response)
+	}
+	var product Product
+	json.Unmarshal(response, &product)
+	if resp, response, _ := makeRequest(server, "POST", pathProducts, `{"name": "Consulting", "price": 80, "unit": "hours"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown unit refused, got %d %s", resp.StatusCode, response)
+	}
+
+	// Product lines bill in the unit of their product unless they give one
+	body := fmt.Sprintf(`{"locale": "pt-BR", "due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [
+			{"product_id": %d, "quantity": 7.5},
+			{"description": "Cable", "unit_price": 2, "quantity": 2.125, "unit": "m"}
+		]}`, remitID, companyID, companyID, product.ID)
+	resp, response, _ = makeRequest(server, "POST", pathInvoices, body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the invoice created, got %d %s", resp.StatusCode, response)
+	}
+	var invoice Invoice
+	json.Unmarshal(response, &invoice)
+	if invoice.TotalAmount != moneyFromFloat(7.5*80+2.125*2) {
+		t.Errorf("Expected decimal quantities billed, got a total of %v", invoice.TotalAmount)
+	}
+	if lines := invoice.InvoiceLines; lines[0].Quantity != 7.5 || lines[0].Unit != UnitHour || lines[1].Unit != UnitMeter {
+		t.Errorf("Expected the quantities and units kept, got %+v", lines)
+	}
+
+	_, page, _ := makeRequest(server, "GET", routePath(pathInvoiceOpen, invoice.ID)+"?template=localized_invoice.html", "")
+	if !strings.Contains(string(page), "<td>7,5 h</td>") || !strings.Contains(string(page), "<td>2,125 m</td>") {
+		t.Errorf("Expected the quantities rendered with their units, got %s", page)
+	}
+	_, ubl, _ := makeRequest(server, "GET", routePath(pathInvoiceUBL, invoice.ID), "")
+	if !strings.Contains(string(ubl), `<cbc:InvoicedQuantity unitCode="HUR">7.5</cbc:InvoicedQuantity>`) ||
+		!strings.Contains(string(ubl), `<cbc:InvoicedQuantity unitCode="MTR">2.125</cbc:InvoicedQuantity>`) {
+		t.Errorf("Expected the e-invoice quantities with their unit codes, got %s", ubl)
+	}
+
+	for _, line := range []string{
+		`{"description": "Support", "unit_price": 10, "quantity": 1.2345}`,
+		`{"description": "Support", "unit_price": 10, "quantity": -2}`,
+		`{"description": "Support", "unit_price": 10, "unit": "weeks"}`,
+	} {
+		body := fmt.Sprintf(`{"due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d, "invoice_lines": [%s]}`,
+			remitID, companyID, companyID, line)
+		if resp, response, _ := makeRequest(server, "POST", pathInvoices, body); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(response), "Line 1") {
+			t.Errorf("Expected line %s refused, got %d %s", line, resp.StatusCode, response)
+		}
+	}
+
+	// Reverting the migration rounds the quantities
+	if _, err := testRepo.MigrateTo(39); err != nil {
+		t.Fatalf("Failed to revert the migration: %v", err)
+	}
+	var quantities []float64
+	testRepo.db.Table("invoice_lines").Where("invoice_id = ?", invoice.ID).Order("position").Pluck("quantity", &quantities)
+	if len(quantities) != 2 || quantities[0] != 8 || quantities[1] != 2 || testRepo.db.Migrator().HasColumn(&Product{}, "unit") {
+		t.Errorf("Expected whole quantities without units, got %v", quantities)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate again: %v", err)
+	}
+	if resp, response, _ := makeRequest(server, "POST", pathInvoices, body); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected decimal quantities allowed again, got %d %s", resp.StatusCode, response)
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	// Amounts are rounded to the cent half away from zero, exactly
+	for text, expected := range map[string]Money{"0.285": 29, "-0.285": -29, "10.004": 1000, "12": 1200, "1e2": 10000} {
+		var amount Money
+		if err := json.Unmarshal([]byte(text), &amount); err != nil || amount != expected {
+			t.Errorf("Expected %s read as %d cents, got %d %v", text, expected, amount, err)
+		}
+	}
+	if Money(1005).Percent(50) != 503 || Money(-1005).Percent(50) != -503 || Money(333).Times(1.5) != 500 || Money(1000).Per(3) != 333 {
+		t.Error("Expected percentages and quantities rounded half away from zero")
+	}
+	if Money(1000).Per(0) != 0 || Money(1000).Per(0.0001) != 0 || Money(1000).Per(-3) != -333 {
+		t.Error("Expected no amount per unit of a quantity rounding to 0, and negative quantities dividing")
+	}
+	if text := fmt.Sprintf("%v %.1f %s", Money(-1205), Money(1250), Money(7)); text != "-12.05 12.5 0.07" {
+		t.Errorf("Unexpected formatting %s", text)
+	}
+	if encoded, _ := json.Marshal(map[string]Money{"a": 1250, "b": 1200, "c": 1}); string(encoded) != `{"a":12.5,"b":12,"c":0.01}` {
+		t.Errorf("Expected amounts written as plain numbers, got %s", encoded)
+	}
+
+	// Cents add up where floats wouldn't, 0.1 + 0.2 being 0.30000000000000004
+	companyID, _, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	body := fmt.Sprintf(`{"due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"discount": 33.33, "discount_type": "percent",
+		"invoice_lines": [
+			{"description": "Stamp", "unit_price": 0.1},
+			{"description": "Envelope", "unit_price": 0.2},
+			{"description": "Paper", "unit_price": 0.333, "quantity": 3, "discount": 15, "discount_type": "percent"}
+		]}`, remitID, companyID, companyID)
+	resp, response, _ := makeRequest(server, "POST", pathInvoices, body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the invoice created, got %d %s", resp.StatusCode, response)
+	}
+	var invoice Invoice
+	json.Unmarshal(response, &invoice)
+	// 0.33 x 3 = 0.99 less 15% (0.15) is 0.84, the subtotal 1.14 less
+	// 33.33% (0.38) is 0.76
+	if invoice.InvoiceLines[2].Total() != 84 || invoice.SubTotalAmount != 114 || invoice.DiscountAmount() != 38 || invoice.TotalAmount != 76 {
+		t.Errorf("Expected the amounts rounded to the cent, got %+v", invoice)
+	}
+	if !strings.Contains(string(response), `"subtotal":1.14`) || !strings.Contains(string(response), `"total":0.76`) {
+		t.Errorf("Expected the totals as decimal numbers, got %s", response)
+	}
+
+	stored, _ := testRepo.GetInvoice(invoice.ID)
+	if totals, err := testRepo.GetInvoiceTotals(InvoiceFilter{}); err != nil || totals.Total != stored.TotalAmount || stored.Total() != 76 {
+		t.Errorf("Expected the stored totals read back to the cent, got %+v %v", totals, err)
+	}
+}
+
+func TestInvoiceRevisions(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	body := fmt.Sprintf(`{"due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 2}, {"description": "Setup", "unit_price": 50}]}`, remitID, companyID, companyID, productID)
+	resp, response, _ := makeRequest(server, "POST", pathInvoices, body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the invoice created, got %d %s", resp.StatusCode, response)
+	}
+	var invoice Invoice
+	json.Unmarshal(response, &invoice)
+	path := routePath(pathInvoice, invoice.ID)
+
+	// Saving it unchanged keeps no revision
+	if resp, response, _ := makeRequest(server, "PUT", path, string(response)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the invoice updated, got %d %s", resp.StatusCode, response)
+	}
+	if revisions, err := testRepo.GetInvoiceRevisions(invoice.ID); err != nil || len(revisions) != 0 {
+		t.Errorf("Expected no revision of an unchanged invoice, got %d %v", len(revisions), err)
+	}
+
+	invoice.DueDate = time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	invoice.InvoiceLines = invoice.InvoiceLines[:1]
+	invoice.InvoiceLines[0].Quantity = 3
+	for _, line := range []*InvoiceLine{nil, {Description: stringPtr("Training"), UnitPrice: moneyFromFloat(80)}} {
+		if line != nil {
+			invoice.InvoiceLines = append(invoice.InvoiceLines, *line)
+		}
+		update, _ := json.Marshal(invoice)
+		if resp, response, _ := makeRequest(server, "PUT", path, string(update)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the invoice updated, got %d %s", resp.StatusCode, response)
+		}
+	}
+
+	resp, response, _ = makeRequest(server, "GET", routePath(pathInvoiceRevisions, invoice.ID), "")
+	var revisions []struct {
+		Revision int             `json:"revision"`
+		Snapshot InvoiceSnapshot `json:"snapshot"`
+		Changes  []struct {
+			Field string          `json:"field"`
+			From  json.RawMessage `json:"from"`
+			To    json.RawMessage `json:"to"`
+		} `json:"changes"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(response, &revisions) != nil || len(revisions) != 2 {
+		t.Fatalf("Expected the 2 revisions, got %d %s", resp.StatusCode, response)
+	}
+	first := revisions[0]
+	if first.Revision != 1 || len(first.Snapshot.Lines) != 2 || first.Snapshot.Lines[1].UnitPrice != moneyFromFloat(50) ||
+		first.Snapshot.Total != moneyFromFloat(99.99*2+50) {
+		t.Errorf("Expected the first revision to keep the original lines, got %+v", first.Snapshot)
+	}
+	var changes []string
+	for _, change := range first.Changes {
+		changes = append(changes, fmt.Sprintf("%s %s>%s", change.Field, change.From, change.To))
+	}
+	expected := `due_date "2024-07-01T00:00:00Z">"2024-08-01T00:00:00Z", subtotal 249.98>299.97, total 249.98>299.97, ` +
+		`lines[1].quantity 2>3, lines[1].total 199.98>299.97, lines[2] {"type":"item","product_id":null,"description":"Setup","quantity":1,"unit":"","unit_price":50,"discount":0,"discount_type":"fixed","total":50}>null`
+	if strings.Join(changes, ", ") != expected {
+		t.Errorf("Unexpected changes of the first revision:\n%s\nexpected\n%s", strings.Join(changes, ", "), expected)
+	}
+	if second := revisions[1]; len(second.Changes) != 3 || second.Changes[2].Field != "lines[2]" || string(second.Changes[2].From) != "null" {
+		t.Errorf("Expected the second revision to diff against the current invoice, got %+v", second.Changes)
+	}
+
+	if resp, _, _ := makeRequest(server, "GET", routePath(pathInvoiceRevisions, 999), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for the revisions of a missing invoice, got %d", resp.StatusCode)
+	}
+	// Revisions go with their invoice
+	if err := testRepo.DeleteInvoice(invoice.ID); err != nil {
+		t.Fatalf("Failed to delete the invoice: %v", err)
+	}
+	var left int64
+	testRepo.db.Model(&InvoiceRevision{}).Count(&left)
+	if left != 0 {
+		t.Errorf("Expected the revisions deleted with the invoice, %d left", left)
+	}
+}
+
+func TestIssuedInvoiceGuard(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	invoiceData := fmt.Sprintf(`{"due_date": "2024-07-01T00:00:00Z", "remit_information_id": %d, "company_id": %d, "client_id": %d,
+		"invoice_lines": [{"product_id": %d, "quantity": 2}]}`, remitID, companyID, companyID, productID)
+	create := func() string {
+		resp, body, _ := makeRequest(server, "POST", pathInvoices, invoiceData)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected the invoice created, got %d %s", resp.StatusCode, body)
+		}
+		var invoice Invoice
+		json.Unmarshal(body, &invoice)
+		return routePath(pathInvoice, invoice.ID)
+	}
+
+	paid, sent := create(), create()
+	if resp, body, _ := makeRequest(server, "PUT", paid, invoiceData); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected drafts editable, got %d %s", resp.StatusCode, body)
+	}
+	testRepo.db.Model(&Invoice{}).Where("id = ?", strings.TrimPrefix(paid, routePath(pathInvoice, ""))).Update("paid", true)
+	testRepo.db.Model(&Invoice{}).Where("id = ?", strings.TrimPrefix(sent, routePath(pathInvoice, ""))).Update("sent_at", time.Now())
+
+	for _, path := range []string{paid, sent} {
+		resp, body, _ := makeRequest(server, "PUT", path, invoiceData)
+		if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "can't be changed") {
+			t.Errorf("Expected 409 updating %s, got %d %s", path, resp.StatusCode, body)
+		}
+		if resp, _, _ := makeRequest(server, "DELETE", path, ""); resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected 409 deleting %s, got %d", path, resp.StatusCode)
+		}
+	}
+	if _, err := testRepo.GetInvoice(1); err != nil {
+		t.Errorf("Expected the paid invoice kept: %v", err)
+	}
+
+	// Administrators can override the guard
+	if resp, body, _ := makeRequest(server, "PUT", paid+"?override=true", invoiceData); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the override to update the paid invoice, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _, _ := makeRequest(server, "DELETE", sent+"?override=true", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the override to delete the sent invoice, got %d", resp.StatusCode)
+	}
+
+	// Overriding doesn't undo a cancellation
+	cancelled := create()
+	cancelledID, _ := strconv.ParseUint(strings.TrimPrefix(cancelled, routePath(pathInvoice, "")), 10, 32)
+	testRepo.SendInvoice(uint(cancelledID), time.Now())
+	if update, err := testRepo.BulkUpdateInvoiceStatus([]uint{uint(cancelledID)}, InvoiceStatusCancelled, time.Now()); err != nil || !update.Applied {
+		t.Fatalf("Failed to cancel the invoice: %v %+v", err, update)
+	}
+	if resp, body, _ := makeRequest(server, "PUT", cancelled+"?override=true", invoiceData); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the override to update the cancelled invoice, got %d %s", resp.StatusCode, body)
+	}
+	if invoice, _ := testRepo.GetInvoice(uint(cancelledID)); invoice.CancelledAt == nil {
+		t.Error("Expected the invoice to stay cancelled after the override")
+	}
+
+	// Nobody else can
+	for _, user := range []*User{{Username: "admin", IsAdmin: true}, {Username: "clerk"}} {
+		var overridden bool
+		handler := issuedOverrideMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			overridden, _ = r.Context().Value(issuedOverrideContextKey{}).(bool)
+		}, false)
+		request := httptest.NewRequest("PUT", paid+"?override=true", nil)
+		handler(httptest.NewRecorder(), request.WithContext(context.WithValue(request.Context(), userContextKey{}, user)))
+		if overridden != user.IsAdmin {
+			t.Errorf("Expected the override for %s to be %v, got %v", user.Username, user.IsAdmin, overridden)
+		}
+	}
+
+	// Nor anybody when authentication is off
+	config.AuthMode = AuthModeNone
+	t.Cleanup(func() { config.AuthMode = AuthModeBasic })
+	handler := setupRoutes(NewHandler(testRepo), false)
+	testRepo.db.Model(&Invoice{}).Where("id = ?", strings.TrimPrefix(paid, routePath(pathInvoice, ""))).Update("paid", true)
+	for _, target := range []string{paid + "?override=true", paid + "?debug_sql=true"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("PUT", target, strings.NewReader(invoiceData)))
+		if recorder.Code != http.StatusConflict || recorder.Header().Get(debugSQLHeader+"-Count") != "" {
+			t.Errorf("Expected %s refused without authentication, got %d", target, recorder.Code)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", paid, nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the invoice served without authentication, got %d", recorder.Code)
+	}
+}
+
+func TestReferentialIntegrity(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	f := NewFactory(testRepo)
+	invoice, err := f.Invoice(InvoicePartiallyPaid)
+	if err != nil {
+		t.Fatalf("Failed to create the invoice: %v", err)
+	}
+	if _, err := f.Invoice(InvoiceDraft, func(i *Invoice) { i.CompanyID = invoice.CompanyID }); err != nil {
+		t.Fatalf("Failed to create the invoice: %v", err)
+	}
+
+	resp, body, _ := makeRequest(server, "DELETE", routePath(pathCompany, invoice.CompanyID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "issuer of 2 invoices, client of 0") {
+		t.Errorf("Expected 409 with the invoices of the issuer, got %d %s", resp.StatusCode, body)
+	}
+	resp, body, _ = makeRequest(server, "DELETE", routePath(pathCompany, invoice.ClientID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "issuer of 0 invoices, client of 1") {
+		t.Errorf("Expected 409 with the invoices of the client, got %d %s", resp.StatusCode, body)
+	}
+	resp, body, _ = makeRequest(server, "DELETE", routePath(pathProduct, *invoice.InvoiceLines[0].ProductID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "1 invoice lines, 0 deliverables") {
+		t.Errorf("Expected 409 with the lines billing the product, got %d %s", resp.StatusCode, body)
+	}
+	resp, body, _ = makeRequest(server, "DELETE", routePath(pathRemit, invoice.RemitInformationID), "")
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "1 invoices, 0 contracts") {
+		t.Errorf("Expected 409 with the invoices paid to the remit information, got %d %s", resp.StatusCode, body)
+	}
+	unused, _ := f.Company()
+	if resp, _, _ := makeRequest(server, "DELETE", routePath(pathCompany, unused.ID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected a company without invoices deleted, got %d", resp.StatusCode)
+	}
+
+	// The database refuses too, and lets go of deleted templates
+	if err := testRepo.db.Delete(&Company{}, invoice.ClientID).Error; err == nil {
+		t.Error("Expected the foreign key to keep the client of an invoice")
+	}
+	if err := testRepo.db.Delete(&RemitInformation{}, invoice.RemitInformationID).Error; err == nil {
+		t.Error("Expected the foreign key to keep the remit information of an invoice")
+	}
+	template := &InvoiceTemplate{CompanyID: invoice.CompanyID, Name: "Plain", BaseTemplate: "default"}
+	if err := testRepo.db.Create(template).Error; err != nil {
+		t.Fatalf("Failed to create the template: %v", err)
+	}
+	testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("invoice_template_id", template.ID)
+	if err := testRepo.db.Delete(template).Error; err != nil {
+		t.Fatalf("Failed to delete the template: %v", err)
+	}
+	if stored, _ := testRepo.GetInvoice(invoice.ID); stored.InvoiceTemplateID != nil {
+		t.Errorf("Expected the deleted template let go of, got %d", *stored.InvoiceTemplateID)
+	}
+	if err := testRepo.db.Model(&Invoice{}).Where("id = ?", invoice.ID).Update("invoice_template_id", 999).Error; err == nil {
+		t.Error("Expected the foreign key to refuse a missing template")
+	}
+
+	// Rebuilding the invoices table keeps what refers to it
+	for _, migrate := range []func() error{
+		func() error { _, err := testRepo.MigrateTo(41); return err },
+		func() error { _, err := testRepo.MigrateUp(); return err },
+	} {
+		if err := migrate(); err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		var payments int64
+		testRepo.db.Model(&Payment{}).Count(&payments)
+		if payments != 1 {
+			t.Errorf("Expected the payment kept by the rebuild, got %d", payments)
+		}
+	}
+	if drift, err := testRepo.SchemaDrift(); err != nil || len(drift) != 0 {
+		t.Errorf("Expected no drift after migrating again, got %v %v", drift, err)
+	}
+	if err := testRepo.db.Delete(&Company{}, invoice.ClientID).Error; err == nil {
+		t.Error("Expected the foreign keys enforced again once migrated")
+	}
+	if err := testRepo.db.Delete(&RemitInformation{}, invoice.RemitInformationID).Error; err == nil {
+		t.Error("Expected the remit information kept once migrated")
+	}
+}
+
+func TestInvoicePDFBatch(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	f := NewFactory(testRepo)
+	client, _ := f.Company(func(c *Company) { c.Name = "Acme Corp" })
+	may := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	var ids []uint
+	for _, issued := range []time.Time{may, may, may.AddDate(0, 1, 0)} {
+		invoice, err := f.Invoice(InvoiceSent, func(i *Invoice) { i.ClientID, i.IssueDate, i.DueDate = client.ID, issued, issued.AddDate(0, 0, 30) })
+		if err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		ids = append(ids, invoice.ID)
+	}
+
+	download := func(body string) (int, []string) {
+		resp, response, _ := makeRequest(server, "POST", pathInvoicesPDFBatch, body)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		if resp.Header.Get("Content-Type") != "application/zip" {
+			t.Errorf("Expected a zip, got %s", resp.Header.Get("Content-Type"))
+		}
+		archive, err := zip.NewReader(bytes.NewReader(response), int64(len(response)))
+		if err != nil {
+			t.Fatalf("Failed to read the zip: %v", err)
+		}
+		var names []string
+		for _, file := range archive.File {
+			content, _ := file.Open()
+			data, _ := io.ReadAll(content)
+			if !bytes.HasPrefix(data, []byte("%PDF")) {
+				t.Errorf("Expected %s to be a PDF", file.Name)
+			}
+			names = append(names, file.Name)
+		}
+		return resp.StatusCode, names
+	}
+
+	_, names := download(fmt.Sprintf(`{"filter": {"ids": [%d, %d]}}`, ids[0], ids[1]))
+	if strings.Join(names, " ") != "AcmeCorp_invoice_20240510.pdf AcmeCorp_invoice_20240510_2.pdf" {
+		t.Errorf("Expected the PDFs named by the invoices, got %v", names)
+	}
+	_, names = download(`{"filter": {"issued_from": "2024-05-01T00:00:00Z", "issued_to": "2024-05-31T00:00:00Z"}}`)
+	if len(names) != 2 {
+		t.Errorf("Expected the 2 invoices of May, got %v", names)
+	}
+	if _, names = download(`{"all": true}`); len(names) != 3 {
+		t.Errorf("Expected every invoice, got %v", names)
+	}
+	if status, _ := download(`{"filter": {}}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a filter, got %d", status)
+	}
+	if status, _ := download(`{"filter": {"issued_from": "2025-01-01T00:00:00Z"}}`); status != http.StatusNotFound {
+		t.Errorf("Expected 404 when nothing matches, got %d", status)
+	}
+
+	// The list takes the issue dates too
+	_, body, _ := makeRequest(server, "GET", pathInvoices+"?issued_from=2024-06-01&issued_to=2024-06-10", "")
+	var listed []InvoiceSummary
+	if json.Unmarshal(body, &listed); len(listed) != 1 || listed[0].ID != ids[2] {
+		t.Errorf("Expected the invoice of June listed, got %s", body)
+	}
+	if resp, _, _ := makeRequest(server, "GET", pathInvoices+"?issued_from=June", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid date, got %d", resp.StatusCode)
+	}
+}
+
+func TestBillingRun(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	product, _ := f.Product()
+	remit, _ := f.RemitInformation()
+	monthly, _ := f.Company(func(c *Company) { c.ConsolidationDay, c.ConsolidationRemitID = intPtr(5), &remit.ID })
+	noRemit, _ := f.Company(func(c *Company) { c.ConsolidationDay = intPtr(5) })
+	archivedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	archived, _ := f.Company(func(c *Company) {
+		c.ConsolidationDay, c.ConsolidationRemitID, c.ArchivedAt = intPtr(5), &remit.ID, &archivedAt
+	})
+	occasional, _ := f.Company()
+	for _, client := range []*Company{monthly, noRemit, archived, occasional} {
+		deliverable := Deliverable{CompanyID: issuer.ID, ClientID: client.ID, ProductID: product.ID, Quantity: 2, Date: time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC)}
+		if err := testRepo.CreateDeliverable(&deliverable); err != nil {
+			t.Fatalf("Failed to create the deliverable: %v", err)
+		}
+	}
+
+	run := func(path string) BillingSummary {
+		resp, body, _ := makeRequest(server, "POST", path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var summary BillingSummary
+		json.Unmarshal(body, &summary)
+		return summary
+	}
+
+	summary := run(pathBillingRun)
+	if summary.Month != "2024-05" || len(summary.Invoiced) != 1 || summary.Invoiced[0].ClientID != monthly.ID || len(summary.Invoiced[0].InvoiceIDs) != 1 {
+		t.Fatalf("Expected the monthly client invoiced for May, got %+v", summary)
+	}
+	if len(summary.Failed) != 1 || summary.Failed[0].ClientID != noRemit.ID || summary.Failed[0].Error == "" {
+		t.Errorf("Expected the client without remit information to fail, got %+v", summary.Failed)
+	}
+	invoiceID := summary.Invoiced[0].InvoiceIDs[0]
+
+	summary = run(pathBillingRun + "?month=2024-05")
+	if len(summary.Invoiced) != 0 || len(summary.Skipped) != 1 || summary.Skipped[0].InvoiceIDs[0] != invoiceID {
+		t.Errorf("Expected the rerun to skip the invoiced client, got %+v", summary)
+	}
+	var count int64
+	testRepo.db.Model(&Invoice{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected the rerun not to invoice again, got %d invoices", count)
+	}
+
+	testRepo.db.Model(&Company{}).Where("id = ?", noRemit.ID).Update("consolidation_remit_id", remit.ID)
+	summary = run(pathBillingRun + "?month=2024-05")
+	if len(summary.Invoiced) != 1 || summary.Invoiced[0].ClientID != noRemit.ID || len(summary.Failed) != 0 {
+		t.Errorf("Expected the failed client billed on the rerun, got %+v", summary)
+	}
+
+	for _, month := range []string{"2024-06", "May"} {
+		if resp, _, _ := makeRequest(server, "POST", pathBillingRun+"?month="+month, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for month %s, got %d", month, resp.StatusCode)
+		}
+	}
+}
+
+func TestContracts(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	client, _ := f.Company()
+	product, _ := f.Product()
+	remit, _ := f.RemitInformation()
+
+	create := func(body string) Contract {
+		resp, response, _ := makeRequest(server, "POST", pathContracts, body)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(response))
+		}
+		var contract Contract
+		json.Unmarshal(response, &contract)
+		return contract
+	}
+	monthly := create(fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d, "name": "Hosting",
+		"start_date": "2024-01-15T00:00:00Z", "lines": [{"product_id": %d, "quantity": 2}]}`, issuer.ID, client.ID, remit.ID, product.ID))
+	quarterly := create(fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d, "name": "Support", "cadence": "quarterly",
+		"start_date": "2024-02-01T00:00:00Z", "end_date": "2024-12-31T00:00:00Z", "lines": [{"product_id": %d, "quantity": 1, "unit_price": 90}]}`,
+		issuer.ID, client.ID, remit.ID, product.ID))
+	if monthly.Cadence != CadenceMonthly || len(monthly.Lines) != 1 {
+		t.Errorf("Expected a monthly contract with its line, got %+v", monthly)
+	}
+
+	resp, body, _ := makeRequest(server, "POST", pathContracts, fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d,
+		"name": "Weekly", "cadence": "weekly", "start_date": "2024-01-01T00:00:00Z", "lines": [{"product_id": %d}]}`, issuer.ID, client.ID, remit.ID, product.ID))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown cadence, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	_, body, _ = makeRequest(server, "GET", pathReportsRecurringRevenue+"?date=2024-06-01", "")
+	var revenue RecurringRevenue
+	json.Unmarshal(body, &revenue)
+	if revenue.MRR != moneyFromFloat(230) || len(revenue.Contracts) != 2 {
+		t.Errorf("Expected 200 a month of hosting and 90 a quarter of support, got %s", body)
+	}
+
+	billed := map[uint]uint{}
+	run := func(path string) BillingSummary {
+		resp, body, _ := makeRequest(server, "POST", path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var summary BillingSummary
+		json.Unmarshal(body, &summary)
+		for _, result := range summary.Invoiced {
+			billed[result.ContractID] = result.InvoiceIDs[0]
+		}
+		return summary
+	}
+	if summary := run(pathBillingRun + "?month=2024-05"); len(summary.Invoiced) != 2 || len(summary.Failed) != 0 {
+		t.Fatalf("Expected both contracts invoiced for May, got %+v", summary)
+	}
+	for contractID, total := range map[uint]Money{monthly.ID: moneyFromFloat(200), quarterly.ID: moneyFromFloat(90)} {
+		invoice, err := testRepo.GetInvoice(billed[contractID])
+		if err != nil || invoice.Total() != total || invoice.ClientID != client.ID {
+			t.Errorf("Expected contract %d invoiced %s, got %+v %v", contractID, total, invoice, err)
+		}
+	}
+	if invoice, _ := testRepo.GetInvoice(billed[quarterly.ID]); *invoice.AdditionalInformation != "Support, 2024-05 to 2024-07" {
+		t.Errorf("Expected the quarter on the invoice, got %q", *invoice.AdditionalInformation)
+	}
+
+	if summary := run(pathBillingRun + "?month=2024-05"); len(summary.Invoiced) != 0 || len(summary.Skipped) != 2 {
+		t.Errorf("Expected the rerun to skip the invoiced contracts, got %+v", summary)
+	}
+	if summary := run(pathBillingRun + "?month=2024-04"); len(summary.Invoiced) != 1 || summary.Invoiced[0].ContractID != monthly.ID {
+		t.Errorf("Expected only the monthly contract due in April, got %+v", summary)
+	}
+
+	resp, body, _ = makeRequest(server, "DELETE", routePath(pathProduct, product.ID), "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 deleting a product under contract, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+
+	ended := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	quarterly.EndDate = &ended
+	update, _ := json.Marshal(quarterly)
+	resp, body, _ = makeRequest(server, "PUT", routePath(pathContract, quarterly.ID), string(update))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	_, body, _ = makeRequest(server, "GET", pathReportsRecurringRevenue+"?date=2024-06-01", "")
+	revenue = RecurringRevenue{}
+	json.Unmarshal(body, &revenue)
+	if revenue.MRR != moneyFromFloat(200) || len(revenue.Contracts) != 1 {
+		t.Errorf("Expected the ended contract left out, got %s", body)
+	}
+
+	resp, _, _ = makeRequest(server, "DELETE", routePath(pathContract, quarterly.ID), "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if _, err := testRepo.GetInvoice(billed[quarterly.ID]); err != nil {
+		t.Errorf("Expected the invoices of a deleted contract kept, got %v", err)
+	}
+}
+
+func TestPriceLists(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	product, _ := f.Product()
+	remit, _ := f.RemitInformation()
+
+	resp, body, _ := makeRequest(server, "POST", pathPriceLists, fmt.Sprintf(`{"name": "Partners", "items": [
+		{"product_id": %d, "price": 80, "valid_from": "2024-01-01T00:00:00Z", "valid_until": "2024-06-30T00:00:00Z"},
+		{"product_id": %d, "price": 70, "valid_from": "2024-07-01T00:00:00Z"}]}`, product.ID, product.ID))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var list PriceList
+	json.Unmarshal(body, &list)
+	if len(list.Items) != 2 {
+		t.Fatalf("Expected the price list with its items, got %s", body)
+	}
+	partner, _ := f.Company(func(c *Company) { c.PriceListID = &list.ID })
+	other, _ := f.Company()
+
+	billed := func(client *Company, issued string, line string) Money {
+		resp, body, _ := makeRequest(server, "POST", pathInvoices, fmt.Sprintf(`{"company_id": %d, "client_id": %d, "remit_information_id": %d,
+			"issue_date": "%sT10:00:00Z", "due_date": "2024-12-31T00:00:00Z", "invoice_lines": [%s]}`, issuer.ID, client.ID, remit.ID, issued, line))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var invoice Invoice
+		json.Unmarshal(body, &invoice)
+		return invoice.InvoiceLines[0].UnitPrice
+	}
+	line := fmt.Sprintf(`{"product_id": %d, "quantity": 1}`, product.ID)
+	for _, tc := range []struct {
+		client *Company
+		issued string
+		line   string
+		price  float64
+	}{
+		{partner, "2024-06-30", line, 80},
+		{partner, "2024-07-01", line, 70},
+		{partner, "2023-12-31", line, 100},
+		{other, "2024-06-30", line, 100},
+		{partner, "2024-06-30", fmt.Sprintf(`{"product_id": %d, "quantity": 1, "unit_price": 95}`, product.ID), 95},
+	} {
+		if price := billed(tc.client, tc.issued, tc.line); price != moneyFromFloat(tc.price) {
+			t.Errorf("Expected client %d billed %.2f on %s, got %s", tc.client.ID, tc.price, tc.issued, price)
+		}
+	}
+
+	resp, err := http.PostForm(server.URL+pathNewInvoiceLines, url.Values{
+		"add_product_id": {fmt.Sprint(product.ID)}, "client_id": {fmt.Sprint(partner.ID)}, "issue_date": {"2024-06-10"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to add the builder line: %v", err)
+	}
+	row, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(row), "80.00") {
+		t.Errorf("Expected the builder to offer the price list price, got %s", row)
+	}
+
+	resp, _, _ = makeRequest(server, "DELETE", routePath(pathPriceList, list.ID), "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if company, _ := testRepo.GetCompany(partner.ID); company.PriceListID != nil {
+		t.Errorf("Expected the client let go of the deleted price list, got %d", *company.PriceListID)
+	}
+	if price := billed(partner, "2024-06-30", line); price != moneyFromFloat(100) {
+		t.Errorf("Expected the product price once the price list is gone, got %s", price)
+	}
+}
+
+func TestRevenueReport(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	alpha, _ := f.Company(func(c *Company) { c.Name = "Alpha" })
+	beta, _ := f.Company(func(c *Company) { c.Name = "Beta" })
+	remit, _ := f.RemitInformation()
+	hosting, _ := f.Product(func(p *Product) { p.Name, p.Price = "Hosting", moneyFromFloat(100) })
+	support, _ := f.Product(func(p *Product) { p.Name, p.Price = "Support", moneyFromFloat(50) })
+
+	issue := func(documentType DocumentType, client *Company, issued time.Time, lines ...InvoiceLine) *Invoice {
+		invoice := &Invoice{Type: documentType, CompanyID: issuer.ID, ClientID: client.ID, RemitInformationID: remit.ID,
+			IssueDate: issued, DueDate: issued.AddDate(0, 0, 30), InvoiceLines: lines}
+		if err := testRepo.CreateInvoice(invoice); err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		return invoice
+	}
+	pay := func(invoice *Invoice, amount float64, date time.Time) {
+		if err := testRepo.db.Create(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(amount), Date: date}).Error; err != nil {
+			t.Fatalf("Failed to create the payment: %v", err)
+		}
+	}
+	may := issue(DocumentInvoice, alpha, time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC),
+		InvoiceLine{ProductID: &hosting.ID, Quantity: 2}, InvoiceLine{ProductID: &support.ID, Quantity: 1})
+	june := issue(DocumentInvoice, beta, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), InvoiceLine{ProductID: &hosting.ID, Quantity: 1})
+	issue(DocumentCreditNote, alpha, time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC), InvoiceLine{ProductID: &support.ID, Quantity: 1})
+	issue(DocumentQuote, beta, time.Date(2024, 6, 20, 0, 0, 0, 0, time.UTC), InvoiceLine{ProductID: &hosting.ID, Quantity: 10})
+	pay(may, 125, time.Date(2024, 6, 5, 0, 0, 0, 0, time.UTC))
+	pay(june, 100, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC))
+
+	report := func(path string) []RevenueLine {
+		resp, body, _ := makeRequest(server, "GET", path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var lines []RevenueLine
+		json.Unmarshal(body, &lines)
+		return lines
+	}
+	describe := func(lines []RevenueLine) string {
+		var parts []string
+		for _, line := range lines {
+			parts = append(parts, fmt.Sprintf("%s %s/%s", line.Group, line.Invoiced, line.Received))
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	for path, expected := range map[string]string{
+		pathReportsRevenue:                                     "2024-05 250.00/0.00, 2024-06 50.00/225.00",
+		pathReportsRevenue + "?group_by=client":                "Alpha 200.00/125.00, Beta 100.00/100.00",
+		pathReportsRevenue + "?group_by=product":               "Hosting 300.00/200.00, Support 0.00/25.00",
+		pathReportsRevenue + "?group_by=month&from=2024-06-01": "2024-06 50.00/225.00",
+		pathReportsRevenue + "?group_by=client&to=2024-06-03":  "Alpha 250.00/0.00, Beta 100.00/100.00",
+	} {
+		if got := describe(report(path)); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, path, got)
+		}
+	}
+	if lines := report(pathReportsRevenue + "?group_by=client"); lines[0].ID == nil || *lines[0].ID != alpha.ID {
+		t.Errorf("Expected the client IDs, got %+v", lines)
+	}
+
+	resp, body, _ := makeRequest(server, "GET", pathReportsRevenue+"?format=csv", "")
+	if resp.Header.Get("Content-Type") != "text/csv" || !strings.HasPrefix(string(body), "group,id,invoiced,received\n2024-05,,250,0\n") {
+		t.Errorf("Expected the report as CSV, got %s", body)
+	}
+	if resp, _, _ := makeRequest(server, "GET", pathReportsRevenue+"?group_by=year", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown grouping, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientReport(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 30, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	alpha, _ := f.Company(func(c *Company) { c.Name = "Alpha" })
+	beta, _ := f.Company(func(c *Company) { c.Name = "Beta" })
+	gamma, _ := f.Company(func(c *Company) { c.Name = "Gamma" })
+	f.Company(func(c *Company) { c.Name = "Delta" })
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+
+	day := func(month time.Month, day int) time.Time { return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC) }
+	issue := func(documentType DocumentType, client *Company, issued, due time.Time, quantity float64) *Invoice {
+		invoice := &Invoice{Type: documentType, CompanyID: issuer.ID, ClientID: client.ID, RemitInformationID: remit.ID,
+			IssueDate: issued, DueDate: due, InvoiceLines: []InvoiceLine{{ProductID: &product.ID, Quantity: quantity}}}
+		if err := testRepo.CreateInvoice(invoice); err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		return invoice
+	}
+	pay := func(invoice *Invoice, amount float64, date time.Time) {
+		if err := testRepo.CreatePayment(&Payment{InvoiceID: invoice.ID, Amount: moneyFromFloat(amount), Date: date}); err != nil {
+			t.Fatalf("Failed to create the payment: %v", err)
+		}
+	}
+	pay(issue(DocumentInvoice, alpha, day(5, 1), day(5, 31), 2), 200, day(5, 11))
+	pay(issue(DocumentInvoice, alpha, day(6, 1), day(6, 15), 1), 40, day(6, 5))
+	pay(issue(DocumentInvoice, beta, day(6, 1), day(7, 31), 1), 100, day(6, 21))
+	issue(DocumentCreditNote, beta, day(6, 10), day(6, 10), 0.5)
+	issue(DocumentInvoice, gamma, day(1, 1), day(1, 31), 5)
+
+	report := func(path string) ([]ClientReportLine, string) {
+		resp, body, _ := makeRequest(server, "GET", path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var lines []ClientReportLine
+		json.Unmarshal(body, &lines)
+		var names []string
+		for _, line := range lines {
+			names = append(names, line.Client)
+		}
+		if resp.Header.Get("X-Total-Count") != "3" {
+			t.Errorf("Expected 3 clients in total, got %s", resp.Header.Get("X-Total-Count"))
+		}
+		return lines, strings.Join(names, " ")
+	}
+
+	lines, order := report(pathReportsClients)
+	if order != "Gamma Alpha Beta" {
+		t.Fatalf("Expected the clients billed, most invoiced first, got %s", order)
+	}
+	alphaLine := lines[1]
+	if alphaLine.Invoiced != moneyFromFloat(300) || alphaLine.Received != moneyFromFloat(240) ||
+		alphaLine.Overdue != moneyFromFloat(60) || alphaLine.AverageDaysToPay == nil || *alphaLine.AverageDaysToPay != 10 {
+		t.Errorf("Expected Alpha invoiced 300, received 240, 60 overdue and paying in 10 days, got %+v", alphaLine)
+	}
+	if lines[0].AverageDaysToPay != nil || lines[0].Overdue != moneyFromFloat(500) || lines[2].Invoiced != moneyFromFloat(50) {
+		t.Errorf("Expected Gamma 500 overdue and Beta credited, got %+v", lines)
+	}
+
+	for path, expected := range map[string]string{
+		pathReportsClients + "?sort=overdue":                    "Gamma Alpha Beta",
+		pathReportsClients + "?sort=client":                     "Alpha Beta Gamma",
+		pathReportsClients + "?sort=client&order=desc":          "Gamma Beta Alpha",
+		pathReportsClients + "?sort=average_days_to_pay":        "Beta Alpha Gamma",
+		pathReportsClients + "?limit=1&offset=1":                "Alpha",
+		pathReportsClients + "?sort=received&order=asc&limit=2": "Gamma Beta",
+	} {
+		if _, order := report(path); order != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, path, order)
+		}
+	}
+
+	resp, body, _ := makeRequest(server, "GET", pathReportsClients+"?format=csv&sort=client", "")
+	if !strings.HasPrefix(string(body), "client_id,client,invoiced,received,average_days_to_pay,overdue\n") {
+		t.Errorf("Expected the report as CSV, got %s", body)
+	}
+	for _, path := range []string{pathReportsClients + "?sort=margin", pathReportsClients + "?limit=0", pathReportsClients + "?order=up"} {
+		if resp, _, _ = makeRequest(server, "GET", path, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestSavedViews(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 30, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	alpha, _ := f.Company(func(c *Company) { c.Name = "Alpha" })
+	beta, _ := f.Company(func(c *Company) { c.Name = "Beta" })
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+
+	day := func(month time.Month, day int) time.Time { return time.Date(2024, month, day, 0, 0, 0, 0, time.UTC) }
+	issue := func(client *Company, due time.Time, quantity float64) *Invoice {
+		invoice := &Invoice{Type: DocumentInvoice, CompanyID: issuer.ID, ClientID: client.ID, RemitInformationID: remit.ID,
+			IssueDate: due.AddDate(0, 0, -30), DueDate: due, InvoiceLines: []InvoiceLine{{ProductID: &product.ID, Quantity: quantity}}}
+		if err := testRepo.CreateInvoice(invoice); err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		return invoice
+	}
+	longOverdue := issue(beta, day(4, 30), 1)
+	olderOverdue := issue(alpha, day(3, 31), 3)
+	issue(alpha, day(6, 15), 2)
+	paid := issue(beta, day(4, 15), 1)
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: paid.ID, Amount: paid.Total(), Date: day(5, 1)}); err != nil {
+		t.Fatalf("Failed to create the payment: %v", err)
+	}
+
+	list := func(path string) []uint {
+		resp, body, _ := makeRequest(server, "GET", path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d. Response: %s", path, resp.StatusCode, string(body))
+		}
+		var summaries []InvoiceSummary
+		json.Unmarshal(body, &summaries)
+		ids := []uint{}
+		for _, summary := range summaries {
+			ids = append(ids, summary.ID)
+		}
+		return ids
+	}
+
+	// Filters and sorts of the list are the ones views save
+	if ids := list(pathInvoices + "?overdue_days=30&sort=client"); fmt.Sprint(ids) != fmt.Sprint([]uint{olderOverdue.ID, longOverdue.ID}) {
+		t.Errorf("Expected the invoices unpaid more than 30 days by client, got %v", ids)
+	}
+	if ids := list(pathInvoices + "?sort=total&order=desc&paid=false"); len(ids) != 3 || ids[0] != olderOverdue.ID {
+		t.Errorf("Expected the unpaid invoices largest first, got %v", ids)
+	}
+
+	resp, body, _ := makeRequest(server, "POST", pathSavedViews,
+		`{"name": " Unpaid > 30 days ", "filter": {"overdue_days": 30, "sort": "due_date", "descending": true}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var view SavedView
+	json.Unmarshal(body, &view)
+	if view.Name != "Unpaid > 30 days" || view.Filter.OverdueDays == nil || *view.Filter.OverdueDays != 30 {
+		t.Errorf("Expected the view saved, got %+v", view)
+	}
+
+	// The view's filter replaces the one of the query
+	if ids := list(pathInvoices + fmt.Sprintf("?saved_view=%d&client_id=%d", view.ID, alpha.ID)); fmt.Sprint(ids) != fmt.Sprint([]uint{longOverdue.ID, olderOverdue.ID}) {
+		t.Errorf("Expected the view's invoices latest due first, got %v", ids)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathReportsInvoiceTotals+fmt.Sprintf("?saved_view=%d", view.ID), "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"count":2`) {
+		t.Errorf("Expected the totals of the view, got %d %s", resp.StatusCode, body)
+	}
+
+	// Views are relative to today
+	setupSimulatedClock(t, time.Date(2024, 7, 20, 9, 0, 0, 0, time.UTC))
+	if ids := list(pathInvoices + fmt.Sprintf("?saved_view=%d&format=json", view.ID)); len(ids) != 3 {
+		t.Errorf("Expected a third invoice unpaid more than 30 days, got %v", ids)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", pathSavedViews, `{"name": "Unpaid > 30 days", "filter": {}}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a duplicate name refused, got %d %s", resp.StatusCode, body)
+	}
+	resp, body, _ = makeRequest(server, "POST", pathSavedViews, `{"name": "Largest", "filter": {"sort": "margin"}}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown sort refused, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, body, _ = makeRequest(server, "PUT", routePath(pathSavedView, view.ID),
+		fmt.Sprintf(`{"name": "Alpha", "filter": {"client_id": %d}}`, alpha.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	if ids := list(pathInvoices + fmt.Sprintf("?saved_view=%d&view=summary", view.ID)); len(ids) != 2 {
+		t.Errorf("Expected the updated view applied, got %v", ids)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathSavedViews, "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"name":"Alpha"`) {
+		t.Errorf("Expected the views listed, got %d %s", resp.StatusCode, body)
+	}
+
+	if resp, _, _ = makeRequest(server, "DELETE", routePath(pathSavedView, view.ID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if resp, _, _ = makeRequest(server, "GET", pathInvoices+fmt.Sprintf("?saved_view=%d", view.ID), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a deleted view not found, got %d", resp.StatusCode)
+	}
+	if resp, _, _ = makeRequest(server, "GET", routePath(pathSavedView, view.ID), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a deleted view not found, got %d", resp.StatusCode)
+	}
+}
+
+func TestBulkInvoiceStatus(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 30, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	client, _ := f.Company()
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+
+	issue := func(quantity float64) *Invoice {
+		invoice := &Invoice{Type: DocumentInvoice, CompanyID: issuer.ID, ClientID: client.ID, RemitInformationID: remit.ID,
+			DueDate: time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC), InvoiceLines: []InvoiceLine{{ProductID: &product.ID, Quantity: quantity}}}
+		if err := testRepo.CreateInvoice(invoice); err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		return invoice
+	}
+	first, second, third := issue(1), issue(2), issue(3)
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: second.ID, Amount: moneyFromFloat(50), Date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatalf("Failed to create the payment: %v", err)
+	}
+
+	bulk := func(body string, expected int) BulkStatusUpdate {
+		resp, response, _ := makeRequest(server, "POST", pathInvoicesBulkStatus, body)
+		if resp.StatusCode != expected {
+			t.Fatalf("Expected status %d for %s, got %d. Response: %s", expected, body, resp.StatusCode, string(response))
+		}
+		var update BulkStatusUpdate
+		json.Unmarshal(response, &update)
+		return update
+	}
+
+	update := bulk(fmt.Sprintf(`{"ids": [%d, %d], "status": "sent"}`, first.ID, second.ID), http.StatusOK)
+	if !update.Applied || len(update.Results) != 2 || update.Results[1].Error != "" {
+		t.Errorf("Expected both invoices sent, got %+v", update)
+	}
+
+	// One invoice failing leaves the others alone
+	update = bulk(fmt.Sprintf(`{"ids": [%d, %d, 999], "status": "paid"}`, first.ID, second.ID), http.StatusUnprocessableEntity)
+	if update.Applied || update.Results[0].Error != "" || update.Results[0].PaymentID != nil || update.Results[2].Error != "invoice 999 not found" {
+		t.Errorf("Expected the missing invoice reported, got %+v", update)
+	}
+	if payments, _ := testRepo.GetPayments(first.ID); len(payments) != 0 {
+		t.Errorf("Expected nothing paid, got %d payments", len(payments))
+	}
+
+	update = bulk(fmt.Sprintf(`{"ids": [%d, %d], "status": "paid"}`, first.ID, second.ID), http.StatusOK)
+	if !update.Applied || update.Results[1].PaymentID == nil {
+		t.Fatalf("Expected both invoices paid, got %+v", update)
+	}
+	paid, _ := testRepo.GetInvoice(second.ID)
+	payments, _ := testRepo.GetPayments(second.ID)
+	if !paid.Paid || len(payments) != 2 || payments[1].Amount != moneyFromFloat(150) {
+		t.Errorf("Expected the rest of the invoice paid, got %v %+v", paid.Paid, payments)
+	}
+	update = bulk(fmt.Sprintf(`{"ids": [%d], "status": "paid"}`, first.ID), http.StatusUnprocessableEntity)
+	if update.Results[0].Error != ErrInvoiceAlreadyPaid.Error() {
+		t.Errorf("Expected a paid invoice refused, got %+v", update)
+	}
+
+	// Cancelling credits sent invoices in full
+	update = bulk(fmt.Sprintf(`{"ids": [%d], "status": "cancelled"}`, third.ID), http.StatusUnprocessableEntity)
+	if update.Results[0].Error != ErrDraftCancellation.Error() {
+		t.Errorf("Expected a draft refused, got %+v", update)
+	}
+	bulk(fmt.Sprintf(`{"ids": [%d], "status": "sent"}`, third.ID), http.StatusOK)
+	update = bulk(fmt.Sprintf(`{"ids": [%d], "status": "cancelled"}`, third.ID), http.StatusOK)
+	if update.Results[0].CreditNoteID == nil {
+		t.Fatalf("Expected a credit note, got %+v", update)
+	}
+	creditNote, _ := testRepo.GetInvoice(*update.Results[0].CreditNoteID)
+	cancelled, _ := testRepo.GetInvoice(third.ID)
+	if creditNote.Type != DocumentCreditNote || creditNote.TotalAmount != cancelled.TotalAmount || creditNote.Draft() || cancelled.Paid || cancelled.CancelledAt == nil {
+		t.Errorf("Expected the invoice credited and cancelled, got %+v and %+v", creditNote, cancelled)
+	}
+
+	// Cancelled invoices are neither paid nor left to pay
+	var summaries []InvoiceSummary
+	_, body, _ := makeRequest(server, "GET", pathInvoices+"?cancelled=true", "")
+	if json.Unmarshal(body, &summaries); len(summaries) != 1 || summaries[0].ID != third.ID || summaries[0].Status != InvoiceStatusCancelled {
+		t.Errorf("Expected the invoice listed as cancelled, got %s", body)
+	}
+	for query, expected := range map[string]int{"paid=true": 2, "paid=false": 0, "cancelled=false": 2} {
+		_, body, _ = makeRequest(server, "GET", pathInvoices+"?type=invoice&"+query, "")
+		if json.Unmarshal(body, &summaries); len(summaries) != expected {
+			t.Errorf("Expected the cancelled invoice left out of %s, got %s", query, body)
+		}
+	}
+	if stats, err := testRepo.dashboardStats(InvoiceFilter{IDs: []uint{third.ID}}, clock.Now()); err != nil || stats.Open != 0 || stats.Invoices.Paid != 0 {
+		t.Errorf("Expected the cancelled invoice neither open nor paid on the dashboard, got %+v %v", stats, err)
+	}
+	if err := testRepo.CreatePayment(&Payment{InvoiceID: third.ID, Amount: moneyFromFloat(10), Date: clock.Now()}); !errors.Is(err, ErrDocumentNotPayable) {
+		t.Errorf("Expected a payment of the cancelled invoice refused, got %v", err)
+	}
+	if err := testRepo.UpdateInvoice(cancelled); !errors.Is(err, ErrInvoiceIssued) || !strings.Contains(err.Error(), "was cancelled") {
+		t.Errorf("Expected the cancelled invoice kept as is, got %v", err)
+	}
+
+	// Invoices cancelled by marking them paid are told apart by their timeline
+	if _, err := testRepo.MigrateTo(55); err != nil {
+		t.Fatalf("Failed to migrate down: %v", err)
+	}
+	var paidBefore bool
+	testRepo.db.Table("invoices").Select("paid").Where("id = ?", third.ID).Scan(&paidBefore)
+	if _, err := testRepo.MigrateUp(); err != nil {
+		t.Fatalf("Failed to migrate up: %v", err)
+	}
+	if migrated, _ := testRepo.GetInvoice(third.ID); !paidBefore || migrated.Paid || migrated.CancelledAt == nil {
+		t.Errorf("Expected the invoice paid before the migration and cancelled after, got %v and %+v", paidBefore, migrated)
+	}
+	update = bulk(fmt.Sprintf(`{"ids": [%d], "status": "cancelled"}`, third.ID), http.StatusUnprocessableEntity)
+	if update.Results[0].Error != ErrInvoiceAlreadyCancelled.Error() {
+		t.Errorf("Expected a second cancellation refused, got %+v", update)
+	}
+
+	for _, body := range []string{`{"ids": [1], "status": "void"}`, `{"ids": [], "status": "paid"}`, `{"ids": [1, 1], "status": "paid"}`} {
+		bulk(body, http.StatusBadRequest)
+	}
+}
+
+func TestBankStatementImport(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	setupSimulatedClock(t, time.Date(2024, 6, 30, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	acme, _ := f.Company(func(c *Company) { c.Name = "Acme" })
+	globex, _ := f.Company(func(c *Company) { c.Name = "Globex" })
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+
+	issue := func(client *Company, quantity float64, send bool) *Invoice {
+		invoice := &Invoice{Type: DocumentInvoice, CompanyID: issuer.ID, ClientID: client.ID, RemitInformationID: remit.ID,
+			DueDate: time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC), InvoiceLines: []InvoiceLine{{ProductID: &product.ID, Quantity: quantity}}}
+		if err := testRepo.CreateInvoice(invoice); err != nil {
+			t.Fatalf("Failed to create the invoice: %v", err)
+		}
+		if send {
+			sent, err := testRepo.SendInvoice(invoice.ID, clock.Now())
+			if err != nil {
+				t.Fatalf("Failed to send the invoice: %v", err)
+			}
+			return sent
+		}
+		return invoice
+	}
+	referenced := issue(acme, 1, true)
+	issue(globex, 2, true)
+	globexOpen := issue(globex, 3, true)
+	acmeOpen := issue(acme, 3, true)
+	issue(acme, 5, false)
+
+	statement := fmt.Sprintf(`OFXHEADER:100
+<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS><BANKTRANLIST>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20240610120000<TRNAMT>100.00<FITID>T1<NAME>ACME INC<MEMO>Invoice %s</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20240611<TRNAMT>200.00<FITID>T2<NAME>Somebody</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20240612<TRNAMT>300.00<FITID>T3<NAME>J. Doe</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20240613<TRNAMT>300.00<FITID>T4<NAME>GLOBEX CORPORATION</STMTTRN>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20240614<TRNAMT>-50.00<FITID>T5<NAME>Bank fees</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20240615<TRNAMT>500.00<FITID>T6<NAME>Acme</STMTTRN>
+</BANKTRANLIST></STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>`, referenced.Identification())
+
+	importStatement := func(body string) BankImport {
+		resp, response, _ := makeRequest(server, "POST", pathPaymentsImport, body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(response))
+		}
+		var result BankImport
+		json.Unmarshal(response, &result)
+		return result
+	}
+
+	result := importStatement(statement)
+	if result.Imported != 5 || result.Ignored != 1 || len(result.Matched) != 3 || len(result.Unmatched) != 2 {
+		t.Fatalf("Expected 3 transactions matched and 2 left, got %+v", result)
+	}
+	matched := map[string]uint{}
+	for _, transaction := range result.Matched {
+		matched[transaction.ExternalID] = transaction.Payment.InvoiceID
+	}
+	if matched["T1"] != referenced.ID || matched["T4"] != globexOpen.ID {
+		t.Errorf("Expected the invoices matched by reference and by payer, got %v", matched)
+	}
+	ambiguous := result.Unmatched[0]
+	if ambiguous.ExternalID != "T3" || fmt.Sprint(ambiguous.Candidates) != fmt.Sprint([]uint{globexOpen.ID, acmeOpen.ID}) {
+		t.Errorf("Expected both invoices of the amount as candidates, got %+v", ambiguous)
+	}
+	if paid, _ := testRepo.GetInvoice(referenced.ID); !paid.Paid {
+		t.Error("Expected the matched invoice paid")
+	}
+
+	// Importing a statement again records nothing twice
+	if result = importStatement(statement); result.Imported != 0 || result.Duplicates != 5 {
+		t.Errorf("Expected the transactions recognized, got %+v", result)
+	}
+	csvStatement := "Date,Amount,Description,Name\n2024-06-20,\"99,50\",Misc,Jane\n"
+	if result = importStatement(csvStatement); result.Imported != 1 || result.Unmatched[0].Amount != moneyFromFloat(99.5) {
+		t.Errorf("Expected the CSV transaction imported, got %+v", result)
+	}
+	if result = importStatement(csvStatement); result.Duplicates != 1 {
+		t.Errorf("Expected the CSV transaction recognized, got %+v", result)
+	}
+
+	resp, body, _ := makeRequest(server, "GET", pathBankTransactions+"?unmatched=true", "")
+	var unmatched []BankTransaction
+	json.Unmarshal(body, &unmatched)
+	if resp.StatusCode != http.StatusOK || len(unmatched) != 3 || unmatched[2].ExternalID != "T3" || len(unmatched[2].Candidates) != 1 {
+		t.Fatalf("Expected the transactions left to assign, the last invoice of the amount a candidate, got %d %+v", resp.StatusCode, unmatched)
+	}
+
+	resp, body, _ = makeRequest(server, "POST", routePath(pathBankTransactionAssign, ambiguous.ID), fmt.Sprintf(`{"invoice_id": %d}`, acmeOpen.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var assigned BankTransaction
+	json.Unmarshal(body, &assigned)
+	if assigned.PaymentID == nil || assigned.Payment.InvoiceID != acmeOpen.ID {
+		t.Errorf("Expected the transaction recorded as a payment, got %+v", assigned)
+	}
+	if paid, _ := testRepo.GetInvoice(acmeOpen.ID); !paid.Paid {
+		t.Error("Expected the assigned invoice paid")
+	}
+	resp, _, _ = makeRequest(server, "POST", routePath(pathBankTransactionAssign, ambiguous.ID), fmt.Sprintf(`{"invoice_id": %d}`, acmeOpen.ID))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a matched transaction refused, got %d", resp.StatusCode)
+	}
+
+	// Deleting the payment leaves the transaction to assign again
+	if resp, _, _ = makeRequest(server, "DELETE", routePath(pathPayment, *assigned.PaymentID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathBankTransactions, "")
+	var transactions []BankTransaction
+	json.Unmarshal(body, &transactions)
+	if len(transactions) != 6 || transactions[3].ExternalID != "T3" || transactions[3].PaymentID != nil {
+		t.Errorf("Expected the transaction unmatched again, got %+v", transactions)
+	}
+
+	for _, statement := range []string{"not a statement", "Date,Amount\n06/20/2024,10\n", "<OFX><STMTTRN><DTPOSTED>20240610<TRNAMT>abc</STMTTRN></OFX>"} {
+		if resp, _, _ = makeRequest(server, "POST", pathPaymentsImport, statement); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %q refused, got %d", statement, resp.StatusCode)
+		}
+	}
+}
+
+func TestBankConnector(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	simulated := setupSimulatedClock(t, time.Date(2024, 6, 30, 9, 0, 0, 0, time.UTC))
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company()
+	acme, _ := f.Company(func(c *Company) { c.Name = "Acme" })
+	remit, _ := f.RemitInformation()
+	product, _ := f.Product()
+	invoice := &Invoice{Type: DocumentInvoice, CompanyID: issuer.ID, ClientID: acme.ID, RemitInformationID: remit.ID,
+		DueDate: time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC), InvoiceLines: []InvoiceLine{{ProductID: &product.ID, Quantity: 2}}}
+	if err := testRepo.CreateInvoice(invoice); err != nil {
+		t.Fatalf("Failed to create the invoice: %v", err)
+	}
+	invoice, _ = testRepo.SendInvoice(invoice.ID, clock.Now())
+
+	// Not configured, polling is refused
+	original := bankConnector
+	t.Cleanup(func() { bankConnector = original })
+	bankConnector = newPixBankConnector(BankConfig{})
+	if resp, _, _ := makeRequest(server, "POST", pathBankPoll, ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 without a bank API, got %d", resp.StatusCode)
+	}
+
+	var requests []url.Values
+	var failing bool
+	bank := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pix" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		requests = append(requests, r.URL.Query())
+		if r.URL.Query().Get("paginacao.paginaAtual") == "0" {
+			fmt.Fprintf(w, `{"parametros": {"paginacao": {"paginaAtual": 0, "quantidadeDePaginas": 2}},
+				"pix": [{"endToEndId": "E1", "txid": "%s", "valor": "200.00", "horario": "2024-06-29T10:00:00Z", "pagador": {"nome": "ACME LTDA"}}]}`,
+				invoice.Identification())
+			return
+		}
+		fmt.Fprint(w, `{"parametros": {"paginacao": {"paginaAtual": 1, "quantidadeDePaginas": 2}},
+			"pix": [{"endToEndId": "E2", "valor": "12.34", "horario": "2024-06-29T11:00:00Z", "pagador": {"nome": "Jane"}}]}`)
+	}))
+	defer bank.Close()
+	bankConnector = newPixBankConnector(BankConfig{PixURL: bank.URL + pathRoot, APIToken: "secret"})
+
+	resp, body, _ := makeRequest(server, "POST", pathBankPoll, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var result BankImport
+	json.Unmarshal(body, &result)
+	if result.Imported != 2 || len(result.Matched) != 1 || len(result.Unmatched) != 1 || len(requests) != 2 {
+		t.Fatalf("Expected both pages imported and the Pix matched, got %+v after %d requests", result, len(requests))
+	}
+	if requests[0].Get("inicio") != "2024-06-23T09:00:00Z" || requests[0].Get("fim") != "2024-06-30T09:00:00Z" {
+		t.Errorf("Expected the first poll to go a week back, got %v", requests[0])
+	}
+	if paid, _ := testRepo.GetInvoice(invoice.ID); !paid.Paid {
+		t.Error("Expected the invoice paid automatically")
+	}
+
+	// The next poll starts an hour before the last one ended, skipping what
+	// it already saw; a failed one is retried from the same point
+	simulated.Advance(15 * time.Minute)
+	failing = true
+	if resp, _, _ = makeRequest(server, "POST", pathBankPoll, ""); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502 when the bank fails, got %d", resp.StatusCode)
+	}
+	failing, requests = false, nil
+	resp, body, _ = makeRequest(server, "POST", pathBankPoll, "")
+	json.Unmarshal(body, &result)
+	if resp.StatusCode != http.StatusOK || result.Imported != 0 || result.Duplicates != 2 || requests[0].Get("inicio") != "2024-06-30T08:00:00Z" {
+		t.Errorf("Expected the transfers recognized, got %d %+v from %v", resp.StatusCode, result, requests[0])
+	}
+
+	resp, body, _ = makeRequest(server, "GET", pathBankReconciliation, "")
+	var reconciliation BankReconciliation
+	json.Unmarshal(body, &reconciliation)
+	if resp.StatusCode != http.StatusOK || len(reconciliation.Matched) != 1 || len(reconciliation.Unmatched) != 1 ||
+		reconciliation.Matched[0].Source != BankSourcePix || reconciliation.LastPoll == nil || !reconciliation.LastPoll.Until.Equal(clock.Now()) {
+		t.Fatalf("Expected the match to review and the last poll, got %d %+v", resp.StatusCode, reconciliation)
+	}
+	matched, unmatched := reconciliation.Matched[0], reconciliation.Unmatched[0]
+
+	if resp, _, _ = makeRequest(server, "POST", routePath(pathBankTransactionConfirm, unmatched.ID), ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected an unmatched transaction refused, got %d", resp.StatusCode)
+	}
+	if resp, _, _ = makeRequest(server, "POST", routePath(pathBankTransactionConfirm, 999), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+
+	// Rejecting the match deletes its payment, the invoice is open again
+	resp, body, _ = makeRequest(server, "POST", routePath(pathBankTransactionReject, matched.ID), "")
+	var rejected BankTransaction
+	json.Unmarshal(body, &rejected)
+	if resp.StatusCode != http.StatusOK || rejected.PaymentID != nil {
+		t.Fatalf("Expected the match undone, got %d %+v", resp.StatusCode, rejected)
+	}
+	if open, _ := testRepo.GetInvoice(invoice.ID); open.Paid {
+		t.Error("Expected the invoice unpaid after the rejection")
+	}
+	if payments, _ := testRepo.GetPayments(invoice.ID); len(payments) != 0 {
+		t.Errorf("Expected the payment deleted, got %+v", payments)
+	}
+
+	// Assigning it by hand reviews it, confirming leaves nothing to review
+	makeRequest(server, "POST", routePath(pathBankTransactionAssign, unmatched.ID), fmt.Sprintf(`{"invoice_id": %d}`, invoice.ID))
+	makeRequest(server, "POST", routePath(pathBankTransactionAssign, matched.ID), fmt.Sprintf(`{"invoice_id": %d}`, invoice.ID))
+	resp, body, _ = makeRequest(server, "GET", pathBankReconciliation, "")
+	reconciliation = BankReconciliation{}
+	json.Unmarshal(body, &reconciliation)
+	if len(reconciliation.Matched) != 0 || len(reconciliation.Unmatched) != 0 {
+		t.Errorf("Expected nothing left to review, got %+v", reconciliation)
+	}
+	resp, body, _ = makeRequest(server, "POST", routePath(pathBankTransactionConfirm, matched.ID), "")
+	var confirmed BankTransaction
+	json.Unmarshal(body, &confirmed)
+	if resp.StatusCode != http.StatusOK || confirmed.ReviewedAt == nil {
+		t.Errorf("Expected the transaction confirmed, got %d %+v", resp.StatusCode, confirmed)
+	}
+}
+
+func TestIssuerSettings(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	config.InvoiceNumbering = NumberingOnSend
+	t.Cleanup(func() { config.InvoiceNumbering = NumberingManual })
+
+	f := NewFactory(testRepo)
+	client, _ := f.Company()
+	product, _ := f.Product()
+	sharedRemit, _ := f.RemitInformation()
+	ownRemit, _ := f.RemitInformation()
+	cacheSettings(Settings{InvoicePrefix: "INV-", DefaultRemitID: &sharedRemit.ID})
+	t.Cleanup(func() { cacheSettings(Settings{}) })
+
+	main, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	resp, body, _ := makeRequest(server, "POST", pathCompanies, fmt.Sprintf(`{"name": "Branch", "document": "98.765.432/0001-10", "address": "Rua C, 3",
+		"is_issuer": true, "invoice_prefix": "BR-", "numbering_strategy": "yearly", "default_remit_id": %d}`, ownRemit.ID))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var branch Company
+	json.Unmarshal(body, &branch)
+
+	// Invoices created without remit information are paid to the issuer's,
+	// and numbered the issuer's way
+	issue := func(issuer uint) *Invoice {
+		t.Helper()
+		resp, body, _ := makeRequest(server, "POST", pathInvoices, fmt.Sprintf(`{"issue_date": "2024-05-10T00:00:00Z", "due_date": "2024-06-10T00:00:00Z",
+			"company_id": %d, "client_id": %d, "invoice_lines": [{"product_id": %d, "quantity": 1}]}`, issuer, client.ID, product.ID))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var draft Invoice
+		json.Unmarshal(body, &draft)
+		invoice, err := testRepo.SendInvoice(draft.ID, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to send the invoice: %v", err)
+		}
+		return invoice
+	}
+	mainInvoice, branchInvoice := issue(main.ID), issue(branch.ID)
+	issue(branch.ID)
+	if mainInvoice.RemitInformationID != sharedRemit.ID || branchInvoice.RemitInformationID != ownRemit.ID {
+		t.Errorf("Expected the remit information of the settings and of the branch, got %d and %d", mainInvoice.RemitInformationID, branchInvoice.RemitInformationID)
+	}
+	if mainInvoice.Identification() != "INV-0001" || branchInvoice.Identification() != "BR-2024-0001" {
+		t.Errorf("Expected INV-0001 and BR-2024-0001, got %s and %s", mainInvoice.Identification(), branchInvoice.Identification())
+	}
+
+	resp, body, _ = makeRequest(server, "GET", pathInvoices+fmt.Sprintf("?company_id=%d", branch.ID), "")
+	var invoices []Invoice
+	json.Unmarshal(body, &invoices)
+	if resp.StatusCode != http.StatusOK || len(invoices) != 2 || invoices[0].CompanyID != branch.ID {
+		t.Errorf("Expected the invoices of the branch, got %d %+v", resp.StatusCode, invoices)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathReportsRevenue+fmt.Sprintf("?company_id=%d", branch.ID), "")
+	var revenue []RevenueLine
+	json.Unmarshal(body, &revenue)
+	if resp.StatusCode != http.StatusOK || len(revenue) != 1 || revenue[0].Invoiced != moneyFromFloat(200) {
+		t.Errorf("Expected the revenue of the branch, got %d %+v", resp.StatusCode, revenue)
+	}
+
+	for _, company := range []string{`"numbering_strategy": "base36"`, `"invoice_prefix": "A-VERY-LONG-INVOICE-PREFIX-"`} {
+		resp, _, _ = makeRequest(server, "PUT", routePath(pathCompany, branch.ID), `{"name": "Branch", "document": "98.765.432/0001-10", "address": "Rua C, 3", "is_issuer": true, `+company+`}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d", company, resp.StatusCode)
+		}
+	}
+}
+
+func TestBusinessTimezone(t *testing.T) {
+	config.Timezone = "America/Sao_Paulo"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Failed to set the timezone: %v", err)
+	}
+	t.Cleanup(func() {
+		config.Timezone = ""
+		config.Validate()
+	})
+	saoPaulo := config.Location()
+
+	dsn := sqliteDSN(filepath.Join(t.TempDir(), "timezone.db"), 5000, config.Timezone)
+	testDB, err := gorm.Open(sqlite.New(sqlite.Config{DriverName: sqliteUTCDriver, DSN: dsn}), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	testRepo, err := NewRepositoryWithDB(testDB)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := testRepo.Migrate(); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	// Dates are midnight in the business time zone, stored in UTC and read
+	// back in the business time zone
+	dueDate, err := parseDate("2024-06-10")
+	if err != nil {
+		t.Fatalf("Failed to parse the date: %v", err)
+	}
+	setupSimulatedClock(t, dueDate.AddDate(0, 0, -30))
+	invoice, err := NewFactory(testRepo).Invoice(InvoiceSent, func(i *Invoice) { i.DueDate = dueDate })
+	if err != nil {
+		t.Fatalf("Failed to create the invoice: %v", err)
+	}
+	var stored string
+	testDB.Raw("SELECT CAST(due_date AS TEXT) FROM invoices WHERE id = ?", invoice.ID).Scan(&stored)
+	if stored != "2024-06-10 03:00:00+00:00" {
+		t.Errorf("Expected the due date stored in UTC, got %s", stored)
+	}
+	saved, _ := testRepo.GetInvoice(invoice.ID)
+	if saved.DueDate.Location().String() != saoPaulo.String() || saved.DueDate.Format("2006-01-02 15:04") != "2024-06-10 00:00" {
+		t.Errorf("Expected the due date read in the business time zone, got %v", saved.DueDate)
+	}
+
+	// The invoice is overdue from midnight of its due date in São Paulo,
+	// and charged late fees by the days there
+	for _, test := range []struct {
+		now     string
+		overdue bool
+		days    int
+	}{
+		{"2024-06-10T02:30:00Z", false, -1},
+		{"2024-06-10T03:30:00Z", true, 0},
+		{"2024-06-12T02:30:00Z", true, 1},
+	} {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		clock = NewSimulatedClock(now)
+		summaries, err := testRepo.GetInvoiceSummaries(InvoiceFilter{IDs: []uint{invoice.ID}})
+		if err != nil || len(summaries) != 1 {
+			t.Fatalf("Failed to list the invoice: %v", err)
+		}
+		if overdue := summaries[0].Status == InvoiceStatusOverdue; overdue != test.overdue {
+			t.Errorf("At %s expected overdue %v, got %s", test.now, test.overdue, summaries[0].Status)
+		}
+		if days := daysBetween(saved.DueDate, clock.Now()); days != test.days {
+			t.Errorf("At %s expected %d days overdue, got %d", test.now, test.days, days)
+		}
+	}
+
+	// Upgrading rewrites the times stored with another offset in UTC
+	testDB.Exec("UPDATE invoices SET due_date = '2024-06-10 00:00:00-03:00' WHERE id = ?", invoice.ID)
+	if _, err := testRepo.MigrateTo(49); err != nil {
+		t.Fatalf("Failed to revert the migration: %v", err)
+	}
+	if _, err := testRepo.MigrateUp(); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	testDB.Raw("SELECT CAST(due_date AS TEXT) FROM invoices WHERE id = ?", invoice.ID).Scan(&stored)
+	if stored != "2024-06-10 03:00:00.000+00:00" {
+		t.Errorf("Expected the due date rewritten in UTC, got %s", stored)
+	}
+
+	config.Timezone = "Mars/Olympus_Mons"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown timezone refused")
+	}
+}
+
+func TestCustomFields(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	f := NewFactory(testRepo)
+	issuer, _ := f.Company(func(c *Company) { c.IsIssuer = true })
+	product, _ := f.Product()
+	remit, _ := f.RemitInformation()
+
+	var fields []CustomField
+	for _, field := range []string{
+		`{"entity": "invoice", "key": "po_number", "label": "PO number", "type": "text", "required": true}`,
+		`{"entity": "company", "key": "segment", "label": "Segment", "type": "choice", "options": ["retainer", "project"]}`,
+		`{"entity": "company", "key": "seats", "label": "Seats", "type": "number"}`,
+	} {
+		resp, body, _ := makeRequest(server, "POST", pathCustomFields, field)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+		}
+		var created CustomField
+		json.Unmarshal(body, &created)
+		fields = append(fields, created)
+	}
+	for field, status := range map[string]int{
+		`{"entity": "invoice", "key": "po_number", "label": "Again", "type": "text"}`: http.StatusConflict,
+		`{"entity": "invoice", "key": "PO Number", "label": "PO", "type": "text"}`:    http.StatusBadRequest,
+		`{"entity": "invoice", "key": "color", "label": "Color", "type": "colour"}`:   http.StatusBadRequest,
+		`{"entity": "product", "key": "color", "label": "Color", "type": "text"}`:     http.StatusBadRequest,
+		`{"entity": "company", "key": "tier", "label": "Tier", "type": "choice"}`:     http.StatusBadRequest,
+	} {
+		if resp, body, _ := makeRequest(server, "POST", pathCustomFields, field); resp.StatusCode != status {
+			t.Errorf("Expected status %d for %s, got %d. Response: %s", status, field, resp.StatusCode, string(body))
+		}
+	}
+
+	// The values are checked against the fields of the entity
+	company := `{"name": "Client", "document": "98.765.432/0001-10", "address": "Rua C, 3", "custom_fields": %s}`
+	for _, values := range []string{`{"segment": "other"}`, `{"seats": "many"}`, `{"po_number": "PO-1"}`} {
+		if resp, body, _ := makeRequest(server, "POST", pathCompanies, fmt.Sprintf(company, values)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d. Response: %s", values, resp.StatusCode, string(body))
+		}
+	}
+	resp, body, _ := makeRequest(server, "POST", pathCompanies, fmt.Sprintf(company, `{"segment": "retainer", "seats": ""}`))
+	var client Company
+	json.Unmarshal(body, &client)
+	if resp.StatusCode != http.StatusCreated || len(client.CustomFields) != 1 || client.CustomFields["segment"] != "retainer" {
+		t.Fatalf("Expected the segment kept and the empty seats dropped, got %d %+v", resp.StatusCode, client.CustomFields)
+	}
+
+	invoice := fmt.Sprintf(`{"issue_date": "2024-05-10T00:00:00Z", "due_date": "2024-06-10T00:00:00Z", "company_id": %d, "client_id": %d,
+		"remit_information_id": %d, "invoice_lines": [{"product_id": %d, "quantity": 1}]`, issuer.ID, client.ID, remit.ID, product.ID)
+	if resp, _, _ := makeRequest(server, "POST", pathInvoices, invoice+"}"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the required PO number asked for, got %d", resp.StatusCode)
+	}
+	resp, body, _ = makeRequest(server, "POST", pathInvoices, invoice+`, "custom_fields": {"po_number": "PO-1234"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Response: %s", resp.StatusCode, string(body))
+	}
+	var created Invoice
+	json.Unmarshal(body, &created)
+	saved, _ := testRepo.GetInvoice(created.ID)
+	if saved.CustomFields["po_number"] != "PO-1234" || saved.Client.CustomFields["segment"] != "retainer" {
+		t.Errorf("Expected the custom fields of the invoice and its client, got %v and %v", saved.CustomFields, saved.Client.CustomFields)
+	}
+
+	// Updating a field keeps its type, deleting it removes its values
+	resp, body, _ = makeRequest(server, "PUT", routePath(pathCustomField, fields[1].ID), `{"label": "Client segment", "type": "text", "options": ["retainer", "project", "on-hold"]}`)
+	var updated CustomField
+	json.Unmarshal(body, &updated)
+	if resp.StatusCode != http.StatusOK || updated.Label != "Client segment" || updated.Type != CustomFieldChoice || len(updated.Options) != 3 {
+		t.Errorf("Expected the label and options changed, got %d %+v", resp.StatusCode, updated)
+	}
+	if resp, _, _ = makeRequest(server, "DELETE", routePath(pathCustomField, fields[1].ID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	if deleted, _ := testRepo.GetCompany(client.ID); len(deleted.CustomFields) != 0 {
+		t.Errorf("Expected the segment removed from the company, got %v", deleted.CustomFields)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathCustomFields+"?entity=company", "")
+	var remaining []CustomField
+	json.Unmarshal(body, &remaining)
+	if resp.StatusCode != http.StatusOK || len(remaining) != 1 || remaining[0].Key != "seats" {
+		t.Errorf("Expected the seats field left, got %d %+v", resp.StatusCode, remaining)
+	}
+}
+
+func TestTagManagement(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	for _, tag := range []string{"retainer", "vip"} {
+		if _, err := testRepo.BulkUpdateCompanies(CompanyFilter{IDs: []uint{companyID}}, BulkAction{Action: BulkTag, Tag: tag}); err != nil {
+			t.Fatalf("Failed to tag company: %v", err)
+		}
+	}
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	if _, err := testRepo.BulkUpdateInvoices(InvoiceFilter{IDs: []uint{invoice.ID}}, BulkAction{Action: BulkTag, Tag: "retainer"}); err != nil {
+		t.Fatalf("Failed to tag invoice: %v", err)
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathTags, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	var tags []TagUsage
+	json.Unmarshal(body, &tags)
+	if len(tags) != 2 || tags[0] != (TagUsage{Tag: "retainer", Companies: 1, Invoices: 1}) || tags[1] != (TagUsage{Tag: "vip", Companies: 1}) {
+		t.Errorf("Unexpected tags: %+v", tags)
+	}
+
+	// Renaming onto a tag the company already carries merges them
+	resp, body, err = makeRequest(server, "PUT", routePath(pathTag, "RETAINER"), `{"tag": "vip"}`)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to rename tag: %v %s", err, body)
+	}
+	var result BulkResult
+	json.Unmarshal(body, &result)
+	if result.Affected != 2 {
+		t.Errorf("Expected 2 records renamed, got %+v", result)
+	}
+	company, _ := testRepo.GetCompany(companyID)
+	if strings.Join(company.Tags, ",") != "vip" {
+		t.Errorf("Expected the company tags merged, got %v", company.Tags)
+	}
+
+	if resp, _, _ := makeRequest(server, "PUT", routePath(pathTag, "vip"), `{"tag": "bad,tag"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid tag to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body, err = makeRequest(server, "DELETE", routePath(pathTag, "vip"), "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+	json.Unmarshal(body, &result)
+	if result.Affected != 2 {
+		t.Errorf("Expected 2 records untagged, got %+v", result)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathInvoices+"?tag=vip", "")
+	var invoices []Invoice
+	json.Unmarshal(body, &invoices)
+	if resp.StatusCode != http.StatusOK || len(invoices) != 0 {
+		t.Errorf("Expected no invoice tagged vip, got %d %+v", resp.StatusCode, invoices)
+	}
+	if resp, _, _ := makeRequest(server, "DELETE", routePath(pathTag, "vip"), ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected deleting an unused tag to give 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestInvoiceComments(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+
+	companyID, productID, remitID, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	invoice := Invoice{
+		DueDate:            time.Now(),
+		RemitInformationID: remitID,
+		CompanyID:          companyID,
+		ClientID:           companyID,
+		InvoiceLines:       []InvoiceLine{{ProductID: &productID, Quantity: 1}},
+	}
+	if err := testRepo.CreateInvoice(&invoice); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	other := invoice
+	other.ID, other.UUID, other.InvoiceLines = 0, uuid.UUID{}, []InvoiceLine{{ProductID: &productID, Quantity: 1}}
+	if err := testRepo.CreateInvoice(&other); err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	for _, user := range []User{{Username: "maria", Email: "maria@example.com", PasswordHash: "x"}, {Username: "joao", PasswordHash: "x"}} {
+		if err := testRepo.CreateUser(&user); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var published []Event
+	defer subscribe(EventCommentCreated, func(store Store, event Event) error {
+		published = append(published, event)
+		return nil
+	})()
+
+	comments := routePath(pathInvoiceComments, invoice.ID)
+	if resp, _, _ := makeRequest(server, "POST", comments, `{"body": "  "}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an empty comment to be refused, got %d", resp.StatusCode)
+	}
+
+	// Email addresses aren't mentions, users without an email aren't notified
+	resp, body, err := makeRequest(server, "POST", comments, `{"body": "@maria the client disputes line 2, see billing@client.com. @joao @nobody @maria."}`)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to comment: %v %s", err, body)
+	}
+	var created struct {
+		InvoiceComment
+		Notified []string `json:"notified"`
+	}
+	json.Unmarshal(body, &created)
+	if strings.Join(created.Mentions, ",") != "maria,joao,nobody" || strings.Join(created.Notified, ",") != "maria" {
+		t.Errorf("Unexpected mentions %v notified %v", created.Mentions, created.Notified)
+	}
+	jobs, _ := testRepo.GetJobs(JobFilter{})
+	if len(jobs) != 1 || jobs[0].Kind != "email" || !strings.Contains(jobs[0].Payload, "maria@example.com") {
+		t.Errorf("Expected one email queued to maria, got %+v", jobs)
+	}
+	if len(published) != 1 || published[0].Data.(*InvoiceComment).ID != created.ID {
+		t.Errorf("Expected the comment published, got %+v", published)
+	}
+
+	reply := fmt.Sprintf(`{"body": "Checked, it was delivered", "parent_id": %d}`, created.ID)
+	if resp, body, _ := makeRequest(server, "POST", comments, reply); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", resp.StatusCode, body)
+	}
+	otherComments := routePath(pathInvoiceComments, other.ID)
+	if resp, _, _ := makeRequest(server, "POST", otherComments, reply); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a reply to a comment of another invoice to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, body, err = makeRequest(server, "GET", comments, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list comments: %v", err)
+	}
+	var threads []InvoiceComment
+	json.Unmarshal(body, &threads)
+	if len(threads) != 1 || len(threads[0].Replies) != 1 || threads[0].Replies[0].Body != "Checked, it was delivered" {
+		t.Errorf("Unexpected threads: %+v", threads)
+	}
+
+	// Deleting a comment deletes its replies
+	if resp, _, _ := makeRequest(server, "DELETE", routePath(pathComment, created.ID), ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to delete comment: %d", resp.StatusCode)
+	}
+	if remaining, _ := testRepo.GetInvoiceComments(invoice.ID); len(remaining) != 0 {
+		t.Errorf("Expected no comment left, got %+v", remaining)
+	}
+}
+
+// failingMailer fails every email
+type failingMailer struct{}
+
+func (failingMailer) Send(email *Email) error {
+	return errors.New("connection refused")
+}
+
+func TestEmailLogAndBounces(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	fake := setupFakeMailer(t)
+
+	companyID, _, _, err := createTestData(testRepo)
+	if err != nil {
+		t.Fatalf("Failed to create test data: %v", err)
+	}
+	company, _ := testRepo.GetCompany(companyID)
+	company.Email = "Billing@Client.com"
+	if err := testRepo.UpdateCompany(company); err != nil {
+		t.Fatalf("Failed to update company: %v", err)
+	}
+
+	if err := sendEmail(testRepo, &Email{To: []string{"billing@client.com"}, Cc: []string{"boss@client.com"}, Subject: "Invoice 1"}); err != nil {
+		t.Fatalf("Failed to send email: %v", err)
+	}
+	messageID := fake.sent[0].MessageID
+	if !strings.HasPrefix(messageID, "<") || !strings.HasSuffix(messageID, ">") {
+		t.Errorf("Expected the email given a Message-ID, got %q", messageID)
+	}
+	mailer = failingMailer{}
+	if err := sendEmail(testRepo, &Email{To: []string{"user@example.com"}, Subject: "Reset"}); err == nil {
+		t.Error("Expected the failure of the mailer returned")
+	}
+
+	resp, body, err := makeRequest(server, "GET", pathEmailLogs, "")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list email logs: %v", err)
+	}
+	var logs []EmailLog
+	json.Unmarshal(body, &logs)
+	if len(logs) != 2 || logs[0].Status != EmailFailed || logs[0].Error != "connection refused" ||
+		logs[1].Status != EmailSent || logs[1].To != "billing@client.com, boss@client.com" || logs[1].MessageID != messageID {
+		t.Errorf("Unexpected email logs: %+v", logs)
+	}
+
+	// Blocks are soft bounces, left alone
+	events := fmt.Sprintf(`[
+		{"email": "billing@client.com", "event": "delivered", "smtp-id": %[1]q},
+		{"email": "billing@client.com", "event": "bounce", "type": "blocked", "smtp-id": %[1]q},
+		{"email": "billing@client.com", "event": "bounce", "type": "bounce", "reason": "550 mailbox unknown", "smtp-id": %[1]q}
+	]`, messageID)
+	resp, body, err = makeRequest(server, "POST", routePath(pathEmailEvents, "sendgrid"), events)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"processed":1,"flagged":1`) {
+		t.Fatalf("Failed to process SendGrid events: %v %s", err, body)
+	}
+	logs, _ = testRepo.GetEmailLogs(EmailLogFilter{Status: EmailBounced})
+	if len(logs) != 1 || logs[0].MessageID != messageID || logs[0].Error != "bounced: 550 mailbox unknown" {
+		t.Errorf("Expected the email marked bounced, got %+v", logs)
+	}
+	company, _ = testRepo.GetCompany(companyID)
+	if company.EmailBouncedAt == nil || company.EmailBounceReason != "bounced: 550 mailbox unknown" {
+		t.Errorf("Expected the company email flagged, got %v %q", company.EmailBouncedAt, company.EmailBounceReason)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathCompanies+"?email_bounced=true", "")
+	var companies []Company
+	json.Unmarshal(body, &companies)
+	if resp.StatusCode != http.StatusOK || len(companies) != 1 || companies[0].ID != companyID {
+		t.Errorf("Expected the flagged company listed, got %d %+v", resp.StatusCode, companies)
+	}
+
+	// Editing the company keeps the flag until the email changes
+	company.Name = "Renamed"
+	testRepo.UpdateCompany(company)
+	if company, _ = testRepo.GetCompany(companyID); company.EmailBouncedAt == nil {
+		t.Error("Expected the flag kept while the email is the same")
+	}
+	company.Email = "accounts@client.com"
+	testRepo.UpdateCompany(company)
+	if company, _ = testRepo.GetCompany(companyID); company.EmailBouncedAt != nil || company.EmailBounceReason != "" {
+		t.Errorf("Expected the flag cleared with a new email, got %v %q", company.EmailBouncedAt, company.EmailBounceReason)
+	}
+
+	notification, _ := json.Marshal(map[string]interface{}{
+		"notificationType": "Complaint",
+		"complaint":        map[string]interface{}{"complainedRecipients": []map[string]string{{"emailAddress": "accounts@client.com"}}, "complaintFeedbackType": "abuse"},
+		"mail":             map[string]interface{}{"messageId": "ses-id", "commonHeaders": map[string]string{"messageId": messageID}},
+	})
+	message, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": string(notification)})
+	resp, body, err = makeRequest(server, "POST", routePath(pathEmailEvents, "ses"), string(message))
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"flagged":1`) {
+		t.Fatalf("Failed to process SES notification: %v %s", err, body)
+	}
+	if company, _ = testRepo.GetCompany(companyID); company.EmailBounceReason != "marked as spam: abuse" {
+		t.Errorf("Expected the complaint flagged, got %q", company.EmailBounceReason)
+	}
+
+	if resp, _, _ := makeRequest(server, "POST", routePath(pathEmailEvents, "ses"), `{"Type": "SubscriptionConfirmation", "SubscribeURL": "http://example.com/confirm"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a subscribe URL off AWS to be refused, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := makeRequest(server, "POST", routePath(pathEmailEvents, "postmark"), `[]`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an unknown provider to give 404, got %d", resp.StatusCode)
+	}
+
+	// A request failing along with its email still logs it
+	mailer = failingMailer{}
+	resp, _, err = makeRequest(server, "POST", routePath(pathCompanyStatementEmail, companyID), `{"to": "statements@client.com"}`)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, got %d %v", resp.StatusCode, err)
+	}
+	logs, _ = testRepo.GetEmailLogs(EmailLogFilter{Status: EmailFailed})
+	if len(logs) != 2 || logs[0].To != "statements@client.com" {
+		t.Errorf("Expected the failed statement logged, got %+v", logs)
+	}
+}
+
+func TestMailProviders(t *testing.T) {
+	email := func() *Email {
+		return &Email{
+			To:          []string{"client@example.com"},
+			Bcc:         []string{"accountant@example.com"},
+			ReplyTo:     "billing@example.com",
+			Subject:     "Invoice 12",
+			Body:        "Please find the invoice attached.",
+			Attachments: []EmailAttachment{{Filename: "invoice-12.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")}},
+			MessageID:   "<local@example.com>",
+		}
+	}
+
+	var request *http.Request
+	var body []byte
+	status, response, header := http.StatusAccepted, "", ""
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, body = r, nil
+		body, _ = io.ReadAll(r.Body)
+		if header != "" {
+			w.Header().Set("X-Message-Id", header)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer provider.Close()
+
+	settings := &Config{SMTP: SMTPConfig{From: "crm@example.com"}, Mail: MailConfig{APIKey: "key", MailgunDomain: "mg.example.com",
+		MailgunURL: provider.URL, SESRegion: "us-east-1", SESAccessKeyID: "AKID", SESSecretAccessKey: "secret"}}
+
+	// SendGrid takes the email as JSON and answers its own message id
+	sendgrid := mailProviders["sendgrid"](settings).(*SendGridMailer)
+	sendgrid.URL = provider.URL
+	header = "sg-id"
+	sent := email()
+	if err := sendgrid.Send(sent); err != nil {
+		t.Fatalf("Failed to send through SendGrid: %v", err)
+	}
+	var message struct {
+		Personalizations []map[string][]map[string]string `json:"personalizations"`
+		From             map[string]string                `json:"from"`
+		Attachments      []map[string]string              `json:"attachments"`
+	}
+	json.Unmarshal(body, &message)
+	if request.Header.Get("Authorization") != "Bearer key" || message.From["email"] != "crm@example.com" ||
+		message.Personalizations[0]["bcc"][0]["email"] != "accountant@example.com" ||
+		message.Attachments[0]["content"] != base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")) {
+		t.Errorf("Unexpected SendGrid request: %s", body)
+	}
+	if sent.MessageID != "sg-id" {
+		t.Errorf("Expected SendGrid's message id kept, got %q", sent.MessageID)
+	}
+	header = ""
+
+	// Mailgun takes the MIME message, delivered to the blind copies too
+	status, response = http.StatusOK, `{"id": "<mg-id@mg.example.com>", "message": "Queued. Thank you."}`
+	sent = email()
+	if err := mailProviders["mailgun"](settings).Send(sent); err != nil {
+		t.Fatalf("Failed to send through Mailgun: %v", err)
+	}
+	username, password, _ := request.BasicAuth()
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	if err := request.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatalf("Failed to read the Mailgun request: %v", err)
+	}
+	file, _, _ := request.FormFile("message")
+	mime, _ := io.ReadAll(file)
+	if request.URL.Path != "/v3/mg.example.com/messages.mime" || username != "api" || password != "key" ||
+		request.FormValue("to") != "client@example.com,accountant@example.com" ||
+		!strings.Contains(string(mime), "Message-ID: <local@example.com>") || strings.Contains(string(mime), "accountant@") {
+		t.Errorf("Unexpected Mailgun request to %s: %v", request.URL.Path, request.Form)
+	}
+	if sent.MessageID != "<mg-id@mg.example.com>" {
+		t.Errorf("Expected Mailgun's message id kept, got %q", sent.MessageID)
+	}
+
+	// SES takes the MIME message, signed
+	response = `{"MessageId": "ses-id"}`
+	ses := mailProviders["ses"](settings).(*SESMailer)
+	if ses.URL != "https://email.us-east-1.amazonaws.com/v2/email/outbound-emails" {
+		t.Errorf("Unexpected SES URL %s", ses.URL)
+	}
+	ses.URL = provider.URL + "/v2/email/outbound-emails"
+	sent = email()
+	if err := ses.Send(sent); err != nil {
+		t.Fatalf("Failed to send through SES: %v", err)
+	}
+	var raw struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct{ Raw struct{ Data []byte } }
+	}
+	json.Unmarshal(body, &raw)
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(authorization, "/us-east-1/ses/aws4_request") ||
+		request.Header.Get("X-Amz-Date") == "" || len(raw.Destination.ToAddresses) != 2 || !strings.Contains(string(raw.Content.Raw.Data), "Subject: Invoice 12") {
+		t.Errorf("Unexpected SES request %q: %s", authorization, body)
+	}
+	if sent.MessageID != "ses-id" {
+		t.Errorf("Expected SES's message id kept, got %q", sent.MessageID)
+	}
+
+	// Requests are signed for the day, the region and SES
+	signed, _ := http.NewRequest(http.MethodPost, "https://email.us-east-1.amazonaws.com/v2/email/outbound-emails", nil)
+	signed.Header.Set("Content-Type", "application/json")
+	ses.sign(signed, []byte("{}"), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if !strings.Contains(signed.Header.Get("Authorization"), "Credential=AKID/20240102/us-east-1/ses/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=") ||
+		signed.Header.Get("X-Amz-Date") != "20240102T030405Z" {
+		t.Errorf("Unexpected signature %q", signed.Header.Get("Authorization"))
+	}
+
+	status, response = http.StatusUnauthorized, `{"errors": [{"message": "bad key"}]}`
+	if err := mailProviders["mailgun"](settings).Send(email()); err == nil || !strings.Contains(err.Error(), "Mailgun answered 401") {
+		t.Errorf("Expected the provider error returned, got %v", err)
+	}
+}
+
+func TestWhatsApp(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	fake := setupFakeMailer(t)
+
+	var request *http.Request
+	var body []byte
+	response := `{"messages": [{"id": "wamid.1"}]}`
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte(response))
+	}))
+	defer provider.Close()
+
+	originalConfig, originalSender := config.WhatsApp, whatsApp
+	t.Cleanup(func() { config.WhatsApp, whatsApp = originalConfig, originalSender })
+	config.WhatsApp = WhatsAppConfig{Provider: "cloud", Token: "token", PhoneNumberID: "123", AppSecret: "secret", VerifyToken: "verify",
+		InvoiceTemplate: "invoice_link", TemplateLanguage: "pt_BR"}
+	cloud := newCloudWhatsAppSender(config.WhatsApp)
+	cloud.URL = provider.URL
+	whatsApp = cloud
+
+	client := &Company{Name: "Client", Document: "1", Address: "Street", Phone: "+55 (11) 91234-5678"}
+	if err := validateCompany(client); err != nil || client.Phone != "+5511912345678" {
+		t.Errorf("Expected the phone normalized, got %q %v", client.Phone, err)
+	}
+	if err := validateCompany(&Company{Name: "Client", Phone: "11 91234-5678"}); err == nil {
+		t.Error("Expected a phone without its country code refused")
+	}
+
+	f := NewFactory(testRepo)
+	invoice, err := f.Invoice(InvoiceSent)
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	path := routePath(pathInvoiceWhatsapp, invoice.ID)
+	if resp, _, _ := makeRequest(server, "POST", path, ""); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a client without a phone refused, got %d", resp.StatusCode)
+	}
+	draft, _ := f.Invoice(InvoiceDraft)
+	if resp, _, _ := makeRequest(server, "POST", routePath(pathInvoiceWhatsapp, draft.ID), ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a draft refused, got %d", resp.StatusCode)
+	}
+
+	invoice.Client.Phone, invoice.Client.WhatsAppOptIn = "+5511912345678", true
+	if err := testRepo.UpdateCompany(&invoice.Client); err != nil {
+		t.Fatalf("Failed to update client: %v", err)
+	}
+	resp, respBody, err := makeRequest(server, "POST", path, "")
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to send over WhatsApp: %v %s", err, respBody)
+	}
+	var message struct {
+		To       string `json:"to"`
+		Type     string `json:"type"`
+		Template struct {
+			Name       string
+			Language   struct{ Code string }
+			Components []struct {
+				Parameters []struct{ Text string }
+			}
+		} `json:"template"`
+	}
+	json.Unmarshal(body, &message)
+	if request.Header.Get("Authorization") != "Bearer token" || message.To != "5511912345678" || message.Type != "template" ||
+		message.Template.Name != "invoice_link" || message.Template.Language.Code != "pt_BR" ||
+		len(message.Template.Components[0].Parameters) != 4 ||
+		message.Template.Components[0].Parameters[3].Text != publicURL(shareLinkPath(invoice)) {
+		t.Errorf("Unexpected Cloud API request: %s", body)
+	}
+
+	// Statuses only move forward, and have to be signed with the app secret
+	report := func(status string) *http.Response {
+		payload := fmt.Sprintf(`{"entry": [{"changes": [{"value": {"statuses": [{"id": "wamid.1", "status": %q}]}}]}]}`, status)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(payload))
+		req, _ := http.NewRequest("POST", server.URL+pathWhatsappCloudWebhook, strings.NewReader(payload))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to report status: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for _, status := range []string{"read", "delivered"} {
+		if resp := report(status); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Failed to report %s: %d", status, resp.StatusCode)
+		}
+	}
+	messages, _ := testRepo.GetInvoiceWhatsAppMessages(invoice.ID)
+	if len(messages) != 1 || messages[0].Status != WhatsAppRead || messages[0].ProviderID != "wamid.1" || messages[0].To != "+5511912345678" {
+		t.Errorf("Expected the message read, got %+v", messages)
+	}
+	resp, _, _ = makeRequest(server, "POST", pathWhatsappCloudWebhook, `{"entry": []}`)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected an unsigned report refused, got %d", resp.StatusCode)
+	}
+	resp, respBody, _ = makeRequest(server, "GET", pathWhatsappCloudWebhook+"?hub.mode=subscribe&hub.verify_token=verify&hub.challenge=42", "")
+	if resp.StatusCode != http.StatusOK || string(respBody) != "42" {
+		t.Errorf("Expected the challenge answered, got %d %s", resp.StatusCode, respBody)
+	}
+	events, _ := testRepo.GetInvoiceEvents(invoice.ID)
+	if events[len(events)-1].Type != "whatsapp_sent" {
+		t.Errorf("Expected the message on the timeline, got %+v", events[len(events)-1])
+	}
+
+	// A failed message is kept though the request fails
+	response = `{"messages": []}`
+	if resp, _, _ := makeRequest(server, "POST", path, ""); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", resp.StatusCode)
+	}
+	messages, _ = testRepo.GetInvoiceWhatsAppMessages(invoice.ID)
+	if len(messages) != 2 || messages[1].Status != WhatsAppFailed || messages[1].Error != "WhatsApp answered no message id" {
+		t.Errorf("Expected the failed message recorded, got %+v", messages)
+	}
+
+	// Reminders go over WhatsApp to a client without an email, through Twilio
+	config.WhatsApp = WhatsAppConfig{Provider: "twilio", TwilioAccountSID: "AC1", TwilioAuthToken: "auth", TwilioFrom: "+14155238886"}
+	twilio := newTwilioWhatsAppSender(config.WhatsApp)
+	twilio.URL = provider.URL
+	whatsApp = twilio
+	response = `{"sid": "SM1"}`
+	overdue, _ := f.Invoice(InvoiceOverdue, func(i *Invoice) { i.ClientID = invoice.ClientID })
+	results, err := sendReminders(testRepo, clock.Now())
+	if err != nil {
+		t.Fatalf("Failed to send reminders: %v", err)
+	}
+	var sent bool
+	for _, result := range results {
+		sent = sent || (result.InvoiceID == overdue.ID && result.Sent)
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.ParseForm()
+	username, _, _ := request.BasicAuth()
+	if !sent || len(fake.sent) != 0 || username != "AC1" || request.PostForm.Get("To") != "whatsapp:+5511912345678" ||
+		request.PostForm.Get("From") != "whatsapp:+14155238886" || !strings.Contains(request.PostForm.Get("Body"), "reminder") {
+		t.Errorf("Expected the reminder sent over WhatsApp, got %+v %v", results, request.PostForm)
+	}
+
+	form := url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"63016"}}
+	signed := publicURL(routePath(pathWhatsappWebhook, "twilio")) + "ErrorCode63016MessageSidSM1MessageStatusundelivered"
+	mac := hmac.New(sha1.New, []byte("auth"))
+	mac.Write([]byte(signed))
+	req, _ := http.NewRequest("POST", server.URL+routePath(pathWhatsappWebhook, "twilio"), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to report the Twilio status: %v", err)
+	}
+	messages, _ = testRepo.GetInvoiceWhatsAppMessages(overdue.ID)
+	if len(messages) != 1 || messages[0].Kind != WhatsAppReminder || messages[0].Status != WhatsAppFailed || messages[0].Error != "error 63016" {
+		t.Errorf("Expected the reminder failed, got %+v", messages)
+	}
+}
+
+func TestInvoiceDisputes(t *testing.T) {
+	server, testRepo := setupTestServer(t)
+	defer server.Close()
+	config.NotifyEmail = "team@example.com"
+	t.Cleanup(func() { config.NotifyEmail = "" })
+
+	f := NewFactory(testRepo)
+	invoice, err := f.Invoice(InvoiceOverdue)
+	if err != nil {
+		t.Fatalf("Failed to create invoice: %v", err)
+	}
+	disputePath := disputeLinkPath(invoice)
+
+	resp, body, _ := makeRequest(server, "GET", shareLinkPath(invoice), "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), html.EscapeString(disputePath)) {
+		t.Errorf("Expected the shared invoice to link to the dispute page, got %d", resp.StatusCode)
+	}
+	if resp, _, _ := makeRequest(server, "GET", disputePath, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the dispute page, got %d", resp.StatusCode)
+	}
+
+	dispute := func(path, comment string) *http.Response {
+		resp, err := http.PostForm(server.URL+path, url.Values{"comment": {comment}})
+		if err != nil {
+			t.Fatalf("Failed to dispute: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := dispute(routePath(pathSharedInvoiceDispute, invoice.UUID.String())+"?sig=forged", "Wrong"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a forged link refused, got %d", resp.StatusCode)
+	}
+	if resp := dispute(disputePath, "  "); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an empty comment refused, got %d", resp.StatusCode)
+	}
+	if resp := dispute(disputePath, "Line 2 was never delivered"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to dispute the invoice: %d", resp.StatusCode)
+	}
+	if resp := dispute(disputePath, "Again"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected disputing twice answered as done, got %d", resp.StatusCode)
+	}
+
+	disputes, _ := testRepo.GetInvoiceDisputes(invoice.ID)
+	if len(disputes) != 1 || disputes[0].Comment != "Line 2 was never delivered" || disputes[0].ResolvedAt != nil {
+		t.Fatalf("Expected one open dispute, got %+v", disputes)
+	}
+	due, _ := testRepo.GetInvoicesDueForReminder(clock.Now())
+	if len(due) != 0 {
+		t.Errorf("Expected no reminder for a disputed invoice, got %d", len(due))
+	}
+
+	// Editing the invoice keeps the dispute and the reminder settings
+	snoozedUntil := clock.Now().AddDate(0, 0, 3)
+	testRepo.SnoozeReminders(invoice.ID, &snoozedUntil)
+	testRepo.SetReminderDays(invoice.ID, ReminderDays{1, 10})
+	edited, _ := testRepo.GetInvoice(invoice.ID)
+	edited.DisputedAt, edited.RemindersSnoozedUntil, edited.ReminderDays = nil, nil, nil
+	if err := (&Repository{db: testRepo.db, overrideIssued: true}).UpdateInvoice(edited); err != nil {
+		t.Fatalf("Failed to update the invoice: %v", err)
+	}
+	edited, _ = testRepo.GetInvoice(invoice.ID)
+	if edited.DisputedAt == nil || edited.RemindersSnoozedUntil == nil || len(edited.ReminderDays) != 2 {
+		t.Errorf("Expected the dispute and reminder settings kept, got %v %v %v", edited.DisputedAt, edited.RemindersSnoozedUntil, edited.ReminderDays)
+	}
+	testRepo.SnoozeReminders(invoice.ID, nil)
+	testRepo.SetReminderDays(invoice.ID, nil)
+	jobs, _ := testRepo.GetJobs(JobFilter{Kind: "email"})
+	if len(jobs) != 1 || !strings.Contains(jobs[0].Payload, "team@example.com") || !strings.Contains(jobs[0].Payload, "never delivered") {
+		t.Errorf("Expected the team notified, got %+v", jobs)
+	}
+	resp, body, _ = makeRequest(server, "GET", pathInvoices+"?disputed=true", "")
+	var summaries []InvoiceSummary
+	json.Unmarshal(body, &summaries)
+	if resp.StatusCode != http.StatusOK || len(summaries) != 1 || summaries[0].ID != invoice.ID || summaries[0].Status != InvoiceStatusDisputed {
+		t.Errorf("Expected the disputed invoice listed, got %d %s", resp.StatusCode, body)
+	}
+
+	resolvePath := routePath(pathInvoiceDisputeResolve, invoice.ID)
+	resp, body, _ = makeRequest(server, "POST", resolvePath, `{"resolution": "Credit note issued"}`)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"resolution":"Credit note issued"`) {
+		t.Fatalf("Failed to resolve the dispute: %d %s", resp.StatusCode, body)
+	}
+	if due, _ := testRepo.GetInvoicesDueForReminder(clock.Now()); len(due) != 1 {
+		t.Errorf("Expected the reminders resumed, got %d due", len(due))
+	}
+	if resp, _, _ := makeRequest(server, "POST", resolvePath, `{"resolution": "Again"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected resolving an undisputed invoice refused, got %d", resp.StatusCode)
+	}
+	events, _ := testRepo.GetInvoiceEvents(invoice.ID)
+	if len(events) < 2 || events[len(events)-2].Type != "dispute_opened" || events[len(events)-1].Type != "dispute_resolved" {
+		t.Errorf("Expected the dispute on the timeline, got %+v", events)
+	}
+
+	paid, _ := f.Invoice(InvoicePaid)
+	if resp := dispute(disputeLinkPath(paid), "Wrong"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a paid invoice not disputable, got %d", resp.StatusCode)
+	}
+}
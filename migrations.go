@@ -0,0 +1,2162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migration is a versioned schema change. Migrations run in order inside a
+// transaction and are recorded in the schema_migrations table once applied.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	// RebuildsTables runs the migration with the foreign keys off, checked
+	// before committing. SQLite changes constraints by rebuilding the table,
+	// and dropping the old one would otherwise cascade to the rows
+	// referring to it.
+	RebuildsTables bool
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:255;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// MigrationStatus is a migration and when it was applied, nil when pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// dropColumns drops the columns in place, their indexes first since SQLite
+// won't drop an indexed column
+func dropColumns(tx *gorm.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		if !tx.Migrator().HasColumn(table, column) {
+			continue
+		}
+		var indexes []string
+		if err := tx.Raw("SELECT DISTINCT list.name FROM pragma_index_list(?) AS list, pragma_index_info(list.name) AS info WHERE info.name = ?",
+			table, column).Scan(&indexes).Error; err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			if err := tx.Migrator().DropIndex(table, index); err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: table}, clause.Column{Name: column}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timesToUTC rewrites the times stored with another offset in UTC, to the
+// millisecond, so they compare as text with the ones stored since
+func timesToUTC(tx *gorm.DB) error {
+	tables, err := tx.Migrator().GetTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		columns, err := tx.Migrator().ColumnTypes(table)
+		if err != nil {
+			return err
+		}
+		for _, column := range columns {
+			if !strings.EqualFold(column.DatabaseTypeName(), "datetime") {
+				continue
+			}
+			name := tx.Statement.Quote(column.Name())
+			err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = strftime('%%Y-%%m-%%d %%H:%%M:%%f', %s) || '+00:00' WHERE %s GLOB ? AND %s NOT LIKE ?",
+				tx.Statement.Quote(table), name, name, name, name), "*[+-][0-9][0-9]:[0-9][0-9]", "%+00:00").Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropRelation drops a belongs-to relation, its foreign key constraint first
+// since SQLite won't drop a column a constraint still refers to
+func dropRelation(tx *gorm.DB, table, constraint, column string) error {
+	if tx.Migrator().HasConstraint(table, constraint) {
+		if err := tx.Migrator().DropConstraint(table, constraint); err != nil {
+			return err
+		}
+	}
+	return dropColumns(tx, table, column)
+}
+
+// recreateRelation rebuilds the foreign key constraint of a belongs-to
+// relation as the model declares it
+func recreateRelation(tx *gorm.DB, model interface{}, relation string) error {
+	if tx.Migrator().HasConstraint(model, relation) {
+		if err := tx.Migrator().DropConstraint(model, relation); err != nil {
+			return err
+		}
+	}
+	return tx.Migrator().CreateConstraint(model, relation)
+}
+
+func dropTables(tx *gorm.DB, tables ...string) error {
+	for _, table := range tables {
+		if err := tx.Migrator().DropTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaIndex is an index of the schema along with its columns
+type schemaIndex struct {
+	Name    string
+	Table   string   `gorm:"column:tbl_name"`
+	SQL     string   `gorm:"column:sql"`
+	Columns []string `gorm:"-"`
+}
+
+func schemaIndexes(tx *gorm.DB) ([]schemaIndex, error) {
+	var indexes []schemaIndex
+	if err := tx.Raw("SELECT name, tbl_name, sql FROM sqlite_master WHERE type = ? AND sql IS NOT NULL", "index").Scan(&indexes).Error; err != nil {
+		return nil, err
+	}
+	for i := range indexes {
+		if err := tx.Raw("SELECT name FROM pragma_index_info(?)", indexes[i].Name).Scan(&indexes[i].Columns).Error; err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+// restoreIndexes creates back the indexes SQLite dropped along with the
+// tables it rebuilt to alter a column or a constraint. Indexes of the
+// tables or columns the migration dropped are left out.
+func restoreIndexes(tx *gorm.DB, indexes []schemaIndex) error {
+	for _, index := range indexes {
+		if !tx.Migrator().HasTable(index.Table) || tx.Migrator().HasIndex(index.Table, index.Name) {
+			continue
+		}
+		kept := true
+		for _, column := range index.Columns {
+			kept = kept && tx.Migrator().HasColumn(index.Table, column)
+		}
+		if !kept {
+			continue
+		}
+		if err := tx.Exec(index.SQL).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrations lists every schema change, new ones are appended with the
+// next version. Each declares the tables and columns it creates with local
+// structs, frozen as they were at its version, so changing a model later
+// doesn't change what an earlier migration does. Up is safe on databases
+// created before migrations were versioned, the tables and columns they
+// already have are left alone.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID           uint      `gorm:"primaryKey"`
+				Username     string    `gorm:"size:255;not null;uniqueIndex"`
+				PasswordHash string    `gorm:"size:255;not null"`
+				CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+			}
+			type remitInformationLine struct {
+				ID                 uint   `gorm:"primaryKey"`
+				Key                string `gorm:"size:255;not null"`
+				Value              string `gorm:"size:255;not null"`
+				RemitInformationID uint   `gorm:"not null"`
+			}
+			type remitInformation struct {
+				ID    uint                   `gorm:"primaryKey"`
+				Name  string                 `gorm:"size:255;not null"`
+				Lines []remitInformationLine `gorm:"foreignKey:RemitInformationID"`
+			}
+			type product struct {
+				ID          uint    `gorm:"primaryKey"`
+				Name        string  `gorm:"size:255;not null"`
+				Description *string `gorm:"type:text"`
+				Price       float64 `gorm:"type:decimal(10,2);not null"`
+			}
+			type company struct {
+				ID       uint   `gorm:"primaryKey"`
+				Name     string `gorm:"size:255;not null"`
+				Document string `gorm:"size:30;not null"`
+				Address  string `gorm:"type:text;not null"`
+			}
+			type invoiceLine struct {
+				ID          uint    `gorm:"primaryKey"`
+				InvoiceID   uint    `gorm:"not null"`
+				ProductID   uint    `gorm:"not null"`
+				Product     product `gorm:"constraint:OnDelete:RESTRICT"`
+				Quantity    int     `gorm:"default:1;not null"`
+				Description *string `gorm:"size:255"`
+			}
+			type invoice struct {
+				ID                    uint             `gorm:"primaryKey"`
+				UUID                  string           `gorm:"type:text"`
+				Number                *int             `gorm:"default:0"`
+				AdditionalInformation *string          `gorm:"type:text"`
+				Discount              float64          `gorm:"type:decimal(10,2);default:0.00"`
+				Penalty               float64          `gorm:"type:decimal(10,2);default:0.00"`
+				Paid                  bool             `gorm:"default:false"`
+				IssueDate             time.Time        `gorm:"default:CURRENT_TIMESTAMP"`
+				DueDate               time.Time        `gorm:"not null"`
+				RemitInformationID    uint             `gorm:"not null"`
+				RemitInformation      remitInformation `gorm:"constraint:OnDelete:CASCADE"`
+				CompanyID             uint             `gorm:"not null"`
+				Company               company          `gorm:"constraint:OnDelete:CASCADE"`
+				ClientID              uint             `gorm:"not null"`
+				Client                company          `gorm:"constraint:OnDelete:CASCADE"`
+				InvoiceLines          []invoiceLine    `gorm:"foreignKey:InvoiceID"`
+			}
+			return tx.AutoMigrate(&user{}, &remitInformation{}, &remitInformationLine{}, &product{}, &company{}, &invoice{}, &invoiceLine{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "invoice_lines", "invoices", "companies", "products", "remit_information_lines", "remit_informations", "users")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "payments and company email",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID    uint
+				Email string `gorm:"size:255"`
+			}
+			type invoice struct {
+				ID uint
+			}
+			type payment struct {
+				ID        uint      `gorm:"primaryKey"`
+				InvoiceID uint      `gorm:"not null;index"`
+				Invoice   invoice   `gorm:"constraint:OnDelete:CASCADE"`
+				Amount    float64   `gorm:"type:decimal(10,2);not null"`
+				Date      time.Time `gorm:"not null"`
+				Reference *string   `gorm:"size:255"`
+			}
+			return tx.AutoMigrate(&company{}, &payment{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "payments"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "email")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "document types",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID   uint
+				Type string `gorm:"size:20;not null;default:invoice;index"`
+			}
+			return tx.AutoMigrate(&invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "invoices", "type")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "locales",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID     uint
+				Locale string `gorm:"size:10"`
+			}
+			type invoice struct {
+				ID     uint
+				Locale string `gorm:"size:10"`
+			}
+			return tx.AutoMigrate(&company{}, &invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "companies", "locale"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoices", "locale")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "invoice templates",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type invoiceTemplate struct {
+				ID                  uint    `gorm:"primaryKey"`
+				CompanyID           uint    `gorm:"not null;index"`
+				Company             company `gorm:"constraint:OnDelete:CASCADE"`
+				Name                string  `gorm:"size:255;not null"`
+				BaseTemplate        string  `gorm:"size:255;not null"`
+				LogoURL             string  `gorm:"size:1024"`
+				Color               string  `gorm:"size:7"`
+				FooterText          string  `gorm:"type:text"`
+				PaymentInstructions string  `gorm:"type:text"`
+				IsDefault           bool    `gorm:"default:false"`
+			}
+			// The templates are only enforced since migration 42
+			type invoice struct {
+				ID                uint
+				InvoiceTemplateID *uint
+			}
+			return tx.AutoMigrate(&invoiceTemplate{}, &invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "invoices", "invoice_template_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "invoice_templates")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "reminders and invoice timeline",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID                    uint
+				ReminderDays          string `gorm:"type:text"`
+				RemindersSnoozedUntil *time.Time
+				LastReminderAt        *time.Time
+			}
+			type invoiceEvent struct {
+				ID        uint    `gorm:"primaryKey"`
+				InvoiceID uint    `gorm:"not null;index"`
+				Invoice   invoice `gorm:"constraint:OnDelete:CASCADE"`
+				Type      string  `gorm:"size:50;not null"`
+				Message   string  `gorm:"type:text"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&invoice{}, &invoiceEvent{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "invoice_events"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoices", "reminder_days", "reminders_snoozed_until", "last_reminder_at")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "satisfaction surveys",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type invoice struct {
+				ID uint
+			}
+			type surveyResponse struct {
+				ID        uint    `gorm:"primaryKey"`
+				CompanyID uint    `gorm:"not null;index"`
+				Company   company `gorm:"constraint:OnDelete:CASCADE"`
+				InvoiceID uint    `gorm:"not null;uniqueIndex"`
+				Invoice   invoice `gorm:"constraint:OnDelete:CASCADE"`
+				Score     int     `gorm:"not null"`
+				Comment   string  `gorm:"type:text"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&surveyResponse{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "survey_responses")
+		},
+	},
+	{
+		Version:        8,
+		Name:           "attachments and company logos",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type attachment struct {
+				ID          uint   `gorm:"primaryKey"`
+				UUID        string `gorm:"type:text;uniqueIndex"`
+				Filename    string `gorm:"size:255;not null"`
+				ContentType string `gorm:"size:100;not null"`
+				Size        int64
+				CreatedAt   time.Time
+			}
+			type company struct {
+				ID     uint
+				LogoID *uint
+				Logo   *attachment
+			}
+			return tx.AutoMigrate(&attachment{}, &company{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "companies", "fk_companies_logo", "logo_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "attachments")
+		},
+	},
+	{
+		Version:        9,
+		Name:           "referral sources",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type referralSource struct {
+				ID   uint   `gorm:"primaryKey"`
+				Name string `gorm:"size:100;not null;uniqueIndex"`
+			}
+			type company struct {
+				ID               uint
+				ReferralSourceID *uint           `gorm:"index"`
+				ReferralSource   *referralSource `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			return tx.AutoMigrate(&referralSource{}, &company{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "companies", "fk_companies_referral_source", "referral_source_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "referral_sources")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "company country",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID      uint
+				Country string `gorm:"size:2"`
+			}
+			return tx.AutoMigrate(&company{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "companies", "country")
+		},
+	},
+	{
+		Version: 11,
+		Name:    "peppol transmissions",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID       uint
+				PeppolID string `gorm:"size:100"`
+			}
+			type invoice struct {
+				ID uint
+			}
+			type peppolTransmission struct {
+				ID         uint    `gorm:"primaryKey"`
+				InvoiceID  uint    `gorm:"not null;index"`
+				Invoice    invoice `gorm:"constraint:OnDelete:CASCADE"`
+				SenderID   string  `gorm:"size:100;not null"`
+				ReceiverID string  `gorm:"size:100;not null"`
+				MessageID  string  `gorm:"size:255"`
+				Evidence   string  `gorm:"type:text"`
+				CreatedAt  time.Time
+			}
+			return tx.AutoMigrate(&company{}, &peppolTransmission{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "peppol_transmissions"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "peppol_id")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "attachment deduplication and quotas",
+		Up: func(tx *gorm.DB) error {
+			type attachment struct {
+				ID        uint
+				CompanyID *uint  `gorm:"index"`
+				SHA256    string `gorm:"column:sha256;size:64;index"`
+			}
+			type company struct {
+				ID             uint
+				StorageQuotaMB *int
+			}
+			if err := tx.AutoMigrate(&attachment{}, &company{}); err != nil {
+				return err
+			}
+			// Logos are the only attachments so far, charge them to their company
+			return tx.Exec("UPDATE attachments SET company_id = (SELECT id FROM companies WHERE companies.logo_id = attachments.id)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "attachments", "sha256", "company_id"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "storage_quota_mb")
+		},
+	},
+	{
+		Version:        13,
+		Name:           "tags, owners and archiving",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID uint
+			}
+			type company struct {
+				ID         uint
+				Tags       string     `gorm:"type:text"`
+				OwnerID    *uint      `gorm:"index"`
+				Owner      *user      `gorm:"constraint:OnDelete:SET NULL"`
+				ArchivedAt *time.Time `gorm:"index"`
+			}
+			type invoice struct {
+				ID         uint
+				Tags       string     `gorm:"type:text"`
+				OwnerID    *uint      `gorm:"index"`
+				Owner      *user      `gorm:"constraint:OnDelete:SET NULL"`
+				ArchivedAt *time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&company{}, &invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []string{"companies", "invoices"} {
+				if err := dropRelation(tx, table, "fk_"+table+"_owner", "owner_id"); err != nil {
+					return err
+				}
+				if err := dropColumns(tx, table, "tags", "archived_at"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 14,
+		Name:    "stored invoice totals",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID       uint
+				Subtotal float64 `gorm:"type:decimal(10,2);default:0.00"`
+				TaxTotal float64 `gorm:"type:decimal(10,2);default:0.00"`
+				Total    float64 `gorm:"type:decimal(10,2);default:0.00"`
+			}
+			if err := tx.AutoMigrate(&invoice{}); err != nil {
+				return err
+			}
+			// Lines were priced at the current product price until unit prices were stored
+			subtotal := `(SELECT COALESCE(SUM(products.price * invoice_lines.quantity), 0)
+				FROM invoice_lines JOIN products ON products.id = invoice_lines.product_id
+				WHERE invoice_lines.invoice_id = invoices.id)`
+			return tx.Exec("UPDATE invoices SET subtotal = " + subtotal + ", tax_total = 0, total = " + subtotal + " - discount + penalty").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "invoices", "subtotal", "tax_total", "total")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "list columns",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID uint
+			}
+			type listColumns struct {
+				ID      uint   `gorm:"primaryKey"`
+				UserID  *uint  `gorm:"index"`
+				User    *user  `gorm:"constraint:OnDelete:CASCADE"`
+				List    string `gorm:"size:50;not null"`
+				Columns string `gorm:"type:text"`
+			}
+			return tx.AutoMigrate(&listColumns{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "list_columns")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "line unit prices and price history",
+		Up: func(tx *gorm.DB) error {
+			type invoiceLine struct {
+				ID        uint
+				UnitPrice float64 `gorm:"type:decimal(10,2);not null;default:0.00"`
+			}
+			type product struct {
+				ID uint
+			}
+			type productPrice struct {
+				ID        uint      `gorm:"primaryKey"`
+				ProductID uint      `gorm:"not null;index"`
+				Product   product   `gorm:"constraint:OnDelete:CASCADE"`
+				Price     float64   `gorm:"type:decimal(10,2);not null"`
+				ValidFrom time.Time `gorm:"not null"`
+			}
+			if err := tx.AutoMigrate(&invoiceLine{}, &productPrice{}); err != nil {
+				return err
+			}
+			// Existing lines were billed at the current product price
+			if err := tx.Exec("UPDATE invoice_lines SET unit_price = (SELECT price FROM products WHERE products.id = invoice_lines.product_id)").Error; err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO product_prices (product_id, price, valid_from) SELECT id, price, ? FROM products", time.Now()).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "product_prices"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoice_lines", "unit_price")
+		},
+	},
+	{
+		Version: 17,
+		Name:    "product archiving",
+		Up: func(tx *gorm.DB) error {
+			type product struct {
+				ID         uint
+				ArchivedAt *time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&product{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "products", "archived_at")
+		},
+	},
+	{
+		Version:        18,
+		Name:           "product categories and tags",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type category struct {
+				ID   uint   `gorm:"primaryKey"`
+				Name string `gorm:"size:100;not null;uniqueIndex"`
+			}
+			type product struct {
+				ID         uint
+				CategoryID *uint     `gorm:"index"`
+				Category   *category `gorm:"constraint:OnDelete:SET NULL"`
+				Tags       string    `gorm:"type:text"`
+			}
+			return tx.AutoMigrate(&category{}, &product{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "products", "fk_products_category", "category_id"); err != nil {
+				return err
+			}
+			if err := dropColumns(tx, "products", "tags"); err != nil {
+				return err
+			}
+			return dropTables(tx, "categories")
+		},
+	},
+	{
+		Version: 19,
+		Name:    "percentage and line discounts",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID           uint
+				DiscountType string `gorm:"size:10;not null;default:fixed"`
+				PenaltyType  string `gorm:"size:10;not null;default:fixed"`
+			}
+			type invoiceLine struct {
+				ID           uint
+				Discount     float64 `gorm:"type:decimal(10,2);not null;default:0.00"`
+				DiscountType string  `gorm:"size:10;not null;default:fixed"`
+			}
+			return tx.AutoMigrate(&invoice{}, &invoiceLine{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "invoice_lines", "discount", "discount_type"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoices", "discount_type", "penalty_type")
+		},
+	},
+	{
+		Version: 20,
+		Name:    "email copies and sent emails",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID           uint
+				EmailCc      string `gorm:"size:255"`
+				EmailBcc     string `gorm:"size:255"`
+				EmailReplyTo string `gorm:"size:255"`
+			}
+			type invoice struct {
+				ID uint
+			}
+			type emailMessage struct {
+				ID        uint     `gorm:"primaryKey"`
+				CompanyID uint     `gorm:"not null;index"`
+				Company   company  `gorm:"constraint:OnDelete:CASCADE"`
+				InvoiceID *uint    `gorm:"index"`
+				Invoice   *invoice `gorm:"constraint:OnDelete:CASCADE"`
+				To        string   `gorm:"type:text;not null"`
+				Cc        string   `gorm:"type:text"`
+				Bcc       string   `gorm:"type:text"`
+				ReplyTo   string   `gorm:"size:255"`
+				Subject   string   `gorm:"size:255;not null"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&company{}, &emailMessage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "email_messages"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "email_cc", "email_bcc", "email_reply_to")
+		},
+	},
+	{
+		Version:        21,
+		Name:           "deliverables and monthly consolidation",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type remitInformation struct {
+				ID uint
+			}
+			type company struct {
+				ID                   uint
+				ConsolidationDay     *int
+				ConsolidationRemitID *uint
+				ConsolidationRemit   *remitInformation `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			type product struct {
+				ID uint
+			}
+			type invoice struct {
+				ID uint
+			}
+			type deliverable struct {
+				ID          uint      `gorm:"primaryKey"`
+				CompanyID   uint      `gorm:"not null;index"`
+				Company     company   `gorm:"constraint:OnDelete:CASCADE"`
+				ClientID    uint      `gorm:"not null;index"`
+				Client      company   `gorm:"constraint:OnDelete:CASCADE"`
+				ProductID   uint      `gorm:"not null"`
+				Product     product   `gorm:"constraint:OnDelete:RESTRICT"`
+				Quantity    int       `gorm:"default:1;not null"`
+				Description *string   `gorm:"size:255"`
+				Date        time.Time `gorm:"not null;index"`
+				UnitPrice   float64   `gorm:"type:decimal(10,2);not null;default:0.00"`
+				InvoiceID   *uint     `gorm:"index"`
+				Invoice     *invoice  `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			return tx.AutoMigrate(&company{}, &deliverable{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "deliverables"); err != nil {
+				return err
+			}
+			if err := dropRelation(tx, "companies", "fk_companies_consolidation_remit", "consolidation_remit_id"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "consolidation_day")
+		},
+	},
+	{
+		Version:        22,
+		Name:           "projects and budget alerts",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type project struct {
+				ID                 uint    `gorm:"primaryKey"`
+				CompanyID          uint    `gorm:"not null;index"`
+				Company            company `gorm:"constraint:OnDelete:CASCADE"`
+				Name               string  `gorm:"size:255;not null"`
+				Budget             float64 `gorm:"type:decimal(10,2);not null;default:0.00"`
+				BudgetAlertPercent *int
+				BudgetAlertedAt    *time.Time
+			}
+			type invoice struct {
+				ID        uint
+				ProjectID *uint    `gorm:"index"`
+				Project   *project `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			return tx.AutoMigrate(&project{}, &invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "invoices", "fk_invoices_project", "project_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "projects")
+		},
+	},
+	{
+		Version: 23,
+		Name:    "project status, tasks and time entries",
+		Up: func(tx *gorm.DB) error {
+			type project struct {
+				ID     uint
+				Status string `gorm:"size:20;not null;default:active"`
+			}
+			type user struct {
+				ID uint
+			}
+			type task struct {
+				ID        uint    `gorm:"primaryKey"`
+				ProjectID uint    `gorm:"not null;index"`
+				Project   project `gorm:"constraint:OnDelete:CASCADE"`
+				Name      string  `gorm:"size:255;not null"`
+				Status    string  `gorm:"size:20;not null;default:open"`
+				CreatedAt time.Time
+			}
+			type timeEntry struct {
+				ID          uint      `gorm:"primaryKey"`
+				ProjectID   uint      `gorm:"not null;index"`
+				Project     project   `gorm:"constraint:OnDelete:CASCADE"`
+				TaskID      *uint     `gorm:"index"`
+				Task        *task     `gorm:"constraint:OnDelete:SET NULL"`
+				UserID      *uint     `gorm:"index"`
+				User        *user     `gorm:"constraint:OnDelete:SET NULL"`
+				Date        time.Time `gorm:"not null;index"`
+				Hours       float64   `gorm:"type:decimal(10,2);not null"`
+				HourlyCost  float64   `gorm:"type:decimal(10,2);not null;default:0.00"`
+				Description *string   `gorm:"size:255"`
+			}
+			return tx.AutoMigrate(&project{}, &task{}, &timeEntry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "time_entries", "tasks"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "projects", "status")
+		},
+	},
+	{
+		Version: 24,
+		Name:    "sent invoices",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID     uint
+				SentAt *time.Time `gorm:"index"`
+			}
+			if err := tx.AutoMigrate(&invoice{}); err != nil {
+				return err
+			}
+			// Numbered invoices were already handed out, the others stay drafts
+			return tx.Exec("UPDATE invoices SET sent_at = issue_date WHERE number IS NOT NULL AND number != 0").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "invoices", "sent_at")
+		},
+	},
+	{
+		Version: 25,
+		Name:    "OpenID Connect identities",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID uint
+			}
+			type userIdentity struct {
+				ID        uint   `gorm:"primaryKey"`
+				UserID    uint   `gorm:"not null;index"`
+				User      user   `gorm:"constraint:OnDelete:CASCADE"`
+				Issuer    string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject"`
+				Subject   string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject"`
+				Email     string `gorm:"size:255"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&userIdentity{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "user_identities")
+		},
+	},
+	{
+		Version: 26,
+		Name:    "invoice edit locks",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID uint
+			}
+			type user struct {
+				ID uint
+			}
+			type invoiceLock struct {
+				InvoiceID uint      `gorm:"primaryKey;autoIncrement:false"`
+				Invoice   invoice   `gorm:"constraint:OnDelete:CASCADE"`
+				UserID    *uint     `gorm:"index"`
+				User      *user     `gorm:"constraint:OnDelete:CASCADE"`
+				Token     string    `gorm:"size:64;not null"`
+				ExpiresAt time.Time `gorm:"not null"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&invoiceLock{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "invoice_locks")
+		},
+	},
+	{
+		Version: 27,
+		Name:    "template versions",
+		Up: func(tx *gorm.DB) error {
+			type templateVersion struct {
+				ID        uint   `gorm:"primaryKey"`
+				Name      string `gorm:"size:255;not null;index"`
+				Hash      string `gorm:"size:64;not null"`
+				Source    string `gorm:"type:text;not null"`
+				CreatedAt time.Time
+			}
+			type invoiceTemplate struct {
+				ID uint
+			}
+			type invoiceTemplateVersion struct {
+				ID                  uint            `gorm:"primaryKey"`
+				InvoiceTemplateID   uint            `gorm:"not null;uniqueIndex:idx_invoice_template_versions_version"`
+				InvoiceTemplate     invoiceTemplate `gorm:"constraint:OnDelete:CASCADE"`
+				Version             int             `gorm:"not null;uniqueIndex:idx_invoice_template_versions_version"`
+				BaseTemplate        string          `gorm:"size:255;not null"`
+				LogoURL             string          `gorm:"size:1024"`
+				Color               string          `gorm:"size:7"`
+				FooterText          string          `gorm:"type:text"`
+				PaymentInstructions string          `gorm:"type:text"`
+				CreatedAt           time.Time
+			}
+			if err := tx.AutoMigrate(&templateVersion{}, &invoiceTemplateVersion{}); err != nil {
+				return err
+			}
+			// Templates saved so far start at their current settings
+			return tx.Exec(`INSERT INTO invoice_template_versions
+				(invoice_template_id, version, base_template, logo_url, color, footer_text, payment_instructions, created_at)
+				SELECT id, 1, base_template, logo_url, color, footer_text, payment_instructions, ? FROM invoice_templates`, time.Now()).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "invoice_template_versions", "template_versions")
+		},
+	},
+	{
+		Version: 28,
+		Name:    "password resets and account lockout",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID                uint
+				Email             string `gorm:"size:255"`
+				MustResetPassword bool   `gorm:"not null;default:false"`
+				FailedLogins      int    `gorm:"not null;default:0"`
+				LockedUntil       *time.Time
+			}
+			type auditEvent struct {
+				ID        uint      `gorm:"primaryKey"`
+				UserID    *uint     `gorm:"index"`
+				User      *user     `gorm:"constraint:OnDelete:SET NULL"`
+				Username  string    `gorm:"size:255;not null;index"`
+				Action    string    `gorm:"size:50;not null;index"`
+				Detail    string    `gorm:"size:255"`
+				CreatedAt time.Time `gorm:"index"`
+			}
+			type passwordResetToken struct {
+				ID        uint      `gorm:"primaryKey"`
+				UserID    uint      `gorm:"not null;index"`
+				User      user      `gorm:"constraint:OnDelete:CASCADE"`
+				TokenHash string    `gorm:"size:64;not null;uniqueIndex"`
+				ExpiresAt time.Time `gorm:"not null"`
+				UsedAt    *time.Time
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&user{}, &auditEvent{}, &passwordResetToken{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "password_reset_tokens", "audit_events"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "users", "email", "must_reset_password", "failed_logins", "locked_until")
+		},
+	},
+	{
+		Version: 29,
+		Name:    "invoice codes",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID   uint
+				Code string `gorm:"size:50;index"`
+			}
+			return tx.AutoMigrate(&invoice{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "invoices", "code")
+		},
+	},
+	{
+		Version: 30,
+		Name:    "login attempts and administrators",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID      uint
+				IsAdmin bool `gorm:"not null;default:false"`
+			}
+			type loginAttempt struct {
+				ID        uint      `gorm:"primaryKey"`
+				IP        string    `gorm:"size:45;not null;index"`
+				Username  string    `gorm:"size:255;not null;index"`
+				Reason    string    `gorm:"size:100"`
+				CreatedAt time.Time `gorm:"index"`
+			}
+			if err := tx.AutoMigrate(&user{}, &loginAttempt{}); err != nil {
+				return err
+			}
+			// Everybody could manage everything so far
+			return tx.Exec("UPDATE users SET is_admin = ?", true).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "login_attempts"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "users", "is_admin")
+		},
+	},
+	{
+		Version: 31,
+		Name:    "task due dates and digests",
+		Up: func(tx *gorm.DB) error {
+			type task struct {
+				ID      uint
+				DueDate *time.Time `gorm:"index"`
+			}
+			type digestRun struct {
+				Day    string `gorm:"size:10;primaryKey"`
+				SentAt time.Time
+			}
+			return tx.AutoMigrate(&task{}, &digestRun{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "digest_runs"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "tasks", "due_date")
+		},
+	},
+	{
+		Version: 32,
+		Name:    "settings",
+		Up: func(tx *gorm.DB) error {
+			type setting struct {
+				Key   string `gorm:"size:100;primaryKey"`
+				Value string `gorm:"type:text;not null"`
+			}
+			return tx.AutoMigrate(&setting{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "settings")
+		},
+	},
+	{
+		Version: 33,
+		Name:    "remit line positions and templates",
+		Up: func(tx *gorm.DB) error {
+			type remitInformation struct {
+				ID         uint
+				IsTemplate bool `gorm:"not null;default:false"`
+			}
+			type remitInformationLine struct {
+				ID       uint
+				Position int `gorm:"not null;default:0"`
+			}
+			return tx.AutoMigrate(&remitInformation{}, &remitInformationLine{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, "remit_information_lines", "position"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "remit_informations", "is_template")
+		},
+	},
+	{
+		Version: 34,
+		Name:    "company roles",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID         uint
+				IsIssuer   bool `gorm:"not null;default:false;index"`
+				IsClient   bool `gorm:"not null;default:false;index"`
+				IsSupplier bool `gorm:"not null;default:false;index"`
+			}
+			if err := tx.AutoMigrate(&company{}); err != nil {
+				return err
+			}
+			// Companies having issued invoices are issuers, the ones billed and
+			// the rest are clients
+			if err := tx.Exec("UPDATE companies SET is_issuer = ? WHERE id IN (SELECT company_id FROM invoices)", true).Error; err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE companies SET is_client = ? WHERE id IN (SELECT client_id FROM invoices) OR is_issuer = ?", true, false).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "companies", "is_issuer", "is_client", "is_supplier")
+		},
+	},
+	{
+		Version:        35,
+		Name:           "client users",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type user struct {
+				ID        uint
+				CompanyID *uint    `gorm:"index"`
+				Company   *company `gorm:"constraint:OnDelete:CASCADE"`
+			}
+			return tx.AutoMigrate(&user{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("DELETE FROM users WHERE company_id IS NOT NULL").Error; err != nil {
+				return err
+			}
+			return dropRelation(tx, "users", "fk_users_company", "company_id")
+		},
+	},
+	{
+		Version: 36,
+		Name:    "jobs",
+		Up: func(tx *gorm.DB) error {
+			type job struct {
+				ID          uint      `gorm:"primaryKey"`
+				Kind        string    `gorm:"size:100;not null;index"`
+				Payload     string    `gorm:"type:text;not null"`
+				Status      string    `gorm:"size:20;not null;default:pending;index"`
+				Attempts    int       `gorm:"not null;default:0"`
+				MaxAttempts int       `gorm:"not null"`
+				RunAt       time.Time `gorm:"not null;index"`
+				StartedAt   *time.Time
+				FinishedAt  *time.Time
+				LastError   string `gorm:"type:text"`
+				CreatedAt   time.Time
+			}
+			return tx.AutoMigrate(&job{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "jobs")
+		},
+	},
+	{
+		Version: 37,
+		Name:    "calendar_tokens",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID                uint
+				CalendarTokenHash string `gorm:"size:64;index"`
+			}
+			return tx.AutoMigrate(&user{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "calendar_token_hash")
+		},
+	},
+	{
+		Version:        38,
+		Name:           "inbound emails",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type inboundEmail struct {
+				ID         uint      `gorm:"primaryKey"`
+				MessageID  string    `gorm:"size:255;index"`
+				CompanyID  *uint     `gorm:"index"`
+				Company    *company  `gorm:"constraint:OnDelete:SET NULL"`
+				From       string    `gorm:"size:255;not null"`
+				FromName   string    `gorm:"size:255"`
+				Subject    string    `gorm:"size:255"`
+				Body       string    `gorm:"type:text"`
+				ReceivedAt time.Time `gorm:"not null;index"`
+			}
+			// Without a constraint: the attachments relation of the inbound
+			// emails took it over from the model and doesn't migrate it
+			type attachment struct {
+				ID             uint
+				InboundEmailID *uint `gorm:"index"`
+			}
+			return tx.AutoMigrate(&inboundEmail{}, &attachment{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "attachments", "fk_attachments_inbound_email", "inbound_email_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "inbound_emails")
+		},
+	},
+	{
+		Version: 39,
+		Name:    "free text invoice lines and sections",
+		Up: func(tx *gorm.DB) error {
+			type invoiceLine struct {
+				ID        uint
+				Type      string `gorm:"size:10;not null;default:item"`
+				ProductID *uint
+				Position  int `gorm:"not null;default:0"`
+			}
+			// AutoMigrate would rebuild the products table along, which its
+			// foreign keys refuse once invoices bill products
+			for _, column := range []string{"Type", "Position"} {
+				if tx.Migrator().HasColumn(&invoiceLine{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&invoiceLine{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().AlterColumn(&invoiceLine{}, "ProductID")
+		},
+		Down: func(tx *gorm.DB) error {
+			// Lines without a product can't be kept once it is required again
+			if err := tx.Exec("DELETE FROM invoice_lines WHERE product_id IS NULL").Error; err != nil {
+				return err
+			}
+			if err := dropColumns(tx, "invoice_lines", "type", "position"); err != nil {
+				return err
+			}
+			type invoiceLine struct {
+				ProductID uint `gorm:"not null"`
+			}
+			return tx.Migrator().AlterColumn(&invoiceLine{}, "ProductID")
+		},
+	},
+	{
+		Version: 40,
+		Name:    "decimal quantities and units",
+		Up: func(tx *gorm.DB) error {
+			type product struct {
+				ID   uint
+				Unit string `gorm:"size:10;not null;default:''"`
+			}
+			type invoiceLine struct {
+				ID       uint
+				Quantity float64 `gorm:"type:decimal(10,3);default:1;not null"`
+				Unit     string  `gorm:"size:10;not null;default:''"`
+			}
+			type deliverable struct {
+				ID       uint
+				Quantity float64 `gorm:"type:decimal(10,3);default:1;not null"`
+			}
+			for _, model := range []interface{}{&product{}, &invoiceLine{}} {
+				if tx.Migrator().HasColumn(model, "Unit") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(model, "Unit"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().AlterColumn(&invoiceLine{}, "Quantity"); err != nil {
+				return err
+			}
+			return tx.Migrator().AlterColumn(&deliverable{}, "Quantity")
+		},
+		Down: func(tx *gorm.DB) error {
+			// Quantities are whole again, rounded
+			type wholeQuantity struct {
+				Quantity int `gorm:"default:1;not null"`
+			}
+			for _, table := range []string{"invoice_lines", "deliverables"} {
+				if err := tx.Exec("UPDATE " + table + " SET quantity = MAX(ROUND(quantity), 1)").Error; err != nil {
+					return err
+				}
+				if err := tx.Table(table).Migrator().AlterColumn(&wholeQuantity{}, "Quantity"); err != nil {
+					return err
+				}
+			}
+			if err := dropColumns(tx, "invoice_lines", "unit"); err != nil {
+				return err
+			}
+			// Dropped in place, rebuilding products is refused by the
+			// foreign keys of the lines billing them
+			return dropColumns(tx, "products", "unit")
+		},
+	},
+	{
+		Version: 41,
+		Name:    "invoice revisions",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID uint
+			}
+			type invoiceRevision struct {
+				ID        uint    `gorm:"primaryKey"`
+				InvoiceID uint    `gorm:"not null;uniqueIndex:idx_invoice_revisions_revision"`
+				Invoice   invoice `gorm:"constraint:OnDelete:CASCADE"`
+				Revision  int     `gorm:"not null;uniqueIndex:idx_invoice_revisions_revision"`
+				Snapshot  string  `gorm:"type:text;not null"`
+				CreatedAt time.Time
+			}
+			// Created on its own, migrating the invoices it refers to
+			// along would rebuild them under their payments and lines
+			return tx.Migrator().CreateTable(&invoiceRevision{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "invoice_revisions")
+		},
+	},
+	{
+		Version:        42,
+		Name:           "invoice foreign keys",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type invoiceTemplate struct {
+				ID uint
+			}
+			type remitInformation struct {
+				ID uint
+			}
+			type invoice struct {
+				CompanyID          uint
+				Company            company `gorm:"constraint:OnDelete:RESTRICT"`
+				ClientID           uint
+				Client             company `gorm:"constraint:OnDelete:RESTRICT"`
+				RemitInformationID uint
+				RemitInformation   remitInformation `gorm:"constraint:OnDelete:RESTRICT"`
+				InvoiceTemplateID  *uint
+				InvoiceTemplate    *invoiceTemplate `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			// Templates deleted before they were enforced are let go of
+			if err := tx.Exec("UPDATE invoices SET invoice_template_id = NULL WHERE invoice_template_id NOT IN (SELECT id FROM invoice_templates)").Error; err != nil {
+				return err
+			}
+			for _, relation := range []string{"Company", "Client", "RemitInformation", "InvoiceTemplate"} {
+				if err := recreateRelation(tx, &invoice{}, relation); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// Invoices were deleted along with their companies and remit
+			// information
+			type company struct {
+				ID uint
+			}
+			type remitInformation struct {
+				ID uint
+			}
+			type invoice struct {
+				CompanyID          uint
+				Company            company `gorm:"constraint:OnDelete:CASCADE"`
+				ClientID           uint
+				Client             company `gorm:"constraint:OnDelete:CASCADE"`
+				RemitInformationID uint
+				RemitInformation   remitInformation `gorm:"constraint:OnDelete:CASCADE"`
+			}
+			if err := tx.Migrator().DropConstraint("invoices", "fk_invoices_invoice_template"); err != nil {
+				return err
+			}
+			for _, relation := range []string{"Company", "Client", "RemitInformation"} {
+				if err := recreateRelation(tx, &invoice{}, relation); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 43,
+		Name:    "billing runs",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type billingRun struct {
+				Month    string    `gorm:"size:7;primaryKey"`
+				ClientID uint      `gorm:"primaryKey;autoIncrement:false"`
+				Client   company   `gorm:"constraint:OnDelete:CASCADE"`
+				RanAt    time.Time `gorm:"not null"`
+			}
+			return tx.Migrator().CreateTable(&billingRun{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "billing_runs")
+		},
+	},
+	{
+		Version: 44,
+		Name:    "contracts",
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID uint
+			}
+			type remitInformation struct {
+				ID uint
+			}
+			type product struct {
+				ID uint
+			}
+			type invoice struct {
+				ID uint
+			}
+			type contractLine struct {
+				ID         uint    `gorm:"primaryKey"`
+				ContractID uint    `gorm:"not null;index"`
+				ProductID  uint    `gorm:"not null"`
+				Product    product `gorm:"constraint:OnDelete:RESTRICT"`
+				Quantity   float64 `gorm:"type:decimal(10,3);default:1;not null"`
+				UnitPrice  float64 `gorm:"type:decimal(10,2);not null;default:0.00"`
+			}
+			type contract struct {
+				ID                 uint             `gorm:"primaryKey"`
+				CompanyID          uint             `gorm:"not null;index"`
+				Company            company          `gorm:"constraint:OnDelete:CASCADE"`
+				ClientID           uint             `gorm:"not null;index"`
+				Client             company          `gorm:"constraint:OnDelete:CASCADE"`
+				RemitInformationID uint             `gorm:"not null"`
+				RemitInformation   remitInformation `gorm:"constraint:OnDelete:CASCADE"`
+				Name               string           `gorm:"size:255;not null"`
+				Cadence            string           `gorm:"size:20;not null;default:monthly"`
+				StartDate          time.Time        `gorm:"not null"`
+				EndDate            *time.Time
+				Lines              []contractLine `gorm:"constraint:OnDelete:CASCADE"`
+			}
+			type contractBilling struct {
+				ContractID uint      `gorm:"primaryKey;autoIncrement:false"`
+				Contract   contract  `gorm:"constraint:OnDelete:CASCADE"`
+				Month      string    `gorm:"size:7;primaryKey"`
+				InvoiceID  *uint     `gorm:"index"`
+				Invoice    *invoice  `gorm:"constraint:OnDelete:SET NULL"`
+				BilledAt   time.Time `gorm:"not null"`
+			}
+			for _, table := range []interface{}{&contract{}, &contractLine{}, &contractBilling{}} {
+				if err := tx.Migrator().CreateTable(table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "contract_billings", "contract_lines", "contracts")
+		},
+	},
+	{
+		Version:        45,
+		Name:           "price lists",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type product struct {
+				ID uint
+			}
+			type priceListItem struct {
+				ID          uint      `gorm:"primaryKey"`
+				PriceListID uint      `gorm:"not null;index"`
+				ProductID   uint      `gorm:"not null;index"`
+				Product     product   `gorm:"constraint:OnDelete:CASCADE"`
+				Price       float64   `gorm:"type:decimal(10,2);not null"`
+				ValidFrom   time.Time `gorm:"not null"`
+				ValidUntil  *time.Time
+			}
+			type priceList struct {
+				ID    uint            `gorm:"primaryKey"`
+				Name  string          `gorm:"size:255;not null;uniqueIndex"`
+				Items []priceListItem `gorm:"constraint:OnDelete:CASCADE"`
+			}
+			type company struct {
+				ID          uint
+				PriceListID *uint      `gorm:"index"`
+				PriceList   *priceList `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			// Databases migrated before the migrations were frozen have the
+			// price lists already
+			for _, table := range []interface{}{&priceList{}, &priceListItem{}} {
+				if tx.Migrator().HasTable(table) {
+					continue
+				}
+				if err := tx.Migrator().CreateTable(table); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasColumn(&company{}, "PriceListID") {
+				if err := tx.Migrator().AddColumn(&company{}, "PriceListID"); err != nil {
+					return err
+				}
+			}
+			if err := recreateRelation(tx, &company{}, "PriceList"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&company{}, "PriceListID") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&company{}, "PriceListID")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "companies", "fk_companies_price_list", "price_list_id"); err != nil {
+				return err
+			}
+			return dropTables(tx, "price_list_items", "price_lists")
+		},
+	},
+	{
+		Version: 46,
+		Name:    "saved views",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				ID uint
+			}
+			type savedView struct {
+				ID     uint   `gorm:"primaryKey"`
+				UserID *uint  `gorm:"index"`
+				User   *user  `gorm:"constraint:OnDelete:CASCADE"`
+				Name   string `gorm:"size:255;not null"`
+				Filter string `gorm:"type:text;not null"`
+			}
+			return tx.Migrator().CreateTable(&savedView{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "saved_views")
+		},
+	},
+	{
+		Version: 47,
+		Name:    "bank transactions",
+		Up: func(tx *gorm.DB) error {
+			type payment struct {
+				ID uint
+			}
+			type bankTransaction struct {
+				ID         uint      `gorm:"primaryKey"`
+				ExternalID string    `gorm:"size:255;not null;uniqueIndex"`
+				Date       time.Time `gorm:"not null;index"`
+				Amount     float64   `gorm:"type:decimal(10,2);not null"`
+				Payer      string    `gorm:"size:255"`
+				Reference  string    `gorm:"size:255"`
+				PaymentID  *uint     `gorm:"index"`
+				Payment    *payment  `gorm:"constraint:OnDelete:SET NULL"`
+				ImportedAt time.Time `gorm:"not null"`
+			}
+			return tx.Migrator().CreateTable(&bankTransaction{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "bank_transactions")
+		},
+	},
+	{
+		Version: 48,
+		Name:    "bank connector",
+		Up: func(tx *gorm.DB) error {
+			type bankTransaction struct {
+				ID         uint
+				Source     string `gorm:"size:20;not null;default:statement"`
+				ReviewedAt *time.Time
+			}
+			type bankPoll struct {
+				ID       uint      `gorm:"primaryKey"`
+				Since    time.Time `gorm:"not null"`
+				Until    time.Time `gorm:"not null;index"`
+				Imported int       `gorm:"not null"`
+				Matched  int       `gorm:"not null"`
+				Error    string    `gorm:"type:text"`
+			}
+			for _, column := range []string{"Source", "ReviewedAt"} {
+				if tx.Migrator().HasColumn(&bankTransaction{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&bankTransaction{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&bankPoll{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "bank_polls"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "bank_transactions", "source", "reviewed_at")
+		},
+	},
+	{
+		Version:        49,
+		Name:           "issuer settings",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type remitInformation struct {
+				ID uint
+			}
+			type company struct {
+				ID                uint
+				InvoicePrefix     *string `gorm:"size:20"`
+				NumberingStrategy string  `gorm:"size:20"`
+				DefaultRemitID    *uint
+				DefaultRemit      *remitInformation `gorm:"constraint:OnDelete:SET NULL"`
+			}
+			for _, column := range []string{"InvoicePrefix", "NumberingStrategy", "DefaultRemitID"} {
+				if tx.Migrator().HasColumn(&company{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&company{}, column); err != nil {
+					return err
+				}
+			}
+			return recreateRelation(tx, &company{}, "DefaultRemit")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropRelation(tx, "companies", "fk_companies_default_remit", "default_remit_id"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "invoice_prefix", "numbering_strategy")
+		},
+	},
+	{
+		Version: 50,
+		Name:    "times in utc",
+		Up:      timesToUTC,
+		Down: func(tx *gorm.DB) error {
+			// Times in UTC read the same in any time zone
+			return nil
+		},
+	},
+	{
+		Version:        51,
+		Name:           "custom fields",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID           uint
+				CustomFields string `gorm:"type:text"`
+			}
+			type invoice struct {
+				ID           uint
+				CustomFields string `gorm:"type:text"`
+			}
+			type customField struct {
+				ID       uint   `gorm:"primaryKey"`
+				Entity   string `gorm:"size:20;not null;uniqueIndex:idx_custom_fields_key"`
+				Key      string `gorm:"size:50;not null;uniqueIndex:idx_custom_fields_key"`
+				Label    string `gorm:"size:255;not null"`
+				Type     string `gorm:"size:20;not null"`
+				Options  string `gorm:"type:text"`
+				Required bool   `gorm:"not null;default:false"`
+			}
+			for _, model := range []interface{}{&company{}, &invoice{}} {
+				if tx.Migrator().HasColumn(model, "CustomFields") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(model, "CustomFields"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&customField{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "custom_fields"); err != nil {
+				return err
+			}
+			for _, table := range []string{"companies", "invoices"} {
+				if err := dropColumns(tx, table, "custom_fields"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 52,
+		Name:    "invoice comments",
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID uint
+			}
+			type user struct {
+				ID uint
+			}
+			type invoiceComment struct {
+				ID        uint            `gorm:"primaryKey"`
+				InvoiceID uint            `gorm:"not null;index"`
+				Invoice   invoice         `gorm:"constraint:OnDelete:CASCADE"`
+				ParentID  *uint           `gorm:"index"`
+				Parent    *invoiceComment `gorm:"constraint:OnDelete:CASCADE"`
+				UserID    *uint           `gorm:"index"`
+				User      *user           `gorm:"constraint:OnDelete:SET NULL"`
+				Body      string          `gorm:"type:text;not null"`
+				CreatedAt time.Time
+			}
+			return tx.Migrator().CreateTable(&invoiceComment{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropTables(tx, "invoice_comments")
+		},
+	},
+	{
+		Version:        53,
+		Name:           "email log",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID                uint
+				EmailBouncedAt    *time.Time
+				EmailBounceReason string `gorm:"type:text"`
+			}
+			type emailLog struct {
+				ID        uint   `gorm:"primaryKey"`
+				To        string `gorm:"type:text;not null"`
+				Subject   string `gorm:"size:255;not null"`
+				Status    string `gorm:"size:20;not null;index"`
+				MessageID string `gorm:"size:255;index"`
+				Error     string `gorm:"type:text"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			for _, column := range []string{"EmailBouncedAt", "EmailBounceReason"} {
+				if tx.Migrator().HasColumn(&company{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&company{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&emailLog{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "email_logs"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "email_bounced_at", "email_bounce_reason")
+		},
+	},
+	{
+		Version:        54,
+		Name:           "whatsapp",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type company struct {
+				ID            uint
+				Phone         string `gorm:"size:20"`
+				WhatsAppOptIn bool   `gorm:"not null;default:false"`
+			}
+			type invoice struct {
+				ID uint
+			}
+			type whatsAppMessage struct {
+				ID         uint     `gorm:"primaryKey"`
+				CompanyID  uint     `gorm:"not null;index"`
+				Company    company  `gorm:"constraint:OnDelete:CASCADE"`
+				InvoiceID  *uint    `gorm:"index"`
+				Invoice    *invoice `gorm:"constraint:OnDelete:CASCADE"`
+				Kind       string   `gorm:"size:20;not null"`
+				To         string   `gorm:"size:20;not null"`
+				Body       string   `gorm:"type:text;not null"`
+				ProviderID string   `gorm:"size:255;index"`
+				Status     string   `gorm:"size:20;not null;index"`
+				Error      string   `gorm:"type:text"`
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+			}
+			for _, column := range []string{"Phone", "WhatsAppOptIn"} {
+				if tx.Migrator().HasColumn(&company{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&company{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&whatsAppMessage{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "whats_app_messages"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "companies", "phone", "whats_app_opt_in")
+		},
+	},
+	{
+		Version:        55,
+		Name:           "invoice disputes",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID         uint
+				DisputedAt *time.Time `gorm:"index"`
+			}
+			type user struct {
+				ID uint
+			}
+			type invoiceDispute struct {
+				ID           uint    `gorm:"primaryKey"`
+				InvoiceID    uint    `gorm:"not null;index"`
+				Invoice      invoice `gorm:"constraint:OnDelete:CASCADE"`
+				Comment      string  `gorm:"type:text;not null"`
+				CreatedAt    time.Time
+				ResolvedAt   *time.Time
+				ResolvedByID *uint
+				ResolvedBy   *user  `gorm:"constraint:OnDelete:SET NULL"`
+				Resolution   string `gorm:"type:text"`
+			}
+			if !tx.Migrator().HasColumn(&invoice{}, "DisputedAt") {
+				if err := tx.Migrator().AddColumn(&invoice{}, "DisputedAt"); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasIndex(&invoice{}, "DisputedAt") {
+				if err := tx.Migrator().CreateIndex(&invoice{}, "DisputedAt"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&invoiceDispute{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables(tx, "invoice_disputes"); err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoices", "disputed_at")
+		},
+	},
+	{
+		Version:        56,
+		Name:           "cancelled invoices",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type invoice struct {
+				ID          uint
+				CancelledAt *time.Time `gorm:"index"`
+			}
+			if !tx.Migrator().HasColumn(&invoice{}, "CancelledAt") {
+				if err := tx.Migrator().AddColumn(&invoice{}, "CancelledAt"); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasIndex(&invoice{}, "CancelledAt") {
+				if err := tx.Migrator().CreateIndex(&invoice{}, "CancelledAt"); err != nil {
+					return err
+				}
+			}
+			// Invoices were cancelled by marking them paid, their timeline
+			// tells which
+			return tx.Exec(`UPDATE invoices SET paid = ?, cancelled_at = (SELECT MIN(created_at) FROM invoice_events
+				WHERE invoice_events.invoice_id = invoices.id AND invoice_events.type = ?)
+				WHERE id IN (SELECT invoice_id FROM invoice_events WHERE type = ?)`, false, "cancelled", "cancelled").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("UPDATE invoices SET paid = ? WHERE cancelled_at IS NOT NULL", true).Error; err != nil {
+				return err
+			}
+			return dropColumns(tx, "invoices", "cancelled_at")
+		},
+	},
+	{
+		Version:        57,
+		Name:           "job leases",
+		RebuildsTables: true,
+		Up: func(tx *gorm.DB) error {
+			type job struct {
+				ID             uint
+				LeaseOwner     string     `gorm:"size:100"`
+				LeaseExpiresAt *time.Time `gorm:"index"`
+			}
+			for _, column := range []string{"LeaseOwner", "LeaseExpiresAt"} {
+				if tx.Migrator().HasColumn(&job{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&job{}, column); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasIndex(&job{}, "LeaseExpiresAt") {
+				return tx.Migrator().CreateIndex(&job{}, "LeaseExpiresAt")
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, "jobs", "lease_owner", "lease_expires_at")
+		},
+	},
+}
+
+func (r *Repository) appliedMigrations() (map[int]SchemaMigration, error) {
+	if err := r.db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := r.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := map[int]SchemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// Migrate applies every pending migration
+func (r *Repository) Migrate() error {
+	_, err := r.MigrateUp()
+	return err
+}
+
+// MigrateUp applies the pending migrations in order and returns them. It
+// stops at the first failure, leaving that migration unapplied.
+func (r *Repository) MigrateUp() ([]Migration, error) {
+	return r.MigrateTo(migrations[len(migrations)-1].Version)
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first
+func (r *Repository) MigrateDown(steps int) ([]Migration, error) {
+	applied, err := r.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := r.revertMigration(migration); err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+// MigrateTo brings the schema to the version: the pending migrations up to
+// it are applied in order, the applied ones after it reverted newest first.
+// Version 0 reverts every migration. It returns the migrations applied or
+// reverted and stops at the first failure.
+func (r *Repository) MigrateTo(version int) ([]Migration, error) {
+	if version != 0 && findMigration(version) == nil {
+		return nil, fmt.Errorf("unknown migration version %d", version)
+	}
+	applied, err := r.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+		if err := r.revertMigration(migration); err != nil {
+			return changed, err
+		}
+		changed = append(changed, migration)
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		if err := r.applyMigration(migration); err != nil {
+			return changed, err
+		}
+		changed = append(changed, migration)
+	}
+	return changed, nil
+}
+
+func findMigration(version int) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+func (r *Repository) applyMigration(migration Migration) error {
+	err := r.migrationTransaction(migration, func(tx *gorm.DB) error {
+		if err := migration.Up(tx); err != nil {
+			return err
+		}
+		return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+func (r *Repository) revertMigration(migration Migration) error {
+	err := r.migrationTransaction(migration, func(tx *gorm.DB) error {
+		if err := migration.Down(tx); err != nil {
+			return err
+		}
+		return tx.Delete(&SchemaMigration{}, migration.Version).Error
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// migrationTransaction runs a step of the migration in a transaction,
+// restoring the indexes of the tables it rebuilt. The foreign keys can only
+// be turned off outside of one, so migrations rebuilding tables hold on to
+// a connection to turn them off and back on.
+func (r *Repository) migrationTransaction(migration Migration, step func(tx *gorm.DB) error) error {
+	step = keepingIndexes(step)
+	if !migration.RebuildsTables {
+		return r.db.Transaction(step)
+	}
+	return r.db.Connection(func(conn *gorm.DB) error {
+		conn = conn.Session(&gorm.Session{NewDB: true})
+		var enforced bool
+		if err := conn.Raw("PRAGMA foreign_keys").Scan(&enforced).Error; err != nil {
+			return err
+		}
+		if err := conn.Exec("PRAGMA foreign_keys = OFF").Error; err != nil {
+			return err
+		}
+		if enforced {
+			defer conn.Exec("PRAGMA foreign_keys = ON")
+		}
+		return conn.Transaction(func(tx *gorm.DB) error {
+			if err := step(tx); err != nil {
+				return err
+			}
+			return checkForeignKeys(tx)
+		})
+	})
+}
+
+// keepingIndexes wraps the step of a migration to restore the indexes
+// SQLite dropped along with the tables the step rebuilt
+func keepingIndexes(step func(tx *gorm.DB) error) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		indexes, err := schemaIndexes(tx)
+		if err != nil {
+			return err
+		}
+		if err := step(tx); err != nil {
+			return err
+		}
+		return restoreIndexes(tx, indexes)
+	}
+}
+
+// checkForeignKeys fails when rows refer to rows that don't exist
+func checkForeignKeys(tx *gorm.DB) error {
+	rows, err := tx.Raw("PRAGMA foreign_key_check").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var table, parent string
+		var rowID, index *int64
+		if err := rows.Scan(&table, &rowID, &parent, &index); err != nil {
+			return err
+		}
+		return fmt.Errorf("rows of %s refer to missing %s", table, parent)
+	}
+	return rows.Err()
+}
+
+// MigrationStatus lists every migration with when it was applied
+func (r *Repository) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := r.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, migration := range migrations {
+		state := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &row.AppliedAt
+		}
+		status = append(status, state)
+	}
+	return status, nil
+}
+
+// runMigrateCommand implements `tiny-crm migrate [up|down [steps]|to <version>|status]`
+func runMigrateCommand(repo *Repository, args []string) {
+	command := "up"
+	if len(args) >= 1 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		ran, err := repo.MigrateUp()
+		for _, migration := range ran {
+			fmt.Printf("Applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error running migrations: %v\n", err)
+			os.Exit(1)
+		}
+		if len(ran) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) >= 2 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Println("Usage: go run . migrate down [steps]")
+				os.Exit(1)
+			}
+		}
+
+		reverted, err := repo.MigrateDown(steps)
+		for _, migration := range reverted {
+			fmt.Printf("Reverted %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error reverting migrations: %v\n", err)
+			os.Exit(1)
+		}
+	case "to":
+		var version int
+		var err error
+		if len(args) == 2 {
+			version, err = strconv.Atoi(args[1])
+		}
+		if len(args) != 2 || err != nil {
+			fmt.Println("Usage: go run . migrate to <version>")
+			os.Exit(1)
+		}
+
+		applied, err := repo.appliedMigrations()
+		if err != nil {
+			fmt.Printf("Error reading migrations: %v\n", err)
+			os.Exit(1)
+		}
+		changed, err := repo.MigrateTo(version)
+		for _, migration := range changed {
+			if _, ok := applied[migration.Version]; ok {
+				fmt.Printf("Reverted %d %s\n", migration.Version, migration.Name)
+			} else {
+				fmt.Printf("Applied %d %s\n", migration.Version, migration.Name)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error migrating to %d: %v\n", version, err)
+			os.Exit(1)
+		}
+	case "status":
+		status, err := repo.MigrationStatus()
+		if err != nil {
+			fmt.Printf("Error reading migrations: %v\n", err)
+			os.Exit(1)
+		}
+		for _, migration := range status {
+			applied := "pending"
+			if migration.AppliedAt != nil {
+				applied = "applied " + migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%3d %-35s %s\n", migration.Version, migration.Name, applied)
+		}
+	default:
+		fmt.Println("Usage: go run . migrate [up|down [steps]|to <version>|status]")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Money is an amount in cents. Invoice math is done on whole cents, so a
+// total is exactly the sum of its lines and adjustments, with no float
+// rounding errors piling up along the way.
+//
+// Every currency the locales bill in (BRL, USD, EUR) has cents, and
+// amounts are rounded to the cent half away from zero: line totals and
+// discounts, penalties and percentages each on their own, before being
+// added up. The JSON and the database keep decimal numbers, 12.34.
+type Money int64
+
+// moneyFromFloat rounds a decimal amount to the cent
+func moneyFromFloat(amount float64) Money {
+	return Money(math.Round(amount * 100))
+}
+
+// divRound divides rounding half away from zero
+func divRound(numerator, denominator int64) int64 {
+	quotient, remainder := numerator/denominator, numerator%denominator
+	if remainder < 0 {
+		remainder = -remainder
+	}
+	if 2*remainder >= denominator {
+		if numerator < 0 {
+			quotient--
+		} else {
+			quotient++
+		}
+	}
+	return quotient
+}
+
+// thousandths is a quantity of up to 3 decimals as a whole number
+func thousandths(quantity float64) int64 {
+	return int64(math.Round(quantity * 1000))
+}
+
+// Times is the amount for a quantity of up to 3 decimals, rounded to the cent
+func (m Money) Times(quantity float64) Money {
+	return Money(divRound(int64(m)*thousandths(quantity), 1000))
+}
+
+// Per is the amount of one of quantity, rounded to the cent. A quantity
+// that rounds to 0 has no amount per unit, Per gives 0 then.
+func (m Money) Per(quantity float64) Money {
+	divisor := thousandths(quantity)
+	if divisor == 0 {
+		return 0
+	}
+	if divisor < 0 {
+		m, divisor = -m, -divisor
+	}
+	return Money(divRound(int64(m)*1000, divisor))
+}
+
+// Percent is percent of the amount, with up to 2 decimals, rounded to the
+// cent
+func (m Money) Percent(percent float64) Money {
+	return Money(divRound(int64(m)*int64(math.Round(percent*100)), 10000))
+}
+
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+// String writes the amount with its 2 decimals, -1234.50
+func (m Money) String() string {
+	sign, cents := "", int64(m)
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Format prints the amount as a decimal number for the float verbs, so
+// templates can printf "%.2f" it, and as String otherwise
+func (m Money) Format(state fmt.State, verb rune) {
+	switch verb {
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		fmt.Fprintf(state, fmt.FormatString(state, verb), m.Float())
+	case 'd':
+		fmt.Fprintf(state, fmt.FormatString(state, verb), int64(m))
+	default:
+		fmt.Fprintf(state, fmt.FormatString(state, 's'), m.String())
+	}
+}
+
+// MarshalJSON writes the amount as a number with the decimals it has, 12.5
+// or 12, as amounts always were
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(m.Float(), 'f', -1, 64)), nil
+}
+
+// UnmarshalJSON reads a JSON number, rounded to the cent
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	amount, err := parseMoney(string(data))
+	if err != nil {
+		return fmt.Errorf("invalid amount %s", data)
+	}
+	*m = amount
+	return nil
+}
+
+// parseMoney reads a decimal number exactly, rounded to the cent
+func parseMoney(text string) (Money, error) {
+	amount, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", text)
+	}
+	cents := new(big.Int).Mul(amount.Num(), big.NewInt(100))
+	if !cents.IsInt64() || !amount.Denom().IsInt64() {
+		return 0, fmt.Errorf("amount %q out of range", text)
+	}
+	return Money(divRound(cents.Int64(), amount.Denom().Int64())), nil
+}
+
+// Value stores the amount as the decimal columns hold it
+func (m Money) Value() (driver.Value, error) {
+	return m.Float(), nil
+}
+
+// Scan reads a decimal column or a sum of them, SQLite giving whole
+// amounts as integers
+func (m *Money) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*m = 0
+	case float64:
+		*m = moneyFromFloat(v)
+	case int64:
+		*m = Money(v * 100)
+	case []byte:
+		return m.scanText(string(v))
+	case string:
+		return m.scanText(v)
+	default:
+		return fmt.Errorf("can't scan %T as money", value)
+	}
+	return nil
+}
+
+func (m *Money) scanText(text string) error {
+	amount, err := parseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = amount
+	return nil
+}
+
+// formatPercent writes a percentage with its 2 decimals, as e-invoices give
+// rates
+func formatPercent(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', 2, 64)
+}
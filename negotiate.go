@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Response formats of the list and detail views
+const (
+	formatJSON = "json"
+	formatHTML = "html"
+	formatCSV  = "csv"
+)
+
+// formatMediaTypes maps the media types of the Accept header to formats
+var formatMediaTypes = map[string]string{
+	"application/json": formatJSON,
+	"text/html":        formatHTML,
+	"text/csv":         formatCSV,
+}
+
+// responseFormat picks the format of the response: the format query
+// parameter when given, or else the preferred type of the Accept header.
+// HTMX requests get HTML fragments unless they ask otherwise, everything
+// else JSON.
+func responseFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case formatJSON, formatHTML, formatCSV:
+			return format, nil
+		}
+		return "", fmt.Errorf("Unsupported format %q, expected json, html or csv", format)
+	}
+
+	fallback := formatJSON
+	if r.Header.Get("HX-Request") != "" {
+		fallback = formatHTML
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return fallback, nil
+	}
+
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if value, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		format, ok := formatMediaTypes[mediaType]
+		if !ok && (mediaType == "*/*" || mediaType == "application/*") {
+			format, ok = fallback, true
+		}
+		// The first of equally preferred types wins
+		if ok && quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("Not acceptable, expected application/json, text/html or text/csv")
+	}
+	return best, nil
+}
+
+// decodeRows turns the rows into their JSON fields
+func decodeRows(rows interface{}) ([]map[string]json.RawMessage, error) {
+	encoded, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// cellText is the text of a JSON field in a CSV or HTML cell: strings
+// unquoted, lists of strings joined, null empty, anything else as JSON
+func cellText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var texts []string
+	if err := json.Unmarshal(raw, &texts); err == nil {
+		return strings.Join(texts, ", ")
+	}
+	return string(raw)
+}
+
+// tableFragment is the HTML table of a list
+type tableFragment struct {
+	Name    string
+	Columns Columns
+	Rows    [][]string
+}
+
+// recordFragment is the HTML description list of a record
+type recordFragment struct {
+	Name   string
+	Fields []recordField
+}
+
+type recordField struct {
+	Name  string
+	Value string
+}
+
+// renderFragment executes one of the HTML fragments answering HTMX
+func renderFragment(w http.ResponseWriter, name string, data interface{}) {
+	tmplPath := filepath.Join("templates", "fragments.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Error executing template %s of %s: %v", name, tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeRows answers with the columns of the rows in the format, a CSV
+// download named after the list or an HTML table
+func writeRows(w http.ResponseWriter, format, name string, columns Columns, rows interface{}) {
+	if format == formatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+		return
+	}
+
+	decoded, err := decodeRows(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cells := make([][]string, len(decoded))
+	for i, row := range decoded {
+		cells[i] = make([]string, len(columns))
+		for j, column := range columns {
+			cells[i][j] = cellText(row[column])
+		}
+	}
+
+	if format == formatHTML {
+		renderFragment(w, "table", tableFragment{Name: name, Columns: columns, Rows: cells})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	writer := csv.NewWriter(w)
+	writer.Write(columns)
+	writer.WriteAll(cells)
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing %s CSV: %v", name, err)
+	}
+}
+
+// rowColumns lists the JSON fields of the elements of a slice, or of a
+// record
+func rowColumns(value interface{}) Columns {
+	rowType := reflect.TypeOf(value)
+	for rowType.Kind() == reflect.Pointer || rowType.Kind() == reflect.Slice {
+		rowType = rowType.Elem()
+	}
+	return jsonColumns(rowType)
+}
+
+// writeRecords answers a list without chosen columns in the format the
+// request accepts, with every field of the rows
+func writeRecords(w http.ResponseWriter, r *http.Request, name string, rows interface{}) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	writeRows(w, format, name, rowColumns(rows), rows)
+}
+
+// writeRecord answers a detail view in the format the request accepts: a
+// JSON object, an HTML description list or a one row CSV
+func writeRecord(w http.ResponseWriter, r *http.Request, name string, record interface{}) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	switch format {
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(record)
+		return
+	case formatCSV:
+		writeRows(w, format, name, rowColumns(record), []interface{}{record})
+		return
+	}
+
+	decoded, err := decodeRows([]interface{}{record})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fragment := recordFragment{Name: name}
+	for _, column := range rowColumns(record) {
+		fragment.Fields = append(fragment.Fields, recordField{Name: column, Value: cellText(decoded[0][column])})
+	}
+	renderFragment(w, "record", fragment)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Brazilian fiscal notes of services (NFS-e) are issued by the city hall
+// from an RPS, the provisional receipt of the invoice
+var (
+	ErrNFSeNotConfigured = errors.New("NFS-e export needs the nfse municipality_code and service_code settings")
+	ErrNFSeDocumentType  = errors.New("fiscal notes are only issued for invoices, cancel the note instead of crediting it")
+	ErrNFSeDraft         = errors.New("fiscal notes are only issued for sent invoices with a number")
+	ErrNFSeDocument      = errors.New("fiscal notes need the CPF or CNPJ of the issuer and the client as their document")
+	ErrNFSeCurrency      = errors.New("fiscal notes are issued in BRL, set the invoice locale to pt-BR")
+)
+
+// NFSeLayout renders an invoice as the RPS XML a city hall provider takes.
+// Cities not following the ABRASF layout can be supported by adding their
+// own to nfseLayouts.
+type NFSeLayout interface {
+	RPSXML(invoice *Invoice, settings NFSeConfig) ([]byte, error)
+}
+
+// nfseLayouts are the layouts nfse.provider picks from
+var nfseLayouts = map[string]NFSeLayout{
+	"abrasf": abrasfLayout{},
+}
+
+// nfseDocument is the CPF (11 digits) or CNPJ (14 digits) of a company,
+// punctuation left out
+type nfseDocument struct {
+	CPF  string `xml:"Cpf,omitempty"`
+	CNPJ string `xml:"Cnpj,omitempty"`
+}
+
+func newNFSeDocument(company *Company) (nfseDocument, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, company.Document)
+	switch len(digits) {
+	case 11:
+		return nfseDocument{CPF: digits}, nil
+	case 14:
+		return nfseDocument{CNPJ: digits}, nil
+	}
+	return nfseDocument{}, fmt.Errorf("%w, %s has %q", ErrNFSeDocument, company.Name, company.Document)
+}
+
+// nfseInvoiceChecks checks the invoice can be issued as a fiscal note and
+// returns the documents of its issuer and client
+func nfseInvoiceChecks(invoice *Invoice, settings NFSeConfig) (issuer, client nfseDocument, err error) {
+	if settings.MunicipalityCode == "" || settings.ServiceCode == "" {
+		return issuer, client, ErrNFSeNotConfigured
+	}
+	if invoice.Type != "" && invoice.Type != DocumentInvoice {
+		return issuer, client, ErrNFSeDocumentType
+	}
+	if invoice.Draft() || invoice.Number == nil || *invoice.Number == 0 {
+		return issuer, client, ErrNFSeDraft
+	}
+	if invoice.EffectiveLocale().CurrencyCode() != "BRL" {
+		return issuer, client, ErrNFSeCurrency
+	}
+	if issuer, err = newNFSeDocument(&invoice.Company); err != nil {
+		return issuer, client, err
+	}
+	client, err = newNFSeDocument(&invoice.Client)
+	return issuer, client, err
+}
+
+// nfseDescription is the discrimination of the services, a line each
+func nfseDescription(invoice *Invoice) string {
+	lines := make([]string, 0, len(invoice.InvoiceLines))
+	for _, line := range invoice.InvoiceLines {
+		if line.Section() {
+			lines = append(lines, line.Name())
+			continue
+		}
+		text := fmt.Sprintf("%s x %s", invoice.FormatQuantity(line.Quantity, line.Unit), line.Name())
+		if details := line.Details(); details != "" {
+			text += " - " + details
+		}
+		lines = append(lines, text+": "+ciiFormatAmount(line.Total()))
+	}
+	if invoice.AdditionalInformation != nil && *invoice.AdditionalInformation != "" {
+		lines = append(lines, *invoice.AdditionalInformation)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The structs below are the subset of the ABRASF 2.04 schema needed to
+// generate a note from an RPS. Field order follows the schema.
+
+type abrasfEnvelope struct {
+	XMLName xml.Name       `xml:"GerarNfseEnvio"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	RPS     abrasfDeclared `xml:"Rps>InfDeclaracaoPrestacaoServico"`
+}
+
+type abrasfDeclared struct {
+	ID           string        `xml:"Id,attr"`
+	Number       int           `xml:"Rps>IdentificacaoRps>Numero"`
+	Series       string        `xml:"Rps>IdentificacaoRps>Serie"`
+	Type         int           `xml:"Rps>IdentificacaoRps>Tipo"`
+	IssueDate    string        `xml:"Rps>DataEmissao"`
+	Status       int           `xml:"Rps>Status"`
+	Competence   string        `xml:"Competencia"`
+	Service      abrasfService `xml:"Servico"`
+	Provider     nfseDocument  `xml:"Prestador>CpfCnpj"`
+	Taker        abrasfTaker   `xml:"TomadorServico"`
+	SimpleTax    int           `xml:"OptanteSimplesNacional"`
+	TaxIncentive int           `xml:"IncentivoFiscal"`
+}
+
+type abrasfService struct {
+	Amount           string `xml:"Valores>ValorServicos"`
+	ISSAmount        string `xml:"Valores>ValorIss"`
+	Rate             string `xml:"Valores>Aliquota"`
+	Discount         string `xml:"Valores>DescontoIncondicionado,omitempty"`
+	ISSWithheld      int    `xml:"IssRetido"`
+	ServiceCode      string `xml:"ItemListaServico"`
+	Description      string `xml:"Discriminacao"`
+	MunicipalityCode string `xml:"CodigoMunicipio"`
+	ISSLiability     int    `xml:"ExigibilidadeISS"`
+}
+
+type abrasfTaker struct {
+	Document nfseDocument `xml:"IdentificacaoTomador>CpfCnpj"`
+	Name     string       `xml:"RazaoSocial"`
+	Email    string       `xml:"Contato>Email,omitempty"`
+}
+
+// abrasfLayout is the national ABRASF 2.04 layout most city providers
+// follow, the note generated from a single RPS
+type abrasfLayout struct{}
+
+func (abrasfLayout) RPSXML(invoice *Invoice, settings NFSeConfig) ([]byte, error) {
+	issuer, client, err := nfseInvoiceChecks(invoice, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Late payment penalties are billed as part of the service, discounts
+	// are unconditional as they don't depend on a later event
+	amount := invoice.SubTotal() + invoice.PenaltyAmount()
+	taxable := amount - invoice.DiscountAmount()
+	service := abrasfService{
+		Amount:           ciiFormatAmount(amount),
+		ISSAmount:        ciiFormatAmount(taxable.Percent(settings.ISSRate)),
+		Rate:             formatPercent(settings.ISSRate),
+		ISSWithheld:      2,
+		ServiceCode:      settings.ServiceCode,
+		Description:      nfseDescription(invoice),
+		MunicipalityCode: settings.MunicipalityCode,
+		ISSLiability:     1,
+	}
+	if invoice.DiscountAmount() != 0 {
+		service.Discount = ciiFormatAmount(invoice.DiscountAmount())
+	}
+
+	taker := abrasfTaker{Document: client, Name: invoice.Client.Name, Email: invoice.Client.Email}
+	envelope := abrasfEnvelope{
+		Xmlns: "http://www.abrasf.org.br/nfse.xsd",
+		RPS: abrasfDeclared{
+			ID:           fmt.Sprintf("rps%d", *invoice.Number),
+			Number:       *invoice.Number,
+			Series:       settings.RPSSeries,
+			Type:         1,
+			IssueDate:    invoice.IssueDate.Format("2006-01-02"),
+			Status:       1,
+			Competence:   invoice.IssueDate.Format("2006-01-02"),
+			Service:      service,
+			Provider:     issuer,
+			Taker:        taker,
+			SimpleTax:    2,
+			TaxIncentive: 2,
+		},
+	}
+	if settings.SimplesNacional {
+		envelope.RPS.SimpleTax = 1
+	}
+
+	data, err := xml.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func (h *Handler) getInvoiceNFSe(w http.ResponseWriter, r *http.Request) {
+	invoiceId, err := strconv.ParseUint(r.PathValue("invoiceId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := nfseLayouts[config.NFSe.Provider].RPSXML(invoice, config.NFSe)
+	if err != nil {
+		for _, invalid := range []error{ErrNFSeNotConfigured, ErrNFSeDocumentType, ErrNFSeDraft, ErrNFSeDocument, ErrNFSeCurrency} {
+			if errors.Is(err, invalid) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", invoice.Repr()+".nfse.xml"))
+	w.Write(data)
+}
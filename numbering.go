@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvoiceAlreadySent  = errors.New("invoice was already sent")
+	ErrSentInvoiceDeletion = errors.New("sent invoices can't be deleted with gapless numbering, issue a credit note instead")
+)
+
+// NumberingStrategy hands out the number of a document being sent. The
+// code, when not empty, is what the document is known by instead of the
+// bare number, e.g. "2024-0007". prefix is the invoice prefix of the
+// issuer, or else of the settings.
+type NumberingStrategy interface {
+	Next(tx *gorm.DB, invoice *Invoice, prefix string) (number *int, code string, err error)
+}
+
+// numberingStrategies are the strategies numbering_strategy picks from
+var numberingStrategies = map[string]NumberingStrategy{
+	"sequential": sequentialNumbering{},
+	"yearly":     seriesNumbering{prefix: yearPrefix},
+	"per_client": seriesNumbering{prefix: clientPrefix},
+	"random":     randomNumbering{},
+}
+
+// numberingStrategy returns the strategy and the invoice prefix of the
+// issuer, the configured strategy and the prefix of the settings when it
+// has none
+func numberingStrategy(issuer *Company) (NumberingStrategy, string) {
+	prefix := currentSettings().InvoicePrefix
+	if issuer.InvoicePrefix != nil {
+		prefix = *issuer.InvoicePrefix
+	}
+	if strategy, ok := numberingStrategies[issuer.NumberingStrategy]; ok {
+		return strategy, prefix
+	}
+	if strategy, ok := numberingStrategies[config.NumberingStrategy]; ok {
+		return strategy, prefix
+	}
+	return sequentialNumbering{}, prefix
+}
+
+// sequentialNumbering numbers the documents of each issuer and type 1, 2, 3...
+// coded like INV-0007 when there is an invoice prefix
+type sequentialNumbering struct{}
+
+func (sequentialNumbering) Next(tx *gorm.DB, invoice *Invoice, prefix string) (*int, string, error) {
+	var last int
+	err := tx.Model(&Invoice{}).
+		Select("COALESCE(MAX(number), 0)").
+		Where("company_id = ? AND type = ?", invoice.CompanyID, invoice.Type).
+		Scan(&last).Error
+	next := last + 1
+	code := ""
+	if prefix != "" {
+		code = fmt.Sprintf("%s%04d", prefix, next)
+	}
+	return &next, code, err
+}
+
+// seriesNumbering restarts the numbers for every prefix, coding documents
+// as the prefix followed by the number, after the invoice prefix
+type seriesNumbering struct {
+	prefix func(invoice *Invoice) string
+}
+
+func yearPrefix(invoice *Invoice) string {
+	return strconv.Itoa(invoice.IssueDate.Year()) + "-"
+}
+
+func clientPrefix(invoice *Invoice) string {
+	return fmt.Sprintf("C%d-", invoice.ClientID)
+}
+
+func (s seriesNumbering) Next(tx *gorm.DB, invoice *Invoice, prefix string) (*int, string, error) {
+	prefix += s.prefix(invoice)
+	var last int
+	err := tx.Model(&Invoice{}).
+		Select("COALESCE(MAX(number), 0)").
+		Where("company_id = ? AND type = ? AND code LIKE ?", invoice.CompanyID, invoice.Type, prefix+"%").
+		Scan(&last).Error
+	next := last + 1
+	return &next, fmt.Sprintf("%s%04d", prefix, next), err
+}
+
+// codeAlphabet leaves out the characters read alike, 0 and O or 1, I and L
+const codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// randomNumbering codes documents like "K7P4-QX2M", so clients can't tell
+// how many documents the issuer sends. They stay unnumbered.
+type randomNumbering struct{}
+
+func (randomNumbering) Next(tx *gorm.DB, invoice *Invoice, prefix string) (*int, string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		code := randomCode(8)
+		code = prefix + code[:4] + "-" + code[4:]
+
+		var taken int64
+		if err := tx.Model(&Invoice{}).Where("company_id = ? AND code = ?", invoice.CompanyID, code).Count(&taken).Error; err != nil {
+			return nil, "", err
+		}
+		if taken == 0 {
+			return nil, code, nil
+		}
+	}
+	return nil, "", errors.New("couldn't find a free invoice code")
+}
+
+// randomCode returns length characters of codeAlphabet
+func randomCode(length int) string {
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			panic(err)
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// SendInvoice marks the draft as sent. With NumberingOnSend it gets the
+// number the configured strategy gives, so drafts abandoned before then
+// don't leave gaps.
+func (r *Repository) SendInvoice(id uint, now time.Time) (*Invoice, error) {
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			return sendInvoice(tx, id, now)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.GetInvoice(id)
+}
+
+// sendInvoice marks the draft as sent, numbering it when invoices are
+// numbered on send
+func sendInvoice(tx *gorm.DB, id uint, now time.Time) error {
+	var invoice Invoice
+	if err := tx.First(&invoice, id).Error; err != nil {
+		return err
+	}
+	if !invoice.Draft() {
+		return ErrInvoiceAlreadySent
+	}
+
+	updates := map[string]interface{}{"sent_at": now}
+	message := "Sent"
+	if config.InvoiceNumbering == NumberingOnSend {
+		var issuer Company
+		if err := tx.First(&issuer, invoice.CompanyID).Error; err != nil {
+			return err
+		}
+		strategy, prefix := numberingStrategy(&issuer)
+		number, code, err := strategy.Next(tx, &invoice, prefix)
+		if err != nil {
+			return err
+		}
+		updates["number"], updates["code"] = number, code
+		invoice.Number, invoice.Code = number, code
+		message = "Sent as " + invoice.Identification()
+	}
+	if err := tx.Model(&invoice).UpdateColumns(updates).Error; err != nil {
+		return err
+	}
+	return tx.Create(&InvoiceEvent{InvoiceID: invoice.ID, Type: "sent", Message: message}).Error
+}
+
+func (h *Handler) sendInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).SendInvoice(uint(invoiceId), clock.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvoiceAlreadySent):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeDatabaseError(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoice)
+}
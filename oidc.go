@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	sessionCookie   = "tinycrm_session"
+	oidcLoginCookie = "tinycrm_oidc"
+	sessionDuration = 12 * time.Hour
+)
+
+var (
+	ErrInvalidIDToken   = errors.New("invalid ID token")
+	ErrUnknownOIDCUser  = errors.New("no user matches this identity")
+	ErrUnverifiedEmail  = errors.New("the provider hasn't verified this email")
+	ErrOIDCLoginExpired = errors.New("sign in expired, please try again")
+)
+
+// UserIdentity links an account at an OpenID Connect provider to a local
+// user, so signing in doesn't depend on the email staying the same
+type UserIdentity struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	User      User      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Issuer    string    `gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject" json:"issuer"`
+	Subject   string    `gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject" json:"subject"`
+	Email     string    `gorm:"size:255" json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r *Repository) GetUserByIdentity(issuer, subject string) (*User, error) {
+	var identity UserIdentity
+	err := r.db.Preload("User").Where("issuer = ? AND subject = ?", issuer, subject).First(&identity).Error
+	if err != nil {
+		return nil, err
+	}
+	return &identity.User, nil
+}
+
+func (r *Repository) LinkUserIdentity(identity *UserIdentity) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(identity).Error
+	})
+}
+
+// isLoopback reports whether the host is this machine, where plain http is
+// acceptable for a provider under development
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// oidcMetadata is the part of the discovery document the login flow needs
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider signs users in with the authorization code flow. The
+// discovery document and the signing keys are fetched on first use and the
+// keys again when a token is signed with an unknown one, after a rotation.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *oidcMetadata
+	keys     map[string]crypto.PublicKey
+}
+
+func newOIDCProvider(c OIDCConfig) *oidcProvider {
+	return &oidcProvider{config: c, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getJSON decodes the JSON answer of the provider
+func (p *oidcProvider) getJSON(target string, value interface{}) error {
+	resp, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+func (p *oidcProvider) discover() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	if err := p.getJSON(p.config.DiscoveryURL, &metadata); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if metadata.Issuer == "" || metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: incomplete provider metadata")
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// jsonWebKey is a signing key of the provider's JWKS, RSA or P-256
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(bytes), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key kid of the provider
+func (p *oidcProvider) key(metadata *oidcMetadata, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("OIDC keys: %w", err)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	for _, webKey := range jwks.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		key, err := webKey.publicKey()
+		if err != nil {
+			log.Printf("Skipping OIDC key %q: %v", webKey.Kid, err)
+			continue
+		}
+		p.keys[webKey.Kid] = key
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+// audience is the aud claim, a single client or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// idTokenClaims are the claims of an ID token the login relies on
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     *bool    `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// verifyIDToken checks the signature of the ID token with the provider's
+// keys and that it was issued by the provider, for us, for this sign in
+func (p *oidcProvider) verifyIDToken(metadata *oidcMetadata, token, nonce string, now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, ErrInvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(metadata, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+		}
+	default:
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims idTokenClaims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, ErrInvalidIDToken
+	}
+	switch {
+	case claims.Issuer != metadata.Issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: issued for another client", ErrInvalidIDToken)
+	case now.Unix() >= claims.Expiry:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	return &claims, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, client := range a {
+		if client == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeCode trades the authorization code for the ID token
+func (p *oidcProvider) exchangeCode(metadata *oidcMetadata, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("OIDC token endpoint answered %s", resp.Status)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("OIDC token endpoint: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("OIDC token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// oidcRedirectURL is where the provider sends the user back, it must be
+// registered with the provider
+func oidcRedirectURL() string {
+	return publicURL("/auth/callback")
+}
+
+// oidcUser returns the local user of the identity. An unknown identity is
+// linked to the user named after its email, created when the configuration
+// allows it.
+func oidcUser(store UserStore, c OIDCConfig, claims *idTokenClaims) (*User, error) {
+	user, err := store.GetUserByIdentity(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	username := claims.Email
+	if username == "" {
+		username = claims.PreferredUsername
+	}
+	if username == "" {
+		return nil, ErrUnknownOIDCUser
+	}
+	if claims.Email != "" && claims.EmailVerified != nil && !*claims.EmailVerified {
+		return nil, ErrUnverifiedEmail
+	}
+
+	user, err = store.GetUserByUsername(username)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound) && c.CreateUsers:
+		// Without a password hash the user can only sign in with the provider
+		user = &User{Username: username, Email: claims.Email}
+		if err := store.CreateUser(user); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, ErrUnknownOIDCUser
+	case err != nil:
+		return nil, err
+	}
+
+	identity := &UserIdentity{UserID: user.ID, Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}
+	if err := store.LinkUserIdentity(identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// randomToken returns a random URL safe string
+func randomToken() string {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// signSession signs the session value with the share link key, so
+// configuring share_link_secret also keeps sessions across restarts
+func signSession(value string) string {
+	mac := hmac.New(sha256.New, shareLinkSecret)
+	mac.Write([]byte("session:" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionValue is the cookie of the signed in user, valid until expires
+func sessionValue(userID uint, expires time.Time) string {
+	value := fmt.Sprintf("%d.%d", userID, expires.Unix())
+	return value + "." + signSession(value)
+}
+
+// newSession starts a session of the user until expires and returns its
+// cookie. With Redis the cookie is a random token of a session kept there,
+// which every instance sees and logging out ends.
+func newSession(userID uint, expires time.Time) (string, error) {
+	if redisClient == nil {
+		return sessionValue(userID, expires), nil
+	}
+	token := randomToken()
+	err := redisClient.Set(context.Background(), redisClient.key("session", token), strconv.FormatUint(uint64(userID), 10),
+		time.Until(expires)).Err()
+	return token, err
+}
+
+// endSession ends the session of the cookie, which only Redis can do: a
+// signed cookie stays valid until it expires
+func endSession(value string) error {
+	if redisClient == nil {
+		return nil
+	}
+	return redisClient.Del(context.Background(), redisClient.key("session", value)).Err()
+}
+
+// sessionUserID returns the user of a valid session cookie
+func sessionUserID(value string) (uint, bool) {
+	if redisClient != nil {
+		userID, err := redisClient.Get(context.Background(), redisClient.key("session", value)).Result()
+		if err != nil {
+			if !errors.Is(err, redis.Nil) {
+				log.Printf("Error reading the session: %v", err)
+			}
+			return 0, false
+		}
+		id, err := strconv.ParseUint(userID, 10, 32)
+		return uint(id), err == nil
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	signed := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signSession(signed))) {
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// sessionUser returns the user of a valid session cookie, nil otherwise
+func (h *Handler) sessionUser(r *http.Request) *User {
+	if h.oidc == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	userID, ok := sessionUserID(cookie.Value)
+	if !ok {
+		return nil
+	}
+
+	user, err := h.storeFor(r).GetUser(userID)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// secureCookies reports whether cookies must only travel over https
+func secureCookies(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(config.BaseURL, "https://")
+}
+
+// oidcLogin sends the user to the provider. The state, nonce and PKCE
+// verifier are kept in a short lived cookie for the callback to check.
+func (h *Handler) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	metadata, err := h.oidc.discover()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {h.oidc.config.ClientID},
+		"redirect_uri":          {oidcRedirectURL()},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, metadata.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// oidcCallback signs the user in once the provider sends them back
+func (h *Handler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if providerError := r.URL.Query().Get("error"); providerError != "" {
+		http.Error(w, "Sign in failed: "+providerError+" "+r.URL.Query().Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcLoginCookie)
+	login := []string{}
+	if err == nil {
+		login = strings.Split(cookie.Value, ".")
+	}
+	if len(login) != 3 || subtle.ConstantTimeCompare([]byte(login[0]), []byte(r.URL.Query().Get("state"))) != 1 {
+		http.Error(w, ErrOIDCLoginExpired.Error(), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookie, Path: "/auth/", MaxAge: -1})
+
+	metadata, err := h.oidc.discover()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	idToken, err := h.oidc.exchangeCode(metadata, r.URL.Query().Get("code"), login[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	claims, err := h.oidc.verifyIDToken(metadata, idToken, login[1], time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := oidcUser(h.storeFor(r), h.oidc.config, claims)
+	if err != nil {
+		if errors.Is(err, ErrUnknownOIDCUser) || errors.Is(err, ErrUnverifiedEmail) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	expires := time.Now().Add(sessionDuration)
+	session, err := newSession(user.ID, expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
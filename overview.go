@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recentActivityLimit is how many entries a company overview lists
+const recentActivityLimit = 10
+
+// CompanyActivity is an entry of a company's recent activity
+type CompanyActivity struct {
+	Date        time.Time `json:"date"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	InvoiceID   uint      `json:"invoice_id"`
+	Amount      *Money    `json:"amount,omitempty"`
+}
+
+// CompanyOverview gathers the key figures of a client for its profile page
+type CompanyOverview struct {
+	Company Company `json:"company"`
+	// LifetimeRevenue is what was billed to the client, invoices minus credit notes
+	LifetimeRevenue Money `json:"lifetime_revenue"`
+	Received        Money `json:"received"`
+	OpenBalance     Money `json:"open_balance"`
+	Invoices        int64 `json:"invoices"`
+	UnpaidInvoices  int64 `json:"unpaid_invoices"`
+	// AverageDaysToPay is measured from the issue date to the payment that
+	// settled the invoice, nil until an invoice is paid
+	AverageDaysToPay *float64   `json:"average_days_to_pay"`
+	LastInvoiceDate  *time.Time `json:"last_invoice_date"`
+	// LastContactDate is the latest payment, survey answer or invoice
+	// timeline event such as a reminder
+	LastContactDate *time.Time        `json:"last_contact_date"`
+	RecentActivity  []CompanyActivity `json:"recent_activity"`
+	Cache           ReadModelStatus   `json:"-"`
+}
+
+// balanceSignSQL is a SQL expression with the balance sign of the type of
+// each invoice, following the document type behaviors
+func balanceSignSQL() string {
+	var types []string
+	for documentType := range documentTypes {
+		types = append(types, string(documentType))
+	}
+	sort.Strings(types)
+
+	expression := "CASE invoices.type"
+	for _, documentType := range types {
+		expression += fmt.Sprintf(" WHEN '%s' THEN %g", documentType, documentTypes[DocumentType(documentType)].BalanceSign)
+	}
+	return expression + " ELSE 0 END"
+}
+
+// GetCompanyOverview returns the overview of the client, cached until the
+// next write
+func (r *Repository) GetCompanyOverview(companyID uint) (*CompanyOverview, error) {
+	overview, status, err := cachedReadModel(r, fmt.Sprintf("company overview %d", companyID), func() (CompanyOverview, error) {
+		overview, err := r.computeCompanyOverview(companyID)
+		if err != nil {
+			return CompanyOverview{}, err
+		}
+		return *overview, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	overview.Cache = status
+	return &overview, nil
+}
+
+// computeCompanyOverview aggregates the client's invoices, payments and
+// timeline in the database, without loading every invoice
+func (r *Repository) computeCompanyOverview(companyID uint) (*CompanyOverview, error) {
+	company, err := r.GetCompany(companyID)
+	if err != nil {
+		return nil, err
+	}
+	overview := &CompanyOverview{Company: *company, RecentActivity: []CompanyActivity{}}
+
+	var billing struct {
+		Revenue  Money
+		Invoices int64
+		Unpaid   int64
+	}
+	err = r.db.Model(&Invoice{}).
+		Select(`COALESCE(SUM(`+balanceSignSQL()+` * total), 0) AS revenue,
+			COUNT(*) AS invoices,
+			COUNT(CASE WHEN NOT paid AND cancelled_at IS NULL AND type = ? THEN 1 END) AS unpaid`, DocumentInvoice).
+		Where("client_id = ?", companyID).
+		Scan(&billing).Error
+	if err != nil {
+		return nil, err
+	}
+	overview.LifetimeRevenue = billing.Revenue
+	overview.Invoices = billing.Invoices
+	overview.UnpaidInvoices = billing.Unpaid
+
+	err = r.db.Model(&Payment{}).
+		Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Where("invoices.client_id = ?", companyID).
+		Select("COALESCE(SUM(payments.amount), 0)").
+		Row().Scan(&overview.Received)
+	if err != nil {
+		return nil, err
+	}
+	overview.OpenBalance = overview.LifetimeRevenue - overview.Received
+
+	var daysToPay sql.NullFloat64
+	err = r.db.Table("invoices").
+		Joins("JOIN (SELECT invoice_id, MAX(date) AS settled_at FROM payments GROUP BY invoice_id) settlements ON settlements.invoice_id = invoices.id").
+		Where("invoices.client_id = ? AND invoices.paid", companyID).
+		Select("AVG(MAX(julianday(settlements.settled_at) - julianday(invoices.issue_date), 0))").
+		Row().Scan(&daysToPay)
+	if err != nil {
+		return nil, err
+	}
+	if daysToPay.Valid {
+		overview.AverageDaysToPay = &daysToPay.Float64
+	}
+
+	activity, err := r.recentCompanyActivity(companyID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range activity {
+		entry := &activity[i]
+		if entry.Type == "invoice" {
+			if overview.LastInvoiceDate == nil {
+				overview.LastInvoiceDate = &entry.Date
+			}
+		} else if overview.LastContactDate == nil {
+			overview.LastContactDate = &entry.Date
+		}
+	}
+	overview.RecentActivity = activity
+	return overview, nil
+}
+
+// recentCompanyActivity merges the latest invoices, payments, timeline
+// events and survey answers of the client, newest first
+func (r *Repository) recentCompanyActivity(companyID uint) ([]CompanyActivity, error) {
+	activity := []CompanyActivity{}
+
+	var invoices []Invoice
+	err := r.db.Select("id", "uuid", "type", "number", "code", "issue_date", "total").
+		Where("client_id = ?", companyID).
+		Order("issue_date DESC").Limit(recentActivityLimit).
+		Find(&invoices).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		total := invoice.TotalAmount
+		activity = append(activity, CompanyActivity{
+			Date:        invoice.IssueDate,
+			Type:        "invoice",
+			Description: invoice.Type.Behavior().Label + " " + invoice.Identification() + " issued",
+			InvoiceID:   invoice.ID,
+			Amount:      &total,
+		})
+	}
+
+	var payments []Payment
+	err = r.db.Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Where("invoices.client_id = ?", companyID).
+		Order("payments.date DESC").Limit(recentActivityLimit).
+		Find(&payments).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		amount := payment.Amount
+		activity = append(activity, CompanyActivity{
+			Date:        payment.Date,
+			Type:        "payment",
+			Description: "Payment received",
+			InvoiceID:   payment.InvoiceID,
+			Amount:      &amount,
+		})
+	}
+
+	var events []InvoiceEvent
+	err = r.db.Joins("JOIN invoices ON invoices.id = invoice_events.invoice_id").
+		Where("invoices.client_id = ?", companyID).
+		Order("invoice_events.created_at DESC").Limit(recentActivityLimit).
+		Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		activity = append(activity, CompanyActivity{
+			Date:        event.CreatedAt,
+			Type:        event.Type,
+			Description: event.Message,
+			InvoiceID:   event.InvoiceID,
+		})
+	}
+
+	var responses []SurveyResponse
+	err = r.db.Where("company_id = ?", companyID).
+		Order("created_at DESC").Limit(recentActivityLimit).
+		Find(&responses).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range responses {
+		activity = append(activity, CompanyActivity{
+			Date:        response.CreatedAt,
+			Type:        "survey_response",
+			Description: fmt.Sprintf("Survey answered with %d/10", response.Score),
+			InvoiceID:   response.InvoiceID,
+		})
+	}
+
+	sort.SliceStable(activity, func(i, j int) bool {
+		return activity[i].Date.After(activity[j].Date)
+	})
+	if len(activity) > recentActivityLimit {
+		activity = activity[:recentActivityLimit]
+	}
+	return activity, nil
+}
+
+func (o *CompanyOverview) Repr() string {
+	return strings.ReplaceAll(o.Company.Name, " ", "") + "_overview"
+}
+
+// FormatDaysToPay formats the average days to pay for the template
+func (o *CompanyOverview) FormatDaysToPay() string {
+	if o.AverageDaysToPay == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", *o.AverageDaysToPay)
+}
+
+// FormatAmount formats the amount for the template, empty when there is none
+func (a CompanyActivity) FormatAmount() string {
+	if a.Amount == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", *a.Amount)
+}
+
+func (h *Handler) getCompanyOverview(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	overview, err := h.storeFor(r).GetCompanyOverview(uint(companyId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	setCacheHeaders(w, "X-Read-Model-Cache", overview.Cache)
+	if r.URL.Query().Get("format") != "html" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(overview)
+		return
+	}
+
+	tmplPath := filepath.Join("templates", "companies", "overview.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := tmpl.Execute(w, struct{ Overview *CompanyOverview }{overview}); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
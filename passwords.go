@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// passwordResetTTL is how long an emailed reset link works
+	passwordResetTTL = time.Hour
+	// maxLockout caps the backoff of repeated failed logins
+	maxLockout        = 24 * time.Hour
+	minPasswordLength = 8
+)
+
+var (
+	ErrAccountLocked         = errors.New("account locked after too many failed logins")
+	ErrPasswordResetRequired = errors.New("password reset required")
+	ErrInvalidResetToken     = errors.New("invalid or expired password reset link")
+)
+
+// PasswordResetToken lets whoever received it choose a new password. Only
+// the hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	User      User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lockoutDuration is how long the account stays locked after the failed
+// logins in a row: login_lockout_minutes once login_lockout_attempts is
+// reached, doubling with every further failure
+func lockoutDuration(failures int) time.Duration {
+	if config.LoginLockoutAttempts == 0 || failures < config.LoginLockoutAttempts {
+		return 0
+	}
+	duration := time.Duration(config.LoginLockoutMinutes) * time.Minute
+	for i := config.LoginLockoutAttempts; i < failures && duration < maxLockout; i++ {
+		duration *= 2
+	}
+	return min(duration, maxLockout)
+}
+
+// Locked reports whether failed logins keep the user out at now
+func (u *User) Locked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// ResetEmail is where the password reset links of the user go, the username
+// when it's an address
+func (u *User) ResetEmail() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	if address, err := mail.ParseAddress(u.Username); err == nil && address.Address == u.Username {
+		return u.Username
+	}
+	return ""
+}
+
+// RecordLoginFailure counts a wrong password for the username, locking the
+// account when there were too many in a row. Unknown usernames are only
+// audited.
+func (r *Repository) RecordLoginFailure(username string, now time.Time) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var user User
+			err := tx.Where("username = ?", username).First(&user).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return recordAuditEvent(tx, nil, username, AuditLoginFailed, "Unknown user")
+			}
+			if err != nil {
+				return err
+			}
+
+			user.FailedLogins++
+			updates := map[string]interface{}{"failed_logins": user.FailedLogins}
+			lockout := lockoutDuration(user.FailedLogins)
+			if lockout > 0 {
+				updates["locked_until"] = now.Add(lockout)
+			}
+			if err := tx.Model(&user).UpdateColumns(updates).Error; err != nil {
+				return err
+			}
+
+			if err := recordAuditEvent(tx, &user, username, AuditLoginFailed, fmt.Sprintf("Failed login %d in a row", user.FailedLogins)); err != nil {
+				return err
+			}
+			if lockout == 0 {
+				return nil
+			}
+			return recordAuditEvent(tx, &user, username, AuditAccountLocked, "Locked until "+now.Add(lockout).Format(time.RFC3339))
+		})
+	})
+}
+
+// RecordLoginSuccess clears the failed logins of the user
+func (r *Repository) RecordLoginSuccess(userID uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Model(&User{}).Where("id = ? AND failed_logins > 0", userID).
+			UpdateColumns(map[string]interface{}{"failed_logins": 0, "locked_until": nil}).Error
+	})
+}
+
+// CreatePasswordResetToken returns a new reset token of the user, valid
+// until now plus passwordResetTTL
+func (r *Repository) CreatePasswordResetToken(userID uint, now time.Time) (string, error) {
+	token := randomToken()
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var user User
+			if err := tx.First(&user, userID).Error; err != nil {
+				return err
+			}
+			reset := &PasswordResetToken{UserID: userID, TokenHash: hashResetToken(token), ExpiresAt: now.Add(passwordResetTTL)}
+			if err := tx.Create(reset).Error; err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, &user, user.Username, AuditPasswordResetRequested, "")
+		})
+	})
+	return token, err
+}
+
+// ResetPassword sets the password of the user the token belongs to. The
+// token can't be used again, and the account is unlocked.
+func (r *Repository) ResetPassword(token, passwordHash string, now time.Time) (*User, error) {
+	var user User
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var reset PasswordResetToken
+			err := tx.Where("token_hash = ?", hashResetToken(token)).First(&reset).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			if err != nil {
+				return err
+			}
+			if reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+				return ErrInvalidResetToken
+			}
+
+			if err := tx.First(&user, reset.UserID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&user).UpdateColumns(map[string]interface{}{
+				"password_hash":       passwordHash,
+				"must_reset_password": false,
+				"failed_logins":       0,
+				"locked_until":        nil,
+			}).Error; err != nil {
+				return err
+			}
+			// Other links sent to the user stop working too
+			if err := tx.Model(&PasswordResetToken{}).Where("user_id = ? AND used_at IS NULL", user.ID).
+				UpdateColumn("used_at", now).Error; err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, &user, user.Username, AuditPasswordReset, "")
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ForcePasswordReset keeps the user from signing in with their password
+// until they choose a new one
+func (r *Repository) ForcePasswordReset(userID uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var user User
+			if err := tx.First(&user, userID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&user).UpdateColumn("must_reset_password", true).Error; err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, &user, user.Username, AuditPasswordResetForced, "")
+		})
+	})
+}
+
+// sendPasswordReset emails the user a link to choose a new password
+func sendPasswordReset(store Store, user *User, now time.Time) error {
+	address := user.ResetEmail()
+	if address == "" {
+		return fmt.Errorf("user %s has no email address", user.Username)
+	}
+
+	token, err := store.CreatePasswordResetToken(user.ID, now)
+	if err != nil {
+		return err
+	}
+	return sendEmail(store, &Email{
+		To:      []string{address},
+		Subject: "Reset your Tiny CRM password",
+		Body: fmt.Sprintf("Hello,\n\nFollow this link within the next hour to choose a new password for %s:\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+			user.Username, publicURL("/auth/password_reset?token="+token)),
+	})
+}
+
+type passwordResetPage struct {
+	Token     string
+	Message   string
+	MinLength int
+}
+
+func renderPasswordReset(w http.ResponseWriter, status int, page passwordResetPage) {
+	tmplPath := filepath.Join("templates", "users", "password_reset.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page.MinLength = minPasswordLength
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+	}
+}
+
+func (h *Handler) viewPasswordReset(w http.ResponseWriter, r *http.Request) {
+	renderPasswordReset(w, http.StatusOK, passwordResetPage{Token: r.URL.Query().Get("token")})
+}
+
+// submitPasswordReset either emails a reset link for the username, or sets
+// the new password of a link's token
+func (h *Handler) submitPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if token := r.FormValue("token"); token != "" {
+		password := r.FormValue("password")
+		if len(password) < minPasswordLength {
+			renderPasswordReset(w, http.StatusBadRequest, passwordResetPage{Token: token,
+				Message: fmt.Sprintf("The password needs at least %d characters.", minPasswordLength)})
+			return
+		}
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = h.storeFor(r).ResetPassword(token, passwordHash, time.Now())
+		switch {
+		case errors.Is(err, ErrInvalidResetToken):
+			renderPasswordReset(w, http.StatusBadRequest, passwordResetPage{Message: "This link is invalid or expired, ask for a new one."})
+		case err != nil:
+			writeDatabaseError(w, r, err)
+		default:
+			renderPasswordReset(w, http.StatusOK, passwordResetPage{Message: "Your password was changed, you can sign in with it now."})
+		}
+		return
+	}
+
+	// The answer is the same whether the user exists or not
+	if user, err := h.storeFor(r).GetUserByUsername(r.FormValue("username")); err == nil {
+		if err := sendPasswordReset(h.storeFor(r), user, time.Now()); err != nil {
+			log.Printf("Error sending password reset to user %d: %v", user.ID, err)
+		}
+	}
+	renderPasswordReset(w, http.StatusAccepted, passwordResetPage{Message: "If the account exists, a link to reset its password is on its way."})
+}
+
+// forcePasswordReset makes the user choose a new password, emailing them
+// the link to do it
+func (h *Handler) forcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	userIdStr := r.PathValue("userId")
+	userId, err := strconv.ParseUint(userIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if err := store.ForcePasswordReset(uint(userId)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	user, err := store.GetUser(uint(userId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	emailed := true
+	if err := sendPasswordReset(store, user, time.Now()); err != nil {
+		log.Printf("Error sending password reset to user %d: %v", user.ID, err)
+		emailed = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user": user, "emailed": emailed})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	pdfPageWidth    = 595 // A4 in points
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+	pdfFontSize     = 10
+	pdfLineHeight   = 14
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+	// The logo is scaled down to fit the top right corner of the first page
+	pdfLogoWidth  = 150
+	pdfLogoHeight = 60
+)
+
+// PDFAttachment is a file embedded in the generated PDF
+type PDFAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	// Relationship tells readers how the file relates to the document,
+	// e.g. "Alternative" for a machine readable copy. Defaults to "Data".
+	Relationship string
+}
+
+// PDFImage is a picture embedded as an image XObject. JPEGs are kept as
+// they are, other images are decoded and stored deflated, their
+// transparency as a soft mask.
+type PDFImage struct {
+	Width, Height int
+	colorSpace    string
+	filter        string
+	data          []byte
+	// alpha is the deflated soft mask, nil for opaque images
+	alpha []byte
+}
+
+// NewPDFImage reads a PNG, JPEG, GIF or WebP image
+func NewPDFImage(data []byte) (*PDFImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" && config.ColorModel != color.CMYKModel {
+		colorSpace := "DeviceRGB"
+		if config.ColorModel == color.GrayModel {
+			colorSpace = "DeviceGray"
+		}
+		return &PDFImage{Width: config.Width, Height: config.Height, colorSpace: colorSpace, filter: "DCTDecode", data: data}, nil
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := decoded.Bounds()
+	rgb := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	alpha := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	opaque := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			rgb = append(rgb, pixel.R, pixel.G, pixel.B)
+			alpha = append(alpha, pixel.A)
+			opaque = opaque && pixel.A == 0xff
+		}
+	}
+
+	img := &PDFImage{Width: bounds.Dx(), Height: bounds.Dy(), colorSpace: "DeviceRGB", filter: "FlateDecode", data: deflate(rgb)}
+	if !opaque {
+		img.alpha = deflate(alpha)
+	}
+	return img, nil
+}
+
+// size is the image in points, scaled down to fit width by height
+func (img *PDFImage) size(width, height int) (float64, float64) {
+	scale := min(1, float64(width)/float64(img.Width), float64(height)/float64(img.Height))
+	return float64(img.Width) * scale, float64(img.Height) * scale
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+// PDFDocument builds a minimal PDF. It only knows how to lay out lines of
+// Helvetica text under an optional logo, which is enough for invoices and
+// statements without pulling a PDF library into the build.
+type PDFDocument struct {
+	Title       string
+	lines       []string
+	Attachments []PDFAttachment
+	// Metadata is an optional XMP packet describing the document
+	Metadata []byte
+	// Logo is drawn in the top right corner of the first page
+	Logo *PDFImage
+}
+
+func NewPDFDocument(title string) *PDFDocument {
+	return &PDFDocument{Title: title}
+}
+
+// AddLine appends a formatted line of text, pages are split when rendering
+func (d *PDFDocument) AddLine(format string, args ...interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf(format, args...))
+}
+
+// AddBlank appends an empty line
+func (d *PDFDocument) AddBlank() {
+	d.lines = append(d.lines, "")
+}
+
+// Bytes renders the document
+func (d *PDFDocument) Bytes() []byte {
+	var pages [][]string
+	for start := 0; start < len(d.lines); start += pdfLinesPerPage {
+		end := min(start+pdfLinesPerPage, len(d.lines))
+		pages = append(pages, d.lines[start:end])
+	}
+	if len(pages) == 0 {
+		pages = append(pages, nil)
+	}
+
+	// Object layout: 1 catalog, 2 pages, 3 font, 4 info, then the logo and
+	// its soft mask, a page and content stream per page, then two objects
+	// per attachment and the metadata stream
+	var objects []string
+	objects = append(objects, "") // catalog, filled in below
+	objects = append(objects, "") // pages, filled in below
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	objects = append(objects, fmt.Sprintf("<< /Title %s /Producer (Tiny CRM) >>", pdfString(d.Title)))
+
+	logoObj := 0
+	if logo := d.Logo; logo != nil {
+		mask := ""
+		if logo.alpha != nil {
+			objects = append(objects, pdfStream(fmt.Sprintf(
+				"/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode",
+				logo.Width, logo.Height), logo.alpha))
+			mask = fmt.Sprintf(" /SMask %d 0 R", len(objects))
+		}
+		objects = append(objects, pdfStream(fmt.Sprintf(
+			"/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s%s",
+			logo.Width, logo.Height, logo.colorSpace, logo.filter, mask), logo.data))
+		logoObj = len(objects)
+	}
+
+	var kids []string
+	for index, lines := range pages {
+		pageObj := len(objects) + 1
+		contentObj := pageObj + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageObj))
+
+		resources := "/Font << /F1 3 0 R >>"
+		var content strings.Builder
+		if index == 0 && logoObj != 0 {
+			resources += fmt.Sprintf(" /XObject << /Im1 %d 0 R >>", logoObj)
+			// Its top lines up with the top of the first line of text
+			width, height := d.Logo.size(pdfLogoWidth, pdfLogoHeight)
+			fmt.Fprintf(&content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im1 Do Q\n",
+				width, height, pdfPageWidth-pdfMargin-width, pdfPageHeight-pdfMargin+pdfFontSize-height)
+		}
+		objects = append(objects, fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << %s >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, contentObj))
+
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range lines {
+			fmt.Fprintf(&content, "%s Tj T*\n", pdfString(line))
+		}
+		content.WriteString("ET")
+		objects = append(objects, pdfStream("", []byte(content.String())))
+	}
+
+	var fileNames, fileRefs []string
+	for _, attachment := range d.Attachments {
+		fileObj := len(objects) + 1
+		specObj := fileObj + 1
+		subtype := strings.ReplaceAll(attachment.ContentType, "/", "#2F")
+		relationship := attachment.Relationship
+		if relationship == "" {
+			relationship = "Data"
+		}
+		objects = append(objects, pdfStream(
+			fmt.Sprintf("/Type /EmbeddedFile /Subtype /%s /Params << /Size %d >>", subtype, len(attachment.Data)),
+			attachment.Data))
+		objects = append(objects, fmt.Sprintf(
+			"<< /Type /Filespec /F %s /UF %s /AFRelationship /%s /EF << /F %d 0 R /UF %d 0 R >> >>",
+			pdfString(attachment.Name), pdfString(attachment.Name), relationship, fileObj, fileObj))
+		fileRef := fmt.Sprintf("%d 0 R", specObj)
+		fileNames = append(fileNames, pdfString(attachment.Name)+" "+fileRef)
+		fileRefs = append(fileRefs, fileRef)
+	}
+
+	catalog := "<< /Type /Catalog /Pages 2 0 R"
+	if len(fileRefs) > 0 {
+		catalog += fmt.Sprintf(" /Names << /EmbeddedFiles << /Names [%s] >> >> /AF [%s]",
+			strings.Join(fileNames, " "), strings.Join(fileRefs, " "))
+	}
+	if d.Metadata != nil {
+		objects = append(objects, pdfStream("/Type /Metadata /Subtype /XML", d.Metadata))
+		catalog += fmt.Sprintf(" /Metadata %d 0 R", len(objects))
+	}
+	objects[0] = catalog + " >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.Bytes()
+}
+
+func pdfStream(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+// pdfString encodes text as a PDF literal string. Characters outside
+// Latin-1 are replaced since the standard fonts only cover WinAnsi.
+func pdfString(text string) string {
+	var buf strings.Builder
+	buf.WriteByte('(')
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(byte(r))
+		case r < 32:
+			buf.WriteByte(' ')
+		case r < 256:
+			buf.WriteByte(byte(r))
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// writeInvoicePDFs writes the PDFs of the invoices in a zip, each named by
+// its Repr and numbered from the second invoice sharing one
+func writeInvoicePDFs(w io.Writer, invoices []Invoice) error {
+	archive := zip.NewWriter(w)
+	named := map[string]int{}
+	for _, invoice := range invoices {
+		name := invoice.Repr()
+		named[name]++
+		if count := named[name]; count > 1 {
+			name = fmt.Sprintf("%s_%d", name, count)
+		}
+		file, err := archive.Create(name + ".pdf")
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(invoice.PDF().Bytes()); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// postInvoicePDFBatch answers a zip with the PDFs of the invoices matching
+// the filter, e.g. the month's invoices for the accountant
+func (h *Handler) postInvoicePDFBatch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Filter InvoiceFilter `json:"filter"`
+		All    bool          `json:"all"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !request.Filter.Type.Valid() {
+		http.Error(w, "Invalid document type", http.StatusBadRequest)
+		return
+	}
+	if request.Filter.empty() && !request.All {
+		http.Error(w, "A filter is required, set \"all\": true to download every invoice", http.StatusBadRequest)
+		return
+	}
+
+	invoices, err := h.storeFor(r).GetInvoices(request.Filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	if len(invoices) == 0 {
+		http.Error(w, "No invoices match the filter", http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("invoices_%s.zip", clock.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	// The PDFs are written as they are rendered, an error past the first
+	// one can only cut the zip short
+	if err := writeInvoicePDFs(w, invoices); err != nil {
+		log.Printf("Error writing the PDFs of %d invoices: %v", len(invoices), err)
+	}
+}
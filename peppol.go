@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	peppolInvoiceDocumentType    = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2::Invoice##" + ublCustomizationID + "::2.1"
+	peppolCreditNoteDocumentType = "urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2::CreditNote##" + ublCustomizationID + "::2.1"
+)
+
+// peppolIDPattern matches participant identifiers like "0106:12345678",
+// an ICD scheme code followed by the identifier in that scheme
+var peppolIDPattern = regexp.MustCompile(`^[0-9]{4}:[^\s]+$`)
+
+var ErrNoPeppolID = errors.New("the issuer and the client need a Peppol ID")
+
+// PeppolDocument is a UBL document addressed through the Peppol network
+type PeppolDocument struct {
+	SenderID       string
+	ReceiverID     string
+	DocumentTypeID string
+	ProcessID      string
+	Payload        []byte
+}
+
+// PeppolReceipt is the access point's acknowledgement of a transmission
+type PeppolReceipt struct {
+	MessageID string
+	// Evidence is the raw acknowledgement, kept as proof of delivery
+	Evidence []byte
+}
+
+// PeppolTransmitter hands documents to a Peppol access point provider
+type PeppolTransmitter interface {
+	Transmit(document *PeppolDocument) (*PeppolReceipt, error)
+}
+
+var peppolTransmitter PeppolTransmitter = newHTTPPeppolTransmitter(config.Peppol)
+
+// HTTPPeppolTransmitter posts the UBL document to an access point's REST
+// API, the shape most providers offer. Installations whose provider
+// differs can plug their own PeppolTransmitter.
+type HTTPPeppolTransmitter struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func newHTTPPeppolTransmitter(c PeppolConfig) *HTTPPeppolTransmitter {
+	return &HTTPPeppolTransmitter{
+		URL:    c.AccessPointURL,
+		APIKey: c.APIKey,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (t *HTTPPeppolTransmitter) Transmit(document *PeppolDocument) (*PeppolReceipt, error) {
+	if t.URL == "" {
+		return nil, fmt.Errorf("Peppol is not configured, set PEPPOL_ACCESS_POINT_URL")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(document.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Authorization", "Bearer "+t.APIKey)
+	req.Header.Set("X-Peppol-Sender", document.SenderID)
+	req.Header.Set("X-Peppol-Receiver", document.ReceiverID)
+	req.Header.Set("X-Peppol-Document-Type", document.DocumentTypeID)
+	req.Header.Set("X-Peppol-Process", document.ProcessID)
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	evidence, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("access point answered %d: %s", resp.StatusCode, strings.TrimSpace(string(evidence)))
+	}
+
+	receipt := &PeppolReceipt{MessageID: resp.Header.Get("X-Message-Id"), Evidence: evidence}
+	var body struct {
+		MessageID string `json:"message_id"`
+	}
+	if receipt.MessageID == "" && json.Unmarshal(evidence, &body) == nil {
+		receipt.MessageID = body.MessageID
+	}
+	return receipt, nil
+}
+
+// PeppolTransmission records an invoice sent through Peppol with the access
+// point's acknowledgement
+type PeppolTransmission struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	InvoiceID  uint      `gorm:"not null;index" json:"invoice_id"`
+	Invoice    Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	SenderID   string    `gorm:"size:100;not null" json:"sender_id"`
+	ReceiverID string    `gorm:"size:100;not null" json:"receiver_id"`
+	MessageID  string    `gorm:"size:255" json:"message_id"`
+	Evidence   string    `gorm:"type:text" json:"evidence"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (r *Repository) CreatePeppolTransmission(transmission *PeppolTransmission) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(transmission).Error
+	})
+}
+
+func (r *Repository) GetPeppolTransmissions(invoiceID uint) ([]PeppolTransmission, error) {
+	var transmissions []PeppolTransmission
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at").Find(&transmissions).Error
+	return transmissions, err
+}
+
+// validPeppolID reports whether id is empty or a participant identifier
+func validPeppolID(id string) bool {
+	return id == "" || peppolIDPattern.MatchString(id)
+}
+
+// sendPeppolInvoice transmits the invoice as UBL and records the evidence
+func sendPeppolInvoice(r Store, invoice *Invoice) (*PeppolTransmission, error) {
+	if invoice.Company.PeppolID == "" || invoice.Client.PeppolID == "" {
+		return nil, ErrNoPeppolID
+	}
+
+	prepaid, err := r.GetPaidAmount(invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := invoice.UBLXML(prepaid)
+	if err != nil {
+		return nil, err
+	}
+
+	documentType := peppolInvoiceDocumentType
+	if invoice.Type == DocumentCreditNote {
+		documentType = peppolCreditNoteDocumentType
+	}
+
+	receipt, err := peppolTransmitter.Transmit(&PeppolDocument{
+		SenderID:       invoice.Company.PeppolID,
+		ReceiverID:     invoice.Client.PeppolID,
+		DocumentTypeID: documentType,
+		ProcessID:      ublProfileID,
+		Payload:        payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transmission := &PeppolTransmission{
+		InvoiceID:  invoice.ID,
+		SenderID:   invoice.Company.PeppolID,
+		ReceiverID: invoice.Client.PeppolID,
+		MessageID:  receipt.MessageID,
+		Evidence:   string(receipt.Evidence),
+	}
+	if err := r.CreatePeppolTransmission(transmission); err != nil {
+		return nil, err
+	}
+	if err := r.RecordInvoiceEvent(invoice.ID, "peppol_sent", "Sent through Peppol to "+invoice.Client.PeppolID); err != nil {
+		return nil, err
+	}
+	return transmission, nil
+}
+
+func (h *Handler) postPeppolTransmission(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	transmission, err := sendPeppolInvoice(h.storeFor(r), invoice)
+	if err != nil {
+		if errors.Is(err, ErrNoPeppolID) || errors.Is(err, ErrEInvoiceDocumentType) || errors.Is(err, ErrEInvoiceCountry) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(transmission)
+}
+
+func (h *Handler) getPeppolTransmissions(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	transmissions, err := h.storeFor(r).GetPeppolTransmissions(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transmissions)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PortalInvoice is an invoice as its client sees it in the portal
+type PortalInvoice struct {
+	ID             uint         `json:"id"`
+	Type           DocumentType `json:"type"`
+	Identification string       `json:"identification"`
+	IssueDate      time.Time    `json:"issue_date"`
+	DueDate        time.Time    `json:"due_date"`
+	Total          Money        `json:"total"`
+	Status         string       `json:"status"`
+	// Link is the signed public view of the invoice, with the details to
+	// pay it
+	Link string `json:"link"`
+}
+
+// GetCompanyUsers lists the client users of the company
+func (r *Repository) GetCompanyUsers(companyID uint) ([]User, error) {
+	var users []User
+	err := r.db.Where("company_id = ?", companyID).Order("username").Find(&users).Error
+	return users, err
+}
+
+// DeleteCompanyUser removes a client user of the company
+func (r *Repository) DeleteCompanyUser(companyID, userID uint) error {
+	return retryOnBusy(func() error {
+		result := r.db.Where("id = ? AND company_id = ?", userID, companyID).Delete(&User{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// portalInvoices lists the invoices sent to the company, drafts left out
+func portalInvoices(store Store, companyID uint) ([]PortalInvoice, error) {
+	sent := true
+	summaries, err := store.GetInvoiceSummaries(InvoiceFilter{ClientID: &companyID, Sent: &sent})
+	if err != nil {
+		return nil, err
+	}
+
+	invoices := make([]PortalInvoice, 0, len(summaries))
+	for _, summary := range summaries {
+		invoice := Invoice{UUID: summary.UUID, Number: summary.Number, Code: summary.Code}
+		invoices = append(invoices, PortalInvoice{
+			ID:             summary.ID,
+			Type:           summary.Type,
+			Identification: invoice.Identification(),
+			IssueDate:      summary.IssueDate,
+			DueDate:        summary.DueDate,
+			Total:          summary.Total,
+			Status:         summary.Status,
+			Link:           publicURL(shareLinkPath(&invoice)),
+		})
+	}
+	return invoices, nil
+}
+
+// portalCompanyID is the company of the client user signed in
+func portalCompanyID(r *http.Request) uint {
+	user := r.Context().Value(userContextKey{}).(*User)
+	return *user.CompanyID
+}
+
+// portalMiddleware lets only client users through, even when testing as
+// the portal shows the company of the user signed in
+func (h *Handler) portalMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := h.signedInUser(w, r)
+		if !ok {
+			return
+		}
+		if user.CompanyID == nil {
+			http.Error(w, "The portal is for client users", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	}
+}
+
+type portalPage struct {
+	Company  *Company
+	Invoices []PortalInvoice
+}
+
+// viewPortal renders the page of the client user: their invoices and
+// statement
+func (h *Handler) viewPortal(w http.ResponseWriter, r *http.Request) {
+	store := h.storeFor(r)
+	company, err := store.GetCompany(portalCompanyID(r))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	invoices, err := portalInvoices(store, company.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	tmplPath := filepath.Join("templates", "portal", "index.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := tmpl.Execute(w, portalPage{Company: company, Invoices: invoices}); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) getPortalInvoices(w http.ResponseWriter, r *http.Request) {
+	invoices, err := portalInvoices(h.storeFor(r), portalCompanyID(r))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	writeRecords(w, r, "invoices", invoices)
+}
+
+// viewPortalInvoice renders an invoice sent to the company of the client
+// user, the others aren't found
+func (h *Handler) viewPortalInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceId, err := strconv.ParseUint(r.PathValue("invoiceId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil || invoice.ClientID != portalCompanyID(r) || invoice.Draft() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-store")
+	h.renderReadOnlyInvoice(w, r, invoice)
+}
+
+// getPortalStatement answers the statement of the company of the client
+// user, in the formats of the statement endpoint. Like the invoices of the
+// portal, it leaves the drafts out.
+func (h *Handler) getPortalStatement(w http.ResponseWriter, r *http.Request) {
+	r.SetPathValue("companyId", strconv.FormatUint(uint64(portalCompanyID(r)), 10))
+	h.getStatement(w, r)
+}
+
+// getCompanyUsers lists the client users signing in to the portal of the
+// company
+func (h *Handler) getCompanyUsers(w http.ResponseWriter, r *http.Request) {
+	companyId, err := strconv.ParseUint(r.PathValue("companyId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	users, err := h.storeFor(r).GetCompanyUsers(uint(companyId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// createCompanyUser gives the portal a client user of the company
+func (h *Handler) createCompanyUser(w http.ResponseWriter, r *http.Request) {
+	companyId, err := strconv.ParseUint(r.PathValue("companyId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.Username = strings.TrimSpace(request.Username)
+	if request.Username == "" {
+		http.Error(w, "A username is required", http.StatusBadRequest)
+		return
+	}
+	if len(request.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("The password needs at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if _, err := store.GetCompany(uint(companyId)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if existing, _ := store.GetUserByUsername(request.Username); existing != nil {
+		http.Error(w, fmt.Sprintf("User %q already exists", request.Username), http.StatusConflict)
+		return
+	}
+
+	passwordHash, err := hashPassword(request.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	companyID := uint(companyId)
+	user := &User{Username: request.Username, Email: request.Email, PasswordHash: passwordHash, CompanyID: &companyID}
+	if err := store.CreateUser(user); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (h *Handler) deleteCompanyUser(w http.ResponseWriter, r *http.Request) {
+	companyId, err := strconv.ParseUint(r.PathValue("companyId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+	userId, err := strconv.ParseUint(r.PathValue("userId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteCompanyUser(uint(companyId), uint(userId)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
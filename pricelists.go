@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PriceList is a set of product prices agreed with the clients it is
+// assigned to, replacing the product prices on their invoices
+type PriceList struct {
+	ID    uint            `gorm:"primaryKey" json:"id"`
+	Name  string          `gorm:"size:255;not null;uniqueIndex" json:"name"`
+	Items []PriceListItem `gorm:"constraint:OnDelete:CASCADE" json:"items"`
+}
+
+// PriceListItem is the price of a product from ValidFrom, until ValidUntil
+// included when set. When several items of a product are in effect the
+// latest one wins.
+type PriceListItem struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	PriceListID uint       `gorm:"not null;index" json:"price_list_id"`
+	ProductID   uint       `gorm:"not null;index" json:"product_id"`
+	Product     Product    `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Price       Money      `gorm:"type:decimal(10,2);not null" json:"price"`
+	ValidFrom   time.Time  `gorm:"not null" json:"valid_from"`
+	ValidUntil  *time.Time `json:"valid_until"`
+}
+
+// validatePriceList checks the fields the database doesn't constrain
+func validatePriceList(list *PriceList) error {
+	list.Name = strings.TrimSpace(list.Name)
+	if list.Name == "" {
+		return errors.New("Name is required")
+	}
+	for i := range list.Items {
+		item := &list.Items[i]
+		if item.ProductID == 0 || item.ValidFrom.IsZero() {
+			return errors.New("Price list items need a product_id and a valid_from date")
+		}
+		if item.Price < 0 {
+			return errors.New("Price can't be negative")
+		}
+		if item.ValidUntil != nil && item.ValidUntil.Before(item.ValidFrom) {
+			return errors.New("Valid until can't be before valid from")
+		}
+		item.ID, item.PriceListID = 0, list.ID
+	}
+	return nil
+}
+
+// clientListPrice looks the product up in the price list of the client,
+// for the given day. ok is false when the client has no price for it.
+func clientListPrice(tx *gorm.DB, clientID, productID uint, on time.Time) (price Money, ok bool, err error) {
+	day := time.Date(on.Year(), on.Month(), on.Day(), 0, 0, 0, 0, on.Location())
+	var prices []Money
+	err = tx.Model(&PriceListItem{}).
+		Joins("JOIN companies ON companies.price_list_id = price_list_items.price_list_id").
+		Where("companies.id = ? AND price_list_items.product_id = ?", clientID, productID).
+		Where("price_list_items.valid_from <= ?", on).
+		Where("price_list_items.valid_until IS NULL OR price_list_items.valid_until >= ?", day).
+		Order("price_list_items.valid_from DESC, price_list_items.id DESC").Limit(1).
+		Pluck("price_list_items.price", &prices).Error
+	if err != nil || len(prices) == 0 {
+		return 0, false, err
+	}
+	return prices[0], true, nil
+}
+
+// GetClientPrice returns what the product costs the client on the day: its
+// price list's price, or else the product price
+func (r *Repository) GetClientPrice(clientID, productID uint, on time.Time) (Money, error) {
+	if price, ok, err := clientListPrice(r.db, clientID, productID, on); ok || err != nil {
+		return price, err
+	}
+	product, err := r.GetProduct(productID)
+	if err != nil {
+		return 0, err
+	}
+	return product.Price, nil
+}
+
+func (r *Repository) GetPriceLists() ([]PriceList, error) {
+	var lists []PriceList
+	err := r.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("product_id, valid_from")
+	}).Order("name").Find(&lists).Error
+	return lists, err
+}
+
+func (r *Repository) GetPriceList(id uint) (*PriceList, error) {
+	var list PriceList
+	err := r.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("product_id, valid_from")
+	}).First(&list, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (r *Repository) CreatePriceList(list *PriceList) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(list).Error
+	})
+}
+
+// UpdatePriceList saves the price list, its items replaced by the given ones
+func (r *Repository) UpdatePriceList(list *PriceList) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.First(&PriceList{}, list.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("price_list_id = ?", list.ID).Delete(&PriceListItem{}).Error; err != nil {
+				return err
+			}
+			return tx.Save(list).Error
+		})
+	})
+}
+
+// DeletePriceList removes the price list, its clients are billed the
+// product prices again
+func (r *Repository) DeletePriceList(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Company{}).Where("price_list_id = ?", id).UpdateColumn("price_list_id", nil).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("price_list_id = ?", id).Delete(&PriceListItem{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&PriceList{}, id).Error
+		})
+	})
+}
+
+// Price list handlers
+func (h *Handler) getPriceLists(w http.ResponseWriter, r *http.Request) {
+	lists, err := h.storeFor(r).GetPriceLists()
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lists)
+}
+
+func (h *Handler) getPriceList(w http.ResponseWriter, r *http.Request) {
+	priceListIdStr := r.PathValue("priceListId")
+	priceListId, err := strconv.ParseUint(priceListIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid price list ID", http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.storeFor(r).GetPriceList(uint(priceListId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *Handler) createPriceList(w http.ResponseWriter, r *http.Request) {
+	var list PriceList
+	if err := decodeRequest(r, &list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list.ID = 0
+
+	if err := validatePriceList(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreatePriceList(&list); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	created, err := h.storeFor(r).GetPriceList(list.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *Handler) updatePriceList(w http.ResponseWriter, r *http.Request) {
+	priceListIdStr := r.PathValue("priceListId")
+	priceListId, err := strconv.ParseUint(priceListIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid price list ID", http.StatusBadRequest)
+		return
+	}
+
+	var list PriceList
+	if err := decodeRequest(r, &list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list.ID = uint(priceListId)
+	if err := validatePriceList(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UpdatePriceList(&list); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	updated, err := h.storeFor(r).GetPriceList(list.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *Handler) deletePriceList(w http.ResponseWriter, r *http.Request) {
+	priceListIdStr := r.PathValue("priceListId")
+	priceListId, err := strconv.ParseUint(priceListIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid price list ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeletePriceList(uint(priceListId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
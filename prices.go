@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProductPrice is a price a product had, from ValidFrom until the next one
+type ProductPrice struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ProductID uint      `gorm:"not null;index" json:"product_id"`
+	Product   Product   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Price     Money     `gorm:"type:decimal(10,2);not null" json:"price"`
+	ValidFrom time.Time `gorm:"not null" json:"valid_from"`
+}
+
+// recordProductPrice adds the product's current price to its history
+func recordProductPrice(tx *gorm.DB, product *Product) error {
+	return tx.Create(&ProductPrice{
+		ProductID: product.ID,
+		Price:     product.Price,
+		ValidFrom: clock.Now(),
+	}).Error
+}
+
+// captureUnitPrices sets the unit price of the product lines sent without
+// one: the price the product was already billed at on the invoice, or else
+// the client's price list price on the issue date, or else the current
+// product price
+func captureUnitPrices(tx *gorm.DB, invoice *Invoice, billed map[uint]Money) error {
+	for i := range invoice.InvoiceLines {
+		line := &invoice.InvoiceLines[i]
+		if line.UnitPrice != 0 || line.ProductID == nil {
+			continue
+		}
+		if price, ok := billed[*line.ProductID]; ok {
+			line.UnitPrice = price
+			continue
+		}
+		price, ok, err := clientListPrice(tx, invoice.ClientID, *line.ProductID, invoice.IssueDate)
+		if err != nil {
+			return err
+		}
+		if ok {
+			line.UnitPrice = price
+			continue
+		}
+
+		var prices []Money
+		if err := tx.Model(&Product{}).Where("id = ?", *line.ProductID).Pluck("price", &prices).Error; err != nil {
+			return err
+		}
+		if len(prices) == 1 {
+			line.UnitPrice = prices[0]
+		}
+	}
+	return nil
+}
+
+// GetProductPrices returns the price history of the product, newest first
+func (r *Repository) GetProductPrices(productID uint) ([]ProductPrice, error) {
+	if _, err := r.GetProduct(productID); err != nil {
+		return nil, err
+	}
+
+	var prices []ProductPrice
+	err := r.db.Where("product_id = ?", productID).Order("valid_from DESC, id DESC").Find(&prices).Error
+	return prices, err
+}
+
+func (h *Handler) getProductPrices(w http.ResponseWriter, r *http.Request) {
+	productIdStr := r.PathValue("productId")
+	productId, err := strconv.ParseUint(productIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	prices, err := h.storeFor(r).GetProductPrices(uint(productId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prices)
+}
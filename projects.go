@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Project groups the invoices of a client engagement under a budget. When
+// what is billed on it reaches the alert percentage of the budget, a
+// notification is sent and the project is flagged, so scope is discussed
+// before the budget is blown.
+type Project struct {
+	ID        uint    `gorm:"primaryKey" json:"id"`
+	CompanyID uint    `gorm:"not null;index" json:"company_id"`
+	Company   Company `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name      string  `gorm:"size:255;not null" json:"name"`
+	// Status is active by default, see ProjectStatus
+	Status ProjectStatus `gorm:"size:20;not null;default:active" json:"status"`
+	// Budget is the amount the client agreed to, 0 means no budget
+	Budget Money `gorm:"type:decimal(10,2);not null;default:0.00" json:"budget"`
+	// BudgetAlertPercent overrides the configured alert percentage when set
+	BudgetAlertPercent *int `json:"budget_alert_percent"`
+	// BudgetAlertedAt is when the alert was sent, it is cleared once the
+	// billing falls back under the alert percentage
+	BudgetAlertedAt *time.Time `json:"budget_alerted_at"`
+
+	// Billed sums the invoices minus the credit notes of the project, it is
+	// computed when the project is read
+	Billed Money `gorm:"->;-:migration" json:"billed"`
+}
+
+// ProjectStatus is where a project stands, only active projects take new
+// work but every project keeps its invoices and time
+type ProjectStatus string
+
+const (
+	ProjectActive    ProjectStatus = "active"
+	ProjectOnHold    ProjectStatus = "on_hold"
+	ProjectCompleted ProjectStatus = "completed"
+	ProjectCancelled ProjectStatus = "cancelled"
+)
+
+// Valid reports whether the status is known, empty meaning active
+func (s ProjectStatus) Valid() bool {
+	switch s {
+	case "", ProjectActive, ProjectOnHold, ProjectCompleted, ProjectCancelled:
+		return true
+	}
+	return false
+}
+
+// ProjectProfitability is a line of the project profitability report.
+// Billed is invoices minus credit notes issued in the period, Cost is the
+// time booked in the period at its hourly cost.
+type ProjectProfitability struct {
+	ProjectID uint          `json:"project_id"`
+	Project   string        `json:"project"`
+	CompanyID uint          `json:"company_id"`
+	Status    ProjectStatus `json:"status"`
+	Budget    Money         `json:"budget"`
+	Billed    Money         `json:"billed"`
+	Hours     float64       `json:"hours"`
+	Cost      Money         `json:"cost"`
+	Margin    Money         `json:"margin"`
+	// MarginPercent is the margin over what was billed, nil when nothing was
+	MarginPercent *float64 `json:"margin_percent"`
+}
+
+// AlertPercent is the share of the budget that triggers the alert
+func (p *Project) AlertPercent() int {
+	if p.BudgetAlertPercent != nil {
+		return *p.BudgetAlertPercent
+	}
+	return config.BudgetAlertPercent
+}
+
+// BudgetAlert reports whether the billing reached the alert percentage
+func (p *Project) BudgetAlert() bool {
+	return p.Budget > 0 && p.Billed >= p.Budget.Percent(float64(p.AlertPercent()))
+}
+
+// MarshalJSON adds the budget flag to the project fields
+func (p Project) MarshalJSON() ([]byte, error) {
+	type project Project
+	return json.Marshal(struct {
+		project
+		BudgetAlert bool `json:"budget_alert"`
+	}{project(p), p.BudgetAlert()})
+}
+
+// ProjectFilter narrows down project listings, zero values match everything
+type ProjectFilter struct {
+	CompanyID   *uint
+	Status      ProjectStatus
+	BudgetAlert bool
+}
+
+// validateProject checks the fields the database doesn't constrain
+func validateProject(project *Project) error {
+	project.Name = strings.TrimSpace(project.Name)
+	if project.Name == "" || project.CompanyID == 0 {
+		return errors.New("Name and company_id are required")
+	}
+	if project.Status == "" {
+		project.Status = ProjectActive
+	}
+	if !project.Status.Valid() {
+		return errors.New("Status must be active, on_hold, completed or cancelled")
+	}
+	if project.Budget < 0 {
+		return errors.New("Budget can't be negative")
+	}
+	if percent := project.BudgetAlertPercent; percent != nil && (*percent < 1 || *percent > 100) {
+		return errors.New("Budget alert percent must be between 1 and 100")
+	}
+	return nil
+}
+
+// projectsQuery selects the projects along with what was billed on them
+func (r *Repository) projectsQuery() *gorm.DB {
+	billed := r.db.Table("invoices").
+		Select("COALESCE(SUM(" + balanceSignSQL() + " * invoices.total), 0)").
+		Where("invoices.project_id = projects.id")
+	return r.db.Model(&Project{}).Select("projects.*, ROUND((?), 2) AS billed", billed)
+}
+
+func (r *Repository) GetProjects(filter ProjectFilter) ([]Project, error) {
+	query := r.projectsQuery()
+	if filter.CompanyID != nil {
+		query = query.Where("company_id = ?", *filter.CompanyID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+
+	var projects []Project
+	if err := query.Order("name, id").Find(&projects).Error; err != nil {
+		return nil, err
+	}
+	if !filter.BudgetAlert {
+		return projects, nil
+	}
+
+	flagged := []Project{}
+	for _, project := range projects {
+		if project.BudgetAlert() {
+			flagged = append(flagged, project)
+		}
+	}
+	return flagged, nil
+}
+
+func (r *Repository) GetProject(id uint) (*Project, error) {
+	var project Project
+	if err := r.projectsQuery().First(&project, id).Error; err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+func (r *Repository) CreateProject(project *Project) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(project).Error
+	})
+}
+
+func (r *Repository) UpdateProject(project *Project) error {
+	return retryOnBusy(func() error {
+		return r.db.Omit("BudgetAlertedAt").Save(project).Error
+	})
+}
+
+// DeleteProject removes the project with its tasks and time entries, its
+// invoices are kept without one
+func (r *Repository) DeleteProject(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Invoice{}).Where("project_id = ?", id).UpdateColumn("project_id", nil).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("project_id = ?", id).Delete(&TimeEntry{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("project_id = ?", id).Delete(&Task{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&Project{}, id).Error
+		})
+	})
+}
+
+// SetProjectBudgetAlerted records when the budget alert was sent, nil
+// re-arms it
+func (r *Repository) SetProjectBudgetAlerted(id uint, at *time.Time) error {
+	return retryOnBusy(func() error {
+		return r.db.Model(&Project{}).Where("id = ?", id).UpdateColumn("budget_alerted_at", at).Error
+	})
+}
+
+// GetProjectProfitability weighs what was billed on each project against
+// the cost of the time booked on it, most profitable first. from and to are
+// inclusive and optional.
+func (r *Repository) GetProjectProfitability(from, to *time.Time) ([]ProjectProfitability, error) {
+	var projects []Project
+	if err := r.db.Order("name, id").Find(&projects).Error; err != nil {
+		return nil, err
+	}
+
+	inPeriod := func(query *gorm.DB, column string) *gorm.DB {
+		if from != nil {
+			query = query.Where(column+" >= ?", *from)
+		}
+		if to != nil {
+			query = query.Where(column+" < ?", to.AddDate(0, 0, 1))
+		}
+		return query
+	}
+
+	var billed []struct {
+		ProjectID uint
+		Billed    Money
+	}
+	err := inPeriod(r.db.Table("invoices").
+		Select("project_id, COALESCE(SUM("+balanceSignSQL()+" * invoices.total), 0) AS billed").
+		Where("project_id IS NOT NULL"), "issue_date").
+		Group("project_id").Scan(&billed).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var booked []struct {
+		ProjectID uint
+		Hours     float64
+		Cost      Money
+	}
+	err = inPeriod(r.db.Model(&TimeEntry{}).
+		Select("project_id, SUM(hours) AS hours, SUM(hours * hourly_cost) AS cost"), "date").
+		Group("project_id").Scan(&booked).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lines := map[uint]*ProjectProfitability{}
+	report := make([]ProjectProfitability, len(projects))
+	for i, project := range projects {
+		report[i] = ProjectProfitability{
+			ProjectID: project.ID,
+			Project:   project.Name,
+			CompanyID: project.CompanyID,
+			Status:    project.Status,
+			Budget:    project.Budget,
+		}
+		lines[project.ID] = &report[i]
+	}
+	for _, row := range billed {
+		if line := lines[row.ProjectID]; line != nil {
+			line.Billed = row.Billed
+		}
+	}
+	for _, row := range booked {
+		if line := lines[row.ProjectID]; line != nil {
+			line.Hours = math.Round(row.Hours*100) / 100
+			line.Cost = row.Cost
+		}
+	}
+	for i := range report {
+		line := &report[i]
+		line.Margin = line.Billed - line.Cost
+		if line.Billed != 0 {
+			percent := math.Round(float64(line.Margin)/float64(line.Billed)*10000) / 100
+			line.MarginPercent = &percent
+		}
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Margin > report[j].Margin
+	})
+	return report, nil
+}
+
+// checkProjectBudget notifies once when the billing of the project reaches
+// its alert percentage, and re-arms the alert when it falls back under it
+func checkProjectBudget(r Store, projectID *uint, now time.Time) error {
+	if projectID == nil {
+		return nil
+	}
+	project, err := r.GetProject(*projectID)
+	if err != nil {
+		return err
+	}
+
+	alert := project.BudgetAlert()
+	switch {
+	case alert && project.BudgetAlertedAt == nil:
+		if config.NotifyEmail != "" && !currentSettings().PauseNotifications {
+			email := &Email{
+				To:      []string{config.NotifyEmail},
+				Subject: fmt.Sprintf("Budget alert - project %s", project.Name),
+				Body: fmt.Sprintf("Hello,\n\nProject %s has billed %.2f of its %.2f budget (%.0f%%), past the %d%% alert.\n",
+					project.Name, project.Billed, project.Budget, project.Billed.Float()/project.Budget.Float()*100, project.AlertPercent()),
+			}
+			if err := sendEmail(r, email); err != nil {
+				log.Printf("Error sending budget alert for project %d: %v", project.ID, err)
+				return nil
+			}
+		}
+		return r.SetProjectBudgetAlerted(project.ID, &now)
+	case !alert && project.BudgetAlertedAt != nil:
+		return r.SetProjectBudgetAlerted(project.ID, nil)
+	}
+	return nil
+}
+
+// Project handlers
+func (h *Handler) getProjects(w http.ResponseWriter, r *http.Request) {
+	var filter ProjectFilter
+	var err error
+	if filter.CompanyID, err = parseOptionalUint(r, "company_id"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Status = ProjectStatus(r.URL.Query().Get("status"))
+	if !filter.Status.Valid() {
+		http.Error(w, "Invalid project status", http.StatusBadRequest)
+		return
+	}
+	alert, err := parseOptionalBool(r, "budget_alert")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.BudgetAlert = alert != nil && *alert
+
+	projects, err := h.storeFor(r).GetProjects(filter)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func (h *Handler) getProject(w http.ResponseWriter, r *http.Request) {
+	projectIdStr := r.PathValue("projectId")
+	projectId, err := strconv.ParseUint(projectIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := h.storeFor(r).GetProject(uint(projectId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+func (h *Handler) createProject(w http.ResponseWriter, r *http.Request) {
+	var project Project
+	if err := decodeRequest(r, &project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	project.ID, project.BudgetAlertedAt = 0, nil
+
+	if err := validateProject(&project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateProject(&project); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	created, err := h.storeFor(r).GetProject(project.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *Handler) updateProject(w http.ResponseWriter, r *http.Request) {
+	projectIdStr := r.PathValue("projectId")
+	projectId, err := strconv.ParseUint(projectIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var project Project
+	if err := decodeRequest(r, &project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateProject(&project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project.ID = uint(projectId)
+	if err := h.storeFor(r).UpdateProject(&project); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	// A new budget or percentage may cross the alert either way
+	if err := checkProjectBudget(h.storeFor(r), &project.ID, clock.Now()); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	updated, err := h.storeFor(r).GetProject(project.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *Handler) deleteProject(w http.ResponseWriter, r *http.Request) {
+	projectIdStr := r.PathValue("projectId")
+	projectId, err := strconv.ParseUint(projectIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteProject(uint(projectId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getProjectProfitability(w http.ResponseWriter, r *http.Request) {
+	from, err := parseDateQuery(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateQuery(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.storeFor(r).GetProjectProfitability(from, to)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
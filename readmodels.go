@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// dataVersion counts the writes to the database, whatever made them:
+// requests, jobs, commands or the bank polling. Read models and reports
+// computed at an older version are stale.
+var dataVersion atomic.Uint64
+
+// dataWritten marks the cached read models and reports stale, those of
+// the other instances too when Redis is shared with them
+func dataWritten() {
+	dataVersion.Add(1)
+	if redisClient == nil {
+		return
+	}
+	if err := redisClient.Incr(context.Background(), redisClient.key("data_version")).Err(); err != nil {
+		log.Printf("Error announcing a write: %v", err)
+	}
+}
+
+// dataMark is the version of the data a read model or report was computed
+// at: the writes of this instance and, with Redis, those of every instance
+type dataMark struct {
+	local  uint64
+	shared int64
+}
+
+// currentDataMark returns the version of the data now, false when Redis
+// can't tell it: nothing is cached then
+func currentDataMark() (dataMark, bool) {
+	mark := dataMark{local: dataVersion.Load()}
+	if redisClient == nil {
+		return mark, true
+	}
+	// Before the first write the version is missing, 0
+	shared, err := redisClient.Get(context.Background(), redisClient.key("data_version")).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("Error reading the data version: %v", err)
+		return mark, false
+	}
+	mark.shared = shared
+	return mark, true
+}
+
+// trackWrites bumps the data version after every statement changing rows.
+// Writes in a transaction bump it again once retryOnBusy sees it
+// committed, so a read model computed before the commit isn't kept.
+func trackWrites(db *gorm.DB) error {
+	track := func(tx *gorm.DB) {
+		if tx.Error == nil && tx.RowsAffected > 0 {
+			dataWritten()
+		}
+	}
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("tinycrm:track_writes", track); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("tinycrm:track_writes", track); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("gorm:delete").Register("tinycrm:track_writes", track); err != nil {
+		return err
+	}
+	return callbacks.Raw().After("gorm:raw").Register("tinycrm:track_writes", track)
+}
+
+// ReadModelStatus tells where a read model came from, for the cache
+// headers of its endpoint
+type ReadModelStatus struct {
+	Hit        bool
+	ComputedAt time.Time
+}
+
+// setCacheHeaders tells the client whether the answer came from the cache
+// and how old it is. Clients revalidate every time, the ETag spares the
+// body while nothing changed.
+func setCacheHeaders(w http.ResponseWriter, name string, status ReadModelStatus) {
+	result := "miss"
+	if status.Hit {
+		result = "hit"
+	}
+	w.Header().Set(name, result)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(status.ComputedAt).Seconds())))
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+type readModelEntry struct {
+	value      interface{}
+	mark       dataMark
+	computedAt time.Time
+}
+
+// readModels caches the expensive aggregates, such as the dashboard
+// figures and the client balances, until the next write or for
+// REPORTS_READ_MODEL_TTL seconds
+var readModels = struct {
+	mu      sync.Mutex
+	entries map[string]readModelEntry
+}{entries: map[string]readModelEntry{}}
+
+// inTransaction reports whether the repository is bound to a transaction,
+// whose uncommitted writes a cached read model mustn't see
+func (r *Repository) inTransaction() bool {
+	_, ok := r.db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok
+}
+
+// cachedReadModel returns the read model cached under key while no write
+// happened since it was computed, else computes and caches it. The value is
+// shared between callers, who must not change it.
+func cachedReadModel[T any](r *Repository, key string, compute func() (T, error)) (T, ReadModelStatus, error) {
+	ttl := time.Duration(config.Reports.ReadModelTTL) * time.Second
+	mark, known := currentDataMark()
+	if ttl <= 0 || !known || r.inTransaction() {
+		value, err := compute()
+		return value, ReadModelStatus{ComputedAt: time.Now()}, err
+	}
+
+	readModels.mu.Lock()
+	entry, ok := readModels.entries[key]
+	readModels.mu.Unlock()
+	if ok && entry.mark == mark && time.Since(entry.computedAt) < ttl {
+		return entry.value.(T), ReadModelStatus{Hit: true, ComputedAt: entry.computedAt}, nil
+	}
+
+	computedAt := time.Now()
+	value, err := compute()
+	if err != nil {
+		return value, ReadModelStatus{}, err
+	}
+	// A write while computing may not be in the value
+	now, known := currentDataMark()
+	readModels.mu.Lock()
+	defer readModels.mu.Unlock()
+	if known && now == mark {
+		readModels.entries[key] = readModelEntry{value: value, mark: mark, computedAt: computedAt}
+	} else {
+		delete(readModels.entries, key)
+	}
+	return value, ReadModelStatus{ComputedAt: computedAt}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisClient shares the sessions, the failed login counters and the job
+// queue between the instances behind a load balancer, nil without
+// REDIS_URL: each instance keeps its own in memory and the database
+var redisClient *RedisClient
+
+// validate checks the Redis URL, redis:// or rediss:// over TLS
+func (c RedisConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	if _, err := redis.ParseURL(c.URL); err != nil {
+		return fmt.Errorf("invalid Redis URL %q, expected redis://[:password@]host:port[/db]: %w", c.URL, err)
+	}
+	return nil
+}
+
+// RedisClient is a go-redis client pooling its connections, keeping the
+// keys of the app under the prefix
+type RedisClient struct {
+	*redis.Client
+	// prefix starts every key, see key
+	prefix string
+}
+
+func newRedisClient(c RedisConfig) *RedisClient {
+	if c.URL == "" {
+		return nil
+	}
+	// validate checked the URL
+	options, _ := redis.ParseURL(c.URL)
+	options.DialTimeout = 5 * time.Second
+	options.PoolSize = 10
+	return &RedisClient{Client: redis.NewClient(options), prefix: c.Prefix}
+}
+
+// key names a key of the app, e.g. key("session", token)
+func (c *RedisClient) key(parts ...string) string {
+	return c.prefix + strings.Join(parts, ":")
+}
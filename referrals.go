@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReferralSource is how a client found us, e.g. "Referral", "Google" or
+// "Conference". The list is managed by the users.
+type ReferralSource struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"size:100;not null;uniqueIndex" json:"name"`
+}
+
+// SourceRevenue is a line of the revenue by acquisition source report.
+// Billed is invoices minus credit notes issued in the period, Received is
+// the payments received in the period.
+type SourceRevenue struct {
+	SourceID *uint  `json:"source_id"`
+	Source   string `json:"source"`
+	Clients  int    `json:"clients"`
+	Billed   Money  `json:"billed"`
+	Received Money  `json:"received"`
+}
+
+const unknownReferralSource = "Unknown"
+
+func (r *Repository) GetReferralSources() ([]ReferralSource, error) {
+	var sources []ReferralSource
+	err := r.db.Order("name").Find(&sources).Error
+	return sources, err
+}
+
+func (r *Repository) CreateReferralSource(source *ReferralSource) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(source).Error
+	})
+}
+
+// DeleteReferralSource removes the source, its clients become unattributed
+func (r *Repository) DeleteReferralSource(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Company{}).Where("referral_source_id = ?", id).Update("referral_source_id", nil).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&ReferralSource{}, id).Error
+		})
+	})
+}
+
+// GetRevenueBySource groups what was billed to and received from clients by
+// their referral source, best paying sources first. from and to are
+// inclusive and optional.
+func (r *Repository) GetRevenueBySource(from, to *time.Time) ([]SourceRevenue, error) {
+	var companies []Company
+	if err := r.db.Preload("ReferralSource").Find(&companies).Error; err != nil {
+		return nil, err
+	}
+	sourceOf := map[uint]*ReferralSource{}
+	for _, company := range companies {
+		sourceOf[company.ID] = company.ReferralSource
+	}
+
+	inPeriod := func(date time.Time) bool {
+		return (from == nil || !date.Before(*from)) && (to == nil || date.Before(to.AddDate(0, 0, 1)))
+	}
+
+	report := map[string]*SourceRevenue{}
+	clients := map[string]map[uint]bool{}
+	lineFor := func(clientID uint) *SourceRevenue {
+		name := unknownReferralSource
+		var sourceID *uint
+		if source := sourceOf[clientID]; source != nil {
+			name = source.Name
+			sourceID = &source.ID
+		}
+
+		if report[name] == nil {
+			report[name] = &SourceRevenue{SourceID: sourceID, Source: name}
+			clients[name] = map[uint]bool{}
+		}
+		if !clients[name][clientID] {
+			clients[name][clientID] = true
+			report[name].Clients++
+		}
+		return report[name]
+	}
+
+	invoices, err := r.GetInvoiceSummaries(InvoiceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		behavior := invoice.Type.Behavior()
+		if behavior.BalanceSign == 0 || !inPeriod(invoice.IssueDate) {
+			continue
+		}
+		lineFor(invoice.ClientID).Billed += Money(behavior.BalanceSign) * invoice.Total
+	}
+
+	var payments []struct {
+		ClientID uint
+		Amount   Money
+		Date     time.Time
+	}
+	err = r.db.Model(&Payment{}).
+		Select("invoices.client_id, payments.amount, payments.date").
+		Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Scan(&payments).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		if inPeriod(payment.Date) {
+			lineFor(payment.ClientID).Received += payment.Amount
+		}
+	}
+
+	lines := []SourceRevenue{}
+	for _, line := range report {
+		lines = append(lines, *line)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Received != lines[j].Received {
+			return lines[i].Received > lines[j].Received
+		}
+		return lines[i].Source < lines[j].Source
+	})
+	return lines, nil
+}
+
+func (h *Handler) getReferralSources(w http.ResponseWriter, r *http.Request) {
+	sources, err := h.storeFor(r).GetReferralSources()
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sources)
+}
+
+func (h *Handler) createReferralSource(w http.ResponseWriter, r *http.Request) {
+	var source ReferralSource
+	if err := decodeRequest(r, &source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source.Name = strings.TrimSpace(source.Name)
+	if source.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateReferralSource(&source); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(source)
+}
+
+func (h *Handler) deleteReferralSource(w http.ResponseWriter, r *http.Request) {
+	sourceIdStr := r.PathValue("sourceId")
+	sourceId, err := strconv.ParseUint(sourceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid referral source ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteReferralSource(uint(sourceId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRevenueBySource(w http.ResponseWriter, r *http.Request) {
+	from, err := parseDateQuery(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateQuery(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.storeFor(r).GetRevenueBySource(from, to)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReminderDays is the dunning schedule, in days relative to the due
+// date, used by invoices without their own schedule
+var defaultReminderDays = ReminderDays{-3, 1, 7, 15}
+
+// ReminderDays is a reminder schedule in days relative to the due date.
+// nil means the default schedule and an empty schedule disables reminders.
+type ReminderDays []int
+
+func (d ReminderDays) Value() (driver.Value, error) {
+	if d == nil {
+		return nil, nil
+	}
+
+	days := make([]string, len(d))
+	for i, day := range d {
+		days[i] = strconv.Itoa(day)
+	}
+	return strings.Join(days, ","), nil
+}
+
+func (d *ReminderDays) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ReminderDays", value)
+	}
+
+	days := ReminderDays{}
+	for _, part := range strings.Split(text, ",") {
+		if part == "" {
+			continue
+		}
+		day, err := strconv.Atoi(part)
+		if err != nil {
+			return err
+		}
+		days = append(days, day)
+	}
+	*d = days
+	return nil
+}
+
+// ReminderSchedule returns the schedule in effect for the invoice
+func (i *Invoice) ReminderSchedule() ReminderDays {
+	if i.ReminderDays != nil {
+		return i.ReminderDays
+	}
+	return defaultReminderDays
+}
+
+// ReminderDue returns the date of the schedule step a reminder should be sent
+// for at now, or false when the invoice needs no reminder
+func (i *Invoice) ReminderDue(now time.Time) (time.Time, bool) {
+	if i.Paid || i.CancelledAt != nil || !i.Type.Behavior().Payable {
+		return time.Time{}, false
+	}
+	if i.RemindersSnoozedUntil != nil && now.Before(*i.RemindersSnoozedUntil) {
+		return time.Time{}, false
+	}
+	// Disputed invoices wait for the dispute to be resolved
+	if i.DisputedAt != nil {
+		return time.Time{}, false
+	}
+
+	var step time.Time
+	for _, day := range i.ReminderSchedule() {
+		date := i.DueDate.In(now.Location()).AddDate(0, 0, day)
+		if !date.After(now) && date.After(step) {
+			step = date
+		}
+	}
+	if step.IsZero() {
+		return time.Time{}, false
+	}
+
+	if i.LastReminderAt != nil && !i.LastReminderAt.Before(step) {
+		return time.Time{}, false
+	}
+	return step, true
+}
+
+// GetOpenInvoices returns the unpaid invoices of payable document types,
+// cancelled ones left out
+func (r *Repository) GetOpenInvoices() ([]Invoice, error) {
+	var invoices []Invoice
+	err := r.db.Preload("InvoiceLines", orderInvoiceLines).Preload("InvoiceLines.Product").Preload("Company").Preload("Client").
+		Where("paid = ? AND cancelled_at IS NULL AND type = ?", false, DocumentInvoice).
+		Order("due_date").
+		Find(&invoices).Error
+	return invoices, err
+}
+
+// GetInvoicesDueForReminder returns the invoices a reminder should be sent for at now
+func (r *Repository) GetInvoicesDueForReminder(now time.Time) ([]Invoice, error) {
+	invoices, err := r.GetOpenInvoices()
+	if err != nil {
+		return nil, err
+	}
+
+	due := []Invoice{}
+	for _, invoice := range invoices {
+		if _, ok := invoice.ReminderDue(now); ok {
+			due = append(due, invoice)
+		}
+	}
+	return due, nil
+}
+
+func (r *Repository) MarkReminderSent(invoiceID uint, at time.Time) error {
+	return retryOnBusy(func() error {
+		return r.db.Model(&Invoice{}).Where("id = ?", invoiceID).Update("last_reminder_at", at).Error
+	})
+}
+
+// SnoozeReminders pauses reminders of the invoice until the given date
+func (r *Repository) SnoozeReminders(invoiceID uint, until *time.Time) error {
+	return retryOnBusy(func() error {
+		result := r.db.Model(&Invoice{}).Where("id = ?", invoiceID).Update("reminders_snoozed_until", until)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return fmt.Errorf("invoice %d not found", invoiceID)
+		}
+		return result.Error
+	})
+}
+
+// SetReminderDays overrides the reminder schedule of the invoice, nil restores the default
+func (r *Repository) SetReminderDays(invoiceID uint, days ReminderDays) error {
+	return retryOnBusy(func() error {
+		result := r.db.Model(&Invoice{}).Where("id = ?", invoiceID).Update("reminder_days", days)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return fmt.Errorf("invoice %d not found", invoiceID)
+		}
+		return result.Error
+	})
+}
+
+// ReminderResult reports what happened to a single reminder
+type ReminderResult struct {
+	InvoiceID uint   `json:"invoice_id"`
+	Sent      bool   `json:"sent"`
+	Error     string `json:"error,omitempty"`
+}
+
+// sendReminders emails the client of every invoice due for a reminder and
+// records it on the invoice timeline
+func sendReminders(r Store, now time.Time) ([]ReminderResult, error) {
+	invoices, err := r.GetInvoicesDueForReminder(now)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReminderResult{}
+	for _, invoice := range invoices {
+		result := ReminderResult{InvoiceID: invoice.ID}
+		byWhatsApp := whatsApp != nil && invoice.Client.WhatsAppOptIn && invoice.Client.Phone != ""
+		if invoice.Client.Email == "" && !byWhatsApp {
+			result.Error = "client has no email address"
+			results = append(results, result)
+			continue
+		}
+
+		body := fmt.Sprintf("Hello,\n\nThis is a reminder that invoice %s of %s is due on %s.\n",
+			invoice.Identification(), invoice.FormatMoney(invoice.Total()), invoice.FormatDate(invoice.DueDate))
+		charges, err := lateChargesOf(r, &invoice, now)
+		if err != nil {
+			return nil, err
+		}
+		if charges != nil {
+			body += "\n" + charges.Describe(&invoice) + "\n"
+		}
+
+		// The reminder goes by email and over WhatsApp when the client opted
+		// in, it was sent if any of them went out
+		sentTo, failures := []string{}, []string{}
+		if invoice.Client.Email != "" {
+			email := &Email{
+				To:      []string{invoice.Client.Email},
+				Subject: fmt.Sprintf("Payment reminder - invoice %s", invoice.Identification()),
+				Body:    body,
+			}
+			if err := sendClientEmail(r, &invoice.Client, &invoice.ID, email); err != nil {
+				log.Printf("Error sending reminder for invoice %d: %v", invoice.ID, err)
+				failures = append(failures, err.Error())
+			} else {
+				sentTo = append(sentTo, invoice.Client.Email)
+			}
+		}
+		if byWhatsApp {
+			message := strings.TrimSpace(body) + "\n\n" + publicURL(shareLinkPath(&invoice))
+			if _, err := sendWhatsApp(r, &invoice.Client, &invoice, WhatsAppReminder, message); err != nil {
+				log.Printf("Error sending reminder for invoice %d over WhatsApp: %v", invoice.ID, err)
+				failures = append(failures, "WhatsApp: "+err.Error())
+			} else {
+				sentTo = append(sentTo, invoice.Client.Phone+" over WhatsApp")
+			}
+		}
+		if len(sentTo) == 0 {
+			result.Error = strings.Join(failures, "; ")
+			results = append(results, result)
+			continue
+		}
+
+		if err := r.MarkReminderSent(invoice.ID, now); err != nil {
+			return nil, err
+		}
+		if err := r.RecordInvoiceEvent(invoice.ID, "reminder_sent", "Reminder sent to "+strings.Join(sentTo, " and ")); err != nil {
+			return nil, err
+		}
+
+		result.Sent = true
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Reminder handlers
+func (h *Handler) getDueReminders(w http.ResponseWriter, r *http.Request) {
+	invoices, err := h.storeFor(r).GetInvoicesDueForReminder(clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+func (h *Handler) postSendReminders(w http.ResponseWriter, r *http.Request) {
+	results, err := sendReminders(h.storeFor(r), clock.Now())
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (h *Handler) snoozeReminders(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Until string `json:"until"`
+		Note  string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	until, err := parseDate(request.Until)
+	if err != nil {
+		http.Error(w, "Invalid until date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SnoozeReminders(uint(invoiceId), &until); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	message := "Reminders snoozed until " + request.Until
+	if request.Note != "" {
+		message += ": " + request.Note
+	}
+	if err := h.storeFor(r).RecordInvoiceEvent(uint(invoiceId), "reminders_snoozed", message); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) unsnoozeReminders(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SnoozeReminders(uint(invoiceId), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := h.storeFor(r).RecordInvoiceEvent(uint(invoiceId), "reminders_resumed", "Reminders resumed"); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) updateReminderSchedule(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Days ReminderDays `json:"days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).SetReminderDays(uint(invoiceId), request.Days); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	message := "Reminder schedule reset to the default"
+	if request.Days != nil {
+		value, _ := request.Days.Value()
+		message = fmt.Sprintf("Reminder schedule set to days %v relative to the due date", value)
+		if len(request.Days) == 0 {
+			message = "Reminders disabled"
+		}
+	}
+	if err := h.storeFor(r).RecordInvoiceEvent(uint(invoiceId), "reminder_schedule_changed", message); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
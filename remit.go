@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+var ErrRemitLinesMismatch = errors.New("the order must list every line of the remit information once")
+
+// RemitFilter narrows the remit information listed
+type RemitFilter struct {
+	// Template lists only the templates, or only the rest
+	Template *bool `json:"template"`
+}
+
+func (f RemitFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.Template != nil {
+		query = query.Where("is_template = ?", *f.Template)
+	}
+	return query
+}
+
+// orderRemitLines preloads the lines of remit information in their order
+func orderRemitLines(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// positionRemitLines numbers the lines 1, 2, 3... in the order of their
+// positions when they all have one, else in the order they are listed in
+func positionRemitLines(lines []RemitInformationLine) {
+	positioned := true
+	for _, line := range lines {
+		positioned = positioned && line.Position > 0
+	}
+	if positioned {
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Position < lines[j].Position })
+	}
+	for index := range lines {
+		lines[index].Position = index + 1
+	}
+}
+
+// ReorderRemitLines puts the lines of the remit information in the order of
+// lineIDs, which lists each of them once
+func (r *Repository) ReorderRemitLines(remitID uint, lineIDs []uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var existing []uint
+			if err := tx.Model(&RemitInformationLine{}).Where("remit_information_id = ?", remitID).Pluck("id", &existing).Error; err != nil {
+				return err
+			}
+			known := map[uint]bool{}
+			for _, id := range existing {
+				known[id] = true
+			}
+			if len(lineIDs) != len(existing) {
+				return ErrRemitLinesMismatch
+			}
+			for _, id := range lineIDs {
+				if !known[id] {
+					return ErrRemitLinesMismatch
+				}
+				delete(known, id)
+			}
+
+			for index, id := range lineIDs {
+				if err := tx.Model(&RemitInformationLine{}).Where("id = ?", id).Update("position", index+1).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// CloneRemitInformation copies the remit information and its lines, in
+// order, under the name given, as a template or not
+func (r *Repository) CloneRemitInformation(id uint, name string, template bool) (*RemitInformation, error) {
+	source, err := r.GetRemitInformation(id)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := &RemitInformation{Name: name, IsTemplate: template}
+	if clone.Name == "" {
+		clone.Name = source.Name
+	}
+	for _, line := range source.Lines {
+		clone.Lines = append(clone.Lines, RemitInformationLine{Key: line.Key, Value: line.Value, Position: line.Position})
+	}
+	if err := r.CreateRemitInformation(clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// remitFromRequest reads the remit information of the path
+func (h *Handler) remitFromRequest(w http.ResponseWriter, r *http.Request) (*RemitInformation, bool) {
+	remitId, err := strconv.ParseUint(r.PathValue("remitId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid remit ID", http.StatusBadRequest)
+		return nil, false
+	}
+	remit, err := h.storeFor(r).GetRemitInformation(uint(remitId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return remit, true
+}
+
+// writeReorderedRemit answers with the remit information in its new order
+func (h *Handler) writeReorderedRemit(w http.ResponseWriter, r *http.Request, remitID uint, lineIDs []uint) {
+	store := h.storeFor(r)
+	if err := store.ReorderRemitLines(remitID, lineIDs); err != nil {
+		if errors.Is(err, ErrRemitLinesMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	remit, err := store.GetRemitInformation(remitID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(remit)
+}
+
+// reorderRemitLines sets the order of all the lines at once
+func (h *Handler) reorderRemitLines(w http.ResponseWriter, r *http.Request) {
+	remit, ok := h.remitFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		LineIDs []uint `json:"line_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.writeReorderedRemit(w, r, remit.ID, request.LineIDs)
+}
+
+// moveRemitLine moves a line to the position given, from 1, shifting the
+// lines in between
+func (h *Handler) moveRemitLine(w http.ResponseWriter, r *http.Request) {
+	remit, ok := h.remitFromRequest(w, r)
+	if !ok {
+		return
+	}
+	lineId, err := strconv.ParseUint(r.PathValue("lineId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid line ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Position int `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Position < 1 || request.Position > len(remit.Lines) {
+		http.Error(w, fmt.Sprintf("Position must be between 1 and %d", len(remit.Lines)), http.StatusBadRequest)
+		return
+	}
+
+	lineIDs := make([]uint, 0, len(remit.Lines))
+	found := false
+	for _, line := range remit.Lines {
+		if line.ID == uint(lineId) {
+			found = true
+			continue
+		}
+		lineIDs = append(lineIDs, line.ID)
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("Line %d not found in remit information %d", lineId, remit.ID), http.StatusNotFound)
+		return
+	}
+	lineIDs = append(lineIDs[:request.Position-1], append([]uint{uint(lineId)}, lineIDs[request.Position-1:]...)...)
+	h.writeReorderedRemit(w, r, remit.ID, lineIDs)
+}
+
+// cloneRemitInformation copies remit information, usually a template, into
+// new remit information. The body may give its name and make it a template.
+func (h *Handler) cloneRemitInformation(w http.ResponseWriter, r *http.Request) {
+	remitId, err := strconv.ParseUint(r.PathValue("remitId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid remit ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name       string `json:"name"`
+		IsTemplate bool   `json:"is_template"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeRequest(r, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	clone, err := h.storeFor(r).CloneRemitInformation(uint(remitId), request.Name, request.IsTemplate)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(clone)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cachedReport is a report response kept for reuse
+type cachedReport struct {
+	header     http.Header
+	status     int
+	body       []byte
+	computedAt time.Time
+	expires    time.Time
+	// mark is the version of the data the report was computed at
+	mark dataMark
+}
+
+// reportLimiter keeps the report endpoints from running many heavy
+// aggregations on SQLite at once: only a few run at the same time and their
+// answers are reused for a few seconds, until the next write
+type reportLimiter struct {
+	// slots holds a token per running report, nil when unlimited
+	slots chan struct{}
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedReport
+}
+
+func newReportLimiter(c ReportsConfig) *reportLimiter {
+	limiter := &reportLimiter{
+		ttl:   time.Duration(c.CacheTTL) * time.Second,
+		cache: map[string]cachedReport{},
+	}
+	if c.MaxConcurrent > 0 {
+		limiter.slots = make(chan struct{}, c.MaxConcurrent)
+	}
+	return limiter
+}
+
+// lookup returns the cached report for key when it hasn't expired and
+// nothing was written since, along with the current data version. Writes
+// from jobs, commands and the other instances count as much as the
+// requests'.
+func (l *reportLimiter) lookup(key string) (cachedReport, bool, dataMark) {
+	mark, known := currentDataMark()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	report, ok := l.cache[key]
+	if ok && (!known || report.mark != mark || time.Now().After(report.expires)) {
+		delete(l.cache, key)
+		ok = false
+	}
+	return report, ok, mark
+}
+
+// store caches the report unless a write happened since it started
+func (l *reportLimiter) store(key string, mark dataMark, report cachedReport) {
+	now, known := currentDataMark()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !known || now != mark {
+		return
+	}
+	report.mark = mark
+	report.expires = time.Now().Add(l.ttl)
+	l.cache[key] = report
+}
+
+func writeCachedReport(w http.ResponseWriter, report cachedReport, cache string) {
+	for key, values := range report.header {
+		w.Header()[key] = values
+	}
+	setCacheHeaders(w, "X-Report-Cache", ReadModelStatus{Hit: cache == "hit", ComputedAt: report.computedAt})
+	w.WriteHeader(report.status)
+	w.Write(report.body)
+}
+
+// reportMiddleware runs next within the report limits. Reports are cached
+// per user and URL, only successful answers are kept.
+func (h *Handler) reportMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := h.reports
+		key := r.URL.RequestURI()
+		if userID := currentUserID(r.Context()); userID != nil {
+			key = fmt.Sprintf("%d %s", *userID, key)
+		}
+
+		if l.ttl > 0 {
+			if report, ok, _ := l.lookup(key); ok {
+				writeCachedReport(w, report, "hit")
+				return
+			}
+		}
+
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+				defer func() { <-l.slots }()
+			case <-r.Context().Done():
+				http.Error(w, "Request cancelled while waiting for a report slot", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if l.ttl <= 0 {
+			next(w, r)
+			return
+		}
+
+		// The same report may have been computed while waiting for a slot
+		report, ok, mark := l.lookup(key)
+		if ok {
+			writeCachedReport(w, report, "hit")
+			return
+		}
+
+		computedAt := time.Now()
+		buffered := &bufferedResponseWriter{header: http.Header{}}
+		next(buffered, r)
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+		report = cachedReport{header: buffered.header, status: buffered.status, body: buffered.body.Bytes(), computedAt: computedAt}
+		if report.status == http.StatusOK {
+			l.store(key, mark, report)
+		}
+		writeCachedReport(w, report, "miss")
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,34 +15,85 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-var DATABASE_FILE = "tinycrm.db"
-
-var monthsInPortuguese = map[string]string{
-	"January":   "Janeiro",
-	"February":  "Fevereiro",
-	"March":     "Março",
-	"April":     "Abril",
-	"May":       "Maio",
-	"June":      "Junho",
-	"July":      "Julho",
-	"August":    "Agosto",
-	"September": "Setembro",
-	"October":   "Outubro",
-	"November":  "Novembro",
-	"December":  "Dezembro",
+// schemaModels lists every model managed by the migrations
+var schemaModels = []interface{}{
+	&User{},
+	&Attachment{},
+	&ReferralSource{},
+	&RemitInformation{},
+	&RemitInformationLine{},
+	&Product{},
+	&Company{},
+	&Invoice{},
+	&InvoiceLine{},
+	&Payment{},
+	&InvoiceTemplate{},
+	&InvoiceEvent{},
+	&SurveyResponse{},
+	&PeppolTransmission{},
+	&ListColumns{},
+	&ProductPrice{},
+	&Category{},
+	&EmailMessage{},
+	&Deliverable{},
+	&Project{},
+	&Task{},
+	&TimeEntry{},
+	&UserIdentity{},
+	&InvoiceLock{},
+	&TemplateVersion{},
+	&InvoiceTemplateVersion{},
+	&AuditEvent{},
+	&PasswordResetToken{},
+	&LoginAttempt{},
+	&DigestRun{},
+	&Setting{},
+	&Job{},
+	&InboundEmail{},
+	&InvoiceRevision{},
+	&BillingRun{},
+	&Contract{},
+	&ContractLine{},
+	&ContractBilling{},
+	&PriceList{},
+	&PriceListItem{},
+	&CustomField{},
+	&InvoiceComment{},
+	&EmailLog{},
+	&WhatsAppMessage{},
+	&InvoiceDispute{},
 }
 
 type User struct {
-	ID           uint      `gorm:"primaryKey" json:"id"`
-	Username     string    `gorm:"size:255;not null;uniqueIndex" json:"username"`
-	PasswordHash string    `gorm:"size:255;not null" json:"-"`
-	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ID           uint   `gorm:"primaryKey" json:"id"`
+	Username     string `gorm:"size:255;not null;uniqueIndex" json:"username"`
+	Email        string `gorm:"size:255" json:"email"`
+	PasswordHash string `gorm:"size:255;not null" json:"-"`
+	// IsAdmin grants the /admin endpoints and user management
+	IsAdmin bool `gorm:"not null;default:false" json:"is_admin"`
+	// MustResetPassword keeps the password from signing in until a new one
+	// is chosen
+	MustResetPassword bool `gorm:"not null;default:false" json:"must_reset_password"`
+	// FailedLogins counts the wrong passwords in a row, too many lock the
+	// account until LockedUntil
+	FailedLogins int        `gorm:"not null;default:0" json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+	// CompanyID makes the user a client user of the company, signing in to
+	// the portal only
+	CompanyID *uint    `gorm:"index" json:"company_id"`
+	Company   *Company `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	// CalendarTokenHash is the hash of the token of the user's calendar
+	// feed, empty when they have none
+	CalendarTokenHash string    `gorm:"size:64;index" json:"-"`
+	CreatedAt         time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
 }
 
 type RemitInformation struct {
 	ID    uint                   `gorm:"primaryKey" json:"id"`
 	Name  string                 `gorm:"size:255;not null" json:"name"`
 	Lines []RemitInformationLine `gorm:"foreignKey:RemitInformationID" json:"lines"`
+	// Templates are cloned into the remit information invoices use
+	IsTemplate bool `gorm:"not null;default:false" json:"is_template"`
 }
 
 type RemitInformationLine struct {
@@ -48,42 +102,150 @@ type RemitInformationLine struct {
 	Value              string           `gorm:"size:255;not null" json:"value"`
 	RemitInformationID uint             `gorm:"not null" json:"remit_information_id"`
 	RemitInformation   RemitInformation `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	// Position orders the lines on the invoice, from 1
+	Position int `gorm:"not null;default:0" json:"position"`
 }
 
 type Product struct {
 	ID          uint    `gorm:"primaryKey" json:"id"`
 	Name        string  `gorm:"size:255;not null" json:"name"`
 	Description *string `gorm:"type:text" json:"description"`
-	Price       float64 `gorm:"type:decimal(10,2);not null" json:"price"`
+	Price       Money   `gorm:"type:decimal(10,2);not null" json:"price"`
+	// Unit is what the price is for, lines billing the product count it
+	Unit Unit `gorm:"size:10;not null;default:''" json:"unit"`
+
+	CategoryID *uint     `gorm:"index" json:"category_id"`
+	Category   *Category `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	Tags       Tags      `gorm:"type:text" json:"tags"`
+	// Archived products are kept for the invoices billing them but can't be
+	// picked anymore
+	ArchivedAt *time.Time `gorm:"index" json:"archived_at"`
 }
 
 type Company struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	Name     string `gorm:"size:255;not null" json:"name"`
-	Document string `gorm:"size:30;not null" json:"document"`
-	Address  string `gorm:"type:text;not null" json:"address"`
+	ID       uint        `gorm:"primaryKey" json:"id"`
+	Name     string      `gorm:"size:255;not null" json:"name"`
+	Document string      `gorm:"size:30;not null" json:"document"`
+	Address  string      `gorm:"type:text;not null" json:"address"`
+	Email    string      `gorm:"size:255" json:"email"`
+	Locale   Locale      `gorm:"size:10" json:"locale"`
+	Country  string      `gorm:"size:2" json:"country"`
+	PeppolID string      `gorm:"size:100" json:"peppol_id"`
+	LogoID   *uint       `json:"logo_id"`
+	Logo     *Attachment `gorm:"foreignKey:LogoID" json:"-"`
+	// StorageQuotaMB overrides the configured attachments quota when set
+	StorageQuotaMB *int `json:"storage_quota_mb"`
+
+	// EmailCc and EmailBcc are comma separated addresses copied on the emails
+	// sent to the company, EmailReplyTo replaces the configured reply-to
+	EmailCc      string `gorm:"size:255" json:"email_cc"`
+	EmailBcc     string `gorm:"size:255" json:"email_bcc"`
+	EmailReplyTo string `gorm:"size:255" json:"email_reply_to"`
+	// EmailBouncedAt flags the email as bad, set when a provider reports a
+	// bounce or a spam complaint and cleared when the email changes
+	EmailBouncedAt    *time.Time `json:"email_bounced_at"`
+	EmailBounceReason string     `gorm:"type:text" json:"email_bounce_reason"`
+	// Phone is in the international format, invoices and reminders are
+	// sent to it over WhatsApp once the client opted in
+	Phone         string `gorm:"size:20" json:"phone"`
+	WhatsAppOptIn bool   `gorm:"not null;default:false" json:"whatsapp_opt_in"`
+
+	// Clients billed monthly get the deliverables of the past month rolled
+	// into one invoice on ConsolidationDay, paid to ConsolidationRemit
+	ConsolidationDay     *int              `json:"consolidation_day"`
+	ConsolidationRemitID *uint             `json:"consolidation_remit_id"`
+	ConsolidationRemit   *RemitInformation `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+
+	ReferralSourceID *uint           `gorm:"index" json:"referral_source_id"`
+	ReferralSource   *ReferralSource `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+
+	// PriceListID prices the company's invoices, see PriceList
+	PriceListID *uint      `gorm:"index" json:"price_list_id"`
+	PriceList   *PriceList `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+
+	// The roles of the company: issuers bill their clients and pay their
+	// suppliers. A company created without a role is a client.
+	IsIssuer   bool `gorm:"not null;default:false;index" json:"is_issuer"`
+	IsClient   bool `gorm:"not null;default:false;index" json:"is_client"`
+	IsSupplier bool `gorm:"not null;default:false;index" json:"is_supplier"`
+
+	// Issuers can number their documents their own way, overriding the
+	// invoice prefix of the settings and the configured numbering strategy,
+	// and be paid to their own remit information by default
+	InvoicePrefix     *string           `gorm:"size:20" json:"invoice_prefix"`
+	NumberingStrategy string            `gorm:"size:20" json:"numbering_strategy"`
+	DefaultRemitID    *uint             `json:"default_remit_id"`
+	DefaultRemit      *RemitInformation `gorm:"foreignKey:DefaultRemitID;constraint:OnDelete:SET NULL" json:"-"`
+
+	// CustomFields holds the values of the company custom fields by key
+	CustomFields CustomFieldValues `gorm:"type:text" json:"custom_fields"`
+
+	// Tags, owner and archiving are managed through the bulk endpoints
+	Tags       Tags       `gorm:"type:text" json:"tags"`
+	OwnerID    *uint      `gorm:"index" json:"owner_id"`
+	Owner      *User      `gorm:"foreignKey:OwnerID;constraint:OnDelete:SET NULL" json:"-"`
+	ArchivedAt *time.Time `gorm:"index" json:"archived_at"`
 }
 
 type Invoice struct {
 	ID                    uint             `gorm:"primaryKey" json:"id"`
 	UUID                  uuid.UUID        `gorm:"type:text" json:"uuid"`
+	Type                  DocumentType     `gorm:"size:20;not null;default:invoice;index" json:"type"`
+	Locale                Locale           `gorm:"size:10" json:"locale"`
+	InvoiceTemplateID     *uint            `json:"invoice_template_id"`
+	InvoiceTemplate       *InvoiceTemplate `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	ReminderDays          ReminderDays     `gorm:"type:text" json:"reminder_days"`
+	RemindersSnoozedUntil *time.Time       `json:"reminders_snoozed_until"`
+	LastReminderAt        *time.Time       `json:"last_reminder_at"`
+	// DisputedAt is set while the client disputes the invoice, see
+	// InvoiceDispute
+	DisputedAt *time.Time `gorm:"index" json:"disputed_at"`
+	// CancelledAt is when a credit note cancelled the invoice, it is left
+	// unpaid and no longer chased
+	CancelledAt           *time.Time       `gorm:"index" json:"cancelled_at"`
 	Number                *int             `gorm:"default:0" json:"number"`
+	Code                  string           `gorm:"size:50;index" json:"code"`
+	SentAt                *time.Time       `gorm:"index" json:"sent_at"`
 	AdditionalInformation *string          `gorm:"type:text" json:"additional_information"`
-	Discount              float64          `gorm:"type:decimal(10,2);default:0.00" json:"discount"`
-	Penalty               float64          `gorm:"type:decimal(10,2);default:0.00" json:"penalty"`
+	Discount              Money            `gorm:"type:decimal(10,2);default:0.00" json:"discount"`
+	DiscountType          AdjustmentType   `gorm:"size:10;not null;default:fixed" json:"discount_type"`
+	Penalty               Money            `gorm:"type:decimal(10,2);default:0.00" json:"penalty"`
+	PenaltyType           AdjustmentType   `gorm:"size:10;not null;default:fixed" json:"penalty_type"`
 	Paid                  bool             `gorm:"default:false" json:"paid"`
 	IssueDate             time.Time        `gorm:"default:CURRENT_TIMESTAMP" json:"issue_date"`
 	DueDate               time.Time        `gorm:"not null" json:"due_date"`
 	RemitInformationID    uint             `gorm:"not null" json:"remit_information_id"`
-	RemitInformation      RemitInformation `gorm:"constraint:OnDelete:CASCADE" json:"remit_information"`
+	RemitInformation      RemitInformation `gorm:"constraint:OnDelete:RESTRICT" json:"remit_information"`
 	CompanyID             uint             `gorm:"not null" json:"company_id"`
-	Company               Company          `gorm:"constraint:OnDelete:CASCADE" json:"company"`
+	Company               Company          `gorm:"constraint:OnDelete:RESTRICT" json:"company"`
 	ClientID              uint             `gorm:"not null" json:"client_id"`
-	Client                Company          `gorm:"constraint:OnDelete:CASCADE" json:"client"`
+	Client                Company          `gorm:"constraint:OnDelete:RESTRICT" json:"client"`
+	ProjectID             *uint            `gorm:"index" json:"project_id"`
+	Project               *Project         `gorm:"constraint:OnDelete:SET NULL" json:"-"`
 	InvoiceLines          []InvoiceLine    `gorm:"foreignKey:InvoiceID" json:"invoice_lines"`
+
+	// Totals are maintained by the repository whenever the lines change,
+	// so listings and reports don't load the lines.
+	// Taxes aren't tracked yet, TaxTotal stays at zero.
+	SubTotalAmount Money `gorm:"column:subtotal;type:decimal(10,2);default:0.00" json:"subtotal"`
+	TaxTotal       Money `gorm:"type:decimal(10,2);default:0.00" json:"tax_total"`
+	TotalAmount    Money `gorm:"column:total;type:decimal(10,2);default:0.00" json:"total"`
+	// LateCharges is computed when an overdue invoice is read, never stored
+	LateCharges *LateCharges `gorm:"-" json:"late_charges,omitempty"`
+	// CustomFields holds the values of the invoice custom fields by key
+	CustomFields CustomFieldValues `gorm:"type:text" json:"custom_fields"`
+
+	// Tags, owner and archiving are managed through the bulk endpoints
+	Tags       Tags       `gorm:"type:text" json:"tags"`
+	OwnerID    *uint      `gorm:"index" json:"owner_id"`
+	Owner      *User      `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	ArchivedAt *time.Time `gorm:"index" json:"archived_at"`
 }
 
 func (i *Invoice) Identification() string {
+	if i.Code != "" {
+		return i.Code
+	}
 	if i.Number != nil && *i.Number != 0 {
 		return strconv.Itoa(*i.Number)
 	}
@@ -91,52 +253,177 @@ func (i *Invoice) Identification() string {
 	return i.UUID.String()
 }
 
+// Draft reports whether the invoice wasn't sent yet, a draft is identified
+// by its UUID until it gets a number
+func (i *Invoice) Draft() bool {
+	return i.SentAt == nil
+}
+
 func (invoice *Invoice) BeforeCreate(tx *gorm.DB) error {
 	if invoice.UUID == (uuid.UUID{}) {
 		invoice.UUID = uuid.New()
 	}
+	if invoice.Type == "" {
+		invoice.Type = DocumentInvoice
+	}
 	return nil
 }
 
-func (i *Invoice) SubTotal() float64 {
-	var subTotal float64
+func (i *Invoice) SubTotal() Money {
+	var subTotal Money
 	for _, line := range i.InvoiceLines {
 		subTotal += line.Total()
 	}
 	return subTotal
 }
 
-func (i *Invoice) Total() float64 {
-	return i.SubTotal() - i.Discount + i.Penalty
+func (i *Invoice) Total() Money {
+	return i.SubTotal() - i.DiscountAmount() + i.PenaltyAmount()
 }
 
 func (i *Invoice) DueMonth() string {
-	return monthsInPortuguese[i.DueDate.Month().String()]
+	return i.EffectiveLocale().MonthName(i.DueDate.Month())
 }
 
 func (i *Invoice) Repr() string {
 	clientName := strings.ReplaceAll(i.Client.Name, " ", "")
 	issueDate := i.IssueDate.Format("20060102")
-	return fmt.Sprintf("%s_invoice_%s", clientName, issueDate)
+	documentType := i.Type
+	if documentType == "" {
+		documentType = DocumentInvoice
+	}
+	return fmt.Sprintf("%s_%s_%s", clientName, documentType, issueDate)
 }
 
 
+// LineType tells the lines billing something from the section headings
+// grouping the lines after them
+type LineType string
+
+const (
+	LineItem    LineType = "item"
+	LineSection LineType = "section"
+)
+
+func (t LineType) Valid() bool {
+	return t == LineItem || t == LineSection
+}
+
 type InvoiceLine struct {
-	ID          uint    `gorm:"primaryKey" json:"id"`
-	InvoiceID   uint    `gorm:"not null" json:"invoice_id"`
-	Invoice     Invoice `gorm:"constraint:OnDelete:CASCADE" json:"-"`
-	ProductID   uint    `gorm:"not null" json:"product_id"`
-	Product     Product `gorm:"constraint:OnDelete:RESTRICT" json:"product"`
-	Quantity    int     `gorm:"default:1;not null" json:"quantity"`
-	Description *string `gorm:"size:255" json:"description"`
+	ID        uint     `gorm:"primaryKey" json:"id"`
+	InvoiceID uint     `gorm:"not null" json:"invoice_id"`
+	Invoice   Invoice  `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Type      LineType `gorm:"size:10;not null;default:item" json:"type"`
+	// ProductID is nil for sections and for free text items, billing what
+	// their description says
+	ProductID   *uint    `json:"product_id"`
+	Product     *Product `gorm:"constraint:OnDelete:RESTRICT" json:"product"`
+	Quantity    float64  `gorm:"type:decimal(10,3);default:1;not null" json:"quantity"`
+	Unit        Unit     `gorm:"size:10;not null;default:''" json:"unit"`
+	Description *string  `gorm:"size:255" json:"description"`
+	// UnitPrice is the product price when the line was billed, so repricing
+	// the product leaves existing invoices alone
+	UnitPrice    Money          `gorm:"type:decimal(10,2);not null;default:0.00" json:"unit_price"`
+	Discount     Money          `gorm:"type:decimal(10,2);not null;default:0.00" json:"discount"`
+	DiscountType AdjustmentType `gorm:"size:10;not null;default:fixed" json:"discount_type"`
+	// Position orders the lines on the invoice, from 1
+	Position int `gorm:"not null;default:0" json:"position"`
+}
+
+func (il *InvoiceLine) Total() Money {
+	return il.Gross() - il.DiscountAmount()
+}
+
+func orderInvoiceLines(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// positionInvoiceLines numbers the lines 1, 2, 3... in the order of their
+// positions when they all have one, else in the order they are listed in
+func positionInvoiceLines(lines []InvoiceLine) {
+	positioned := true
+	for _, line := range lines {
+		positioned = positioned && line.Position > 0
+	}
+	if positioned {
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Position < lines[j].Position })
+	}
+	for index := range lines {
+		lines[index].Position = index + 1
+	}
+}
+
+// Section tells whether the line is a heading, billing nothing
+func (il *InvoiceLine) Section() bool {
+	return il.Type == LineSection
 }
 
-func (il *InvoiceLine) Total() float64 {
-	return il.Product.Price * float64(il.Quantity)
+// Name is what the line bills: its product, else its description
+func (il *InvoiceLine) Name() string {
+	if il.Product != nil {
+		return il.Product.Name
+	}
+	if il.Description != nil {
+		return *il.Description
+	}
+	return ""
+}
+
+// Details is the description shown under the product name, free text
+// lines and sections show theirs as their name
+func (il *InvoiceLine) Details() string {
+	if il.Product == nil || il.Description == nil {
+		return ""
+	}
+	return *il.Description
+}
+
+type Payment struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	InvoiceID uint      `gorm:"not null;index" json:"invoice_id"`
+	Invoice   Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Amount    Money     `gorm:"type:decimal(10,2);not null" json:"amount"`
+	Date      time.Time `gorm:"not null" json:"date"`
+	Reference *string   `gorm:"size:255" json:"reference"`
 }
 
 type Repository struct {
 	db *gorm.DB
+	// overrideIssued lets sent and paid invoices be changed
+	overrideIssued bool
+	// work is the unit of work of the request the repository is bound to
+	work *unitOfWork
+}
+
+// sqliteDSN adds the connection pragmas every connection needs: WAL so
+// readers don't block the writer, a busy timeout so concurrent writes wait
+// for the lock instead of failing, transactions taking the write lock when
+// they begin, foreign key enforcement, and the time zone times are read in,
+// the server's when empty. Pragmas already set in the DSN are kept.
+func sqliteDSN(dsn string, busyTimeout int, timezone string) string {
+	if timezone == "" {
+		timezone = "auto"
+	}
+	pragmas := []struct{ name, value string }{
+		{"_journal_mode", "WAL"},
+		{"_busy_timeout", strconv.Itoa(busyTimeout)},
+		{"_txlock", "immediate"},
+		{"_foreign_keys", "on"},
+		{"_loc", timezone},
+	}
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	for _, pragma := range pragmas {
+		if strings.Contains(dsn, pragma.name+"=") {
+			continue
+		}
+		dsn += separator + pragma.name + "=" + pragma.value
+		separator = "&"
+	}
+	return dsn
 }
 
 func NewRepository() (*Repository, error) {
@@ -146,17 +433,24 @@ func NewRepository() (*Repository, error) {
 func NewRepositoryWithDB(db *gorm.DB) (*Repository, error) {
 	if db == nil {
 		var err error
-		db, err = gorm.Open(sqlite.Open("tinycrm.db"), &gorm.Config{})
+		dsn := sqliteDSN(config.DatabaseDSN, config.DatabaseBusyTimeout, config.Timezone)
+		db, err = gorm.Open(sqlite.New(sqlite.Config{DriverName: sqliteUTCDriver, DSN: dsn}), &gorm.Config{})
 		if err != nil {
 			return nil, err
 		}
+		if err := configurePool(db); err != nil {
+			return nil, err
+		}
+	}
+	if err := trackWrites(db); err != nil {
+		return nil, err
 	}
 	return &Repository{db: db}, nil
 }
 
 func (r *Repository) GetCompany(id uint) (*Company, error) {
 	var company Company
-	err := r.db.First(&company, id).Error
+	err := r.db.Preload("Logo").First(&company, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -164,27 +458,64 @@ func (r *Repository) GetCompany(id uint) (*Company, error) {
 }
 
 func (r *Repository) CreateCompany(company *Company) error {
-	return r.db.Create(company).Error
+	return retryOnBusy(func() error {
+		return r.db.Create(company).Error
+	})
 }
 
 func (r *Repository) UpdateCompany(company *Company) error {
-	return r.db.Save(company).Error
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			// A new email address is given the benefit of the doubt
+			err := tx.Model(&Company{}).Where("id = ? AND email <> ?", company.ID, company.Email).
+				Updates(map[string]interface{}{"email_bounced_at": nil, "email_bounce_reason": ""}).Error
+			if err != nil {
+				return err
+			}
+			// The logo is managed through SetCompanyLogo, the bounces by the
+			// email webhooks
+			return tx.Omit("LogoID", "Tags", "OwnerID", "ArchivedAt", "EmailBouncedAt", "EmailBounceReason").Save(company).Error
+		})
+	})
+	if err != nil {
+		return err
+	}
+	publishEvent(r, EventCompanyUpdated, company)
+	return nil
 }
 
-func (r *Repository) GetCompanies() ([]Company, error) {
+func (r *Repository) GetCompanies(filter CompanyFilter) ([]Company, error) {
 	var companies []Company
-	err := r.db.Find(&companies).Error
+	err := filter.apply(r.db).Find(&companies).Error
 	return companies, err
 }
 
+// ErrCompanyInUse is returned when deleting a company that issued or was
+// billed invoices
+var ErrCompanyInUse = errors.New("company is on invoices, archive it instead")
+
 func (r *Repository) DeleteCompany(id uint) error {
-	return r.db.Select(clause.Associations).Delete(&Company{}, id).Error
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var issued, billed int64
+			if err := tx.Model(&Invoice{}).Where("company_id = ?", id).Count(&issued).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Invoice{}).Where("client_id = ?", id).Count(&billed).Error; err != nil {
+				return err
+			}
+			if issued > 0 || billed > 0 {
+				return fmt.Errorf("%w: issuer of %d invoices, client of %d", ErrCompanyInUse, issued, billed)
+			}
+			return tx.Select(clause.Associations).Delete(&Company{}, id).Error
+		})
+	})
 }
 
 // RemitInformation CRUD
 func (r *Repository) GetRemitInformation(id uint) (*RemitInformation, error) {
 	var remit RemitInformation
-	err := r.db.Preload("Lines").First(&remit, id).Error
+	err := r.db.Preload("Lines", orderRemitLines).First(&remit, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -192,38 +523,62 @@ func (r *Repository) GetRemitInformation(id uint) (*RemitInformation, error) {
 }
 
 func (r *Repository) CreateRemitInformation(remit *RemitInformation) error {
-	return r.db.Create(remit).Error
+	positionRemitLines(remit.Lines)
+	return retryOnBusy(func() error {
+		return r.db.Create(remit).Error
+	})
 }
 
 func (r *Repository) UpdateRemitInformation(remit *RemitInformation) error {
-	return r.db.Transaction(func(tx *gorm.DB) error {
-		// First, delete existing remit lines
-		if err := tx.Where("remit_information_id = ?", remit.ID).Delete(&RemitInformationLine{}).Error; err != nil {
-			return err
-		}
+	positionRemitLines(remit.Lines)
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			// First, delete existing remit lines
+			if err := tx.Where("remit_information_id = ?", remit.ID).Delete(&RemitInformationLine{}).Error; err != nil {
+				return err
+			}
 		
-		// Then save the remit information with new lines
-		if err := tx.Save(remit).Error; err != nil {
-			return err
-		}
+			// Then save the remit information with new lines
+			if err := tx.Save(remit).Error; err != nil {
+				return err
+			}
 		
-		return nil
+			return nil
+		})
 	})
 }
 
-func (r *Repository) GetRemitInformations() ([]RemitInformation, error) {
+func (r *Repository) GetRemitInformations(filter RemitFilter) ([]RemitInformation, error) {
 	var remits []RemitInformation
-	err := r.db.Preload("Lines").Find(&remits).Error
+	err := filter.apply(r.db).Preload("Lines", orderRemitLines).Find(&remits).Error
 	return remits, err
 }
 
+// ErrRemitInUse is returned when deleting remit information that invoices
+// or contracts are paid to
+var ErrRemitInUse = errors.New("remit information is on invoices, keep it")
+
 func (r *Repository) DeleteRemitInformation(id uint) error {
-	// First delete associated lines
-	if err := r.db.Where("remit_information_id = ?", id).Delete(&RemitInformationLine{}).Error; err != nil {
-		return err
-	}
-	// Then delete the main record
-	return r.db.Delete(&RemitInformation{}, id).Error
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var invoices, contracts int64
+			if err := tx.Model(&Invoice{}).Where("remit_information_id = ?", id).Count(&invoices).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Contract{}).Where("remit_information_id = ?", id).Count(&contracts).Error; err != nil {
+				return err
+			}
+			if invoices > 0 || contracts > 0 {
+				return fmt.Errorf("%w: %d invoices, %d contracts", ErrRemitInUse, invoices, contracts)
+			}
+			// First delete associated lines
+			if err := tx.Where("remit_information_id = ?", id).Delete(&RemitInformationLine{}).Error; err != nil {
+				return err
+			}
+			// Then delete the main record
+			return tx.Delete(&RemitInformation{}, id).Error
+		})
+	})
 }
 
 // Product CRUD
@@ -237,91 +592,686 @@ func (r *Repository) GetProduct(id uint) (*Product, error) {
 }
 
 func (r *Repository) CreateProduct(product *Product) error {
-	return r.db.Create(product).Error
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(product).Error; err != nil {
+				return err
+			}
+			return recordProductPrice(tx, product)
+		})
+	})
 }
 
 func (r *Repository) UpdateProduct(product *Product) error {
-	return r.db.Save(product).Error
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var previous []Money
+			if err := tx.Model(&Product{}).Where("id = ?", product.ID).Pluck("price", &previous).Error; err != nil {
+				return err
+			}
+			// Archiving is managed through SetProductArchived
+			if err := tx.Omit("ArchivedAt").Save(product).Error; err != nil {
+				return err
+			}
+			if len(previous) == 1 && previous[0] == product.Price {
+				return nil
+			}
+			return recordProductPrice(tx, product)
+		})
+	})
 }
 
-func (r *Repository) GetProducts() ([]Product, error) {
+func (r *Repository) GetProducts(filter ProductFilter) ([]Product, error) {
 	var products []Product
-	err := r.db.Find(&products).Error
+	err := filter.apply(r.db).Find(&products).Error
 	return products, err
 }
 
+// SetProductArchived archives or brings back the product
+func (r *Repository) SetProductArchived(id uint, archived bool) (*Product, error) {
+	product, err := r.GetProduct(id)
+	if err != nil {
+		return nil, err
+	}
+	if archived == (product.ArchivedAt != nil) {
+		return product, nil
+	}
+
+	var archivedAt *time.Time
+	if archived {
+		now := clock.Now()
+		archivedAt = &now
+	}
+	err = retryOnBusy(func() error {
+		return r.db.Model(product).UpdateColumn("archived_at", archivedAt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	product.ArchivedAt = archivedAt
+	return product, nil
+}
+
+// ErrProductInUse is returned when deleting a product billed on invoices or
+// deliverables
+var ErrProductInUse = errors.New("product is billed on invoices, archive it instead")
+
 func (r *Repository) DeleteProduct(id uint) error {
-	return r.db.Select(clause.Associations).Delete(&Product{}, id).Error
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var lines, deliverables, contracts int64
+			if err := tx.Model(&InvoiceLine{}).Where("product_id = ?", id).Count(&lines).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Deliverable{}).Where("product_id = ?", id).Count(&deliverables).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&ContractLine{}).Where("product_id = ?", id).Count(&contracts).Error; err != nil {
+				return err
+			}
+			if lines > 0 || deliverables > 0 || contracts > 0 {
+				return fmt.Errorf("%w: %d invoice lines, %d deliverables, %d contract lines", ErrProductInUse, lines, deliverables, contracts)
+			}
+			return tx.Select(clause.Associations).Delete(&Product{}, id).Error
+		})
+	})
 }
 
 // Invoice CRUD
 func (r *Repository) GetInvoice(id uint) (*Invoice, error) {
 	var invoice Invoice
-	err := r.db.Preload("InvoiceLines.Product").Preload("RemitInformation.Lines").Preload("Company").Preload("Client").First(&invoice, id).Error
+	err := r.db.Preload("InvoiceLines", orderInvoiceLines).Preload("InvoiceLines.Product").Preload("RemitInformation.Lines", orderRemitLines).Preload("Company.Logo").Preload("Client").First(&invoice, id).Error
 	if err != nil {
 		return nil, err
 	}
 	return &invoice, nil
 }
 
+func (r *Repository) GetInvoiceByUUID(id uuid.UUID) (*Invoice, error) {
+	var invoice Invoice
+	err := r.db.Preload("InvoiceLines", orderInvoiceLines).Preload("InvoiceLines.Product").Preload("RemitInformation.Lines", orderRemitLines).Preload("Company.Logo").Preload("Client").Where("uuid = ?", id).First(&invoice).Error
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// saveInvoiceTotals stores the totals computed from the invoice lines
+func saveInvoiceTotals(tx *gorm.DB, invoice *Invoice) error {
+	invoice.SubTotalAmount = invoice.SubTotal()
+	invoice.TaxTotal = 0
+	invoice.TotalAmount = invoice.Total()
+	return tx.Model(&Invoice{}).Where("id = ?", invoice.ID).UpdateColumns(map[string]interface{}{
+		"subtotal":  invoice.SubTotalAmount,
+		"tax_total": invoice.TaxTotal,
+		"total":     invoice.TotalAmount,
+	}).Error
+}
+
 func (r *Repository) CreateInvoice(invoice *Invoice) error {
-	return r.db.Create(invoice).Error
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			return createInvoice(tx, invoice)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	publishEvent(r, EventInvoiceCreated, invoice)
+	return nil
+}
+
+// createInvoice prices the lines and stores the invoice with its totals
+func createInvoice(tx *gorm.DB, invoice *Invoice) error {
+	// Invoices are created as drafts, numbered when sent
+	invoice.SentAt = nil
+	if invoice.IssueDate.IsZero() {
+		invoice.IssueDate = clock.Now()
+	}
+	if config.InvoiceNumbering == NumberingOnSend {
+		invoice.Number, invoice.Code = nil, ""
+	}
+	positionInvoiceLines(invoice.InvoiceLines)
+	if err := captureUnitPrices(tx, invoice, nil); err != nil {
+		return err
+	}
+	if err := captureUnits(tx, invoice); err != nil {
+		return err
+	}
+	if err := invoice.checkAdjustments(); err != nil {
+		return err
+	}
+	if err := tx.Create(invoice).Error; err != nil {
+		return err
+	}
+	return saveInvoiceTotals(tx, invoice)
 }
 
 func (r *Repository) UpdateInvoice(invoice *Invoice) error {
-	return r.db.Transaction(func(tx *gorm.DB) error {
-		// First, delete existing invoice lines
-		if err := tx.Where("invoice_id = ?", invoice.ID).Delete(&InvoiceLine{}).Error; err != nil {
-			return err
-		}
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := r.checkInvoiceIssued(tx, invoice.ID); err != nil {
+				return err
+			}
+			// The invoice as it was is kept as a revision
+			var previous Invoice
+			if err := tx.Preload("InvoiceLines", orderInvoiceLines).First(&previous, invoice.ID).Error; err != nil {
+				return err
+			}
+			// Lines sent without a price keep the one their product was billed at
+			billed := map[uint]Money{}
+			for _, line := range previous.InvoiceLines {
+				if line.ProductID != nil {
+					billed[*line.ProductID] = line.UnitPrice
+				}
+			}
+			positionInvoiceLines(invoice.InvoiceLines)
+			if err := captureUnitPrices(tx, invoice, billed); err != nil {
+				return err
+			}
+			if err := captureUnits(tx, invoice); err != nil {
+				return err
+			}
+			if err := invoice.checkAdjustments(); err != nil {
+				return err
+			}
+
+			// First, delete existing invoice lines
+			if err := tx.Where("invoice_id = ?", invoice.ID).Delete(&InvoiceLine{}).Error; err != nil {
+				return err
+			}
 		
-		// Then save the invoice with new lines
-		if err := tx.Save(invoice).Error; err != nil {
-			return err
-		}
+			// Then save the invoice with new lines, keeping the reminder
+			// settings and bookkeeping, the dispute, the cancellation and
+			// the numbering done when it was sent, which have endpoints of
+			// their own
+			kept := []string{"LastReminderAt", "ReminderDays", "RemindersSnoozedUntil", "DisputedAt", "Tags", "OwnerID", "ArchivedAt", "SentAt", "CancelledAt"}
+			if config.InvoiceNumbering == NumberingOnSend {
+				kept = append(kept, "Number", "Code")
+			}
+			if err := tx.Omit(kept...).Save(invoice).Error; err != nil {
+				return err
+			}
 		
-		return nil
+			if err := saveInvoiceTotals(tx, invoice); err != nil {
+				return err
+			}
+			return recordInvoiceRevision(tx, &previous)
+		})
 	})
 }
 
-func (r *Repository) GetInvoices() ([]Invoice, error) {
+// InvoiceFilter narrows down invoice listings, zero values match everything
+type InvoiceFilter struct {
+	Type      DocumentType `json:"type"`
+	IDs       []uint       `json:"ids"`
+	CompanyID *uint        `json:"company_id"`
+	ClientID  *uint        `json:"client_id"`
+	// Paid false lists the invoices left to pay, cancelled ones left out
+	Paid     *bool  `json:"paid"`
+	Tag      string `json:"tag"`
+	OwnerID  *uint  `json:"owner_id"`
+	Archived *bool  `json:"archived"`
+	// Search matches text in the line descriptions or the billed products
+	Search string `json:"search"`
+	// Sent lists only the invoices sent, or only the drafts
+	Sent *bool `json:"sent"`
+	// IssuedFrom and IssuedTo bound the issue date, both days included
+	IssuedFrom *time.Time `json:"issued_from"`
+	IssuedTo   *time.Time `json:"issued_to"`
+	// OverdueDays lists only the invoices left unpaid more than that many
+	// days past their due date, counted from today
+	OverdueDays *uint `json:"overdue_days"`
+	// Disputed lists only the invoices the client disputes, or the others
+	Disputed *bool `json:"disputed"`
+	// Cancelled lists only the invoices cancelled by a credit note, or the
+	// others
+	Cancelled *bool `json:"cancelled"`
+	// Sort, one of invoiceSorts, and Descending order the listing, by ID
+	// when no sort is given. They don't narrow it down.
+	Sort       string `json:"sort"`
+	Descending bool   `json:"descending"`
+}
+
+// invoiceSorts maps the columns invoice lists sort by to their SQL
+var invoiceSorts = map[string]string{
+	"number":     "invoices.number",
+	"issue_date": "invoices.issue_date",
+	"due_date":   "invoices.due_date",
+	"total":      "invoices.total",
+	"client":     "(SELECT name FROM companies WHERE companies.id = invoices.client_id)",
+}
+
+func (f InvoiceFilter) empty() bool {
+	return f.Type == "" && len(f.IDs) == 0 && f.CompanyID == nil && f.ClientID == nil && f.Paid == nil &&
+		f.Tag == "" && f.OwnerID == nil && f.Archived == nil && strings.TrimSpace(f.Search) == "" && f.Sent == nil &&
+		f.IssuedFrom == nil && f.IssuedTo == nil && f.OverdueDays == nil && f.Disputed == nil && f.Cancelled == nil
+}
+
+// order is the ORDER BY of the listing, ties broken by ID
+func (f InvoiceFilter) order() string {
+	column, ok := invoiceSorts[f.Sort]
+	if !ok {
+		return "invoices.id"
+	}
+	direction := "ASC"
+	if f.Descending {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("%s %s, invoices.id %s", column, direction, direction)
+}
+
+// likeContains is the LIKE pattern matching text anywhere, with the LIKE
+// wildcards in text escaped by a backslash
+func likeContains(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+	return "%" + text + "%"
+}
+
+func (f InvoiceFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+	if len(f.IDs) > 0 {
+		query = query.Where("id IN ?", f.IDs)
+	}
+	if f.CompanyID != nil {
+		query = query.Where("company_id = ?", *f.CompanyID)
+	}
+	if f.ClientID != nil {
+		query = query.Where("client_id = ?", *f.ClientID)
+	}
+	if f.Paid != nil {
+		query = query.Where("paid = ?", *f.Paid)
+		if !*f.Paid {
+			query = query.Where("cancelled_at IS NULL")
+		}
+	}
+	if f.Tag != "" {
+		query = query.Where("tags LIKE ?", tagLike(strings.ToLower(f.Tag)))
+	}
+	if f.OwnerID != nil {
+		query = query.Where("owner_id = ?", *f.OwnerID)
+	}
+	if search := strings.TrimSpace(f.Search); search != "" {
+		pattern := likeContains(search)
+		query = query.Where(`id IN (SELECT invoice_lines.invoice_id FROM invoice_lines
+			LEFT JOIN products ON products.id = invoice_lines.product_id
+			WHERE invoice_lines.description LIKE @pattern ESCAPE '\'
+			OR products.name LIKE @pattern ESCAPE '\'
+			OR products.description LIKE @pattern ESCAPE '\')`, sql.Named("pattern", pattern))
+	}
+	if f.Sent != nil {
+		if *f.Sent {
+			query = query.Where("sent_at IS NOT NULL")
+		} else {
+			query = query.Where("sent_at IS NULL")
+		}
+	}
+	if f.IssuedFrom != nil {
+		query = query.Where("issue_date >= ?", *f.IssuedFrom)
+	}
+	if f.IssuedTo != nil {
+		query = query.Where("issue_date < ?", f.IssuedTo.AddDate(0, 0, 1))
+	}
+	if f.OverdueDays != nil {
+		query = query.Where("type = ? AND NOT paid AND cancelled_at IS NULL AND due_date < ?", DocumentInvoice, clock.Now().AddDate(0, 0, -int(*f.OverdueDays)))
+	}
+	if f.Disputed != nil {
+		if *f.Disputed {
+			query = query.Where("disputed_at IS NOT NULL")
+		} else {
+			query = query.Where("disputed_at IS NULL")
+		}
+	}
+	if f.Cancelled != nil {
+		if *f.Cancelled {
+			query = query.Where("cancelled_at IS NOT NULL")
+		} else {
+			query = query.Where("cancelled_at IS NULL")
+		}
+	}
+	return applyArchivedFilter(query, f.Archived)
+}
+
+// GetInvoices loads the invoices matched by filter in full. The companies
+// and the remit information are joined, only the lines are preloaded, so
+// the number of queries doesn't grow with the invoices.
+func (r *Repository) GetInvoices(filter InvoiceFilter) ([]Invoice, error) {
 	var invoices []Invoice
-	err := r.db.Preload("InvoiceLines.Product").Preload("RemitInformation.Lines").Preload("Company").Preload("Client").Find(&invoices).Error
+	// The filter runs in a subquery so its columns stay unambiguous
+	matching := filter.apply(r.db.Model(&Invoice{}).Select("id"))
+	err := r.db.Joins("Company").Joins("Company.Logo").Joins("Client").Joins("RemitInformation").
+		Preload("InvoiceLines", orderInvoiceLines).Preload("InvoiceLines.Product").Preload("RemitInformation.Lines", orderRemitLines).
+		Where("invoices.id IN (?)", matching).
+		Order(filter.order()).
+		Find(&invoices).Error
 	return invoices, err
 }
 
+const (
+	InvoiceStatusOpen    = "open"
+	InvoiceStatusOverdue = "overdue"
+	InvoiceStatusPaid    = "paid"
+	// InvoiceStatusDisputed is an unpaid invoice the client disputes
+	InvoiceStatusDisputed = "disputed"
+	// InvoiceStatusCancelled is an invoice a credit note cancelled
+	InvoiceStatusCancelled = "cancelled"
+)
+
+// InvoiceSummary is the row of an invoice list, read with its stored
+// totals instead of loading every line and relationship
+type InvoiceSummary struct {
+	ID           uint           `json:"id"`
+	UUID         uuid.UUID      `json:"uuid"`
+	Type         DocumentType   `json:"type"`
+	Number       *int           `json:"number"`
+	Code         string         `json:"code"`
+	SentAt       *time.Time     `json:"sent_at"`
+	CompanyID    uint           `json:"company_id"`
+	ClientID     uint           `json:"client_id"`
+	ClientName   string         `json:"client_name"`
+	SubTotal     Money          `json:"subtotal"`
+	Discount     Money          `json:"discount"`
+	DiscountType AdjustmentType `json:"discount_type"`
+	Penalty      Money          `json:"penalty"`
+	PenaltyType  AdjustmentType `json:"penalty_type"`
+	TaxTotal     Money          `json:"tax_total"`
+	Total        Money          `json:"total"`
+	Paid         bool           `json:"paid"`
+	Status       string         `json:"status"`
+	IssueDate    time.Time      `json:"issue_date"`
+	DueDate      time.Time      `json:"due_date"`
+	Tags         Tags           `json:"tags"`
+	ArchivedAt   *time.Time     `json:"archived_at"`
+	DisputedAt   *time.Time     `json:"disputed_at"`
+	CancelledAt  *time.Time     `json:"cancelled_at"`
+}
+
+// GetInvoiceSummaries lists the invoices matched by filter as summaries
+// with a single query
+func (r *Repository) GetInvoiceSummaries(filter InvoiceFilter) ([]InvoiceSummary, error) {
+	return r.invoiceSummaries(filter, filter.order(), 0)
+}
+
+// invoiceSummaries lists the summaries in the given order, at most limit
+// of them unless it is 0
+func (r *Repository) invoiceSummaries(filter InvoiceFilter, order string, limit int) ([]InvoiceSummary, error) {
+	var summaries []InvoiceSummary
+	// The filter runs in a subquery so its columns stay unambiguous
+	matching := filter.apply(r.db.Model(&Invoice{}).Select("id"))
+	query := r.db.Table("invoices")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.
+		Select(`invoices.id, invoices.uuid, invoices.type, invoices.number, invoices.code, invoices.sent_at, invoices.company_id, invoices.client_id,
+			clients.name AS client_name, invoices.subtotal AS sub_total, invoices.discount, invoices.discount_type, invoices.penalty, invoices.penalty_type,
+			invoices.tax_total, invoices.total, invoices.paid, invoices.issue_date, invoices.due_date,
+			invoices.tags, invoices.archived_at, invoices.disputed_at, invoices.cancelled_at`).
+		Joins("JOIN companies clients ON clients.id = invoices.client_id").
+		Where("invoices.id IN (?)", matching).
+		Order(order).
+		Scan(&summaries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Now()
+	for i := range summaries {
+		summary := &summaries[i]
+		switch {
+		case summary.Paid:
+			summary.Status = InvoiceStatusPaid
+		case summary.CancelledAt != nil:
+			summary.Status = InvoiceStatusCancelled
+		case summary.DisputedAt != nil:
+			summary.Status = InvoiceStatusDisputed
+		case summary.DueDate.Before(now):
+			summary.Status = InvoiceStatusOverdue
+		default:
+			summary.Status = InvoiceStatusOpen
+		}
+	}
+	return summaries, nil
+}
+
 func (r *Repository) DeleteInvoice(id uint) error {
-	// First delete associated invoice lines
-	if err := r.db.Where("invoice_id = ?", id).Delete(&InvoiceLine{}).Error; err != nil {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := r.checkInvoiceIssued(tx, id); err != nil {
+				return err
+			}
+			if config.InvoiceNumbering == NumberingOnSend {
+				var sent int64
+				if err := tx.Model(&Invoice{}).Where("id = ? AND sent_at IS NOT NULL", id).Count(&sent).Error; err != nil {
+					return err
+				}
+				if sent > 0 {
+					return ErrSentInvoiceDeletion
+				}
+			}
+			// First delete associated invoice lines and payments
+			if err := tx.Where("invoice_id = ?", id).Delete(&InvoiceLine{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&Payment{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&InvoiceEvent{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&SurveyResponse{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&PeppolTransmission{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&EmailMessage{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&InvoiceLock{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&InvoiceComment{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&WhatsAppMessage{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invoice_id = ?", id).Delete(&InvoiceDispute{}).Error; err != nil {
+				return err
+			}
+			// Its deliverables go back to the ones waiting to be invoiced
+			if err := tx.Model(&Deliverable{}).Where("invoice_id = ?", id).UpdateColumn("invoice_id", nil).Error; err != nil {
+				return err
+			}
+			// Then delete the main record
+			return tx.Delete(&Invoice{}, id).Error
+		})
+	})
+}
+
+// GetClientInvoices returns every invoice billed to the given client
+func (r *Repository) GetClientInvoices(clientID uint) ([]Invoice, error) {
+	var invoices []Invoice
+	err := r.db.Preload("InvoiceLines", orderInvoiceLines).Preload("InvoiceLines.Product").Where("client_id = ?", clientID).Order("issue_date").Find(&invoices).Error
+	return invoices, err
+}
+
+// InvoiceTotals aggregates the stored totals of a set of invoices
+type InvoiceTotals struct {
+	Count    int64 `json:"count"`
+	SubTotal Money `json:"subtotal"`
+	TaxTotal Money `json:"tax_total"`
+	Total    Money `json:"total"`
+	Paid     Money `json:"paid"`
+}
+
+// GetInvoiceTotals sums the invoices matched by filter in the database
+func (r *Repository) GetInvoiceTotals(filter InvoiceFilter) (*InvoiceTotals, error) {
+	var totals InvoiceTotals
+	err := filter.apply(r.db.Model(&Invoice{})).
+		Select(`COUNT(*) AS count, COALESCE(SUM(subtotal), 0) AS sub_total, COALESCE(SUM(tax_total), 0) AS tax_total,
+			COALESCE(SUM(total), 0) AS total,
+			COALESCE(SUM((SELECT SUM(amount) FROM payments WHERE payments.invoice_id = invoices.id)), 0) AS paid`).
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+	return &totals, nil
+}
+
+// Payment CRUD
+func (r *Repository) GetPayments(invoiceID uint) ([]Payment, error) {
+	var payments []Payment
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("date").Find(&payments).Error
+	return payments, err
+}
+
+// GetPaidAmount sums the payments received against the invoice
+func (r *Repository) GetPaidAmount(invoiceID uint) (Money, error) {
+	var paid Money
+	err := r.db.Model(&Payment{}).Where("invoice_id = ?", invoiceID).Select("COALESCE(SUM(amount), 0)").Scan(&paid).Error
+	return paid, err
+}
+
+// GetClientPayments returns every payment received for invoices billed to the given client
+func (r *Repository) GetClientPayments(clientID uint) ([]Payment, error) {
+	var payments []Payment
+	err := r.db.Joins("JOIN invoices ON invoices.id = payments.invoice_id").
+		Where("invoices.client_id = ?", clientID).
+		Order("payments.date").
+		Find(&payments).Error
+	return payments, err
+}
+
+// CreatePayment records a payment and marks the invoice as paid once the
+// payments cover its total
+func (r *Repository) CreatePayment(payment *Payment) error {
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			return createPayment(tx, payment)
+		})
+	})
+	if err != nil {
 		return err
 	}
-	// Then delete the main record
-	return r.db.Delete(&Invoice{}, id).Error
+	publishEvent(r, EventPaymentRecorded, payment)
+	return nil
 }
 
-func (r *Repository) Migrate() {
-	fmt.Println("Running migrations...")
-	db, err := gorm.Open(sqlite.Open(DATABASE_FILE), &gorm.Config{})
+// createPayment stores the payment, the invoice is paid once the payments
+// cover its total
+func createPayment(tx *gorm.DB, payment *Payment) error {
+	var invoice Invoice
+	if err := tx.First(&invoice, payment.InvoiceID).Error; err != nil {
+		return err
+	}
+	if !invoice.Type.Behavior().Payable {
+		return ErrDocumentNotPayable
+	}
+	if invoice.CancelledAt != nil {
+		return fmt.Errorf("invoice %d was cancelled: %w", invoice.ID, ErrDocumentNotPayable)
+	}
+
+	if err := tx.Create(payment).Error; err != nil {
+		return err
+	}
+
+	received, err := invoiceReceived(tx, invoice.ID)
 	if err != nil {
-		panic("failed to connect database")
+		return err
+	}
+
+	if received >= invoice.TotalAmount && !invoice.Paid {
+		return tx.Model(&invoice).Update("paid", true).Error
 	}
+	return nil
+}
 
-	// Migrate the schema
-	db.AutoMigrate(
-		&User{},
-		&RemitInformation{},
-		&RemitInformationLine{},
-		&Product{},
-		&Company{},
-		&Invoice{},
-		&InvoiceLine{},
-	)
-	fmt.Println("Migrations completed.")
+// invoiceReceived sums the payments of the invoice
+func invoiceReceived(tx *gorm.DB, invoiceID uint) (Money, error) {
+	var received Money
+	err := tx.Model(&Payment{}).Where("invoice_id = ?", invoiceID).Select("COALESCE(SUM(amount), 0)").Scan(&received).Error
+	return received, err
+}
+
+func (r *Repository) DeletePayment(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Delete(&Payment{}, id).Error
+	})
+}
+
+// SchemaDrift compares the live database schema against the models and
+// returns a description of every missing table, column, index or foreign
+// key. Nothing is changed in the database.
+func (r *Repository) SchemaDrift() ([]string, error) {
+	var drift []string
+	migrator := r.db.Migrator()
+
+	for _, model := range schemaModels {
+		stmt := &gorm.Statement{DB: r.db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+		table := stmt.Schema.Table
+
+		if !migrator.HasTable(model) {
+			drift = append(drift, fmt.Sprintf("missing table %s", table))
+			continue
+		}
+
+		for _, column := range stmt.Schema.DBNames {
+			// Computed fields are read from queries, they have no column
+			if stmt.Schema.FieldsByDBName[column].IgnoreMigration {
+				continue
+			}
+			if !migrator.HasColumn(model, column) {
+				drift = append(drift, fmt.Sprintf("missing column %s.%s", table, column))
+			}
+		}
+
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if !migrator.HasIndex(model, index.Name) {
+				drift = append(drift, fmt.Sprintf("missing index %s on %s", index.Name, table))
+			}
+		}
+
+		var constraints []string
+		for _, relation := range stmt.Schema.Relationships.Relations {
+			if relation.Field.IgnoreMigration {
+				continue
+			}
+			// Has-many relations are constrained on the other table
+			if constraint := relation.ParseConstraint(); constraint != nil && constraint.Schema == stmt.Schema {
+				constraints = append(constraints, constraint.Name)
+			}
+		}
+		sort.Strings(constraints)
+		for _, constraint := range constraints {
+			if !migrator.HasConstraint(model, constraint) {
+				drift = append(drift, fmt.Sprintf("missing foreign key %s on %s", constraint, table))
+			}
+		}
+	}
+
+	return drift, nil
 }
 
 // User CRUD
 func (r *Repository) CreateUser(user *User) error {
-	return r.db.Create(user).Error
+	return retryOnBusy(func() error {
+		return r.db.Create(user).Error
+	})
+}
+
+func (r *Repository) GetUser(id uint) (*User, error) {
+	var user User
+	if err := r.db.First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
 func (r *Repository) GetUserByUsername(username string) (*User, error) {
@@ -332,3 +1282,36 @@ func (r *Repository) GetUserByUsername(username string) (*User, error) {
 	}
 	return &user, nil
 }
+
+func (r *Repository) GetUsers() ([]User, error) {
+	var users []User
+	err := r.db.Order("username").Find(&users).Error
+	return users, err
+}
+
+// SetPassword replaces the password of the user, unlocking the account
+func (r *Repository) SetPassword(userID uint, passwordHash string) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var user User
+			if err := tx.First(&user, userID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&user).UpdateColumns(map[string]interface{}{
+				"password_hash":       passwordHash,
+				"must_reset_password": false,
+				"failed_logins":       0,
+				"locked_until":        nil,
+			}).Error; err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, &user, user.Username, AuditPasswordReset, "set from the command line")
+		})
+	})
+}
+
+// Backup copies the database into a new SQLite file, a consistent
+// snapshot even while other connections write
+func (r *Repository) Backup(path string) error {
+	return r.db.Exec("VACUUM INTO ?", path).Error
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	busyRetryAttempts  = 5
+	busyRetryBaseDelay = 20 * time.Millisecond
+)
+
+// isBusyError reports whether err is SQLite refusing a write because
+// another connection holds the lock
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// writeBusyResponse tells the client the database is busy and to try again
+func writeBusyResponse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "The database is busy, please retry in a moment", http.StatusServiceUnavailable)
+}
+
+// databaseErrorContextKey holds where writeDatabaseError records the error
+// of the request, for the unit of work to know why the handler failed
+type databaseErrorContextKey struct{}
+
+// writeDatabaseError answers with 503 for busy errors and 500 otherwise,
+// recording the error for the unit of work of the request
+func writeDatabaseError(w http.ResponseWriter, r *http.Request, err error) {
+	if recorded, ok := r.Context().Value(databaseErrorContextKey{}).(*error); ok {
+		*recorded = err
+	}
+	if isBusyError(err) {
+		writeBusyResponse(w)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// retryOnBusy runs a write, retrying with exponential backoff and jitter
+// while the database is busy. Other errors are returned immediately. A
+// write done marks the read models stale. Transactions take the write lock
+// when they begin, so a busy one is retried whole rather than failing a
+// statement it can't take the lock for anymore.
+func retryOnBusy(write func() error) error {
+	var err error
+	for attempt := 0; attempt < busyRetryAttempts; attempt++ {
+		err = write()
+		if err == nil {
+			dataWritten()
+			return nil
+		}
+		if !isBusyError(err) {
+			return err
+		}
+
+		delay := busyRetryBaseDelay << attempt
+		time.Sleep(delay/2 + rand.N(delay/2))
+	}
+	return err
+}
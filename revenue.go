@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RevenueGrouping is what the revenue report adds up by
+type RevenueGrouping string
+
+const (
+	RevenueByMonth   RevenueGrouping = "month"
+	RevenueByClient  RevenueGrouping = "client"
+	RevenueByProduct RevenueGrouping = "product"
+)
+
+// noProduct groups the invoice lines billed without a product
+const noProduct = "No product"
+
+// RevenueLine is a line of the revenue report. Group is the month, as
+// 2024-05, or the name of the client or product, whose ID is then given.
+// Invoiced is invoices minus credit notes issued in the period, Received
+// the payments made in the period.
+type RevenueLine struct {
+	Group    string `json:"group"`
+	ID       *uint  `json:"id"`
+	Invoiced Money  `json:"invoiced"`
+	Received Money  `json:"received"`
+}
+
+// revenueRow is an amount the database added up for a group
+type revenueRow struct {
+	Group  string
+	ID     *uint
+	Amount Money
+}
+
+// revenueGroupColumns are the SQL grouping the invoices, joined with their
+// clients, or their lines, joined with their products
+func revenueGroupColumns(groupBy RevenueGrouping, date string) (string, string) {
+	switch groupBy {
+	case RevenueByClient:
+		return "companies.name", "companies.id"
+	case RevenueByProduct:
+		return fmt.Sprintf("COALESCE(products.name, '%s')", noProduct), "products.id"
+	}
+	// Dates are stored as text, the month is the start of it
+	return "SUBSTR(" + date + ", 1, 7)", "NULL"
+}
+
+// GetRevenue adds up in the database what was invoiced and received in
+// the period, by month, client or product. Products are invoiced what
+// their lines add up to, before line and invoice discounts and penalties,
+// and received the payments of their invoices in proportion. from and to
+// are inclusive and optional, the issuer leaves out the invoices of the
+// others when given.
+func (r *Repository) GetRevenue(groupBy RevenueGrouping, from, to *time.Time, issuerID *uint) ([]RevenueLine, error) {
+	inPeriod := func(query *gorm.DB, column string) *gorm.DB {
+		if from != nil {
+			query = query.Where(column+" >= ?", *from)
+		}
+		if to != nil {
+			query = query.Where(column+" < ?", to.AddDate(0, 0, 1))
+		}
+		return query
+	}
+	scan := func(query *gorm.DB, date, amount string) ([]revenueRow, error) {
+		group, id := revenueGroupColumns(groupBy, date)
+		var rows []revenueRow
+		err := inPeriod(query, date).
+			Select(fmt.Sprintf("%s AS `group`, %s AS id, ROUND(COALESCE(SUM(%s), 0), 2) AS amount", group, id, amount)).
+			Group("1, 2").Scan(&rows).Error
+		return rows, err
+	}
+
+	invoices := r.db.Table("invoices").Where(balanceSignSQL() + " <> 0")
+	payments := r.db.Table("payments").Joins("JOIN invoices ON invoices.id = payments.invoice_id")
+	if issuerID != nil {
+		invoices = invoices.Where("invoices.company_id = ?", *issuerID)
+		payments = payments.Where("invoices.company_id = ?", *issuerID)
+	}
+	invoicedAmount, receivedAmount := balanceSignSQL()+" * invoices.total", "payments.amount"
+	switch groupBy {
+	case RevenueByClient:
+		invoices = invoices.Joins("JOIN companies ON companies.id = invoices.client_id")
+		payments = payments.Joins("JOIN companies ON companies.id = invoices.client_id")
+	case RevenueByProduct:
+		lines := func(query *gorm.DB) *gorm.DB {
+			return query.Joins("JOIN invoice_lines ON invoice_lines.invoice_id = invoices.id").
+				Joins("LEFT JOIN products ON products.id = invoice_lines.product_id").
+				Where("invoice_lines.type <> ?", LineSection)
+		}
+		invoices, payments = lines(invoices), lines(payments.Where("invoices.subtotal <> 0"))
+		invoicedAmount = balanceSignSQL() + " * invoice_lines.unit_price * invoice_lines.quantity"
+		receivedAmount = "payments.amount * invoice_lines.unit_price * invoice_lines.quantity / invoices.subtotal"
+	}
+
+	invoiced, err := scan(invoices, "invoices.issue_date", invoicedAmount)
+	if err != nil {
+		return nil, err
+	}
+	received, err := scan(payments, "payments.date", receivedAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	report := map[string]*RevenueLine{}
+	lineFor := func(row revenueRow) *RevenueLine {
+		key := row.Group
+		if row.ID != nil {
+			key = fmt.Sprint(*row.ID)
+		}
+		if report[key] == nil {
+			report[key] = &RevenueLine{Group: row.Group, ID: row.ID}
+		}
+		return report[key]
+	}
+	for _, row := range invoiced {
+		lineFor(row).Invoiced += row.Amount
+	}
+	for _, row := range received {
+		lineFor(row).Received += row.Amount
+	}
+
+	lines := []RevenueLine{}
+	for _, line := range report {
+		lines = append(lines, *line)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if groupBy != RevenueByMonth && lines[i].Invoiced != lines[j].Invoiced {
+			return lines[i].Invoiced > lines[j].Invoiced
+		}
+		return lines[i].Group < lines[j].Group
+	})
+	return lines, nil
+}
+
+func (h *Handler) getRevenue(w http.ResponseWriter, r *http.Request) {
+	groupBy := RevenueGrouping(r.URL.Query().Get("group_by"))
+	switch groupBy {
+	case "":
+		groupBy = RevenueByMonth
+	case RevenueByMonth, RevenueByClient, RevenueByProduct:
+	default:
+		http.Error(w, "Invalid group_by, expected month, client or product", http.StatusBadRequest)
+		return
+	}
+	from, err := parseDateQuery(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateQuery(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	issuerID, err := parseOptionalUint(r, "company_id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines, err := h.storeFor(r).GetRevenue(groupBy, from, to, issuerID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	writeRecords(w, r, "revenue_by_"+string(groupBy), lines)
+}
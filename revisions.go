@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InvoiceRevision keeps an invoice as it was before an update, as the
+// update replaces its lines. Revisions are numbered from 1 per invoice.
+type InvoiceRevision struct {
+	ID        uint            `gorm:"primaryKey" json:"id"`
+	InvoiceID uint            `gorm:"not null;uniqueIndex:idx_invoice_revisions_revision" json:"invoice_id"`
+	Invoice   Invoice         `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Revision  int             `gorm:"not null;uniqueIndex:idx_invoice_revisions_revision" json:"revision"`
+	Snapshot  InvoiceSnapshot `gorm:"type:text;not null" json:"snapshot"`
+	CreatedAt time.Time       `json:"created_at"`
+	// Changes is what the update made of the revision, up to the next
+	// revision or the current invoice
+	Changes []RevisionChange `gorm:"-" json:"changes"`
+}
+
+// InvoiceSnapshot is the header and lines of an invoice, without the
+// companies, remit information and products it refers to
+type InvoiceSnapshot struct {
+	Type                  DocumentType          `json:"type"`
+	Locale                Locale                `json:"locale"`
+	Number                *int                  `json:"number"`
+	Code                  string                `json:"code"`
+	IssueDate             time.Time             `json:"issue_date"`
+	DueDate               time.Time             `json:"due_date"`
+	CompanyID             uint                  `json:"company_id"`
+	ClientID              uint                  `json:"client_id"`
+	RemitInformationID    uint                  `json:"remit_information_id"`
+	ProjectID             *uint                 `json:"project_id"`
+	InvoiceTemplateID     *uint                 `json:"invoice_template_id"`
+	AdditionalInformation *string               `json:"additional_information"`
+	Discount              Money                 `json:"discount"`
+	DiscountType          AdjustmentType        `json:"discount_type"`
+	Penalty               Money                 `json:"penalty"`
+	PenaltyType           AdjustmentType        `json:"penalty_type"`
+	Paid                  bool                  `json:"paid"`
+	SubTotal              Money                 `json:"subtotal"`
+	Total                 Money                 `json:"total"`
+	Lines                 []InvoiceLineSnapshot `json:"lines"`
+}
+
+type InvoiceLineSnapshot struct {
+	Type         LineType       `json:"type"`
+	ProductID    *uint          `json:"product_id"`
+	Description  *string        `json:"description"`
+	Quantity     float64        `json:"quantity"`
+	Unit         Unit           `json:"unit"`
+	UnitPrice    Money          `json:"unit_price"`
+	Discount     Money          `json:"discount"`
+	DiscountType AdjustmentType `json:"discount_type"`
+	Total        Money          `json:"total"`
+}
+
+func snapshotInvoice(invoice *Invoice) InvoiceSnapshot {
+	snapshot := InvoiceSnapshot{
+		Type:                  invoice.Type,
+		Locale:                invoice.Locale,
+		Number:                invoice.Number,
+		Code:                  invoice.Code,
+		IssueDate:             invoice.IssueDate,
+		DueDate:               invoice.DueDate,
+		CompanyID:             invoice.CompanyID,
+		ClientID:              invoice.ClientID,
+		RemitInformationID:    invoice.RemitInformationID,
+		ProjectID:             invoice.ProjectID,
+		InvoiceTemplateID:     invoice.InvoiceTemplateID,
+		AdditionalInformation: invoice.AdditionalInformation,
+		Discount:              invoice.Discount,
+		DiscountType:          invoice.DiscountType,
+		Penalty:               invoice.Penalty,
+		PenaltyType:           invoice.PenaltyType,
+		Paid:                  invoice.Paid,
+		SubTotal:              invoice.SubTotal(),
+		Total:                 invoice.Total(),
+		Lines:                 []InvoiceLineSnapshot{},
+	}
+	for _, line := range invoice.InvoiceLines {
+		snapshot.Lines = append(snapshot.Lines, InvoiceLineSnapshot{
+			Type:         line.Type,
+			ProductID:    line.ProductID,
+			Description:  line.Description,
+			Quantity:     line.Quantity,
+			Unit:         line.Unit,
+			UnitPrice:    line.UnitPrice,
+			Discount:     line.Discount,
+			DiscountType: line.DiscountType,
+			Total:        line.Total(),
+		})
+	}
+	return snapshot
+}
+
+func (s InvoiceSnapshot) Value() (driver.Value, error) {
+	encoded, err := json.Marshal(s)
+	return string(encoded), err
+}
+
+func (s *InvoiceSnapshot) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	case []byte:
+		return json.Unmarshal(v, s)
+	default:
+		return fmt.Errorf("cannot scan %T into InvoiceSnapshot", value)
+	}
+}
+
+// RevisionChange is a field of the invoice, or of one of its lines, that
+// changed. Lines are compared by their place on the invoice, from 1, and a
+// line added or removed is a change of the whole line.
+type RevisionChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// diffFields compares the fields of two structs of the same type by their
+// JSON, slices left out
+func diffFields(prefix string, from, to reflect.Value) []RevisionChange {
+	var changes []RevisionChange
+	for i := 0; i < from.NumField(); i++ {
+		field := from.Type().Field(i)
+		if field.Type.Kind() == reflect.Slice {
+			continue
+		}
+		fromValue, toValue := from.Field(i).Interface(), to.Field(i).Interface()
+		fromJSON, _ := json.Marshal(fromValue)
+		toJSON, _ := json.Marshal(toValue)
+		if !bytes.Equal(fromJSON, toJSON) {
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			changes = append(changes, RevisionChange{Field: prefix + name, From: fromValue, To: toValue})
+		}
+	}
+	return changes
+}
+
+// diffSnapshots lists what changed from one snapshot to the other
+func diffSnapshots(from, to *InvoiceSnapshot) []RevisionChange {
+	changes := diffFields("", reflect.ValueOf(*from), reflect.ValueOf(*to))
+	for i := 0; i < len(from.Lines) || i < len(to.Lines); i++ {
+		field := fmt.Sprintf("lines[%d]", i+1)
+		switch {
+		case i >= len(from.Lines):
+			changes = append(changes, RevisionChange{Field: field, To: to.Lines[i]})
+		case i >= len(to.Lines):
+			changes = append(changes, RevisionChange{Field: field, From: from.Lines[i]})
+		default:
+			changes = append(changes, diffFields(field+".", reflect.ValueOf(from.Lines[i]), reflect.ValueOf(to.Lines[i]))...)
+		}
+	}
+	if changes == nil {
+		changes = []RevisionChange{}
+	}
+	return changes
+}
+
+// recordInvoiceRevision keeps previous as the next revision of the invoice
+// once updated, unless the update changed nothing
+func recordInvoiceRevision(tx *gorm.DB, previous *Invoice) error {
+	var updated Invoice
+	if err := tx.Preload("InvoiceLines", orderInvoiceLines).First(&updated, previous.ID).Error; err != nil {
+		return err
+	}
+	snapshot, current := snapshotInvoice(previous), snapshotInvoice(&updated)
+	if len(diffSnapshots(&snapshot, &current)) == 0 {
+		return nil
+	}
+
+	var latest int
+	if err := tx.Model(&InvoiceRevision{}).Where("invoice_id = ?", previous.ID).
+		Select("COALESCE(MAX(revision), 0)").Scan(&latest).Error; err != nil {
+		return err
+	}
+	return tx.Create(&InvoiceRevision{InvoiceID: previous.ID, Revision: latest + 1, Snapshot: snapshot}).Error
+}
+
+// GetInvoiceRevisions returns the revisions of the invoice, oldest first,
+// each with the changes made to it
+func (r *Repository) GetInvoiceRevisions(invoiceID uint) ([]InvoiceRevision, error) {
+	invoice, err := r.GetInvoice(invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	var revisions []InvoiceRevision
+	if err := r.db.Where("invoice_id = ?", invoiceID).Order("revision").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+
+	current := snapshotInvoice(invoice)
+	for i := range revisions {
+		next := &current
+		if i+1 < len(revisions) {
+			next = &revisions[i+1].Snapshot
+		}
+		revisions[i].Changes = diffSnapshots(&revisions[i].Snapshot, next)
+	}
+	return revisions, nil
+}
+
+func (h *Handler) getInvoiceRevisions(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := h.storeFor(r).GetInvoiceRevisions(uint(invoiceId))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
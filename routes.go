@@ -0,0 +1,400 @@
+package main
+
+import "net/http"
+
+// The paths of the manifest. The tests build their requests from them, so
+// a route renamed or removed here fails to compile rather than leaving
+// them testing a 404.
+const (
+	pathRoot                        = "/"
+	pathDashboard                   = "/dashboard"
+	pathNewInvoice                  = "/invoices/new"
+	pathProductSearch               = "/product/search"
+	pathNewInvoiceLines             = "/invoices/new/lines"
+	pathNewInvoiceTotal             = "/invoices/new/total"
+	pathApp                         = "/app"
+	pathAuthLogin                   = "/auth/login"
+	pathAuthCallback                = "/auth/callback"
+	pathAuthPasswordReset           = "/auth/password_reset"
+	pathPortal                      = "/portal"
+	pathPortalInvoices              = "/portal/invoices"
+	pathPortalInvoice               = "/portal/invoices/{invoiceId}"
+	pathPortalStatement             = "/portal/statement"
+	pathSharedInvoice               = "/i/{invoiceUUID}"
+	pathSurvey                      = "/survey/{invoiceUUID}"
+	pathSharedInvoiceDispute        = "/i/{invoiceUUID}/dispute"
+	pathWhatsappCloudWebhook        = "/webhooks/whatsapp/cloud"
+	pathWhatsappWebhook             = "/webhooks/whatsapp/{provider}"
+	pathCalendar                    = "/calendar.ics"
+	pathCalendarToken               = "/api/calendar_token"
+	pathCompanies                   = "/api/companies"
+	pathCompaniesBulk               = "/api/companies/bulk"
+	pathCompany                     = "/api/companies/{companyId}"
+	pathCompanyArchive              = "/api/companies/{companyId}/archive.zip"
+	pathCompanyOverview             = "/api/companies/{companyId}/overview"
+	pathCompanyStatement            = "/api/companies/{companyId}/statement"
+	pathCompanyStatementEmail       = "/api/companies/{companyId}/statement/email"
+	pathReferralSources             = "/api/referral_sources"
+	pathReferralSource              = "/api/referral_sources/{sourceId}"
+	pathCategories                  = "/api/categories"
+	pathCategory                    = "/api/categories/{categoryId}"
+	pathReportsRevenue              = "/api/reports/revenue"
+	pathReportsClients              = "/api/reports/clients"
+	pathReportsRevenueByCategory    = "/api/reports/revenue_by_category"
+	pathReportsRevenueBySource      = "/api/reports/revenue_by_source"
+	pathReportsStorage              = "/api/reports/storage"
+	pathReportsProjectProfitability = "/api/reports/project_profitability"
+	pathReportsInvoiceTotals        = "/api/reports/invoice_totals"
+	pathReportsRecurringRevenue     = "/api/reports/recurring_revenue"
+	pathCompanyLogo                 = "/api/companies/{companyId}/logo"
+	pathCompanySurveys              = "/api/companies/{companyId}/surveys"
+	pathCompanyPortalUsers          = "/api/companies/{companyId}/portal_users"
+	pathCompanyPortalUser           = "/api/companies/{companyId}/portal_users/{userId}"
+	pathSurveysScore                = "/api/surveys/score"
+	pathCompanyInvoiceTemplates     = "/api/companies/{companyId}/invoice_templates"
+	pathInvoiceTemplate             = "/api/invoice_templates/{templateId}"
+	pathInvoiceTemplateVersions     = "/api/invoice_templates/{templateId}/versions"
+	pathRemits                      = "/api/remit"
+	pathRemit                       = "/api/remit/{remitId}"
+	pathRemitClone                  = "/api/remit/{remitId}/clone"
+	pathRemitLinesOrder             = "/api/remit/{remitId}/lines/order"
+	pathRemitLineMove               = "/api/remit/{remitId}/lines/{lineId}/move"
+	pathProducts                    = "/api/products"
+	pathProduct                     = "/api/products/{productId}"
+	pathProductArchive              = "/api/products/{productId}/archive"
+	pathProductUnarchive            = "/api/products/{productId}/unarchive"
+	pathProductPrices               = "/api/products/{productId}/prices"
+	pathInvoices                    = "/api/invoices"
+	pathInvoicesBulk                = "/api/invoices/bulk"
+	pathInvoicesBulkStatus          = "/api/invoices/bulk-status"
+	pathInvoicesPDFBatch            = "/api/invoices/pdf-batch"
+	pathInvoice                     = "/api/invoices/{invoiceId}"
+	pathInvoiceOpen                 = "/api/invoices/{invoiceId}/open"
+	pathInvoicePreview              = "/api/invoices/{invoiceId}/preview"
+	pathInvoiceFacturX              = "/api/invoices/{invoiceId}/facturx"
+	pathInvoiceUBL                  = "/api/invoices/{invoiceId}/ubl.xml"
+	pathInvoiceNFSe                 = "/api/invoices/{invoiceId}/nfse.xml"
+	pathInvoicePeppol               = "/api/invoices/{invoiceId}/peppol"
+	pathInvoicePayments             = "/api/invoices/{invoiceId}/payments"
+	pathPayment                     = "/api/payments/{paymentId}"
+	pathPaymentsImport              = "/api/payments/import"
+	pathBankTransactions            = "/api/bank_transactions"
+	pathBankTransactionAssign       = "/api/bank_transactions/{transactionId}/assign"
+	pathBankTransactionConfirm      = "/api/bank_transactions/{transactionId}/confirm"
+	pathBankTransactionReject       = "/api/bank_transactions/{transactionId}/reject"
+	pathBankReconciliation          = "/api/bank/reconciliation"
+	pathBankPoll                    = "/api/bank/poll"
+	pathInvoiceLock                 = "/api/invoices/{invoiceId}/lock"
+	pathInvoiceSend                 = "/api/invoices/{invoiceId}/send"
+	pathInvoiceConvert              = "/api/invoices/{invoiceId}/convert"
+	pathInvoiceShare                = "/api/invoices/{invoiceId}/share"
+	pathInvoiceTimeline             = "/api/invoices/{invoiceId}/timeline"
+	pathInvoiceRevisions            = "/api/invoices/{invoiceId}/revisions"
+	pathInvoiceEmails               = "/api/invoices/{invoiceId}/emails"
+	pathInvoiceWhatsapp             = "/api/invoices/{invoiceId}/whatsapp"
+	pathInvoiceComments             = "/api/invoices/{invoiceId}/comments"
+	pathComment                     = "/api/comments/{commentId}"
+	pathInvoiceDisputes             = "/api/invoices/{invoiceId}/disputes"
+	pathInvoiceDisputeResolve       = "/api/invoices/{invoiceId}/dispute/resolve"
+	pathEmailLogs                   = "/api/email_logs"
+	pathEmailEvents                 = "/api/email_events/{provider}"
+	pathInboundEmails               = "/api/inbound_emails"
+	pathInboundEmail                = "/api/inbound_emails/{emailId}"
+	pathInboundEmailCompany         = "/api/inbound_emails/{emailId}/company"
+	pathInvoiceRemindersSnooze      = "/api/invoices/{invoiceId}/reminders/snooze"
+	pathInvoiceRemindersSchedule    = "/api/invoices/{invoiceId}/reminders/schedule"
+	pathRemindersDue                = "/api/reminders/due"
+	pathRemindersSend               = "/api/reminders/send"
+	pathDigest                      = "/api/digest"
+	pathDigestSend                  = "/api/digest/send"
+	pathProjects                    = "/api/projects"
+	pathProject                     = "/api/projects/{projectId}"
+	pathProjectTasks                = "/api/projects/{projectId}/tasks"
+	pathTask                        = "/api/tasks/{taskId}"
+	pathProjectTimeEntries          = "/api/projects/{projectId}/time_entries"
+	pathTimeEntry                   = "/api/time_entries/{timeEntryId}"
+	pathDeliverables                = "/api/deliverables"
+	pathDeliverable                 = "/api/deliverables/{deliverableId}"
+	pathDeliverablesConsolidate     = "/api/deliverables/consolidate"
+	pathCompanyConsolidate          = "/api/companies/{companyId}/consolidate"
+	pathBillingRun                  = "/api/billing/run"
+	pathContracts                   = "/api/contracts"
+	pathContract                    = "/api/contracts/{contractId}"
+	pathTags                        = "/api/tags"
+	pathTag                         = "/api/tags/{tag}"
+	pathCustomFields                = "/api/custom_fields"
+	pathCustomField                 = "/api/custom_fields/{customFieldId}"
+	pathPriceLists                  = "/api/price_lists"
+	pathPriceList                   = "/api/price_lists/{priceListId}"
+	pathGraphQL                     = "/graphql"
+	pathListColumns                 = "/api/list_columns/{list}"
+	pathSavedViews                  = "/api/saved_views"
+	pathSavedView                   = "/api/saved_views/{savedViewId}"
+	pathListInvoiceTemplates        = "/api/list_invoice_templates"
+	pathUserForcePasswordReset      = "/api/users/{userId}/force_password_reset"
+	pathAuditEvents                 = "/api/audit_events"
+	pathAdminLoginAttempts          = "/admin/login-attempts"
+	pathSettings                    = "/api/settings"
+	pathAdminExport                 = "/admin/export"
+	pathAdminImport                 = "/admin/import"
+	pathAdminJobs                   = "/admin/jobs"
+	pathAdminJobRetry               = "/admin/jobs/{jobId}/retry"
+	pathAdminClock                  = "/admin/clock"
+	pathAdminDBStats                = "/admin/db-stats"
+	pathLogout                      = "/api/logout"
+)
+
+// RouteAccess is who may call a route
+type RouteAccess int
+
+const (
+	// RoutePublic routes authenticate the caller themselves, if at all
+	RoutePublic RouteAccess = iota
+	// RouteUser routes need a signed in user
+	RouteUser
+	// RouteAdmin routes need an administrator
+	RouteAdmin
+	// RouteClient routes need a client user, whose company they show
+	RouteClient
+)
+
+// Route is an entry of the route manifest
+type Route struct {
+	// Pattern is the ServeMux pattern, method and path
+	Pattern string
+	Access  RouteAccess
+	Handler http.HandlerFunc
+}
+
+// routes is the manifest of every route the server answers, registered by
+// setupRoutes
+func routes(h *Handler, testing bool) []Route {
+	return []Route{
+		// The root leads to the dashboard
+		{pathRoot, RoutePublic, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != pathRoot {
+				http.NotFound(w, r)
+				return
+			}
+			// Without a session, OpenID Connect users sign in first
+			if !testing && !h.noAuth && h.oidc != nil && h.sessionUser(r) == nil && r.Header.Get("Authorization") == "" {
+				http.Redirect(w, r, pathAuthLogin, http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, pathDashboard, http.StatusFound)
+		}},
+		{"GET " + pathDashboard, RouteUser, h.viewDashboard},
+		// Composing an invoice with HTMX, the form posting the fragments
+		{"GET " + pathNewInvoice, RouteUser, h.viewInvoiceBuilder},
+		{"POST " + pathNewInvoice, RouteUser, h.createBuilderInvoice},
+		{"GET " + pathProductSearch, RouteUser, h.searchProducts},
+		{"POST " + pathNewInvoiceLines, RouteUser, h.addInvoiceBuilderLine},
+		{"DELETE " + pathNewInvoiceLines, RouteUser, h.removeInvoiceBuilderLine},
+		{"POST " + pathNewInvoiceTotal, RouteUser, h.getInvoiceBuilderTotal},
+		// The application managing the records, talking to the API
+		{"GET " + pathApp, RoutePublic, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "templates/index.html")
+		}},
+
+		// OpenID Connect sign in, when enabled
+		{"GET " + pathAuthLogin, RoutePublic, h.oidcLogin},
+		{"GET " + pathAuthCallback, RoutePublic, h.oidcCallback},
+
+		// Password resets, authenticated by the emailed token
+		{"GET " + pathAuthPasswordReset, RoutePublic, h.viewPasswordReset},
+		{"POST " + pathAuthPasswordReset, RoutePublic, h.submitPasswordReset},
+
+		// The client portal, scoped to the company of the client user
+		{"GET " + pathPortal, RouteClient, h.viewPortal},
+		{"GET " + pathPortalInvoices, RouteClient, h.getPortalInvoices},
+		{"GET " + pathPortalInvoice, RouteClient, h.viewPortalInvoice},
+		{"GET " + pathPortalStatement, RouteClient, h.getPortalStatement},
+
+		// Public invoice links, authenticated by their signature
+		{"GET " + pathSharedInvoice, RoutePublic, h.viewSharedInvoice},
+		{"GET " + pathSurvey, RoutePublic, h.viewSurvey},
+		{"POST " + pathSurvey, RoutePublic, h.submitSurvey},
+		{"GET " + pathSharedInvoiceDispute, RoutePublic, h.viewDispute},
+		{"POST " + pathSharedInvoiceDispute, RoutePublic, h.submitDispute},
+
+		// WhatsApp delivery statuses, authenticated by the provider's signature
+		{"GET " + pathWhatsappCloudWebhook, RoutePublic, h.verifyWhatsAppWebhook},
+		{"POST " + pathWhatsappWebhook, RoutePublic, h.receiveWhatsAppStatus},
+
+		// The calendar feed, authenticated by the token of the user
+		{"GET " + pathCalendar, RoutePublic, h.getCalendar},
+		{"POST " + pathCalendarToken, RouteUser, h.createCalendarToken},
+		{"DELETE " + pathCalendarToken, RouteUser, h.revokeCalendarToken},
+
+		// Protected API routes
+		{"GET " + pathCompanies, RouteUser, h.getCompanies},
+		{"POST " + pathCompanies, RouteUser, h.createCompany},
+		{"POST " + pathCompaniesBulk, RouteUser, h.bulkUpdateCompanies},
+		{"GET " + pathCompany, RouteUser, h.getCompany},
+		{"PUT " + pathCompany, RouteUser, h.updateCompany},
+		{"DELETE " + pathCompany, RouteUser, h.deleteCompany},
+		{"GET " + pathCompanyArchive, RouteUser, h.getClientArchive},
+		{"GET " + pathCompanyOverview, RouteUser, h.reportMiddleware(h.getCompanyOverview)},
+		{"GET " + pathCompanyStatement, RouteUser, h.reportMiddleware(h.getStatement)},
+		{"POST " + pathCompanyStatementEmail, RouteUser, h.emailStatement},
+		{"GET " + pathReferralSources, RouteUser, h.getReferralSources},
+		{"POST " + pathReferralSources, RouteUser, h.createReferralSource},
+		{"DELETE " + pathReferralSource, RouteUser, h.deleteReferralSource},
+		{"GET " + pathCategories, RouteUser, h.getCategories},
+		{"POST " + pathCategories, RouteUser, h.createCategory},
+		{"DELETE " + pathCategory, RouteUser, h.deleteCategory},
+		{"GET " + pathReportsRevenue, RouteUser, h.reportMiddleware(h.getRevenue)},
+		{"GET " + pathReportsClients, RouteUser, h.reportMiddleware(h.getClientReport)},
+		{"GET " + pathReportsRevenueByCategory, RouteUser, h.reportMiddleware(h.getRevenueByCategory)},
+		{"GET " + pathReportsRevenueBySource, RouteUser, h.reportMiddleware(h.getRevenueBySource)},
+		{"GET " + pathReportsStorage, RouteUser, h.reportMiddleware(h.getStorageUsage)},
+		{"GET " + pathReportsProjectProfitability, RouteUser, h.reportMiddleware(h.getProjectProfitability)},
+		{"GET " + pathReportsInvoiceTotals, RouteUser, h.reportMiddleware(h.getInvoiceTotals)},
+		{"GET " + pathReportsRecurringRevenue, RouteUser, h.reportMiddleware(h.getRecurringRevenue)},
+		{"GET " + pathCompanyLogo, RouteUser, h.getCompanyLogo},
+		{"PUT " + pathCompanyLogo, RouteUser, h.uploadCompanyLogo},
+		{"DELETE " + pathCompanyLogo, RouteUser, h.deleteCompanyLogo},
+		{"GET " + pathCompanySurveys, RouteUser, h.getCompanySurveys},
+		{"GET " + pathCompanyPortalUsers, RouteAdmin, h.getCompanyUsers},
+		{"POST " + pathCompanyPortalUsers, RouteAdmin, h.createCompanyUser},
+		{"DELETE " + pathCompanyPortalUser, RouteAdmin, h.deleteCompanyUser},
+		{"GET " + pathSurveysScore, RouteUser, h.reportMiddleware(h.getNPSScore)},
+		{"GET " + pathCompanyInvoiceTemplates, RouteUser, h.getInvoiceTemplates},
+		{"POST " + pathCompanyInvoiceTemplates, RouteUser, h.createInvoiceTemplate},
+		{"GET " + pathInvoiceTemplate, RouteUser, h.getInvoiceTemplate},
+		{"PUT " + pathInvoiceTemplate, RouteUser, h.updateInvoiceTemplate},
+		{"DELETE " + pathInvoiceTemplate, RouteUser, h.deleteInvoiceTemplate},
+		{"GET " + pathInvoiceTemplateVersions, RouteUser, h.getInvoiceTemplateVersions},
+
+		{"GET " + pathRemits, RouteUser, h.getRemitInformations},
+		{"POST " + pathRemits, RouteUser, h.createRemitInformation},
+		{"GET " + pathRemit, RouteUser, h.getRemitInformation},
+		{"POST " + pathRemitClone, RouteUser, h.cloneRemitInformation},
+		{"PUT " + pathRemitLinesOrder, RouteUser, h.reorderRemitLines},
+		{"POST " + pathRemitLineMove, RouteUser, h.moveRemitLine},
+		{"PUT " + pathRemit, RouteUser, h.updateRemitInformation},
+		{"DELETE " + pathRemit, RouteUser, h.deleteRemitInformation},
+
+		{"GET " + pathProducts, RouteUser, h.getProducts},
+		{"POST " + pathProducts, RouteUser, h.createProduct},
+		{"GET " + pathProduct, RouteUser, h.getProduct},
+		{"PUT " + pathProduct, RouteUser, h.updateProduct},
+		{"DELETE " + pathProduct, RouteUser, h.deleteProduct},
+		{"POST " + pathProductArchive, RouteUser, h.archiveProduct},
+		{"POST " + pathProductUnarchive, RouteUser, h.unarchiveProduct},
+		{"GET " + pathProductPrices, RouteUser, h.getProductPrices},
+
+		{"GET " + pathInvoices, RouteUser, h.getInvoices},
+		{"POST " + pathInvoices, RouteUser, h.createInvoice},
+		{"POST " + pathInvoicesBulk, RouteUser, h.bulkUpdateInvoices},
+		{"POST " + pathInvoicesBulkStatus, RouteUser, h.bulkUpdateInvoiceStatus},
+		{"POST " + pathInvoicesPDFBatch, RouteUser, h.postInvoicePDFBatch},
+		{"GET " + pathInvoice, RouteUser, h.getInvoice},
+		{"PUT " + pathInvoice, RouteUser, h.updateInvoice},
+		{"DELETE " + pathInvoice, RouteUser, h.deleteInvoice},
+		{"GET " + pathInvoiceOpen, RouteUser, h.openInvoice},
+		{"GET " + pathInvoicePreview, RouteUser, h.previewInvoice},
+		{"GET " + pathInvoiceFacturX, RouteUser, h.getInvoiceFacturX},
+		{"GET " + pathInvoiceUBL, RouteUser, h.getInvoiceUBL},
+		{"GET " + pathInvoiceNFSe, RouteUser, h.getInvoiceNFSe},
+		{"GET " + pathInvoicePeppol, RouteUser, h.getPeppolTransmissions},
+		{"POST " + pathInvoicePeppol, RouteUser, h.postPeppolTransmission},
+		{"GET " + pathInvoicePayments, RouteUser, h.getPayments},
+		{"POST " + pathInvoicePayments, RouteUser, h.createPayment},
+		{"DELETE " + pathPayment, RouteUser, h.deletePayment},
+		{"POST " + pathPaymentsImport, RouteUser, h.importBankStatement},
+		{"GET " + pathBankTransactions, RouteUser, h.getBankTransactions},
+		{"POST " + pathBankTransactionAssign, RouteUser, h.assignBankTransaction},
+		{"POST " + pathBankTransactionConfirm, RouteUser, h.confirmBankTransaction},
+		{"POST " + pathBankTransactionReject, RouteUser, h.rejectBankTransaction},
+		{"GET " + pathBankReconciliation, RouteUser, h.getBankReconciliation},
+		{"POST " + pathBankPoll, RouteAdmin, h.postBankPoll},
+		{"GET " + pathInvoiceLock, RouteUser, h.getInvoiceLock},
+		{"POST " + pathInvoiceLock, RouteUser, h.lockInvoice},
+		{"DELETE " + pathInvoiceLock, RouteUser, h.unlockInvoice},
+		{"POST " + pathInvoiceSend, RouteUser, h.sendInvoice},
+		{"POST " + pathInvoiceConvert, RouteUser, h.convertDocument},
+		{"GET " + pathInvoiceShare, RouteUser, h.shareInvoice},
+		{"GET " + pathInvoiceTimeline, RouteUser, h.getInvoiceTimeline},
+		{"GET " + pathInvoiceRevisions, RouteUser, h.getInvoiceRevisions},
+		{"GET " + pathInvoiceEmails, RouteUser, h.getInvoiceEmails},
+		{"GET " + pathInvoiceWhatsapp, RouteUser, h.getInvoiceWhatsAppMessages},
+		{"POST " + pathInvoiceWhatsapp, RouteUser, h.sendInvoiceWhatsApp},
+		{"GET " + pathInvoiceComments, RouteUser, h.getInvoiceComments},
+		{"POST " + pathInvoiceComments, RouteUser, h.createInvoiceComment},
+		{"DELETE " + pathComment, RouteUser, h.deleteInvoiceComment},
+		{"GET " + pathInvoiceDisputes, RouteUser, h.getInvoiceDisputes},
+		{"POST " + pathInvoiceDisputeResolve, RouteUser, h.resolveInvoiceDispute},
+		{"GET " + pathEmailLogs, RouteUser, h.getEmailLogs},
+		{"POST " + pathEmailEvents, RouteUser, h.receiveEmailEvents},
+		{"POST " + pathInboundEmails, RouteUser, h.receiveInboundEmail},
+		{"GET " + pathInboundEmails, RouteUser, h.getInboundEmails},
+		{"GET " + pathInboundEmail, RouteUser, h.getInboundEmail},
+		{"PUT " + pathInboundEmailCompany, RouteUser, h.assignInboundEmail},
+		{"POST " + pathInvoiceRemindersSnooze, RouteUser, h.snoozeReminders},
+		{"DELETE " + pathInvoiceRemindersSnooze, RouteUser, h.unsnoozeReminders},
+		{"PUT " + pathInvoiceRemindersSchedule, RouteUser, h.updateReminderSchedule},
+		{"GET " + pathRemindersDue, RouteUser, h.getDueReminders},
+		{"POST " + pathRemindersSend, RouteUser, h.postSendReminders},
+		{"GET " + pathDigest, RouteUser, h.getDigest},
+		{"POST " + pathDigestSend, RouteAdmin, h.postSendDigest},
+		{"GET " + pathProjects, RouteUser, h.getProjects},
+		{"POST " + pathProjects, RouteUser, h.createProject},
+		{"GET " + pathProject, RouteUser, h.getProject},
+		{"PUT " + pathProject, RouteUser, h.updateProject},
+		{"DELETE " + pathProject, RouteUser, h.deleteProject},
+		{"GET " + pathProjectTasks, RouteUser, h.getTasks},
+		{"POST " + pathProjectTasks, RouteUser, h.createTask},
+		{"PUT " + pathTask, RouteUser, h.updateTask},
+		{"DELETE " + pathTask, RouteUser, h.deleteTask},
+		{"GET " + pathProjectTimeEntries, RouteUser, h.getTimeEntries},
+		{"POST " + pathProjectTimeEntries, RouteUser, h.createTimeEntry},
+		{"DELETE " + pathTimeEntry, RouteUser, h.deleteTimeEntry},
+		{"GET " + pathDeliverables, RouteUser, h.getDeliverables},
+		{"POST " + pathDeliverables, RouteUser, h.createDeliverable},
+		{"DELETE " + pathDeliverable, RouteUser, h.deleteDeliverable},
+		{"POST " + pathDeliverablesConsolidate, RouteUser, h.postConsolidateInvoices},
+		{"POST " + pathCompanyConsolidate, RouteUser, h.consolidateDeliverables},
+		{"POST " + pathBillingRun, RouteUser, h.postBillingRun},
+		{"GET " + pathContracts, RouteUser, h.getContracts},
+		{"POST " + pathContracts, RouteUser, h.createContract},
+		{"GET " + pathContract, RouteUser, h.getContract},
+		{"PUT " + pathContract, RouteUser, h.updateContract},
+		{"DELETE " + pathContract, RouteUser, h.deleteContract},
+		{"GET " + pathTags, RouteUser, h.getTags},
+		{"PUT " + pathTag, RouteUser, h.renameTag},
+		{"DELETE " + pathTag, RouteUser, h.deleteTag},
+		{"GET " + pathCustomFields, RouteUser, h.getCustomFields},
+		{"POST " + pathCustomFields, RouteUser, h.createCustomField},
+		{"PUT " + pathCustomField, RouteUser, h.updateCustomField},
+		{"DELETE " + pathCustomField, RouteUser, h.deleteCustomField},
+		{"GET " + pathPriceLists, RouteUser, h.getPriceLists},
+		{"POST " + pathPriceLists, RouteUser, h.createPriceList},
+		{"GET " + pathPriceList, RouteUser, h.getPriceList},
+		{"PUT " + pathPriceList, RouteUser, h.updatePriceList},
+		{"DELETE " + pathPriceList, RouteUser, h.deletePriceList},
+		{"GET " + pathGraphQL, RouteUser, h.graphQL},
+		{"POST " + pathGraphQL, RouteUser, h.graphQL},
+		{"GET " + pathListColumns, RouteUser, h.getListColumns},
+		{"PUT " + pathListColumns, RouteUser, h.updateListColumns},
+		{"GET " + pathSavedViews, RouteUser, h.getSavedViews},
+		{"POST " + pathSavedViews, RouteUser, h.createSavedView},
+		{"GET " + pathSavedView, RouteUser, h.getSavedView},
+		{"PUT " + pathSavedView, RouteUser, h.updateSavedView},
+		{"DELETE " + pathSavedView, RouteUser, h.deleteSavedView},
+		{"GET " + pathListInvoiceTemplates, RouteUser, h.listTemplates},
+		{"POST " + pathUserForcePasswordReset, RouteAdmin, h.forcePasswordReset},
+		{"GET " + pathAuditEvents, RouteAdmin, h.getAuditEvents},
+		{"GET " + pathAdminLoginAttempts, RouteAdmin, h.getLoginAttempts},
+		{"GET " + pathSettings, RouteUser, h.getSettings},
+		{"PUT " + pathSettings, RouteAdmin, h.updateSettings},
+		{"GET " + pathAdminExport, RouteAdmin, h.exportDataset},
+		{"POST " + pathAdminImport, RouteAdmin, h.importDataset},
+		{"GET " + pathAdminJobs, RouteAdmin, h.getJobs},
+		{"POST " + pathAdminJobRetry, RouteAdmin, h.retryJob},
+		{"GET " + pathAdminClock, RouteAdmin, h.getClock},
+		{"POST " + pathAdminClock, RouteAdmin, h.moveClock},
+		{"GET " + pathAdminDBStats, RouteAdmin, h.getDatabaseStats},
+		{"POST " + pathLogout, RoutePublic, h.logout},
+	}
+}
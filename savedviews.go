@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrSavedViewName is returned when the user already saved a view by that
+// name
+var ErrSavedViewName = errors.New("a saved view already has that name")
+
+// SavedView is a named filter and sort of the invoice list a user saved,
+// as "Unpaid > 30 days". Views without a user are the ones saved when
+// authentication is disabled.
+type SavedView struct {
+	ID     uint          `gorm:"primaryKey" json:"id"`
+	UserID *uint         `gorm:"index" json:"-"`
+	User   *User         `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name   string        `gorm:"size:255;not null" json:"name"`
+	Filter InvoiceFilter `gorm:"type:text;not null" json:"filter"`
+}
+
+func (f InvoiceFilter) Value() (driver.Value, error) {
+	encoded, err := json.Marshal(f)
+	return string(encoded), err
+}
+
+func (f *InvoiceFilter) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	case []byte:
+		return json.Unmarshal(v, f)
+	default:
+		return fmt.Errorf("cannot scan %T into InvoiceFilter", value)
+	}
+}
+
+// validateSavedView checks the fields the database doesn't constrain
+func validateSavedView(view *SavedView) error {
+	view.Name = strings.TrimSpace(view.Name)
+	if view.Name == "" {
+		return errors.New("Name is required")
+	}
+	if !view.Filter.Type.Valid() {
+		return errors.New("Invalid document type")
+	}
+	if _, ok := invoiceSorts[view.Filter.Sort]; view.Filter.Sort != "" && !ok {
+		return errors.New("Invalid sort, expected number, issue_date, due_date, total or client")
+	}
+	return nil
+}
+
+func (r *Repository) GetSavedViews(userID *uint) ([]SavedView, error) {
+	var views []SavedView
+	err := listColumnsOwner(r.db, userID).Order("name").Find(&views).Error
+	return views, err
+}
+
+// GetSavedView returns the view when the user saved it
+func (r *Repository) GetSavedView(userID *uint, id uint) (*SavedView, error) {
+	var view SavedView
+	if err := listColumnsOwner(r.db, userID).First(&view, id).Error; err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+// savedViewNameTaken tells whether another view of the user has the name
+func savedViewNameTaken(tx *gorm.DB, view *SavedView) error {
+	var count int64
+	err := listColumnsOwner(tx.Model(&SavedView{}), view.UserID).
+		Where("name = ? AND id <> ?", view.Name, view.ID).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrSavedViewName
+	}
+	return nil
+}
+
+func (r *Repository) CreateSavedView(view *SavedView) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := savedViewNameTaken(tx, view); err != nil {
+				return err
+			}
+			return tx.Create(view).Error
+		})
+	})
+}
+
+func (r *Repository) UpdateSavedView(view *SavedView) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			if err := listColumnsOwner(tx, view.UserID).First(&SavedView{}, view.ID).Error; err != nil {
+				return err
+			}
+			if err := savedViewNameTaken(tx, view); err != nil {
+				return err
+			}
+			return tx.Save(view).Error
+		})
+	})
+}
+
+func (r *Repository) DeleteSavedView(userID *uint, id uint) error {
+	return retryOnBusy(func() error {
+		return listColumnsOwner(r.db, userID).Delete(&SavedView{}, id).Error
+	})
+}
+
+// requestInvoiceFilter returns the filter of the invoice list: the one of
+// the view given by the saved_view query parameter, or else the one of the
+// query
+func (h *Handler) requestInvoiceFilter(r *http.Request) (InvoiceFilter, error) {
+	id, err := parseOptionalUint(r, "saved_view")
+	if err != nil {
+		return InvoiceFilter{}, err
+	}
+	if id == nil {
+		return invoiceFilterFromQuery(r)
+	}
+	view, err := h.storeFor(r).GetSavedView(currentUserID(r.Context()), *id)
+	if err != nil {
+		return InvoiceFilter{}, err
+	}
+	return view.Filter, nil
+}
+
+// writeInvoiceFilterError answers an invoice list whose filter can't be read
+func writeInvoiceFilterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Saved view not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// writeSavedViewError answers a failed save of a view
+func writeSavedViewError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrSavedViewName):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Saved view handlers
+func (h *Handler) getSavedViews(w http.ResponseWriter, r *http.Request) {
+	views, err := h.storeFor(r).GetSavedViews(currentUserID(r.Context()))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func (h *Handler) getSavedView(w http.ResponseWriter, r *http.Request) {
+	savedViewIdStr := r.PathValue("savedViewId")
+	savedViewId, err := strconv.ParseUint(savedViewIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid saved view ID", http.StatusBadRequest)
+		return
+	}
+
+	view, err := h.storeFor(r).GetSavedView(currentUserID(r.Context()), uint(savedViewId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+func (h *Handler) createSavedView(w http.ResponseWriter, r *http.Request) {
+	var view SavedView
+	if err := decodeRequest(r, &view); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.ID, view.UserID = 0, currentUserID(r.Context())
+
+	if err := validateSavedView(&view); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateSavedView(&view); err != nil {
+		writeSavedViewError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+func (h *Handler) updateSavedView(w http.ResponseWriter, r *http.Request) {
+	savedViewIdStr := r.PathValue("savedViewId")
+	savedViewId, err := strconv.ParseUint(savedViewIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid saved view ID", http.StatusBadRequest)
+		return
+	}
+
+	var view SavedView
+	if err := decodeRequest(r, &view); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.ID, view.UserID = uint(savedViewId), currentUserID(r.Context())
+
+	if err := validateSavedView(&view); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UpdateSavedView(&view); err != nil {
+		writeSavedViewError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+func (h *Handler) deleteSavedView(w http.ResponseWriter, r *http.Request) {
+	savedViewIdStr := r.PathValue("savedViewId")
+	savedViewId, err := strconv.ParseUint(savedViewIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid saved view ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteSavedView(currentUserID(r.Context()), uint(savedViewId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
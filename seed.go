@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runSeedCommand fills the database with demo records. They are built by
+// the Factory below, which only this command and the tests use, keeping it
+// off the server's request paths.
+func runSeedCommand(repo *Repository, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	invoices, err := seed(repo)
+	if err != nil {
+		return fmt.Errorf("seeding the database: %w", err)
+	}
+
+	for _, invoice := range invoices {
+		fmt.Printf("Invoice %s: %.2f to %s\n", invoice.Identification(), invoice.TotalAmount, invoice.Client.Name)
+	}
+	return nil
+}
+
+// seed fills an empty database with an issuer, its clients and products,
+// and an invoice in every state, to try the application out
+func seed(store Store) ([]Invoice, error) {
+	f := NewFactory(store)
+	issuer, err := f.Company(func(c *Company) {
+		c.Name, c.Document, c.Email = "Acme Consulting", "11.222.333/0001-81", "billing@acme.example"
+		c.IsIssuer = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var clients []*Company
+	for _, name := range []string{"Globex", "Initech"} {
+		client, err := f.Company(func(c *Company) {
+			c.Name, c.Email = name, "finance@"+strings.ToLower(name)+".example"
+		})
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	remit, err := f.RemitInformation(func(r *RemitInformation) { r.Name = "Main account" })
+	if err != nil {
+		return nil, err
+	}
+	var products []*Product
+	for _, product := range []Product{{Name: "Consulting hour", Price: moneyFromFloat(150)}, {Name: "Support plan", Price: moneyFromFloat(990)}} {
+		created, err := f.Product(func(p *Product) { p.Name, p.Price = product.Name, product.Price })
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, created)
+	}
+
+	var invoices []Invoice
+	states := []InvoiceState{InvoiceDraft, InvoiceSent, InvoicePartiallyPaid, InvoicePaid, InvoiceOverdue}
+	for i, state := range states {
+		invoice, err := f.Invoice(state, func(invoice *Invoice) {
+			invoice.CompanyID, invoice.ClientID, invoice.RemitInformationID = issuer.ID, clients[i%len(clients)].ID, remit.ID
+			if state != InvoiceDraft {
+				number := i
+				invoice.Number = &number
+			}
+			invoice.InvoiceLines = []InvoiceLine{
+				{ProductID: &products[0].ID, Quantity: float64(8 * (i + 1))},
+				{ProductID: &products[1].ID, Quantity: 1},
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating the %s invoice: %w", state, err)
+		}
+		invoices = append(invoices, *invoice)
+	}
+	return invoices, nil
+}
+
+// InvoiceState is where in its life the factory leaves an invoice
+type InvoiceState string
+
+const (
+	InvoiceDraft         InvoiceState = "draft"
+	InvoiceSent          InvoiceState = "sent"
+	InvoicePartiallyPaid InvoiceState = "partially_paid"
+	InvoicePaid          InvoiceState = "paid"
+	InvoiceOverdue       InvoiceState = "overdue"
+)
+
+// Factory creates records with working defaults for the tests and the seed
+// command, each with a name of its own. Callers override the fields that
+// matter to them.
+type Factory struct {
+	store Store
+	count int
+}
+
+func NewFactory(store Store) *Factory {
+	return &Factory{store: store}
+}
+
+// sequence numbers the records, keeping their names apart
+func (f *Factory) sequence() int {
+	f.count++
+	return f.count
+}
+
+func (f *Factory) Company(overrides ...func(*Company)) (*Company, error) {
+	n := f.sequence()
+	company := &Company{
+		Name:     fmt.Sprintf("Company %d", n),
+		Document: fmt.Sprintf("%02d.345.678/0001-90", n%100),
+		Address:  fmt.Sprintf("%d Test Street, Test City", n),
+	}
+	for _, override := range overrides {
+		override(company)
+	}
+	defaultCompanyRoles(company)
+	if err := f.store.CreateCompany(company); err != nil {
+		return nil, err
+	}
+	return company, nil
+}
+
+func (f *Factory) Product(overrides ...func(*Product)) (*Product, error) {
+	product := &Product{Name: fmt.Sprintf("Product %d", f.sequence()), Price: moneyFromFloat(100)}
+	for _, override := range overrides {
+		override(product)
+	}
+	if err := f.store.CreateProduct(product); err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+func (f *Factory) RemitInformation(overrides ...func(*RemitInformation)) (*RemitInformation, error) {
+	remit := &RemitInformation{
+		Name: fmt.Sprintf("Bank account %d", f.sequence()),
+		Lines: []RemitInformationLine{
+			{Key: "bank", Value: "Test Bank"},
+			{Key: "account", Value: "123456789"},
+		},
+	}
+	for _, override := range overrides {
+		override(remit)
+	}
+	if err := f.store.CreateRemitInformation(remit); err != nil {
+		return nil, err
+	}
+	return remit, nil
+}
+
+// Invoice creates an invoice and brings it to the state: sent, paid in
+// part or in full, or sent and past its due date. The issuer, client, remit
+// information and a line of a new product are created unless the overrides
+// set them.
+func (f *Factory) Invoice(state InvoiceState, overrides ...func(*Invoice)) (*Invoice, error) {
+	now := clock.Now()
+	invoice := &Invoice{IssueDate: now, DueDate: now.AddDate(0, 0, 30)}
+	if state == InvoiceOverdue {
+		invoice.IssueDate, invoice.DueDate = now.AddDate(0, 0, -40), now.AddDate(0, 0, -10)
+	}
+	for _, override := range overrides {
+		override(invoice)
+	}
+
+	if invoice.CompanyID == 0 {
+		issuer, err := f.Company(func(c *Company) { c.IsIssuer = true })
+		if err != nil {
+			return nil, err
+		}
+		invoice.CompanyID = issuer.ID
+	}
+	if invoice.ClientID == 0 {
+		client, err := f.Company()
+		if err != nil {
+			return nil, err
+		}
+		invoice.ClientID = client.ID
+	}
+	if invoice.RemitInformationID == 0 {
+		remit, err := f.RemitInformation()
+		if err != nil {
+			return nil, err
+		}
+		invoice.RemitInformationID = remit.ID
+	}
+	if len(invoice.InvoiceLines) == 0 {
+		product, err := f.Product()
+		if err != nil {
+			return nil, err
+		}
+		invoice.InvoiceLines = []InvoiceLine{{ProductID: &product.ID, Quantity: 1}}
+	}
+
+	if err := f.store.CreateInvoice(invoice); err != nil {
+		return nil, err
+	}
+	if state != InvoiceDraft {
+		if _, err := f.store.SendInvoice(invoice.ID, now); err != nil {
+			return nil, err
+		}
+	}
+	switch state {
+	case InvoicePartiallyPaid:
+		if _, err := f.Payment(invoice, invoice.TotalAmount.Per(2)); err != nil {
+			return nil, err
+		}
+	case InvoicePaid:
+		if _, err := f.Payment(invoice, invoice.TotalAmount); err != nil {
+			return nil, err
+		}
+	}
+	return f.store.GetInvoice(invoice.ID)
+}
+
+// Payment records a payment of the amount on the invoice, dated now
+func (f *Factory) Payment(invoice *Invoice, amount Money) (*Payment, error) {
+	payment := &Payment{InvoiceID: invoice.ID, Amount: amount, Date: clock.Now()}
+	if err := f.store.CreatePayment(payment); err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm/clause"
+)
+
+var ErrEmailsPaused = errors.New("emails are paused in the settings")
+
+// Setting is a runtime setting, its value JSON encoded
+type Setting struct {
+	Key   string `gorm:"size:100;primaryKey"`
+	Value string `gorm:"type:text;not null"`
+}
+
+// Settings are changed at runtime through /api/settings, where the config
+// holds what is set when the server starts. The zero values keep the
+// built-in behavior.
+type Settings struct {
+	// DefaultCompanyID issues the invoices created without an issuer
+	DefaultCompanyID *uint `json:"default_company_id"`
+	// DefaultRemitID is the remit information of the invoices created
+	// without one
+	DefaultRemitID *uint `json:"default_remit_id"`
+	// InvoicePrefix starts the codes given when invoices are numbered on
+	// send, e.g. "INV-" for INV-0007
+	InvoicePrefix string `json:"invoice_prefix"`
+	// Locale renders the documents of clients without a locale
+	Locale Locale `json:"locale"`
+	// Currency is the ISO 4217 code billed in, instead of the currency of
+	// the locale
+	Currency string `json:"currency"`
+	// PauseClientEmails holds back the emails to clients: reminders,
+	// receipts, statements and surveys, and the WhatsApp messages
+	PauseClientEmails bool `json:"pause_client_emails"`
+	// PauseNotifications holds back the emails to notify_email: the digest
+	// and the budget alerts
+	PauseNotifications bool `json:"pause_notifications"`
+}
+
+// settings caches the stored settings, read on every document and email
+var (
+	settingsMu sync.RWMutex
+	settings   Settings
+)
+
+// currentSettings returns a copy of the cached settings
+func currentSettings() Settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	s := settings
+	if s.DefaultCompanyID != nil {
+		s.DefaultCompanyID = new(uint)
+		*s.DefaultCompanyID = *settings.DefaultCompanyID
+	}
+	if s.DefaultRemitID != nil {
+		s.DefaultRemitID = new(uint)
+		*s.DefaultRemitID = *settings.DefaultRemitID
+	}
+	return s
+}
+
+func cacheSettings(s Settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings = s
+}
+
+// loadSettings reads the stored settings into the cache, at start up
+func loadSettings(store Store) error {
+	s, err := store.GetSettings()
+	if err != nil {
+		return err
+	}
+	cacheSettings(s)
+	return nil
+}
+
+// settingsSaved tells the other instances to reload the settings, when
+// Redis is shared with them
+func settingsSaved() {
+	if redisClient == nil {
+		return
+	}
+	if err := redisClient.Incr(context.Background(), redisClient.key("settings_version")).Err(); err != nil {
+		log.Printf("Error announcing the new settings: %v", err)
+	}
+}
+
+// watchSettings reloads the settings saved by another instance, checking
+// every few seconds
+func watchSettings(store Store) {
+	var loaded int64
+	for range time.Tick(5 * time.Second) {
+		version, err := redisClient.Get(context.Background(), redisClient.key("settings_version")).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			log.Printf("Error checking the settings version: %v", err)
+			continue
+		}
+		if version == loaded {
+			continue
+		}
+		if err := loadSettings(store); err != nil {
+			log.Printf("Error reloading the settings: %v", err)
+			continue
+		}
+		loaded = version
+	}
+}
+
+// GetSettings reads the stored settings, keys no longer known are ignored
+func (r *Repository) GetSettings() (Settings, error) {
+	var rows []Setting
+	if err := r.db.Find(&rows).Error; err != nil {
+		return Settings{}, err
+	}
+	values := map[string]json.RawMessage{}
+	for _, row := range rows {
+		values[row.Key] = json.RawMessage(row.Value)
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return Settings{}, err
+	}
+	var s Settings
+	return s, json.Unmarshal(encoded, &s)
+}
+
+// SaveSettings stores every setting, a row per key
+func (r *Repository) SaveSettings(s Settings) error {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return err
+	}
+	rows := make([]Setting, 0, len(values))
+	for key, value := range values {
+		rows = append(rows, Setting{Key: key, Value: string(value)})
+	}
+	return retryOnBusy(func() error {
+		return r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&rows).Error
+	})
+}
+
+// applyInvoiceDefaults gives the invoice the issuer of the settings when it
+// has none, and the remit information of its issuer, or else of the
+// settings
+func applyInvoiceDefaults(store Store, invoice *Invoice) {
+	s := currentSettings()
+	if invoice.CompanyID == 0 && s.DefaultCompanyID != nil {
+		invoice.CompanyID = *s.DefaultCompanyID
+	}
+	if invoice.RemitInformationID != 0 {
+		return
+	}
+	if invoice.CompanyID != 0 {
+		// An unknown issuer is reported by checkInvoiceIssuer
+		if issuer, err := store.GetCompany(invoice.CompanyID); err == nil && issuer.DefaultRemitID != nil {
+			invoice.RemitInformationID = *issuer.DefaultRemitID
+			return
+		}
+	}
+	if s.DefaultRemitID != nil {
+		invoice.RemitInformationID = *s.DefaultRemitID
+	}
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validateSettings checks the settings and that the records they name exist
+func validateSettings(store Store, s *Settings) error {
+	if s.DefaultCompanyID != nil {
+		if _, err := store.GetCompany(*s.DefaultCompanyID); err != nil {
+			return fmt.Errorf("default company %d not found", *s.DefaultCompanyID)
+		}
+	}
+	if s.DefaultRemitID != nil {
+		if _, err := store.GetRemitInformation(*s.DefaultRemitID); err != nil {
+			return fmt.Errorf("default remit information %d not found", *s.DefaultRemitID)
+		}
+	}
+	if len(s.InvoicePrefix) > 20 {
+		return errors.New("invoice prefix can't be longer than 20 characters")
+	}
+	if !s.Locale.Valid() {
+		return fmt.Errorf("unsupported locale %q", s.Locale)
+	}
+	if s.Currency != "" && !currencyPattern.MatchString(s.Currency) {
+		return fmt.Errorf("invalid currency %q, expected an ISO 4217 code like EUR", s.Currency)
+	}
+	return nil
+}
+
+func (h *Handler) getSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentSettings())
+}
+
+// updateSettings changes the settings given, the others are kept
+func (h *Handler) updateSettings(w http.ResponseWriter, r *http.Request) {
+	s := currentSettings()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	if err := validateSettings(store, &s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.SaveSettings(s); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+	cacheSettings(s)
+	settingsSaved()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const defaultInvoiceTemplate = "default_invoice.html"
+
+var shareLinkSecret = randomShareLinkSecret()
+
+// publicURL turns a path into an absolute URL clients can open, using the
+// configured base URL so links in emails resolve
+func publicURL(path string) string {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = "http://localhost:" + config.Port
+	}
+	return strings.TrimRight(baseURL, "/") + path
+}
+
+// randomShareLinkSecret is the key used to sign public invoice links when no
+// share_link_secret is configured, so links only last until a restart
+func randomShareLinkSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// signInvoiceUUID returns the signature that authorizes public access to the invoice
+func signInvoiceUUID(id uuid.UUID) string {
+	mac := hmac.New(sha256.New, shareLinkSecret)
+	mac.Write([]byte(id.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareLinkPath builds the public read-only path of the invoice
+func shareLinkPath(invoice *Invoice) string {
+	return "/i/" + invoice.UUID.String() + "?sig=" + signInvoiceUUID(invoice.UUID)
+}
+
+func (h *Handler) shareInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": publicURL(shareLinkPath(invoice)),
+	})
+}
+
+// viewSharedInvoice renders an invoice read-only for anyone holding a validly signed link
+func (h *Handler) viewSharedInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceUUID, err := uuid.Parse(r.PathValue("invoiceUUID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	signature := r.URL.Query().Get("sig")
+	if !hmac.Equal([]byte(signature), []byte(signInvoiceUUID(invoiceUUID))) {
+		log.Printf("Rejected shared invoice link for %s: bad signature", invoiceUUID)
+		http.NotFound(w, r)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoiceByUUID(invoiceUUID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	h.renderReadOnlyInvoice(w, r, invoice)
+}
+
+// renderReadOnlyInvoice renders the invoice for its client with its stored
+// template or the default one. The template can't be picked in the query,
+// and nothing is recorded by the render.
+func (h *Handler) renderReadOnlyInvoice(w http.ResponseWriter, r *http.Request, invoice *Invoice) {
+	disputeURL := ""
+	if invoice.Disputable() {
+		disputeURL = disputeLinkPath(invoice)
+	}
+
+	invoiceTemplate, err := resolveInvoiceTemplate(h.storeFor(r), invoice, nil)
+	if err != nil || invoiceTemplate == nil {
+		renderInvoice(w, h.storeFor(r), invoice, defaultInvoiceTemplate, nil, disputeURL, true)
+		return
+	}
+	renderInvoice(w, h.storeFor(r), invoice, invoiceTemplate.BaseTemplate, invoiceTemplate, disputeURL, true)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateStateless refuses the backends keeping state on the instance, so
+// a request can be served by any instance behind the load balancer. Every
+// problem is reported at once.
+//
+// The database is shared when its file is on a filesystem replicating it to
+// every instance. The rest is shared already: the jobs, settings and edit
+// locks are in the database, the templates ship with the binary and their
+// versions are recorded in the database, and the scheduled runs are claimed
+// in Redis.
+func (c *Config) validateStateless() error {
+	var problems []error
+	add := func(problem string) {
+		problems = append(problems, errors.New("stateless: "+problem))
+	}
+
+	if file := sqliteDatabaseFile(c.DatabaseDSN); file == "" {
+		add("DATABASE_DSN " + strconv.Quote(c.DatabaseDSN) + " is a database in the memory of this instance")
+	} else if !replicatedFilesystems[mountFilesystem(file)] {
+		add("DATABASE_DSN " + strconv.Quote(c.DatabaseDSN) + " is a SQLite file on the disk of this instance, put it on a LiteFS mount replicating it to the others")
+	}
+	if c.SerializeWrites {
+		add("DATABASE_SERIALIZE_WRITES only serializes the writes of this instance")
+	}
+	if c.S3.Bucket == "" {
+		add("ATTACHMENTS_DIR is on the disk of this instance, set S3_BUCKET")
+	}
+	if c.Redis.URL == "" {
+		add("REDIS_URL is needed to share the sessions, login blocks, caches and job queue")
+	}
+	if c.ShareLinkSecret == "" {
+		add("SHARE_LINK_SECRET is needed, each instance would sign share links and sessions with its own random key")
+	}
+	if c.DemoClock != "" {
+		add("DEMO_CLOCK runs a simulated clock in each instance")
+	}
+	if len(c.TLS.AutocertDomains) > 0 {
+		add("TLS_AUTOCERT_DOMAINS caches the certificates on the disk of this instance, terminate TLS at the load balancer")
+	}
+	return errors.Join(problems...)
+}
+
+// replicatedFilesystems are the filesystems replicating a SQLite database
+// to every instance, named as in mountinfo
+var replicatedFilesystems = map[string]bool{"fuse.litefs": true}
+
+// mountInfoPath lists the mounts of the process
+var mountInfoPath = "/proc/self/mountinfo"
+
+// mountPointEscapes decodes the characters mountinfo escapes in paths
+var mountPointEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// sqliteDatabaseFile is the file a SQLite DSN opens, empty for an in-memory
+// database
+func sqliteDatabaseFile(dsn string) string {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if path == "" || path == ":memory:" || strings.Contains("&"+query+"&", "&mode=memory&") {
+		return ""
+	}
+	return path
+}
+
+// mountFilesystem is the type of the filesystem path is on, e.g. ext4 or
+// fuse.litefs, from the deepest mount holding it. It is empty when the
+// mounts can't be read, outside of Linux.
+func mountFilesystem(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(mountInfoPath)
+	if err != nil {
+		return ""
+	}
+	// Each line is "id parent major:minor root mount-point options
+	// [optional fields...] - type source super-options"
+	var mountPoint, filesystem string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		separator := slices.Index(fields, "-")
+		if separator < 6 || separator+1 >= len(fields) {
+			continue
+		}
+		point := mountPointEscapes.Replace(fields[4])
+		holds := point == "/" || path == point || strings.HasPrefix(path, point+"/")
+		if holds && len(point) >= len(mountPoint) {
+			mountPoint, filesystem = point, fields[separator+1]
+		}
+	}
+	return filesystem
+}
+
+// claimScheduledRun reports whether this instance runs the scheduled task
+// now: with Redis only the first instance claiming it within every does,
+// alone it always runs
+func claimScheduledRun(task string, every time.Duration) bool {
+	if redisClient == nil {
+		return true
+	}
+	claimed, err := redisClient.SetNX(context.Background(), redisClient.key("scheduled", task), "1", every).Result()
+	if err != nil {
+		log.Printf("Error claiming the scheduled %s: %v", task, err)
+		return false
+	}
+	return claimed
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StatementEntry struct {
+	Date        time.Time `json:"date"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	InvoiceID   uint      `json:"invoice_id"`
+	Debit       Money     `json:"debit"`
+	Credit      Money     `json:"credit"`
+	Balance     Money     `json:"balance"`
+	// LateCharges is the penalty and interest of an overdue invoice as of
+	// today, not included in the balance
+	LateCharges Money `json:"late_charges,omitempty"`
+}
+
+// Statement is a client's account summary: invoices and credit notes billed
+// and payments received in a period with the running balance after each entry
+type Statement struct {
+	Company        Company          `json:"company"`
+	From           *time.Time       `json:"from"`
+	To             *time.Time       `json:"to"`
+	OpeningBalance Money            `json:"opening_balance"`
+	Entries        []StatementEntry `json:"entries"`
+	ClosingBalance Money            `json:"closing_balance"`
+	// LateCharges sums the late charges of the entries, AmountDue is the
+	// closing balance with them
+	LateCharges Money `json:"late_charges"`
+	AmountDue   Money `json:"amount_due"`
+}
+
+func (s *Statement) Repr() string {
+	clientName := strings.ReplaceAll(s.Company.Name, " ", "")
+	period := "all"
+	if s.From != nil || s.To != nil {
+		period = ""
+		if s.From != nil {
+			period += s.From.Format("20060102")
+		}
+		period += "-"
+		if s.To != nil {
+			period += s.To.Format("20060102")
+		}
+	}
+	return fmt.Sprintf("%s_statement_%s", clientName, period)
+}
+
+// GetStatement builds the statement of the given client. Entries before
+// from are folded into the opening balance, to is inclusive. Drafts aren't
+// owed yet and are left out. It reads the client, its sent invoices with
+// their stored totals and its payments, in three queries however many
+// there are.
+func (r *Repository) GetStatement(clientID uint, from, to *time.Time) (*Statement, error) {
+	var company Company
+	if err := r.db.First(&company, clientID).Error; err != nil {
+		return nil, err
+	}
+
+	// The lines aren't needed, the totals are stored
+	var invoices []Invoice
+	if err := r.db.Where("client_id = ? AND sent_at IS NOT NULL", clientID).Order("issue_date").Find(&invoices).Error; err != nil {
+		return nil, err
+	}
+
+	payments, err := r.GetClientPayments(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	paid := map[uint]Money{}
+	for _, payment := range payments {
+		paid[payment.InvoiceID] += payment.Amount
+	}
+
+	now := clock.Now()
+	var entries []StatementEntry
+	for _, invoice := range invoices {
+		behavior := invoice.Type.Behavior()
+		if behavior.BalanceSign == 0 {
+			continue
+		}
+
+		entry := StatementEntry{
+			Date:        invoice.IssueDate,
+			Type:        string(invoice.Type),
+			Description: behavior.Label + " " + invoice.Identification(),
+			InvoiceID:   invoice.ID,
+		}
+		if behavior.BalanceSign > 0 {
+			entry.Debit = invoice.TotalAmount
+			if charges := config.LateFees.charges(&invoice, invoice.TotalAmount, paid[invoice.ID], now); charges != nil {
+				entry.LateCharges = charges.Penalty + charges.Interest
+			}
+		} else {
+			entry.Credit = invoice.TotalAmount
+		}
+		entries = append(entries, entry)
+	}
+	for _, payment := range payments {
+		description := "Payment"
+		if payment.Reference != nil && *payment.Reference != "" {
+			description += " " + *payment.Reference
+		}
+		entries = append(entries, StatementEntry{
+			Date:        payment.Date,
+			Type:        "payment",
+			Description: description,
+			InvoiceID:   payment.InvoiceID,
+			Credit:      payment.Amount,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date.Before(entries[j].Date)
+	})
+
+	statement := &Statement{Company: company, From: from, To: to, Entries: []StatementEntry{}}
+	var balance Money
+	for _, entry := range entries {
+		if to != nil && !entry.Date.Before(to.AddDate(0, 0, 1)) {
+			continue
+		}
+
+		balance += entry.Debit - entry.Credit
+		statement.LateCharges += entry.LateCharges
+		if from != nil && entry.Date.Before(*from) {
+			statement.OpeningBalance = balance
+			continue
+		}
+
+		entry.Balance = balance
+		statement.Entries = append(statement.Entries, entry)
+	}
+	statement.ClosingBalance = balance
+	statement.AmountDue = balance + statement.LateCharges
+
+	return statement, nil
+}
+
+// PDF renders the statement as a printable document
+func (s *Statement) PDF() []byte {
+	doc := NewPDFDocument(s.Repr())
+	doc.AddLine("Statement of Account")
+	doc.AddBlank()
+	doc.AddLine("%s - %s", s.Company.Name, s.Company.Document)
+	doc.AddLine("%s", s.Company.Address)
+	if s.From != nil {
+		doc.AddLine("From: %s", s.From.Format("2006/01/02"))
+	}
+	if s.To != nil {
+		doc.AddLine("To: %s", s.To.Format("2006/01/02"))
+	}
+	doc.AddBlank()
+	doc.AddLine("Opening balance: %.2f", s.OpeningBalance)
+	doc.AddBlank()
+	for _, entry := range s.Entries {
+		doc.AddLine("%s   %-40s %12.2f %12.2f", entry.Date.Format("2006/01/02"), entry.Description, entry.Debit-entry.Credit, entry.Balance)
+	}
+	doc.AddBlank()
+	doc.AddLine("Closing balance: %.2f", s.ClosingBalance)
+	if s.LateCharges > 0 {
+		doc.AddLine("Late charges as of today: %.2f", s.LateCharges)
+		doc.AddLine("Amount due: %.2f", s.AmountDue)
+	}
+	return doc.Bytes()
+}
+
+// parseDateQuery reads an optional YYYY-MM-DD query parameter
+func parseDateQuery(r *http.Request, name string) (*time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	date, err := parseDate(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s date, expected YYYY-MM-DD", name)
+	}
+	return &date, nil
+}
+
+// statementFromRequest loads the statement for the company and period in the request
+func (h *Handler) statementFromRequest(w http.ResponseWriter, r *http.Request) (*Statement, bool) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	from, err := parseDateQuery(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	to, err := parseDateQuery(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	statement, err := h.storeFor(r).GetStatement(uint(companyId), from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return statement, true
+}
+
+func (h *Handler) getStatement(w http.ResponseWriter, r *http.Request) {
+	statement, ok := h.statementFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", statement.Repr()+".pdf"))
+		w.Write(statement.PDF())
+	case "html":
+		tmplPath := filepath.Join("templates", "statements", "default_statement.html")
+		tmpl, err := template.ParseFiles(tmplPath)
+		if err != nil {
+			log.Printf("Error parsing template %s: %v", tmplPath, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		if err := tmpl.Execute(w, struct{ Statement *Statement }{statement}); err != nil {
+			log.Printf("Error executing template %s: %v", tmplPath, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statement)
+	}
+}
+
+func (h *Handler) emailStatement(w http.ResponseWriter, r *http.Request) {
+	statement, ok := h.statementFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		To string `json:"to"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	to := request.To
+	if to == "" {
+		to = statement.Company.Email
+	}
+	if to == "" {
+		http.Error(w, "company has no email address, provide one in \"to\"", http.StatusBadRequest)
+		return
+	}
+
+	email := &Email{
+		To:      []string{to},
+		Subject: "Statement of account - " + statement.Company.Name,
+		Body:    fmt.Sprintf("Hello,\n\nPlease find attached your statement of account. The current balance is %.2f.\n", statement.ClosingBalance),
+		Attachments: []EmailAttachment{
+			{Filename: statement.Repr() + ".pdf", ContentType: "application/pdf", Data: statement.PDF()},
+		},
+	}
+	if err := sendClientEmail(h.storeFor(r), &statement.Company, nil, email); err != nil {
+		if errors.Is(err, ErrEmailsPaused) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Error sending statement to %s: %v", to, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
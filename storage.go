@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const unassignedStorage = "Unassigned"
+
+// CompanyStorageUsage is what a company's attachments take on disk. Files
+// it uploaded more than once are only counted once.
+type CompanyStorageUsage struct {
+	CompanyID *uint  `json:"company_id"`
+	Company   string `json:"company"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	// QuotaBytes is 0 when the company has no quota
+	QuotaBytes int64 `json:"quota_bytes"`
+}
+
+// StorageUsage reports attachment storage. UploadedBytes counts every
+// upload, StoredBytes what is left on disk after deduplication.
+type StorageUsage struct {
+	Files         int                   `json:"files"`
+	UploadedBytes int64                 `json:"uploaded_bytes"`
+	StoredBytes   int64                 `json:"stored_bytes"`
+	Companies     []CompanyStorageUsage `json:"companies"`
+}
+
+// contentKey identifies the file an attachment is stored in
+func (a *Attachment) contentKey() string {
+	if a.SHA256 == "" {
+		return a.UUID.String()
+	}
+	return a.SHA256
+}
+
+// storageQuota returns the company's quota in bytes, 0 when unlimited
+func storageQuota(company *Company) int64 {
+	quota := config.StorageQuotaMB
+	if company.StorageQuotaMB != nil {
+		quota = *company.StorageQuotaMB
+	}
+	return int64(quota) << 20
+}
+
+// checkStorageQuota fails when storing attachment would take the company
+// over its quota. Content the company already stores is free.
+func (r *Repository) checkStorageQuota(companyID uint, attachment *Attachment, replacing *uint) error {
+	company, err := r.GetCompany(companyID)
+	if err != nil {
+		return err
+	}
+	quota := storageQuota(company)
+	if quota == 0 {
+		return nil
+	}
+
+	query := r.db.Where("company_id = ?", companyID)
+	if replacing != nil {
+		query = query.Where("id <> ?", *replacing)
+	}
+	var attachments []Attachment
+	if err := query.Find(&attachments).Error; err != nil {
+		return err
+	}
+
+	used := int64(0)
+	stored := map[string]bool{}
+	for _, existing := range attachments {
+		if !stored[existing.contentKey()] {
+			stored[existing.contentKey()] = true
+			used += existing.Size
+		}
+	}
+	if stored[attachment.contentKey()] {
+		return nil
+	}
+	if used+attachment.Size > quota {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrStorageQuotaExceeded, used, quota)
+	}
+	return nil
+}
+
+// GetStorageUsage reports attachment storage per company, biggest first
+func (r *Repository) GetStorageUsage() (*StorageUsage, error) {
+	var companies []Company
+	if err := r.db.Find(&companies).Error; err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	if err := r.db.Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+
+	usage := &StorageUsage{Companies: []CompanyStorageUsage{}}
+	lines := map[uint]*CompanyStorageUsage{}
+	for _, company := range companies {
+		lines[company.ID] = &CompanyStorageUsage{
+			CompanyID:  &company.ID,
+			Company:    company.Name,
+			QuotaBytes: storageQuota(&company),
+		}
+	}
+	unassigned := &CompanyStorageUsage{Company: unassignedStorage}
+
+	stored := map[string]bool{}
+	storedBy := map[*CompanyStorageUsage]map[string]bool{}
+	for _, attachment := range attachments {
+		key := attachment.contentKey()
+		usage.Files++
+		usage.UploadedBytes += attachment.Size
+		if !stored[key] {
+			stored[key] = true
+			usage.StoredBytes += attachment.Size
+		}
+
+		line := unassigned
+		if attachment.CompanyID != nil && lines[*attachment.CompanyID] != nil {
+			line = lines[*attachment.CompanyID]
+		}
+		if storedBy[line] == nil {
+			storedBy[line] = map[string]bool{}
+		}
+		line.Files++
+		if !storedBy[line][key] {
+			storedBy[line][key] = true
+			line.Bytes += attachment.Size
+		}
+	}
+
+	for _, line := range lines {
+		usage.Companies = append(usage.Companies, *line)
+	}
+	if unassigned.Files > 0 {
+		usage.Companies = append(usage.Companies, *unassigned)
+	}
+	sort.Slice(usage.Companies, func(i, j int) bool {
+		if usage.Companies[i].Bytes != usage.Companies[j].Bytes {
+			return usage.Companies[i].Bytes > usage.Companies[j].Bytes
+		}
+		return usage.Companies[i].Company < usage.Companies[j].Company
+	})
+	return usage, nil
+}
+
+func (h *Handler) getStorageUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.storeFor(r).GetStorageUsage()
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// writeAttachmentError answers a failed upload
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnsupportedLogo):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, ErrStorageQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
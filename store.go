@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The store interfaces describe what the HTTP handlers need from
+// persistence, grouped by the data they manage. *Repository implements all
+// of them on top of GORM; tests and alternate backends can provide their own.
+
+type CompanyStore interface {
+	GetCompanies(filter CompanyFilter) ([]Company, error)
+	BulkUpdateCompanies(filter CompanyFilter, action BulkAction) (int64, error)
+	GetCompany(id uint) (*Company, error)
+	CreateCompany(company *Company) error
+	UpdateCompany(company *Company) error
+	DeleteCompany(id uint) error
+	SetCompanyLogo(companyID uint, filename string, data []byte) (*Attachment, error)
+	RemoveCompanyLogo(companyID uint) error
+}
+
+type AttachmentStore interface {
+	CreateAttachment(companyID *uint, filename, contentType string, data []byte) (*Attachment, error)
+	GetAttachment(id uint) (*Attachment, error)
+	GetCompanyAttachments(companyID uint) ([]Attachment, error)
+	DeleteAttachment(id uint) error
+}
+
+type ReferralSourceStore interface {
+	GetReferralSources() ([]ReferralSource, error)
+	CreateReferralSource(source *ReferralSource) error
+	DeleteReferralSource(id uint) error
+}
+
+type TagStore interface {
+	GetTags() ([]TagUsage, error)
+	RenameTag(tag, to string) (int64, error)
+	DeleteTag(tag string) (int64, error)
+}
+
+type CustomFieldStore interface {
+	GetCustomFields(entity CustomFieldEntity) ([]CustomField, error)
+	GetCustomField(id uint) (*CustomField, error)
+	CreateCustomField(field *CustomField) error
+	UpdateCustomField(field *CustomField) error
+	DeleteCustomField(id uint) error
+}
+
+type CategoryStore interface {
+	GetCategories() ([]Category, error)
+	CreateCategory(category *Category) error
+	DeleteCategory(id uint) error
+}
+
+type RemitInformationStore interface {
+	GetRemitInformations(filter RemitFilter) ([]RemitInformation, error)
+	GetRemitInformation(id uint) (*RemitInformation, error)
+	CreateRemitInformation(remit *RemitInformation) error
+	UpdateRemitInformation(remit *RemitInformation) error
+	DeleteRemitInformation(id uint) error
+	ReorderRemitLines(remitID uint, lineIDs []uint) error
+	CloneRemitInformation(id uint, name string, template bool) (*RemitInformation, error)
+}
+
+type ProductStore interface {
+	GetProducts(filter ProductFilter) ([]Product, error)
+	GetProduct(id uint) (*Product, error)
+	CreateProduct(product *Product) error
+	UpdateProduct(product *Product) error
+	DeleteProduct(id uint) error
+	SetProductArchived(id uint, archived bool) (*Product, error)
+	GetProductPrices(productID uint) ([]ProductPrice, error)
+}
+
+type InvoiceStore interface {
+	GetInvoices(filter InvoiceFilter) ([]Invoice, error)
+	GetInvoiceSummaries(filter InvoiceFilter) ([]InvoiceSummary, error)
+	GetInvoiceTotals(filter InvoiceFilter) (*InvoiceTotals, error)
+	BulkUpdateInvoices(filter InvoiceFilter, action BulkAction) (int64, error)
+	BulkUpdateInvoiceStatus(ids []uint, status string, now time.Time) (*BulkStatusUpdate, error)
+	GetInvoice(id uint) (*Invoice, error)
+	GetInvoiceByUUID(id uuid.UUID) (*Invoice, error)
+	GetClientInvoices(clientID uint) ([]Invoice, error)
+	CreateInvoice(invoice *Invoice) error
+	UpdateInvoice(invoice *Invoice) error
+	DeleteInvoice(id uint) error
+	SendInvoice(id uint, now time.Time) (*Invoice, error)
+	GetInvoiceLock(invoiceID uint) (*InvoiceLock, error)
+	LockInvoice(invoiceID uint, holder lockHolder, now time.Time, duration time.Duration) (*InvoiceLock, error)
+	UnlockInvoice(invoiceID uint, holder lockHolder, now time.Time) error
+	ConvertDocument(id uint, documentType DocumentType) (*Invoice, error)
+	RecordInvoiceEvent(invoiceID uint, eventType, message string) error
+	GetInvoiceEvents(invoiceID uint) ([]InvoiceEvent, error)
+	GetInvoiceRevisions(invoiceID uint) ([]InvoiceRevision, error)
+}
+
+type InvoiceTemplateStore interface {
+	GetInvoiceTemplates(companyID uint) ([]InvoiceTemplate, error)
+	GetInvoiceTemplate(id uint) (*InvoiceTemplate, error)
+	GetDefaultInvoiceTemplate(companyID uint) (*InvoiceTemplate, error)
+	SaveInvoiceTemplate(invoiceTemplate *InvoiceTemplate) error
+	DeleteInvoiceTemplate(id uint) error
+}
+
+type TemplateVersionStore interface {
+	GetInvoiceTemplateVersions(templateID uint) ([]InvoiceTemplateVersion, error)
+	RecordTemplateVersion(name, source string) (*TemplateVersion, error)
+	GetTemplateVersions(name string) ([]TemplateVersion, error)
+}
+
+type PaymentStore interface {
+	GetPayments(invoiceID uint) ([]Payment, error)
+	GetPaidAmount(invoiceID uint) (Money, error)
+	GetClientPayments(clientID uint) ([]Payment, error)
+	CreatePayment(payment *Payment) error
+	DeletePayment(id uint) error
+}
+
+type ReminderStore interface {
+	GetOpenInvoices() ([]Invoice, error)
+	GetInvoicesDueForReminder(now time.Time) ([]Invoice, error)
+	MarkReminderSent(invoiceID uint, at time.Time) error
+	SnoozeReminders(invoiceID uint, until *time.Time) error
+	SetReminderDays(invoiceID uint, days ReminderDays) error
+}
+
+type SurveyStore interface {
+	SaveSurveyResponse(response *SurveyResponse) error
+	GetSurveyResponses(companyID uint) ([]SurveyResponse, error)
+	GetNPSScore(companyID *uint) (*NPSScore, error)
+}
+
+type PeppolStore interface {
+	CreatePeppolTransmission(transmission *PeppolTransmission) error
+	GetPeppolTransmissions(invoiceID uint) ([]PeppolTransmission, error)
+}
+
+type ProjectStore interface {
+	GetProjects(filter ProjectFilter) ([]Project, error)
+	GetProject(id uint) (*Project, error)
+	CreateProject(project *Project) error
+	UpdateProject(project *Project) error
+	DeleteProject(id uint) error
+	SetProjectBudgetAlerted(id uint, at *time.Time) error
+	GetProjectProfitability(from, to *time.Time) ([]ProjectProfitability, error)
+}
+
+type TaskStore interface {
+	GetTasks(projectID uint) ([]Task, error)
+	GetTask(id uint) (*Task, error)
+	CreateTask(task *Task) error
+	UpdateTask(task *Task) error
+	DeleteTask(id uint) error
+	GetTimeEntries(projectID uint) ([]TimeEntry, error)
+	CreateTimeEntry(entry *TimeEntry) error
+	DeleteTimeEntry(id uint) error
+}
+
+type DeliverableStore interface {
+	GetDeliverables(clientID *uint, invoiced *bool) ([]Deliverable, error)
+	CreateDeliverable(deliverable *Deliverable) error
+	DeleteDeliverable(id uint) error
+	ConsolidateDeliverables(clientID uint, month, issueDate time.Time, remitID *uint) ([]Invoice, error)
+	GetClientsConsolidatingOn(day int) ([]Company, error)
+}
+
+type EmailMessageStore interface {
+	RecordEmailMessage(message *EmailMessage) error
+	GetInvoiceEmailMessages(invoiceID uint) ([]EmailMessage, error)
+	GetCompanyEmailMessages(companyID uint) ([]EmailMessage, error)
+}
+
+type EmailLogStore interface {
+	RecordEmailLog(entry *EmailLog) error
+	GetEmailLogs(filter EmailLogFilter) ([]EmailLog, error)
+	RecordEmailBounce(bounce EmailBounce, now time.Time) (int64, error)
+}
+
+type InvoiceDisputeStore interface {
+	OpenInvoiceDispute(dispute *InvoiceDispute) error
+	ResolveInvoiceDispute(invoiceID uint, userID *uint, resolution string, now time.Time) (*InvoiceDispute, error)
+	GetInvoiceDisputes(invoiceID uint) ([]InvoiceDispute, error)
+}
+
+type WhatsAppStore interface {
+	RecordWhatsAppMessage(message *WhatsAppMessage) error
+	GetInvoiceWhatsAppMessages(invoiceID uint) ([]WhatsAppMessage, error)
+	UpdateWhatsAppStatus(providerID, status, reason string) error
+}
+
+type InvoiceCommentStore interface {
+	GetInvoiceComments(invoiceID uint) ([]InvoiceComment, error)
+	GetInvoiceComment(id uint) (*InvoiceComment, error)
+	CreateInvoiceComment(comment *InvoiceComment) error
+	DeleteInvoiceComment(id uint) error
+}
+
+type ReportStore interface {
+	GetStatement(clientID uint, from, to *time.Time) (*Statement, error)
+	GetRevenueBySource(from, to *time.Time) ([]SourceRevenue, error)
+	GetRevenueByCategory(from, to *time.Time) ([]CategoryRevenue, error)
+	GetRevenue(groupBy RevenueGrouping, from, to *time.Time, issuerID *uint) ([]RevenueLine, error)
+	GetClientReport(query ClientReportQuery, now time.Time) ([]ClientReportLine, int64, error)
+	GetStorageUsage() (*StorageUsage, error)
+	GetCompanyOverview(companyID uint) (*CompanyOverview, error)
+	GetDashboardSummary() (*DashboardSummary, error)
+}
+
+type PreferenceStore interface {
+	GetListColumns(userID *uint, list string) (Columns, error)
+	SetListColumns(userID *uint, list string, columns Columns) error
+	GetSavedViews(userID *uint) ([]SavedView, error)
+	GetSavedView(userID *uint, id uint) (*SavedView, error)
+	CreateSavedView(view *SavedView) error
+	UpdateSavedView(view *SavedView) error
+	DeleteSavedView(userID *uint, id uint) error
+}
+
+type UserStore interface {
+	GetUser(id uint) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	GetUsers() ([]User, error)
+	CreateUser(user *User) error
+	SetPassword(userID uint, passwordHash string) error
+	GetUserByIdentity(issuer, subject string) (*User, error)
+	LinkUserIdentity(identity *UserIdentity) error
+	RecordLoginFailure(username string, now time.Time) error
+	RecordLoginSuccess(userID uint) error
+	CreatePasswordResetToken(userID uint, now time.Time) (string, error)
+	ResetPassword(token, passwordHash string, now time.Time) (*User, error)
+	ForcePasswordReset(userID uint) error
+	GetCompanyUsers(companyID uint) ([]User, error)
+	DeleteCompanyUser(companyID, userID uint) error
+}
+
+type AuditStore interface {
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+	RecordLoginAttempt(attempt *LoginAttempt) error
+	GetLoginAttempts(filter LoginAttemptFilter) ([]LoginAttempt, error)
+	CountLoginAttempts(ip string, since time.Time) (int64, error)
+}
+
+type SettingsStore interface {
+	GetSettings() (Settings, error)
+	SaveSettings(s Settings) error
+}
+
+type JobStore interface {
+	CreateJob(job *Job) error
+	GetJob(id uint) (*Job, error)
+	GetJobs(filter JobFilter) ([]Job, error)
+	ClaimJob(owner string, now time.Time) (*Job, error)
+	RenewJobLease(job *Job, until time.Time) error
+	FinishJob(job *Job, runErr error, now time.Time) error
+	RetryJob(id uint, now time.Time) error
+	RequeueRunningJobs() (int64, error)
+	RequeueExpiredJobs(now time.Time) (int64, error)
+}
+
+type CalendarStore interface {
+	SetCalendarToken(userID uint) (string, error)
+	RevokeCalendarToken(userID uint) error
+	GetUserByCalendarToken(token string) (*User, error)
+	GetOpenTasksDue() ([]Task, error)
+	GetConsolidatingClients() ([]Company, error)
+}
+
+type InboundEmailStore interface {
+	MatchSenderCompany(address string) (*Company, error)
+	GetInboundEmailByMessageID(messageID string) (*InboundEmail, error)
+	CreateInboundEmail(email *InboundEmail, files []EmailAttachment) error
+	GetInboundEmails(filter InboundEmailFilter) ([]InboundEmail, error)
+	GetInboundEmail(id uint) (*InboundEmail, error)
+	AssignInboundEmail(id, companyID uint) error
+}
+
+type DatasetStore interface {
+	ExportDataset(now time.Time) (*Dataset, error)
+	ImportDataset(dataset *Dataset) error
+}
+
+type BillingStore interface {
+	GetBillingRuns(month string) ([]BillingRun, error)
+	RecordBillingRun(run *BillingRun) error
+}
+
+type ContractStore interface {
+	GetContracts(filter ContractFilter) ([]Contract, error)
+	GetContract(id uint) (*Contract, error)
+	CreateContract(contract *Contract) error
+	UpdateContract(contract *Contract) error
+	DeleteContract(id uint) error
+	GetContractBillings(month string) ([]ContractBilling, error)
+	BillContract(contract *Contract, month, issueDate time.Time) (*Invoice, error)
+	GetRecurringRevenue(on time.Time) (*RecurringRevenue, error)
+}
+
+type PriceListStore interface {
+	GetPriceLists() ([]PriceList, error)
+	GetPriceList(id uint) (*PriceList, error)
+	CreatePriceList(list *PriceList) error
+	UpdatePriceList(list *PriceList) error
+	DeletePriceList(id uint) error
+	GetClientPrice(clientID, productID uint, on time.Time) (Money, error)
+}
+
+type BankTransactionStore interface {
+	ImportBankTransactions(transactions []BankTransaction, now time.Time) (*BankImport, error)
+	GetBankTransactions(filter BankTransactionFilter) ([]BankTransaction, error)
+	AssignBankTransaction(id, invoiceID uint, now time.Time) (*BankTransaction, error)
+	ReviewBankTransaction(id uint, confirm bool, now time.Time) (*BankTransaction, error)
+	GetLastBankPoll() (*BankPoll, error)
+	RecordBankPoll(poll *BankPoll) error
+}
+
+type DatabaseStore interface {
+	DatabaseStats() (*DatabaseStats, error)
+}
+
+type DigestStore interface {
+	GetDigest(since, now time.Time) (*Digest, error)
+	DigestSent(day string) (bool, error)
+	RecordDigestSent(day string, at time.Time) error
+}
+
+// Store is the full set of stores the handlers are built on
+type Store interface {
+	CompanyStore
+	AttachmentStore
+	ReferralSourceStore
+	CategoryStore
+	TagStore
+	CustomFieldStore
+	RemitInformationStore
+	ProductStore
+	InvoiceStore
+	InvoiceTemplateStore
+	TemplateVersionStore
+	PaymentStore
+	ReminderStore
+	SurveyStore
+	PeppolStore
+	ProjectStore
+	TaskStore
+	DeliverableStore
+	EmailMessageStore
+	EmailLogStore
+	WhatsAppStore
+	InvoiceCommentStore
+	InvoiceDisputeStore
+	ReportStore
+	PreferenceStore
+	UserStore
+	AuditStore
+	DigestStore
+	DatabaseStore
+	SettingsStore
+	JobStore
+	CalendarStore
+	InboundEmailStore
+	DatasetStore
+	BillingStore
+	ContractStore
+	PriceListStore
+	BankTransactionStore
+
+	// WithContext returns the store bound to the unit of work carried by
+	// ctx, or the store itself when there is none
+	WithContext(ctx context.Context) Store
+	// AfterUnitOfWork runs write with a store outside of the unit of work
+	// once it is over, committed or rolled back, so what it records
+	// outlives a failed request; right away when there is none
+	AfterUnitOfWork(write func(store Store))
+}
+
+// UnitOfWork is implemented by stores that can run each write request
+// inside a single transaction
+type UnitOfWork interface {
+	UnitOfWork(next http.Handler) http.Handler
+}
+
+// Handler serves the HTTP API on top of a Store
+type Handler struct {
+	store   Store
+	reports *reportLimiter
+	// oidc is nil unless OpenID Connect sign in is enabled
+	oidc *oidcProvider
+	// blocked holds the IPs blocked after failed logins
+	blocked ipBlocker
+	// noAuth serves the routes of users to anybody, AUTH_MODE=none. Unlike
+	// the tests, nobody gets the overrides of administrators.
+	noAuth bool
+}
+
+func NewHandler(store Store) *Handler {
+	h := &Handler{store: store, reports: newReportLimiter(config.Reports), blocked: newIPBlocker(), noAuth: config.AuthMode == AuthModeNone}
+	if config.OIDC.Enabled() {
+		h.oidc = newOIDCProvider(config.OIDC)
+	}
+	return h
+}
+
+// storeFor returns the store handlers must use for the request, so every
+// call made while serving it joins the request's unit of work
+func (h *Handler) storeFor(r *http.Request) Store {
+	return h.store.WithContext(r.Context())
+}
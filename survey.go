@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// SurveyResponse is a client's answer to "how likely are you to recommend us",
+// one per paid invoice
+type SurveyResponse struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CompanyID uint      `gorm:"not null;index" json:"company_id"`
+	Company   Company   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	InvoiceID uint      `gorm:"not null;uniqueIndex" json:"invoice_id"`
+	Invoice   Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Score     int       `gorm:"not null" json:"score"`
+	Comment   string    `gorm:"type:text" json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NPSScore aggregates survey responses into a Net Promoter Score: the
+// percentage of promoters (9-10) minus the percentage of detractors (0-6)
+type NPSScore struct {
+	Responses  int     `json:"responses"`
+	Promoters  int     `json:"promoters"`
+	Passives   int     `json:"passives"`
+	Detractors int     `json:"detractors"`
+	Score      float64 `json:"score"`
+}
+
+// SaveSurveyResponse stores the response, replacing an earlier answer for the same invoice
+func (r *Repository) SaveSurveyResponse(response *SurveyResponse) error {
+	return retryOnBusy(func() error {
+		return r.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "invoice_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"score", "comment", "created_at"}),
+		}).Create(response).Error
+	})
+}
+
+func (r *Repository) GetSurveyResponses(companyID uint) ([]SurveyResponse, error) {
+	var responses []SurveyResponse
+	err := r.db.Where("company_id = ?", companyID).Order("created_at DESC").Find(&responses).Error
+	return responses, err
+}
+
+// GetNPSScore aggregates every response, or only the given company's
+func (r *Repository) GetNPSScore(companyID *uint) (*NPSScore, error) {
+	query := r.db.Model(&SurveyResponse{}).Select(
+		"COUNT(*) AS responses, " +
+			"COALESCE(SUM(CASE WHEN score >= 9 THEN 1 ELSE 0 END), 0) AS promoters, " +
+			"COALESCE(SUM(CASE WHEN score BETWEEN 7 AND 8 THEN 1 ELSE 0 END), 0) AS passives, " +
+			"COALESCE(SUM(CASE WHEN score <= 6 THEN 1 ELSE 0 END), 0) AS detractors")
+	if companyID != nil {
+		query = query.Where("company_id = ?", *companyID)
+	}
+
+	var score NPSScore
+	if err := query.Scan(&score).Error; err != nil {
+		return nil, err
+	}
+	if score.Responses > 0 {
+		score.Score = float64(score.Promoters-score.Detractors) * 100 / float64(score.Responses)
+	}
+	return &score, nil
+}
+
+// signSurveyUUID signs survey links, distinct from share links so one can't
+// be used as the other
+func signSurveyUUID(id uuid.UUID) string {
+	mac := hmac.New(sha256.New, shareLinkSecret)
+	mac.Write([]byte("survey:" + id.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func surveyLinkPath(invoice *Invoice) string {
+	return "/survey/" + invoice.UUID.String() + "?sig=" + signSurveyUUID(invoice.UUID)
+}
+
+// sendReceipt thanks the client for paying the invoice when receipts or
+// surveys are enabled, with the survey link when surveys are
+func sendReceipt(r Store, invoice *Invoice) error {
+	if !config.ReceiptsEnabled && !config.NPSSurveyEnabled || invoice.Client.Email == "" {
+		return nil
+	}
+
+	body := fmt.Sprintf("Hello,\n\nWe received the payment of invoice %s (%s). Thank you!\n",
+		invoice.Identification(), invoice.FormatMoney(invoice.Total()))
+	if config.NPSSurveyEnabled {
+		body += fmt.Sprintf("\nHow likely are you to recommend us to a friend or colleague? Let us know in one click:\n%s\n",
+			publicURL(surveyLinkPath(invoice)))
+	}
+
+	email := &Email{
+		To:      []string{invoice.Client.Email},
+		Subject: fmt.Sprintf("Payment received - invoice %s", invoice.Identification()),
+		Body:    body,
+	}
+	if err := sendClientEmail(r, &invoice.Client, &invoice.ID, email); err != nil {
+		return err
+	}
+	return r.RecordInvoiceEvent(invoice.ID, "receipt_sent", "Receipt sent to "+invoice.Client.Email)
+}
+
+// surveyInvoice loads the invoice of a signed survey link, only paid
+// invoices are rated
+func (h *Handler) surveyInvoice(w http.ResponseWriter, r *http.Request) (*Invoice, bool) {
+	invoiceUUID, err := uuid.Parse(r.PathValue("invoiceUUID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	signature := r.URL.Query().Get("sig")
+	if !hmac.Equal([]byte(signature), []byte(signSurveyUUID(invoiceUUID))) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	invoice, err := h.storeFor(r).GetInvoiceByUUID(invoiceUUID)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if !invoice.Paid {
+		http.Error(w, "Only paid invoices can be rated", http.StatusConflict)
+		return nil, false
+	}
+	return invoice, true
+}
+
+func renderSurvey(w http.ResponseWriter, data interface{}) {
+	tmplPath := filepath.Join("templates", "surveys", "nps.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		log.Printf("Error parsing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing template %s: %v", tmplPath, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type surveyPage struct {
+	Invoice   *Invoice
+	Scores    []int
+	Submitted bool
+}
+
+func (h *Handler) viewSurvey(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.surveyInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	renderSurvey(w, surveyPage{Invoice: invoice, Scores: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}})
+}
+
+func (h *Handler) submitSurvey(w http.ResponseWriter, r *http.Request) {
+	invoice, ok := h.surveyInvoice(w, r)
+	if !ok {
+		return
+	}
+
+	score, err := strconv.Atoi(r.FormValue("score"))
+	if err != nil || score < 0 || score > 10 {
+		http.Error(w, "Score must be between 0 and 10", http.StatusBadRequest)
+		return
+	}
+
+	response := SurveyResponse{
+		CompanyID: invoice.ClientID,
+		InvoiceID: invoice.ID,
+		Score:     score,
+		Comment:   r.FormValue("comment"),
+		CreatedAt: clock.Now(),
+	}
+	if err := h.storeFor(r).SaveSurveyResponse(&response); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	renderSurvey(w, surveyPage{Invoice: invoice, Submitted: true})
+}
+
+func (h *Handler) getCompanySurveys(w http.ResponseWriter, r *http.Request) {
+	companyIdStr := r.PathValue("companyId")
+	companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return
+	}
+
+	responses, err := h.storeFor(r).GetSurveyResponses(uint(companyId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses)
+}
+
+func (h *Handler) getNPSScore(w http.ResponseWriter, r *http.Request) {
+	var companyID *uint
+	if companyIdStr := r.URL.Query().Get("company_id"); companyIdStr != "" {
+		companyId, err := strconv.ParseUint(companyIdStr, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid company ID", http.StatusBadRequest)
+			return
+		}
+		id := uint(companyId)
+		companyID = &id
+	}
+
+	score, err := h.storeFor(r).GetNPSScore(companyID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(score)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+var ErrUnknownTag = errors.New("no company, invoice or product carries that tag")
+
+// taggedTables are the tables carrying Tags, by the name TagUsage counts
+// them under
+var taggedTables = []struct {
+	Name  string
+	Model interface{}
+}{
+	{"companies", &Company{}},
+	{"invoices", &Invoice{}},
+	{"products", &Product{}},
+}
+
+// TagUsage is a tag in use and how many records of each kind carry it
+type TagUsage struct {
+	Tag       string `json:"tag"`
+	Companies int64  `json:"companies"`
+	Invoices  int64  `json:"invoices"`
+	Products  int64  `json:"products"`
+}
+
+// taggedRecord is the part of a tagged row the tag management reads
+type taggedRecord struct {
+	ID   uint
+	Tags Tags `gorm:"type:text"`
+}
+
+// GetTags lists every tag in use, archived records included, by name
+func (r *Repository) GetTags() ([]TagUsage, error) {
+	usages := map[string]*TagUsage{}
+	for _, table := range taggedTables {
+		var records []taggedRecord
+		if err := r.db.Model(table.Model).Select("id, tags").Where("tags IS NOT NULL").Scan(&records).Error; err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			for _, tag := range record.Tags {
+				usage, ok := usages[tag]
+				if !ok {
+					usage = &TagUsage{Tag: tag}
+					usages[tag] = usage
+				}
+				switch table.Name {
+				case "companies":
+					usage.Companies++
+				case "invoices":
+					usage.Invoices++
+				case "products":
+					usage.Products++
+				}
+			}
+		}
+	}
+
+	tags := make([]TagUsage, 0, len(usages))
+	for _, usage := range usages {
+		tags = append(tags, *usage)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags, nil
+}
+
+// retag replaces tag with to on every record carrying it, or removes it
+// when to is empty. Records already carrying to keep it once, which merges
+// the two tags.
+func (r *Repository) retag(tag, to string) (int64, error) {
+	var affected int64
+	err := retryOnBusy(func() error {
+		affected = 0
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			for _, table := range taggedTables {
+				var records []taggedRecord
+				err := tx.Model(table.Model).Select("id, tags").Where("tags LIKE ?", tagLike(tag)).Scan(&records).Error
+				if err != nil {
+					return err
+				}
+				for _, record := range records {
+					tags := Tags{}
+					seen := map[string]bool{}
+					for _, current := range record.Tags {
+						if current == tag {
+							current = to
+						}
+						if current != "" && !seen[current] {
+							seen[current] = true
+							tags = append(tags, current)
+						}
+					}
+					if err := tx.Model(table.Model).Where("id = ?", record.ID).UpdateColumn("tags", tags).Error; err != nil {
+						return err
+					}
+				}
+				affected += int64(len(records))
+			}
+			if affected == 0 {
+				return ErrUnknownTag
+			}
+			return nil
+		})
+	})
+	return affected, err
+}
+
+// RenameTag renames the tag on every company, invoice and product
+func (r *Repository) RenameTag(tag, to string) (int64, error) {
+	return r.retag(tag, to)
+}
+
+// DeleteTag removes the tag from every company, invoice and product
+func (r *Repository) DeleteTag(tag string) (int64, error) {
+	return r.retag(tag, "")
+}
+
+// Tag handlers
+func (h *Handler) getTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.storeFor(r).GetTags()
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func (h *Handler) renameTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := normalizeTag(r.PathValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Tag string `json:"tag"`
+	}
+	if err := decodeRequest(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := normalizeTag(request.Tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	affected, err := h.storeFor(r).RenameTag(tag, to)
+	writeBulkResult(w, affected, err)
+}
+
+func (h *Handler) deleteTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := normalizeTag(r.PathValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	affected, err := h.storeFor(r).DeleteTag(tag)
+	writeBulkResult(w, affected, err)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TaskStatus tracks a task of a project from open to done
+type TaskStatus string
+
+const (
+	TaskOpen TaskStatus = "open"
+	TaskDone TaskStatus = "done"
+)
+
+// Task is a piece of work of a project, time entries may be booked on it
+type Task struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	ProjectID uint       `gorm:"not null;index" json:"project_id"`
+	Project   Project    `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name      string     `gorm:"size:255;not null" json:"name"`
+	Status    TaskStatus `gorm:"size:20;not null;default:open" json:"status"`
+	DueDate   *time.Time `gorm:"index" json:"due_date"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TimeEntry is time spent on a project. HourlyCost is what the hour costs,
+// so the project profitability can weigh the time against the billing.
+type TimeEntry struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	ProjectID   uint      `gorm:"not null;index" json:"project_id"`
+	Project     Project   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	TaskID      *uint     `gorm:"index" json:"task_id"`
+	Task        *Task     `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	UserID      *uint     `gorm:"index" json:"user_id"`
+	User        *User     `gorm:"constraint:OnDelete:SET NULL" json:"-"`
+	Date        time.Time `gorm:"not null;index" json:"date"`
+	Hours       float64   `gorm:"type:decimal(10,2);not null" json:"hours"`
+	HourlyCost  float64   `gorm:"type:decimal(10,2);not null;default:0.00" json:"hourly_cost"`
+	Description *string   `gorm:"size:255" json:"description"`
+}
+
+// validateTask checks the fields the database doesn't constrain
+func validateTask(task *Task) error {
+	task.Name = strings.TrimSpace(task.Name)
+	if task.Name == "" {
+		return errors.New("Name is required")
+	}
+	if task.Status == "" {
+		task.Status = TaskOpen
+	}
+	if task.Status != TaskOpen && task.Status != TaskDone {
+		return errors.New("Status must be open or done")
+	}
+	return nil
+}
+
+// validateTimeEntry checks the fields the database doesn't constrain
+func validateTimeEntry(entry *TimeEntry) error {
+	if entry.Hours <= 0 {
+		return errors.New("Hours must be positive")
+	}
+	if entry.HourlyCost < 0 {
+		return errors.New("Hourly cost can't be negative")
+	}
+	if entry.Date.IsZero() {
+		entry.Date = clock.Now()
+	}
+	return nil
+}
+
+func (r *Repository) GetTasks(projectID uint) ([]Task, error) {
+	var tasks []Task
+	err := r.db.Where("project_id = ?", projectID).Order("created_at, id").Find(&tasks).Error
+	return tasks, err
+}
+
+func (r *Repository) GetTask(id uint) (*Task, error) {
+	var task Task
+	if err := r.db.First(&task, id).Error; err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (r *Repository) CreateTask(task *Task) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(task).Error
+	})
+}
+
+func (r *Repository) UpdateTask(task *Task) error {
+	return retryOnBusy(func() error {
+		return r.db.Model(task).Select("Name", "Status", "DueDate").Updates(task).Error
+	})
+}
+
+func (r *Repository) DeleteTask(id uint) error {
+	return retryOnBusy(func() error {
+		if err := r.db.Model(&TimeEntry{}).Where("task_id = ?", id).UpdateColumn("task_id", nil).Error; err != nil {
+			return err
+		}
+		return r.db.Delete(&Task{}, id).Error
+	})
+}
+
+func (r *Repository) GetTimeEntries(projectID uint) ([]TimeEntry, error) {
+	var entries []TimeEntry
+	err := r.db.Where("project_id = ?", projectID).Order("date, id").Find(&entries).Error
+	return entries, err
+}
+
+func (r *Repository) CreateTimeEntry(entry *TimeEntry) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(entry).Error
+	})
+}
+
+func (r *Repository) DeleteTimeEntry(id uint) error {
+	return retryOnBusy(func() error {
+		return r.db.Delete(&TimeEntry{}, id).Error
+	})
+}
+
+// projectIDFromPath reads the project of a nested route, answering 404
+// when it doesn't exist
+func (h *Handler) projectIDFromPath(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	projectId, err := strconv.ParseUint(r.PathValue("projectId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if _, err := h.storeFor(r).GetProject(uint(projectId)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return 0, false
+	}
+	return uint(projectId), true
+}
+
+// Task handlers
+func (h *Handler) getTasks(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := h.projectIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	tasks, err := h.storeFor(r).GetTasks(projectID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+func (h *Handler) createTask(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := h.projectIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var task Task
+	if err := decodeRequest(r, &task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	task.ID, task.ProjectID = 0, projectID
+
+	if err := validateTask(&task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).CreateTask(&task); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(task)
+}
+
+func (h *Handler) updateTask(w http.ResponseWriter, r *http.Request) {
+	taskIdStr := r.PathValue("taskId")
+	taskId, err := strconv.ParseUint(taskIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	var task Task
+	if err := decodeRequest(r, &task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	task.ID = uint(taskId)
+
+	if err := validateTask(&task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).UpdateTask(&task); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) deleteTask(w http.ResponseWriter, r *http.Request) {
+	taskIdStr := r.PathValue("taskId")
+	taskId, err := strconv.ParseUint(taskIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteTask(uint(taskId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Time entry handlers
+func (h *Handler) getTimeEntries(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := h.projectIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := h.storeFor(r).GetTimeEntries(projectID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (h *Handler) createTimeEntry(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := h.projectIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var entry TimeEntry
+	if err := decodeRequest(r, &entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.ID, entry.ProjectID = 0, projectID
+	if entry.UserID == nil {
+		entry.UserID = currentUserID(r.Context())
+	}
+
+	if err := validateTimeEntry(&entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if entry.TaskID != nil {
+		task, err := h.storeFor(r).GetTask(*entry.TaskID)
+		if err != nil || task.ProjectID != projectID {
+			http.Error(w, "Task not found in the project", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.storeFor(r).CreateTimeEntry(&entry); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+func (h *Handler) deleteTimeEntry(w http.ResponseWriter, r *http.Request) {
+	entryIdStr := r.PathValue("timeEntryId")
+	entryId, err := strconv.ParseUint(entryIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid time entry ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storeFor(r).DeleteTimeEntry(uint(entryId)); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
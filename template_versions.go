@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TemplateVersion is the content of an HTML file in templates/invoices at
+// some point in time. A new version is recorded whenever the file changes,
+// so invoices already sent keep rendering with the file they were sent with.
+type TemplateVersion struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"size:255;not null;index" json:"name"`
+	Hash      string    `gorm:"size:64;not null" json:"hash"`
+	Source    string    `gorm:"type:text;not null" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InvoiceTemplateVersion is a snapshot of a stored template's settings,
+// taken every time the template is saved
+type InvoiceTemplateVersion struct {
+	ID                  uint            `gorm:"primaryKey" json:"id"`
+	InvoiceTemplateID   uint            `gorm:"not null;uniqueIndex:idx_invoice_template_versions_version" json:"invoice_template_id"`
+	InvoiceTemplate     InvoiceTemplate `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Version             int             `gorm:"not null;uniqueIndex:idx_invoice_template_versions_version" json:"version"`
+	BaseTemplate        string          `gorm:"size:255;not null" json:"base_template"`
+	LogoURL             string          `gorm:"size:1024" json:"logo_url"`
+	Color               string          `gorm:"size:7" json:"color"`
+	FooterText          string          `gorm:"type:text" json:"footer_text"`
+	PaymentInstructions string          `gorm:"type:text" json:"payment_instructions"`
+	CreatedAt           time.Time       `json:"created_at"`
+}
+
+// apply returns the template with the settings of the version
+func (v *InvoiceTemplateVersion) apply(t InvoiceTemplate) *InvoiceTemplate {
+	t.BaseTemplate = v.BaseTemplate
+	t.LogoURL = v.LogoURL
+	t.Color = v.Color
+	t.FooterText = v.FooterText
+	t.PaymentInstructions = v.PaymentInstructions
+	return &t
+}
+
+// recordInvoiceTemplateVersion snapshots the template as its next version
+func recordInvoiceTemplateVersion(tx *gorm.DB, t *InvoiceTemplate) error {
+	var latest int
+	if err := tx.Model(&InvoiceTemplateVersion{}).Where("invoice_template_id = ?", t.ID).
+		Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+		return err
+	}
+	return tx.Create(&InvoiceTemplateVersion{
+		InvoiceTemplateID:   t.ID,
+		Version:             latest + 1,
+		BaseTemplate:        t.BaseTemplate,
+		LogoURL:             t.LogoURL,
+		Color:               t.Color,
+		FooterText:          t.FooterText,
+		PaymentInstructions: t.PaymentInstructions,
+	}).Error
+}
+
+func (r *Repository) GetInvoiceTemplateVersions(templateID uint) ([]InvoiceTemplateVersion, error) {
+	var versions []InvoiceTemplateVersion
+	err := r.db.Where("invoice_template_id = ?", templateID).Order("version").Find(&versions).Error
+	return versions, err
+}
+
+// RecordTemplateVersion stores the source of the invoice file unless it's
+// the same as its latest version
+func (r *Repository) RecordTemplateVersion(name, source string) (*TemplateVersion, error) {
+	sum := sha256.Sum256([]byte(source))
+	version := TemplateVersion{Name: name, Hash: hex.EncodeToString(sum[:]), Source: source}
+	err := retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var latest TemplateVersion
+			err := tx.Where("name = ?", name).Order("id DESC").First(&latest).Error
+			if err == nil && latest.Hash == version.Hash {
+				version = latest
+				return nil
+			}
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			return tx.Create(&version).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func (r *Repository) GetTemplateVersions(name string) ([]TemplateVersion, error) {
+	var versions []TemplateVersion
+	err := r.db.Where("name = ?", name).Order("id").Find(&versions).Error
+	return versions, err
+}
+
+// versionAt returns the index of the last version created at or before at,
+// or of the first one when all of them are newer. Versions predating the
+// versioning itself are only known from the first snapshot.
+func versionAt(count int, createdAt func(int) time.Time, at time.Time) int {
+	i := sort.Search(count, func(i int) bool { return createdAt(i).After(at) })
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// snapshotTemplateFiles records the current version of every invoice file
+func snapshotTemplateFiles(store TemplateVersionStore) error {
+	entries, err := os.ReadDir(filepath.Join("templates", "invoices"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		source, err := os.ReadFile(filepath.Join("templates", "invoices", entry.Name()))
+		if err != nil {
+			return err
+		}
+		if _, err := store.RecordTemplateVersion(entry.Name(), string(source)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// invoiceTemplateSource returns the file and settings an invoice renders
+// with. Drafts use the current ones, sent invoices the versions active when
+// they were sent, so regenerating them gives the same document. record
+// keeps the current file as a version, else a file never recorded is used
+// as it is.
+func invoiceTemplateSource(store TemplateVersionStore, invoice *Invoice, templateName string, settings *InvoiceTemplate, record bool) (string, *InvoiceTemplate, error) {
+	if settings != nil && invoice.SentAt != nil {
+		versions, err := store.GetInvoiceTemplateVersions(settings.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(versions) > 0 {
+			i := versionAt(len(versions), func(i int) time.Time { return versions[i].CreatedAt }, *invoice.SentAt)
+			settings = versions[i].apply(*settings)
+			templateName = settings.BaseTemplate
+		}
+	}
+
+	templateName = filepath.Base(templateName)
+	source, readErr := os.ReadFile(filepath.Join("templates", "invoices", templateName))
+	if readErr == nil && record {
+		if _, err := store.RecordTemplateVersion(templateName, string(source)); err != nil {
+			return "", nil, err
+		}
+	}
+	if invoice.SentAt == nil {
+		return string(source), settings, readErr
+	}
+
+	// The file may be gone by now, its versions are still around
+	versions, err := store.GetTemplateVersions(templateName)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(versions) == 0 {
+		return string(source), settings, readErr
+	}
+	i := versionAt(len(versions), func(i int) time.Time { return versions[i].CreatedAt }, *invoice.SentAt)
+	return versions[i].Source, settings, nil
+}
+
+func (h *Handler) getInvoiceTemplateVersions(w http.ResponseWriter, r *http.Request) {
+	templateIdStr := r.PathValue("templateId")
+	templateId, err := strconv.ParseUint(templateIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.storeFor(r).GetInvoiceTemplate(uint(templateId)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	versions, err := h.storeFor(r).GetInvoiceTemplateVersions(uint(templateId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InvoiceEvent is an entry in an invoice's timeline
+type InvoiceEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	InvoiceID uint      `gorm:"not null;index" json:"invoice_id"`
+	Invoice   Invoice   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Type      string    `gorm:"size:50;not null" json:"type"`
+	Message   string    `gorm:"type:text" json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecordInvoiceEvent appends an entry to the invoice's timeline
+func (r *Repository) RecordInvoiceEvent(invoiceID uint, eventType, message string) error {
+	return retryOnBusy(func() error {
+		return r.db.Create(&InvoiceEvent{InvoiceID: invoiceID, Type: eventType, Message: message}).Error
+	})
+}
+
+func (r *Repository) GetInvoiceEvents(invoiceID uint) ([]InvoiceEvent, error) {
+	var events []InvoiceEvent
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at, id").Find(&events).Error
+	return events, err
+}
+
+func (h *Handler) getInvoiceTimeline(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.storeFor(r).GetInvoiceEvents(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteUTCDriver is the SQLite driver the repository opens the database
+// with. Times are stored in UTC, which SQLite, comparing them as text,
+// needs to order them whatever time zone they were given in, and read back
+// in the business time zone with the _loc pragma of sqliteDSN.
+const sqliteUTCDriver = "sqlite3_utc"
+
+func init() {
+	sql.Register(sqliteUTCDriver, utcDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type utcDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+func (d utcDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return utcConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// utcConn binds the times of every statement in UTC
+type utcConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (utcConn) CheckNamedValue(value *driver.NamedValue) error {
+	switch t := value.Value.(type) {
+	case time.Time:
+		value.Value = t.UTC()
+		return nil
+	case *time.Time:
+		if t != nil {
+			value.Value = t.UTC()
+			return nil
+		}
+	}
+	return driver.ErrSkip
+}
+
+// parseDate reads a YYYY-MM-DD date as midnight in the business time zone
+func parseDate(value string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02", value, config.Location())
+}
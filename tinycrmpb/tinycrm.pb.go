@@ -0,0 +1,2122 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: tinycrm/v1/tinycrm.proto
+
+// The gRPC API mirrors the JSON API. Unset optional fields are null there,
+// timestamps are UTC and amounts use the invoice currency.
+
+package tinycrmpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Company struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Id               uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name             string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Document         string                 `protobuf:"bytes,3,opt,name=document,proto3" json:"document,omitempty"`
+	Address          string                 `protobuf:"bytes,4,opt,name=address,proto3" json:"address,omitempty"`
+	Email            string                 `protobuf:"bytes,5,opt,name=email,proto3" json:"email,omitempty"`
+	Locale           string                 `protobuf:"bytes,6,opt,name=locale,proto3" json:"locale,omitempty"`
+	Country          string                 `protobuf:"bytes,7,opt,name=country,proto3" json:"country,omitempty"`
+	PeppolId         string                 `protobuf:"bytes,8,opt,name=peppol_id,json=peppolId,proto3" json:"peppol_id,omitempty"`
+	ReferralSourceId *uint32                `protobuf:"varint,9,opt,name=referral_source_id,json=referralSourceId,proto3,oneof" json:"referral_source_id,omitempty"`
+	// Tags, owner and archiving are read only, they are managed through the
+	// bulk endpoints of the JSON API
+	Tags          []string               `protobuf:"bytes,10,rep,name=tags,proto3" json:"tags,omitempty"`
+	OwnerId       *uint32                `protobuf:"varint,11,opt,name=owner_id,json=ownerId,proto3,oneof" json:"owner_id,omitempty"`
+	ArchivedAt    *timestamppb.Timestamp `protobuf:"bytes,12,opt,name=archived_at,json=archivedAt,proto3" json:"archived_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Company) Reset() {
+	*x = Company{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Company) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Company) ProtoMessage() {}
+
+func (x *Company) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Company.ProtoReflect.Descriptor instead.
+func (*Company) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Company) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Company) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Company) GetDocument() string {
+	if x != nil {
+		return x.Document
+	}
+	return ""
+}
+
+func (x *Company) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Company) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *Company) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *Company) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+func (x *Company) GetPeppolId() string {
+	if x != nil {
+		return x.PeppolId
+	}
+	return ""
+}
+
+func (x *Company) GetReferralSourceId() uint32 {
+	if x != nil && x.ReferralSourceId != nil {
+		return *x.ReferralSourceId
+	}
+	return 0
+}
+
+func (x *Company) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Company) GetOwnerId() uint32 {
+	if x != nil && x.OwnerId != nil {
+		return *x.OwnerId
+	}
+	return 0
+}
+
+func (x *Company) GetArchivedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ArchivedAt
+	}
+	return nil
+}
+
+type Product struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Description   *string                `protobuf:"bytes,3,opt,name=description,proto3,oneof" json:"description,omitempty"`
+	Price         float64                `protobuf:"fixed64,4,opt,name=price,proto3" json:"price,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Product) Reset() {
+	*x = Product{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Product) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Product) ProtoMessage() {}
+
+func (x *Product) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Product.ProtoReflect.Descriptor instead.
+func (*Product) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Product) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Product) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Product) GetDescription() string {
+	if x != nil && x.Description != nil {
+		return *x.Description
+	}
+	return ""
+}
+
+func (x *Product) GetPrice() float64 {
+	if x != nil {
+		return x.Price
+	}
+	return 0
+}
+
+type RemitInformationLine struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Key           string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         string                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RemitInformationLine) Reset() {
+	*x = RemitInformationLine{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RemitInformationLine) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RemitInformationLine) ProtoMessage() {}
+
+func (x *RemitInformationLine) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RemitInformationLine.ProtoReflect.Descriptor instead.
+func (*RemitInformationLine) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RemitInformationLine) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *RemitInformationLine) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *RemitInformationLine) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+type RemitInformation struct {
+	state         protoimpl.MessageState  `protogen:"open.v1"`
+	Id            uint32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                  `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Lines         []*RemitInformationLine `protobuf:"bytes,3,rep,name=lines,proto3" json:"lines,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RemitInformation) Reset() {
+	*x = RemitInformation{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RemitInformation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RemitInformation) ProtoMessage() {}
+
+func (x *RemitInformation) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RemitInformation.ProtoReflect.Descriptor instead.
+func (*RemitInformation) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RemitInformation) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *RemitInformation) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *RemitInformation) GetLines() []*RemitInformationLine {
+	if x != nil {
+		return x.Lines
+	}
+	return nil
+}
+
+type InvoiceLine struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	ProductId uint32                 `protobuf:"varint,2,opt,name=product_id,json=productId,proto3" json:"product_id,omitempty"`
+	// Deprecated: rounded to a whole number, use decimal_quantity. It is only
+	// read when decimal_quantity is unset.
+	//
+	// Deprecated: Marked as deprecated in tinycrm/v1/tinycrm.proto.
+	Quantity    int32   `protobuf:"varint,3,opt,name=quantity,proto3" json:"quantity,omitempty"`
+	Description *string `protobuf:"bytes,4,opt,name=description,proto3,oneof" json:"description,omitempty"`
+	// Product and total are filled in responses
+	Product *Product `protobuf:"bytes,5,opt,name=product,proto3" json:"product,omitempty"`
+	Total   float64  `protobuf:"fixed64,6,opt,name=total,proto3" json:"total,omitempty"`
+	// The quantity billed, e.g. 7.5 hours, in unit: h, day, kg... or empty
+	// for a count. Lines sent without a unit keep the one they had.
+	DecimalQuantity *float64 `protobuf:"fixed64,7,opt,name=decimal_quantity,json=decimalQuantity,proto3,oneof" json:"decimal_quantity,omitempty"`
+	Unit            string   `protobuf:"bytes,8,opt,name=unit,proto3" json:"unit,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *InvoiceLine) Reset() {
+	*x = InvoiceLine{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InvoiceLine) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InvoiceLine) ProtoMessage() {}
+
+func (x *InvoiceLine) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InvoiceLine.ProtoReflect.Descriptor instead.
+func (*InvoiceLine) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *InvoiceLine) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *InvoiceLine) GetProductId() uint32 {
+	if x != nil {
+		return x.ProductId
+	}
+	return 0
+}
+
+// Deprecated: Marked as deprecated in tinycrm/v1/tinycrm.proto.
+func (x *InvoiceLine) GetQuantity() int32 {
+	if x != nil {
+		return x.Quantity
+	}
+	return 0
+}
+
+func (x *InvoiceLine) GetDescription() string {
+	if x != nil && x.Description != nil {
+		return *x.Description
+	}
+	return ""
+}
+
+func (x *InvoiceLine) GetProduct() *Product {
+	if x != nil {
+		return x.Product
+	}
+	return nil
+}
+
+func (x *InvoiceLine) GetTotal() float64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *InvoiceLine) GetDecimalQuantity() float64 {
+	if x != nil && x.DecimalQuantity != nil {
+		return *x.DecimalQuantity
+	}
+	return 0
+}
+
+func (x *InvoiceLine) GetUnit() string {
+	if x != nil {
+		return x.Unit
+	}
+	return ""
+}
+
+type Invoice struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Uuid  string                 `protobuf:"bytes,2,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	// Type is invoice, quote, credit_note, receipt or proforma
+	Type                  string                 `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	Locale                string                 `protobuf:"bytes,4,opt,name=locale,proto3" json:"locale,omitempty"`
+	Number                *int32                 `protobuf:"varint,5,opt,name=number,proto3,oneof" json:"number,omitempty"`
+	AdditionalInformation *string                `protobuf:"bytes,6,opt,name=additional_information,json=additionalInformation,proto3,oneof" json:"additional_information,omitempty"`
+	Discount              float64                `protobuf:"fixed64,7,opt,name=discount,proto3" json:"discount,omitempty"`
+	Penalty               float64                `protobuf:"fixed64,8,opt,name=penalty,proto3" json:"penalty,omitempty"`
+	Paid                  bool                   `protobuf:"varint,9,opt,name=paid,proto3" json:"paid,omitempty"`
+	IssueDate             *timestamppb.Timestamp `protobuf:"bytes,10,opt,name=issue_date,json=issueDate,proto3" json:"issue_date,omitempty"`
+	DueDate               *timestamppb.Timestamp `protobuf:"bytes,11,opt,name=due_date,json=dueDate,proto3" json:"due_date,omitempty"`
+	RemitInformationId    uint32                 `protobuf:"varint,12,opt,name=remit_information_id,json=remitInformationId,proto3" json:"remit_information_id,omitempty"`
+	CompanyId             uint32                 `protobuf:"varint,13,opt,name=company_id,json=companyId,proto3" json:"company_id,omitempty"`
+	ClientId              uint32                 `protobuf:"varint,14,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	Lines                 []*InvoiceLine         `protobuf:"bytes,15,rep,name=lines,proto3" json:"lines,omitempty"`
+	// The fields below are filled in responses
+	Company          *Company               `protobuf:"bytes,16,opt,name=company,proto3" json:"company,omitempty"`
+	Client           *Company               `protobuf:"bytes,17,opt,name=client,proto3" json:"client,omitempty"`
+	RemitInformation *RemitInformation      `protobuf:"bytes,18,opt,name=remit_information,json=remitInformation,proto3" json:"remit_information,omitempty"`
+	Subtotal         float64                `protobuf:"fixed64,19,opt,name=subtotal,proto3" json:"subtotal,omitempty"`
+	Total            float64                `protobuf:"fixed64,20,opt,name=total,proto3" json:"total,omitempty"`
+	Tags             []string               `protobuf:"bytes,21,rep,name=tags,proto3" json:"tags,omitempty"`
+	OwnerId          *uint32                `protobuf:"varint,22,opt,name=owner_id,json=ownerId,proto3,oneof" json:"owner_id,omitempty"`
+	ArchivedAt       *timestamppb.Timestamp `protobuf:"bytes,23,opt,name=archived_at,json=archivedAt,proto3" json:"archived_at,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Invoice) Reset() {
+	*x = Invoice{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Invoice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Invoice) ProtoMessage() {}
+
+func (x *Invoice) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Invoice.ProtoReflect.Descriptor instead.
+func (*Invoice) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Invoice) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Invoice) GetUuid() string {
+	if x != nil {
+		return x.Uuid
+	}
+	return ""
+}
+
+func (x *Invoice) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Invoice) GetLocale() string {
+	if x != nil {
+		return x.Locale
+	}
+	return ""
+}
+
+func (x *Invoice) GetNumber() int32 {
+	if x != nil && x.Number != nil {
+		return *x.Number
+	}
+	return 0
+}
+
+func (x *Invoice) GetAdditionalInformation() string {
+	if x != nil && x.AdditionalInformation != nil {
+		return *x.AdditionalInformation
+	}
+	return ""
+}
+
+func (x *Invoice) GetDiscount() float64 {
+	if x != nil {
+		return x.Discount
+	}
+	return 0
+}
+
+func (x *Invoice) GetPenalty() float64 {
+	if x != nil {
+		return x.Penalty
+	}
+	return 0
+}
+
+func (x *Invoice) GetPaid() bool {
+	if x != nil {
+		return x.Paid
+	}
+	return false
+}
+
+func (x *Invoice) GetIssueDate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.IssueDate
+	}
+	return nil
+}
+
+func (x *Invoice) GetDueDate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.DueDate
+	}
+	return nil
+}
+
+func (x *Invoice) GetRemitInformationId() uint32 {
+	if x != nil {
+		return x.RemitInformationId
+	}
+	return 0
+}
+
+func (x *Invoice) GetCompanyId() uint32 {
+	if x != nil {
+		return x.CompanyId
+	}
+	return 0
+}
+
+func (x *Invoice) GetClientId() uint32 {
+	if x != nil {
+		return x.ClientId
+	}
+	return 0
+}
+
+func (x *Invoice) GetLines() []*InvoiceLine {
+	if x != nil {
+		return x.Lines
+	}
+	return nil
+}
+
+func (x *Invoice) GetCompany() *Company {
+	if x != nil {
+		return x.Company
+	}
+	return nil
+}
+
+func (x *Invoice) GetClient() *Company {
+	if x != nil {
+		return x.Client
+	}
+	return nil
+}
+
+func (x *Invoice) GetRemitInformation() *RemitInformation {
+	if x != nil {
+		return x.RemitInformation
+	}
+	return nil
+}
+
+func (x *Invoice) GetSubtotal() float64 {
+	if x != nil {
+		return x.Subtotal
+	}
+	return 0
+}
+
+func (x *Invoice) GetTotal() float64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *Invoice) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Invoice) GetOwnerId() uint32 {
+	if x != nil && x.OwnerId != nil {
+		return *x.OwnerId
+	}
+	return 0
+}
+
+func (x *Invoice) GetArchivedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ArchivedAt
+	}
+	return nil
+}
+
+type Payment struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	InvoiceId uint32                 `protobuf:"varint,2,opt,name=invoice_id,json=invoiceId,proto3" json:"invoice_id,omitempty"`
+	Amount    float64                `protobuf:"fixed64,3,opt,name=amount,proto3" json:"amount,omitempty"`
+	// Date defaults to now
+	Date          *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=date,proto3" json:"date,omitempty"`
+	Reference     *string                `protobuf:"bytes,5,opt,name=reference,proto3,oneof" json:"reference,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Payment) Reset() {
+	*x = Payment{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Payment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Payment) ProtoMessage() {}
+
+func (x *Payment) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Payment.ProtoReflect.Descriptor instead.
+func (*Payment) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Payment) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Payment) GetInvoiceId() uint32 {
+	if x != nil {
+		return x.InvoiceId
+	}
+	return 0
+}
+
+func (x *Payment) GetAmount() float64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *Payment) GetDate() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Date
+	}
+	return nil
+}
+
+func (x *Payment) GetReference() string {
+	if x != nil && x.Reference != nil {
+		return *x.Reference
+	}
+	return ""
+}
+
+type ListCompaniesRequest struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Tag              string                 `protobuf:"bytes,1,opt,name=tag,proto3" json:"tag,omitempty"`
+	OwnerId          *uint32                `protobuf:"varint,2,opt,name=owner_id,json=ownerId,proto3,oneof" json:"owner_id,omitempty"`
+	Archived         *bool                  `protobuf:"varint,3,opt,name=archived,proto3,oneof" json:"archived,omitempty"`
+	Country          string                 `protobuf:"bytes,4,opt,name=country,proto3" json:"country,omitempty"`
+	ReferralSourceId *uint32                `protobuf:"varint,5,opt,name=referral_source_id,json=referralSourceId,proto3,oneof" json:"referral_source_id,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *ListCompaniesRequest) Reset() {
+	*x = ListCompaniesRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCompaniesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCompaniesRequest) ProtoMessage() {}
+
+func (x *ListCompaniesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCompaniesRequest.ProtoReflect.Descriptor instead.
+func (*ListCompaniesRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListCompaniesRequest) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *ListCompaniesRequest) GetOwnerId() uint32 {
+	if x != nil && x.OwnerId != nil {
+		return *x.OwnerId
+	}
+	return 0
+}
+
+func (x *ListCompaniesRequest) GetArchived() bool {
+	if x != nil && x.Archived != nil {
+		return *x.Archived
+	}
+	return false
+}
+
+func (x *ListCompaniesRequest) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+func (x *ListCompaniesRequest) GetReferralSourceId() uint32 {
+	if x != nil && x.ReferralSourceId != nil {
+		return *x.ReferralSourceId
+	}
+	return 0
+}
+
+type ListCompaniesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Companies     []*Company             `protobuf:"bytes,1,rep,name=companies,proto3" json:"companies,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListCompaniesResponse) Reset() {
+	*x = ListCompaniesResponse{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListCompaniesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListCompaniesResponse) ProtoMessage() {}
+
+func (x *ListCompaniesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListCompaniesResponse.ProtoReflect.Descriptor instead.
+func (*ListCompaniesResponse) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListCompaniesResponse) GetCompanies() []*Company {
+	if x != nil {
+		return x.Companies
+	}
+	return nil
+}
+
+type GetCompanyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCompanyRequest) Reset() {
+	*x = GetCompanyRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCompanyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCompanyRequest) ProtoMessage() {}
+
+func (x *GetCompanyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCompanyRequest.ProtoReflect.Descriptor instead.
+func (*GetCompanyRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetCompanyRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type CreateCompanyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Company       *Company               `protobuf:"bytes,1,opt,name=company,proto3" json:"company,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateCompanyRequest) Reset() {
+	*x = CreateCompanyRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateCompanyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateCompanyRequest) ProtoMessage() {}
+
+func (x *CreateCompanyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateCompanyRequest.ProtoReflect.Descriptor instead.
+func (*CreateCompanyRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CreateCompanyRequest) GetCompany() *Company {
+	if x != nil {
+		return x.Company
+	}
+	return nil
+}
+
+// UpdateCompanyRequest replaces the company with the id of company
+type UpdateCompanyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Company       *Company               `protobuf:"bytes,1,opt,name=company,proto3" json:"company,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateCompanyRequest) Reset() {
+	*x = UpdateCompanyRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateCompanyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateCompanyRequest) ProtoMessage() {}
+
+func (x *UpdateCompanyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateCompanyRequest.ProtoReflect.Descriptor instead.
+func (*UpdateCompanyRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *UpdateCompanyRequest) GetCompany() *Company {
+	if x != nil {
+		return x.Company
+	}
+	return nil
+}
+
+type DeleteCompanyRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteCompanyRequest) Reset() {
+	*x = DeleteCompanyRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteCompanyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteCompanyRequest) ProtoMessage() {}
+
+func (x *DeleteCompanyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteCompanyRequest.ProtoReflect.Descriptor instead.
+func (*DeleteCompanyRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *DeleteCompanyRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListProductsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProductsRequest) Reset() {
+	*x = ListProductsRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProductsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProductsRequest) ProtoMessage() {}
+
+func (x *ListProductsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProductsRequest.ProtoReflect.Descriptor instead.
+func (*ListProductsRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{13}
+}
+
+type ListProductsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Products      []*Product             `protobuf:"bytes,1,rep,name=products,proto3" json:"products,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListProductsResponse) Reset() {
+	*x = ListProductsResponse{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListProductsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListProductsResponse) ProtoMessage() {}
+
+func (x *ListProductsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListProductsResponse.ProtoReflect.Descriptor instead.
+func (*ListProductsResponse) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *ListProductsResponse) GetProducts() []*Product {
+	if x != nil {
+		return x.Products
+	}
+	return nil
+}
+
+type GetProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetProductRequest) Reset() {
+	*x = GetProductRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetProductRequest) ProtoMessage() {}
+
+func (x *GetProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetProductRequest.ProtoReflect.Descriptor instead.
+func (*GetProductRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *GetProductRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type CreateProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Product       *Product               `protobuf:"bytes,1,opt,name=product,proto3" json:"product,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateProductRequest) Reset() {
+	*x = CreateProductRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateProductRequest) ProtoMessage() {}
+
+func (x *CreateProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateProductRequest.ProtoReflect.Descriptor instead.
+func (*CreateProductRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *CreateProductRequest) GetProduct() *Product {
+	if x != nil {
+		return x.Product
+	}
+	return nil
+}
+
+// UpdateProductRequest replaces the product with the id of product
+type UpdateProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Product       *Product               `protobuf:"bytes,1,opt,name=product,proto3" json:"product,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateProductRequest) Reset() {
+	*x = UpdateProductRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateProductRequest) ProtoMessage() {}
+
+func (x *UpdateProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateProductRequest.ProtoReflect.Descriptor instead.
+func (*UpdateProductRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *UpdateProductRequest) GetProduct() *Product {
+	if x != nil {
+		return x.Product
+	}
+	return nil
+}
+
+type DeleteProductRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteProductRequest) Reset() {
+	*x = DeleteProductRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteProductRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteProductRequest) ProtoMessage() {}
+
+func (x *DeleteProductRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteProductRequest.ProtoReflect.Descriptor instead.
+func (*DeleteProductRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *DeleteProductRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListInvoicesRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Type lists every document type when empty
+	Type          string  `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	CompanyId     *uint32 `protobuf:"varint,2,opt,name=company_id,json=companyId,proto3,oneof" json:"company_id,omitempty"`
+	ClientId      *uint32 `protobuf:"varint,3,opt,name=client_id,json=clientId,proto3,oneof" json:"client_id,omitempty"`
+	Paid          *bool   `protobuf:"varint,4,opt,name=paid,proto3,oneof" json:"paid,omitempty"`
+	Tag           string  `protobuf:"bytes,5,opt,name=tag,proto3" json:"tag,omitempty"`
+	OwnerId       *uint32 `protobuf:"varint,6,opt,name=owner_id,json=ownerId,proto3,oneof" json:"owner_id,omitempty"`
+	Archived      *bool   `protobuf:"varint,7,opt,name=archived,proto3,oneof" json:"archived,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListInvoicesRequest) Reset() {
+	*x = ListInvoicesRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListInvoicesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListInvoicesRequest) ProtoMessage() {}
+
+func (x *ListInvoicesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListInvoicesRequest.ProtoReflect.Descriptor instead.
+func (*ListInvoicesRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *ListInvoicesRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *ListInvoicesRequest) GetCompanyId() uint32 {
+	if x != nil && x.CompanyId != nil {
+		return *x.CompanyId
+	}
+	return 0
+}
+
+func (x *ListInvoicesRequest) GetClientId() uint32 {
+	if x != nil && x.ClientId != nil {
+		return *x.ClientId
+	}
+	return 0
+}
+
+func (x *ListInvoicesRequest) GetPaid() bool {
+	if x != nil && x.Paid != nil {
+		return *x.Paid
+	}
+	return false
+}
+
+func (x *ListInvoicesRequest) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *ListInvoicesRequest) GetOwnerId() uint32 {
+	if x != nil && x.OwnerId != nil {
+		return *x.OwnerId
+	}
+	return 0
+}
+
+func (x *ListInvoicesRequest) GetArchived() bool {
+	if x != nil && x.Archived != nil {
+		return *x.Archived
+	}
+	return false
+}
+
+type ListInvoicesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Invoices      []*Invoice             `protobuf:"bytes,1,rep,name=invoices,proto3" json:"invoices,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListInvoicesResponse) Reset() {
+	*x = ListInvoicesResponse{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListInvoicesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListInvoicesResponse) ProtoMessage() {}
+
+func (x *ListInvoicesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListInvoicesResponse.ProtoReflect.Descriptor instead.
+func (*ListInvoicesResponse) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *ListInvoicesResponse) GetInvoices() []*Invoice {
+	if x != nil {
+		return x.Invoices
+	}
+	return nil
+}
+
+type GetInvoiceRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetInvoiceRequest) Reset() {
+	*x = GetInvoiceRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetInvoiceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetInvoiceRequest) ProtoMessage() {}
+
+func (x *GetInvoiceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetInvoiceRequest.ProtoReflect.Descriptor instead.
+func (*GetInvoiceRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *GetInvoiceRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type CreateInvoiceRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Invoice       *Invoice               `protobuf:"bytes,1,opt,name=invoice,proto3" json:"invoice,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateInvoiceRequest) Reset() {
+	*x = CreateInvoiceRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateInvoiceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateInvoiceRequest) ProtoMessage() {}
+
+func (x *CreateInvoiceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateInvoiceRequest.ProtoReflect.Descriptor instead.
+func (*CreateInvoiceRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *CreateInvoiceRequest) GetInvoice() *Invoice {
+	if x != nil {
+		return x.Invoice
+	}
+	return nil
+}
+
+// UpdateInvoiceRequest replaces the invoice with the id of invoice
+type UpdateInvoiceRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Invoice       *Invoice               `protobuf:"bytes,1,opt,name=invoice,proto3" json:"invoice,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateInvoiceRequest) Reset() {
+	*x = UpdateInvoiceRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateInvoiceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateInvoiceRequest) ProtoMessage() {}
+
+func (x *UpdateInvoiceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateInvoiceRequest.ProtoReflect.Descriptor instead.
+func (*UpdateInvoiceRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *UpdateInvoiceRequest) GetInvoice() *Invoice {
+	if x != nil {
+		return x.Invoice
+	}
+	return nil
+}
+
+type DeleteInvoiceRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteInvoiceRequest) Reset() {
+	*x = DeleteInvoiceRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteInvoiceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteInvoiceRequest) ProtoMessage() {}
+
+func (x *DeleteInvoiceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteInvoiceRequest.ProtoReflect.Descriptor instead.
+func (*DeleteInvoiceRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *DeleteInvoiceRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListPaymentsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InvoiceId     uint32                 `protobuf:"varint,1,opt,name=invoice_id,json=invoiceId,proto3" json:"invoice_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListPaymentsRequest) Reset() {
+	*x = ListPaymentsRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListPaymentsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPaymentsRequest) ProtoMessage() {}
+
+func (x *ListPaymentsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPaymentsRequest.ProtoReflect.Descriptor instead.
+func (*ListPaymentsRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *ListPaymentsRequest) GetInvoiceId() uint32 {
+	if x != nil {
+		return x.InvoiceId
+	}
+	return 0
+}
+
+type ListPaymentsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Payments      []*Payment             `protobuf:"bytes,1,rep,name=payments,proto3" json:"payments,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListPaymentsResponse) Reset() {
+	*x = ListPaymentsResponse{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[26]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListPaymentsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListPaymentsResponse) ProtoMessage() {}
+
+func (x *ListPaymentsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[26]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListPaymentsResponse.ProtoReflect.Descriptor instead.
+func (*ListPaymentsResponse) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *ListPaymentsResponse) GetPayments() []*Payment {
+	if x != nil {
+		return x.Payments
+	}
+	return nil
+}
+
+type CreatePaymentRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Payment       *Payment               `protobuf:"bytes,1,opt,name=payment,proto3" json:"payment,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreatePaymentRequest) Reset() {
+	*x = CreatePaymentRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[27]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreatePaymentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreatePaymentRequest) ProtoMessage() {}
+
+func (x *CreatePaymentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[27]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreatePaymentRequest.ProtoReflect.Descriptor instead.
+func (*CreatePaymentRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *CreatePaymentRequest) GetPayment() *Payment {
+	if x != nil {
+		return x.Payment
+	}
+	return nil
+}
+
+type DeletePaymentRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint32                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeletePaymentRequest) Reset() {
+	*x = DeletePaymentRequest{}
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[28]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeletePaymentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeletePaymentRequest) ProtoMessage() {}
+
+func (x *DeletePaymentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tinycrm_v1_tinycrm_proto_msgTypes[28]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeletePaymentRequest.ProtoReflect.Descriptor instead.
+func (*DeletePaymentRequest) Descriptor() ([]byte, []int) {
+	return file_tinycrm_v1_tinycrm_proto_rawDescGZIP(), []int{28}
+}
+
+func (x *DeletePaymentRequest) GetId() uint32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+var File_tinycrm_v1_tinycrm_proto protoreflect.FileDescriptor
+
+const file_tinycrm_v1_tinycrm_proto_rawDesc = "" +
+	"\n" +
+	"\x18tinycrm/v1/tinycrm.proto\x12\n" +
+	"tinycrm.v1\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x90\x03\n" +
+	"\aCompany\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x1a\n" +
+	"\bdocument\x18\x03 \x01(\tR\bdocument\x12\x18\n" +
+	"\aaddress\x18\x04 \x01(\tR\aaddress\x12\x14\n" +
+	"\x05email\x18\x05 \x01(\tR\x05email\x12\x16\n" +
+	"\x06locale\x18\x06 \x01(\tR\x06locale\x12\x18\n" +
+	"\acountry\x18\a \x01(\tR\acountry\x12\x1b\n" +
+	"\tpeppol_id\x18\b \x01(\tR\bpeppolId\x121\n" +
+	"\x12referral_source_id\x18\t \x01(\rH\x00R\x10referralSourceId\x88\x01\x01\x12\x12\n" +
+	"\x04tags\x18\n" +
+	" \x03(\tR\x04tags\x12\x1e\n" +
+	"\bowner_id\x18\v \x01(\rH\x01R\aownerId\x88\x01\x01\x12;\n" +
+	"\varchived_at\x18\f \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"archivedAtB\x15\n" +
+	"\x13_referral_source_idB\v\n" +
+	"\t_owner_id\"z\n" +
+	"\aProduct\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12%\n" +
+	"\vdescription\x18\x03 \x01(\tH\x00R\vdescription\x88\x01\x01\x12\x14\n" +
+	"\x05price\x18\x04 \x01(\x01R\x05priceB\x0e\n" +
+	"\f_description\"N\n" +
+	"\x14RemitInformationLine\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\tR\x05value\"n\n" +
+	"\x10RemitInformation\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x126\n" +
+	"\x05lines\x18\x03 \x03(\v2 .tinycrm.v1.RemitInformationLineR\x05lines\"\xb1\x02\n" +
+	"\vInvoiceLine\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x1d\n" +
+	"\n" +
+	"product_id\x18\x02 \x01(\rR\tproductId\x12\x1e\n" +
+	"\bquantity\x18\x03 \x01(\x05B\x02\x18\x01R\bquantity\x12%\n" +
+	"\vdescription\x18\x04 \x01(\tH\x00R\vdescription\x88\x01\x01\x12-\n" +
+	"\aproduct\x18\x05 \x01(\v2\x13.tinycrm.v1.ProductR\aproduct\x12\x14\n" +
+	"\x05total\x18\x06 \x01(\x01R\x05total\x12.\n" +
+	"\x10decimal_quantity\x18\a \x01(\x01H\x01R\x0fdecimalQuantity\x88\x01\x01\x12\x12\n" +
+	"\x04unit\x18\b \x01(\tR\x04unitB\x0e\n" +
+	"\f_descriptionB\x13\n" +
+	"\x11_decimal_quantity\"\x88\a\n" +
+	"\aInvoice\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x12\n" +
+	"\x04uuid\x18\x02 \x01(\tR\x04uuid\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x12\x16\n" +
+	"\x06locale\x18\x04 \x01(\tR\x06locale\x12\x1b\n" +
+	"\x06number\x18\x05 \x01(\x05H\x00R\x06number\x88\x01\x01\x12:\n" +
+	"\x16additional_information\x18\x06 \x01(\tH\x01R\x15additionalInformation\x88\x01\x01\x12\x1a\n" +
+	"\bdiscount\x18\a \x01(\x01R\bdiscount\x12\x18\n" +
+	"\apenalty\x18\b \x01(\x01R\apenalty\x12\x12\n" +
+	"\x04paid\x18\t \x01(\bR\x04paid\x129\n" +
+	"\n" +
+	"issue_date\x18\n" +
+	" \x01(\v2\x1a.google.protobuf.TimestampR\tissueDate\x125\n" +
+	"\bdue_date\x18\v \x01(\v2\x1a.google.protobuf.TimestampR\adueDate\x120\n" +
+	"\x14remit_information_id\x18\f \x01(\rR\x12remitInformationId\x12\x1d\n" +
+	"\n" +
+	"company_id\x18\r \x01(\rR\tcompanyId\x12\x1b\n" +
+	"\tclient_id\x18\x0e \x01(\rR\bclientId\x12-\n" +
+	"\x05lines\x18\x0f \x03(\v2\x17.tinycrm.v1.InvoiceLineR\x05lines\x12-\n" +
+	"\acompany\x18\x10 \x01(\v2\x13.tinycrm.v1.CompanyR\acompany\x12+\n" +
+	"\x06client\x18\x11 \x01(\v2\x13.tinycrm.v1.CompanyR\x06client\x12I\n" +
+	"\x11remit_information\x18\x12 \x01(\v2\x1c.tinycrm.v1.RemitInformationR\x10remitInformation\x12\x1a\n" +
+	"\bsubtotal\x18\x13 \x01(\x01R\bsubtotal\x12\x14\n" +
+	"\x05total\x18\x14 \x01(\x01R\x05total\x12\x12\n" +
+	"\x04tags\x18\x15 \x03(\tR\x04tags\x12\x1e\n" +
+	"\bowner_id\x18\x16 \x01(\rH\x02R\aownerId\x88\x01\x01\x12;\n" +
+	"\varchived_at\x18\x17 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"archivedAtB\t\n" +
+	"\a_numberB\x19\n" +
+	"\x17_additional_informationB\v\n" +
+	"\t_owner_id\"\xb1\x01\n" +
+	"\aPayment\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\x12\x1d\n" +
+	"\n" +
+	"invoice_id\x18\x02 \x01(\rR\tinvoiceId\x12\x16\n" +
+	"\x06amount\x18\x03 \x01(\x01R\x06amount\x12.\n" +
+	"\x04date\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\x04date\x12!\n" +
+	"\treference\x18\x05 \x01(\tH\x00R\treference\x88\x01\x01B\f\n" +
+	"\n" +
+	"_reference\"\xe7\x01\n" +
+	"\x14ListCompaniesRequest\x12\x10\n" +
+	"\x03tag\x18\x01 \x01(\tR\x03tag\x12\x1e\n" +
+	"\bowner_id\x18\x02 \x01(\rH\x00R\aownerId\x88\x01\x01\x12\x1f\n" +
+	"\barchived\x18\x03 \x01(\bH\x01R\barchived\x88\x01\x01\x12\x18\n" +
+	"\acountry\x18\x04 \x01(\tR\acountry\x121\n" +
+	"\x12referral_source_id\x18\x05 \x01(\rH\x02R\x10referralSourceId\x88\x01\x01B\v\n" +
+	"\t_owner_idB\v\n" +
+	"\t_archivedB\x15\n" +
+	"\x13_referral_source_id\"J\n" +
+	"\x15ListCompaniesResponse\x121\n" +
+	"\tcompanies\x18\x01 \x03(\v2\x13.tinycrm.v1.CompanyR\tcompanies\"#\n" +
+	"\x11GetCompanyRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"E\n" +
+	"\x14CreateCompanyRequest\x12-\n" +
+	"\acompany\x18\x01 \x01(\v2\x13.tinycrm.v1.CompanyR\acompany\"E\n" +
+	"\x14UpdateCompanyRequest\x12-\n" +
+	"\acompany\x18\x01 \x01(\v2\x13.tinycrm.v1.CompanyR\acompany\"&\n" +
+	"\x14DeleteCompanyRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"\x15\n" +
+	"\x13ListProductsRequest\"G\n" +
+	"\x14ListProductsResponse\x12/\n" +
+	"\bproducts\x18\x01 \x03(\v2\x13.tinycrm.v1.ProductR\bproducts\"#\n" +
+	"\x11GetProductRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"E\n" +
+	"\x14CreateProductRequest\x12-\n" +
+	"\aproduct\x18\x01 \x01(\v2\x13.tinycrm.v1.ProductR\aproduct\"E\n" +
+	"\x14UpdateProductRequest\x12-\n" +
+	"\aproduct\x18\x01 \x01(\v2\x13.tinycrm.v1.ProductR\aproduct\"&\n" +
+	"\x14DeleteProductRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"\x9b\x02\n" +
+	"\x13ListInvoicesRequest\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\"\n" +
+	"\n" +
+	"company_id\x18\x02 \x01(\rH\x00R\tcompanyId\x88\x01\x01\x12 \n" +
+	"\tclient_id\x18\x03 \x01(\rH\x01R\bclientId\x88\x01\x01\x12\x17\n" +
+	"\x04paid\x18\x04 \x01(\bH\x02R\x04paid\x88\x01\x01\x12\x10\n" +
+	"\x03tag\x18\x05 \x01(\tR\x03tag\x12\x1e\n" +
+	"\bowner_id\x18\x06 \x01(\rH\x03R\aownerId\x88\x01\x01\x12\x1f\n" +
+	"\barchived\x18\a \x01(\bH\x04R\barchived\x88\x01\x01B\r\n" +
+	"\v_company_idB\f\n" +
+	"\n" +
+	"_client_idB\a\n" +
+	"\x05_paidB\v\n" +
+	"\t_owner_idB\v\n" +
+	"\t_archived\"G\n" +
+	"\x14ListInvoicesResponse\x12/\n" +
+	"\binvoices\x18\x01 \x03(\v2\x13.tinycrm.v1.InvoiceR\binvoices\"#\n" +
+	"\x11GetInvoiceRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"E\n" +
+	"\x14CreateInvoiceRequest\x12-\n" +
+	"\ainvoice\x18\x01 \x01(\v2\x13.tinycrm.v1.InvoiceR\ainvoice\"E\n" +
+	"\x14UpdateInvoiceRequest\x12-\n" +
+	"\ainvoice\x18\x01 \x01(\v2\x13.tinycrm.v1.InvoiceR\ainvoice\"&\n" +
+	"\x14DeleteInvoiceRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id\"4\n" +
+	"\x13ListPaymentsRequest\x12\x1d\n" +
+	"\n" +
+	"invoice_id\x18\x01 \x01(\rR\tinvoiceId\"G\n" +
+	"\x14ListPaymentsResponse\x12/\n" +
+	"\bpayments\x18\x01 \x03(\v2\x13.tinycrm.v1.PaymentR\bpayments\"E\n" +
+	"\x14CreatePaymentRequest\x12-\n" +
+	"\apayment\x18\x01 \x01(\v2\x13.tinycrm.v1.PaymentR\apayment\"&\n" +
+	"\x14DeletePaymentRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\rR\x02id2\x83\x03\n" +
+	"\x0eCompanyService\x12T\n" +
+	"\rListCompanies\x12 .tinycrm.v1.ListCompaniesRequest\x1a!.tinycrm.v1.ListCompaniesResponse\x12@\n" +
+	"\n" +
+	"GetCompany\x12\x1d.tinycrm.v1.GetCompanyRequest\x1a\x13.tinycrm.v1.Company\x12F\n" +
+	"\rCreateCompany\x12 .tinycrm.v1.CreateCompanyRequest\x1a\x13.tinycrm.v1.Company\x12F\n" +
+	"\rUpdateCompany\x12 .tinycrm.v1.UpdateCompanyRequest\x1a\x13.tinycrm.v1.Company\x12I\n" +
+	"\rDeleteCompany\x12 .tinycrm.v1.DeleteCompanyRequest\x1a\x16.google.protobuf.Empty2\x80\x03\n" +
+	"\x0eProductService\x12Q\n" +
+	"\fListProducts\x12\x1f.tinycrm.v1.ListProductsRequest\x1a .tinycrm.v1.ListProductsResponse\x12@\n" +
+	"\n" +
+	"GetProduct\x12\x1d.tinycrm.v1.GetProductRequest\x1a\x13.tinycrm.v1.Product\x12F\n" +
+	"\rCreateProduct\x12 .tinycrm.v1.CreateProductRequest\x1a\x13.tinycrm.v1.Product\x12F\n" +
+	"\rUpdateProduct\x12 .tinycrm.v1.UpdateProductRequest\x1a\x13.tinycrm.v1.Product\x12I\n" +
+	"\rDeleteProduct\x12 .tinycrm.v1.DeleteProductRequest\x1a\x16.google.protobuf.Empty2\x80\x03\n" +
+	"\x0eInvoiceService\x12Q\n" +
+	"\fListInvoices\x12\x1f.tinycrm.v1.ListInvoicesRequest\x1a .tinycrm.v1.ListInvoicesResponse\x12@\n" +
+	"\n" +
+	"GetInvoice\x12\x1d.tinycrm.v1.GetInvoiceRequest\x1a\x13.tinycrm.v1.Invoice\x12F\n" +
+	"\rCreateInvoice\x12 .tinycrm.v1.CreateInvoiceRequest\x1a\x13.tinycrm.v1.Invoice\x12F\n" +
+	"\rUpdateInvoice\x12 .tinycrm.v1.UpdateInvoiceRequest\x1a\x13.tinycrm.v1.Invoice\x12I\n" +
+	"\rDeleteInvoice\x12 .tinycrm.v1.DeleteInvoiceRequest\x1a\x16.google.protobuf.Empty2\xf6\x01\n" +
+	"\x0ePaymentService\x12Q\n" +
+	"\fListPayments\x12\x1f.tinycrm.v1.ListPaymentsRequest\x1a .tinycrm.v1.ListPaymentsResponse\x12F\n" +
+	"\rCreatePayment\x12 .tinycrm.v1.CreatePaymentRequest\x1a\x13.tinycrm.v1.Payment\x12I\n" +
+	"\rDeletePayment\x12 .tinycrm.v1.DeletePaymentRequest\x1a\x16.google.protobuf.EmptyB+Z)github.com/samuel19992/tiny-crm/tinycrmpbb\x06proto3"
+
+var (
+	file_tinycrm_v1_tinycrm_proto_rawDescOnce sync.Once
+	file_tinycrm_v1_tinycrm_proto_rawDescData []byte
+)
+
+func file_tinycrm_v1_tinycrm_proto_rawDescGZIP() []byte {
+	file_tinycrm_v1_tinycrm_proto_rawDescOnce.Do(func() {
+		file_tinycrm_v1_tinycrm_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tinycrm_v1_tinycrm_proto_rawDesc), len(file_tinycrm_v1_tinycrm_proto_rawDesc)))
+	})
+	return file_tinycrm_v1_tinycrm_proto_rawDescData
+}
+
+var file_tinycrm_v1_tinycrm_proto_msgTypes = make([]protoimpl.MessageInfo, 29)
+var file_tinycrm_v1_tinycrm_proto_goTypes = []any{
+	(*Company)(nil),               // 0: tinycrm.v1.Company
+	(*Product)(nil),               // 1: tinycrm.v1.Product
+	(*RemitInformationLine)(nil),  // 2: tinycrm.v1.RemitInformationLine
+	(*RemitInformation)(nil),      // 3: tinycrm.v1.RemitInformation
+	(*InvoiceLine)(nil),           // 4: tinycrm.v1.InvoiceLine
+	(*Invoice)(nil),               // 5: tinycrm.v1.Invoice
+	(*Payment)(nil),               // 6: tinycrm.v1.Payment
+	(*ListCompaniesRequest)(nil),  // 7: tinycrm.v1.ListCompaniesRequest
+	(*ListCompaniesResponse)(nil), // 8: tinycrm.v1.ListCompaniesResponse
+	(*GetCompanyRequest)(nil),     // 9: tinycrm.v1.GetCompanyRequest
+	(*CreateCompanyRequest)(nil),  // 10: tinycrm.v1.CreateCompanyRequest
+	(*UpdateCompanyRequest)(nil),  // 11: tinycrm.v1.UpdateCompanyRequest
+	(*DeleteCompanyRequest)(nil),  // 12: tinycrm.v1.DeleteCompanyRequest
+	(*ListProductsRequest)(nil),   // 13: tinycrm.v1.ListProductsRequest
+	(*ListProductsResponse)(nil),  // 14: tinycrm.v1.ListProductsResponse
+	(*GetProductRequest)(nil),     // 15: tinycrm.v1.GetProductRequest
+	(*CreateProductRequest)(nil),  // 16: tinycrm.v1.CreateProductRequest
+	(*UpdateProductRequest)(nil),  // 17: tinycrm.v1.UpdateProductRequest
+	(*DeleteProductRequest)(nil),  // 18: tinycrm.v1.DeleteProductRequest
+	(*ListInvoicesRequest)(nil),   // 19: tinycrm.v1.ListInvoicesRequest
+	(*ListInvoicesResponse)(nil),  // 20: tinycrm.v1.ListInvoicesResponse
+	(*GetInvoiceRequest)(nil),     // 21: tinycrm.v1.GetInvoiceRequest
+	(*CreateInvoiceRequest)(nil),  // 22: tinycrm.v1.CreateInvoiceRequest
+	(*UpdateInvoiceRequest)(nil),  // 23: tinycrm.v1.UpdateInvoiceRequest
+	(*DeleteInvoiceRequest)(nil),  // 24: tinycrm.v1.DeleteInvoiceRequest
+	(*ListPaymentsRequest)(nil),   // 25: tinycrm.v1.ListPaymentsRequest
+	(*ListPaymentsResponse)(nil),  // 26: tinycrm.v1.ListPaymentsResponse
+	(*CreatePaymentRequest)(nil),  // 27: tinycrm.v1.CreatePaymentRequest
+	(*DeletePaymentRequest)(nil),  // 28: tinycrm.v1.DeletePaymentRequest
+	(*timestamppb.Timestamp)(nil), // 29: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 30: google.protobuf.Empty
+}
+var file_tinycrm_v1_tinycrm_proto_depIdxs = []int32{
+	29, // 0: tinycrm.v1.Company.archived_at:type_name -> google.protobuf.Timestamp
+	2,  // 1: tinycrm.v1.RemitInformation.lines:type_name -> tinycrm.v1.RemitInformationLine
+	1,  // 2: tinycrm.v1.InvoiceLine.product:type_name -> tinycrm.v1.Product
+	29, // 3: tinycrm.v1.Invoice.issue_date:type_name -> google.protobuf.Timestamp
+	29, // 4: tinycrm.v1.Invoice.due_date:type_name -> google.protobuf.Timestamp
+	4,  // 5: tinycrm.v1.Invoice.lines:type_name -> tinycrm.v1.InvoiceLine
+	0,  // 6: tinycrm.v1.Invoice.company:type_name -> tinycrm.v1.Company
+	0,  // 7: tinycrm.v1.Invoice.client:type_name -> tinycrm.v1.Company
+	3,  // 8: tinycrm.v1.Invoice.remit_information:type_name -> tinycrm.v1.RemitInformation
+	29, // 9: tinycrm.v1.Invoice.archived_at:type_name -> google.protobuf.Timestamp
+	29, // 10: tinycrm.v1.Payment.date:type_name -> google.protobuf.Timestamp
+	0,  // 11: tinycrm.v1.ListCompaniesResponse.companies:type_name -> tinycrm.v1.Company
+	0,  // 12: tinycrm.v1.CreateCompanyRequest.company:type_name -> tinycrm.v1.Company
+	0,  // 13: tinycrm.v1.UpdateCompanyRequest.company:type_name -> tinycrm.v1.Company
+	1,  // 14: tinycrm.v1.ListProductsResponse.products:type_name -> tinycrm.v1.Product
+	1,  // 15: tinycrm.v1.CreateProductRequest.product:type_name -> tinycrm.v1.Product
+	1,  // 16: tinycrm.v1.UpdateProductRequest.product:type_name -> tinycrm.v1.Product
+	5,  // 17: tinycrm.v1.ListInvoicesResponse.invoices:type_name -> tinycrm.v1.Invoice
+	5,  // 18: tinycrm.v1.CreateInvoiceRequest.invoice:type_name -> tinycrm.v1.Invoice
+	5,  // 19: tinycrm.v1.UpdateInvoiceRequest.invoice:type_name -> tinycrm.v1.Invoice
+	6,  // 20: tinycrm.v1.ListPaymentsResponse.payments:type_name -> tinycrm.v1.Payment
+	6,  // 21: tinycrm.v1.CreatePaymentRequest.payment:type_name -> tinycrm.v1.Payment
+	7,  // 22: tinycrm.v1.CompanyService.ListCompanies:input_type -> tinycrm.v1.ListCompaniesRequest
+	9,  // 23: tinycrm.v1.CompanyService.GetCompany:input_type -> tinycrm.v1.GetCompanyRequest
+	10, // 24: tinycrm.v1.CompanyService.CreateCompany:input_type -> tinycrm.v1.CreateCompanyRequest
+	11, // 25: tinycrm.v1.CompanyService.UpdateCompany:input_type -> tinycrm.v1.UpdateCompanyRequest
+	12, // 26: tinycrm.v1.CompanyService.DeleteCompany:input_type -> tinycrm.v1.DeleteCompanyRequest
+	13, // 27: tinycrm.v1.ProductService.ListProducts:input_type -> tinycrm.v1.ListProductsRequest
+	15, // 28: tinycrm.v1.ProductService.GetProduct:input_type -> tinycrm.v1.GetProductRequest
+	16, // 29: tinycrm.v1.ProductService.CreateProduct:input_type -> tinycrm.v1.CreateProductRequest
+	17, // 30: tinycrm.v1.ProductService.UpdateProduct:input_type -> tinycrm.v1.UpdateProductRequest
+	18, // 31: tinycrm.v1.ProductService.DeleteProduct:input_type -> tinycrm.v1.DeleteProductRequest
+	19, // 32: tinycrm.v1.InvoiceService.ListInvoices:input_type -> tinycrm.v1.ListInvoicesRequest
+	21, // 33: tinycrm.v1.InvoiceService.GetInvoice:input_type -> tinycrm.v1.GetInvoiceRequest
+	22, // 34: tinycrm.v1.InvoiceService.CreateInvoice:input_type -> tinycrm.v1.CreateInvoiceRequest
+	23, // 35: tinycrm.v1.InvoiceService.UpdateInvoice:input_type -> tinycrm.v1.UpdateInvoiceRequest
+	24, // 36: tinycrm.v1.InvoiceService.DeleteInvoice:input_type -> tinycrm.v1.DeleteInvoiceRequest
+	25, // 37: tinycrm.v1.PaymentService.ListPayments:input_type -> tinycrm.v1.ListPaymentsRequest
+	27, // 38: tinycrm.v1.PaymentService.CreatePayment:input_type -> tinycrm.v1.CreatePaymentRequest
+	28, // 39: tinycrm.v1.PaymentService.DeletePayment:input_type -> tinycrm.v1.DeletePaymentRequest
+	8,  // 40: tinycrm.v1.CompanyService.ListCompanies:output_type -> tinycrm.v1.ListCompaniesResponse
+	0,  // 41: tinycrm.v1.CompanyService.GetCompany:output_type -> tinycrm.v1.Company
+	0,  // 42: tinycrm.v1.CompanyService.CreateCompany:output_type -> tinycrm.v1.Company
+	0,  // 43: tinycrm.v1.CompanyService.UpdateCompany:output_type -> tinycrm.v1.Company
+	30, // 44: tinycrm.v1.CompanyService.DeleteCompany:output_type -> google.protobuf.Empty
+	14, // 45: tinycrm.v1.ProductService.ListProducts:output_type -> tinycrm.v1.ListProductsResponse
+	1,  // 46: tinycrm.v1.ProductService.GetProduct:output_type -> tinycrm.v1.Product
+	1,  // 47: tinycrm.v1.ProductService.CreateProduct:output_type -> tinycrm.v1.Product
+	1,  // 48: tinycrm.v1.ProductService.UpdateProduct:output_type -> tinycrm.v1.Product
+	30, // 49: tinycrm.v1.ProductService.DeleteProduct:output_type -> google.protobuf.Empty
+	20, // 50: tinycrm.v1.InvoiceService.ListInvoices:output_type -> tinycrm.v1.ListInvoicesResponse
+	5,  // 51: tinycrm.v1.InvoiceService.GetInvoice:output_type -> tinycrm.v1.Invoice
+	5,  // 52: tinycrm.v1.InvoiceService.CreateInvoice:output_type -> tinycrm.v1.Invoice
+	5,  // 53: tinycrm.v1.InvoiceService.UpdateInvoice:output_type -> tinycrm.v1.Invoice
+	30, // 54: tinycrm.v1.InvoiceService.DeleteInvoice:output_type -> google.protobuf.Empty
+	26, // 55: tinycrm.v1.PaymentService.ListPayments:output_type -> tinycrm.v1.ListPaymentsResponse
+	6,  // 56: tinycrm.v1.PaymentService.CreatePayment:output_type -> tinycrm.v1.Payment
+	30, // 57: tinycrm.v1.PaymentService.DeletePayment:output_type -> google.protobuf.Empty
+	40, // [40:58] is the sub-list for method output_type
+	22, // [22:40] is the sub-list for method input_type
+	22, // [22:22] is the sub-list for extension type_name
+	22, // [22:22] is the sub-list for extension extendee
+	0,  // [0:22] is the sub-list for field type_name
+}
+
+func init() { file_tinycrm_v1_tinycrm_proto_init() }
+func file_tinycrm_v1_tinycrm_proto_init() {
+	if File_tinycrm_v1_tinycrm_proto != nil {
+		return
+	}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[0].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[1].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[4].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[5].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[6].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[7].OneofWrappers = []any{}
+	file_tinycrm_v1_tinycrm_proto_msgTypes[19].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tinycrm_v1_tinycrm_proto_rawDesc), len(file_tinycrm_v1_tinycrm_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   29,
+			NumExtensions: 0,
+			NumServices:   4,
+		},
+		GoTypes:           file_tinycrm_v1_tinycrm_proto_goTypes,
+		DependencyIndexes: file_tinycrm_v1_tinycrm_proto_depIdxs,
+		MessageInfos:      file_tinycrm_v1_tinycrm_proto_msgTypes,
+	}.Build()
+	File_tinycrm_v1_tinycrm_proto = out.File
+	file_tinycrm_v1_tinycrm_proto_goTypes = nil
+	file_tinycrm_v1_tinycrm_proto_depIdxs = nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// hstsMiddleware tells browsers to only reach the server over HTTPS
+func hstsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	certManagerOnce sync.Once
+	autocertManager *autocert.Manager
+)
+
+// certManager returns the autocert manager shared by the HTTPS and gRPC
+// listeners
+func certManager(c *Config) *autocert.Manager {
+	certManagerOnce.Do(func() {
+		autocertManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.TLS.AutocertCache),
+			HostPolicy: autocert.HostWhitelist(c.TLS.AutocertDomains...),
+			Email:      c.TLS.AutocertEmail,
+		}
+	})
+	return autocertManager
+}
+
+// grpcCredentials secures the gRPC listener with the HTTPS certificates
+func grpcCredentials(c *Config) (credentials.TransportCredentials, error) {
+	if !c.TLS.Enabled() {
+		return insecure.NewCredentials(), nil
+	}
+	if c.TLS.CertFile != "" {
+		return credentials.NewServerTLSFromFile(c.TLS.CertFile, c.TLS.KeyFile)
+	}
+	tlsConfig := certManager(c).TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// serve listens with the configured transport. Plain HTTP uses the
+// configured port, certificate files serve HTTPS on it, and autocert serves
+// HTTPS on 443 with port 80 answering ACME challenges and redirecting to
+// HTTPS, since Let's Encrypt only validates on the standard ports.
+func serve(c *Config, handler http.Handler) error {
+	if !c.TLS.Enabled() {
+		fmt.Println("Running on port " + c.Port)
+		return newServer(":"+c.Port, handler).ListenAndServe()
+	}
+
+	handler = hstsMiddleware(handler)
+
+	if c.TLS.CertFile != "" {
+		server := newServer(":"+c.Port, handler)
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		fmt.Println("Running with TLS on port " + c.Port)
+		return server.ListenAndServeTLS(c.TLS.CertFile, c.TLS.KeyFile)
+	}
+
+	manager := certManager(c)
+
+	challengeServer := newServer(":80", manager.HTTPHandler(nil))
+	errs := make(chan error, 2)
+	go func() {
+		errs <- challengeServer.ListenAndServe()
+	}()
+
+	server := newServer(":443", handler)
+	server.TLSConfig = manager.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	fmt.Printf("Running with automatic TLS for %v\n", c.TLS.AutocertDomains)
+	go func() {
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	return <-errs
+}
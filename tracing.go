@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/logger"
+)
+
+// requestIDHeader identifies a request in the logs and the error answers,
+// taken from the proxy in front when it sets one
+const requestIDHeader = "X-Request-ID"
+
+// traceparentHeader carries the W3C trace context, so the spans of the
+// server join the trace of the caller
+const traceparentHeader = "traceparent"
+
+// maxTraceSpans caps the spans kept for a request, the rest are counted
+const maxTraceSpans = 200
+
+type requestIDContextKey struct{}
+type traceContextKey struct{}
+
+// requestIDFrom returns the ID of the request being served, empty outside
+// of a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID accepts the IDs given by proxies: up to 128 visible ASCII
+// characters, so they can't forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// parseTraceparent reads the trace and the parent span of a traceparent
+// header, all zero IDs being invalid
+func parseTraceparent(value string) (traceID, parentID string, ok bool) {
+	match := traceparentPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || strings.Trim(match[1], "0") == "" || strings.Trim(match[2], "0") == "" {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// randomHex returns n random bytes in hexadecimal, the IDs of traces and
+// spans
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceSpan is a timed step of a request, its handler or a query
+type traceSpan struct {
+	ID       string
+	ParentID string
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+}
+
+// requestTrace gathers the spans of a request under its root span
+type requestTrace struct {
+	mu      sync.Mutex
+	TraceID string
+	Root    traceSpan
+	spans   []traceSpan
+	total   int
+}
+
+// newRequestTrace starts the trace of the request, continuing the trace of
+// the caller when it sent a traceparent
+func newRequestTrace(r *http.Request, start time.Time) *requestTrace {
+	trace := &requestTrace{TraceID: randomHex(16)}
+	trace.Root = traceSpan{ID: randomHex(8), Name: r.Method + " " + r.URL.Path, Start: start}
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		trace.TraceID, trace.Root.ParentID = traceID, parentID
+	}
+	return trace
+}
+
+// traceparent is the header handing the trace on, with the root span as
+// the parent
+func (t *requestTrace) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", t.TraceID, t.Root.ID)
+}
+
+// add records a span under the root span
+func (t *requestTrace) add(span traceSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	if len(t.spans) < maxTraceSpans {
+		span.ID, span.ParentID = randomHex(8), t.Root.ID
+		t.spans = append(t.spans, span)
+	}
+}
+
+// log writes the trace to the server log, a line per span with its offset
+// from the start of the request
+func (t *requestTrace) log(requestID string, status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var lines strings.Builder
+	fmt.Fprintf(&lines, "Trace %s span=%s request_id=%s %s %d %.3fms, %d queries",
+		t.TraceID, t.Root.ID, requestID, t.Root.Name, status, milliseconds(t.Root.Duration), t.total)
+	for _, span := range t.spans {
+		fmt.Fprintf(&lines, "\n  +%.3fms %.3fms %s", milliseconds(span.Start.Sub(t.Root.Start)), milliseconds(span.Duration), span.Name)
+		if span.Error != "" {
+			fmt.Fprintf(&lines, " error=%s", span.Error)
+		}
+	}
+	log.Print(lines.String())
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// traceLogger is a GORM logger recording the queries as spans of the
+// request, passing them on to the logger it replaces
+type traceLogger struct {
+	trace *requestTrace
+	next  logger.Interface
+}
+
+func (l *traceLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return &traceLogger{trace: l.trace, next: l.next.LogMode(level)}
+}
+
+func (l *traceLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	l.next.Info(ctx, msg, args...)
+}
+
+func (l *traceLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	l.next.Warn(ctx, msg, args...)
+}
+
+func (l *traceLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	l.next.Error(ctx, msg, args...)
+}
+
+func (l *traceLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, rows := fc()
+	span := traceSpan{Name: "SQL " + strings.Join(strings.Fields(sql), " "), Start: begin, Duration: time.Since(begin)}
+	if err != nil {
+		span.Error = strings.Join(strings.Fields(err.Error()), " ")
+	}
+	l.trace.add(span)
+	l.next.Trace(ctx, begin, func() (string, int64) { return sql, rows }, err)
+}
+
+// requestIDWriter keeps the status of the answer, to tag the internal
+// errors with the request ID
+type requestIDWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDMiddleware gives every request an ID, the one of the proxy in
+// front or a new one, answered in X-Request-ID. Internal errors are logged
+// with it and end with it, so a user can quote it. With tracing enabled
+// the request and its queries are traced, continuing the trace of the
+// caller, and the traces at least tracing.slow_ms long are logged.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+
+		var trace *requestTrace
+		if config.Tracing.Enabled {
+			trace = newRequestTrace(r, start)
+			w.Header().Set(traceparentHeader, trace.traceparent())
+			ctx = context.WithValue(ctx, traceContextKey{}, trace)
+		}
+
+		recorded := &requestIDWriter{ResponseWriter: w}
+		next.ServeHTTP(recorded, r.WithContext(ctx))
+		if recorded.status == 0 {
+			recorded.status = http.StatusOK
+		}
+
+		if recorded.status >= http.StatusInternalServerError {
+			log.Printf("Error answering %s %s: %d request_id=%s", r.Method, r.URL.Path, recorded.status, id)
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+				fmt.Fprintf(w, "Request ID: %s\n", id)
+			}
+		}
+		if trace != nil {
+			trace.Root.Duration = time.Since(start)
+			if trace.Root.Duration >= time.Duration(config.Tracing.SlowMS)*time.Millisecond {
+				trace.log(id, recorded.status)
+			}
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+type txContextKey struct{}
+
+type unitOfWorkContextKey struct{}
+
+// unitOfWork holds the writes kept for after the transaction of a request
+type unitOfWork struct {
+	mu    sync.Mutex
+	after []func(store Store)
+}
+
+// finish runs the writes kept for after the transaction on the database
+// outside of it
+func (work *unitOfWork) finish(db *gorm.DB) {
+	work.mu.Lock()
+	after := work.after
+	work.after = nil
+	work.mu.Unlock()
+	for _, write := range after {
+		write(&Repository{db: db})
+	}
+}
+
+// writeLock serializes write requests when config.SerializeWrites is set
+var writeLock sync.Mutex
+
+// WithContext returns a repository bound to the transaction carried by ctx,
+// or the repository itself when there is none. The queries go to the SQL
+// recorder and the trace of the request when it has them, and sent and
+// paid invoices can be changed when the request has the override.
+func (r *Repository) WithContext(ctx context.Context) Store {
+	db := r.db
+	if tx, ok := ctx.Value(txContextKey{}).(*gorm.DB); ok {
+		db = tx
+	}
+	if recorder, ok := ctx.Value(sqlRecorderContextKey{}).(*sqlRecorder); ok {
+		db = db.Session(&gorm.Session{Logger: recorder})
+	}
+	if trace, ok := ctx.Value(traceContextKey{}).(*requestTrace); ok {
+		db = db.Session(&gorm.Session{Logger: &traceLogger{trace: trace, next: db.Logger}})
+	}
+	overrideIssued, _ := ctx.Value(issuedOverrideContextKey{}).(bool)
+	work, _ := ctx.Value(unitOfWorkContextKey{}).(*unitOfWork)
+	if db == r.db && overrideIssued == r.overrideIssued && work == r.work {
+		return r
+	}
+	return &Repository{db: db, overrideIssued: overrideIssued, work: work}
+}
+
+// AfterUnitOfWork keeps write for after the transaction of the request,
+// or runs it right away outside of one
+func (r *Repository) AfterUnitOfWork(write func(store Store)) {
+	if r.work == nil {
+		write(r)
+		return
+	}
+	r.work.mu.Lock()
+	defer r.work.mu.Unlock()
+	r.work.after = append(r.work.after, write)
+}
+
+// bufferedResponseWriter holds the response back until the transaction
+// outcome is known, so a failed commit can still turn into an error
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// UnitOfWork wraps next with unitOfWorkMiddleware on the repository database
+func (r *Repository) UnitOfWork(next http.Handler) http.Handler {
+	return unitOfWorkMiddleware(r.db, next)
+}
+
+// unitOfWorkMiddleware runs every write request inside a single database
+// transaction. It is committed when the handler answers with a success
+// status and rolled back on an error status or a panic. Either way the
+// writes kept with AfterUnitOfWork run before the response goes out.
+func unitOfWorkMiddleware(db *gorm.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if config.SerializeWrites {
+			writeLock.Lock()
+			defer writeLock.Unlock()
+		}
+
+		tx := db.WithContext(r.Context()).Begin()
+		if tx.Error != nil {
+			writeDatabaseError(w, r, tx.Error)
+			return
+		}
+
+		done := false
+		defer func() {
+			if !done {
+				tx.Rollback()
+			}
+		}()
+
+		var failure error
+		work := &unitOfWork{}
+		ctx := context.WithValue(r.Context(), txContextKey{}, tx)
+		ctx = context.WithValue(ctx, unitOfWorkContextKey{}, work)
+		ctx = context.WithValue(ctx, databaseErrorContextKey{}, &failure)
+		buffered := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(buffered, r.WithContext(ctx))
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		done = true
+		if buffered.status >= http.StatusBadRequest {
+			tx.Rollback()
+			work.finish(db)
+		} else {
+			err := tx.Commit().Error
+			work.finish(db)
+			if err != nil {
+				writeDatabaseError(w, r, err)
+				return
+			}
+			dataWritten()
+		}
+
+		// Busy whatever the handler made of it, the client can retry
+		if isBusyError(failure) {
+			writeBusyResponse(w)
+			return
+		}
+
+		for key, values := range buffered.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ublInvoiceNamespace    = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	ublCreditNoteNamespace = "urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2"
+
+	// Peppol BIS Billing 3.0, the EN 16931 flavour most e-invoicing networks accept
+	ublCustomizationID = "urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0"
+	ublProfileID       = "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0"
+)
+
+// The structs below are the subset of UBL 2.1 needed for an EN 16931
+// invoice or credit note. Field order follows the schema.
+
+type ublAmount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type ublQuantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ublTaxCategory struct {
+	ID              string `xml:"cbc:ID"`
+	ExemptionReason string `xml:"cbc:TaxExemptionReason,omitempty"`
+	TaxScheme       string `xml:"cac:TaxScheme>cbc:ID"`
+}
+
+type ublLegalEntity struct {
+	RegistrationName string `xml:"cbc:RegistrationName"`
+	CompanyID        string `xml:"cbc:CompanyID,omitempty"`
+}
+
+type ublContact struct {
+	Email string `xml:"cbc:ElectronicMail"`
+}
+
+type ublEndpoint struct {
+	SchemeID string `xml:"schemeID,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type ublParty struct {
+	Endpoint    *ublEndpoint   `xml:"cbc:EndpointID,omitempty"`
+	Name        string         `xml:"cac:PartyName>cbc:Name"`
+	Street      string         `xml:"cac:PostalAddress>cbc:StreetName"`
+	Country     string         `xml:"cac:PostalAddress>cac:Country>cbc:IdentificationCode"`
+	LegalEntity ublLegalEntity `xml:"cac:PartyLegalEntity"`
+	Contact     *ublContact    `xml:"cac:Contact,omitempty"`
+}
+
+type ublAllowanceCharge struct {
+	ChargeIndicator bool           `xml:"cbc:ChargeIndicator"`
+	Reason          string         `xml:"cbc:AllowanceChargeReason"`
+	Amount          ublAmount      `xml:"cbc:Amount"`
+	TaxCategory     ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     ublAmount      `xml:"cbc:TaxAmount"`
+	TaxCategory   ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublTaxTotal struct {
+	TaxAmount ublAmount      `xml:"cbc:TaxAmount"`
+	Subtotal  ublTaxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type ublMonetaryTotal struct {
+	LineExtensionAmount ublAmount `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount  ublAmount `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount  ublAmount `xml:"cbc:TaxInclusiveAmount"`
+	AllowanceTotal      ublAmount `xml:"cbc:AllowanceTotalAmount"`
+	ChargeTotal         ublAmount `xml:"cbc:ChargeTotalAmount"`
+	PrepaidAmount       ublAmount `xml:"cbc:PrepaidAmount"`
+	PayableAmount       ublAmount `xml:"cbc:PayableAmount"`
+}
+
+type ublLine struct {
+	ID                  string         `xml:"cbc:ID"`
+	InvoicedQuantity    *ublQuantity   `xml:"cbc:InvoicedQuantity,omitempty"`
+	CreditedQuantity    *ublQuantity   `xml:"cbc:CreditedQuantity,omitempty"`
+	LineExtensionAmount ublAmount      `xml:"cbc:LineExtensionAmount"`
+	Description         string         `xml:"cac:Item>cbc:Description,omitempty"`
+	Name                string         `xml:"cac:Item>cbc:Name"`
+	TaxCategory         ublTaxCategory `xml:"cac:Item>cac:ClassifiedTaxCategory"`
+	Price               ublAmount      `xml:"cac:Price>cbc:PriceAmount"`
+}
+
+// ublDocument is either an Invoice or a CreditNote, they only differ in the
+// root element, the type code element and the line elements
+type ublDocument struct {
+	XMLName            xml.Name
+	Xmlns              string               `xml:"xmlns,attr"`
+	CAC                string               `xml:"xmlns:cac,attr"`
+	CBC                string               `xml:"xmlns:cbc,attr"`
+	CustomizationID    string               `xml:"cbc:CustomizationID"`
+	ProfileID          string               `xml:"cbc:ProfileID"`
+	ID                 string               `xml:"cbc:ID"`
+	IssueDate          string               `xml:"cbc:IssueDate"`
+	DueDate            string               `xml:"cbc:DueDate,omitempty"`
+	InvoiceTypeCode    string               `xml:"cbc:InvoiceTypeCode,omitempty"`
+	CreditNoteTypeCode string               `xml:"cbc:CreditNoteTypeCode,omitempty"`
+	Note               string               `xml:"cbc:Note,omitempty"`
+	CurrencyCode       string               `xml:"cbc:DocumentCurrencyCode"`
+	BuyerReference     string               `xml:"cbc:BuyerReference"`
+	Supplier           ublParty             `xml:"cac:AccountingSupplierParty>cac:Party"`
+	Customer           ublParty             `xml:"cac:AccountingCustomerParty>cac:Party"`
+	AllowanceCharges   []ublAllowanceCharge `xml:"cac:AllowanceCharge"`
+	TaxTotal           ublTaxTotal          `xml:"cac:TaxTotal"`
+	MonetaryTotal      ublMonetaryTotal     `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLines       []ublLine            `xml:"cac:InvoiceLine"`
+	CreditNoteLines    []ublLine            `xml:"cac:CreditNoteLine"`
+}
+
+func newUBLParty(company *Company) ublParty {
+	party := ublParty{
+		Name:        company.Name,
+		Street:      company.Address,
+		Country:     company.Country,
+		LegalEntity: ublLegalEntity{RegistrationName: company.Name, CompanyID: company.Document},
+	}
+	if scheme, id, ok := strings.Cut(company.PeppolID, ":"); ok {
+		party.Endpoint = &ublEndpoint{SchemeID: scheme, Value: id}
+	}
+	if company.Email != "" {
+		party.Contact = &ublContact{Email: company.Email}
+	}
+	return party
+}
+
+// UBLXML renders the invoice as a UBL 2.1 document following Peppol BIS
+// Billing 3.0. Credit notes become a CreditNote document. As with Factur-X
+// every amount is declared outside the scope of VAT. prepaid is what has
+// already been received against the invoice.
+func (i *Invoice) UBLXML(prepaid Money) ([]byte, error) {
+	typeCode, err := i.eInvoiceTypeCode()
+	if err != nil {
+		return nil, err
+	}
+
+	currency := i.EffectiveLocale().CurrencyCode()
+	amount := func(value Money) ublAmount {
+		return ublAmount{CurrencyID: currency, Value: ciiFormatAmount(value)}
+	}
+	outOfScope := ublTaxCategory{ID: "O", TaxScheme: "VAT"}
+
+	buyerReference := i.Client.Document
+	if buyerReference == "" {
+		buyerReference = i.Identification()
+	}
+
+	document := ublDocument{
+		CAC:             "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2",
+		CBC:             "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2",
+		CustomizationID: ublCustomizationID,
+		ProfileID:       ublProfileID,
+		ID:              i.Identification(),
+		IssueDate:       i.IssueDate.Format("2006-01-02"),
+		CurrencyCode:    currency,
+		BuyerReference:  buyerReference,
+		Supplier:        newUBLParty(&i.Company),
+		Customer:        newUBLParty(&i.Client),
+	}
+	isInvoice := typeCode == eInvoiceTypeCodes[DocumentInvoice]
+	if isInvoice {
+		document.XMLName = xml.Name{Local: "Invoice"}
+		document.Xmlns = ublInvoiceNamespace
+		document.InvoiceTypeCode = typeCode
+		document.DueDate = i.DueDate.Format("2006-01-02")
+	} else {
+		document.XMLName = xml.Name{Local: "CreditNote"}
+		document.Xmlns = ublCreditNoteNamespace
+		document.CreditNoteTypeCode = typeCode
+	}
+	if i.AdditionalInformation != nil {
+		document.Note = *i.AdditionalInformation
+	}
+
+	if i.DiscountAmount() != 0 {
+		document.AllowanceCharges = append(document.AllowanceCharges, ublAllowanceCharge{
+			ChargeIndicator: false,
+			Reason:          "Discount",
+			Amount:          amount(i.DiscountAmount()),
+			TaxCategory:     outOfScope,
+		})
+	}
+	if i.PenaltyAmount() != 0 {
+		document.AllowanceCharges = append(document.AllowanceCharges, ublAllowanceCharge{
+			ChargeIndicator: true,
+			Reason:          "Late payment penalty",
+			Amount:          amount(i.PenaltyAmount()),
+			TaxCategory:     outOfScope,
+		})
+	}
+
+	total := i.Total()
+	document.TaxTotal = ublTaxTotal{
+		TaxAmount: amount(0),
+		Subtotal: ublTaxSubtotal{
+			TaxableAmount: amount(total),
+			TaxAmount:     amount(0),
+			TaxCategory:   ublTaxCategory{ID: "O", ExemptionReason: "Not subject to VAT", TaxScheme: "VAT"},
+		},
+	}
+	document.MonetaryTotal = ublMonetaryTotal{
+		LineExtensionAmount: amount(i.SubTotal()),
+		TaxExclusiveAmount:  amount(total),
+		TaxInclusiveAmount:  amount(total),
+		AllowanceTotal:      amount(i.DiscountAmount()),
+		ChargeTotal:         amount(i.PenaltyAmount()),
+		PrepaidAmount:       amount(prepaid),
+		PayableAmount:       amount(total - prepaid),
+	}
+
+	// Sections only group the lines on paper, they bill nothing
+	number := 0
+	for _, line := range i.InvoiceLines {
+		if line.Section() {
+			continue
+		}
+		number++
+		quantity := &ublQuantity{UnitCode: line.Unit.Code(), Value: ciiFormatQuantity(line.Quantity)}
+		documentLine := ublLine{
+			ID:                  strconv.Itoa(number),
+			LineExtensionAmount: amount(line.Total()),
+			Name:                line.Name(),
+			TaxCategory:         ublTaxCategory{ID: "O", TaxScheme: "VAT"},
+			Price:               amount(line.NetUnitPrice()),
+			Description:         line.Details(),
+		}
+		if isInvoice {
+			documentLine.InvoicedQuantity = quantity
+			document.InvoiceLines = append(document.InvoiceLines, documentLine)
+		} else {
+			documentLine.CreditedQuantity = quantity
+			document.CreditNoteLines = append(document.CreditNoteLines, documentLine)
+		}
+	}
+
+	data, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func (h *Handler) getInvoiceUBL(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := h.storeFor(r).GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	prepaid, err := h.storeFor(r).GetPaidAmount(invoice.ID)
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	data, err := invoice.UBLXML(prepaid)
+	if err != nil {
+		if errors.Is(err, ErrEInvoiceDocumentType) || errors.Is(err, ErrEInvoiceCountry) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", invoice.Repr()+".ubl.xml"))
+	w.Write(data)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Unit is what a quantity counts, e.g. hours for services billed by the
+// hour. Empty counts units.
+type Unit string
+
+const (
+	UnitPiece    Unit = "un"
+	UnitHour     Unit = "h"
+	UnitDay      Unit = "day"
+	UnitMonth    Unit = "month"
+	UnitKilogram Unit = "kg"
+	UnitMeter    Unit = "m"
+	UnitLiter    Unit = "l"
+)
+
+// unitCodes are the UN/ECE Recommendation 20 codes e-invoices give
+// quantities in
+var unitCodes = map[Unit]string{
+	"":           "C62",
+	UnitPiece:    "C62",
+	UnitHour:     "HUR",
+	UnitDay:      "DAY",
+	UnitMonth:    "MON",
+	UnitKilogram: "KGM",
+	UnitMeter:    "MTR",
+	UnitLiter:    "LTR",
+}
+
+func (u Unit) Valid() bool {
+	_, ok := unitCodes[u]
+	return ok
+}
+
+func validateUnit(unit Unit) error {
+	if !unit.Valid() {
+		return fmt.Errorf("unknown unit %q, expected un, h, day, month, kg, m or l", unit)
+	}
+	return nil
+}
+
+// Code is the UN/ECE code of the unit
+func (u Unit) Code() string {
+	return unitCodes[u]
+}
+
+// quantityDecimals is how precise quantities are, 7.5 hours or 0.125 kg
+const quantityDecimals = 3
+
+// FormatQuantity renders a quantity with its decimals, up to three, in the
+// locale separators and followed by its unit
+func (l Locale) FormatQuantity(quantity float64, unit Unit) string {
+	text := strconv.FormatFloat(quantity, 'f', quantityDecimals, 64)
+	text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	text = strings.Replace(text, ".", l.format().decimalSeparator, 1)
+	if unit != "" {
+		text += " " + string(unit)
+	}
+	return text
+}
+
+func (i *Invoice) FormatQuantity(quantity float64, unit Unit) string {
+	return i.EffectiveLocale().FormatQuantity(quantity, unit)
+}
+
+// validQuantity tells whether the quantity is positive with at most the
+// decimals quantities are stored with
+func validQuantity(quantity float64) bool {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(quantity, 'f', quantityDecimals, 64), 64)
+	return quantity > 0 && rounded == quantity
+}
+
+// captureUnits sets the unit of the product lines sent without one to the
+// unit of their product
+func captureUnits(tx *gorm.DB, invoice *Invoice) error {
+	for i := range invoice.InvoiceLines {
+		line := &invoice.InvoiceLines[i]
+		if line.Unit != "" || line.ProductID == nil {
+			continue
+		}
+
+		var units []Unit
+		if err := tx.Model(&Product{}).Where("id = ?", *line.ProductID).Pluck("unit", &units).Error; err != nil {
+			return err
+		}
+		if len(units) == 1 {
+			line.Unit = units[0]
+		}
+	}
+	return nil
+}
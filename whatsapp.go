@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// What a WhatsApp message was sent for
+const (
+	WhatsAppInvoice  = "invoice"
+	WhatsAppReminder = "reminder"
+)
+
+// The status of a WhatsApp message, as the provider reports it
+const (
+	WhatsAppQueued    = "queued"
+	WhatsAppSent      = "sent"
+	WhatsAppDelivered = "delivered"
+	WhatsAppRead      = "read"
+	WhatsAppFailed    = "failed"
+)
+
+// whatsAppStatusRanks orders the statuses, reports arriving out of order
+// don't move a message back
+var whatsAppStatusRanks = map[string]int{
+	WhatsAppQueued:    0,
+	WhatsAppSent:      1,
+	WhatsAppDelivered: 2,
+	WhatsAppRead:      3,
+}
+
+var (
+	ErrWhatsAppDisabled = errors.New("WhatsApp is not configured, set WHATSAPP_PROVIDER")
+	ErrNoWhatsApp       = errors.New("client has no phone number opted in to WhatsApp")
+)
+
+// phonePattern is the international format WhatsApp takes, e.g.
+// +5511912345678
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// normalizePhone drops the spaces and punctuation of the phone number,
+// which has to be in the international format
+func normalizePhone(phone string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" .-()", r) {
+			return -1
+		}
+		return r
+	}, phone)
+	if !phonePattern.MatchString(normalized) {
+		return "", errors.New("Phone must be in the international format, e.g. +55 11 91234-5678")
+	}
+	return normalized, nil
+}
+
+// WhatsAppMessage records a message sent to a client over WhatsApp, with
+// the status the provider last reported
+type WhatsAppMessage struct {
+	ID         uint     `gorm:"primaryKey" json:"id"`
+	CompanyID  uint     `gorm:"not null;index" json:"company_id"`
+	Company    Company  `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	InvoiceID  *uint    `gorm:"index" json:"invoice_id"`
+	Invoice    *Invoice `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Kind       string   `gorm:"size:20;not null" json:"kind"`
+	To         string   `gorm:"size:20;not null" json:"to"`
+	Body       string   `gorm:"type:text;not null" json:"body"`
+	ProviderID string   `gorm:"size:255;index" json:"provider_id"`
+	Status     string   `gorm:"size:20;not null;index" json:"status"`
+	// Error is why sending failed or the provider couldn't deliver it
+	Error     string    `gorm:"type:text" json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WhatsAppSender delivers WhatsApp messages
+type WhatsAppSender interface {
+	// Send delivers the message, params filling the template of its kind,
+	// and returns the provider's id of the message
+	Send(message *WhatsAppMessage, params []string) (string, error)
+}
+
+// whatsApp is nil while WhatsApp isn't configured
+var whatsApp WhatsAppSender = newWhatsAppSender(config.WhatsApp)
+
+// whatsAppProviders builds the WhatsAppSender of each WHATSAPP_PROVIDER
+var whatsAppProviders = map[string]func(c WhatsAppConfig) WhatsAppSender{
+	"cloud":  func(c WhatsAppConfig) WhatsAppSender { return newCloudWhatsAppSender(c) },
+	"twilio": func(c WhatsAppConfig) WhatsAppSender { return newTwilioWhatsAppSender(c) },
+}
+
+func newWhatsAppSender(c WhatsAppConfig) WhatsAppSender {
+	provider, ok := whatsAppProviders[c.Provider]
+	if !ok {
+		return nil
+	}
+	return provider(c)
+}
+
+// validate checks the settings the provider needs
+func (c WhatsAppConfig) validate() error {
+	switch c.Provider {
+	case "":
+	case "cloud":
+		if c.Token == "" || c.PhoneNumberID == "" {
+			return errors.New("the cloud WhatsApp provider needs WHATSAPP_TOKEN and WHATSAPP_PHONE_NUMBER_ID")
+		}
+	case "twilio":
+		if c.TwilioAccountSID == "" || c.TwilioAuthToken == "" {
+			return errors.New("the twilio WhatsApp provider needs TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN")
+		}
+		if _, err := normalizePhone(c.TwilioFrom); err != nil {
+			return fmt.Errorf("invalid TWILIO_WHATSAPP_FROM %q, expected the international format", c.TwilioFrom)
+		}
+	default:
+		return fmt.Errorf("invalid WhatsApp provider %q, expected cloud or twilio", c.Provider)
+	}
+	return nil
+}
+
+// CloudWhatsAppSender sends messages through the WhatsApp Business Cloud
+// API of Meta
+type CloudWhatsAppSender struct {
+	URL       string
+	Token     string
+	Templates map[string]string
+	Language  string
+	Client    *http.Client
+}
+
+func newCloudWhatsAppSender(c WhatsAppConfig) *CloudWhatsAppSender {
+	return &CloudWhatsAppSender{
+		URL:       "https://graph.facebook.com/v20.0/" + url.PathEscape(c.PhoneNumberID) + "/messages",
+		Token:     c.Token,
+		Templates: map[string]string{WhatsAppInvoice: c.InvoiceTemplate, WhatsAppReminder: c.ReminderTemplate},
+		Language:  c.TemplateLanguage,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *CloudWhatsAppSender) Send(message *WhatsAppMessage, params []string) (string, error) {
+	payload := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(message.To, "+"),
+	}
+	if template := s.Templates[message.Kind]; template != "" {
+		parameters := make([]map[string]string, len(params))
+		for i, param := range params {
+			parameters[i] = map[string]string{"type": "text", "text": param}
+		}
+		payload["type"] = "template"
+		payload["template"] = map[string]interface{}{
+			"name":       template,
+			"language":   map[string]string{"code": s.Language},
+			"components": []map[string]interface{}{{"type": "body", "parameters": parameters}},
+		}
+	} else {
+		payload["type"] = "text"
+		payload["text"] = map[string]interface{}{"body": message.Body, "preview_url": true}
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(encoded))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", providerError("WhatsApp", resp)
+	}
+	var sent struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil || len(sent.Messages) == 0 {
+		return "", errors.New("WhatsApp answered no message id")
+	}
+	return sent.Messages[0].ID, nil
+}
+
+// TwilioWhatsAppSender sends messages through the WhatsApp sender of a
+// Twilio account
+type TwilioWhatsAppSender struct {
+	URL       string
+	AccountID string
+	AuthToken string
+	From      string
+	Client    *http.Client
+}
+
+func newTwilioWhatsAppSender(c WhatsAppConfig) *TwilioWhatsAppSender {
+	from, _ := normalizePhone(c.TwilioFrom)
+	return &TwilioWhatsAppSender{
+		URL:       "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(c.TwilioAccountSID) + "/Messages.json",
+		AccountID: c.TwilioAccountSID,
+		AuthToken: c.TwilioAuthToken,
+		From:      from,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send posts the text, Twilio matches it with the approved templates
+func (s *TwilioWhatsAppSender) Send(message *WhatsAppMessage, params []string) (string, error) {
+	form := url.Values{
+		"From":           {"whatsapp:" + s.From},
+		"To":             {"whatsapp:" + message.To},
+		"Body":           {message.Body},
+		"StatusCallback": {publicURL("/webhooks/whatsapp/twilio")},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.AccountID, s.AuthToken)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", providerError("Twilio", resp)
+	}
+	var sent struct {
+		SID string `json:"sid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil || sent.SID == "" {
+		return "", errors.New("Twilio answered no message sid")
+	}
+	return sent.SID, nil
+}
+
+// invoiceWhatsAppParams are the parameters of the invoice and reminder
+// templates: the invoice number, amount, due date and link
+func invoiceWhatsAppParams(invoice *Invoice) []string {
+	return []string{
+		invoice.Identification(),
+		invoice.FormatMoney(invoice.Total()),
+		invoice.FormatDate(invoice.DueDate),
+		publicURL(shareLinkPath(invoice)),
+	}
+}
+
+// sendWhatsApp sends the message about the invoice to the client's phone
+// and records it, sent or not. A failed message is recorded after the unit
+// of work, which the failure rolls back. Nothing is sent while the
+// settings pause the client emails.
+func sendWhatsApp(store Store, client *Company, invoice *Invoice, kind, body string) (*WhatsAppMessage, error) {
+	if whatsApp == nil {
+		return nil, ErrWhatsAppDisabled
+	}
+	if currentSettings().PauseClientEmails {
+		return nil, ErrEmailsPaused
+	}
+	if client.Phone == "" || !client.WhatsAppOptIn {
+		return nil, ErrNoWhatsApp
+	}
+
+	message := &WhatsAppMessage{CompanyID: client.ID, InvoiceID: &invoice.ID, Kind: kind, To: client.Phone, Body: body, Status: WhatsAppQueued}
+	providerID, err := whatsApp.Send(message, invoiceWhatsAppParams(invoice))
+	message.ProviderID = providerID
+	if err != nil {
+		message.Status, message.Error = WhatsAppFailed, err.Error()
+		store.AfterUnitOfWork(func(store Store) {
+			if recordErr := store.RecordWhatsAppMessage(message); recordErr != nil {
+				log.Printf("Error recording the WhatsApp message to %s: %v", message.To, recordErr)
+			}
+		})
+		return message, err
+	}
+	if err := store.RecordWhatsAppMessage(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (r *Repository) RecordWhatsAppMessage(message *WhatsAppMessage) error {
+	return retryOnBusy(func() error {
+		return r.db.Omit("Company", "Invoice").Create(message).Error
+	})
+}
+
+func (r *Repository) GetInvoiceWhatsAppMessages(invoiceID uint) ([]WhatsAppMessage, error) {
+	messages := []WhatsAppMessage{}
+	err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at, id").Find(&messages).Error
+	return messages, err
+}
+
+// UpdateWhatsAppStatus records the status the provider reported for the
+// message. Failures always stand, other statuses only move forward.
+// Messages sent by someone else are ignored.
+func (r *Repository) UpdateWhatsAppStatus(providerID, status, reason string) error {
+	return retryOnBusy(func() error {
+		return r.db.Transaction(func(tx *gorm.DB) error {
+			var message WhatsAppMessage
+			err := tx.Where("provider_id = ?", providerID).First(&message).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if message.Status == WhatsAppFailed ||
+				(status != WhatsAppFailed && whatsAppStatusRanks[status] <= whatsAppStatusRanks[message.Status]) {
+				return nil
+			}
+			return tx.Model(&message).Updates(map[string]interface{}{"status": status, "error": reason}).Error
+		})
+	})
+}
+
+// WhatsAppStatus is a status report of a provider
+type WhatsAppStatus struct {
+	ProviderID string
+	Status     string
+	Reason     string
+}
+
+// parseCloudStatuses reads the statuses of a Cloud API webhook, signed
+// with the app secret
+func parseCloudStatuses(r *http.Request, body []byte) ([]WhatsAppStatus, error) {
+	mac := hmac.New(sha256.New, []byte(config.WhatsApp.AppSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if config.WhatsApp.AppSecret == "" || !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(expected)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var notification struct {
+		Entry []struct {
+			Changes []struct {
+				Value struct {
+					Statuses []struct {
+						ID     string `json:"id"`
+						Status string `json:"status"`
+						Errors []struct {
+							Title string `json:"title"`
+						} `json:"errors"`
+					} `json:"statuses"`
+				} `json:"value"`
+			} `json:"changes"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid WhatsApp notification: %v", err)
+	}
+	statuses := []WhatsAppStatus{}
+	for _, entry := range notification.Entry {
+		for _, change := range entry.Changes {
+			for _, status := range change.Value.Statuses {
+				reported := WhatsAppStatus{ProviderID: status.ID, Status: status.Status}
+				if len(status.Errors) > 0 {
+					reported.Reason = status.Errors[0].Title
+				}
+				statuses = append(statuses, reported)
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// parseTwilioStatus reads the status callback of Twilio, signed with the
+// auth token over the URL and the parameters sorted
+func parseTwilioStatus(r *http.Request, body []byte) ([]WhatsAppStatus, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	signed := publicURL(r.URL.RequestURI())
+	for _, key := range keys {
+		signed += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(config.WhatsApp.TwilioAuthToken))
+	mac.Write([]byte(signed))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if config.WhatsApp.TwilioAuthToken == "" || !hmac.Equal([]byte(r.Header.Get("X-Twilio-Signature")), []byte(expected)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	status := WhatsAppStatus{ProviderID: form.Get("MessageSid"), Status: form.Get("MessageStatus")}
+	switch status.Status {
+	case "undelivered", "failed":
+		status.Status = WhatsAppFailed
+		status.Reason = "error " + form.Get("ErrorCode")
+	case "accepted", "sending":
+		status.Status = WhatsAppQueued
+	}
+	return []WhatsAppStatus{status}, nil
+}
+
+// whatsAppStatusParsers read the status webhooks of each provider,
+// checking they come from it
+var whatsAppStatusParsers = map[string]func(r *http.Request, body []byte) ([]WhatsAppStatus, error){
+	"cloud":  parseCloudStatuses,
+	"twilio": parseTwilioStatus,
+}
+
+// WhatsApp handlers
+func (h *Handler) getInvoiceWhatsAppMessages(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.storeFor(r).GetInvoiceWhatsAppMessages(uint(invoiceId))
+	if err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// sendInvoiceWhatsApp sends the link of the invoice to the client
+func (h *Handler) sendInvoiceWhatsApp(w http.ResponseWriter, r *http.Request) {
+	invoiceIdStr := r.PathValue("invoiceId")
+	invoiceId, err := strconv.ParseUint(invoiceIdStr, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	store := h.storeFor(r)
+	invoice, err := store.GetInvoice(uint(invoiceId))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if invoice.Draft() {
+		http.Error(w, "Send the invoice before sharing it over WhatsApp", http.StatusConflict)
+		return
+	}
+
+	params := invoiceWhatsAppParams(invoice)
+	body := fmt.Sprintf("Hello, here is invoice %s of %s, due on %s: %s", params[0], params[1], params[2], params[3])
+	message, err := sendWhatsApp(store, &invoice.Client, invoice, WhatsAppInvoice, body)
+	switch {
+	case errors.Is(err, ErrWhatsAppDisabled), errors.Is(err, ErrNoWhatsApp):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, ErrEmailsPaused):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case message == nil:
+		writeDatabaseError(w, r, err)
+		return
+	case err != nil:
+		log.Printf("Error sending invoice %d over WhatsApp: %v", invoice.ID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if err := store.RecordInvoiceEvent(invoice.ID, "whatsapp_sent", "Invoice link sent over WhatsApp to "+message.To); err != nil {
+		writeDatabaseError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(message)
+}
+
+// verifyWhatsAppWebhook answers the challenge of the Cloud API when the
+// status webhook is subscribed
+func (h *Handler) verifyWhatsAppWebhook(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	token := query.Get("hub.verify_token")
+	if config.WhatsApp.VerifyToken == "" || query.Get("hub.mode") != "subscribe" ||
+		!hmac.Equal([]byte(token), []byte(config.WhatsApp.VerifyToken)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Write([]byte(query.Get("hub.challenge")))
+}
+
+// receiveWhatsAppStatus records the delivery statuses a provider reports
+func (h *Handler) receiveWhatsAppStatus(w http.ResponseWriter, r *http.Request) {
+	provider := r.PathValue("provider")
+	parse, ok := whatsAppStatusParsers[provider]
+	if !ok || provider != config.WhatsApp.Provider {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statuses, err := parse(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	for _, status := range statuses {
+		if status.ProviderID == "" {
+			continue
+		}
+		if _, ok := whatsAppStatusRanks[status.Status]; !ok && status.Status != WhatsAppFailed {
+			continue
+		}
+		if err := h.storeFor(r).UpdateWhatsAppStatus(status.ProviderID, status.Status, status.Reason); err != nil {
+			writeDatabaseError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"strings"
+)
+
+// moneySpeller writes amounts out in words in a language, as formal
+// documents ask for next to the figures
+type moneySpeller struct {
+	integer func(n int64) string
+	// currency and cents name the units that follow n, e.g. "reais"
+	currency func(n int64) string
+	cents    func(n int64) string
+	and      string
+	minus    string
+}
+
+var moneySpellers = map[Locale]moneySpeller{
+	LocalePtBR: {
+		integer: ptBRNumberInWords,
+		currency: func(n int64) string {
+			switch {
+			case n == 1:
+				return "real"
+			case n > 0 && n%1000000 == 0:
+				return "de reais"
+			default:
+				return "reais"
+			}
+		},
+		cents: pluralWord("centavo", "centavos"),
+		and:   " e ",
+		minus: "menos ",
+	},
+	LocaleEn: {
+		integer:  enNumberInWords,
+		currency: pluralWord("dollar", "dollars"),
+		cents:    pluralWord("cent", "cents"),
+		and:      " and ",
+		minus:    "minus ",
+	},
+}
+
+func pluralWord(singular, plural string) func(n int64) string {
+	return func(n int64) string {
+		if n == 1 {
+			return singular
+		}
+		return plural
+	}
+}
+
+// MoneyInWords writes the amount out in words in the locale currency, e.g.
+// "mil duzentos e trinta e quatro reais e cinquenta e seis centavos". It is
+// empty for the locales that can't be spelled yet.
+func (l Locale) MoneyInWords(amount Money) string {
+	speller, ok := moneySpellers[l]
+	if !ok {
+		return ""
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = speller.minus
+		amount = -amount
+	}
+	cents := int64(amount)
+	integer, fraction := cents/100, cents%100
+
+	var parts []string
+	if integer > 0 || fraction == 0 {
+		parts = append(parts, speller.integer(integer)+" "+speller.currency(integer))
+	}
+	if fraction > 0 {
+		parts = append(parts, speller.integer(fraction)+" "+speller.cents(fraction))
+	}
+	return sign + strings.Join(parts, speller.and)
+}
+
+// MoneyInWords writes the amount out in words in the invoice locale
+func (i *Invoice) MoneyInWords(amount Money) string {
+	return i.EffectiveLocale().MoneyInWords(amount)
+}
+
+// TotalInWords writes the invoice total out in words, for use in templates
+func (i *Invoice) TotalInWords() string {
+	return i.MoneyInWords(i.Total())
+}
+
+// splitThousands splits n in groups of three digits, the lowest first
+func splitThousands(n int64) []int64 {
+	var groups []int64
+	for n > 0 {
+		groups = append(groups, n%1000)
+		n /= 1000
+	}
+	return groups
+}
+
+var (
+	ptBRUnits = []string{"zero", "um", "dois", "três", "quatro", "cinco", "seis", "sete", "oito", "nove",
+		"dez", "onze", "doze", "treze", "quatorze", "quinze", "dezesseis", "dezessete", "dezoito", "dezenove"}
+	ptBRTens     = []string{"", "", "vinte", "trinta", "quarenta", "cinquenta", "sessenta", "setenta", "oitenta", "noventa"}
+	ptBRHundreds = []string{"", "cento", "duzentos", "trezentos", "quatrocentos", "quinhentos", "seiscentos", "setecentos", "oitocentos", "novecentos"}
+	ptBRScales   = [][2]string{{"", ""}, {"mil", "mil"}, {"milhão", "milhões"}, {"bilhão", "bilhões"}, {"trilhão", "trilhões"}, {"quatrilhão", "quatrilhões"}, {"quintilhão", "quintilhões"}}
+)
+
+// ptBRHundredsInWords writes 1 to 999 in Portuguese
+func ptBRHundredsInWords(n int64) string {
+	if n == 100 {
+		return "cem"
+	}
+	var words []string
+	if n >= 100 {
+		words = append(words, ptBRHundreds[n/100])
+		n %= 100
+	}
+	if n >= 20 {
+		words = append(words, ptBRTens[n/10])
+		n %= 10
+	}
+	if n > 0 {
+		words = append(words, ptBRUnits[n])
+	}
+	return strings.Join(words, " e ")
+}
+
+// ptBRNumberInWords writes n out in Brazilian Portuguese. Groups are joined
+// with "e" only before the last one when it is under a hundred or of whole
+// hundreds, as in "mil e duzentos" and "mil duzentos e trinta".
+func ptBRNumberInWords(n int64) string {
+	if n == 0 {
+		return ptBRUnits[0]
+	}
+
+	groups := splitThousands(n)
+	last := 0
+	for groups[last] == 0 {
+		last++
+	}
+
+	var words []string
+	for scale := len(groups) - 1; scale >= 0; scale-- {
+		group := groups[scale]
+		if group == 0 {
+			continue
+		}
+
+		var word string
+		switch {
+		case scale == 0:
+			word = ptBRHundredsInWords(group)
+		case scale == 1 && group == 1:
+			word = "mil"
+		case group == 1:
+			word = "um " + ptBRScales[scale][0]
+		default:
+			word = ptBRHundredsInWords(group) + " " + ptBRScales[scale][1]
+		}
+
+		if len(words) > 0 && scale == last && (group < 100 || group%100 == 0) {
+			words = append(words, "e")
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+var (
+	enUnits = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine",
+		"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	enTens   = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	enScales = []string{"", "thousand", "million", "billion", "trillion", "quadrillion", "quintillion"}
+)
+
+// enHundredsInWords writes 1 to 999 in English
+func enHundredsInWords(n int64) string {
+	var words []string
+	if n >= 100 {
+		words = append(words, enUnits[n/100], "hundred")
+		n %= 100
+	}
+	switch {
+	case n >= 20 && n%10 != 0:
+		words = append(words, enTens[n/10]+"-"+enUnits[n%10])
+	case n >= 20:
+		words = append(words, enTens[n/10])
+	case n > 0:
+		words = append(words, enUnits[n])
+	}
+	return strings.Join(words, " ")
+}
+
+// enNumberInWords writes n out in English, e.g. "one thousand two hundred
+// thirty-four"
+func enNumberInWords(n int64) string {
+	if n == 0 {
+		return enUnits[0]
+	}
+
+	groups := splitThousands(n)
+	var words []string
+	for scale := len(groups) - 1; scale >= 0; scale-- {
+		if groups[scale] == 0 {
+			continue
+		}
+		words = append(words, enHundredsInWords(groups[scale]))
+		if scale > 0 {
+			words = append(words, enScales[scale])
+		}
+	}
+	return strings.Join(words, " ")
+}